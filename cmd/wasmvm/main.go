@@ -2,109 +2,81 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
-	"sync"
+	"strings"
 
 	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
 )
 
-type ExecutionContext struct {
-	Id      int
-	Title   string
-	Want    any // Test support intentionally leaked
-	WantT   wasmvm.ValueStackEntryType
-	Program []byte
-}
+// Process exit codes, besides the status a guest exits with
+const (
+	ExitFailure = 1   // Bad module or config, or the instance couldn't be set up
+	ExitUsage   = 2   // Bad command line
+	ExitTimeout = 124 // Same as timeout(1)
+	ExitTrap    = 134 // Same as a process killed by SIGABRT
+)
 
-var executions = []ExecutionContext{
-	{
-		Id:    0,
-		Title: "2 + 3 = 5",
-		Program: []byte{
-			wasmvm.OP_CONST_I32, 2, 0, 0, 0,
-			wasmvm.OP_CONST_I32, 3, 0, 0, 0,
-			wasmvm.OP_ADD_I32,
-			wasmvm.OP_END,
-		},
-	},
-	{
-		Id:    1,
-		Title: "NOP, 5 * 8 = 40",
-		Program: []byte{
-			wasmvm.OP_NOP,
-			wasmvm.OP_CONST_I32, 5, 0, 0, 0,
-			wasmvm.OP_CONST_I32, 8, 0, 0, 0,
-			wasmvm.OP_MUL_I32,
-			wasmvm.OP_END,
-		},
-	},
-	{
-		Id:    1,
-		Title: "NOP, 5 - 8 = -3, NOP",
-		Program: []byte{
-			wasmvm.OP_NOP,
-			wasmvm.OP_CONST_I64, 5, 0, 0, 0, 0, 0, 0, 0,
-			wasmvm.OP_CONST_I64, 8, 0, 0, 0, 0, 0, 0, 0,
-			wasmvm.OP_SUB_I64,
-			wasmvm.OP_END,
-		},
-	},
-}
+const usage = `usage:
+  wasmvm run [flags] <module> [args...]   run the entry point of a module
+  wasmvm inspect <module>                 list the sections and code of a module
 
-// SetupAndRunVM initializes a WASM VM with the given ExecutionContext, loads
-// its program into memory, and executes it. Returns the final VM state
-// and any error encountered during setup or execution.
-func SetupAndRunVM(context *ExecutionContext) (*wasmvm.VMState, error) {
-	fmt.Printf("Starting %d with title of %s", context.Id, context.Title)
-	size := uint64(len(context.Program))
-	cfg := &wasmvm.VMConfig{
-		Image: &wasmvm.ImageConfig{
-			Type:  wasmvm.Array,
-			Size:  size,
-			Array: context.Program,
-		},
-		Size:   size,
-		Rings:  map[uint8]wasmvm.RingConfig{},
-		Stdin:  nil,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+Modules are binaries, or text format when the name ends in .wat.
+Run "wasmvm run -h" for the flags of run.
+`
+
+// Main runs the command line in args, without the program name, and
+// returns the exit code for the process
+func Main(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return ExitUsage
+	}
+	switch args[0] {
+	case "run":
+		return Run(args[1:], stdin, stdout, stderr)
+	case "inspect":
+		if len(args) != 2 {
+			fmt.Fprint(stderr, usage)
+			return ExitUsage
+		}
+		if err := Inspect(args[1], stdout); err != nil {
+			fmt.Fprintf(stderr, "wasmvm: %v\n", err)
+			return ExitFailure
+		}
+		return 0
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
 	}
+	fmt.Fprintf(stderr, "wasmvm: unknown command %q\n%s", args[0], usage)
+	return ExitUsage
+}
 
-	vm, err := wasmvm.NewVM(cfg)
+// Reads a module file, assembling it first when it's in the text format
+func loadModule(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize vm: %v", err)
+		return nil, err
 	}
-
-	// Set PC to 0
-	vm.PC = 0
-	vm.MainLoop()
-	if vm.TrapErr != nil {
-		fmt.Printf("(%d) Trap after execution: %v\n", context.Id, vm.TrapErr)
+	if strings.HasSuffix(path, ".wat") {
+		return wasmvm.AssembleWAT(string(data))
 	}
-	fmt.Printf("(%d) Memory after execution: %+v\n", context.Id, vm.Memory)
-	fmt.Printf("(%d) Stack after execution: %#v\n", context.Id, vm.ValueStack)
-
-	return vm, nil
+	return data, nil
 }
 
-// wrapGoRoutine runs SetupAndRunVM in a goroutine for the provided context,
-// and calls wg.Done() when finished. Intended for use with sync.WaitGroup
-// to coordinate concurrent VM execution.
-// This method is not part of the test suite
-func wrapGoRoutine(context *ExecutionContext, wg *sync.WaitGroup) {
-	defer wg.Done()
-	SetupAndRunVM(context)
+// Inspect writes the sections and a disassembly of the module in the
+// file at path
+func Inspect(path string, w io.Writer) error {
+	data, err := loadModule(path)
+	if err != nil {
+		return err
+	}
+	return wasmvm.InspectModule(w, data)
 }
 
-// main is the entry point for this program. It defines a set of VM execution
-// contexts, then runs each in parallel goroutines, waiting for all to finish.
+// main is the entry point for this program.
 // This method is not part of the test suite
 func main() {
-	var wg sync.WaitGroup
-	for i := range executions {
-		context := &executions[i]
-		wg.Add(1)
-		go wrapGoRoutine(context, &wg)
-	}
-	wg.Wait()
+	os.Exit(Main(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
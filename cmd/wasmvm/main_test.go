@@ -1,114 +1,201 @@
 package main_test
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
-	cmdwasmvm "github.com/redmasq/rmq-wasm-vm/cmd/wasmvm"
-	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	wasmvm "github.com/redmasq/rmq-wasm-vm/cmd/wasmvm"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-// TestSetupAndRunVM uses a test table to do various combinations of executions
-// and then verifies the stack
-func TestSetupAndRunVM(t *testing.T) {
-	tests := []cmdwasmvm.ExecutionContext{
-		{
-			Id:    0,
-			Title: "2 + 3 = 5",
-			Want:  uint32(5),
-			WantT: wasmvm.TYPE_I32,
-			Program: []byte{
-				wasmvm.OP_CONST_I32, 2, 0, 0, 0,
-				wasmvm.OP_CONST_I32, 3, 0, 0, 0,
-				wasmvm.OP_ADD_I32,
-				wasmvm.OP_END,
-			},
-		},
-		{
-			Id:    1,
-			Title: "NOP, 5 * 8 = 40",
-			Want:  uint32(40),
-			WantT: wasmvm.TYPE_I32,
-			Program: []byte{
-				wasmvm.OP_NOP,
-				wasmvm.OP_CONST_I32, 5, 0, 0, 0,
-				wasmvm.OP_CONST_I32, 8, 0, 0, 0,
-				wasmvm.OP_MUL_I32,
-				wasmvm.OP_END,
-			},
-		},
-		{
-			Id:    1,
-			Title: "NOP, 8 - 5 = 3, NOP",
-			Want:  uint64(3),
-			WantT: wasmvm.TYPE_I64,
-			Program: []byte{
-				wasmvm.OP_NOP,
-				wasmvm.OP_CONST_I64, 8, 0, 0, 0, 0, 0, 0, 0,
-				wasmvm.OP_CONST_I64, 5, 0, 0, 0, 0, 0, 0, 0,
-				wasmvm.OP_SUB_I64,
-				wasmvm.OP_END,
-			},
-		},
-		{
-			Id:    2,
-			Title: "NOP, 9 - 4 = 5, NOP",
-			Want:  uint64(5),
-			WantT: wasmvm.TYPE_I64,
-			Program: []byte{
-				wasmvm.OP_NOP,
-				wasmvm.OP_CONST_I64, 9, 0, 0, 0, 0, 0, 0, 0,
-				wasmvm.OP_CONST_I64, 4, 0, 0, 0, 0, 0, 0, 0,
-				wasmvm.OP_SUB_I64,
-				wasmvm.OP_END,
-			},
-		},
-		{
-			Id:    3,
-			Title: "NOP, 1 - 2 = -1, NOP (i32)",
-			Want:  ^uint32(0),
-			WantT: wasmvm.TYPE_I32,
-			Program: []byte{
-				wasmvm.OP_NOP,
-				wasmvm.OP_CONST_I32, 1, 0, 0, 0,
-				wasmvm.OP_CONST_I32, 2, 0, 0, 0,
-				wasmvm.OP_SUB_I32,
-				wasmvm.OP_END,
-			},
-		},
-		{
-			Id:    4,
-			Title: "NOP, 1 - 2 = -1, NOP (i64)",
-			Want:  ^uint64(0),
-			WantT: wasmvm.TYPE_I64,
-			Program: []byte{
-				wasmvm.OP_NOP,
-				wasmvm.OP_CONST_I64, 1, 0, 0, 0, 0, 0, 0, 0,
-				wasmvm.OP_CONST_I64, 2, 0, 0, 0, 0, 0, 0, 0,
-				wasmvm.OP_SUB_I64,
-				wasmvm.OP_END,
-			},
-		},
-	}
+// Exits with 10 times the argument count plus the variable count
+const countsWAT = `
+(module
+  (import "wasi_snapshot_preview1" "args_sizes_get" (func $args (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "environ_sizes_get" (func $env (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+  (memory 1)
+  (func (export "_start")
+    (drop (call $args (i32.const 0) (i32.const 4)))
+    (drop (call $env (i32.const 8) (i32.const 12)))
+    (call $exit (i32.add
+      (i32.mul (i32.load (i32.const 0)) (i32.const 10))
+      (i32.load (i32.const 8))))))
+`
+
+// Writes the name of the first preopen to stdout
+const preopenWAT = `
+(module
+  (import "wasi_snapshot_preview1" "fd_prestat_dir_name" (func $name (param i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $write (param i32 i32 i32 i32) (result i32)))
+  (memory 1)
+  (data (i32.const 100) "\00\00\00\00\05\00\00\00")
+  (func (export "_start")
+    (drop (call $name (i32.const 3) (i32.const 0) (i32.const 5)))
+    (drop (call $write (i32.const 1) (i32.const 100) (i32.const 1) (i32.const 200)))))
+`
+
+const trapWAT = `
+(module
+  (memory 1)
+  (func (export "_start") nop unreachable)
+  (func (export "spin") loop br 0 end)
+  (func (export "add") (param i32) (result i32) local.get 0))
+`
+
+func writeModule(t *testing.T, name, src string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(src), 0o644))
+	return path
+}
+
+func runMain(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := wasmvm.Main(args, strings.NewReader(""), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestMain_Usage(t *testing.T) {
+	code, _, stderr := runMain()
+	assert.Equal(t, wasmvm.ExitUsage, code)
+	assert.Contains(t, stderr, "usage:")
+
+	code, _, stderr = runMain("frobnicate")
+	assert.Equal(t, wasmvm.ExitUsage, code)
+	assert.Contains(t, stderr, `unknown command "frobnicate"`)
+
+	code, _, _ = runMain("run")
+	assert.Equal(t, wasmvm.ExitUsage, code)
+	code, _, _ = runMain("run", "-bogus", "x.wasm")
+	assert.Equal(t, wasmvm.ExitUsage, code)
+	code, _, stderr = runMain("run", "-max-memory", "lots", "x.wasm")
+	assert.Equal(t, wasmvm.ExitUsage, code)
+	assert.Contains(t, stderr, `invalid size "lots"`)
+	code, stdout, _ := runMain("help")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "wasmvm run")
+}
+
+func TestRun_ArgsAndEnv(t *testing.T) {
+	path := writeModule(t, "counts.wat", countsWAT)
+	t.Setenv("WASMVM_TEST_PASS", "1")
+	code, _, stderr := runMain("run", "-env", "A=1", "-env", "WASMVM_TEST_PASS", "-env", "WASMVM_TEST_UNSET", path, "x", "y")
+	assert.Equal(t, 32, code, stderr)
+	code, _, _ = runMain("run", path)
+	assert.Equal(t, 10, code)
+}
+
+func TestRun_Preopen(t *testing.T) {
+	path := writeModule(t, "preopen.wat", preopenWAT)
+	code, stdout, stderr := runMain("run", "-dir", t.TempDir()+":/data", path)
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, "/data", stdout)
+
+	code, _, stderr = runMain("run", "-dir", filepath.Join(t.TempDir(), "missing"), path)
+	assert.Equal(t, wasmvm.ExitFailure, code)
+	assert.NotEmpty(t, stderr)
+}
 
+func TestRun_Traps(t *testing.T) {
+	path := writeModule(t, "trap.wat", trapWAT)
+	code, _, stderr := runMain("run", path)
+	assert.Equal(t, wasmvm.ExitTrap, code)
+	assert.Contains(t, stderr, "[TrapUnreachable]")
+	assert.Contains(t, stderr, "in function 0 at 0x")
+	assert.Contains(t, stderr, ": unreachable\n")
+
+	code, _, stderr = runMain("run", "-entry", "spin", "-fuel", "100", path)
+	assert.Equal(t, wasmvm.ExitTrap, code)
+	assert.Contains(t, stderr, "out of fuel")
+	assert.Contains(t, stderr, "in function 1 at 0x")
+
+	code, _, stderr = runMain("run", "-entry", "spin", "-timeout", "20ms", path)
+	assert.Equal(t, wasmvm.ExitTimeout, code)
+	assert.Contains(t, stderr, "[TrapInterrupted]")
+
+	// The timeout covers the start function too
+	path = writeModule(t, "start.wat", `(module (func $spin loop br 0 end) (start $spin) (func (export "_start")))`)
+	code, _, stderr = runMain("run", "-timeout", "20ms", path)
+	assert.Equal(t, wasmvm.ExitTimeout, code)
+	assert.Contains(t, stderr, "[InstanceStartFailed]")
+}
+
+func TestRun_Failures(t *testing.T) {
+	path := writeModule(t, "trap.wat", trapWAT)
+	tests := []struct {
+		name   string
+		args   []string
+		expect string
+	}{
+		{name: "missing file", args: []string{filepath.Join(t.TempDir(), "none.wasm")}, expect: "no such file"},
+		{name: "bad module", args: []string{writeModule(t, "bad.wasm", "nope")}, expect: "[ModuleBadMagic]"},
+		{name: "bad text", args: []string{writeModule(t, "bad.wat", "(module")}, expect: "wasmvm:"},
+		{name: "max memory", args: []string{"-max-memory", "32KiB", path}, expect: "[InstanceMemoryLimit]"},
+		{name: "missing entry", args: []string{"-entry", "nothing", path}, expect: "[InstanceMissingEntryPoint]"},
+		{name: "entry signature", args: []string{"-entry", "add", path}, expect: "[InstanceSignatureMismatch]"},
+		{name: "no entry", args: []string{writeModule(t, "lib.wat", "(module)")}, expect: "no entry point"},
+		{name: "unresolved import", args: []string{writeModule(t, "imp.wat", `(module (import "env" "f" (func)))`)}, expect: "[InstanceLinkFailed]"},
+	}
 	for _, tc := range tests {
-		t.Run(tc.Title, func(t *testing.T) {
-			vm, err := cmdwasmvm.SetupAndRunVM(&tc)
-			assert.NoError(t, err, "setupAndRunVM failed: %v", err)
-
-			assert.Equal(t, 1, vm.ValueStack.Size(), "Incorrect number of entries in stack")
-			success, collect := vm.ValueStack.HasAtLeastOfType(1, tc.WantT)
-			assert.True(t, success, "There should be at least one entry of the required type %s", tc.WantT.String())
-			assert.Equal(t, len(collect), 1, "Wrong size for the stack")
-			switch tc.WantT {
-			case wasmvm.TYPE_I32:
-				assert.Equal(t, tc.Want, collect[0].Value_I32)
-			case wasmvm.TYPE_I64:
-				assert.Equal(t, tc.Want, collect[0].Value_I64)
-			default:
-				assert.Fail(t, "Unexpected test type %s", tc.WantT)
-			}
+		t.Run(tc.name, func(t *testing.T) {
+			code, _, stderr := runMain(append([]string{"run"}, tc.args...)...)
+			assert.Equal(t, wasmvm.ExitFailure, code)
+			assert.Contains(t, stderr, tc.expect)
 		})
 	}
 }
+
+func TestRun_StartTrap(t *testing.T) {
+	path := writeModule(t, "start.wat", `(module (func $s unreachable) (start $s))`)
+	code, _, stderr := runMain("run", path)
+	assert.Equal(t, wasmvm.ExitTrap, code)
+	assert.Contains(t, stderr, "[InstanceStartFailed]")
+}
+
+func TestRun_Config(t *testing.T) {
+	path := writeModule(t, "trap.wat", trapWAT)
+	config := writeModule(t, "vm.json", `{"EntryPoint": "spin", "Fuel": 50}`)
+	code, _, stderr := runMain("run", "-config", config, path)
+	assert.Equal(t, wasmvm.ExitTrap, code)
+	assert.Contains(t, stderr, "out of fuel")
+
+	// Flags win over the file
+	code, _, stderr = runMain("run", "-config", config, "-entry", "_start", path)
+	assert.Equal(t, wasmvm.ExitTrap, code)
+	assert.Contains(t, stderr, "[TrapUnreachable]")
+
+	code, _, stderr = runMain("run", "-config", writeModule(t, "bad.json", `{"Fuell": 50}`), path)
+	assert.Equal(t, wasmvm.ExitFailure, code)
+	assert.Contains(t, stderr, "[ConfigUnknownField] Fuell: unknown field")
+
+	// Environment from the file and the flags, output to a file next to it
+	dir := t.TempDir()
+	config = filepath.Join(dir, "vm.yaml")
+	require.NoError(t, os.WriteFile(config, []byte("stdout: out.txt\nwasi:\n  env: [A=1, B=2]\n"), 0o644))
+	code, _, stderr = runMain("run", "-config", config, "-env", "C=3", writeModule(t, "counts.wat", countsWAT), "x")
+	assert.Equal(t, 23, code, stderr)
+	code, _, _ = runMain("run", "-config", config, "-dir", dir+":/work", writeModule(t, "preopen.wat", preopenWAT))
+	assert.Equal(t, 0, code)
+	out, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "/work", string(out))
+}
+
+func TestInspect(t *testing.T) {
+	path := writeModule(t, "trap.wat", trapWAT)
+	code, stdout, _ := runMain("inspect", path)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, ";; code")
+	assert.Contains(t, stdout, `(func 1 (type 0)  ;; export "spin"`)
+
+	code, _, _ = runMain("inspect")
+	assert.Equal(t, wasmvm.ExitUsage, code)
+	code, _, stderr := runMain("inspect", writeModule(t, "bad.wasm", "nope"))
+	assert.Equal(t, wasmvm.ExitFailure, code)
+	assert.Contains(t, stderr, "[ModuleBadMagic]")
+}
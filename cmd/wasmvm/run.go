@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+)
+
+// Collects a flag that can be given more than once
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// Run is the run command: it instantiates the module with WASI, calls
+// its entry point and returns the exit code for the process
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("wasmvm run", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: wasmvm run [flags] <module> [args...]")
+		fs.PrintDefaults()
+	}
+	var dirs, env listFlag
+	configPath := fs.String("config", "", "JSON or YAML config `file`, the other flags override it")
+	maxMemory := fs.String("max-memory", "", "`size` the memory may grow to, such as 64MiB")
+	fuel := fs.Uint64("fuel", 0, "instructions to execute before trapping, 0 for no limit")
+	timeout := fs.Duration("timeout", 0, "wall clock time before interrupting the guest, 0 for no limit")
+	entry := fs.String("entry", "", "`export` to call instead of _start or _initialize")
+	fs.Var(&dirs, "dir", "preopen host directory as `host[:guest]`, can be repeated")
+	fs.Var(&env, "env", "set `KEY=value` for the guest, or pass KEY through from the host, can be repeated")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return ExitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return ExitUsage
+	}
+	fail := func(err error) int {
+		fmt.Fprintf(stderr, "wasmvm: %v\n", err)
+		return ExitFailure
+	}
+
+	lc := &wasmvm.LoadedConfig{VM: &wasmvm.VMConfig{}}
+	if *configPath != "" {
+		var err error
+		lc, err = wasmvm.LoadConfigFile(*configPath, &wasmvm.ConfigOptions{Stdin: stdin, Stdout: stdout, Stderr: stderr})
+		if err != nil {
+			return fail(err)
+		}
+		defer lc.Close()
+	}
+	cfg := lc.VM
+	if *maxMemory != "" {
+		size, err := wasmvm.ParseSize(*maxMemory)
+		if err != nil {
+			fmt.Fprintf(stderr, "wasmvm: -max-memory: %v\n", err)
+			return ExitUsage
+		}
+		cfg.SetMaxMemory(size)
+	}
+	if *fuel > 0 {
+		cfg.SetFuel(*fuel)
+	}
+	if *entry != "" {
+		cfg.SetEntryPoint(*entry)
+	}
+	// The config file may have redirected these
+	if cfg.Stdin == nil {
+		cfg.SetStdin(stdin)
+	}
+	if cfg.Stdout == nil {
+		cfg.SetStdout(stdout)
+	}
+	if cfg.Stderr == nil {
+		cfg.SetStderr(stderr)
+	}
+
+	path := fs.Arg(0)
+	if lc.WASI == nil {
+		lc.WASI = &wasmvm.WASIConfig{}
+	}
+	wc := lc.WASI
+	wc.SetArgs(fs.Args()...)
+	for _, kv := range env {
+		if !strings.Contains(kv, "=") {
+			v, ok := os.LookupEnv(kv)
+			if !ok {
+				continue
+			}
+			kv += "=" + v
+		}
+		wc.Env = append(wc.Env, kv)
+	}
+	for _, d := range dirs {
+		host, guest := d, d
+		if i := strings.LastIndex(d, ":"); i > 0 {
+			host, guest = d[:i], d[i+1:]
+		}
+		dir, err := wasmvm.NewDirFS(host)
+		if err != nil {
+			return fail(err)
+		}
+		defer dir.Close()
+		wc.AddPreopen(guest, dir)
+	}
+
+	data, err := loadModule(path)
+	if err != nil {
+		return fail(err)
+	}
+	m, err := wasmvm.DecodeModule(data)
+	if err != nil {
+		return fail(err)
+	}
+	l, err := lc.Linker()
+	if err != nil {
+		return fail(err)
+	}
+	// The timeout covers the start function as well
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	inst, err := wasmvm.InstantiateContext(ctx, m, l, cfg)
+	if err != nil {
+		return exitStatus(err, nil, stderr)
+	}
+	if inst.EntryPoint() == "" {
+		return fail(errors.New("the module has no entry point, use -entry"))
+	}
+	return exitStatus(inst.Run(ctx), inst, stderr)
+}
+
+// Maps the outcome of running the guest to an exit code, reporting
+// anything but a clean exit on stderr. inst is nil when the trap came
+// from the start function.
+func exitStatus(err error, inst *wasmvm.Instance, stderr io.Writer) int {
+	if err == nil {
+		return 0
+	}
+	if code, ok := wasmvm.ExitCode(err); ok {
+		return int(code)
+	}
+	fmt.Fprintf(stderr, "wasmvm: %v\n", err)
+	var te *wasmvm.TrapError
+	if !errors.As(err, &te) {
+		return ExitFailure
+	}
+	if inst != nil {
+		if where := trapLocation(inst, te.PC); where != "" {
+			fmt.Fprintf(stderr, "wasmvm: %s\n", where)
+		}
+	}
+	if te.Type == wasmvm.TrapInterrupted && errors.Is(err, context.DeadlineExceeded) {
+		return ExitTimeout
+	}
+	return ExitTrap
+}
+
+// Names the function and instruction a trap happened at
+func trapLocation(inst *wasmvm.Instance, pc uint64) string {
+	idx, offset, ok := inst.Locate(pc)
+	if !ok {
+		return ""
+	}
+	where := fmt.Sprintf("in function %d at 0x%06x", idx, offset)
+	code, _ := inst.Module.Disassemble(idx)
+	for _, in := range code {
+		if in.Offset == offset {
+			return where + ": " + in.Text
+		}
+	}
+	return where
+}
@@ -0,0 +1,718 @@
+package wasmvm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// Checkpoints are a magic number and version followed by tagged
+// sections, each one a tag octet, a little endian uint64 length and
+// the payload. Sections that don't apply to the VM (no trap, no host
+// hooks) are left out, which leaves room for new ones as more state
+// is added to the VM.
+var checkpointMagic = [4]byte{'R', 'W', 'V', 'S'}
+
+const CheckpointVersion uint16 = 1
+
+const (
+	checkpointSectionMemory byte = iota + 1
+	checkpointSectionThread
+	checkpointSectionTrap
+	checkpointSectionHost
+	checkpointSectionGlobals
+	checkpointSectionTables
+	checkpointSectionSegments
+	checkpointSectionEnd = 0xFF
+)
+
+// Lets host functions keep their own state in a checkpoint. Hooks are
+// registered by name through VMConfig.SetSnapshotHooks, and the name is
+// what matches the saved state back up on Restore, so it has to be
+// stable.
+type SnapshotHook interface {
+	SaveState(w io.Writer) error
+	RestoreState(r io.Reader) error
+}
+
+type CheckpointErrorType byte
+
+const (
+	UndefinedCheckpointError CheckpointErrorType = iota
+	CheckpointIOError
+	CheckpointBadMagic
+	CheckpointUnsupportedVersion
+	CheckpointCorrupt
+	CheckpointMemoryMismatch
+	CheckpointThreadsRunning
+	CheckpointHookMissing
+	CheckpointHookFailed
+	CheckpointCallInProgress
+	CheckpointForeignReference
+)
+
+var checkpointErrorTypeNames = map[CheckpointErrorType]string{
+	UndefinedCheckpointError:     "UndefinedCheckpointError",
+	CheckpointIOError:            "CheckpointIOError",
+	CheckpointBadMagic:           "CheckpointBadMagic",
+	CheckpointUnsupportedVersion: "CheckpointUnsupportedVersion",
+	CheckpointCorrupt:            "CheckpointCorrupt",
+	CheckpointMemoryMismatch:     "CheckpointMemoryMismatch",
+	CheckpointThreadsRunning:     "CheckpointThreadsRunning",
+	CheckpointHookMissing:        "CheckpointHookMissing",
+	CheckpointHookFailed:         "CheckpointHookFailed",
+	CheckpointCallInProgress:     "CheckpointCallInProgress",
+	CheckpointForeignReference:   "CheckpointForeignReference",
+}
+
+var checkpointErrorMessageTemplates = map[CheckpointErrorType]string{
+	UndefinedCheckpointError:     "unknown checkpoint error",
+	CheckpointIOError:            "i/o error: %v",
+	CheckpointBadMagic:           "not a checkpoint",
+	CheckpointUnsupportedVersion: "unsupported checkpoint version %d",
+	CheckpointCorrupt:            "corrupt checkpoint: %s",
+	CheckpointMemoryMismatch:     "checkpoint memory does not fit: %v",
+	CheckpointThreadsRunning:     "threads other than thread 0 have not been joined",
+	CheckpointHookMissing:        "no snapshot hook named %q",
+	CheckpointHookFailed:         "snapshot hook %q failed: %v",
+	CheckpointCallInProgress:     "instance is in the middle of a call",
+	CheckpointForeignReference:   "table %d element %d is a function of another instance",
+}
+
+func (t CheckpointErrorType) String() string {
+	if name, ok := checkpointErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("CheckpointErrorType(%d)", t)
+}
+
+type CheckpointError struct {
+	Type  CheckpointErrorType
+	Msg   string
+	Cause error
+}
+
+func NewCheckpointError(eType CheckpointErrorType, cause error, paras ...any) error {
+	msg, ok := checkpointErrorMessageTemplates[eType]
+	if !ok {
+		msg = checkpointErrorMessageTemplates[UndefinedCheckpointError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	return &CheckpointError{
+		Type:  eType,
+		Msg:   msg,
+		Cause: cause,
+	}
+}
+
+func (e *CheckpointError) Error() string {
+	return fmt.Sprintf("[%s] %s", e.Type.String(), e.Msg)
+}
+
+func (e *CheckpointError) Unwrap() error {
+	return e.Cause
+}
+
+// Trap state as it is stored. Cause is kept as its message and Meta
+// comes back as whatever encoding/json decodes it to.
+type checkpointTrap struct {
+	Type        TrapType
+	Op          string
+	PC          uint64
+	Message     string
+	Cause       string          `json:",omitempty"`
+	AccessType  TrapAccessType  `json:",omitempty"`
+	Address     *uint64         `json:",omitempty"`
+	Ring        *uint8          `json:",omitempty"`
+	Instruction *uint8          `json:",omitempty"`
+	Meta        json.RawMessage `json:",omitempty"`
+}
+
+// Little endian section payload builder
+type checkpointEncoder struct {
+	bytes.Buffer
+}
+
+func (e *checkpointEncoder) u8(v uint8) {
+	e.WriteByte(v)
+}
+
+func (e *checkpointEncoder) u32(v uint32) {
+	e.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func (e *checkpointEncoder) u64(v uint64) {
+	e.Write(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func (e *checkpointEncoder) str(s string) {
+	e.u32(uint32(len(s)))
+	e.WriteString(s)
+}
+
+// Reads a section payload, remembering the first short read
+type checkpointDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *checkpointDecoder) take(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.data)) < n {
+		d.err = errors.New("section truncated")
+		d.data = nil
+		return nil
+	}
+	out := d.data[:n]
+	d.data = d.data[n:]
+	return out
+}
+
+func (d *checkpointDecoder) u8() uint8 {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *checkpointDecoder) u32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *checkpointDecoder) u64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *checkpointDecoder) str() string {
+	return string(d.take(uint64(d.u32())))
+}
+
+type checkpointSection struct {
+	tag     byte
+	payload []byte
+}
+
+func writeCheckpointSection(w io.Writer, tag byte, payload []byte) error {
+	var header [9]byte
+	header[0] = tag
+	binary.LittleEndian.PutUint64(header[1:], uint64(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func encodeCheckpointMemory(s *MemorySnapshot) []byte {
+	e := &checkpointEncoder{}
+	e.u64(s.size)
+	if s.allowWX {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+	e.u32(uint32(len(s.perms)))
+	for _, p := range s.perms {
+		e.u8(uint8(p))
+	}
+	count := 0
+	for _, shard := range s.shards {
+		if shard != nil {
+			count++
+		}
+	}
+	e.u32(uint32(count))
+	for i, shard := range s.shards {
+		if shard != nil {
+			e.u32(uint32(i))
+			e.Write(shard)
+		}
+	}
+	return e.Bytes()
+}
+
+// The size is checked before anything gets allocated for the shards. It
+// may differ from the current size as long as the memory can be grown
+// or cut back to it.
+func decodeCheckpointMemory(payload []byte, size, limit uint64) (*MemorySnapshot, error) {
+	d := &checkpointDecoder{data: payload}
+	s := &MemorySnapshot{size: d.u64()}
+	if d.err == nil && s.size != size && s.size > limit {
+		return nil, &MemorySnapshotError{Msg: fmt.Sprintf(errmsg_SnapshotTooLarge, s.size, limit)}
+	}
+	s.allowWX = d.u8() != 0
+	shardCount := (s.size + MemoryShardSize - 1) / MemoryShardSize
+	if permCount := uint64(d.u32()); permCount > 0 {
+		if permCount != shardCount {
+			return nil, errors.New("permission table does not match memory size")
+		}
+		for _, p := range d.take(permCount) {
+			s.perms = append(s.perms, MemoryPermission(p))
+		}
+	}
+	s.shards = make([][]byte, shardCount)
+	for range d.u32() {
+		idx := uint64(d.u32())
+		shard := d.take(MemoryShardSize)
+		if d.err != nil {
+			break
+		}
+		if idx >= shardCount {
+			return nil, fmt.Errorf("shard %d out of range", idx)
+		}
+		s.shards[idx] = slices.Clone(shard)
+	}
+	return s, d.err
+}
+
+func encodeCheckpointThread(t *Thread) []byte {
+	e := &checkpointEncoder{}
+	e.u32(uint32(t.ID))
+	e.u64(t.PC)
+	e.u8(t.Ring)
+	if t.Trap {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+	e.u32(uint32(t.ValueStack.Size()))
+	for _, entry := range t.ValueStack.elements {
+		e.u8(uint8(entry.EntryType))
+		e.u32(entry.Value_I32)
+		e.u32(math.Float32bits(entry.Value_F32))
+		e.u64(entry.Value_I64)
+		e.u64(math.Float64bits(entry.Value_F64))
+	}
+	e.u32(uint32(len(t.CallStack)))
+	for _, frame := range t.CallStack {
+		e.u64(frame.ReturnPC)
+		e.u64(uint64(frame.StackHeight))
+	}
+	return e.Bytes()
+}
+
+// Fills in everything but the trap error itself
+func decodeCheckpointThread(payload []byte, t *Thread) error {
+	d := &checkpointDecoder{data: payload}
+	t.ID = ThreadID(d.u32())
+	t.PC = d.u64()
+	t.Ring = d.u8()
+	t.Trap = d.u8() != 0
+	t.ValueStack = ValueStack{}
+	for range d.u32() {
+		entry := ValueStackEntry{EntryType: ValueStackEntryType(d.u8())}
+		entry.Value_I32 = d.u32()
+		entry.Value_F32 = math.Float32frombits(d.u32())
+		entry.Value_I64 = d.u64()
+		entry.Value_F64 = math.Float64frombits(d.u64())
+		if d.err != nil {
+			break
+		}
+		t.ValueStack.Push(&entry)
+	}
+	t.CallStack = nil
+	for range d.u32() {
+		frame := CallFrame{ReturnPC: d.u64(), StackHeight: int(d.u64())}
+		if d.err != nil {
+			break
+		}
+		t.CallStack = append(t.CallStack, frame)
+	}
+	return d.err
+}
+
+func encodeCheckpointTrap(trap *TrapError) ([]byte, error) {
+	rec := checkpointTrap{
+		Type:        trap.Type,
+		Op:          trap.Op,
+		PC:          trap.PC,
+		Message:     trap.Message,
+		AccessType:  trap.AccessType,
+		Address:     trap.Address,
+		Ring:        trap.Ring,
+		Instruction: trap.Instruction,
+	}
+	if trap.Cause != nil {
+		rec.Cause = trap.Cause.Error()
+	}
+	if trap.Meta != nil {
+		meta, err := json.Marshal(trap.Meta)
+		if err != nil {
+			return nil, err
+		}
+		rec.Meta = meta
+	}
+	return json.Marshal(rec)
+}
+
+func decodeCheckpointTrap(payload []byte) (*TrapError, error) {
+	rec := checkpointTrap{}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return nil, err
+	}
+	trap := &TrapError{
+		Type:        rec.Type,
+		Op:          rec.Op,
+		PC:          rec.PC,
+		Message:     rec.Message,
+		AccessType:  rec.AccessType,
+		Address:     rec.Address,
+		Ring:        rec.Ring,
+		Instruction: rec.Instruction,
+	}
+	if rec.Cause != "" {
+		trap.Cause = errors.New(rec.Cause)
+	}
+	if rec.Meta != nil {
+		if err := json.Unmarshal(rec.Meta, &trap.Meta); err != nil {
+			return nil, err
+		}
+	}
+	return trap, nil
+}
+
+func encodeCheckpointGlobals(globals []*Global) []byte {
+	e := &checkpointEncoder{}
+	e.u32(uint32(len(globals)))
+	for _, g := range globals {
+		e.u64(entryBits(&g.Value))
+	}
+	return e.Bytes()
+}
+
+// Only the values are stored, their types come from the instance
+func decodeCheckpointGlobals(payload []byte, globals []*Global) ([]ValueStackEntry, error) {
+	d := &checkpointDecoder{data: payload}
+	if n := d.u32(); d.err == nil && int(n) != len(globals) {
+		return nil, fmt.Errorf("%d globals, instance has %d", n, len(globals))
+	}
+	values := make([]ValueStackEntry, len(globals))
+	for i, g := range globals {
+		values[i] = entryFromBits(d.u64(), g.Type.ValType)
+	}
+	return values, d.err
+}
+
+// Table elements are stored as 1 plus the index of the function in
+// the instance, or 0 for null, so that they resolve again in a fresh
+// instance of the same module. Functions of other instances can't be.
+func encodeCheckpointTables(inst *Instance) ([]byte, error) {
+	index := make(map[*ExposedFunc]uint32)
+	for i := range inst.funcs {
+		if host := inst.funcs[i].host; host != nil {
+			index[host] = uint32(i)
+		}
+	}
+	e := &checkpointEncoder{}
+	e.u32(uint32(len(inst.Tables)))
+	for t, table := range inst.Tables {
+		e.u32(uint32(len(table.Elements)))
+		for i, ef := range table.Elements {
+			switch idx, ok := index[ef]; {
+			case ef == nil:
+				e.u32(0)
+			case ef.owner == inst:
+				e.u32(ef.index + 1)
+			case ok:
+				e.u32(idx + 1)
+			default:
+				return nil, NewCheckpointError(CheckpointForeignReference, nil, t, i)
+			}
+		}
+	}
+	return e.Bytes(), nil
+}
+
+func decodeCheckpointTables(payload []byte, inst *Instance) ([][]*ExposedFunc, error) {
+	d := &checkpointDecoder{data: payload}
+	if n := d.u32(); d.err == nil && int(n) != len(inst.Tables) {
+		return nil, fmt.Errorf("%d tables, instance has %d", n, len(inst.Tables))
+	}
+	tables := make([][]*ExposedFunc, len(inst.Tables))
+	for t, table := range inst.Tables {
+		size := uint64(d.u32())
+		if max := table.Type.Limits.Max; d.err == nil && (size < table.Type.Limits.Min || max != nil && size > *max) {
+			return nil, fmt.Errorf("table %d has %d elements, outside its limits", t, size)
+		}
+		// Each element takes 4 octets, which bounds the allocation
+		if d.err == nil && size*4 > uint64(len(d.data)) {
+			return nil, errors.New("section truncated")
+		}
+		elements := make([]*ExposedFunc, size)
+		for i := range elements {
+			idx := d.u32()
+			if idx == 0 {
+				continue
+			}
+			if int(idx) > len(inst.funcs) {
+				return nil, fmt.Errorf("table %d element %d: no function %d", t, i, idx-1)
+			}
+			elements[i] = inst.funcRef(idx - 1)
+		}
+		tables[t] = elements
+	}
+	return tables, d.err
+}
+
+func encodeCheckpointSegments(inst *Instance) []byte {
+	e := &checkpointEncoder{}
+	for _, dropped := range [][]bool{inst.droppedData, inst.droppedElems} {
+		e.u32(uint32(len(dropped)))
+		for _, d := range dropped {
+			if d {
+				e.u8(1)
+			} else {
+				e.u8(0)
+			}
+		}
+	}
+	return e.Bytes()
+}
+
+// Which data and element segments have been dropped, in that order
+func decodeCheckpointSegments(payload []byte, inst *Instance) ([2][]bool, error) {
+	d := &checkpointDecoder{data: payload}
+	var dropped [2][]bool
+	for i, want := range []int{len(inst.droppedData), len(inst.droppedElems)} {
+		if n := d.u32(); d.err == nil && int(n) != want {
+			return dropped, fmt.Errorf("%d segments, instance has %d", n, want)
+		}
+		for _, b := range d.take(uint64(want)) {
+			dropped[i] = append(dropped[i], b != 0)
+		}
+	}
+	return dropped, d.err
+}
+
+// Writes the memory, thread 0 and any host hook state of the VM to w.
+// In protected mode every other thread must have been joined first. The
+// VM of an instance also saves its globals, tables and dropped segments,
+// and can only be saved between calls.
+func (vm *VMState) Save(w io.Writer) error {
+	if vm.instance != nil && len(vm.CallStack) > 0 {
+		return NewCheckpointError(CheckpointCallInProgress, nil)
+	}
+	if tg := vm.threads; tg != nil {
+		tg.mu.Lock()
+		defer tg.mu.Unlock()
+		if len(tg.threads) > 1 {
+			return NewCheckpointError(CheckpointThreadsRunning, nil)
+		}
+	}
+	mem, err := NewMemorySnapshot(vm.Memory)
+	if err != nil {
+		return NewCheckpointError(CheckpointMemoryMismatch, err, err)
+	}
+
+	bw := bufio.NewWriter(w)
+	header := binary.LittleEndian.AppendUint16(checkpointMagic[:], CheckpointVersion)
+	sections := []checkpointSection{
+		{checkpointSectionMemory, encodeCheckpointMemory(mem)},
+		{checkpointSectionThread, encodeCheckpointThread(&vm.Thread)},
+	}
+	if vm.TrapErr != nil {
+		payload, err := encodeCheckpointTrap(vm.TrapErr)
+		if err != nil {
+			return NewCheckpointError(CheckpointCorrupt, err, err.Error())
+		}
+		sections = append(sections, checkpointSection{checkpointSectionTrap, payload})
+	}
+	if vm.instance != nil {
+		tables, err := encodeCheckpointTables(vm.instance)
+		if err != nil {
+			return err
+		}
+		sections = append(sections,
+			checkpointSection{checkpointSectionGlobals, encodeCheckpointGlobals(vm.instance.Globals)},
+			checkpointSection{checkpointSectionTables, tables},
+			checkpointSection{checkpointSectionSegments, encodeCheckpointSegments(vm.instance)},
+		)
+	}
+	if vm.Config != nil {
+		names := make([]string, 0, len(vm.Config.SnapshotHooks))
+		for name := range vm.Config.SnapshotHooks {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			e := &checkpointEncoder{}
+			e.str(name)
+			if err := vm.Config.SnapshotHooks[name].SaveState(e); err != nil {
+				return NewCheckpointError(CheckpointHookFailed, err, name, err)
+			}
+			sections = append(sections, checkpointSection{checkpointSectionHost, e.Bytes()})
+		}
+	}
+
+	if _, err := bw.Write(header); err != nil {
+		return NewCheckpointError(CheckpointIOError, err, err)
+	}
+	for _, section := range sections {
+		if err := writeCheckpointSection(bw, section.tag, section.payload); err != nil {
+			return NewCheckpointError(CheckpointIOError, err, err)
+		}
+	}
+	if err := writeCheckpointSection(bw, checkpointSectionEnd, nil); err != nil {
+		return NewCheckpointError(CheckpointIOError, err, err)
+	}
+	if err := bw.Flush(); err != nil {
+		return NewCheckpointError(CheckpointIOError, err, err)
+	}
+	return nil
+}
+
+// Replaces the state of the VM with a checkpoint written by Save. The
+// memory is grown or cut back to the saved size, within the limits
+// memory.grow has, and the VM needs the snapshot hooks named in the
+// checkpoint. Nothing is changed unless the
+// whole checkpoint decodes; host hooks run last, in the saved order.
+func (vm *VMState) Restore(r io.Reader) error {
+	if tg := vm.threads; tg != nil {
+		tg.mu.Lock()
+		defer tg.mu.Unlock()
+		if len(tg.threads) > 1 {
+			return NewCheckpointError(CheckpointThreadsRunning, nil)
+		}
+	}
+	br := bufio.NewReader(r)
+	var header [6]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return NewCheckpointError(CheckpointIOError, err, err)
+	}
+	if !bytes.Equal(header[:4], checkpointMagic[:]) {
+		return NewCheckpointError(CheckpointBadMagic, nil)
+	}
+	if version := binary.LittleEndian.Uint16(header[4:]); version != CheckpointVersion {
+		return NewCheckpointError(CheckpointUnsupportedVersion, nil, version)
+	}
+
+	var mem *MemorySnapshot
+	var thread Thread
+	var trap *TrapError
+	var globals []ValueStackEntry
+	var tables [][]*ExposedFunc
+	var dropped *[2][]bool
+	type hostState struct {
+		name string
+		hook SnapshotHook
+		data []byte
+	}
+	hosts := []hostState{}
+	seenThread := false
+	for {
+		var sh [9]byte
+		if _, err := io.ReadFull(br, sh[:]); err != nil {
+			return NewCheckpointError(CheckpointIOError, err, err)
+		}
+		tag, length := sh[0], binary.LittleEndian.Uint64(sh[1:])
+		if tag == checkpointSectionEnd {
+			break
+		}
+		// CopyN grows the buffer as data arrives, so a bogus length
+		// can't force a huge allocation up front
+		payload := &bytes.Buffer{}
+		if _, err := io.CopyN(payload, br, int64(min(length, math.MaxInt64))); err != nil {
+			return NewCheckpointError(CheckpointIOError, err, err)
+		}
+		var err error
+		switch tag {
+		case checkpointSectionMemory:
+			mem, err = decodeCheckpointMemory(payload.Bytes(), vm.Memory.Size(), vm.memoryLimit())
+			var se *MemorySnapshotError
+			if errors.As(err, &se) {
+				return NewCheckpointError(CheckpointMemoryMismatch, err, err)
+			}
+		case checkpointSectionThread:
+			err = decodeCheckpointThread(payload.Bytes(), &thread)
+			seenThread = true
+		case checkpointSectionTrap:
+			trap, err = decodeCheckpointTrap(payload.Bytes())
+		case checkpointSectionGlobals:
+			if vm.instance == nil {
+				err = errors.New("globals saved from an instance")
+				break
+			}
+			globals, err = decodeCheckpointGlobals(payload.Bytes(), vm.instance.Globals)
+		case checkpointSectionTables:
+			if vm.instance == nil {
+				err = errors.New("tables saved from an instance")
+				break
+			}
+			tables, err = decodeCheckpointTables(payload.Bytes(), vm.instance)
+		case checkpointSectionSegments:
+			if vm.instance == nil {
+				err = errors.New("segments saved from an instance")
+				break
+			}
+			var segs [2][]bool
+			segs, err = decodeCheckpointSegments(payload.Bytes(), vm.instance)
+			dropped = &segs
+		case checkpointSectionHost:
+			d := &checkpointDecoder{data: payload.Bytes()}
+			name := d.str()
+			if d.err != nil {
+				err = d.err
+				break
+			}
+			var hook SnapshotHook
+			if vm.Config != nil {
+				hook = vm.Config.SnapshotHooks[name]
+			}
+			if hook == nil {
+				return NewCheckpointError(CheckpointHookMissing, nil, name)
+			}
+			hosts = append(hosts, hostState{name: name, hook: hook, data: d.data})
+		default:
+			err = fmt.Errorf("unknown section 0x%02X", tag)
+		}
+		if err != nil {
+			return NewCheckpointError(CheckpointCorrupt, err, err.Error())
+		}
+	}
+	if mem == nil || !seenThread {
+		return NewCheckpointError(CheckpointCorrupt, nil, "missing memory or thread section")
+	}
+
+	if err := RestoreMemorySnapshot(vm.Memory, mem); err != nil {
+		return NewCheckpointError(CheckpointMemoryMismatch, err, err)
+	}
+	vm.PC = thread.PC
+	vm.Ring = thread.Ring
+	vm.Trap = thread.Trap
+	vm.TrapErr = trap
+	vm.ValueStack = thread.ValueStack
+	vm.CallStack = thread.CallStack
+	vm.Labels = vm.Labels[:0]
+	for i, val := range globals {
+		vm.instance.Globals[i].Value = val
+	}
+	for i, elements := range tables {
+		vm.instance.Tables[i].Elements = elements
+	}
+	if dropped != nil {
+		vm.instance.droppedData, vm.instance.droppedElems = dropped[0], dropped[1]
+	}
+	vm.aborted.Store(false)
+	for _, host := range hosts {
+		if err := host.hook.RestoreState(bytes.NewReader(host.data)); err != nil {
+			return NewCheckpointError(CheckpointHookFailed, err, host.name, err)
+		}
+	}
+	return nil
+}
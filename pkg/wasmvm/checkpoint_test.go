@@ -0,0 +1,196 @@
+package wasmvm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Keeps a single counter as its host state
+type counterHook struct {
+	count   uint32
+	failErr error
+}
+
+func (h *counterHook) SaveState(w io.Writer) error {
+	if h.failErr != nil {
+		return h.failErr
+	}
+	return binary.Write(w, binary.LittleEndian, h.count)
+}
+
+func (h *counterHook) RestoreState(r io.Reader) error {
+	if h.failErr != nil {
+		return h.failErr
+	}
+	return binary.Read(r, binary.LittleEndian, &h.count)
+}
+
+func newCheckpointConfig(hooks map[string]wasmvm.SnapshotHook) *wasmvm.VMConfig {
+	return (&wasmvm.VMConfig{
+		Image: (&wasmvm.ImageConfig{}).SetArray(snapshotProgram).SetSize(uint64(len(snapshotProgram))),
+	}).SetSize(wasmvm.MemoryShardSize * 3).SetSnapshotHooks(hooks)
+}
+
+func checkpointErrorType(t *testing.T, err error) wasmvm.CheckpointErrorType {
+	t.Helper()
+	var ce *wasmvm.CheckpointError
+	require.ErrorAs(t, err, &ce)
+	return ce.Type
+}
+
+func TestCheckpoint_RoundTrip(t *testing.T) {
+	hook := &counterHook{count: 42}
+	vm, err := newCheckpointConfig(map[string]wasmvm.SnapshotHook{"counter": hook}).BuildVMState()
+	require.NoError(t, err)
+	// Both constants are on the stack, the store hasn't happened yet
+	require.NoError(t, vm.Step())
+	require.NoError(t, vm.Step())
+	vm.CallStack = append(vm.CallStack, wasmvm.CallFrame{ReturnPC: 3, StackHeight: 1})
+
+	path := filepath.Join(t.TempDir(), "vm.checkpoint")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, vm.Save(f))
+	require.NoError(t, f.Close())
+
+	restoredHook := &counterHook{}
+	restored, err := newCheckpointConfig(map[string]wasmvm.SnapshotHook{"counter": restoredHook}).
+		SetMemoryModel(wasmvm.ShardedMemoryModel).
+		BuildVMState()
+	require.NoError(t, err)
+	f, err = os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, restored.Restore(f))
+
+	assert.Equal(t, uint32(42), restoredHook.count)
+	assert.Equal(t, vm.PC, restored.PC)
+	assert.Equal(t, vm.ValueStack, restored.ValueStack)
+	assert.Equal(t, vm.CallStack, restored.CallStack)
+	assert.Equal(t, wasmvm.MemoryPermRX, restored.Memory.(wasmvm.PermissionedMemory).Permissions(0))
+
+	restored.CallStack = nil
+	restored.MainLoop()
+	assert.Equal(t, wasmvm.TrapCallStackEmpty, restored.TrapErr.Type)
+	assert.Equal(t, []byte{0xDD, 0xCC, 0xBB, 0xAA}, readData(t, restored))
+	// The original is untouched
+	assert.Equal(t, []byte{0, 0, 0, 0}, readData(t, vm))
+}
+
+func TestCheckpoint_TrapState(t *testing.T) {
+	vm, err := newCheckpointConfig(nil).BuildVMState()
+	require.NoError(t, err)
+	assert.Error(t, vm.WriteMemory("TEST", 0, []byte{0}))
+	vm.TrapErr.Cause = errors.New("underlying")
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, vm.Save(buf))
+	restored, err := newCheckpointConfig(nil).BuildVMState()
+	require.NoError(t, err)
+	require.NoError(t, restored.Restore(buf))
+
+	assert.True(t, restored.Trap)
+	expect := *vm.TrapErr
+	actual := *restored.TrapErr
+	assert.EqualError(t, actual.Cause, "underlying")
+	assert.Equal(t, map[string]any{"width": float64(1), "memory_len": float64(wasmvm.MemoryShardSize * 3)}, actual.Meta)
+	expect.Cause, expect.Meta, actual.Cause, actual.Meta = nil, nil, nil, nil
+	assert.Equal(t, expect, actual)
+
+	// Restoring a checkpoint without a trap clears it
+	clean, err := newCheckpointConfig(nil).BuildVMState()
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, clean.Save(buf))
+	require.NoError(t, restored.Restore(buf))
+	assert.False(t, restored.Trap)
+	assert.Nil(t, restored.TrapErr)
+}
+
+func TestCheckpoint_Errors(t *testing.T) {
+	vm, err := newCheckpointConfig(map[string]wasmvm.SnapshotHook{"counter": &counterHook{}}).BuildVMState()
+	require.NoError(t, err)
+	saved := &bytes.Buffer{}
+	require.NoError(t, vm.Save(saved))
+	good := saved.Bytes()
+
+	// Corrupts the first section length
+	badLength := bytes.Clone(good)
+	binary.LittleEndian.PutUint64(badLength[7:], 3)
+	badVersion := bytes.Clone(good)
+	badVersion[4] = 9
+	unknownSection := append(bytes.Clone(good[:6]), 0x42, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	tests := []struct {
+		name      string
+		config    *wasmvm.VMConfig
+		data      []byte
+		expectErr wasmvm.CheckpointErrorType
+	}{
+		{name: "empty", data: nil, expectErr: wasmvm.CheckpointIOError},
+		{name: "bad magic", data: []byte("RWVX\x01\x00"), expectErr: wasmvm.CheckpointBadMagic},
+		{name: "bad version", data: badVersion, expectErr: wasmvm.CheckpointUnsupportedVersion},
+		{name: "truncated", data: good[:len(good)-20], expectErr: wasmvm.CheckpointIOError},
+		{name: "short memory section", data: badLength, expectErr: wasmvm.CheckpointCorrupt},
+		{name: "unknown section", data: unknownSection, expectErr: wasmvm.CheckpointCorrupt},
+		{name: "missing sections", data: append(bytes.Clone(good[:6]), 0xFF, 0, 0, 0, 0, 0, 0, 0, 0), expectErr: wasmvm.CheckpointCorrupt},
+		{
+			name:      "memory over the limit",
+			config:    newCheckpointConfig(map[string]wasmvm.SnapshotHook{"counter": &counterHook{}}).SetSize(wasmvm.MemoryShardSize).SetMaxMemory(wasmvm.MemoryShardSize),
+			data:      good,
+			expectErr: wasmvm.CheckpointMemoryMismatch,
+		},
+		{
+			name:      "missing hook",
+			config:    newCheckpointConfig(nil),
+			data:      good,
+			expectErr: wasmvm.CheckpointHookMissing,
+		},
+		{
+			name:      "hook fails",
+			config:    newCheckpointConfig(map[string]wasmvm.SnapshotHook{"counter": &counterHook{failErr: io.ErrUnexpectedEOF}}),
+			data:      good,
+			expectErr: wasmvm.CheckpointHookFailed,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			if config == nil {
+				config = newCheckpointConfig(map[string]wasmvm.SnapshotHook{"counter": &counterHook{}})
+			}
+			target, err := config.BuildVMState()
+			require.NoError(t, err)
+			err = target.Restore(bytes.NewReader(tc.data))
+			assert.Equal(t, tc.expectErr, checkpointErrorType(t, err))
+		})
+	}
+
+	failing, err := newCheckpointConfig(map[string]wasmvm.SnapshotHook{"counter": &counterHook{failErr: io.ErrClosedPipe}}).BuildVMState()
+	require.NoError(t, err)
+	err = failing.Save(&bytes.Buffer{})
+	assert.Equal(t, wasmvm.CheckpointHookFailed, checkpointErrorType(t, err))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	threaded, err := newCheckpointConfig(nil).SetMode(wasmvm.ProtectedMode).SetShared(true).BuildVMState()
+	require.NoError(t, err)
+	id, err := threaded.SpawnThread(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, wasmvm.CheckpointThreadsRunning, checkpointErrorType(t, threaded.Save(&bytes.Buffer{})))
+	assert.Equal(t, wasmvm.CheckpointThreadsRunning, checkpointErrorType(t, threaded.Restore(bytes.NewReader(good))))
+	_, err = threaded.JoinThread(id)
+	require.NoError(t, err)
+
+	custom, err := (&wasmvm.VMConfig{}).SetMemory(plainMemory{wasmvm.NewFlatMemory(make([]byte, 8))}).BuildVMState()
+	require.NoError(t, err)
+	assert.Equal(t, wasmvm.CheckpointMemoryMismatch, checkpointErrorType(t, custom.Save(&bytes.Buffer{})))
+}
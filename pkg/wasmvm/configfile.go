@@ -0,0 +1,781 @@
+package wasmvm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration files: a VMConfig written as JSON or YAML, plus what the
+// struct itself can't hold. The keys are the VMConfig field names,
+// matched without regard to case like encoding/json does, and:
+//
+//	Stdin, Stdout, Stderr  "inherit", "null" or a file path
+//	WASI                   Args, Env (KEY=value, or KEY to pass the host
+//	                       value through) and Preopens ({Host, Guest})
+//	HostModules            import module name to the name a host module
+//	                       was registered under in ConfigOptions
+//
+// Sizes (Size, MaxMemory and the image size) may be given as "64KiB",
+// "16MiB" or "1GiB", and byte arrays as base64 or a list of numbers.
+// Relative paths are taken from the directory of the file.
+
+type ConfigFormat byte
+
+const (
+	ConfigJSON ConfigFormat = iota
+	ConfigYAML
+)
+
+var configFormatNames = map[ConfigFormat]string{
+	ConfigJSON: "json",
+	ConfigYAML: "yaml",
+}
+
+func (f ConfigFormat) String() string {
+	if name, ok := configFormatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConfigFormat(%d)", f)
+}
+
+// The format of a config file going by its extension
+func ConfigFormatForPath(path string) (ConfigFormat, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		return ConfigJSON, nil
+	case ".yaml", ".yml":
+		return ConfigYAML, nil
+	default:
+		return ConfigJSON, NewConfigError(ConfigUnknownFormat, "", nil, ext)
+	}
+}
+
+type ConfigErrorType byte
+
+const (
+	UndefinedConfigError ConfigErrorType = iota
+	ConfigUnknownFormat
+	ConfigSyntax
+	ConfigUnknownField
+	ConfigTypeMismatch
+	ConfigOutOfRange
+	ConfigInvalidValue
+	ConfigMissingField
+	ConfigUnknownHostModule
+	ConfigOpenFailed
+)
+
+var configErrorTypeNames = map[ConfigErrorType]string{
+	UndefinedConfigError:    "UndefinedConfigError",
+	ConfigUnknownFormat:     "ConfigUnknownFormat",
+	ConfigSyntax:            "ConfigSyntax",
+	ConfigUnknownField:      "ConfigUnknownField",
+	ConfigTypeMismatch:      "ConfigTypeMismatch",
+	ConfigOutOfRange:        "ConfigOutOfRange",
+	ConfigInvalidValue:      "ConfigInvalidValue",
+	ConfigMissingField:      "ConfigMissingField",
+	ConfigUnknownHostModule: "ConfigUnknownHostModule",
+	ConfigOpenFailed:        "ConfigOpenFailed",
+}
+
+var configErrorMessageTemplates = map[ConfigErrorType]string{
+	UndefinedConfigError:    "unknown config error",
+	ConfigUnknownFormat:     "unknown config format %q",
+	ConfigSyntax:            "%v",
+	ConfigUnknownField:      "unknown field",
+	ConfigTypeMismatch:      "expected %s, got %s",
+	ConfigOutOfRange:        "%s does not fit in %d bits",
+	ConfigInvalidValue:      "%v",
+	ConfigMissingField:      "required",
+	ConfigUnknownHostModule: "no host module registered as %q",
+	ConfigOpenFailed:        "%v",
+}
+
+func (t ConfigErrorType) String() string {
+	if name, ok := configErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConfigErrorType(%d)", t)
+}
+
+// A problem with a config file. Path is where in the file it is, such
+// as WASI.Preopens[1].Host, and empty for the file as a whole.
+type ConfigError struct {
+	Type  ConfigErrorType
+	Path  string
+	Msg   string
+	Cause error
+}
+
+func NewConfigError(eType ConfigErrorType, path string, cause error, paras ...any) error {
+	msg, ok := configErrorMessageTemplates[eType]
+	if !ok {
+		msg = configErrorMessageTemplates[UndefinedConfigError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	return &ConfigError{
+		Type:  eType,
+		Path:  path,
+		Msg:   msg,
+		Cause: cause,
+	}
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("[%s] %s", e.Type.String(), e.Msg)
+	}
+	return fmt.Sprintf("[%s] %s: %s", e.Type.String(), e.Path, e.Msg)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Cause
+}
+
+// Parses a byte count such as 65536, 64KiB, 16MiB or 1GiB
+func ParseSize(s string) (uint64, error) {
+	num, shift := strings.TrimSpace(s), uint(0)
+	for _, u := range []struct {
+		suffix string
+		shift  uint
+	}{{"GiB", 30}, {"MiB", 20}, {"KiB", 10}, {"B", 0}} {
+		if strings.HasSuffix(num, u.suffix) {
+			num, shift = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.shift
+			break
+		}
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil || n > ^uint64(0)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+type schemaKind byte
+
+const (
+	schemaObject schemaKind = iota
+	schemaMap
+	schemaList
+	schemaString
+	schemaBool
+	schemaUint
+	schemaSize
+	schemaBytes
+	schemaEnum
+)
+
+var schemaKindNames = map[schemaKind]string{
+	schemaObject: "an object",
+	schemaMap:    "an object",
+	schemaList:   "a list",
+	schemaString: "a string",
+	schemaBool:   "a boolean",
+	schemaUint:   "an unsigned integer",
+	schemaSize:   "a size",
+	schemaBytes:  "bytes",
+	schemaEnum:   "a name",
+}
+
+type schemaField struct {
+	name     string
+	schema   *configSchema
+	required bool
+}
+
+// What a config file may contain. Checking a value against it also
+// brings sizes and byte lists into the form encoding/json expects.
+type configSchema struct {
+	kind   schemaKind
+	fields []schemaField      // Object
+	elem   *configSchema      // Map values and list entries
+	bits   int                // Uint, and map keys when non-zero
+	parse  func(string) error // Enum
+}
+
+func schemaUintN(bits int) *configSchema {
+	return &configSchema{kind: schemaUint, bits: bits}
+}
+
+var (
+	schemaStringValue = &configSchema{kind: schemaString}
+	schemaBoolValue   = &configSchema{kind: schemaBool}
+	schemaSizeValue   = &configSchema{kind: schemaSize}
+	schemaBytesValue  = &configSchema{kind: schemaBytes}
+	schemaStrings     = &configSchema{kind: schemaList, elem: schemaStringValue}
+)
+
+var imageConfigSchema = &configSchema{kind: schemaObject, fields: []schemaField{
+	{name: "type", schema: &configSchema{kind: schemaEnum, parse: func(s string) error {
+		_, err := ParseImageType(s)
+		return err
+	}}},
+	{name: "filename", schema: schemaStringValue},
+	{name: "format", schema: &configSchema{kind: schemaEnum, parse: func(s string) error {
+		_, err := ParseImageFormat(s)
+		return err
+	}}},
+	{name: "array", schema: schemaBytesValue},
+	{name: "size", schema: schemaSizeValue},
+	{name: "sparsearray", schema: &configSchema{kind: schemaList, elem: &configSchema{kind: schemaObject, fields: []schemaField{
+		{name: "offset", schema: schemaUintN(64)},
+		{name: "array", schema: schemaBytesValue},
+	}}}},
+}}
+
+var wasiConfigSchema = &configSchema{kind: schemaObject, fields: []schemaField{
+	{name: "Args", schema: schemaStrings},
+	{name: "Env", schema: schemaStrings},
+	{name: "Preopens", schema: &configSchema{kind: schemaList, elem: &configSchema{kind: schemaObject, fields: []schemaField{
+		{name: "Host", schema: schemaStringValue, required: true},
+		{name: "Guest", schema: schemaStringValue},
+	}}}},
+}}
+
+var configFileSchema = &configSchema{kind: schemaObject, fields: []schemaField{
+	{name: "Size", schema: schemaSizeValue},
+	{name: "FlatMemory", schema: schemaBytesValue},
+	{name: "MemoryModel", schema: &configSchema{kind: schemaEnum, parse: func(s string) error {
+		_, err := ParseMemoryModel(s)
+		return err
+	}}},
+	{name: "Shared", schema: schemaBoolValue},
+	{name: "Mode", schema: &configSchema{kind: schemaEnum, parse: func(s string) error {
+		_, err := ParseExecutionMode(s)
+		return err
+	}}},
+	{name: "MaxThreads", schema: schemaUintN(32)},
+	{name: "AllowWriteExecute", schema: schemaBoolValue},
+	{name: "Strict", schema: schemaBoolValue},
+	{name: "Image", schema: imageConfigSchema},
+	{name: "Rings", schema: &configSchema{kind: schemaMap, bits: 8, elem: &configSchema{kind: schemaObject, fields: []schemaField{
+		{name: "Enabled", schema: schemaBoolValue},
+	}}}},
+	{name: "StartOverride", schema: schemaUintN(64)},
+	{name: "EntryPoint", schema: schemaStringValue},
+	{name: "Deterministic", schema: schemaBoolValue},
+	{name: "Seed", schema: schemaUintN(64)},
+	{name: "MaxMemory", schema: schemaSizeValue},
+	{name: "Fuel", schema: schemaUintN(64)},
+	{name: "Stdin", schema: schemaStringValue},
+	{name: "Stdout", schema: schemaStringValue},
+	{name: "Stderr", schema: schemaStringValue},
+	{name: "WASI", schema: wasiConfigSchema},
+	{name: "HostModules", schema: &configSchema{kind: schemaMap, elem: schemaStringValue}},
+}}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// How a parsed value is described in type mismatches
+func describeConfigValue(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "a list"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "a number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Checks v at path, adding every problem to errs, and returns it in the
+// form encoding/json takes. Null is accepted anywhere, as the zero value.
+func (s *configSchema) check(v any, path string, errs *[]error) any {
+	if v == nil {
+		return nil
+	}
+	mismatch := func() any {
+		*errs = append(*errs, NewConfigError(ConfigTypeMismatch, path, nil, schemaKindNames[s.kind], describeConfigValue(v)))
+		return v
+	}
+	switch s.kind {
+	case schemaObject:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return mismatch()
+		}
+		for _, key := range sortedConfigKeys(obj) {
+			i := slices.IndexFunc(s.fields, func(f schemaField) bool { return strings.EqualFold(f.name, key) })
+			if i < 0 {
+				*errs = append(*errs, NewConfigError(ConfigUnknownField, joinConfigPath(path, key), nil))
+				continue
+			}
+			obj[key] = s.fields[i].schema.check(obj[key], joinConfigPath(path, key), errs)
+		}
+		for _, f := range s.fields {
+			if f.required && !slices.ContainsFunc(sortedConfigKeys(obj), func(key string) bool { return strings.EqualFold(f.name, key) }) {
+				*errs = append(*errs, NewConfigError(ConfigMissingField, joinConfigPath(path, f.name), nil))
+			}
+		}
+	case schemaMap:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return mismatch()
+		}
+		for _, key := range sortedConfigKeys(obj) {
+			if s.bits > 0 {
+				if _, err := strconv.ParseUint(key, 10, s.bits); err != nil {
+					*errs = append(*errs, NewConfigError(ConfigOutOfRange, joinConfigPath(path, key), nil, strconv.Quote(key), s.bits))
+					continue
+				}
+			}
+			obj[key] = s.elem.check(obj[key], joinConfigPath(path, key), errs)
+		}
+	case schemaList:
+		list, ok := v.([]any)
+		if !ok {
+			return mismatch()
+		}
+		for i := range list {
+			list[i] = s.elem.check(list[i], fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case schemaString:
+		if _, ok := v.(string); !ok {
+			return mismatch()
+		}
+	case schemaBool:
+		if _, ok := v.(bool); !ok {
+			return mismatch()
+		}
+	case schemaUint:
+		n, ok := v.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		if strings.Trim(n.String(), "0123456789") != "" {
+			// Negative or fractional
+			return mismatch()
+		}
+		if _, err := strconv.ParseUint(n.String(), 10, s.bits); err != nil {
+			*errs = append(*errs, NewConfigError(ConfigOutOfRange, path, nil, n, s.bits))
+		}
+	case schemaSize:
+		switch val := v.(type) {
+		case json.Number:
+			if _, err := strconv.ParseUint(val.String(), 10, 64); err != nil {
+				return mismatch()
+			}
+		case string:
+			size, err := ParseSize(val)
+			if err != nil {
+				*errs = append(*errs, NewConfigError(ConfigInvalidValue, path, err, err))
+				return v
+			}
+			return json.Number(strconv.FormatUint(size, 10))
+		default:
+			return mismatch()
+		}
+	case schemaBytes:
+		switch val := v.(type) {
+		case string:
+			if _, err := base64.StdEncoding.DecodeString(val); err != nil {
+				*errs = append(*errs, NewConfigError(ConfigInvalidValue, path, err, "invalid base64"))
+			}
+		case []any:
+			data := make([]byte, len(val))
+			for i, b := range val {
+				n, ok := b.(json.Number)
+				if !ok {
+					*errs = append(*errs, NewConfigError(ConfigTypeMismatch, fmt.Sprintf("%s[%d]", path, i), nil, "a byte", describeConfigValue(b)))
+					continue
+				}
+				u, err := strconv.ParseUint(n.String(), 10, 8)
+				if err != nil {
+					*errs = append(*errs, NewConfigError(ConfigOutOfRange, fmt.Sprintf("%s[%d]", path, i), nil, n, 8))
+					continue
+				}
+				data[i] = byte(u)
+			}
+			return base64.StdEncoding.EncodeToString(data)
+		default:
+			return mismatch()
+		}
+	case schemaEnum:
+		switch val := v.(type) {
+		case string:
+			if err := s.parse(val); err != nil {
+				*errs = append(*errs, NewConfigError(ConfigInvalidValue, path, err, err))
+			}
+		case json.Number:
+			if _, err := strconv.ParseUint(val.String(), 10, 8); err != nil {
+				*errs = append(*errs, NewConfigError(ConfigOutOfRange, path, nil, val, 8))
+			}
+		default:
+			return mismatch()
+		}
+	}
+	return v
+}
+
+func sortedConfigKeys(obj map[string]any) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Parses data into maps, lists, strings, booleans, json.Numbers and nil
+func parseConfigData(data []byte, format ConfigFormat) (any, error) {
+	switch format {
+	case ConfigJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, NewConfigError(ConfigSyntax, "", err, err)
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, NewConfigError(ConfigSyntax, "", nil, "data after the top-level value")
+		}
+		return v, nil
+	case ConfigYAML:
+		var v any
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, NewConfigError(ConfigSyntax, "", err, err)
+		}
+		if v == nil {
+			// An empty document
+			return map[string]any{}, nil
+		}
+		return normalizeYAML(v), nil
+	}
+	return nil, NewConfigError(ConfigUnknownFormat, "", nil, format.String())
+}
+
+// Brings what yaml.v3 decodes to the forms the JSON decoder produces
+func normalizeYAML(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for key, elem := range val {
+			val[key] = normalizeYAML(elem)
+		}
+		return val
+	case map[any]any:
+		obj := make(map[string]any, len(val))
+		for key, elem := range val {
+			obj[fmt.Sprint(key)] = normalizeYAML(elem)
+		}
+		return obj
+	case []any:
+		for i := range val {
+			val[i] = normalizeYAML(val[i])
+		}
+		return val
+	case int:
+		return json.Number(strconv.Itoa(val))
+	case uint64:
+		return json.Number(strconv.FormatUint(val, 10))
+	case float64:
+		return json.Number(strconv.FormatFloat(val, 'g', -1, 64))
+	}
+	return v
+}
+
+// Parses and checks a config file, returning the document ready for
+// encoding/json, or every problem found joined together
+func parseConfig(data []byte, format ConfigFormat) (map[string]any, error) {
+	v, err := parseConfigData(data, format)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	v = configFileSchema.check(v, "", &errs)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	doc, ok := v.(map[string]any)
+	if !ok {
+		// Null at the top
+		doc = map[string]any{}
+	}
+	return doc, nil
+}
+
+// Checks a config file against the schema. Every problem is reported,
+// each as a *ConfigError, joined with errors.Join.
+func ValidateConfig(data []byte, format ConfigFormat) error {
+	_, err := parseConfig(data, format)
+	return err
+}
+
+// What LoadConfig needs from the host
+type ConfigOptions struct {
+	// Relative paths are taken from here, the working directory when
+	// empty. LoadConfigFile defaults it to the directory of the file
+	Dir string
+	// The streams "inherit" refers to, the ones of the process when nil
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Host modules the HostModules of a file can name, each a set of
+	// functions as for Linker.DefineExposedFuncs
+	HostModules map[string]map[string]*ExposedFunc
+}
+
+// A loaded config file. Close releases the files and directories it
+// opened once the VMs using it are done.
+type LoadedConfig struct {
+	VM *VMConfig
+	// Nil when the file has no WASI section
+	WASI *WASIConfig
+	// Functions to define, by the module name imports use
+	HostModules map[string]map[string]*ExposedFunc
+	closers     []io.Closer
+}
+
+// Defines WASI, when configured, and the host modules in a new linker
+func (lc *LoadedConfig) Linker() (*Linker, error) {
+	l := NewLinker()
+	if lc.WASI != nil {
+		if _, err := l.DefineWASI(lc.WASI); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(lc.HostModules)) {
+		if _, err := l.DefineExposedFuncs(name, lc.HostModules[name]); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (lc *LoadedConfig) Close() error {
+	var errs []error
+	for _, c := range lc.closers {
+		errs = append(errs, c.Close())
+	}
+	lc.closers = nil
+	return errors.Join(errs...)
+}
+
+// The file format of wasiConfigSchema, for decoding
+type wasiConfigFile struct {
+	Args     []string
+	Env      []string
+	Preopens []struct {
+		Host  string
+		Guest string
+	}
+}
+
+// Takes key out of doc, matching like encoding/json would
+func takeConfigKey(doc map[string]any, name string) (any, string, bool) {
+	for key, v := range doc {
+		if strings.EqualFold(key, name) {
+			delete(doc, key)
+			return v, key, true
+		}
+	}
+	return nil, "", false
+}
+
+// Turns the document back into JSON for encoding/json to decode into
+// out. The schema has been checked, so failures are unexpected.
+func decodeConfigValue(v any, path string, out any) error {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(data, out)
+	}
+	if err != nil {
+		return NewConfigError(ConfigInvalidValue, path, err, err)
+	}
+	return nil
+}
+
+// Reads a config file in the given format. opts may be nil. Streams,
+// preopens and host modules are resolved, so the result is ready for
+// Instantiate and DefineWASI.
+func LoadConfig(data []byte, format ConfigFormat, opts *ConfigOptions) (*LoadedConfig, error) {
+	if opts == nil {
+		opts = &ConfigOptions{}
+	}
+	doc, err := parseConfig(data, format)
+	if err != nil {
+		return nil, err
+	}
+	lc := &LoadedConfig{VM: &VMConfig{}}
+	ok := false
+	defer func() {
+		if !ok {
+			lc.Close()
+		}
+	}()
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) || opts.Dir == "" {
+			return path
+		}
+		return filepath.Join(opts.Dir, path)
+	}
+
+	outputs := map[string]io.Writer{}
+	for _, name := range []string{"Stdin", "Stdout", "Stderr"} {
+		v, key, found := takeConfigKey(doc, name)
+		if !found || v == nil {
+			continue
+		}
+		ref := v.(string)
+		var err error
+		switch name {
+		case "Stdin":
+			var r io.Reader
+			r, err = lc.openInput(ref, resolve, opts)
+			lc.VM.SetStdin(r)
+		case "Stdout":
+			var w io.Writer
+			w, err = lc.openOutput(ref, resolve, opts.Stdout, os.Stdout, outputs)
+			lc.VM.SetStdout(w)
+		default:
+			var w io.Writer
+			w, err = lc.openOutput(ref, resolve, opts.Stderr, os.Stderr, outputs)
+			lc.VM.SetStderr(w)
+		}
+		if err != nil {
+			return nil, NewConfigError(ConfigOpenFailed, key, err, err)
+		}
+	}
+
+	if v, key, found := takeConfigKey(doc, "HostModules"); found && v != nil {
+		lc.HostModules = map[string]map[string]*ExposedFunc{}
+		for module, name := range v.(map[string]any) {
+			funcs, ok := opts.HostModules[name.(string)]
+			if !ok {
+				return nil, NewConfigError(ConfigUnknownHostModule, joinConfigPath(key, module), nil, name)
+			}
+			lc.HostModules[module] = funcs
+		}
+	}
+
+	if v, key, found := takeConfigKey(doc, "WASI"); found && v != nil {
+		var wf wasiConfigFile
+		if err := decodeConfigValue(v, key, &wf); err != nil {
+			return nil, err
+		}
+		lc.WASI = &WASIConfig{}
+		lc.WASI.SetArgs(wf.Args...)
+		for _, kv := range wf.Env {
+			if !strings.Contains(kv, "=") {
+				val, set := os.LookupEnv(kv)
+				if !set {
+					continue
+				}
+				kv += "=" + val
+			}
+			lc.WASI.Env = append(lc.WASI.Env, kv)
+		}
+		for i, p := range wf.Preopens {
+			dir, err := NewDirFS(resolve(p.Host))
+			if err != nil {
+				return nil, NewConfigError(ConfigOpenFailed, fmt.Sprintf("%s.Preopens[%d].Host", key, i), err, err)
+			}
+			lc.closers = append(lc.closers, dir)
+			guest := p.Guest
+			if guest == "" {
+				guest = p.Host
+			}
+			lc.WASI.AddPreopen(guest, dir)
+		}
+	}
+
+	if err := decodeConfigValue(doc, "", lc.VM); err != nil {
+		return nil, err
+	}
+	if lc.VM.Image != nil && lc.VM.Image.Filename != "" {
+		lc.VM.Image.Filename = resolve(lc.VM.Image.Filename)
+	}
+	ok = true
+	return lc, nil
+}
+
+// Opens the stream a Stdin reference names
+func (lc *LoadedConfig) openInput(ref string, resolve func(string) string, opts *ConfigOptions) (io.Reader, error) {
+	switch ref {
+	case "inherit":
+		if opts.Stdin != nil {
+			return opts.Stdin, nil
+		}
+		return os.Stdin, nil
+	case "null":
+		return bytes.NewReader(nil), nil
+	}
+	f, err := os.Open(resolve(ref))
+	if err != nil {
+		return nil, err
+	}
+	lc.closers = append(lc.closers, f)
+	return f, nil
+}
+
+// Opens the stream a Stdout or Stderr reference names. A file named for
+// both, such as one log, is opened once and shared through opened.
+func (lc *LoadedConfig) openOutput(ref string, resolve func(string) string, inherit io.Writer, process *os.File, opened map[string]io.Writer) (io.Writer, error) {
+	switch ref {
+	case "inherit":
+		if inherit != nil {
+			return inherit, nil
+		}
+		return process, nil
+	case "null":
+		return io.Discard, nil
+	}
+	path := resolve(ref)
+	if w, ok := opened[path]; ok {
+		return w, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	lc.closers = append(lc.closers, f)
+	opened[path] = f
+	return f, nil
+}
+
+// Reads the config file at path, in the format its extension names.
+// Relative paths in it are taken from its directory unless opts.Dir is
+// set.
+func LoadConfigFile(path string, opts *ConfigOptions) (*LoadedConfig, error) {
+	format, err := ConfigFormatForPath(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	o := ConfigOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Dir == "" {
+		o.Dir = filepath.Dir(path)
+	}
+	return LoadConfig(data, format, &o)
+}
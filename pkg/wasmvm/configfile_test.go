@@ -0,0 +1,261 @@
+package wasmvm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const configTestYAML = `
+size: 64KiB
+maxMemory: 1MiB
+fuel: 100000
+mode: protected
+memoryModel: sharded
+strict: true
+flatMemory: [1, 2, 3]
+image:
+  type: array
+  array: AQID
+rings:
+  1: {enabled: true}
+entryPoint: main
+stdin: input.txt
+stdout: inherit
+stderr: "null"
+wasi:
+  args: [prog, one]
+  env: [A=1, WASMVM_CONFIG_PASS, WASMVM_CONFIG_UNSET]
+  preopens:
+    - host: data
+      guest: /data
+    - host: data
+hostModules:
+  env: math
+`
+
+func TestLoadConfig_YAML(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "input.txt"), []byte("in"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "data"), 0o755))
+	t.Setenv("WASMVM_CONFIG_PASS", "yes")
+	double, err := wasmvm.NewHostFunc(func(x int32) int32 { return 2 * x })
+	require.NoError(t, err)
+	var stdout bytes.Buffer
+
+	lc, err := wasmvm.LoadConfig([]byte(configTestYAML), wasmvm.ConfigYAML, &wasmvm.ConfigOptions{
+		Dir:         dir,
+		Stdout:      &stdout,
+		HostModules: map[string]map[string]*wasmvm.ExposedFunc{"math": {"double": double}},
+	})
+	require.NoError(t, err)
+	defer lc.Close()
+
+	vc := lc.VM
+	assert.Equal(t, uint64(64<<10), vc.Size)
+	assert.Equal(t, uint64(1<<20), vc.MaxMemory)
+	assert.Equal(t, uint64(100000), vc.Fuel)
+	assert.Equal(t, wasmvm.ProtectedMode, vc.Mode)
+	assert.Equal(t, wasmvm.ShardedMemoryModel, vc.MemoryModel)
+	assert.True(t, vc.Strict)
+	assert.Equal(t, []byte{1, 2, 3}, vc.FlatMemory)
+	assert.Equal(t, &wasmvm.ImageConfig{Type: wasmvm.Array, Array: []byte{1, 2, 3}}, vc.Image)
+	assert.Equal(t, map[uint8]wasmvm.RingConfig{1: {Enabled: true}}, vc.Rings)
+	assert.Equal(t, "main", vc.EntryPoint)
+	in, err := io.ReadAll(vc.Stdin)
+	require.NoError(t, err)
+	assert.Equal(t, "in", string(in))
+	assert.Same(t, &stdout, vc.Stdout)
+	assert.NotNil(t, vc.Stderr)
+
+	require.NotNil(t, lc.WASI)
+	assert.Equal(t, []string{"prog", "one"}, lc.WASI.Args)
+	assert.Equal(t, []string{"A=1", "WASMVM_CONFIG_PASS=yes"}, lc.WASI.Env)
+	require.Len(t, lc.WASI.Preopens, 2)
+	assert.Equal(t, "/data", lc.WASI.Preopens[0].GuestPath)
+	assert.Equal(t, "data", lc.WASI.Preopens[1].GuestPath)
+
+	m, err := wasmvm.ParseWAT(`(module
+	  (import "env" "double" (func $d (param i32) (result i32)))
+	  (func (export "run") (param i32) (result i32) local.get 0 call $d))`)
+	require.NoError(t, err)
+	l, err := lc.Linker()
+	require.NoError(t, err)
+	_, ok := l.Lookup(wasmvm.WASIModuleName, "fd_write")
+	assert.True(t, ok)
+	inst, err := wasmvm.Instantiate(m, l, &wasmvm.VMConfig{})
+	require.NoError(t, err)
+	r, err := inst.ExportedFunction("run").Call(context.Background(), 21)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), r[0])
+}
+
+func TestLoadConfig_JSON(t *testing.T) {
+	// What encoding/json makes of a VMConfig loads back as is
+	vc := (&wasmvm.VMConfig{}).SetSize(1024).SetFuel(5).SetEntryPoint("go").SetSeed(9).SetFlatMemory([]byte{7, 8})
+	vc.Image = &wasmvm.ImageConfig{Type: wasmvm.SparseArray, Sparse: []wasmvm.SparseArrayEntry{{Offset: 4, Array: []byte{1}}}}
+	data, err := json.Marshal(vc)
+	require.NoError(t, err)
+	lc, err := wasmvm.LoadConfig(data, wasmvm.ConfigJSON, nil)
+	require.NoError(t, err)
+	assert.Equal(t, vc, lc.VM)
+	assert.Nil(t, lc.WASI)
+
+	lc, err = wasmvm.LoadConfig([]byte(`{"size": "2KiB", "rings": {"0": {"Enabled": true}}, "image": {"type": "file", "filename": "img.bin"}}`), wasmvm.ConfigJSON, &wasmvm.ConfigOptions{Dir: "/cfg"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2048), lc.VM.Size)
+	assert.Equal(t, filepath.Join("/cfg", "img.bin"), lc.VM.Image.Filename)
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vm.yml")
+	require.NoError(t, os.WriteFile(path, []byte("stdout: out.log\nstderr: out.log\n"), 0o644))
+	lc, err := wasmvm.LoadConfigFile(path, nil)
+	require.NoError(t, err)
+	assert.Same(t, lc.VM.Stdout, lc.VM.Stderr)
+
+	l, err := lc.Linker()
+	require.NoError(t, err)
+	_, err = l.DefineWASI(nil)
+	require.NoError(t, err)
+	inst, err := wasmvm.Instantiate(mustDecode(t, wasiTestModule), l, lc.VM)
+	require.NoError(t, err)
+	code, ok := wasmvm.ExitCode(inst.Run(context.Background()))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(7), code)
+	require.NoError(t, lc.Close())
+	out, err := os.ReadFile(filepath.Join(dir, "out.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "hi\n", string(out))
+
+	_, err = wasmvm.LoadConfigFile(filepath.Join(dir, "vm.toml"), nil)
+	var ce *wasmvm.ConfigError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, wasmvm.ConfigUnknownFormat, ce.Type)
+	_, err = wasmvm.LoadConfigFile(filepath.Join(dir, "missing.json"), nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func mustDecode(t *testing.T, bin []byte) *wasmvm.Module {
+	m, err := wasmvm.DecodeModule(bin)
+	require.NoError(t, err)
+	return m
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		format wasmvm.ConfigFormat
+		src    string
+		expect []string
+	}{
+		{name: "valid", src: `{"EntryPoint": "x", "Seed": null}`},
+		{name: "empty yaml", format: wasmvm.ConfigYAML, src: ``},
+		{name: "syntax", src: `{"Size": }`, expect: []string{"[ConfigSyntax] invalid character"}},
+		{name: "trailing", src: `{} {}`, expect: []string{"[ConfigSyntax] data after the top-level value"}},
+		{name: "yaml syntax", format: wasmvm.ConfigYAML, src: "a: [", expect: []string{"[ConfigSyntax] yaml:"}},
+		{name: "not an object", src: `[]`, expect: []string{"[ConfigTypeMismatch] expected an object, got a list"}},
+		{
+			name: "every problem",
+			src: `{"Fuell": 1, "Size": -1, "MaxThreads": 4294967296, "Mode": "turbo", "Strict": "yes",
+				"MaxMemory": "12 parsecs", "FlatMemory": "!!", "Rings": {"256": {}, "1": {"On": true}},
+				"Image": {"format": "zip", "sparsearray": [{"array": [1, 300, "x"]}]},
+				"WASI": {"Args": [1], "Preopens": [{"Guest": "/"}]}, "HostModules": {"env": 3}}`,
+			expect: []string{
+				"[ConfigInvalidValue] FlatMemory: invalid base64",
+				"[ConfigUnknownField] Fuell: unknown field",
+				"[ConfigTypeMismatch] HostModules.env: expected a string, got a number",
+				"[ConfigInvalidValue] Image.format: [UnknownImageType] unknown image format: \"zip\"",
+				"[ConfigOutOfRange] Image.sparsearray[0].array[1]: 300 does not fit in 8 bits",
+				"[ConfigTypeMismatch] Image.sparsearray[0].array[2]: expected a byte, got a string",
+				"[ConfigInvalidValue] MaxMemory: invalid size \"12 parsecs\"",
+				"[ConfigOutOfRange] MaxThreads: 4294967296 does not fit in 32 bits",
+				"[ConfigInvalidValue] Mode: unknown execution mode: \"turbo\"",
+				"[ConfigUnknownField] Rings.1.On: unknown field",
+				"[ConfigOutOfRange] Rings.256: \"256\" does not fit in 8 bits",
+				"[ConfigTypeMismatch] Size: expected a size, got a number",
+				"[ConfigTypeMismatch] Strict: expected a boolean, got a string",
+				"[ConfigTypeMismatch] WASI.Args[0]: expected a string, got a number",
+				"[ConfigMissingField] WASI.Preopens[0].Host: required",
+			},
+		},
+		{
+			name:   "yaml paths",
+			format: wasmvm.ConfigYAML,
+			src:    "wasi:\n  preopens:\n    - host: 7\n",
+			expect: []string{"[ConfigTypeMismatch] wasi.preopens[0].host: expected a string, got a number"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := wasmvm.ValidateConfig([]byte(tc.src), tc.format)
+			if tc.expect == nil {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			var msgs []string
+			if joined, ok := err.(interface{ Unwrap() []error }); ok {
+				for _, e := range joined.Unwrap() {
+					msgs = append(msgs, e.Error())
+				}
+			} else {
+				msgs = []string{err.Error()}
+			}
+			require.Len(t, msgs, len(tc.expect), strings.Join(msgs, "\n"))
+			for i := range msgs {
+				assert.True(t, strings.HasPrefix(msgs[i], tc.expect[i]), msgs[i])
+			}
+			var ce *wasmvm.ConfigError
+			assert.True(t, errors.As(err, &ce))
+		})
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		src    string
+		expect wasmvm.ConfigErrorType
+		path   string
+	}{
+		{name: "schema", src: `{"Fuel": "lots"}`, expect: wasmvm.ConfigTypeMismatch, path: "Fuel"},
+		{name: "host module", src: `{"HostModules": {"env": "nope"}}`, expect: wasmvm.ConfigUnknownHostModule, path: "HostModules.env"},
+		{name: "stdin", src: `{"Stdin": "missing.txt"}`, expect: wasmvm.ConfigOpenFailed, path: "Stdin"},
+		{name: "stdout", src: `{"Stdout": "no/such/dir/out"}`, expect: wasmvm.ConfigOpenFailed, path: "Stdout"},
+		{name: "preopen", src: `{"WASI": {"Preopens": [{"Host": "missing"}]}}`, expect: wasmvm.ConfigOpenFailed, path: "WASI.Preopens[0].Host"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := wasmvm.LoadConfig([]byte(tc.src), wasmvm.ConfigJSON, &wasmvm.ConfigOptions{Dir: dir})
+			var ce *wasmvm.ConfigError
+			require.ErrorAs(t, err, &ce)
+			assert.Equal(t, tc.expect, ce.Type, ce.Error())
+			assert.Equal(t, tc.path, ce.Path)
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expect := range map[string]uint64{"0": 0, "65536": 65536, "64KiB": 64 << 10, "16 MiB": 16 << 20, "1GiB": 1 << 30, "3B": 3} {
+		n, err := wasmvm.ParseSize(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expect, n, s)
+	}
+	for _, s := range []string{"", "lots", "-1", "1.5MiB", "17179869184GiB"} {
+		_, err := wasmvm.ParseSize(s)
+		assert.Error(t, err, s)
+	}
+}
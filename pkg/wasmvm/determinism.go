@@ -0,0 +1,87 @@
+package wasmvm
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"sync"
+)
+
+// Deterministic mode makes a VM give bit-identical results for the same
+// inputs on any machine. NaNs coming out of float arithmetic are
+// canonicalized, threads can't be spawned, the WASI clocks and
+// randomness come from virtual sources seeded by VMConfig.Seed, and
+// an instance may only import functions marked deterministic.
+
+// Where the virtual wall clock starts, 2000-01-01T00:00:00Z
+const virtualEpoch = 946684800 * 1e9
+
+// Every read of the virtual clock moves it on by this much, so that
+// time never stands still for the guest
+const virtualTick = 1000
+
+// The virtual clock and randomness of a deterministic VM
+type virtualSources struct {
+	mu    sync.Mutex
+	rand  *rand.ChaCha8
+	clock uint64 // Nanoseconds since the VM started
+}
+
+func newVirtualSources(seed uint64) *virtualSources {
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], seed)
+	return &virtualSources{rand: rand.NewChaCha8(key)}
+}
+
+// Nanoseconds since the VM started, ticking on every call
+func (v *virtualSources) now() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.clock += virtualTick
+	return v.clock
+}
+
+func (v *virtualSources) Read(p []byte) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.rand.Read(p)
+}
+
+// Whether a deterministic instance may import ef. Exports of other
+// instances are as deterministic as the VM they run in.
+func (ef *ExposedFunc) isDeterministic() bool {
+	if ef.owner != nil {
+		return ef.owner.VM.deterministic
+	}
+	return ef.Deterministic
+}
+
+// Marks ef as giving the same results for the same arguments and VM
+// state, which deterministic instances require of their imports
+func (ef *ExposedFunc) SetDeterministic(deterministic bool) *ExposedFunc {
+	ef.Deterministic = deterministic
+	return ef
+}
+
+// The imports of m, resolved to res, that aren't deterministic
+func nondeterministicImports(m *Module, res *ResolvedImports) []string {
+	var names []string
+	funcs, tables := res.Funcs, res.Tables
+	for _, imp := range m.Imports {
+		switch imp.Kind {
+		case ExternFunc:
+			if !funcs[0].isDeterministic() {
+				names = append(names, imp.Module+"."+imp.Name)
+			}
+			funcs = funcs[1:]
+		case ExternTable:
+			for _, ef := range tables[0].Elements {
+				if ef != nil && !ef.isDeterministic() {
+					names = append(names, imp.Module+"."+imp.Name)
+					break
+				}
+			}
+			tables = tables[1:]
+		}
+	}
+	return names
+}
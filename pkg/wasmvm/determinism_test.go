@@ -0,0 +1,174 @@
+package wasmvm_test
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// div32 and neg32 on f32, add64 on f64 and call, which calls env.f
+var determinismTestModule = wasmBinary(
+	wasmSection(wasmvm.SectionType, wasmVec(
+		wasmFuncType([]byte{wasmF32, wasmF32}, []byte{wasmF32}),
+		wasmFuncType([]byte{wasmF32}, []byte{wasmF32}),
+		wasmFuncType([]byte{wasmF64, wasmF64}, []byte{wasmF64}),
+		wasmFuncType(nil, nil),
+	)...),
+	wasmSection(wasmvm.SectionImport, wasmVec(
+		wasmCat(wasmName("env"), wasmName("f"), []byte{0x00, 0x03}),
+	)...),
+	wasmSection(wasmvm.SectionFunction, wasmVec([]byte{0x00}, []byte{0x01}, []byte{0x02}, []byte{0x03})...),
+	wasmSection(wasmvm.SectionExport, wasmVec(
+		wasmCat(wasmName("div32"), []byte{0x00, 0x01}),
+		wasmCat(wasmName("neg32"), []byte{0x00, 0x02}),
+		wasmCat(wasmName("add64"), []byte{0x00, 0x03}),
+		wasmCat(wasmName("call"), []byte{0x00, 0x04}),
+	)...),
+	wasmSection(wasmvm.SectionCode, wasmVec(
+		wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_DIV_F32, wasmvm.OP_END),
+		wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_NEG_F32, wasmvm.OP_END),
+		wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_ADD_F64, wasmvm.OP_END),
+		wasmBody(wasmvm.OP_CALL, 0, wasmvm.OP_END),
+	)...),
+)
+
+func newDeterminismTestInstance(t *testing.T, deterministic, mark bool) (*wasmvm.Instance, error) {
+	t.Helper()
+	m, err := wasmvm.DecodeModule(determinismTestModule)
+	require.NoError(t, err)
+	f := wasmvm.HostFunc0_0(func(context.Context, *wasmvm.VMState) error { return nil })
+	if mark {
+		f.SetDeterministic(true)
+	}
+	l, err := wasmvm.NewLinker().DefineFunc("env", "f", f)
+	require.NoError(t, err)
+	return wasmvm.Instantiate(m, l, new(wasmvm.VMConfig).SetDeterministic(deterministic))
+}
+
+func TestDeterministic_NaN(t *testing.T) {
+	ctx := context.Background()
+	payload32 := uint64(0xFFA00001)
+	payload64 := uint64(0xFFF4000000000001)
+
+	inst, err := newDeterminismTestInstance(t, true, true)
+	require.NoError(t, err)
+	r, err := inst.ExportedFunction("div32").Call(ctx, wasmvm.EncodeValue(float32(0)), wasmvm.EncodeValue(float32(0)))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x7FC00000), r[0])
+	r, err = inst.ExportedFunction("add64").Call(ctx, payload64, wasmvm.EncodeValue(1.0))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x7FF8000000000000), r[0])
+	// neg is a bit operation and keeps the payload
+	r, err = inst.ExportedFunction("neg32").Call(ctx, payload32)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x7FA00001), r[0])
+	// Ordinary results are left alone
+	r, err = inst.ExportedFunction("div32").Call(ctx, wasmvm.EncodeValue(float32(1)), wasmvm.EncodeValue(float32(4)))
+	require.NoError(t, err)
+	assert.Equal(t, float32(0.25), wasmvm.DecodeValue[float32](r[0]))
+
+	// Without deterministic mode the payload comes through
+	inst, err = newDeterminismTestInstance(t, false, false)
+	require.NoError(t, err)
+	r, err = inst.ExportedFunction("add64").Call(ctx, payload64, wasmvm.EncodeValue(1.0))
+	require.NoError(t, err)
+	assert.True(t, math.IsNaN(wasmvm.DecodeValue[float64](r[0])))
+	assert.NotEqual(t, uint64(0x7FF8000000000000), r[0])
+}
+
+func TestDeterministic_Imports(t *testing.T) {
+	_, err := newDeterminismTestInstance(t, true, false)
+	var ie *wasmvm.InstanceError
+	require.ErrorAs(t, err, &ie)
+	assert.Equal(t, wasmvm.InstanceNondeterministic, ie.Type)
+	assert.Contains(t, ie.Msg, "env.f")
+
+	_, err = newDeterminismTestInstance(t, false, false)
+	assert.NoError(t, err)
+
+	// fd_write and proc_exit only see the standard streams
+	m, err := wasmvm.DecodeModule(wasiTestModule)
+	require.NoError(t, err)
+	l, err := wasmvm.NewLinker().DefineWASI(nil)
+	require.NoError(t, err)
+	_, err = wasmvm.Instantiate(m, l, new(wasmvm.VMConfig).SetDeterministic(true))
+	assert.NoError(t, err)
+}
+
+func TestDeterministic_WASIImports(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		config *wasmvm.WASIConfig
+		ok     bool
+	}{
+		{name: "args_get", params: "i32 i32", ok: true},
+		{name: "clock_time_get", params: "i32 i64 i32", ok: true},
+		{name: "clock_time_get", params: "i32 i64 i32", config: new(wasmvm.WASIConfig).SetClock(time.Now)},
+		{name: "random_get", params: "i32 i32", ok: true},
+		{name: "random_get", params: "i32 i32", config: new(wasmvm.WASIConfig).SetRand(strings.NewReader("x"))},
+		{name: "fd_read", params: "i32 i32 i32 i32"},
+		{name: "path_open", params: "i32 i32 i32 i32 i32 i64 i64 i32 i32"},
+		{name: "sock_accept", params: "i32 i32 i32"},
+		// Not implemented, it only ever fails
+		{name: "path_symlink", params: "i32 i32 i32 i32 i32", ok: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := wasmvm.ParseWAT(`(import "wasi_snapshot_preview1" "` + tc.name + `" (func (param ` + tc.params + `) (result i32)))`)
+			require.NoError(t, err)
+			l, err := wasmvm.NewLinker().DefineWASI(tc.config)
+			require.NoError(t, err)
+			_, err = wasmvm.Instantiate(m, l, new(wasmvm.VMConfig).SetDeterministic(true))
+			if tc.ok {
+				assert.NoError(t, err)
+				return
+			}
+			var ie *wasmvm.InstanceError
+			require.ErrorAs(t, err, &ie)
+			assert.Equal(t, wasmvm.InstanceNondeterministic, ie.Type)
+		})
+	}
+}
+
+func TestDeterministic_Threads(t *testing.T) {
+	vm, err := new(wasmvm.VMConfig).SetSize(64).SetMode(wasmvm.ProtectedMode).SetDeterministic(true).BuildVMState()
+	require.NoError(t, err)
+	_, err = vm.SpawnThread(0, 0)
+	var te *wasmvm.ThreadError
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, wasmvm.ThreadDeterministic, te.Type)
+}
+
+func TestDeterministic_WASISources(t *testing.T) {
+	l, err := wasmvm.NewLinker().DefineWASI(nil)
+	require.NoError(t, err)
+	sample := func(seed uint64) ([]byte, []uint64) {
+		vm, err := new(wasmvm.VMConfig).SetSize(64).SetDeterministic(true).SetSeed(seed).BuildVMState()
+		require.NoError(t, err)
+		mem := vm.Memory.(*wasmvm.FlatMemory).Bytes()
+		require.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "random_get", i32(0), i32(16)))
+		var times []uint64
+		for _, clock := range []uint32{0, 1, 1} {
+			require.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "clock_time_get", i32(clock), i64(1), i32(32)))
+			times = append(times, binary.LittleEndian.Uint64(mem[32:]))
+		}
+		return append([]byte(nil), mem[:16]...), times
+	}
+
+	rand1, times1 := sample(1)
+	rand2, times2 := sample(1)
+	rand3, _ := sample(2)
+	assert.Equal(t, rand1, rand2)
+	assert.NotEqual(t, rand1, rand3)
+	assert.Equal(t, times1, times2)
+	// The clocks only move when read
+	assert.Equal(t, []uint64{946684800_000_001_000, 2000, 3000}, times1)
+}
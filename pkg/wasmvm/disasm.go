@@ -0,0 +1,500 @@
+package wasmvm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A listing of a module in WAT-like syntax, for the inspect command,
+// debuggers and error messages
+
+// Where a section sits in a binary
+type SectionInfo struct {
+	ID     SectionID
+	Name   string // Of a custom section
+	Offset uint64 // Of the section id
+	Size   uint64 // Of the payload
+}
+
+// Lists the sections of a binary in order, without decoding them
+func ModuleSections(data []byte) ([]SectionInfo, error) {
+	if len(data) < 8 || !bytes.Equal(data[:4], ModuleMagic) {
+		return nil, NewModuleError(ModuleBadMagic, 0, nil)
+	}
+	r := &moduleReader{data: data, pos: 8}
+	var sections []SectionInfo
+	for !r.done() {
+		info := SectionInfo{Offset: r.offset()}
+		id, _ := r.readByte()
+		info.ID = SectionID(id)
+		size, err := r.readU32()
+		if err != nil {
+			return nil, err
+		}
+		info.Size = uint64(size)
+		payload, err := r.readBytes(info.Size)
+		if err != nil {
+			return nil, err
+		}
+		if info.ID == SectionCustom {
+			sr := &moduleReader{data: payload, base: r.offset() - info.Size}
+			if info.Name, err = sr.readName(); err != nil {
+				return nil, err
+			}
+		}
+		sections = append(sections, info)
+	}
+	return sections, nil
+}
+
+// One decoded instruction of a function body or constant expression
+type DecodedInstruction struct {
+	Offset uint64 // Into the binary
+	Depth  int    // How many blocks it's nested in
+	Text   string // As in "i32.load offset=8 align=1"
+}
+
+// Disassembles the body of function idx, which counts imported
+// functions like the function index space does
+func (m *Module) Disassemble(idx uint32) ([]DecodedInstruction, error) {
+	local := int(idx) - m.ImportCount(ExternFunc)
+	if local < 0 || local >= len(m.Code) {
+		return nil, NewModuleError(ModuleInvalidIndex, 0, nil, "defined function", idx)
+	}
+	body := m.Code[local]
+	return disassemble(body.Code, body.Offset)
+}
+
+// Decodes an instruction sequence that is at base in the binary
+func disassemble(code []byte, base uint64) ([]DecodedInstruction, error) {
+	r := &moduleReader{data: code, base: base}
+	var out []DecodedInstruction
+	depth := 0
+	for !r.done() {
+		at := r.offset()
+		op, _ := r.readByte()
+		text, err := r.instructionText(op)
+		if err != nil {
+			return out, err
+		}
+		switch op {
+		case OP_ELSE:
+			out = append(out, DecodedInstruction{Offset: at, Depth: depth - 1, Text: text})
+			continue
+		case OP_END:
+			if depth > 0 {
+				depth--
+			}
+		}
+		out = append(out, DecodedInstruction{Offset: at, Depth: depth, Text: text})
+		if op == OP_BLOCK || op == OP_LOOP || op == OP_IF {
+			depth++
+		}
+	}
+	return out, nil
+}
+
+// Reads the immediates of op and formats the whole instruction
+func (r *moduleReader) instructionText(op byte) (string, error) {
+	kind, sub, err := r.readImmediateKind(op)
+	if err != nil {
+		return "", err
+	}
+	key := opcodeKey{op: op}
+	if op == OP_PREFIX_MISC || op == OP_PREFIX_ATOMIC {
+		key.sub = sub
+	}
+	name := instructionNames[key]
+
+	var args []string
+	u32 := func() uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readU32()
+		}
+		return v
+	}
+	switch kind {
+	case immBlockType:
+		var b byte
+		if b, err = r.readByte(); err != nil {
+			break
+		}
+		if vt, ok := valueTypeEncodings[b]; ok {
+			args = append(args, "(result "+valueTypeNames[vt]+")")
+		} else if b != 0x40 {
+			r.pos--
+			var idx int64
+			idx, err = r.readSigned(33)
+			args = append(args, fmt.Sprintf("(type %d)", idx))
+		}
+	case immU32:
+		v := u32()
+		// Memory zero goes without saying
+		if v != 0 || !(op == OP_MEMORY_SIZE || op == OP_MEMORY_GROW || (op == OP_PREFIX_MISC && sub == 11)) {
+			args = append(args, strconv.FormatUint(uint64(v), 10))
+		}
+	case immU32Pair:
+		a, b := u32(), u32()
+		switch {
+		case op == OP_CALL_INDIRECT:
+			// The type comes first in the binary but last in the text
+			args = append(args, fmt.Sprintf("(type %d)", a))
+			if b != 0 {
+				args = append([]string{strconv.FormatUint(uint64(b), 10)}, args...)
+			}
+		case sub == 12: // table.init has the element segment first too
+			if b != 0 {
+				args = append(args, strconv.FormatUint(uint64(b), 10))
+			}
+			args = append(args, strconv.FormatUint(uint64(a), 10))
+		case sub == 8: // memory.init
+			args = append(args, strconv.FormatUint(uint64(a), 10))
+		case a != 0 || b != 0: // Copies within memory or table zero
+			args = append(args, strconv.FormatUint(uint64(a), 10), strconv.FormatUint(uint64(b), 10))
+		}
+	case immMemArg:
+		align, offset := u32(), u32()
+		if offset != 0 {
+			args = append(args, fmt.Sprintf("offset=%d", offset))
+		}
+		if align < 32 && 1<<align != naturalAlignment(name) {
+			args = append(args, fmt.Sprintf("align=%d", 1<<align))
+		}
+	case immBrTable:
+		var n int
+		if n, err = r.readCount(); err != nil {
+			break
+		}
+		for range n + 1 {
+			args = append(args, strconv.FormatUint(uint64(u32()), 10))
+		}
+	case immSelectTypes:
+		var n int
+		if n, err = r.readCount(); err != nil {
+			break
+		}
+		types := make([]string, n)
+		for i := range types {
+			var vt ValueStackEntryType
+			if vt, err = r.readValType(); err != nil {
+				break
+			}
+			types[i] = valueTypeNames[vt]
+		}
+		args = append(args, "(result "+strings.Join(types, " ")+")")
+	case immS32, immS64:
+		bits := uint(32)
+		if kind == immS64 {
+			bits = 64
+		}
+		var v int64
+		v, err = r.readSigned(bits)
+		args = append(args, strconv.FormatInt(v, 10))
+	case immF32:
+		var raw []byte
+		if raw, err = r.readBytes(4); err == nil {
+			bits := uint64(raw[0]) | uint64(raw[1])<<8 | uint64(raw[2])<<16 | uint64(raw[3])<<24
+			args = append(args, floatText(bits, 32))
+		}
+	case immF64:
+		var raw []byte
+		if raw, err = r.readBytes(8); err == nil {
+			var bits uint64
+			for i := 7; i >= 0; i-- {
+				bits = bits<<8 | uint64(raw[i])
+			}
+			args = append(args, floatText(bits, 64))
+		}
+	case immByte:
+		var b byte
+		if b, err = r.readByte(); err == nil && op == 0xD0 {
+			// ref.null names the heap type rather than the reference type
+			args = append(args, strings.TrimSuffix(RefType(b).String(), "ref"))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(append([]string{name}, args...), " "), nil
+}
+
+// A float as the text format writes it, NaN payloads included
+func floatText(bits uint64, size int) string {
+	mantBits, sign := uint(52), bits>>63 != 0
+	f := math.Float64frombits(bits)
+	if size == 32 {
+		mantBits, sign = 23, bits>>31 != 0
+		f = float64(math.Float32frombits(uint32(bits)))
+	}
+	switch {
+	case math.IsNaN(f):
+		payload := bits & (1<<mantBits - 1)
+		text := "nan"
+		if payload != 1<<(mantBits-1) {
+			text = fmt.Sprintf("nan:0x%x", payload)
+		}
+		if sign {
+			return "-" + text
+		}
+		return text
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, size)
+}
+
+// A constant expression in folded form, like "(i32.const 8)"
+func constExprText(expr []byte) string {
+	code, err := disassemble(expr, 0)
+	if err != nil {
+		return "(;malformed;)"
+	}
+	parts := make([]string, 0, len(code))
+	for _, in := range code {
+		if in.Text != "end" {
+			parts = append(parts, "("+in.Text+")")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func funcTypeText(ft FuncType) string {
+	var parts []string
+	for _, list := range []struct {
+		name  string
+		types []ValueStackEntryType
+	}{{"param", ft.Params}, {"result", ft.Results}} {
+		if len(list.types) == 0 {
+			continue
+		}
+		names := make([]string, len(list.types))
+		for i, vt := range list.types {
+			names[i] = valueTypeNames[vt]
+		}
+		parts = append(parts, "("+list.name+" "+strings.Join(names, " ")+")")
+	}
+	return strings.Join(parts, " ")
+}
+
+func limitsText(l Limits) string {
+	if l.Max == nil {
+		return strconv.FormatUint(l.Min, 10)
+	}
+	return fmt.Sprintf("%d %d", l.Min, *l.Max)
+}
+
+func globalTypeText(gt GlobalType) string {
+	if gt.Mutable {
+		return "(mut " + valueTypeNames[gt.ValType] + ")"
+	}
+	return valueTypeNames[gt.ValType]
+}
+
+// Longest data segment shown in full
+const listingDataLimit = 64
+
+// A quoted string with everything but printable ASCII escaped
+func watQuote(data []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, b := range data {
+		if b >= 0x20 && b < 0x7F && b != '"' && b != '\\' {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "\\%02x", b)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// Width of the offset column in front of instructions
+const listingMargin = 12
+
+// Writes the module as WAT-like text. Indices are spelled out where
+// the text format would allow leaving them implicit, exports are noted
+// next to what they export, and each instruction is prefixed with its
+// offset in the binary. A body that doesn't decode is listed up to the
+// bad instruction and the error is noted there.
+func (m *Module) WriteListing(w io.Writer) error {
+	lw := &listingWriter{w: w}
+	exports := map[ExternType]map[uint32][]string{}
+	for _, exp := range m.Exports {
+		if exports[exp.Kind] == nil {
+			exports[exp.Kind] = map[uint32][]string{}
+		}
+		exports[exp.Kind][exp.Index] = append(exports[exp.Kind][exp.Index], strconv.Quote(exp.Name))
+	}
+	exported := func(kind ExternType, idx uint32) string {
+		if names := exports[kind][idx]; len(names) > 0 {
+			return "  ;; export " + strings.Join(names, ", ")
+		}
+		return ""
+	}
+
+	lw.line("", 0, "(module")
+	for i, ft := range m.Types {
+		lw.line("", 1, "(type %d %s)", i, strings.TrimSpace("(func "+funcTypeText(ft))+")")
+	}
+	counts := map[ExternType]uint32{}
+	for _, imp := range m.Imports {
+		idx := counts[imp.Kind]
+		counts[imp.Kind]++
+		var desc string
+		switch imp.Kind {
+		case ExternFunc:
+			desc = fmt.Sprintf("(func %d (type %d))", idx, imp.Func)
+		case ExternTable:
+			desc = fmt.Sprintf("(table %d %s %s)", idx, limitsText(imp.Table.Limits), imp.Table.ElemType)
+		case ExternMemory:
+			desc = fmt.Sprintf("(memory %d %s%s)", idx, limitsText(imp.Memory.Limits), sharedText(imp.Memory.Shared))
+		case ExternGlobal:
+			desc = fmt.Sprintf("(global %d %s)", idx, globalTypeText(imp.Global))
+		}
+		lw.line("", 1, "(import %q %q %s)%s", imp.Module, imp.Name, desc, exported(imp.Kind, idx))
+	}
+	for i, tt := range m.Tables {
+		idx := counts[ExternTable] + uint32(i)
+		lw.line("", 1, "(table %d %s %s)%s", idx, limitsText(tt.Limits), tt.ElemType, exported(ExternTable, idx))
+	}
+	for i, mt := range m.Memories {
+		idx := counts[ExternMemory] + uint32(i)
+		lw.line("", 1, "(memory %d %s%s)%s", idx, limitsText(mt.Limits), sharedText(mt.Shared), exported(ExternMemory, idx))
+	}
+	for i, g := range m.Globals {
+		idx := counts[ExternGlobal] + uint32(i)
+		lw.line("", 1, "(global %d %s %s)%s", idx, globalTypeText(g.Type), constExprText(g.Init), exported(ExternGlobal, idx))
+	}
+	if m.Start != nil {
+		lw.line("", 1, "(start %d)", *m.Start)
+	}
+	for i, seg := range m.Elements {
+		lw.line("", 1, "(elem %d %s)", i, elemText(seg))
+	}
+	for i, seg := range m.Data {
+		text := fmt.Sprintf("(data %d", i)
+		if seg.Mode == SegmentActive {
+			if seg.Memory != 0 {
+				text += fmt.Sprintf(" (memory %d)", seg.Memory)
+			}
+			text += " " + constExprText(seg.Offset)
+		}
+		if len(seg.Init) > listingDataLimit {
+			text += fmt.Sprintf(" %s...)  ;; %d bytes", watQuote(seg.Init[:listingDataLimit]), len(seg.Init))
+		} else {
+			text += " " + watQuote(seg.Init) + ")"
+		}
+		lw.line("", 1, "%s", text)
+	}
+
+	for i, body := range m.Code {
+		idx := counts[ExternFunc] + uint32(i)
+		header := fmt.Sprintf("(func %d (type %d)", idx, m.Funcs[i])
+		if sig := funcTypeText(m.Types[m.Funcs[i]]); sig != "" {
+			header += " " + sig
+		}
+		lw.line("", 1, "%s%s", header, exported(ExternFunc, idx))
+		for _, l := range body.Locals {
+			names := strings.TrimSpace(strings.Repeat(valueTypeNames[l.Type]+" ", int(l.Count)))
+			lw.line("", 2, "(local %s)", names)
+		}
+		code, err := disassemble(body.Code, body.Offset)
+		for _, in := range code {
+			lw.line(fmt.Sprintf("0x%06x", in.Offset), 2+in.Depth, "%s", in.Text)
+		}
+		if err != nil {
+			lw.line("", 2, ";; %v", err)
+		}
+		lw.line("", 1, ")")
+	}
+	lw.line("", 0, ")")
+	return lw.err
+}
+
+// The listing WriteListing writes, as a string
+func (m *Module) Listing() string {
+	var sb strings.Builder
+	m.WriteListing(&sb)
+	return sb.String()
+}
+
+func sharedText(shared bool) string {
+	if shared {
+		return " shared"
+	}
+	return ""
+}
+
+func elemText(seg ElementSegment) string {
+	var parts []string
+	switch seg.Mode {
+	case SegmentActive:
+		if seg.Table != 0 {
+			parts = append(parts, fmt.Sprintf("(table %d)", seg.Table))
+		}
+		parts = append(parts, constExprText(seg.Offset))
+	case SegmentDeclarative:
+		parts = append(parts, "declare")
+	}
+	if seg.Exprs == nil {
+		parts = append(parts, "func")
+		for _, idx := range seg.Funcs {
+			parts = append(parts, strconv.FormatUint(uint64(idx), 10))
+		}
+		return strings.Join(parts, " ")
+	}
+	parts = append(parts, seg.Type.String())
+	for _, e := range seg.Exprs {
+		parts = append(parts, "(item "+strings.Trim(constExprText(e), "()")+")")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Writes lines with a margin for offsets, keeping the first error
+type listingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (lw *listingWriter) printf(format string, paras ...any) {
+	if lw.err == nil {
+		_, lw.err = fmt.Fprintf(lw.w, format, paras...)
+	}
+}
+
+func (lw *listingWriter) line(margin string, depth int, format string, paras ...any) {
+	lw.printf("%-*s%s%s\n", listingMargin, margin, strings.Repeat("  ", depth), fmt.Sprintf(format, paras...))
+}
+
+// Decodes a binary and writes its sections followed by the listing of
+// the module, as the inspect command shows it
+func InspectModule(w io.Writer, data []byte) error {
+	sections, err := ModuleSections(data)
+	if err != nil {
+		return err
+	}
+	m, err := DecodeModule(data)
+	if err != nil {
+		return err
+	}
+	lw := &listingWriter{w: w}
+	lw.printf(";; %-16s %-10s %s\n", "section", "offset", "size")
+	for _, s := range sections {
+		name := s.ID.String()
+		if s.ID == SectionCustom {
+			name += " " + strconv.Quote(s.Name)
+		}
+		lw.printf(";; %-16s 0x%08x %d\n", name, s.Offset, s.Size)
+	}
+	if lw.err != nil {
+		return lw.err
+	}
+	return m.WriteListing(w)
+}
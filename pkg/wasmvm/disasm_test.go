@@ -0,0 +1,161 @@
+package wasmvm_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleSections(t *testing.T) {
+	sections, err := wasmvm.ModuleSections(linkTestModule)
+	require.NoError(t, err)
+	require.Len(t, sections, 12)
+	assert.Equal(t, wasmvm.SectionInfo{ID: wasmvm.SectionType, Offset: 8, Size: 10}, sections[0])
+	custom := sections[11]
+	assert.Equal(t, wasmvm.SectionCustom, custom.ID)
+	assert.Equal(t, "name", custom.Name)
+	assert.Equal(t, uint64(len(linkTestModule)), custom.Offset+2+custom.Size)
+
+	_, err = wasmvm.ModuleSections(linkTestModule[:len(linkTestModule)-1])
+	var me *wasmvm.ModuleError
+	require.ErrorAs(t, err, &me)
+	assert.Equal(t, wasmvm.ModuleTruncated, me.Type)
+}
+
+const disasmTestWAT = `
+(module
+  (type (func (param i32) (result i32 i32)))
+  (memory 1 1 shared)
+  (table 2 funcref)
+  (data "x")
+  (elem func 0)
+  (elem func 0)
+  (func (param i32) (result f64) (local i64 i64)
+    block (result i32)
+      local.get 0
+      if (type 0)
+        local.get 0
+      else
+        local.get 0
+      end
+      br_table 0 0
+    end
+    select (result i64)
+    drop
+    i32.const -7
+    i64.const 0x7fffffffffffffff
+    f32.const nan:0x1
+    f32.const -inf
+    f64.const 0.1
+    i32.load8_u offset=3
+    i64.load align=1
+    i32.atomic.rmw.cmpxchg offset=4
+    atomic.fence
+    memory.init 0
+    memory.copy
+    memory.size
+    call_indirect (type 0)
+    ref.null extern
+    ref.func 0
+    table.init 1
+    unreachable))
+`
+
+func TestDisassemble(t *testing.T) {
+	m, err := wasmvm.ParseWAT(disasmTestWAT)
+	require.NoError(t, err)
+	code, err := m.Disassemble(0)
+	require.NoError(t, err)
+
+	var texts []string
+	for _, in := range code {
+		texts = append(texts, strings.Repeat("  ", in.Depth)+in.Text)
+	}
+	assert.Equal(t, []string{
+		"block (result i32)",
+		"  local.get 0",
+		"  if (type 0)",
+		"    local.get 0",
+		"  else",
+		"    local.get 0",
+		"  end",
+		"  br_table 0 0",
+		"end",
+		"select (result i64)",
+		"drop",
+		"i32.const -7",
+		"i64.const 9223372036854775807",
+		"f32.const nan:0x1",
+		"f32.const -inf",
+		"f64.const 0.1",
+		"i32.load8_u offset=3",
+		"i64.load align=1",
+		"i32.atomic.rmw.cmpxchg offset=4",
+		"atomic.fence",
+		"memory.init 0",
+		"memory.copy",
+		"memory.size",
+		"call_indirect (type 0)",
+		"ref.null extern",
+		"ref.func 0",
+		"table.init 1",
+		"unreachable",
+		"end",
+	}, texts)
+	assert.Equal(t, m.Code[0].Offset, code[0].Offset)
+	assert.Equal(t, m.Code[0].Offset+2, code[1].Offset)
+
+	// What comes out can be read back in
+	src := strings.Replace(disasmTestWAT, disasmTestWAT[strings.Index(disasmTestWAT, "    block"):], "", 1)
+	for _, text := range texts[:len(texts)-1] {
+		src += text + "\n"
+	}
+	again, err := wasmvm.ParseWAT(src + "))")
+	require.NoError(t, err)
+	assert.Equal(t, m.Code[0].Code, again.Code[0].Code)
+}
+
+func TestDisassemble_Errors(t *testing.T) {
+	m, err := wasmvm.DecodeModule(instanceTestModule)
+	require.NoError(t, err)
+	_, err = m.Disassemble(0) // Imported
+	var me *wasmvm.ModuleError
+	require.ErrorAs(t, err, &me)
+	assert.Equal(t, wasmvm.ModuleInvalidIndex, me.Type)
+
+	m.Code[0].Code = []byte{wasmvm.OP_NOP, 0xFF, wasmvm.OP_END}
+	code, err := m.Disassemble(1)
+	require.ErrorAs(t, err, &me)
+	assert.Equal(t, wasmvm.ModuleMalformed, me.Type)
+	assert.Len(t, code, 1)
+	assert.Contains(t, m.Listing(), "nop\n                ;; [ModuleMalformed]")
+}
+
+func TestInspectModule(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, wasmvm.InspectModule(&out, linkTestModule))
+	listing := out.String()
+	for _, line := range []string{
+		";; type             0x00000008 10\n",
+		";; custom \"name\"    0x000000a0 8\n",
+		"  (import \"env\" \"mem\" (memory 0 1 2))\n",
+		"  (import \"env\" \"counter\" (global 0 (mut i64)))  ;; export \"counter\"\n",
+		"  (global 1 f64 (f64.const 1))\n",
+		"  (elem 1 funcref (item ref.func 1))\n",
+		"  (data 1 \"!\")\n",
+		"  (func 1 (type 1)  ;; export \"run\"\n",
+		"0x000091        nop\n",
+	} {
+		assert.Contains(t, listing, line)
+	}
+
+	m, err := wasmvm.ParseWAT(`(memory 1) (data (i32.const 0) "` + strings.Repeat(`\00`, 100) + `")`)
+	require.NoError(t, err)
+	assert.Contains(t, m.Listing(), `\00"...)  ;; 100 bytes`)
+
+	assert.Error(t, wasmvm.InspectModule(&out, []byte("nope")))
+}
@@ -0,0 +1,387 @@
+package wasmvm
+
+import "encoding/binary"
+
+// Writing a Module back out as a binary, the reverse of DecodeModule
+
+var valueTypeBytes = map[ValueStackEntryType]byte{
+	TYPE_I32: 0x7F,
+	TYPE_I64: 0x7E,
+	TYPE_F32: 0x7D,
+	TYPE_F64: 0x7C,
+}
+
+func appendValType(dst []byte, vt ValueStackEntryType) ([]byte, error) {
+	b, ok := valueTypeBytes[vt]
+	if !ok {
+		return nil, NewModuleError(ModuleUnsupportedType, 0, nil, "value type", int(vt))
+	}
+	return append(dst, b), nil
+}
+
+func appendRefType(dst []byte, rt RefType) ([]byte, error) {
+	if _, ok := refTypeNames[rt]; !ok {
+		return nil, NewModuleError(ModuleUnsupportedType, 0, nil, "reference type", byte(rt))
+	}
+	return append(dst, byte(rt)), nil
+}
+
+func appendName(dst []byte, name string) []byte {
+	return append(AppendULEB128(dst, uint64(len(name))), name...)
+}
+
+func appendLimits(dst []byte, l Limits, shared bool) []byte {
+	var flags byte
+	if l.Max != nil {
+		flags |= 1
+	}
+	if shared {
+		flags |= 2
+	}
+	dst = AppendULEB128(append(dst, flags), l.Min)
+	if l.Max != nil {
+		dst = AppendULEB128(dst, *l.Max)
+	}
+	return dst
+}
+
+func appendTableType(dst []byte, tt TableType) ([]byte, error) {
+	dst, err := appendRefType(dst, tt.ElemType)
+	if err != nil {
+		return nil, err
+	}
+	return appendLimits(dst, tt.Limits, false), nil
+}
+
+func appendGlobalType(dst []byte, gt GlobalType) ([]byte, error) {
+	dst, err := appendValType(dst, gt.ValType)
+	if err != nil {
+		return nil, err
+	}
+	if gt.Mutable {
+		return append(dst, 1), nil
+	}
+	return append(dst, 0), nil
+}
+
+// Payload of a section holding a vector of n entries, nil when there
+// are none so the section can be left out
+func encodeVec(n int, entry func(dst []byte, i int) ([]byte, error)) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	payload := AppendULEB128(nil, uint64(n))
+	for i := range n {
+		var err error
+		if payload, err = entry(payload, i); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+func appendSection(dst []byte, id SectionID, payload []byte) []byte {
+	dst = AppendULEB128(append(dst, byte(id)), uint64(len(payload)))
+	return append(dst, payload...)
+}
+
+// Copies an instruction sequence, rewriting every LEB128 immediate in
+// its shortest form. code is read as if it was at base in the binary,
+// for the offsets in errors.
+func appendCanonicalCode(dst []byte, code []byte, base uint64) ([]byte, error) {
+	r := &moduleReader{data: code, base: base}
+	for !r.done() {
+		op, _ := r.readByte()
+		dst = append(dst, op)
+		kind, sub, err := r.readImmediateKind(op)
+		if err != nil {
+			return nil, err
+		}
+		if op == OP_PREFIX_MISC || op == OP_PREFIX_ATOMIC {
+			dst = AppendULEB128(dst, uint64(sub))
+		}
+
+		switch kind {
+		case immBlockType:
+			b, err := r.readByte()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := valueTypeEncodings[b]; ok || b == 0x40 {
+				dst = append(dst, b)
+				continue
+			}
+			r.pos--
+			idx, err := r.readSigned(33)
+			if err != nil {
+				return nil, err
+			}
+			dst = AppendSLEB128(dst, idx)
+		case immU32:
+			var v uint32
+			v, err = r.readU32()
+			dst = AppendULEB128(dst, uint64(v))
+		case immU32Pair, immMemArg:
+			for range 2 {
+				var v uint32
+				if v, err = r.readU32(); err != nil {
+					break
+				}
+				dst = AppendULEB128(dst, uint64(v))
+			}
+		case immBrTable, immSelectTypes:
+			var n int
+			if n, err = r.readCount(); err != nil {
+				return nil, err
+			}
+			dst = AppendULEB128(dst, uint64(n))
+			if kind == immSelectTypes {
+				var types []byte
+				types, err = r.readBytes(uint64(n))
+				dst = append(dst, types...)
+				break
+			}
+			for range n + 1 {
+				var v uint32
+				if v, err = r.readU32(); err != nil {
+					break
+				}
+				dst = AppendULEB128(dst, uint64(v))
+			}
+		case immS32, immS64:
+			bits := uint(32)
+			if kind == immS64 {
+				bits = 64
+			}
+			var v int64
+			v, err = r.readSigned(bits)
+			dst = AppendSLEB128(dst, v)
+		case immF32, immF64, immByte:
+			size := map[immediateKind]uint64{immF32: 4, immF64: 8, immByte: 1}[kind]
+			var raw []byte
+			raw, err = r.readBytes(size)
+			dst = append(dst, raw...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// Encodes m as a WebAssembly binary. Every LEB128 comes out in its
+// shortest form, the immediates in function bodies and constant
+// expressions included, and custom sections go back after the section
+// they followed. Like DecodeModule, function bodies aren't validated.
+func EncodeModule(m *Module) ([]byte, error) {
+	if err := m.check(0); err != nil {
+		return nil, err
+	}
+	customs := map[SectionID][]CustomSection{}
+	for _, c := range m.Customs {
+		if _, ok := sectionOrder[c.After]; !ok && c.After != SectionCustom {
+			return nil, NewModuleError(ModuleUnknownSection, 0, nil, byte(c.After))
+		}
+		customs[c.After] = append(customs[c.After], c)
+	}
+
+	sections := []struct {
+		id      SectionID
+		payload func() ([]byte, error)
+	}{
+		{SectionType, m.encodeTypes},
+		{SectionImport, m.encodeImports},
+		{SectionFunction, func() ([]byte, error) {
+			return encodeVec(len(m.Funcs), func(dst []byte, i int) ([]byte, error) {
+				return AppendULEB128(dst, uint64(m.Funcs[i])), nil
+			})
+		}},
+		{SectionTable, func() ([]byte, error) {
+			return encodeVec(len(m.Tables), func(dst []byte, i int) ([]byte, error) {
+				return appendTableType(dst, m.Tables[i])
+			})
+		}},
+		{SectionMemory, func() ([]byte, error) {
+			return encodeVec(len(m.Memories), func(dst []byte, i int) ([]byte, error) {
+				return appendLimits(dst, m.Memories[i].Limits, m.Memories[i].Shared), nil
+			})
+		}},
+		{SectionGlobal, func() ([]byte, error) {
+			return encodeVec(len(m.Globals), func(dst []byte, i int) ([]byte, error) {
+				dst, err := appendGlobalType(dst, m.Globals[i].Type)
+				if err != nil {
+					return nil, err
+				}
+				return appendCanonicalCode(dst, m.Globals[i].Init, 0)
+			})
+		}},
+		{SectionExport, func() ([]byte, error) {
+			return encodeVec(len(m.Exports), func(dst []byte, i int) ([]byte, error) {
+				exp := m.Exports[i]
+				return AppendULEB128(append(appendName(dst, exp.Name), byte(exp.Kind)), uint64(exp.Index)), nil
+			})
+		}},
+		{SectionStart, func() ([]byte, error) {
+			if m.Start == nil {
+				return nil, nil
+			}
+			return AppendULEB128(nil, uint64(*m.Start)), nil
+		}},
+		{SectionElement, func() ([]byte, error) {
+			return encodeVec(len(m.Elements), func(dst []byte, i int) ([]byte, error) {
+				return appendElementSegment(dst, m.Elements[i])
+			})
+		}},
+		{SectionDataCount, func() ([]byte, error) {
+			if m.DataCount == nil {
+				return nil, nil
+			}
+			return AppendULEB128(nil, uint64(*m.DataCount)), nil
+		}},
+		{SectionCode, m.encodeCode},
+		{SectionData, m.encodeData},
+	}
+
+	out := binary.LittleEndian.AppendUint32(append([]byte(nil), ModuleMagic...), ModuleVersion)
+	out = appendCustoms(out, customs[SectionCustom])
+	for _, s := range sections {
+		payload, err := s.payload()
+		if err != nil {
+			return nil, err
+		}
+		if payload != nil {
+			out = appendSection(out, s.id, payload)
+		}
+		out = appendCustoms(out, customs[s.id])
+	}
+	return out, nil
+}
+
+func appendCustoms(dst []byte, customs []CustomSection) []byte {
+	for _, c := range customs {
+		dst = appendSection(dst, SectionCustom, append(appendName(nil, c.Name), c.Data...))
+	}
+	return dst
+}
+
+func (m *Module) encodeTypes() ([]byte, error) {
+	return encodeVec(len(m.Types), func(dst []byte, i int) ([]byte, error) {
+		dst = append(dst, 0x60)
+		for _, list := range [][]ValueStackEntryType{m.Types[i].Params, m.Types[i].Results} {
+			dst = AppendULEB128(dst, uint64(len(list)))
+			for _, vt := range list {
+				var err error
+				if dst, err = appendValType(dst, vt); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return dst, nil
+	})
+}
+
+func (m *Module) encodeImports() ([]byte, error) {
+	return encodeVec(len(m.Imports), func(dst []byte, i int) ([]byte, error) {
+		imp := m.Imports[i]
+		dst = append(appendName(appendName(dst, imp.Module), imp.Name), byte(imp.Kind))
+		switch imp.Kind {
+		case ExternFunc:
+			return AppendULEB128(dst, uint64(imp.Func)), nil
+		case ExternTable:
+			return appendTableType(dst, imp.Table)
+		case ExternMemory:
+			return appendLimits(dst, imp.Memory.Limits, imp.Memory.Shared), nil
+		case ExternGlobal:
+			return appendGlobalType(dst, imp.Global)
+		}
+		return nil, NewModuleError(ModuleUnsupportedType, 0, nil, "import kind", byte(imp.Kind))
+	})
+}
+
+func (m *Module) encodeCode() ([]byte, error) {
+	return encodeVec(len(m.Code), func(dst []byte, i int) ([]byte, error) {
+		body := AppendULEB128(nil, uint64(len(m.Code[i].Locals)))
+		for _, l := range m.Code[i].Locals {
+			var err error
+			if body, err = appendValType(AppendULEB128(body, uint64(l.Count)), l.Type); err != nil {
+				return nil, err
+			}
+		}
+		body, err := appendCanonicalCode(body, m.Code[i].Code, m.Code[i].Offset)
+		if err != nil {
+			return nil, err
+		}
+		return append(AppendULEB128(dst, uint64(len(body))), body...), nil
+	})
+}
+
+func (m *Module) encodeData() ([]byte, error) {
+	return encodeVec(len(m.Data), func(dst []byte, i int) ([]byte, error) {
+		seg := m.Data[i]
+		if seg.Mode == SegmentPassive {
+			dst = append(dst, 1)
+		} else {
+			if seg.Memory != 0 {
+				dst = AppendULEB128(append(dst, 2), uint64(seg.Memory))
+			} else {
+				dst = append(dst, 0)
+			}
+			var err error
+			if dst, err = appendCanonicalCode(dst, seg.Offset, 0); err != nil {
+				return nil, err
+			}
+		}
+		return append(AppendULEB128(dst, uint64(len(seg.Init))), seg.Init...), nil
+	})
+}
+
+// Picks the shortest of the eight encodings that can express seg
+func appendElementSegment(dst []byte, seg ElementSegment) ([]byte, error) {
+	// Indices can only stand for funcref elements
+	exprs := seg.Exprs != nil || seg.Type != RefFunc
+	var flags uint64
+	if exprs {
+		flags |= 4
+	}
+	switch seg.Mode {
+	case SegmentPassive:
+		flags |= 1
+	case SegmentDeclarative:
+		flags |= 3
+	default:
+		if seg.Table != 0 || seg.Type != RefFunc {
+			flags |= 2
+		}
+	}
+	dst = AppendULEB128(dst, flags)
+	var err error
+	if seg.Mode == SegmentActive {
+		if flags&2 != 0 {
+			dst = AppendULEB128(dst, uint64(seg.Table))
+		}
+		if dst, err = appendCanonicalCode(dst, seg.Offset, 0); err != nil {
+			return nil, err
+		}
+	}
+	if flags != 0 && flags != 4 {
+		if !exprs {
+			dst = append(dst, 0x00) // Element kind funcref
+		} else if dst, err = appendRefType(dst, seg.Type); err != nil {
+			return nil, err
+		}
+	}
+	if exprs {
+		dst = AppendULEB128(dst, uint64(len(seg.Exprs)))
+		for _, e := range seg.Exprs {
+			if dst, err = appendCanonicalCode(dst, e, 0); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	}
+	dst = AppendULEB128(dst, uint64(len(seg.Funcs)))
+	for _, idx := range seg.Funcs {
+		dst = AppendULEB128(dst, uint64(idx))
+	}
+	return dst, nil
+}
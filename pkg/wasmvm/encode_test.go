@@ -0,0 +1,152 @@
+package wasmvm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeModule_RoundTrip(t *testing.T) {
+	withCustoms := wasmBinary(
+		wasmSection(wasmvm.SectionCustom, wasmCat(wasmName("first"), []byte{1})...),
+		wasmSection(wasmvm.SectionType, wasmVec(wasmFuncType(nil, nil))...),
+		wasmSection(wasmvm.SectionCustom, wasmCat(wasmName("after type"), []byte{2})...),
+		wasmSection(wasmvm.SectionCustom, wasmCat(wasmName("also after type"))...),
+		wasmSection(wasmvm.SectionFunction, wasmVec([]byte{0x00})...),
+		wasmSection(wasmvm.SectionCode, wasmVec(wasmBody(wasmvm.OP_END))...),
+	)
+	for name, bin := range map[string][]byte{
+		"link":     linkTestModule,
+		"instance": instanceTestModule,
+		"customs":  withCustoms,
+	} {
+		t.Run(name, func(t *testing.T) {
+			m, err := wasmvm.DecodeModule(bin)
+			require.NoError(t, err)
+			out, err := wasmvm.EncodeModule(m)
+			require.NoError(t, err)
+			assert.Equal(t, bin, out)
+		})
+	}
+}
+
+func TestEncodeModule_Canonical(t *testing.T) {
+	// Every LEB128 padded out to more bytes than it needs
+	padded := wasmBinary(
+		[]byte{byte(wasmvm.SectionType), 0x85, 0x00, 0x81, 0x00, 0x60, 0x00, 0x00},
+		wasmSection(wasmvm.SectionFunction, 0x01, 0x80, 0x00),
+		wasmSection(wasmvm.SectionMemory, 0x01, 0x00, 0x81, 0x80, 0x00),
+		wasmSection(wasmvm.SectionGlobal, 0x01, wasmI32, 0x00, wasmvm.OP_CONST_I32, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F, wasmvm.OP_END),
+		wasmSection(wasmvm.SectionCode, wasmVec(wasmBodyLocals(1, wasmI32,
+			wasmvm.OP_BLOCK, 0x40,
+			wasmvm.OP_LOCAL_GET, 0x80, 0x80, 0x00,
+			wasmvm.OP_BR_TABLE, 0x81, 0x00, 0x80, 0x00, 0x80, 0x80, 0x00,
+			wasmvm.OP_END,
+			wasmvm.OP_CONST_I64, 0x80, 0x00,
+			wasmvm.OP_CONST_I32, 0x00, 0x28, 0x82, 0x80, 0x00, 0x80, 0x00, // i32.load
+			0xFC, 0x8B, 0x00, 0x80, 0x00, // memory.fill
+			wasmvm.OP_END,
+		))...),
+	)
+	canonical := wasmBinary(
+		wasmSection(wasmvm.SectionType, 0x01, 0x60, 0x00, 0x00),
+		wasmSection(wasmvm.SectionFunction, 0x01, 0x00),
+		wasmSection(wasmvm.SectionMemory, 0x01, 0x00, 0x01),
+		wasmSection(wasmvm.SectionGlobal, 0x01, wasmI32, 0x00, wasmvm.OP_CONST_I32, 0x7F, wasmvm.OP_END),
+		wasmSection(wasmvm.SectionCode, wasmVec(wasmBodyLocals(1, wasmI32,
+			wasmvm.OP_BLOCK, 0x40,
+			wasmvm.OP_LOCAL_GET, 0x00,
+			wasmvm.OP_BR_TABLE, 0x01, 0x00, 0x00,
+			wasmvm.OP_END,
+			wasmvm.OP_CONST_I64, 0x00,
+			wasmvm.OP_CONST_I32, 0x00, 0x28, 0x02, 0x00,
+			0xFC, 0x0B, 0x00,
+			wasmvm.OP_END,
+		))...),
+	)
+	m, err := wasmvm.DecodeModule(padded)
+	require.NoError(t, err)
+	out, err := wasmvm.EncodeModule(m)
+	require.NoError(t, err)
+	assert.Equal(t, canonical, out)
+}
+
+func TestEncodeModule_Instrument(t *testing.T) {
+	m, err := wasmvm.DecodeModule(instanceTestModule)
+	require.NoError(t, err)
+	m.Imports[0].Name = "probe"
+	m.Exports = append(m.Exports, wasmvm.Export{Name: "twice", Kind: wasmvm.ExternFunc, Index: 2})
+	m.Customs = append(m.Customs, wasmvm.CustomSection{Name: "probes", Data: []byte{7}, After: wasmvm.SectionType})
+	bin, err := wasmvm.EncodeModule(m)
+	require.NoError(t, err)
+
+	m, err = wasmvm.DecodeModule(bin)
+	require.NoError(t, err)
+	assert.Equal(t, []wasmvm.CustomSection{{Name: "probes", Data: []byte{7}, After: wasmvm.SectionType}}, m.Customs)
+	l, err := wasmvm.NewLinker().DefineHostFunc("env", "probe", func(x int32) int32 { return x + 1 })
+	require.NoError(t, err)
+	inst, err := wasmvm.Instantiate(m, l, nil)
+	require.NoError(t, err)
+
+	r, err := inst.ExportedFunction("twice").Call(context.Background(), 21)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), r[0])
+	r, err = inst.ExportedFunction("callback").Call(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), r[0])
+}
+
+func TestEncodeModule_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		edit   func(m *wasmvm.Module)
+		expect wasmvm.ModuleErrorType
+	}{
+		{
+			name:   "missing body",
+			edit:   func(m *wasmvm.Module) { m.Code = m.Code[:1] },
+			expect: wasmvm.ModuleFunctionCountMismatch,
+		},
+		{
+			name:   "export out of range",
+			edit:   func(m *wasmvm.Module) { m.Exports[0].Index = 100 },
+			expect: wasmvm.ModuleInvalidIndex,
+		},
+		{
+			name:   "value type",
+			edit:   func(m *wasmvm.Module) { m.Types[0].Params[0] = wasmvm.ValueStackEntryType(9) },
+			expect: wasmvm.ModuleUnsupportedType,
+		},
+		{
+			name: "custom section placement",
+			edit: func(m *wasmvm.Module) {
+				m.Customs = []wasmvm.CustomSection{{Name: "x", After: 99}}
+			},
+			expect: wasmvm.ModuleUnknownSection,
+		},
+		{
+			name:   "unknown instruction",
+			edit:   func(m *wasmvm.Module) { m.Code[0].Code = []byte{0xFF, wasmvm.OP_END} },
+			expect: wasmvm.ModuleMalformed,
+		},
+		{
+			name:   "truncated immediate",
+			edit:   func(m *wasmvm.Module) { m.Code[0].Code = []byte{wasmvm.OP_LOCAL_GET, 0x80} },
+			expect: wasmvm.ModuleTruncated,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := wasmvm.DecodeModule(instanceTestModule)
+			require.NoError(t, err)
+			tc.edit(m)
+			_, err = wasmvm.EncodeModule(m)
+			var me *wasmvm.ModuleError
+			require.ErrorAs(t, err, &me)
+			assert.Equal(t, tc.expect, me.Type, me.Error())
+		})
+	}
+}
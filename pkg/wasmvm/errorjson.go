@@ -0,0 +1,132 @@
+package wasmvm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Shared pieces of the JSON forms of the config and error types. Enums
+// are written by name and causes tagged with their kind, so that what
+// is written can be read back into the same values.
+
+// An enum whose String() gives a name for every value, including
+// unnamed ones like "TrapType(99)"
+type namedEnum interface {
+	~uint8
+	String() string
+}
+
+func marshalEnumName[T namedEnum](v T) ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+// Reads a name written by marshalEnumName, or a plain number
+func unmarshalEnumName[T namedEnum](data []byte, v *T, typeName string) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		for i := 0; i <= math.MaxUint8; i++ {
+			if T(i).String() == s {
+				*v = T(i)
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: unknown name %q", typeName, s)
+	}
+	var i uint8
+	if err := json.Unmarshal(data, &i); err == nil {
+		*v = T(i)
+		return nil
+	}
+	return fmt.Errorf("%s: cannot unmarshal %s", typeName, string(data))
+}
+
+// The kinds of cause that come back as themselves. Anything else is
+// kept as its message only.
+const (
+	causeKindError = "error"
+	causeKindTrap  = "TrapError"
+	causeKindImage = "ImageInitializationError"
+	causeKindVM    = "VMInitializationError"
+	causeKindExit  = "ExitError"
+)
+
+type causeJSON struct {
+	Kind  string          `json:"kind"`
+	Error json.RawMessage `json:"error"`
+}
+
+// Writes err as {"kind": ..., "error": ...}, nil for no cause
+func marshalCause(err error) (json.RawMessage, error) {
+	if err == nil {
+		return nil, nil
+	}
+	var kind string
+	var v any
+	switch e := err.(type) {
+	case *TrapError:
+		kind, v = causeKindTrap, e
+	case *ImageInitializationError:
+		kind, v = causeKindImage, e
+	case *VMInitializationError:
+		kind, v = causeKindVM, e
+	case *ExitError:
+		kind, v = causeKindExit, struct {
+			Code uint32 `json:"code"`
+		}{e.Code}
+	default:
+		kind, v = causeKindError, err.Error()
+	}
+	data, merr := json.Marshal(v)
+	if merr != nil {
+		return nil, merr
+	}
+	return json.Marshal(causeJSON{Kind: kind, Error: data})
+}
+
+func unmarshalCause(data json.RawMessage) (error, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	var c causeJSON
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	switch c.Kind {
+	case causeKindTrap:
+		e := &TrapError{}
+		return e, json.Unmarshal(c.Error, e)
+	case causeKindImage:
+		e := &ImageInitializationError{}
+		return e, json.Unmarshal(c.Error, e)
+	case causeKindVM:
+		e := &VMInitializationError{}
+		return e, json.Unmarshal(c.Error, e)
+	case causeKindExit:
+		var v struct {
+			Code uint32 `json:"code"`
+		}
+		err := json.Unmarshal(c.Error, &v)
+		return &ExitError{Code: v.Code}, err
+	case causeKindError:
+		var msg string
+		err := json.Unmarshal(c.Error, &msg)
+		return errors.New(msg), err
+	}
+	return nil, fmt.Errorf("unknown cause kind %q", c.Kind)
+}
+
+// Metadata of unknown type comes back as maps, lists and json.Numbers,
+// which write out the same values again, though with object keys sorted
+func unmarshalMeta(data json.RawMessage) (any, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	return v, err
+}
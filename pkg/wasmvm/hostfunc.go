@@ -0,0 +1,389 @@
+package wasmvm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+var valueTypeNames = map[ValueStackEntryType]string{
+	TYPE_I32: "i32",
+	TYPE_F32: "f32",
+	TYPE_I64: "i64",
+	TYPE_F64: "f64",
+}
+
+// The WebAssembly signature of a function
+type FuncType struct {
+	Params  []ValueStackEntryType
+	Results []ValueStackEntryType
+}
+
+// Formatted like "(i32, f64) -> (i64)"
+func (ft FuncType) String() string {
+	list := func(types []ValueStackEntryType) string {
+		names := make([]string, len(types))
+		for i, t := range types {
+			if name, ok := valueTypeNames[t]; ok {
+				names[i] = name
+			} else {
+				names[i] = t.String()
+			}
+		}
+		return "(" + strings.Join(names, ", ") + ")"
+	}
+	return list(ft.Params) + " -> " + list(ft.Results)
+}
+
+func (ft FuncType) Equal(other FuncType) bool {
+	return slices.Equal(ft.Params, other.Params) && slices.Equal(ft.Results, other.Results)
+}
+
+// The lowest level form of a host function. params are in signature
+// order and the results have to match the signature as well.
+type HostFunction func(ctx context.Context, vm *VMState, params []ValueStackEntry) ([]ValueStackEntry, error)
+
+// A function exposed to anything running in the VM
+type ExposedFunc struct {
+	Type     FuncType
+	Function *HostFunction
+	direct   directHostFunc // Set by the HostFuncN_M constructors
+	// Same results for the same arguments and VM state, see
+	// SetDeterministic
+	Deterministic bool
+	// Set when the function is an export of an instance
+	owner *Instance
+	index uint32
+}
+
+func NewExposedFunc(ft FuncType, fn HostFunction) *ExposedFunc {
+	return &ExposedFunc{
+		Type:     ft,
+		Function: &fn,
+	}
+}
+
+// Pops the parameters off the value stack, runs the function and pushes
+// its results. Anything going wrong, including a panic in the function,
+// traps the VM.
+func (ef *ExposedFunc) Call(ctx context.Context, vm *VMState) (err error) {
+	const op = "CALL_HOST"
+	ok, collect := vm.ValueStack.HasTypes(ef.Type.Params...)
+	if !ok {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if ef.direct != nil {
+		return ef.callDirect(ctx, vm, op, collect)
+	}
+	// The collected slice aliases the stack, which the results reuse
+	params := make([]ValueStackEntry, len(collect))
+	copy(params, collect)
+	if len(params) > 0 && !vm.ValueStack.Drop(len(params), true) {
+		return NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = hostFuncPanicked(vm, op, ef.Type, r)
+		}
+	}()
+	results, err := (*ef.Function)(ctx, vm, params)
+	if err != nil {
+		return hostFuncFailed(vm, op, ef.Type, err)
+	}
+	if len(results) != len(ef.Type.Results) {
+		return hostResultMismatch(vm, op, ef.Type)
+	}
+	for i := range results {
+		if results[i].EntryType != ef.Type.Results[i] {
+			return hostResultMismatch(vm, op, ef.Type)
+		}
+	}
+	for i := range results {
+		vm.ValueStack.Push(&results[i])
+	}
+	return nil
+}
+
+// Skips copying the parameters and checking the results since both are
+// fixed by the generic signature
+func (ef *ExposedFunc) callDirect(ctx context.Context, vm *VMState, op string, args []ValueStackEntry) (err error) {
+	if len(args) > 0 && !vm.ValueStack.Drop(len(args), true) {
+		return NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = hostFuncPanicked(vm, op, ef.Type, r)
+		}
+	}()
+	if err := ef.direct(ctx, vm, args, &vm.ValueStack); err != nil {
+		return hostFuncFailed(vm, op, ef.Type, err)
+	}
+	return nil
+}
+
+func hostFuncPanicked(vm *VMState, op string, ft FuncType, r any) error {
+	return vm.SetTrapError(&TrapError{
+		Type:    TrapHostFunction,
+		Op:      op,
+		PC:      vm.PC,
+		Message: fmt.Sprintf("%s: host function panicked: %v", op, r),
+		Meta:    ft.String(),
+	})
+}
+
+// proc_exit and the like report an ExitError, which gets its own trap type
+func hostFuncFailed(vm *VMState, op string, ft FuncType, err error) error {
+	trap := TrapHostFunction
+	if _, ok := ExitCode(err); ok {
+		trap = TrapExit
+	}
+	return vm.SetTrapError(&TrapError{
+		Type:    trap,
+		Op:      op,
+		PC:      vm.PC,
+		Message: fmt.Sprintf("%s: %v", op, err),
+		Cause:   err,
+		Meta:    ft.String(),
+	})
+}
+
+func hostResultMismatch(vm *VMState, op string, ft FuncType) error {
+	return vm.SetTrapError(&TrapError{
+		Type:    TrapHostFunction,
+		Op:      op,
+		PC:      vm.PC,
+		Message: fmt.Sprintf("%s: results do not match %s", op, ft),
+		Meta:    ft.String(),
+	})
+}
+
+type HostFuncErrorType byte
+
+const (
+	UndefinedHostFuncError HostFuncErrorType = iota
+	HostFuncNotAFunction
+	HostFuncVariadic
+	HostFuncUnsupportedParam
+	HostFuncMisplacedParam
+	HostFuncUnsupportedResult
+)
+
+var hostFuncErrorTypeNames = map[HostFuncErrorType]string{
+	UndefinedHostFuncError:    "UndefinedHostFuncError",
+	HostFuncNotAFunction:      "HostFuncNotAFunction",
+	HostFuncVariadic:          "HostFuncVariadic",
+	HostFuncUnsupportedParam:  "HostFuncUnsupportedParam",
+	HostFuncMisplacedParam:    "HostFuncMisplacedParam",
+	HostFuncUnsupportedResult: "HostFuncUnsupportedResult",
+}
+
+var hostFuncErrorMessageTemplates = map[HostFuncErrorType]string{
+	UndefinedHostFuncError:    "unknown host function error",
+	HostFuncNotAFunction:      "expected a function, got %s",
+	HostFuncVariadic:          "variadic functions are not supported",
+	HostFuncUnsupportedParam:  "parameter %d has unsupported type %s",
+	HostFuncMisplacedParam:    "parameter %d of type %s must come before the value parameters",
+	HostFuncUnsupportedResult: "result %d has unsupported type %s",
+}
+
+func (t HostFuncErrorType) String() string {
+	if name, ok := hostFuncErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("HostFuncErrorType(%d)", t)
+}
+
+// Reported when a Go function can't be bound as a host function
+type HostFuncError struct {
+	Type HostFuncErrorType
+	Msg  string
+	Func string // Go type of the function
+}
+
+func NewHostFuncError(eType HostFuncErrorType, fn reflect.Type, paras ...any) error {
+	msg, ok := hostFuncErrorMessageTemplates[eType]
+	if !ok {
+		msg = hostFuncErrorMessageTemplates[UndefinedHostFuncError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	name := "<nil>"
+	if fn != nil {
+		name = fn.String()
+	}
+	return &HostFuncError{
+		Type: eType,
+		Msg:  msg,
+		Func: name,
+	}
+}
+
+func (e *HostFuncError) Error() string {
+	return fmt.Sprintf("[%s] %s: %s", e.Type.String(), e.Func, e.Msg)
+}
+
+var (
+	contextType = reflect.TypeFor[context.Context]()
+	memoryType  = reflect.TypeFor[Memory]()
+	vmStateType = reflect.TypeFor[*VMState]()
+	errorType   = reflect.TypeFor[error]()
+)
+
+// WebAssembly type for a Go kind. Named types such as `type Fd int32`
+// are fine, but int and uint are rejected since their size depends on
+// the platform.
+func valueTypeForKind(k reflect.Kind) (ValueStackEntryType, bool) {
+	switch k {
+	case reflect.Int32, reflect.Uint32:
+		return TYPE_I32, true
+	case reflect.Int64, reflect.Uint64:
+		return TYPE_I64, true
+	case reflect.Float32:
+		return TYPE_F32, true
+	case reflect.Float64:
+		return TYPE_F64, true
+	}
+	return 0, false
+}
+
+func valueFromEntry(entry ValueStackEntry, t reflect.Type) reflect.Value {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int32:
+		v.SetInt(int64(int32(entry.Value_I32)))
+	case reflect.Uint32:
+		v.SetUint(uint64(entry.Value_I32))
+	case reflect.Int64:
+		v.SetInt(int64(entry.Value_I64))
+	case reflect.Uint64:
+		v.SetUint(entry.Value_I64)
+	case reflect.Float32:
+		v.SetFloat(float64(entry.Value_F32))
+	case reflect.Float64:
+		v.SetFloat(entry.Value_F64)
+	}
+	return v
+}
+
+func entryFromValue(v reflect.Value) ValueStackEntry {
+	switch v.Kind() {
+	case reflect.Int32:
+		return ValueStackEntry{EntryType: TYPE_I32, Value_I32: uint32(v.Int())}
+	case reflect.Uint32:
+		return ValueStackEntry{EntryType: TYPE_I32, Value_I32: uint32(v.Uint())}
+	case reflect.Int64:
+		return ValueStackEntry{EntryType: TYPE_I64, Value_I64: uint64(v.Int())}
+	case reflect.Uint64:
+		return ValueStackEntry{EntryType: TYPE_I64, Value_I64: v.Uint()}
+	case reflect.Float32:
+		return ValueStackEntry{EntryType: TYPE_F32, Value_F32: float32(v.Float())}
+	default:
+		return ValueStackEntry{EntryType: TYPE_F64, Value_F64: v.Float()}
+	}
+}
+
+// Binds an ordinary Go function as a host function, deriving its
+// signature by reflection. The function may start with any of a
+// context.Context, then a Memory or *VMState, followed by the value
+// parameters (int32, uint32, int64, uint64, float32, float64 or types
+// based on them). Results use the same value types and may end with an
+// error, which traps the VM when non-nil. Anything else is rejected
+// here rather than when the function gets called.
+func NewHostFunc(fn any) (*ExposedFunc, error) {
+	fv := reflect.ValueOf(fn)
+	ft := reflect.TypeOf(fn)
+	if ft == nil || ft.Kind() != reflect.Func || fv.IsNil() {
+		kind := "nil"
+		if ft != nil {
+			kind = ft.String()
+		}
+		return nil, NewHostFuncError(HostFuncNotAFunction, ft, kind)
+	}
+	if ft.IsVariadic() {
+		return nil, NewHostFuncError(HostFuncVariadic, ft)
+	}
+
+	sig := FuncType{}
+	// Where each Go parameter comes from: -1 for the context, -2 for
+	// the memory, -3 for the VM, otherwise the index into the params
+	sources := make([]int, ft.NumIn())
+	inValues := false
+	for i := range ft.NumIn() {
+		in := ft.In(i)
+		switch {
+		case in == contextType:
+			if i != 0 {
+				return nil, NewHostFuncError(HostFuncMisplacedParam, ft, i, in)
+			}
+			sources[i] = -1
+		case in == memoryType || in == vmStateType:
+			if inValues {
+				return nil, NewHostFuncError(HostFuncMisplacedParam, ft, i, in)
+			}
+			sources[i] = -2
+			if in == vmStateType {
+				sources[i] = -3
+			}
+		default:
+			vt, ok := valueTypeForKind(in.Kind())
+			if !ok {
+				return nil, NewHostFuncError(HostFuncUnsupportedParam, ft, i, in)
+			}
+			sources[i] = len(sig.Params)
+			sig.Params = append(sig.Params, vt)
+			inValues = true
+		}
+	}
+
+	hasErr := false
+	for i := range ft.NumOut() {
+		out := ft.Out(i)
+		if out == errorType && i == ft.NumOut()-1 {
+			hasErr = true
+			continue
+		}
+		vt, ok := valueTypeForKind(out.Kind())
+		if !ok {
+			return nil, NewHostFuncError(HostFuncUnsupportedResult, ft, i, out)
+		}
+		sig.Results = append(sig.Results, vt)
+	}
+
+	invoke := func(ctx context.Context, vm *VMState, params []ValueStackEntry) ([]ValueStackEntry, error) {
+		args := make([]reflect.Value, len(sources))
+		for i, src := range sources {
+			switch src {
+			case -1:
+				args[i] = reflect.ValueOf(&ctx).Elem()
+			case -2:
+				mem := vm.Memory
+				args[i] = reflect.ValueOf(&mem).Elem()
+			case -3:
+				args[i] = reflect.ValueOf(vm)
+			default:
+				args[i] = valueFromEntry(params[src], ft.In(i))
+			}
+		}
+		outs := fv.Call(args)
+		if hasErr {
+			last := outs[len(outs)-1]
+			outs = outs[:len(outs)-1]
+			if !last.IsNil() {
+				return nil, last.Interface().(error)
+			}
+		}
+		results := make([]ValueStackEntry, len(outs))
+		for i, out := range outs {
+			results[i] = entryFromValue(out)
+		}
+		return results, nil
+	}
+	return NewExposedFunc(sig, invoke), nil
+}
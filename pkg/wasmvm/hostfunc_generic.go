@@ -0,0 +1,371 @@
+package wasmvm
+
+import (
+	"context"
+	"unsafe"
+)
+
+// The Go types that map onto the WebAssembly numeric types. Named types
+// such as `type Fd int32` are fine as well.
+type WasmValue interface {
+	~int32 | ~uint32 | ~int64 | ~uint64 | ~float32 | ~float64
+}
+
+// Like HostFunction, but reads its arguments from args and pushes its
+// results onto out. args aliases the value stack, so it has to be read
+// before anything gets pushed.
+type directHostFunc func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error
+
+// Works out the WebAssembly type of T without reflection. Only the
+// float types keep the fraction of 1/2.
+func wasmType[T WasmValue]() ValueStackEntryType {
+	var v T = 1
+	float := v/2 != 0
+	switch {
+	case float && unsafe.Sizeof(v) == 4:
+		return TYPE_F32
+	case float:
+		return TYPE_F64
+	case unsafe.Sizeof(v) == 4:
+		return TYPE_I32
+	default:
+		return TYPE_I64
+	}
+}
+
+// The entry type has already been checked against the signature, so the
+// conversion only needs to pick the matching field
+func fromEntry[T WasmValue](e *ValueStackEntry) T {
+	switch e.EntryType {
+	case TYPE_I32:
+		return T(e.Value_I32)
+	case TYPE_I64:
+		return T(e.Value_I64)
+	case TYPE_F32:
+		return T(e.Value_F32)
+	default:
+		return T(e.Value_F64)
+	}
+}
+
+func toEntry[T WasmValue](v T, vt ValueStackEntryType) ValueStackEntry {
+	switch vt {
+	case TYPE_I32:
+		return ValueStackEntry{EntryType: TYPE_I32, Value_I32: uint32(v)}
+	case TYPE_I64:
+		return ValueStackEntry{EntryType: TYPE_I64, Value_I64: uint64(v)}
+	case TYPE_F32:
+		return ValueStackEntry{EntryType: TYPE_F32, Value_F32: float32(v)}
+	default:
+		return ValueStackEntry{EntryType: TYPE_F64, Value_F64: float64(v)}
+	}
+}
+
+// Wraps a direct function so it can also be called through the regular
+// HostFunction, which collects the results into a slice
+func newDirectFunc(ft FuncType, direct directHostFunc) *ExposedFunc {
+	ef := NewExposedFunc(ft, func(ctx context.Context, vm *VMState, params []ValueStackEntry) ([]ValueStackEntry, error) {
+		out := ValueStack{}
+		if err := direct(ctx, vm, params, &out); err != nil {
+			return nil, err
+		}
+		return out.elements, nil
+	})
+	ef.direct = direct
+	return ef
+}
+
+// The HostFuncN_M constructors bind a function taking N values and
+// returning M values. Unlike NewHostFunc the signature is checked at
+// compile time and calls go straight to fn, without reflection or
+// boxing the values. A non-nil error traps the VM.
+
+func HostFunc0_0(fn func(context.Context, *VMState) error) *ExposedFunc {
+	ft := FuncType{}
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, _ []ValueStackEntry, _ *ValueStack) error {
+		return fn(ctx, vm)
+	})
+}
+
+func HostFunc0_1[R1 WasmValue](fn func(context.Context, *VMState) (R1, error)) *ExposedFunc {
+	ft := FuncType{
+		Results: []ValueStackEntryType{wasmType[R1]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, _ []ValueStackEntry, out *ValueStack) error {
+		r1, err := fn(ctx, vm)
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		return nil
+	})
+}
+
+func HostFunc0_2[R1, R2 WasmValue](fn func(context.Context, *VMState) (R1, R2, error)) *ExposedFunc {
+	ft := FuncType{
+		Results: []ValueStackEntryType{wasmType[R1](), wasmType[R2]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, _ []ValueStackEntry, out *ValueStack) error {
+		r1, r2, err := fn(ctx, vm)
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		out.pushEntry(toEntry(r2, results[1]))
+		return nil
+	})
+}
+
+func HostFunc1_0[P1 WasmValue](fn func(context.Context, *VMState, P1) error) *ExposedFunc {
+	ft := FuncType{
+		Params: []ValueStackEntryType{wasmType[P1]()},
+	}
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, _ *ValueStack) error {
+		return fn(ctx, vm, fromEntry[P1](&args[0]))
+	})
+}
+
+func HostFunc1_1[P1, R1 WasmValue](fn func(context.Context, *VMState, P1) (R1, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1]()},
+		Results: []ValueStackEntryType{wasmType[R1]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, err := fn(ctx, vm, fromEntry[P1](&args[0]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		return nil
+	})
+}
+
+func HostFunc1_2[P1, R1, R2 WasmValue](fn func(context.Context, *VMState, P1) (R1, R2, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1]()},
+		Results: []ValueStackEntryType{wasmType[R1](), wasmType[R2]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, r2, err := fn(ctx, vm, fromEntry[P1](&args[0]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		out.pushEntry(toEntry(r2, results[1]))
+		return nil
+	})
+}
+
+func HostFunc2_0[P1, P2 WasmValue](fn func(context.Context, *VMState, P1, P2) error) *ExposedFunc {
+	ft := FuncType{
+		Params: []ValueStackEntryType{wasmType[P1](), wasmType[P2]()},
+	}
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, _ *ValueStack) error {
+		return fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]))
+	})
+}
+
+func HostFunc2_1[P1, P2, R1 WasmValue](fn func(context.Context, *VMState, P1, P2) (R1, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2]()},
+		Results: []ValueStackEntryType{wasmType[R1]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		return nil
+	})
+}
+
+func HostFunc2_2[P1, P2, R1, R2 WasmValue](fn func(context.Context, *VMState, P1, P2) (R1, R2, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2]()},
+		Results: []ValueStackEntryType{wasmType[R1](), wasmType[R2]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, r2, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		out.pushEntry(toEntry(r2, results[1]))
+		return nil
+	})
+}
+
+func HostFunc3_0[P1, P2, P3 WasmValue](fn func(context.Context, *VMState, P1, P2, P3) error) *ExposedFunc {
+	ft := FuncType{
+		Params: []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3]()},
+	}
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, _ *ValueStack) error {
+		return fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]))
+	})
+}
+
+func HostFunc3_1[P1, P2, P3, R1 WasmValue](fn func(context.Context, *VMState, P1, P2, P3) (R1, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3]()},
+		Results: []ValueStackEntryType{wasmType[R1]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		return nil
+	})
+}
+
+func HostFunc3_2[P1, P2, P3, R1, R2 WasmValue](fn func(context.Context, *VMState, P1, P2, P3) (R1, R2, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3]()},
+		Results: []ValueStackEntryType{wasmType[R1](), wasmType[R2]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, r2, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		out.pushEntry(toEntry(r2, results[1]))
+		return nil
+	})
+}
+
+func HostFunc4_0[P1, P2, P3, P4 WasmValue](fn func(context.Context, *VMState, P1, P2, P3, P4) error) *ExposedFunc {
+	ft := FuncType{
+		Params: []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3](), wasmType[P4]()},
+	}
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, _ *ValueStack) error {
+		return fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]), fromEntry[P4](&args[3]))
+	})
+}
+
+func HostFunc4_1[P1, P2, P3, P4, R1 WasmValue](fn func(context.Context, *VMState, P1, P2, P3, P4) (R1, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3](), wasmType[P4]()},
+		Results: []ValueStackEntryType{wasmType[R1]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]), fromEntry[P4](&args[3]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		return nil
+	})
+}
+
+func HostFunc4_2[P1, P2, P3, P4, R1, R2 WasmValue](fn func(context.Context, *VMState, P1, P2, P3, P4) (R1, R2, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3](), wasmType[P4]()},
+		Results: []ValueStackEntryType{wasmType[R1](), wasmType[R2]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, r2, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]), fromEntry[P4](&args[3]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		out.pushEntry(toEntry(r2, results[1]))
+		return nil
+	})
+}
+
+func HostFunc5_0[P1, P2, P3, P4, P5 WasmValue](fn func(context.Context, *VMState, P1, P2, P3, P4, P5) error) *ExposedFunc {
+	ft := FuncType{
+		Params: []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3](), wasmType[P4](), wasmType[P5]()},
+	}
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, _ *ValueStack) error {
+		return fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]), fromEntry[P4](&args[3]), fromEntry[P5](&args[4]))
+	})
+}
+
+func HostFunc5_1[P1, P2, P3, P4, P5, R1 WasmValue](fn func(context.Context, *VMState, P1, P2, P3, P4, P5) (R1, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3](), wasmType[P4](), wasmType[P5]()},
+		Results: []ValueStackEntryType{wasmType[R1]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]), fromEntry[P4](&args[3]), fromEntry[P5](&args[4]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		return nil
+	})
+}
+
+func HostFunc5_2[P1, P2, P3, P4, P5, R1, R2 WasmValue](fn func(context.Context, *VMState, P1, P2, P3, P4, P5) (R1, R2, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3](), wasmType[P4](), wasmType[P5]()},
+		Results: []ValueStackEntryType{wasmType[R1](), wasmType[R2]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, r2, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]), fromEntry[P4](&args[3]), fromEntry[P5](&args[4]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		out.pushEntry(toEntry(r2, results[1]))
+		return nil
+	})
+}
+
+func HostFunc6_0[P1, P2, P3, P4, P5, P6 WasmValue](fn func(context.Context, *VMState, P1, P2, P3, P4, P5, P6) error) *ExposedFunc {
+	ft := FuncType{
+		Params: []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3](), wasmType[P4](), wasmType[P5](), wasmType[P6]()},
+	}
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, _ *ValueStack) error {
+		return fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]), fromEntry[P4](&args[3]), fromEntry[P5](&args[4]), fromEntry[P6](&args[5]))
+	})
+}
+
+func HostFunc6_1[P1, P2, P3, P4, P5, P6, R1 WasmValue](fn func(context.Context, *VMState, P1, P2, P3, P4, P5, P6) (R1, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3](), wasmType[P4](), wasmType[P5](), wasmType[P6]()},
+		Results: []ValueStackEntryType{wasmType[R1]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]), fromEntry[P4](&args[3]), fromEntry[P5](&args[4]), fromEntry[P6](&args[5]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		return nil
+	})
+}
+
+func HostFunc6_2[P1, P2, P3, P4, P5, P6, R1, R2 WasmValue](fn func(context.Context, *VMState, P1, P2, P3, P4, P5, P6) (R1, R2, error)) *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{wasmType[P1](), wasmType[P2](), wasmType[P3](), wasmType[P4](), wasmType[P5](), wasmType[P6]()},
+		Results: []ValueStackEntryType{wasmType[R1](), wasmType[R2]()},
+	}
+	results := ft.Results
+	return newDirectFunc(ft, func(ctx context.Context, vm *VMState, args []ValueStackEntry, out *ValueStack) error {
+		r1, r2, err := fn(ctx, vm, fromEntry[P1](&args[0]), fromEntry[P2](&args[1]), fromEntry[P3](&args[2]), fromEntry[P4](&args[3]), fromEntry[P5](&args[4]), fromEntry[P6](&args[5]))
+		if err != nil {
+			return err
+		}
+		out.pushEntry(toEntry(r1, results[0]))
+		out.pushEntry(toEntry(r2, results[1]))
+		return nil
+	})
+}
@@ -0,0 +1,188 @@
+package wasmvm_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newHostTestVM(t testing.TB) *wasmvm.VMState {
+	vm, err := (&wasmvm.VMConfig{}).SetSize(1).BuildVMState()
+	require.NoError(t, err)
+	return vm
+}
+
+func TestHostFuncN_M_Signature(t *testing.T) {
+	tests := []struct {
+		name   string
+		ef     *wasmvm.ExposedFunc
+		expect string
+	}{
+		{
+			name:   "0_0",
+			ef:     wasmvm.HostFunc0_0(func(context.Context, *wasmvm.VMState) error { return nil }),
+			expect: "() -> ()",
+		},
+		{
+			name: "1_2",
+			ef: wasmvm.HostFunc1_2(func(context.Context, *wasmvm.VMState, fd) (float32, uint64, error) {
+				return 0, 0, nil
+			}),
+			expect: "(i32) -> (f32, i64)",
+		},
+		{
+			name: "6_1",
+			ef: wasmvm.HostFunc6_1(func(context.Context, *wasmvm.VMState, int32, uint32, int64, uint64, float32, float64) (float64, error) {
+				return 0, nil
+			}),
+			expect: "(i32, i32, i64, i64, f32, f64) -> (f64)",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, tc.ef.Type.String())
+		})
+	}
+
+	// Matches the reflective binding of the same function
+	reflective, err := wasmvm.NewHostFunc(func(context.Context, *wasmvm.VMState, fd) (float32, uint64, error) {
+		return 0, 0, nil
+	})
+	require.NoError(t, err)
+	assert.True(t, reflective.Type.Equal(tests[1].ef.Type))
+}
+
+func TestHostFuncN_M_Call(t *testing.T) {
+	vm := newHostTestVM(t)
+	ef := wasmvm.HostFunc3_2(func(ctx context.Context, v *wasmvm.VMState, a int32, b float64, c fd) (int64, float32, error) {
+		assert.Same(t, vm, v)
+		if c == 0 {
+			return 0, 0, errors.New("bad fd")
+		}
+		return int64(a) * int64(c), float32(b / 2), nil
+	})
+
+	vm.ValueStack.PushInt32(99)                     // Left alone
+	vm.ValueStack.PushInt32(uint32(math.MaxUint32)) // -1
+	vm.ValueStack.Push(wasmvm.NewValueStackEntryF64(5))
+	vm.ValueStack.PushInt32(3)
+	require.NoError(t, ef.Call(nil, vm))
+	assert.Equal(t, 3, vm.ValueStack.Size())
+	top, _ := vm.ValueStack.Pop()
+	assert.Equal(t, *wasmvm.NewValueStackEntryF32(2.5), *top)
+	top, _ = vm.ValueStack.Pop()
+	assert.Equal(t, *wasmvm.NewValueStackEntryI64(math.MaxUint64 - 2), *top)
+
+	// The regular HostFunction path gives the same results
+	results, err := (*ef.Function)(context.Background(), vm, []wasmvm.ValueStackEntry{i32(2), *wasmvm.NewValueStackEntryF64(1), i32(4)})
+	require.NoError(t, err)
+	assert.Equal(t, []wasmvm.ValueStackEntry{i64(8), *wasmvm.NewValueStackEntryF32(0.5)}, results)
+
+	vm.ValueStack.PushInt32(1)
+	vm.ValueStack.Push(wasmvm.NewValueStackEntryF64(1))
+	vm.ValueStack.PushInt32(0)
+	assert.Error(t, ef.Call(context.Background(), vm))
+	assert.Equal(t, wasmvm.TrapHostFunction, vm.TrapErr.Type)
+	assert.Equal(t, "CALL_HOST: bad fd", vm.TrapErr.Message)
+	assert.Equal(t, 1, vm.ValueStack.Size())
+}
+
+func TestHostFuncN_M_CallTraps(t *testing.T) {
+	tests := []struct {
+		name     string
+		ef       *wasmvm.ExposedFunc
+		stack    []wasmvm.ValueStackEntry
+		trapType wasmvm.TrapType
+		message  string
+	}{
+		{
+			name:     "panic",
+			ef:       wasmvm.HostFunc0_0(func(context.Context, *wasmvm.VMState) error { panic("boom") }),
+			trapType: wasmvm.TrapHostFunction,
+			message:  "CALL_HOST: host function panicked: boom",
+		},
+		{
+			name:     "missing argument",
+			ef:       wasmvm.HostFunc2_0(func(context.Context, *wasmvm.VMState, int32, int32) error { return nil }),
+			stack:    []wasmvm.ValueStackEntry{i32(1)},
+			trapType: wasmvm.TrapStackUnderflow,
+			message:  "CALL_HOST: Stack Underflow",
+		},
+		{
+			name:     "wrong argument type",
+			ef:       wasmvm.HostFunc1_0(func(context.Context, *wasmvm.VMState, uint64) error { return nil }),
+			stack:    []wasmvm.ValueStackEntry{i32(1)},
+			trapType: wasmvm.TrapStackUnderflow,
+			message:  "CALL_HOST: Stack Underflow",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := newHostTestVM(t)
+			for i := range tc.stack {
+				vm.ValueStack.Push(&tc.stack[i])
+			}
+			assert.Error(t, tc.ef.Call(context.Background(), vm))
+			require.NotNil(t, vm.TrapErr)
+			assert.Equal(t, tc.trapType, vm.TrapErr.Type)
+			assert.Equal(t, tc.message, vm.TrapErr.Message)
+		})
+	}
+}
+
+func TestHostFuncN_M_NoAllocations(t *testing.T) {
+	vm := newHostTestVM(t)
+	ef := wasmvm.HostFunc2_1(func(_ context.Context, _ *wasmvm.VMState, a, b int32) (int32, error) {
+		return a + b, nil
+	})
+	ctx := context.Background()
+	vm.ValueStack.PushInt32(0)
+	allocs := testing.AllocsPerRun(100, func() {
+		vm.ValueStack.PushInt32(1)
+		_ = ef.Call(ctx, vm)
+	})
+	assert.Zero(t, allocs)
+	top, _ := vm.ValueStack.Pop()
+	assert.Equal(t, uint32(101), top.Value_I32)
+}
+
+func benchmarkHostAdd(b *testing.B, ef *wasmvm.ExposedFunc) {
+	vm := newHostTestVM(b)
+	ctx := context.Background()
+	vm.ValueStack.PushInt32(0)
+	for b.Loop() {
+		vm.ValueStack.PushInt32(1)
+		if err := ef.Call(ctx, vm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHostFunc_Reflect(b *testing.B) {
+	ef, err := wasmvm.NewHostFunc(func(a, b int32) int32 { return a + b })
+	require.NoError(b, err)
+	benchmarkHostAdd(b, ef)
+}
+
+func BenchmarkHostFunc_Generic(b *testing.B) {
+	benchmarkHostAdd(b, wasmvm.HostFunc2_1(func(_ context.Context, _ *wasmvm.VMState, a, b int32) (int32, error) {
+		return a + b, nil
+	}))
+}
+
+func BenchmarkHostFunc_Raw(b *testing.B) {
+	benchmarkHostAdd(b, wasmvm.NewExposedFunc(
+		wasmvm.FuncType{
+			Params:  []wasmvm.ValueStackEntryType{wasmvm.TYPE_I32, wasmvm.TYPE_I32},
+			Results: []wasmvm.ValueStackEntryType{wasmvm.TYPE_I32},
+		},
+		func(_ context.Context, _ *wasmvm.VMState, params []wasmvm.ValueStackEntry) ([]wasmvm.ValueStackEntry, error) {
+			return []wasmvm.ValueStackEntry{i32(params[0].Value_I32 + params[1].Value_I32)}, nil
+		},
+	))
+}
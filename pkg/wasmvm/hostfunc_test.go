@@ -0,0 +1,193 @@
+package wasmvm_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fd int32
+
+type ctxKey struct{}
+
+func TestNewHostFunc_Signature(t *testing.T) {
+	tests := []struct {
+		name      string
+		fn        any
+		expect    string
+		expectErr wasmvm.HostFuncErrorType
+	}{
+		{name: "no params", fn: func() {}, expect: "() -> ()"},
+		{
+			name:   "context memory and values",
+			fn:     func(context.Context, wasmvm.Memory, int32, float64) (int64, error) { return 0, nil },
+			expect: "(i32, f64) -> (i64)",
+		},
+		{
+			name:   "vm state",
+			fn:     func(*wasmvm.VMState, uint32, uint64, float32) (float32, uint32) { return 0, 0 },
+			expect: "(i32, i64, f32) -> (f32, i32)",
+		},
+		{name: "named type", fn: func(fd) fd { return 0 }, expect: "(i32) -> (i32)"},
+		{name: "error only", fn: func(int64) error { return nil }, expect: "(i64) -> ()"},
+		{name: "failure - not a function", fn: 42, expectErr: wasmvm.HostFuncNotAFunction},
+		{name: "failure - nil", fn: nil, expectErr: wasmvm.HostFuncNotAFunction},
+		{name: "failure - nil function", fn: (func())(nil), expectErr: wasmvm.HostFuncNotAFunction},
+		{name: "failure - variadic", fn: func(...int32) {}, expectErr: wasmvm.HostFuncVariadic},
+		{name: "failure - int", fn: func(int) {}, expectErr: wasmvm.HostFuncUnsupportedParam},
+		{name: "failure - string", fn: func(int32, string) {}, expectErr: wasmvm.HostFuncUnsupportedParam},
+		{name: "failure - context second", fn: func(int32, context.Context) {}, expectErr: wasmvm.HostFuncMisplacedParam},
+		{name: "failure - memory after values", fn: func(int32, wasmvm.Memory) {}, expectErr: wasmvm.HostFuncMisplacedParam},
+		{name: "failure - bool result", fn: func() bool { return false }, expectErr: wasmvm.HostFuncUnsupportedResult},
+		{name: "failure - error not last", fn: func() (error, int32) { return nil, 0 }, expectErr: wasmvm.HostFuncUnsupportedResult},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ef, err := wasmvm.NewHostFunc(tc.fn)
+			if tc.expectErr != wasmvm.UndefinedHostFuncError {
+				var he *wasmvm.HostFuncError
+				require.ErrorAs(t, err, &he)
+				assert.Equal(t, tc.expectErr, he.Type)
+				assert.Nil(t, ef)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, ef.Type.String())
+		})
+	}
+
+	_, err := wasmvm.NewHostFunc(func(int32, string) {})
+	assert.EqualError(t, err, "[HostFuncUnsupportedParam] func(int32, string): parameter 1 has unsupported type string")
+}
+
+func TestExposedFunc_Call(t *testing.T) {
+	vm, err := (&wasmvm.VMConfig{}).SetFlatMemory([]byte{0, 0, 0, 0, 0x2A, 0, 0, 0}).BuildVMState()
+	require.NoError(t, err)
+
+	ef, err := wasmvm.NewHostFunc(func(ctx context.Context, mem wasmvm.Memory, addr int32, scale float64, neg fd) (int64, float32, uint32, error) {
+		buf := make([]byte, 1)
+		if res := mem.Read(wasmvm.MemoryContext{}, uint64(addr), buf); res != wasmvm.MemoryAccessOK {
+			return 0, 0, 0, errors.New(res.String())
+		}
+		return int64(float64(buf[0]) * scale), float32(ctx.Value(ctxKey{}).(int)), uint32(neg), nil
+	})
+	require.NoError(t, err)
+	assert.True(t, ef.Type.Equal(wasmvm.FuncType{
+		Params:  []wasmvm.ValueStackEntryType{wasmvm.TYPE_I32, wasmvm.TYPE_F64, wasmvm.TYPE_I32},
+		Results: []wasmvm.ValueStackEntryType{wasmvm.TYPE_I64, wasmvm.TYPE_F32, wasmvm.TYPE_I32},
+	}))
+
+	vm.ValueStack.PushInt32(99) // Left alone
+	vm.ValueStack.PushInt32(4)
+	vm.ValueStack.Push(wasmvm.NewValueStackEntryF64(1.5))
+	vm.ValueStack.PushInt32(uint32(math.MaxUint32)) // -1
+	ctx := context.WithValue(context.Background(), ctxKey{}, 7)
+	require.NoError(t, ef.Call(ctx, vm))
+
+	assert.Equal(t, 4, vm.ValueStack.Size())
+	top, _ := vm.ValueStack.Pop()
+	assert.Equal(t, *wasmvm.NewValueStackEntryI32(math.MaxUint32), *top)
+	top, _ = vm.ValueStack.Pop()
+	assert.Equal(t, *wasmvm.NewValueStackEntryF32(7), *top)
+	top, _ = vm.ValueStack.Pop()
+	assert.Equal(t, *wasmvm.NewValueStackEntryI64(63), *top)
+	top, _ = vm.ValueStack.Pop()
+	assert.Equal(t, uint32(99), top.Value_I32)
+
+	// The host error becomes a trap
+	vm.ValueStack.PushInt32(100)
+	vm.ValueStack.Push(wasmvm.NewValueStackEntryF64(1))
+	vm.ValueStack.PushInt32(0)
+	assert.Error(t, ef.Call(ctx, vm))
+	assert.Equal(t, wasmvm.TrapHostFunction, vm.TrapErr.Type)
+	assert.EqualError(t, vm.TrapErr.Cause, "MemoryAccessOutOfBounds")
+}
+
+func TestExposedFunc_CallTraps(t *testing.T) {
+	newVM := func(t *testing.T) *wasmvm.VMState {
+		vm, err := (&wasmvm.VMConfig{}).SetSize(1).BuildVMState()
+		require.NoError(t, err)
+		return vm
+	}
+	panics, err := wasmvm.NewHostFunc(func(v *wasmvm.VMState) { panic("boom") })
+	require.NoError(t, err)
+	typed, err := wasmvm.NewHostFunc(func(int64) {})
+	require.NoError(t, err)
+	wrongResult := wasmvm.NewExposedFunc(
+		wasmvm.FuncType{Results: []wasmvm.ValueStackEntryType{wasmvm.TYPE_I32}},
+		func(context.Context, *wasmvm.VMState, []wasmvm.ValueStackEntry) ([]wasmvm.ValueStackEntry, error) {
+			return []wasmvm.ValueStackEntry{*wasmvm.NewValueStackEntryI64(1)}, nil
+		},
+	)
+	tooMany := wasmvm.NewExposedFunc(
+		wasmvm.FuncType{},
+		func(context.Context, *wasmvm.VMState, []wasmvm.ValueStackEntry) ([]wasmvm.ValueStackEntry, error) {
+			return []wasmvm.ValueStackEntry{*wasmvm.NewValueStackEntryI64(1)}, nil
+		},
+	)
+
+	tests := []struct {
+		name     string
+		ef       *wasmvm.ExposedFunc
+		stack    []wasmvm.ValueStackEntry
+		trapType wasmvm.TrapType
+		message  string
+	}{
+		{name: "panic", ef: panics, trapType: wasmvm.TrapHostFunction, message: "CALL_HOST: host function panicked: boom"},
+		{name: "missing argument", ef: typed, trapType: wasmvm.TrapStackUnderflow, message: "CALL_HOST: Stack Underflow"},
+		{name: "wrong argument type", ef: typed, stack: []wasmvm.ValueStackEntry{i32(1)}, trapType: wasmvm.TrapStackUnderflow, message: "CALL_HOST: Stack Underflow"},
+		{name: "wrong result type", ef: wrongResult, trapType: wasmvm.TrapHostFunction, message: "CALL_HOST: results do not match () -> (i32)"},
+		{name: "too many results", ef: tooMany, trapType: wasmvm.TrapHostFunction, message: "CALL_HOST: results do not match () -> ()"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := newVM(t)
+			for i := range tc.stack {
+				vm.ValueStack.Push(&tc.stack[i])
+			}
+			assert.Error(t, tc.ef.Call(context.Background(), vm))
+			require.NotNil(t, vm.TrapErr)
+			assert.Equal(t, tc.trapType, vm.TrapErr.Type)
+			assert.Equal(t, tc.message, vm.TrapErr.Message)
+		})
+	}
+}
+
+func TestVMConfig_AppendHostFunc(t *testing.T) {
+	conf, err := new(wasmvm.VMConfig).AppendHostFunc("add", func(a, b int32) int32 { return a + b })
+	require.NoError(t, err)
+	_, err = conf.AppendHostFunc("sub", func(a, b int32) int32 { return a - b })
+	require.NoError(t, err)
+	assert.Len(t, conf.ExposedFuncs, 2)
+
+	_, err = conf.AppendHostFunc("add", func() {})
+	assert.Error(t, err)
+	_, err = conf.AppendHostFunc("bad", func(string) {})
+	var he *wasmvm.HostFuncError
+	assert.ErrorAs(t, err, &he)
+	assert.Len(t, conf.ExposedFuncs, 2)
+
+	// The default context is filled in when the caller has none
+	vm, err := conf.SetSize(1).BuildVMState()
+	require.NoError(t, err)
+	withCtx, err := wasmvm.NewHostFunc(func(ctx context.Context) int32 {
+		if ctx == nil {
+			return 0
+		}
+		return 1
+	})
+	require.NoError(t, err)
+	require.NoError(t, withCtx.Call(nil, vm))
+	vm.ValueStack.PushInt32(2)
+	vm.ValueStack.PushInt32(40)
+	require.NoError(t, vm.Config.ExposedFuncs["add"].Call(context.Background(), vm))
+	top, _ := vm.ValueStack.Pop()
+	assert.Equal(t, uint32(42), top.Value_I32)
+	top, _ = vm.ValueStack.Pop()
+	assert.Equal(t, uint32(1), top.Value_I32)
+}
@@ -1,8 +1,13 @@
 package wasmvm
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"strings"
 	//"golang.org/x/text/cases"
@@ -18,6 +23,10 @@ const (
 	Array
 	Empty
 	SparseArray
+	// Read to the end of ImageConfig.Reader
+	Reader
+	// Filename within ImageConfig.FS, such as an embed.FS
+	FS
 )
 
 var imageTypeStringToEnum = map[string]ImageType{
@@ -26,6 +35,8 @@ var imageTypeStringToEnum = map[string]ImageType{
 	"array":       Array,
 	"empty":       Empty,
 	"sparsearray": SparseArray,
+	"reader":      Reader,
+	"fs":          FS,
 }
 
 func ParseImageType(s string) (ImageType, error) {
@@ -45,6 +56,17 @@ func (t *ImageType) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// Written by the name ParseImageType takes, or as a number when it has
+// none
+func (t ImageType) MarshalJSON() ([]byte, error) {
+	for name, val := range imageTypeStringToEnum {
+		if val == t {
+			return json.Marshal(name)
+		}
+	}
+	return json.Marshal(int(t))
+}
+
 func (t *ImageType) UnmarshalJSON(data []byte) error {
 	// Try as string first
 	var s string
@@ -60,6 +82,75 @@ func (t *ImageType) UnmarshalJSON(data []byte) error {
 	return fmt.Errorf("ImageType: cannot unmarshal %s", string(data))
 }
 
+// How the data of a File, Reader or FS image is encoded. The other
+// image types ignore it.
+type ImageFormat byte
+
+const (
+	// Copied to memory from address 0
+	RawImage ImageFormat = iota
+	// A raw image, gzip compressed
+	GzipImage
+	// Intel HEX records, which carry their own load addresses
+	IntelHexImage
+	// Motorola S-records, which carry their own load addresses
+	SRecordImage
+)
+
+var imageFormatNames = map[ImageFormat]string{
+	RawImage:      "raw",
+	GzipImage:     "gzip",
+	IntelHexImage: "ihex",
+	SRecordImage:  "srec",
+}
+
+func (f ImageFormat) String() string {
+	if name, ok := imageFormatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("ImageFormat(%d)", f)
+}
+
+func ParseImageFormat(s string) (ImageFormat, error) {
+	key := strings.ToLower(strings.TrimSpace(s))
+	for k, v := range imageFormatNames {
+		if v == key {
+			return k, nil
+		}
+	}
+	return RawImage, NewImageInitializationError(UnknownImageType, fmt.Sprintf("unknown image format: %q", s))
+}
+
+func (f *ImageFormat) UnmarshalText(text []byte) error {
+	val, err := ParseImageFormat(string(text))
+	if err != nil {
+		return err
+	}
+	*f = val
+	return nil
+}
+
+// Written by name, or as a number when it has none
+func (f ImageFormat) MarshalJSON() ([]byte, error) {
+	if name, ok := imageFormatNames[f]; ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(int(f))
+}
+
+func (f *ImageFormat) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return f.UnmarshalText([]byte(s))
+	}
+	var i int
+	if err := json.Unmarshal(data, &i); err == nil {
+		*f = ImageFormat(i)
+		return nil
+	}
+	return fmt.Errorf("ImageFormat: cannot unmarshal %s", string(data))
+}
+
 //go:generate stringer -type=ImageInitializationErrorType
 type ImageInitializationErrorType byte
 
@@ -74,6 +165,10 @@ const (
 	SparseEntryOutOfBounds
 	SparseEntryMemoryOverwrite
 	SparseEntryMultipleTypes
+	// A Reader or FS image without its Reader or FS
+	ImageSourceMissing
+	// Data that doesn't decode in the configured format
+	ImageMalformed
 )
 
 // Custom error struct
@@ -115,19 +210,63 @@ func (sa *SparseArrayEntry) CreateErrorMeta(errorType ImageInitializationErrorTy
 	}
 }
 
-/*
-// This might get added later to support configuration export
+func (t ImageInitializationErrorType) MarshalJSON() ([]byte, error) {
+	return marshalEnumName(t)
+}
+
+func (t *ImageInitializationErrorType) UnmarshalJSON(data []byte) error {
+	return unmarshalEnumName(data, t, "ImageInitializationErrorType")
+}
+
+// For configuration export. The type is written by name through
+// ImageInitializationErrorType and the cause tagged with its kind
 func (e *ImageInitializationError) MarshalJSON() ([]byte, error) {
 	type Dummy ImageInitializationError
+	cause, err := marshalCause(e.Cause)
+	if err != nil {
+		return nil, err
+	}
 	return json.Marshal(&struct {
-		Type string `json:"type"` // override only this
 		*Dummy
+		Cause json.RawMessage `json:"cause,omitempty"` // override only this
 	}{
-		Type:  e.Type.String(),
-		Dummy: (*Dummy)(e), // ← actually using the alias
+		Dummy: (*Dummy)(e),
+		Cause: cause,
 	})
 }
-*/
+
+// Metadata comes back as the ImageErrorSparseMetaData or
+// ImageErrorMetaData the type of error carries
+func (e *ImageInitializationError) UnmarshalJSON(data []byte) error {
+	type Dummy ImageInitializationError
+	v := struct {
+		*Dummy
+		Cause json.RawMessage `json:"cause,omitempty"`
+		Meta  json.RawMessage `json:"metadata,omitempty"`
+	}{Dummy: (*Dummy)(e)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	cause, err := unmarshalCause(v.Cause)
+	if err != nil {
+		return err
+	}
+	e.Cause, e.Meta = cause, nil
+	if len(v.Meta) == 0 || string(v.Meta) == "null" {
+		return nil
+	}
+	switch e.Type {
+	case SparseEntryOutOfBounds, SparseEntryMemoryOverwrite, SparseEntryMultipleTypes:
+		var meta ImageErrorSparseMetaData
+		err = json.Unmarshal(v.Meta, &meta)
+		e.Meta = meta
+	default:
+		var meta ImageErrorMetaData
+		err = json.Unmarshal(v.Meta, &meta)
+		e.Meta = meta
+	}
+	return err
+}
 
 // Constructor helper
 func NewImageInitializationError(t ImageInitializationErrorType, msg string) error {
@@ -154,6 +293,11 @@ type ImageConfig struct {
 	Array    []uint8            `json:"array,omitempty"`
 	Size     uint64             `json:"size,omitempty"`
 	Sparse   []SparseArrayEntry `json:"sparsearray,omitempty"`
+	Format   ImageFormat        `json:"format,omitempty"`
+	// Sources that can't be written out. NewVM passes them on from the
+	// config it was given rather than cloning them.
+	Reader io.Reader `json:"-"`
+	FS     fs.FS     `json:"-"`
 }
 
 func (ic *ImageConfig) SetType(it ImageType) *ImageConfig {
@@ -173,6 +317,25 @@ func (ic *ImageConfig) SetArray(arr []uint8) *ImageConfig {
 	return ic
 }
 
+func (ic *ImageConfig) SetReader(r io.Reader) *ImageConfig {
+	ic.Type = Reader
+	ic.Reader = r
+	return ic
+}
+
+// Reads name from fsys, which is handy for images built in with embed
+func (ic *ImageConfig) SetFS(fsys fs.FS, name string) *ImageConfig {
+	ic.Type = FS
+	ic.FS = fsys
+	ic.Filename = name
+	return ic
+}
+
+func (ic *ImageConfig) SetFormat(f ImageFormat) *ImageConfig {
+	ic.Format = f
+	return ic
+}
+
 func (ic *ImageConfig) SetSize(size uint64) *ImageConfig {
 	ic.Size = size
 	return ic
@@ -215,18 +378,111 @@ const errmsg_ArrayLargerMemory = "array configured size larger than memory"
 const errmsg_ArrayLargerSize = "array entry larger than size"
 const errmsg_EmptyRequireSize = "empty type requires size"
 const errmsg_EmptyMemorySmallerThanSize = "memory is smaller than image size"
-const errmsg_SparseArrayOOBNumbered = "sparsearray entry out of bounds at offset %d"
+const errmsg_SparseArrayOOBNumbered = "sparsearray entry out of bounds at offset %d (entry %d, %d bytes)"
 const errmsg_SparseArrayOOB = "sparsearray entry out of bounds detected"
-const errmsg_SparseArrayOverwriteNumbered = "sparsearray: overwrite at offset %d"
+const errmsg_SparseArrayOverwriteNumbered = "sparsearray: overwrite at offset %d (entry %d, %d bytes)"
 const errmsg_SparseArrayOverwrite = "sparsearray: overwrite detected"
 const errmsg_SparseArrayMultiple = "sparsearray: multiple errors"
 const errmsg_SpareArrayUnknown = "sparearray: unknown error"
+const errmsg_SourceMissing = "%s image requires %s"
+const errmsg_GzipMalformed = "gzip image: %v"
+
+// Something PopulateImage let through in lenient mode that strict mode
+// fails on. Type is the error strict mode would have returned, or
+// UndefinedImageError for warnings about the rest of the config, such
+// as a redefined ring 0. A sparse entry gets one warning for each kind
+// of problem, covering all the bytes it affects.
+type ImageWarning struct {
+	Type ImageInitializationErrorType `json:"type"`
+	Msg  string                       `json:"message"`
+	// Index of the sparse entry, -1 for the other image types
+	Entry int `json:"entry"`
+	// First byte affected and how many are, for sparse entries
+	Offset     uint64 `json:"offset,omitempty"`
+	Count      uint64 `json:"count,omitempty"`
+	DataSize   uint64 `json:"dataSize"`
+	ConfigSize uint64 `json:"configSize"`
+	MemSize    uint64 `json:"memSize"`
+}
+
+func (w ImageWarning) String() string {
+	return w.Msg
+}
+
+// The display form of warnings, one line each
+func ImageWarningStrings(warns []ImageWarning) []string {
+	strs := make([]string, len(warns))
+	for i, w := range warns {
+		strs[i] = w.String()
+	}
+	return strs
+}
+
+// A warning about the image as a whole
+func newImageWarning(eType ImageInitializationErrorType, msg string, cfg *ImageConfig, dataSize uint64, mem Memory) ImageWarning {
+	return ImageWarning{
+		Type:       eType,
+		Msg:        msg,
+		Entry:      -1,
+		DataSize:   dataSize,
+		ConfigSize: cfg.Size,
+		MemSize:    mem.Size(),
+	}
+}
+
+// The warning for an error lenient mode still returns, such as an
+// unreadable file
+func imageWarningFromError(err error) ImageWarning {
+	w := ImageWarning{Msg: err.Error(), Entry: -1}
+	var ie *ImageInitializationError
+	if errors.As(err, &ie) {
+		w.Type = ie.Type
+		if meta, ok := ie.Meta.(ImageErrorMetaData); ok {
+			w.DataSize, w.ConfigSize, w.MemSize = meta.DataSize, meta.ConfigSize, meta.MemSize
+		}
+	}
+	return w
+}
+
+// The image is written by the loader rather than any running code,
+// so it uses the ring 0 context
+var imageLoaderContext = MemoryContext{}
+
+func readImageByte(mem Memory, addr uint64) byte {
+	var b [1]byte
+	mem.Read(imageLoaderContext, addr, b[:])
+	return b[0]
+}
+
+// Writes as much of data as fits, the same way copy() would
+func writeImageClamped(mem Memory, addr uint64, data []byte) {
+	size := mem.Size()
+	if addr >= size {
+		return
+	}
+	n := min(uint64(len(data)), size-addr)
+	mem.Write(imageLoaderContext, addr, data[:n])
+}
+
+// Zeroes [from, to) clamped to the memory size
+func zeroFillImage(mem Memory, from uint64, to uint64) {
+	to = min(to, mem.Size())
+	if from >= to {
+		return
+	}
+	zeros := make([]byte, min(to-from, MemoryShardSize))
+	for from < to {
+		n := min(to-from, uint64(len(zeros)))
+		mem.Write(imageLoaderContext, from, zeros[:n])
+		from += n
+	}
+}
 
 // PopulateImage fills mem according to config; returns warnings and error if any
-func PopulateImage(mem []byte, cfg *ImageConfig, strict bool) ([]string, error) {
-	warns := []string{}
+func PopulateImage(mem Memory, cfg *ImageConfig, strict bool) ([]ImageWarning, error) {
+	warns := []ImageWarning{}
 	switch cfg.Type {
-	case File:
+	case File, Reader, FS:
 		warns, err := handleFile(cfg, warns, mem, strict)
 		return warns, err
 	case Array:
@@ -247,14 +503,29 @@ func createSparseProblemKey(et ImageInitializationErrorType, i int) string {
 	return fmt.Sprintf("%d:%d", byte(et), i)
 }
 
-func handleSparse(cfg *ImageConfig, mem []byte, strict bool, warns []string) ([]string, error) {
+func handleSparse(cfg *ImageConfig, mem Memory, strict bool, warns []ImageWarning) ([]ImageWarning, error) {
 	cache := make(map[string]struct{})
 	problemEntries := []SparseArrayErrorEntry{}
 	eType := UndefinedImageError
 	for j, entry := range cfg.Sparse {
+		// Lenient mode problems of this entry, by type
+		var outOfBounds, overwrite *ImageWarning
+		note := func(w **ImageWarning, t ImageInitializationErrorType, addr uint64) {
+			if *w == nil {
+				*w = &ImageWarning{
+					Type:       t,
+					Entry:      j,
+					Offset:     addr,
+					DataSize:   uint64(len(entry.Array)),
+					ConfigSize: cfg.Size,
+					MemSize:    mem.Size(),
+				}
+			}
+			(*w).Count++
+		}
 		for i, b := range entry.Array {
 			addr := entry.Offset + uint64(i)
-			if addr >= uint64(len(mem)) {
+			if addr >= mem.Size() {
 				if strict {
 					if eType == UndefinedImageError {
 						eType = SparseEntryOutOfBounds
@@ -273,13 +544,13 @@ func handleSparse(cfg *ImageConfig, mem []byte, strict bool, warns []string) ([]
 
 					continue
 				} else {
-					warns = append(warns, fmt.Sprintf(errmsg_SparseArrayOOBNumbered, addr))
+					note(&outOfBounds, SparseEntryOutOfBounds, addr)
 				}
-			} else if mem[addr] != 0x00 && !strict {
+			} else if readImageByte(mem, addr) != 0x00 && !strict {
 				// Note that Overwrite means replacing non-zero data
 				// rather than than a range check
-				warns = append(warns, fmt.Sprintf(errmsg_SparseArrayOverwriteNumbered, addr))
-			} else if mem[addr] != 0x00 && strict {
+				note(&overwrite, SparseEntryMemoryOverwrite, addr)
+			} else if readImageByte(mem, addr) != 0x00 && strict {
 				if eType == UndefinedImageError {
 					eType = SparseEntryMemoryOverwrite
 				} else if eType == SparseEntryMemoryOverwrite {
@@ -295,10 +566,18 @@ func handleSparse(cfg *ImageConfig, mem []byte, strict bool, warns []string) ([]
 				}
 				continue
 			}
-			if addr < uint64(len(mem)) {
-				mem[addr] = b
+			if addr < mem.Size() {
+				mem.Write(imageLoaderContext, addr, []byte{b})
 			}
 		}
+		if outOfBounds != nil {
+			outOfBounds.Msg = fmt.Sprintf(errmsg_SparseArrayOOBNumbered, outOfBounds.Offset, j, outOfBounds.Count)
+			warns = append(warns, *outOfBounds)
+		}
+		if overwrite != nil {
+			overwrite.Msg = fmt.Sprintf(errmsg_SparseArrayOverwriteNumbered, overwrite.Offset, j, overwrite.Count)
+			warns = append(warns, *overwrite)
+		}
 	}
 	// We don't abort early
 	if len(problemEntries) != 0 {
@@ -319,7 +598,7 @@ func handleSparse(cfg *ImageConfig, mem []byte, strict bool, warns []string) ([]
 		if bldErr, ok := ferr.(*ImageInitializationError); ok {
 			bldErr.ApplyMeta(ImageErrorSparseMetaData{
 				ConfigSize:     uint64(cfg.Size),
-				MemSize:        uint64(len(mem)),
+				MemSize:        mem.Size(),
 				ProblemEntries: problemEntries,
 			})
 		}
@@ -328,7 +607,7 @@ func handleSparse(cfg *ImageConfig, mem []byte, strict bool, warns []string) ([]
 	return warns, nil
 }
 
-func handleEmpty(cfg *ImageConfig, mem []byte, warns []string, strict bool) ([]string, error) {
+func handleEmpty(cfg *ImageConfig, mem Memory, warns []ImageWarning, strict bool) ([]ImageWarning, error) {
 	if cfg.Size == 0 {
 		ferr := NewImageInitializationError(ImageSizeRequired, errmsg_EmptyRequireSize)
 		if bldErr, ok := ferr.(*ImageInitializationError); ok {
@@ -336,12 +615,12 @@ func handleEmpty(cfg *ImageConfig, mem []byte, warns []string, strict bool) ([]s
 				Filename:   cfg.Filename,
 				DataSize:   uint64(len(cfg.Array)),
 				ConfigSize: uint64(cfg.Size),
-				MemSize:    uint64(len(mem)),
+				MemSize:    mem.Size(),
 			})
 		}
 		return warns, ferr
 	}
-	if cfg.Size > uint64(len(mem)) {
+	if cfg.Size > mem.Size() {
 		if strict {
 			ferr := NewImageInitializationError(ImageSizeTooLargeForMemory, errmsg_EmptyMemorySmallerThanSize)
 			if bldErr, ok := ferr.(*ImageInitializationError); ok {
@@ -349,20 +628,18 @@ func handleEmpty(cfg *ImageConfig, mem []byte, warns []string, strict bool) ([]s
 					Filename:   cfg.Filename,
 					DataSize:   uint64(len(cfg.Array)),
 					ConfigSize: uint64(cfg.Size),
-					MemSize:    uint64(len(mem)),
+					MemSize:    mem.Size(),
 				})
 			}
 			return warns, ferr
 		}
-		warns = append(warns, errmsg_EmptyMemorySmallerThanSize)
-	}
-	for i := uint64(0); i < cfg.Size && i < uint64(len(mem)); i++ {
-		mem[i] = 0x00
+		warns = append(warns, newImageWarning(ImageSizeTooLargeForMemory, errmsg_EmptyMemorySmallerThanSize, cfg, uint64(len(cfg.Array)), mem))
 	}
+	zeroFillImage(mem, 0, cfg.Size)
 	return warns, nil
 }
 
-func handleArray(cfg *ImageConfig, mem []byte, warns []string, strict bool) ([]string, error) {
+func handleArray(cfg *ImageConfig, mem Memory, warns []ImageWarning, strict bool) ([]ImageWarning, error) {
 	if cfg.Size == 0 {
 		ferr := NewImageInitializationError(ImageSizeRequired, errmsg_ArrayRequiresSize)
 		if bldErr, ok := ferr.(*ImageInitializationError); ok {
@@ -370,12 +647,12 @@ func handleArray(cfg *ImageConfig, mem []byte, warns []string, strict bool) ([]s
 				Filename:   cfg.Filename,
 				DataSize:   uint64(len(cfg.Array)),
 				ConfigSize: uint64(cfg.Size),
-				MemSize:    uint64(len(mem)),
+				MemSize:    mem.Size(),
 			})
 		}
 		return warns, ferr
 	}
-	if cfg.Size > uint64(len(mem)) {
+	if cfg.Size > mem.Size() {
 		if strict {
 			ferr := NewImageInitializationError(ImageSizeTooLargeForMemory, errmsg_ArrayLargerMemory)
 			if bldErr, ok := ferr.(*ImageInitializationError); ok {
@@ -383,12 +660,12 @@ func handleArray(cfg *ImageConfig, mem []byte, warns []string, strict bool) ([]s
 					Filename:   cfg.Filename,
 					DataSize:   uint64(len(cfg.Array)),
 					ConfigSize: uint64(cfg.Size),
-					MemSize:    uint64(len(mem)),
+					MemSize:    mem.Size(),
 				})
 			}
 			return warns, ferr
 		}
-		warns = append(warns, errmsg_ArrayLargerMemory)
+		warns = append(warns, newImageWarning(ImageSizeTooLargeForMemory, errmsg_ArrayLargerMemory, cfg, uint64(len(cfg.Array)), mem))
 	}
 	if cfg.Size < uint64(len(cfg.Array)) {
 		if strict {
@@ -398,47 +675,116 @@ func handleArray(cfg *ImageConfig, mem []byte, warns []string, strict bool) ([]s
 					Filename:   cfg.Filename,
 					DataSize:   uint64(len(cfg.Array)),
 					ConfigSize: uint64(cfg.Size),
-					MemSize:    uint64(len(mem)),
+					MemSize:    mem.Size(),
 				})
 			}
 			return warns, ferr
 		}
-		warns = append(warns, errmsg_ArrayLargerSize)
-	}
-	copy(mem, cfg.Array)
-	for i := uint64(len(cfg.Array)); i < cfg.Size && i < uint64(len(mem)); i++ {
-		mem[i] = 0x00
+		warns = append(warns, newImageWarning(ImageInitArrayLargerThanConfig, errmsg_ArrayLargerSize, cfg, uint64(len(cfg.Array)), mem))
 	}
+	writeImageClamped(mem, 0, cfg.Array)
+	zeroFillImage(mem, uint64(len(cfg.Array)), cfg.Size)
 	return warns, nil
 }
 
-func handleFile(cfg *ImageConfig, warns []string, mem []byte, strict bool) ([]string, error) {
-	data, err := ReadFile(cfg.Filename)
+// Reads the data of a File, Reader or FS image, undecoded
+func readImageSource(cfg *ImageConfig) ([]byte, error) {
+	var data []byte
+	var err error
+	switch cfg.Type {
+	case Reader:
+		if cfg.Reader == nil {
+			return nil, NewImageInitializationError(ImageSourceMissing, fmt.Sprintf(errmsg_SourceMissing, "reader", "a Reader"))
+		}
+		data, err = io.ReadAll(cfg.Reader)
+	case FS:
+		if cfg.FS == nil {
+			return nil, NewImageInitializationError(ImageSourceMissing, fmt.Sprintf(errmsg_SourceMissing, "fs", "an FS"))
+		}
+		data, err = fs.ReadFile(cfg.FS, cfg.Filename)
+	default:
+		data, err = ReadFile(cfg.Filename)
+	}
 	if err != nil {
-		return warns, NewImageInitializationErrorWithCause(FileImageOtherError, errmsg_ReadingFile, err)
+		return nil, NewImageInitializationErrorWithCause(FileImageOtherError, errmsg_ReadingFile, err)
 	}
-	if len(data) > len(mem) {
+	return data, nil
+}
+
+// Decompresses at most limit bytes, so that a small file can't expand
+// to fill the host's memory. Anything past the limit is left unread.
+func gunzipImage(data []byte, limit uint64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(io.LimitReader(zr, int64(min(limit, 1<<62))))
+}
+
+func handleFile(cfg *ImageConfig, warns []ImageWarning, mem Memory, strict bool) ([]ImageWarning, error) {
+	data, err := readImageSource(cfg)
+	if err != nil {
+		return warns, err
+	}
+	switch cfg.Format {
+	case RawImage:
+	case GzipImage:
+		// One byte past the memory is enough to tell it doesn't fit
+		data, err = gunzipImage(data, mem.Size()+1)
+		if err != nil {
+			return warns, malformedImageError(cfg, mem, fmt.Sprintf(errmsg_GzipMalformed, err), err)
+		}
+	case IntelHexImage, SRecordImage:
+		parse := parseIntelHex
+		if cfg.Format == SRecordImage {
+			parse = parseSRecord
+		}
+		entries, err := parse(data)
+		if err != nil {
+			return warns, malformedImageError(cfg, mem, err.Error(), nil)
+		}
+		// The records load like a sparse array, so they are checked
+		// against the memory the same way
+		records := *cfg
+		records.Sparse = entries
+		return handleSparse(&records, mem, strict, warns)
+	default:
+		return warns, NewImageInitializationError(UnknownImageType, fmt.Sprintf("unknown image format: %s", cfg.Format.String()))
+	}
+	if uint64(len(data)) > mem.Size() {
 		if strict {
 			ferr := NewImageInitializationError(ImageSizeTooLargeForMemory,
-				fmt.Sprintf(errmsg_FileLargerMemory, len(data), len(mem)))
+				fmt.Sprintf(errmsg_FileLargerMemory, len(data), mem.Size()))
 			if bldErr, ok := ferr.(*ImageInitializationError); ok {
 				bldErr.ApplyMeta(ImageErrorMetaData{
 					Filename:   cfg.Filename,
 					DataSize:   uint64(len(data)),
 					ConfigSize: uint64(cfg.Size),
-					MemSize:    uint64(len(mem)),
+					MemSize:    mem.Size(),
 				})
 			}
 
 			return warns, ferr
 		}
-		// For now, we are keeping warns as just strings
-		warns = append(warns, fmt.Sprintf(errmsg_FileLargerMemory, len(data), len(mem)))
+		warns = append(warns, newImageWarning(ImageSizeTooLargeForMemory, fmt.Sprintf(errmsg_FileLargerMemory, len(data), mem.Size()), cfg, uint64(len(data)), mem))
 	}
-	copy(mem, data)
+	writeImageClamped(mem, 0, data)
 	return warns, nil
 }
 
+func malformedImageError(cfg *ImageConfig, mem Memory, msg string, cause error) error {
+	ferr := NewImageInitializationErrorWithCause(ImageMalformed, msg, cause)
+	if bldErr, ok := ferr.(*ImageInitializationError); ok {
+		bldErr.ApplyMeta(ImageErrorMetaData{
+			Filename:   cfg.Filename,
+			ConfigSize: uint64(cfg.Size),
+			MemSize:    mem.Size(),
+		})
+	}
+	return ferr
+}
+
 // ParseImageConfig parses JSON and returns *ImageConfig
 func ParseImageConfig(jsonBytes []byte) (*ImageConfig, error) {
 	var cfg ImageConfig
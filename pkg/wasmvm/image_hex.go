@@ -0,0 +1,164 @@
+package wasmvm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// Parsers for the text image formats that carry their own load
+// addresses. Both give back the data as sparse entries, with records
+// that follow on from each other joined into one entry, so they load
+// and are checked against the memory like a SparseArray image.
+
+type imageRecords struct {
+	entries []SparseArrayEntry
+}
+
+func (r *imageRecords) add(addr uint64, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if n := len(r.entries); n > 0 {
+		last := &r.entries[n-1]
+		if last.Offset+uint64(len(last.Array)) == addr {
+			last.Array = append(last.Array, data...)
+			return
+		}
+	}
+	r.entries = append(r.entries, SparseArrayEntry{Offset: addr, Array: slices.Clone(data)})
+}
+
+// Calls fn with each line that isn't blank, numbered from 1. Stops at
+// the first error or when fn reports the end record.
+func eachRecordLine(data []byte, fn func(n int, line []byte) (bool, error)) (bool, error) {
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		done, err := fn(i+1, line)
+		if err != nil || done {
+			return done, err
+		}
+	}
+	return false, nil
+}
+
+func decodeRecordHex(format string, n int, digits []byte) ([]byte, error) {
+	rec := make([]byte, hex.DecodedLen(len(digits)))
+	if _, err := hex.Decode(rec, digits); err != nil {
+		return nil, fmt.Errorf("%s line %d: %v", format, n, err)
+	}
+	return rec, nil
+}
+
+func parseIntelHex(data []byte) ([]SparseArrayEntry, error) {
+	const format = "intel hex"
+	var records imageRecords
+	// Set by the extended segment and linear address records
+	var base uint64
+	done, err := eachRecordLine(data, func(n int, line []byte) (bool, error) {
+		if line[0] != ':' {
+			return false, fmt.Errorf("%s line %d: missing start code", format, n)
+		}
+		rec, err := decodeRecordHex(format, n, line[1:])
+		if err != nil {
+			return false, err
+		}
+		if len(rec) < 5 || len(rec) != 5+int(rec[0]) {
+			return false, fmt.Errorf("%s line %d: wrong record length", format, n)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return false, fmt.Errorf("%s line %d: bad checksum", format, n)
+		}
+		addr := uint64(rec[1])<<8 | uint64(rec[2])
+		payload := rec[4 : len(rec)-1]
+		switch rec[3] {
+		case 0x00:
+			records.add(base+addr, payload)
+		case 0x01:
+			return true, nil
+		case 0x02, 0x04:
+			if len(payload) != 2 {
+				return false, fmt.Errorf("%s line %d: wrong address length", format, n)
+			}
+			base = uint64(payload[0])<<8 | uint64(payload[1])
+			if rec[3] == 0x02 {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		case 0x03, 0x05:
+			// Start addresses, there is nothing to load
+		default:
+			return false, fmt.Errorf("%s line %d: unknown record type %02X", format, n, rec[3])
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !done {
+		return nil, fmt.Errorf("%s: missing end of file record", format)
+	}
+	return records.entries, nil
+}
+
+// Bytes of address in each type of S-record, 0 for the reserved S4
+var srecordAddressSize = [10]int{2, 2, 3, 4, 0, 2, 3, 4, 3, 2}
+
+func parseSRecord(data []byte) ([]SparseArrayEntry, error) {
+	const format = "s-record"
+	var records imageRecords
+	done, err := eachRecordLine(data, func(n int, line []byte) (bool, error) {
+		if len(line) < 2 || line[0] != 'S' || line[1] < '0' || line[1] > '9' {
+			return false, fmt.Errorf("%s line %d: missing record type", format, n)
+		}
+		typ := line[1] - '0'
+		size := srecordAddressSize[typ]
+		if size == 0 {
+			return false, fmt.Errorf("%s line %d: unknown record type S%c", format, n, line[1])
+		}
+		rec, err := decodeRecordHex(format, n, line[2:])
+		if err != nil {
+			return false, err
+		}
+		// The count covers the address, data and checksum
+		if len(rec) < 2+size || len(rec) != 1+int(rec[0]) {
+			return false, fmt.Errorf("%s line %d: wrong record length", format, n)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0xFF {
+			return false, fmt.Errorf("%s line %d: bad checksum", format, n)
+		}
+		var addr uint64
+		for _, b := range rec[1 : 1+size] {
+			addr = addr<<8 | uint64(b)
+		}
+		switch typ {
+		case 1, 2, 3:
+			records.add(addr, rec[1+size:len(rec)-1])
+		case 7, 8, 9:
+			return true, nil
+		default:
+			// The header and record counts, there is nothing to load
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !done {
+		return nil, fmt.Errorf("%s: missing termination record", format)
+	}
+	return records.entries, nil
+}
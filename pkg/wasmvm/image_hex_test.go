@@ -0,0 +1,112 @@
+package wasmvm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadHexImage(mem []byte, format wasmvm.ImageFormat, text string, strict bool) ([]wasmvm.ImageWarning, error) {
+	cfg := (&wasmvm.ImageConfig{}).SetReader(strings.NewReader(text)).SetFormat(format)
+	return wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), cfg, strict)
+}
+
+// Data at 0 split over two records, 0x10002 past an extended linear
+// address and 0x20 past an extended segment address
+const intelHexImage = `:03000000010203F7
+:020003000405F2
+
+:020000040001F9
+:0100020009F4
+:020000020001FB
+:020010000707E0
+:0400000500000000F7
+:00000001FF
+anything after the end is ignored
+`
+
+func TestPopulateImage_IntelHex(t *testing.T) {
+	mem := make([]byte, 0x30)
+	_, err := loadHexImage(mem, wasmvm.IntelHexImage, intelHexImage, true)
+	var ie *wasmvm.ImageInitializationError
+	require.ErrorAs(t, err, &ie)
+	assert.Equal(t, wasmvm.SparseEntryOutOfBounds, ie.Type)
+	assert.Equal(t, []wasmvm.SparseArrayErrorEntry{
+		{Offset: 0x10002, Array: []byte{9}, ErrorType: wasmvm.SparseEntryOutOfBounds},
+	}, ie.Meta.(wasmvm.ImageErrorSparseMetaData).ProblemEntries)
+
+	mem = make([]byte, 0x30)
+	warns, err := loadHexImage(mem, wasmvm.IntelHexImage, intelHexImage, false)
+	require.NoError(t, err)
+	assert.Equal(t, []wasmvm.ImageWarning{
+		{Type: wasmvm.SparseEntryOutOfBounds, Msg: "sparsearray entry out of bounds at offset 65538 (entry 1, 1 bytes)", Entry: 1, Offset: 0x10002, Count: 1, DataSize: 1, MemSize: 0x30},
+	}, warns)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 0}, mem[:6])
+	assert.Equal(t, []byte{7, 7}, mem[0x20:0x22])
+}
+
+const sRecordImage = `S0060000686472BB
+S10500000102F7
+S20500000203F5
+S3060000000606ED
+S5030003F9
+S9030000FC
+`
+
+func TestPopulateImage_SRecord(t *testing.T) {
+	mem := make([]byte, 8)
+	warns, err := loadHexImage(mem, wasmvm.SRecordImage, sRecordImage, true)
+	require.NoError(t, err)
+	assert.Empty(t, warns)
+	assert.Equal(t, []byte{1, 2, 3, 0, 0, 0, 6, 0}, mem)
+
+	// Overwriting loaded data is checked like a sparse array
+	_, err = loadHexImage(mem, wasmvm.SRecordImage, sRecordImage, true)
+	assert.EqualError(t, err, "[SparseEntryMemoryOverwrite] sparsearray: overwrite detected")
+	warns, err = loadHexImage(mem, wasmvm.SRecordImage, "S10500100707DC\n"+sRecordImage, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"sparsearray entry out of bounds at offset 16 (entry 0, 2 bytes)",
+		"sparsearray: overwrite at offset 0 (entry 1, 3 bytes)",
+		"sparsearray: overwrite at offset 6 (entry 2, 1 bytes)",
+	}, wasmvm.ImageWarningStrings(warns))
+}
+
+func TestPopulateImage_HexMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		format wasmvm.ImageFormat
+		text   string
+		expect string
+	}{
+		{name: "ihex start code", format: wasmvm.IntelHexImage, text: "0300000001", expect: "intel hex line 1: missing start code"},
+		{name: "ihex digits", format: wasmvm.IntelHexImage, text: ":0G", expect: "intel hex line 1: encoding/hex: invalid byte: U+0047 'G'"},
+		{name: "ihex crlf", format: wasmvm.IntelHexImage, text: ":00000001FF\r\n", expect: ""},
+		{name: "ihex bad checksum", format: wasmvm.IntelHexImage, text: "\n\n:03000000010203F8", expect: "intel hex line 3: bad checksum"},
+		{name: "ihex length", format: wasmvm.IntelHexImage, text: ":0400000001020300", expect: "intel hex line 1: wrong record length"},
+		{name: "ihex address length", format: wasmvm.IntelHexImage, text: ":0100000400FB", expect: "intel hex line 1: wrong address length"},
+		{name: "ihex record type", format: wasmvm.IntelHexImage, text: ":00000006FA", expect: "intel hex line 1: unknown record type 06"},
+		{name: "ihex no end", format: wasmvm.IntelHexImage, text: ":03000000010203F7", expect: "intel hex: missing end of file record"},
+		{name: "srec type", format: wasmvm.SRecordImage, text: "X10500000102F7", expect: "s-record line 1: missing record type"},
+		{name: "srec reserved type", format: wasmvm.SRecordImage, text: "S4030000FC", expect: "s-record line 1: unknown record type S4"},
+		{name: "srec checksum", format: wasmvm.SRecordImage, text: "S10500000102F8", expect: "s-record line 1: bad checksum"},
+		{name: "srec length", format: wasmvm.SRecordImage, text: "S1040000", expect: "s-record line 1: wrong record length"},
+		{name: "srec no end", format: wasmvm.SRecordImage, text: "S10500000102F7", expect: "s-record: missing termination record"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Malformed data fails in either mode
+			for _, strict := range []bool{true, false} {
+				_, err := loadHexImage(make([]byte, 4), tc.format, tc.text, strict)
+				if tc.expect == "" {
+					assert.NoError(t, err)
+					continue
+				}
+				assert.EqualError(t, err, "[ImageMalformed] "+tc.expect)
+			}
+		})
+	}
+}
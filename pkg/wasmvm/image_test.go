@@ -1,10 +1,16 @@
 package wasmvm_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
 	"github.com/stretchr/testify/assert"
@@ -162,7 +168,7 @@ func executeTests(t *testing.T, tests []imageTestCase) {
 					mem = make([]byte, tc.memorySize)
 				}
 
-				warns, err := wasmvm.PopulateImage(mem, cfg, tc.useStrict)
+				warns, err := wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), cfg, tc.useStrict)
 
 				if tc.expectError {
 					processTestExpectError(t, err, warns, tc)
@@ -172,11 +178,11 @@ func executeTests(t *testing.T, tests []imageTestCase) {
 					if tc.expertWarns {
 						assert.NotEmpty(t, warns)
 						if tc.warnsContains != "" {
-							assert.Contains(t, warns[0], tc.warnsContains)
+							assert.Contains(t, warns[0].String(), tc.warnsContains)
 						} else if tc.multipleWarnsContains != nil {
 							for i = range tc.multipleWarnsContains {
 								// We expect the same order, but allow partial match
-								assert.Contains(t, warns[i], tc.multipleWarnsContains[i])
+								assert.Contains(t, warns[i].String(), tc.multipleWarnsContains[i])
 							}
 						}
 					}
@@ -193,7 +199,7 @@ func executeTests(t *testing.T, tests []imageTestCase) {
 }
 
 // Extracted function for handling the error condition
-func processTestExpectError(t *testing.T, err error, warns []string, tc imageTestCase) {
+func processTestExpectError(t *testing.T, err error, warns []wasmvm.ImageWarning, tc imageTestCase) {
 	assert.Error(t, err)
 	assert.Empty(t, warns)
 	if tc.checkErrorType {
@@ -771,7 +777,7 @@ func TestPopulateImage_UnknownType(t *testing.T) {
 	cfg := &wasmvm.ImageConfig{
 		Type: wasmvm.Unknown,
 	}
-	warns, err := wasmvm.PopulateImage(mem, cfg, false)
+	warns, err := wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), cfg, false)
 	assert.Error(t, err)
 	assert.Empty(t, warns)
 	var imgErr *wasmvm.ImageInitializationError
@@ -980,3 +986,215 @@ func TestImageConfig_Fluent(t *testing.T) {
 		})
 	}
 }
+
+func TestImageConfig_JSON(t *testing.T) {
+	cfg := (&wasmvm.ImageConfig{}).SetSparseArray([]wasmvm.SparseArrayEntry{{Offset: 2, Array: []byte{1, 2}}}).SetSize(8)
+	data, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, `{"type":"sparsearray","size":8,"sparsearray":[{"offset":2,"array":"AQI="}]}`, string(data))
+	back, err := wasmvm.ParseImageConfig(data)
+	require.NoError(t, err)
+	assert.Equal(t, cfg, back)
+
+	for _, it := range []wasmvm.ImageType{wasmvm.Unknown, wasmvm.File, wasmvm.Array, wasmvm.Empty, wasmvm.SparseArray, wasmvm.ImageType(9)} {
+		data, err := json.Marshal(it)
+		require.NoError(t, err)
+		var back wasmvm.ImageType
+		require.NoError(t, json.Unmarshal(data, &back), string(data))
+		assert.Equal(t, it, back)
+	}
+}
+
+func TestImageInitializationError_JSON(t *testing.T) {
+	sparse := &wasmvm.ImageInitializationError{
+		Type: wasmvm.SparseEntryMultipleTypes,
+		Msg:  "sparsearray: multiple errors",
+		Meta: wasmvm.ImageErrorSparseMetaData{
+			ConfigSize: 4,
+			MemSize:    8,
+			ProblemEntries: []wasmvm.SparseArrayErrorEntry{
+				{Offset: 6, Array: []byte{1, 2, 3}, ErrorType: wasmvm.SparseEntryOutOfBounds},
+			},
+		},
+	}
+	file := &wasmvm.ImageInitializationError{
+		Type:  wasmvm.FileImageOtherError,
+		Msg:   "Error while reading image file",
+		Cause: errors.New("no such file"),
+		Meta:  wasmvm.ImageErrorMetaData{Filename: "image.bin"},
+	}
+	data, err := json.Marshal(sparse)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type": "SparseEntryMultipleTypes", "message": "sparsearray: multiple errors",
+		"metadata": {"configSize": 4, "memSize": 8, "problemEntries": [
+			{"offset": 6, "array": "AQID", "ErrorType": "SparseEntryOutOfBounds"}]}}`, string(data))
+
+	for _, e := range []*wasmvm.ImageInitializationError{sparse, file, {Type: wasmvm.UnknownImageType, Msg: "x"}} {
+		data, err := json.Marshal(e)
+		require.NoError(t, err)
+		back := &wasmvm.ImageInitializationError{}
+		require.NoError(t, json.Unmarshal(data, back))
+		assert.Equal(t, e.Error(), back.Error())
+		assert.Equal(t, e.Meta, back.Meta)
+		if e.Cause != nil {
+			assert.Equal(t, e.Cause.Error(), back.Cause.Error())
+		}
+	}
+	assert.Error(t, json.Unmarshal([]byte(`{"type": "Nope"}`), &wasmvm.ImageInitializationError{}))
+}
+
+func TestPopulateImage_Warnings(t *testing.T) {
+	// One warning per entry and kind of problem, however many bytes
+	mem := []byte{0, 5, 0, 5}
+	cfg := (&wasmvm.ImageConfig{}).SetSparseArray([]wasmvm.SparseArrayEntry{
+		{Offset: 0, Array: []byte{1, 2, 3, 4, 5, 6}},
+		{Offset: 2, Array: make([]byte, 1<<20)},
+	})
+	warns, err := wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), cfg, false)
+	require.NoError(t, err)
+	assert.Equal(t, []wasmvm.ImageWarning{
+		{Type: wasmvm.SparseEntryOutOfBounds, Msg: "sparsearray entry out of bounds at offset 4 (entry 0, 2 bytes)", Entry: 0, Offset: 4, Count: 2, DataSize: 6, MemSize: 4},
+		{Type: wasmvm.SparseEntryMemoryOverwrite, Msg: "sparsearray: overwrite at offset 1 (entry 0, 2 bytes)", Entry: 0, Offset: 1, Count: 2, DataSize: 6, MemSize: 4},
+		{Type: wasmvm.SparseEntryOutOfBounds, Msg: "sparsearray entry out of bounds at offset 4 (entry 1, 1048574 bytes)", Entry: 1, Offset: 4, Count: 1<<20 - 2, DataSize: 1 << 20, MemSize: 4},
+		{Type: wasmvm.SparseEntryMemoryOverwrite, Msg: "sparsearray: overwrite at offset 2 (entry 1, 2 bytes)", Entry: 1, Offset: 2, Count: 2, DataSize: 1 << 20, MemSize: 4},
+	}, warns)
+	assert.Equal(t, []byte{1, 2, 0, 0}, mem)
+
+	warns, err = wasmvm.PopulateImage(wasmvm.NewFlatMemory(make([]byte, 2)), (&wasmvm.ImageConfig{}).SetArray([]byte{1, 2, 3}).SetSize(4), false)
+	require.NoError(t, err)
+	assert.Equal(t, []wasmvm.ImageWarning{
+		{Type: wasmvm.ImageSizeTooLargeForMemory, Msg: "array configured size larger than memory", Entry: -1, DataSize: 3, ConfigSize: 4, MemSize: 2},
+	}, warns)
+	assert.Equal(t, []string{"array configured size larger than memory"}, wasmvm.ImageWarningStrings(warns))
+
+	data, err := json.Marshal(warns[0])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type": "ImageSizeTooLargeForMemory", "message": "array configured size larger than memory",
+		"entry": -1, "dataSize": 3, "configSize": 4, "memSize": 2}`, string(data))
+}
+
+func TestNewVM_ImageWarningFromError(t *testing.T) {
+	vm, err := wasmvm.NewVM(&wasmvm.VMConfig{Size: 4, Image: (&wasmvm.ImageConfig{}).SetType(wasmvm.Array)})
+	require.NoError(t, err)
+	assert.Equal(t, []wasmvm.ImageWarning{
+		{Type: wasmvm.ImageSizeRequired, Msg: "[ImageSizeRequired] array type requires size", Entry: -1, MemSize: 4},
+	}, vm.ImageInitWarn)
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestPopulateImage_Sources(t *testing.T) {
+	fsys := fstest.MapFS{"boot/image.bin": {Data: []byte{1, 2, 3}}}
+
+	mem := make([]byte, 4)
+	warns, err := wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), (&wasmvm.ImageConfig{}).SetReader(strings.NewReader("\x01\x02")), true)
+	require.NoError(t, err)
+	assert.Empty(t, warns)
+	assert.Equal(t, []byte{1, 2, 0, 0}, mem)
+
+	mem = make([]byte, 4)
+	_, err = wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), (&wasmvm.ImageConfig{}).SetFS(fsys, "boot/image.bin"), true)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 0}, mem)
+
+	// The same size checks as a file
+	mem = make([]byte, 2)
+	_, err = wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), (&wasmvm.ImageConfig{}).SetFS(fsys, "boot/image.bin"), true)
+	assert.EqualError(t, err, "[ImageSizeTooLargeForMemory] file entry image is larger than memory file:3 vs mem:2")
+	warns, err = wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), (&wasmvm.ImageConfig{}).SetFS(fsys, "boot/image.bin"), false)
+	require.NoError(t, err)
+	assert.Equal(t, []wasmvm.ImageWarning{
+		{Type: wasmvm.ImageSizeTooLargeForMemory, Msg: "file entry image is larger than memory file:3 vs mem:2", Entry: -1, DataSize: 3, MemSize: 2},
+	}, warns)
+	assert.Equal(t, []byte{1, 2}, mem)
+
+	_, err = wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), (&wasmvm.ImageConfig{}).SetFS(fsys, "missing.bin"), false)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Contains(t, err.Error(), "[FileImageOtherError]")
+
+	_, err = wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), (&wasmvm.ImageConfig{}).SetType(wasmvm.Reader), false)
+	assert.EqualError(t, err, "[ImageSourceMissing] reader image requires a Reader")
+	_, err = wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), (&wasmvm.ImageConfig{}).SetType(wasmvm.FS), false)
+	assert.EqualError(t, err, "[ImageSourceMissing] fs image requires an FS")
+
+	_, err = wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), (&wasmvm.ImageConfig{}).SetFS(fsys, "boot/image.bin").SetFormat(wasmvm.ImageFormat(9)), false)
+	assert.EqualError(t, err, "[UnknownImageType] unknown image format: ImageFormat(9)")
+}
+
+func TestPopulateImage_Gzip(t *testing.T) {
+	original := wasmvm.ReadFile
+	defer func() { wasmvm.ReadFile = original }()
+	files := map[string][]byte{
+		"small.gz": gzipBytes(t, []byte{1, 2, 3}),
+		"large.gz": gzipBytes(t, make([]byte, 1<<20)),
+		"bad.gz":   []byte("this is not a gzip file"),
+	}
+	wasmvm.ReadFile = func(name string) ([]byte, error) {
+		return files[name], nil
+	}
+	load := func(mem []byte, name string, strict bool) ([]wasmvm.ImageWarning, error) {
+		cfg := (&wasmvm.ImageConfig{}).SetFilename(name).SetFormat(wasmvm.GzipImage)
+		return wasmvm.PopulateImage(wasmvm.NewFlatMemory(mem), cfg, strict)
+	}
+
+	mem := make([]byte, 4)
+	warns, err := load(mem, "small.gz", true)
+	require.NoError(t, err)
+	assert.Empty(t, warns)
+	assert.Equal(t, []byte{1, 2, 3, 0}, mem)
+
+	// Decompression stops a byte past the memory
+	_, err = load(mem, "large.gz", true)
+	assert.EqualError(t, err, "[ImageSizeTooLargeForMemory] file entry image is larger than memory file:5 vs mem:4")
+	warns, err = load(mem, "large.gz", false)
+	require.NoError(t, err)
+	assert.Len(t, warns, 1)
+	assert.Equal(t, []byte{0, 0, 0, 0}, mem)
+
+	for _, strict := range []bool{true, false} {
+		_, err = load(mem, "bad.gz", strict)
+		assert.ErrorIs(t, err, gzip.ErrHeader)
+		var ie *wasmvm.ImageInitializationError
+		require.ErrorAs(t, err, &ie)
+		assert.Equal(t, wasmvm.ImageMalformed, ie.Type)
+		assert.Equal(t, wasmvm.ImageErrorMetaData{Filename: "bad.gz", MemSize: 4}, ie.Meta)
+	}
+}
+
+func TestImageFormat_JSON(t *testing.T) {
+	cfg, err := wasmvm.ParseImageConfig([]byte(`{"type": "fs", "filename": "a.hex", "format": "IHEX"}`))
+	require.NoError(t, err)
+	assert.Equal(t, &wasmvm.ImageConfig{Type: wasmvm.FS, Filename: "a.hex", Format: wasmvm.IntelHexImage}, cfg)
+	data, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type": "fs", "filename": "a.hex", "format": "ihex"}`, string(data))
+
+	_, err = wasmvm.ParseImageConfig([]byte(`{"type": "file", "format": "zip"}`))
+	assert.EqualError(t, err, `[UnknownImageType] unknown image format: "zip"`)
+	f, err := wasmvm.ParseImageFormat(" srec ")
+	require.NoError(t, err)
+	assert.Equal(t, wasmvm.SRecordImage, f)
+	assert.Equal(t, "gzip", wasmvm.GzipImage.String())
+}
+
+func TestNewVM_ImageReader(t *testing.T) {
+	// The reader isn't lost when NewVM clones the config
+	mem := make([]byte, 4)
+	vm, err := wasmvm.NewVM(&wasmvm.VMConfig{
+		FlatMemory: mem,
+		Strict:     true,
+		Image:      (&wasmvm.ImageConfig{}).SetReader(bytes.NewReader([]byte{7, 8})),
+	})
+	require.NoError(t, err)
+	assert.Empty(t, vm.ImageInitWarn)
+	buf := make([]byte, 4)
+	vm.Memory.Read(wasmvm.MemoryContext{}, 0, buf)
+	assert.Equal(t, []byte{7, 8, 0, 0}, buf)
+}
@@ -18,11 +18,13 @@ func _() {
 	_ = x[SparseEntryOutOfBounds-7]
 	_ = x[SparseEntryMemoryOverwrite-8]
 	_ = x[SparseEntryMultipleTypes-9]
+	_ = x[ImageSourceMissing-10]
+	_ = x[ImageMalformed-11]
 }
 
-const _ImageInitializationErrorType_name = "UndefinedImageErrorUnknownImageTypeFileImageOtherErrorImageSizeRequiredImageSizeTooLargeForConfigImageSizeTooLargeForMemoryImageInitArrayLargerThanConfigSparseEntryOutOfBoundsSparseEntryMemoryOverwriteSparseEntryMultipleTypes"
+const _ImageInitializationErrorType_name = "UndefinedImageErrorUnknownImageTypeFileImageOtherErrorImageSizeRequiredImageSizeTooLargeForConfigImageSizeTooLargeForMemoryImageInitArrayLargerThanConfigSparseEntryOutOfBoundsSparseEntryMemoryOverwriteSparseEntryMultipleTypesImageSourceMissingImageMalformed"
 
-var _ImageInitializationErrorType_index = [...]uint8{0, 19, 35, 54, 71, 97, 123, 153, 175, 201, 225}
+var _ImageInitializationErrorType_index = [...]uint16{0, 19, 35, 54, 71, 97, 123, 153, 175, 201, 225, 243, 257}
 
 func (i ImageInitializationErrorType) String() string {
 	if i >= ImageInitializationErrorType(len(_ImageInitializationErrorType_index)-1) {
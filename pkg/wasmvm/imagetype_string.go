@@ -13,11 +13,13 @@ func _() {
 	_ = x[Array-2]
 	_ = x[Empty-3]
 	_ = x[SparseArray-4]
+	_ = x[Reader-5]
+	_ = x[FS-6]
 }
 
-const _ImageType_name = "UnknownFileArrayEmptySparseArray"
+const _ImageType_name = "UnknownFileArrayEmptySparseArrayReaderFS"
 
-var _ImageType_index = [...]uint8{0, 7, 11, 16, 21, 32}
+var _ImageType_index = [...]uint8{0, 7, 11, 16, 21, 32, 38, 40}
 
 func (i ImageType) String() string {
 	if i >= ImageType(len(_ImageType_index)-1) {
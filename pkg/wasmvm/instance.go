@@ -0,0 +1,857 @@
+package wasmvm
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// How deep calls may nest before trapping with TrapCallStackExhausted
+const maxCallDepth = 10000
+
+// Upper bound on the locals of a single function, declared counts are
+// only checked against this when the instance is built
+const maxFuncLocals = 50000
+
+// A function in the index space of an instance. Imported functions only
+// have host set, the rest run from the code memory.
+type funcInfo struct {
+	Type   FuncType
+	host   *ExposedFunc
+	Entry  uint64
+	End    uint64
+	Locals []ValueStackEntryType
+}
+
+// A module instantiated against a Linker. Its VM runs the function
+// bodies from a separate code memory, while VM.Memory is the linear
+// memory of the module.
+type Instance struct {
+	Module  *Module
+	VM      *VMState
+	Tables  []*Table
+	Globals []*Global
+
+	memory *HostMemory
+	funcs  []funcInfo
+	// Lazily built ExposedFuncs of the functions, see funcRef
+	refs   []*ExposedFunc
+	blocks map[uint64]blockInfo
+	// What Reset returns the instance to, taken by Snapshot
+	saved instanceState
+	// Segments that data.drop and elem.drop freed. Active and
+	// declarative segments start out dropped.
+	droppedData  []bool
+	droppedElems []bool
+	// Instructions left when VMConfig.Fuel is set
+	fuel    uint64
+	metered bool
+}
+
+type InstanceErrorType byte
+
+const (
+	UndefinedInstanceError InstanceErrorType = iota
+	InstanceLinkFailed
+	InstanceUnsupported
+	InstanceConstExpr
+	InstanceSegmentOutOfBounds
+	InstanceMalformedCode
+	InstanceSignatureMismatch
+	InstanceStartFailed
+	InstanceMissingEntryPoint
+	InstanceNondeterministic
+	InstanceMemoryLimit
+)
+
+var instanceErrorTypeNames = map[InstanceErrorType]string{
+	UndefinedInstanceError:     "UndefinedInstanceError",
+	InstanceLinkFailed:         "InstanceLinkFailed",
+	InstanceUnsupported:        "InstanceUnsupported",
+	InstanceConstExpr:          "InstanceConstExpr",
+	InstanceSegmentOutOfBounds: "InstanceSegmentOutOfBounds",
+	InstanceMalformedCode:      "InstanceMalformedCode",
+	InstanceSignatureMismatch:  "InstanceSignatureMismatch",
+	InstanceStartFailed:        "InstanceStartFailed",
+	InstanceMissingEntryPoint:  "InstanceMissingEntryPoint",
+	InstanceNondeterministic:   "InstanceNondeterministic",
+	InstanceMemoryLimit:        "InstanceMemoryLimit",
+}
+
+var instanceErrorMessageTemplates = map[InstanceErrorType]string{
+	UndefinedInstanceError:     "unknown instance error",
+	InstanceLinkFailed:         "%v",
+	InstanceUnsupported:        "unsupported: %s",
+	InstanceConstExpr:          "bad constant expression in %s: %v",
+	InstanceSegmentOutOfBounds: "%s segment %d out of bounds",
+	InstanceMalformedCode:      "function %d: %v",
+	InstanceSignatureMismatch:  "%s expects %s, called with %s",
+	InstanceStartFailed:        "start function %d: %v",
+	InstanceMissingEntryPoint:  "no function exported as %q",
+	InstanceNondeterministic:   "deterministic mode forbids importing %s",
+	InstanceMemoryLimit:        "memory of %d bytes exceeds the limit of %d",
+}
+
+func (t InstanceErrorType) String() string {
+	if name, ok := instanceErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("InstanceErrorType(%d)", t)
+}
+
+type InstanceError struct {
+	Type  InstanceErrorType
+	Msg   string
+	Cause error
+}
+
+func NewInstanceError(eType InstanceErrorType, cause error, paras ...any) error {
+	msg, ok := instanceErrorMessageTemplates[eType]
+	if !ok {
+		msg = instanceErrorMessageTemplates[UndefinedInstanceError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	return &InstanceError{
+		Type:  eType,
+		Msg:   msg,
+		Cause: cause,
+	}
+}
+
+func (e *InstanceError) Error() string {
+	return fmt.Sprintf("[%s] %s", e.Type.String(), e.Msg)
+}
+
+func (e *InstanceError) Unwrap() error {
+	return e.Cause
+}
+
+// Resolves the imports of m through l (which may be nil for a module
+// without imports), sets up memory, globals and tables, applies the
+// active segments and runs the start function if there is one. config
+// is optional; only the memory model, rings, mode, entry point, limits,
+// determinism and host fields of it are used.
+func Instantiate(m *Module, l *Linker, config *VMConfig) (*Instance, error) {
+	return InstantiateContext(context.Background(), m, l, config)
+}
+
+// Instantiate with the start function run under ctx, so that it can be
+// interrupted
+func InstantiateContext(ctx context.Context, m *Module, l *Linker, config *VMConfig) (*Instance, error) {
+	if l == nil {
+		l = NewLinker()
+	}
+	res, err := l.Resolve(m)
+	if err != nil {
+		return nil, NewInstanceError(InstanceLinkFailed, err, err)
+	}
+	if len(res.Memories)+len(m.Memories) > 1 {
+		return nil, NewInstanceError(InstanceUnsupported, nil, "more than one memory")
+	}
+	vc := &VMConfig{}
+	if config != nil {
+		if vc, err = config.QuickClone(); err != nil {
+			return nil, NewVMInitializationErrorWithCauseOrMeta(VMConfigInternalError, VmInitErrStr(VMConfigInternalError, err.Error()), err, nil)
+		}
+		vc.Stdin = config.Stdin
+		vc.Stdout = config.Stdout
+		vc.Stderr = config.Stderr
+		vc.ExposedFuncs = config.ExposedFuncs
+		vc.SnapshotHooks = config.SnapshotHooks
+	}
+	if vc.Deterministic {
+		if names := nondeterministicImports(m, res); len(names) > 0 {
+			return nil, NewInstanceError(InstanceNondeterministic, nil, strings.Join(names, ", "))
+		}
+	}
+
+	// Check a defined memory before allocating it; an imported one
+	// already exists and is checked below
+	if len(res.Memories) == 0 && len(m.Memories) > 0 && vc.MaxMemory > 0 {
+		if pages := m.Memories[0].Limits.Min; pages > vc.MaxMemory/WasmPageSize {
+			return nil, NewInstanceError(InstanceMemoryLimit, nil, pages*WasmPageSize, vc.MaxMemory)
+		}
+	}
+
+	inst := &Instance{
+		Module:  m,
+		blocks:  map[uint64]blockInfo{},
+		memory:  newInstanceMemory(m, res, vc),
+		fuel:    vc.Fuel,
+		metered: vc.Fuel > 0,
+	}
+	vc.Size = inst.memory.Memory.Size()
+	if vc.MaxMemory > 0 && vc.Size > vc.MaxMemory {
+		return nil, NewInstanceError(InstanceMemoryLimit, nil, vc.Size, vc.MaxMemory)
+	}
+
+	code, err := inst.layoutFuncs(res)
+	if err != nil {
+		return nil, err
+	}
+	codeMem := NewFlatMemory(code)
+	if err := codeMem.SetPermissions(0, uint64(len(code)), MemoryPermRX); err != nil {
+		return nil, err
+	}
+	vm := &VMState{
+		Memory:         inst.memory.Memory,
+		Config:         vc,
+		InstructionMap: instanceInstructionMap(),
+		instance:       inst,
+		code:           codeMem,
+	}
+	if err := initVMState(vm); err != nil {
+		return nil, err
+	}
+	inst.VM = vm
+
+	if err := inst.initGlobals(res); err != nil {
+		return nil, err
+	}
+	inst.Tables = append(inst.Tables, res.Tables...)
+	for _, tt := range m.Tables {
+		inst.Tables = append(inst.Tables, NewTable(tt))
+	}
+	if err := inst.initElements(); err != nil {
+		return nil, err
+	}
+	if err := inst.initData(); err != nil {
+		return nil, err
+	}
+	if m.Start != nil {
+		if _, err := inst.invoke(ctx, *m.Start, nil); err != nil {
+			return nil, NewInstanceError(InstanceStartFailed, err, *m.Start, err)
+		}
+	}
+	return inst, nil
+}
+
+// Entry exports of the WASI application ABI
+const (
+	EntryStart      = "_start"
+	EntryInitialize = "_initialize"
+)
+
+// The export Run calls: VMConfig.EntryPoint when set, otherwise _start
+// for a command or _initialize for a reactor. Empty for a module with
+// neither, such as a library.
+func (inst *Instance) EntryPoint() string {
+	if name := inst.VM.Config.EntryPoint; name != "" {
+		return name
+	}
+	for _, name := range []string{EntryStart, EntryInitialize} {
+		if exp, ok := inst.Module.Export(name); ok && exp.Kind == ExternFunc {
+			return name
+		}
+	}
+	return ""
+}
+
+// Calls the entry point, which has to take and return nothing. Does
+// nothing when there is no entry point.
+func (inst *Instance) Run(ctx context.Context) error {
+	name := inst.EntryPoint()
+	if name == "" {
+		return nil
+	}
+	f := inst.ExportedFunction(name)
+	if f == nil {
+		return NewInstanceError(InstanceMissingEntryPoint, nil, name)
+	}
+	if len(f.Type.Params) > 0 || len(f.Type.Results) > 0 {
+		return NewInstanceError(InstanceSignatureMismatch, nil, name, f.Type, FuncType{})
+	}
+	_, err := f.Call(ctx)
+	return err
+}
+
+// The imported memory, or a new one sized to the minimum of the memory
+// the module defines
+func newInstanceMemory(m *Module, res *ResolvedImports, vc *VMConfig) *HostMemory {
+	if len(res.Memories) > 0 {
+		return res.Memories[0]
+	}
+	if len(m.Memories) == 0 {
+		return &HostMemory{Memory: NewFlatMemory(nil), Max: new(uint64)}
+	}
+	mt := m.Memories[0]
+	size := mt.Limits.Min * WasmPageSize
+	hm := &HostMemory{Max: mt.Limits.Max}
+	switch {
+	case mt.Shared:
+		hm.Memory = NewFlatSharedMemory(size)
+	case vc.MemoryModel == ShardedMemoryModel:
+		hm.Memory = NewShardedMemory(size)
+	default:
+		hm.Memory = NewFlatMemory(make([]byte, size))
+	}
+	return hm
+}
+
+// Builds the function index space and copies the bodies back to back
+// into the returned code
+func (inst *Instance) layoutFuncs(res *ResolvedImports) ([]byte, error) {
+	m := inst.Module
+	imported := len(res.Funcs)
+	inst.funcs = make([]funcInfo, imported+len(m.Funcs))
+	inst.refs = make([]*ExposedFunc, len(inst.funcs))
+	for i, ef := range res.Funcs {
+		inst.funcs[i] = funcInfo{Type: ef.Type, host: ef}
+		inst.refs[i] = ef
+	}
+	var code []byte
+	for i, body := range m.Code {
+		idx := imported + i
+		f := funcInfo{Type: m.Types[m.Funcs[i]], Entry: uint64(len(code))}
+		total := 0
+		for _, local := range body.Locals {
+			total += int(local.Count)
+			if total > maxFuncLocals {
+				return nil, NewInstanceError(InstanceUnsupported, nil, fmt.Sprintf("more than %d locals in function %d", maxFuncLocals, idx))
+			}
+			for range local.Count {
+				f.Locals = append(f.Locals, local.Type)
+			}
+		}
+		end, err := scanFuncBody(m, body, f.Entry, inst.blocks)
+		if re, ok := err.(*refInstructionError); ok {
+			return nil, NewInstanceError(InstanceUnsupported, nil, fmt.Sprintf("%s in function %d", re.name, idx))
+		}
+		if err != nil {
+			return nil, NewInstanceError(InstanceMalformedCode, err, idx, err)
+		}
+		f.End = end
+		inst.funcs[idx] = f
+		code = append(code, body.Code...)
+	}
+	return code, nil
+}
+
+func (inst *Instance) initGlobals(res *ResolvedImports) error {
+	inst.Globals = append(inst.Globals, res.Globals...)
+	for i, mg := range inst.Module.Globals {
+		val, _, err := inst.evalConstExpr(mg.Init)
+		if err == nil && val.EntryType != mg.Type.ValType {
+			err = fmt.Errorf("%s value for a %s global", val.EntryType, mg.Type.ValType)
+		}
+		if err != nil {
+			return NewInstanceError(InstanceConstExpr, err, fmt.Sprintf("global %d", len(res.Globals)+i), err)
+		}
+		inst.Globals = append(inst.Globals, &Global{Type: mg.Type, Value: val})
+	}
+	return nil
+}
+
+// The state of an instance outside its memory that Reset restores
+type instanceState struct {
+	globals      []ValueStackEntry
+	tables       [][]*ExposedFunc
+	droppedData  []bool
+	droppedElems []bool
+	fuel         uint64
+}
+
+func (inst *Instance) saveState() {
+	s := &inst.saved
+	s.globals = s.globals[:0]
+	for _, g := range inst.Globals {
+		s.globals = append(s.globals, g.Value)
+	}
+	s.tables = s.tables[:0]
+	for _, t := range inst.Tables {
+		s.tables = append(s.tables, slices.Clone(t.Elements))
+	}
+	s.droppedData = slices.Clone(inst.droppedData)
+	s.droppedElems = slices.Clone(inst.droppedElems)
+	s.fuel = inst.fuel
+}
+
+// The saved elements are copied back, so the state can be restored again
+func (inst *Instance) restoreState() {
+	s := &inst.saved
+	for i, g := range inst.Globals {
+		if g.Type.Mutable {
+			g.Value = s.globals[i]
+		}
+	}
+	for i, t := range inst.Tables {
+		t.Elements = append(t.Elements[:0], s.tables[i]...)
+	}
+	copy(inst.droppedData, s.droppedData)
+	copy(inst.droppedElems, s.droppedElems)
+	inst.fuel = s.fuel
+}
+
+// Evaluates a constant expression, which yields either a value or a
+// function reference (nil for ref.null)
+func (inst *Instance) evalConstExpr(expr []byte) (ValueStackEntry, *ExposedFunc, error) {
+	r := &moduleReader{data: expr}
+	var val ValueStackEntry
+	var ref *ExposedFunc
+	for !r.done() {
+		op, _ := r.readByte()
+		switch op {
+		case OP_END:
+			return val, ref, nil
+		case OP_CONST_I32, OP_CONST_I64:
+			bits := uint(32)
+			if op == OP_CONST_I64 {
+				bits = 64
+			}
+			v, n, err := DecodeSLEB128(r.data[r.pos:], bits)
+			if err != nil {
+				return val, nil, err
+			}
+			r.pos += n
+			if op == OP_CONST_I32 {
+				val = *NewValueStackEntryI32(uint32(v))
+			} else {
+				val = *NewValueStackEntryI64(uint64(v))
+			}
+		case 0x43: // f32.const
+			b, err := r.readBytes(4)
+			if err != nil {
+				return val, nil, err
+			}
+			val = *NewValueStackEntryF32(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		case 0x44: // f64.const
+			b, err := r.readBytes(8)
+			if err != nil {
+				return val, nil, err
+			}
+			val = *NewValueStackEntryF64(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		case 0x23: // global.get, only of globals defined before
+			idx, err := r.readU32()
+			if err != nil {
+				return val, nil, err
+			}
+			if int(idx) >= len(inst.Globals) {
+				return val, nil, fmt.Errorf("global %d not available", idx)
+			}
+			val = inst.Globals[idx].Value
+		case 0xD2: // ref.func
+			idx, err := r.readU32()
+			if err != nil {
+				return val, nil, err
+			}
+			if int(idx) >= len(inst.funcs) {
+				return val, nil, fmt.Errorf("function %d out of range", idx)
+			}
+			ref = inst.funcRef(idx)
+		case 0xD0: // ref.null
+			if _, err := r.readRefType(); err != nil {
+				return val, nil, err
+			}
+			ref = nil
+		default:
+			return val, nil, fmt.Errorf("opcode 0x%02X", op)
+		}
+	}
+	return val, nil, fmt.Errorf("missing end")
+}
+
+// Evaluates the offset of an active segment
+func (inst *Instance) segmentOffset(what string, idx int, expr []byte) (uint64, error) {
+	val, _, err := inst.evalConstExpr(expr)
+	if err == nil && val.EntryType != TYPE_I32 {
+		err = fmt.Errorf("%s offset", val.EntryType)
+	}
+	if err != nil {
+		return 0, NewInstanceError(InstanceConstExpr, err, fmt.Sprintf("%s segment %d", what, idx), err)
+	}
+	return uint64(val.Value_I32), nil
+}
+
+// The functions element segment i refers to
+func (inst *Instance) elementRefs(i int) ([]*ExposedFunc, error) {
+	seg := inst.Module.Elements[i]
+	refs := make([]*ExposedFunc, 0, len(seg.Funcs)+len(seg.Exprs))
+	for _, idx := range seg.Funcs {
+		refs = append(refs, inst.funcRef(idx))
+	}
+	for _, expr := range seg.Exprs {
+		_, ref, err := inst.evalConstExpr(expr)
+		if err != nil {
+			return nil, NewInstanceError(InstanceConstExpr, err, fmt.Sprintf("element segment %d", i), err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func (inst *Instance) initElements() error {
+	inst.droppedElems = make([]bool, len(inst.Module.Elements))
+	for i, seg := range inst.Module.Elements {
+		if seg.Mode == SegmentPassive {
+			continue
+		}
+		inst.droppedElems[i] = true
+		if seg.Mode != SegmentActive {
+			continue
+		}
+		offset, err := inst.segmentOffset("element", i, seg.Offset)
+		if err != nil {
+			return err
+		}
+		refs, err := inst.elementRefs(i)
+		if err != nil {
+			return err
+		}
+		table := inst.Tables[seg.Table]
+		if offset+uint64(len(refs)) > uint64(len(table.Elements)) {
+			return NewInstanceError(InstanceSegmentOutOfBounds, nil, "element", i)
+		}
+		copy(table.Elements[offset:], refs)
+	}
+	return nil
+}
+
+func (inst *Instance) initData() error {
+	mem := inst.memory.Memory
+	inst.droppedData = make([]bool, len(inst.Module.Data))
+	for i, seg := range inst.Module.Data {
+		if seg.Mode != SegmentActive {
+			continue
+		}
+		inst.droppedData[i] = true
+		offset, err := inst.segmentOffset("data", i, seg.Offset)
+		if err != nil {
+			return err
+		}
+		if !inBounds(mem.Size(), offset, len(seg.Init)) {
+			return NewInstanceError(InstanceSegmentOutOfBounds, nil, "data", i)
+		}
+		if res := mem.Write(MemoryContext{}, offset, seg.Init); res != MemoryAccessOK {
+			return NewInstanceError(InstanceSegmentOutOfBounds, nil, "data", i)
+		}
+	}
+	return nil
+}
+
+// The ExposedFunc for function idx, so that it can be stored in tables
+// and exported to other instances
+func (inst *Instance) funcRef(idx uint32) *ExposedFunc {
+	if ef := inst.refs[idx]; ef != nil {
+		return ef
+	}
+	ef := NewExposedFunc(inst.funcs[idx].Type, func(ctx context.Context, _ *VMState, params []ValueStackEntry) ([]ValueStackEntry, error) {
+		return inst.invoke(ctx, idx, params)
+	})
+	ef.owner = inst
+	ef.index = idx
+	inst.refs[idx] = ef
+	return ef
+}
+
+// Pushes a frame for function idx, whose parameters are already on the
+// stack, and jumps to its first instruction
+func (inst *Instance) enter(vm *VMState, op string, idx uint32, returnPC uint64) error {
+	f := &inst.funcs[idx]
+	if len(vm.CallStack) >= maxCallDepth {
+		return vm.SetTrapError(&TrapError{
+			Type:    TrapCallStackExhausted,
+			Op:      op,
+			PC:      vm.PC,
+			Message: fmt.Sprintf("%s: call depth of %d exceeded", op, maxCallDepth),
+		})
+	}
+	if ok, _ := vm.ValueStack.HasTypes(f.Type.Params...); !ok {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	vm.CallStack = append(vm.CallStack, CallFrame{
+		ReturnPC:    returnPC,
+		StackHeight: vm.ValueStack.Size() - len(f.Type.Params),
+		Func:        idx,
+		Labels:      len(vm.Labels),
+		Arity:       len(f.Type.Results),
+	})
+	for _, t := range f.Locals {
+		vm.ValueStack.pushEntry(ValueStackEntry{EntryType: t})
+	}
+	vm.Labels = append(vm.Labels, Label{
+		Func:        true,
+		End:         f.End,
+		StackHeight: vm.ValueStack.Size(),
+		Arity:       len(f.Type.Results),
+	})
+	vm.PC = f.Entry
+	return nil
+}
+
+// Calls function idx from the instruction at vm.PC, continuing at next
+// once it returns
+func (inst *Instance) call(vm *VMState, op string, idx uint32, next uint64) error {
+	f := &inst.funcs[idx]
+	if f.host == nil {
+		return inst.enter(vm, op, idx, next)
+	}
+	if err := f.host.Call(vm.ctx, vm); err != nil {
+		return err
+	}
+	vm.PC = next
+	return nil
+}
+
+// Steps until the call stack is back to depth frames, checking for a
+// cancelled ctx every so often
+func (inst *Instance) runUntilReturn(ctx context.Context, depth int) error {
+	vm := inst.VM
+	done := ctx.Done()
+	for steps := 0; len(vm.CallStack) > depth; steps++ {
+		if steps&1023 == 0 && done != nil {
+			select {
+			case <-done:
+				return vm.SetTrapError(&TrapError{
+					Type:    TrapInterrupted,
+					Op:      "CALL",
+					PC:      vm.PC,
+					Message: fmt.Sprintf("CALL: interrupted: %v", context.Cause(ctx)),
+					Cause:   context.Cause(ctx),
+				})
+			default:
+			}
+		}
+		if inst.metered {
+			if inst.fuel == 0 {
+				return vm.SetTrapError(&TrapError{
+					Type:    TrapOutOfFuel,
+					Op:      "CALL",
+					PC:      vm.PC,
+					Message: "CALL: out of fuel",
+				})
+			}
+			inst.fuel--
+		}
+		if err := vm.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Instructions left to execute, and whether the instance is metered at
+// all
+func (inst *Instance) Fuel() (uint64, bool) {
+	return inst.fuel, inst.metered
+}
+
+// Tops up the fuel of a metered instance, for instance after it ran out
+func (inst *Instance) AddFuel(n uint64) {
+	inst.fuel += n
+}
+
+// Finds the function a code address belongs to, and where that
+// instruction is in the module binary. Trap PCs are such addresses.
+func (inst *Instance) Locate(pc uint64) (uint32, uint64, bool) {
+	imported := inst.Module.ImportCount(ExternFunc)
+	for i, f := range inst.funcs[imported:] {
+		if pc >= f.Entry && pc <= f.End {
+			return uint32(imported + i), inst.Module.Code[i].Offset + pc - f.Entry, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Runs function idx to completion on the VM of the instance. It can be
+// called while the VM is already running, e.g. from a host function,
+// since everything it pushes is unwound before returning. A trap is
+// returned as the *TrapError and then cleared, leaving the instance
+// usable.
+func (inst *Instance) invoke(ctx context.Context, idx uint32, args []ValueStackEntry) ([]ValueStackEntry, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	vm := inst.VM
+	f := &inst.funcs[idx]
+	savedPC, savedCtx := vm.PC, vm.ctx
+	frames, labels, height := len(vm.CallStack), len(vm.Labels), vm.ValueStack.Size()
+	vm.ctx = ctx
+	defer func() {
+		vm.PC, vm.ctx = savedPC, savedCtx
+	}()
+
+	for i := range args {
+		vm.ValueStack.pushEntry(args[i])
+	}
+	var err error
+	if f.host != nil {
+		err = f.host.Call(ctx, vm)
+	} else if err = inst.enter(vm, "CALL", idx, savedPC); err == nil {
+		err = inst.runUntilReturn(ctx, frames)
+	}
+	if err == nil {
+		ok, results := vm.ValueStack.HasTypes(f.Type.Results...)
+		if ok && vm.ValueStack.Size() == height+len(results) {
+			out := make([]ValueStackEntry, len(results))
+			copy(out, results)
+			vm.ValueStack.elements = vm.ValueStack.elements[:height]
+			return out, nil
+		}
+		err = NewStackCleanupErrorAndSetTrap(vm, "RETURN")
+	}
+	vm.CallStack = vm.CallStack[:frames]
+	vm.Labels = vm.Labels[:labels]
+	vm.ValueStack.elements = vm.ValueStack.elements[:height]
+	vm.Trap = false
+	vm.TrapErr = nil
+	return nil, err
+}
+
+// Looks up an export of the instance. Functions come back as an
+// ExposedFunc, so the result can be defined in another Linker.
+func (inst *Instance) Export(name string) (Extern, bool) {
+	exp, ok := inst.Module.Export(name)
+	if !ok {
+		return Extern{}, false
+	}
+	ext := Extern{Kind: exp.Kind}
+	switch exp.Kind {
+	case ExternFunc:
+		ext.Func = inst.funcRef(exp.Index)
+	case ExternTable:
+		ext.Table = inst.Tables[exp.Index]
+	case ExternMemory:
+		ext.Memory = inst.memory
+	case ExternGlobal:
+		ext.Global = inst.Globals[exp.Index]
+	}
+	return ext, true
+}
+
+// An exported function, callable from Go
+type ExportedFunction struct {
+	Name  string
+	Type  FuncType
+	inst  *Instance
+	index uint32
+}
+
+// Returns nil when there is no function exported as name
+func (inst *Instance) ExportedFunction(name string) *ExportedFunction {
+	exp, ok := inst.Module.Export(name)
+	if !ok || exp.Kind != ExternFunc {
+		return nil
+	}
+	return &ExportedFunction{
+		Name:  name,
+		Type:  inst.funcs[exp.Index].Type,
+		inst:  inst,
+		index: exp.Index,
+	}
+}
+
+// Calls the function with arguments in signature order. A trap comes
+// back as a *TrapError.
+func (f *ExportedFunction) CallValues(ctx context.Context, args ...ValueStackEntry) ([]ValueStackEntry, error) {
+	ok := len(args) == len(f.Type.Params)
+	for i := 0; ok && i < len(args); i++ {
+		ok = args[i].EntryType == f.Type.Params[i]
+	}
+	if !ok {
+		got := FuncType{Params: make([]ValueStackEntryType, len(args))}
+		for i := range args {
+			got.Params[i] = args[i].EntryType
+		}
+		return nil, NewInstanceError(InstanceSignatureMismatch, nil, f.Name, f.Type, got)
+	}
+	return f.inst.invoke(ctx, f.index, args)
+}
+
+// Like CallValues, with each value encoded as by EncodeValue according
+// to the signature
+func (f *ExportedFunction) Call(ctx context.Context, args ...uint64) ([]uint64, error) {
+	if len(args) != len(f.Type.Params) {
+		return nil, NewInstanceError(InstanceSignatureMismatch, nil, f.Name, f.Type, fmt.Sprintf("%d arguments", len(args)))
+	}
+	entries := make([]ValueStackEntry, len(args))
+	for i, arg := range args {
+		entries[i] = entryFromBits(arg, f.Type.Params[i])
+	}
+	results, err := f.inst.invoke(ctx, f.index, entries)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]uint64, len(results))
+	for i := range results {
+		out[i] = entryBits(&results[i])
+	}
+	return out, nil
+}
+
+func checkResults(f *ExportedFunction, want ...ValueStackEntryType) error {
+	got := FuncType{Params: f.Type.Params, Results: want}
+	if !got.Equal(f.Type) {
+		return NewInstanceError(InstanceSignatureMismatch, nil, f.Name, f.Type, got)
+	}
+	return nil
+}
+
+// Calls a function returning a single R
+func Call1[R WasmValue](ctx context.Context, f *ExportedFunction, args ...uint64) (R, error) {
+	var r R
+	if err := checkResults(f, wasmType[R]()); err != nil {
+		return r, err
+	}
+	out, err := f.Call(ctx, args...)
+	if err != nil {
+		return r, err
+	}
+	return DecodeValue[R](out[0]), nil
+}
+
+// Calls a function returning an R1 and an R2
+func Call2[R1, R2 WasmValue](ctx context.Context, f *ExportedFunction, args ...uint64) (R1, R2, error) {
+	var r1 R1
+	var r2 R2
+	if err := checkResults(f, wasmType[R1](), wasmType[R2]()); err != nil {
+		return r1, r2, err
+	}
+	out, err := f.Call(ctx, args...)
+	if err != nil {
+		return r1, r2, err
+	}
+	return DecodeValue[R1](out[0]), DecodeValue[R2](out[1]), nil
+}
+
+// Encodes a value for ExportedFunction.Call. 32 bit integers take the
+// low half and floats are stored as their bits.
+func EncodeValue[T WasmValue](v T) uint64 {
+	e := toEntry(v, wasmType[T]())
+	return entryBits(&e)
+}
+
+func DecodeValue[T WasmValue](bits uint64) T {
+	e := entryFromBits(bits, wasmType[T]())
+	return fromEntry[T](&e)
+}
+
+func entryBits(e *ValueStackEntry) uint64 {
+	switch e.EntryType {
+	case TYPE_I32:
+		return uint64(e.Value_I32)
+	case TYPE_I64:
+		return e.Value_I64
+	case TYPE_F32:
+		return uint64(math.Float32bits(e.Value_F32))
+	default:
+		return math.Float64bits(e.Value_F64)
+	}
+}
+
+func entryFromBits(bits uint64, vt ValueStackEntryType) ValueStackEntry {
+	switch vt {
+	case TYPE_I32:
+		return *NewValueStackEntryI32(uint32(bits))
+	case TYPE_I64:
+		return *NewValueStackEntryI64(bits)
+	case TYPE_F32:
+		return *NewValueStackEntryF32(math.Float32frombits(uint32(bits)))
+	default:
+		return *NewValueStackEntryF64(math.Float64frombits(bits))
+	}
+}
@@ -0,0 +1,282 @@
+package wasmvm
+
+import "fmt"
+
+// Function bodies are copied back to back into the code memory of an
+// instance. While doing so each body is scanned once to find where its
+// blocks end, so the control instructions don't have to search for the
+// matching end at run time.
+
+// How the immediates of an instruction are encoded
+type immediateKind byte
+
+const (
+	immNone immediateKind = iota
+	immBlockType
+	immU32
+	immU32Pair
+	immBrTable
+	immSelectTypes
+	immMemArg
+	immS32
+	immS64
+	immF32
+	immF64
+	immByte
+)
+
+func opcodeImmediate(op byte) (immediateKind, bool) {
+	switch {
+	case op == OP_BLOCK || op == OP_LOOP || op == OP_IF:
+		return immBlockType, true
+	case op == OP_BR || op == OP_BR_IF || op == OP_CALL || op == 0xD2: // ref.func
+		return immU32, true
+	case op >= OP_LOCAL_GET && op <= 0x26: // Through table.set
+		return immU32, true
+	case op == OP_BR_TABLE:
+		return immBrTable, true
+	case op == OP_CALL_INDIRECT:
+		return immU32Pair, true
+	case op == OP_SELECT_T:
+		return immSelectTypes, true
+	case op >= 0x28 && op <= 0x3E: // Loads and stores
+		return immMemArg, true
+	case op == 0x3F || op == 0x40: // memory.size, memory.grow
+		return immU32, true
+	case op == OP_CONST_I32:
+		return immS32, true
+	case op == OP_CONST_I64:
+		return immS64, true
+	case op == 0x43:
+		return immF32, true
+	case op == 0x44:
+		return immF64, true
+	case op == 0xD0: // ref.null
+		return immByte, true
+	case op == OP_UNREACHABLE || op == OP_NOP || op == OP_ELSE || op == OP_END ||
+		op == OP_RETURN || op == OP_DROP || op == OP_SELECT || op == 0xD1: // ref.is_null
+		return immNone, true
+	case op >= 0x45 && op <= 0xC4: // Numeric instructions
+		return immNone, true
+	}
+	return immNone, false
+}
+
+// Immediates of the 0xFC prefixed instructions, by sub-opcode
+func miscImmediate(sub uint32) (immediateKind, bool) {
+	switch {
+	case sub <= 7: // Saturating truncation
+		return immNone, true
+	case sub == 8, sub == 12, sub == 14: // memory.init, table.init, table.copy
+		return immU32Pair, true
+	case sub == 9, sub == 11, sub == 13, sub >= 15 && sub <= 17:
+		return immU32, true
+	case sub == 10: // memory.copy
+		return immU32Pair, true
+	}
+	return immNone, false
+}
+
+// How the immediates of op are encoded. The prefixed instructions have
+// their sub-opcode read and returned as well.
+func (r *moduleReader) readImmediateKind(op byte) (immediateKind, uint32, error) {
+	kind, ok := opcodeImmediate(op)
+	var sub uint32
+	switch op {
+	case OP_PREFIX_MISC:
+		var err error
+		if sub, err = r.readU32(); err != nil {
+			return immNone, 0, err
+		}
+		if kind, ok = miscImmediate(sub); !ok {
+			return immNone, 0, r.malformed("unknown instruction 0xFC %d", sub)
+		}
+	case OP_PREFIX_ATOMIC:
+		var err error
+		if sub, err = r.readU32(); err != nil {
+			return immNone, 0, err
+		}
+		kind, ok = immMemArg, sub <= OP_ATOMIC_RMW32_CMPXCHGU_I64
+		if sub == OP_ATOMIC_FENCE {
+			kind = immByte
+		}
+		if !ok {
+			return immNone, 0, r.malformed("unknown instruction 0xFE %d", sub)
+		}
+	}
+	if !ok {
+		return immNone, 0, r.malformed("unknown instruction 0x%02X", op)
+	}
+	return kind, sub, nil
+}
+
+// Skips over the immediates of op
+func (r *moduleReader) skipImmediates(op byte) error {
+	kind, _, err := r.readImmediateKind(op)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case immU32:
+		_, err = r.readU32()
+	case immU32Pair, immMemArg:
+		if _, err = r.readU32(); err == nil {
+			_, err = r.readU32()
+		}
+	case immBrTable:
+		var n int
+		if n, err = r.readCount(); err != nil {
+			return err
+		}
+		for range n + 1 {
+			if _, err = r.readU32(); err != nil {
+				return err
+			}
+		}
+	case immSelectTypes:
+		var n int
+		if n, err = r.readCount(); err != nil {
+			return err
+		}
+		for range n {
+			if _, err = r.readValType(); err != nil {
+				return err
+			}
+		}
+	case immS32:
+		_, err = r.readSigned(32)
+	case immS64:
+		_, err = r.readSigned(64)
+	case immF32:
+		_, err = r.readBytes(4)
+	case immF64:
+		_, err = r.readBytes(8)
+	case immByte:
+		_, err = r.readByte()
+	}
+	return err
+}
+
+// Parameter and result counts of a block type
+func (r *moduleReader) readBlockType(m *Module) (int, int, error) {
+	if r.done() {
+		return 0, 0, NewModuleError(ModuleTruncated, r.offset(), nil)
+	}
+	b := r.data[r.pos]
+	if b == 0x40 {
+		r.pos++
+		return 0, 0, nil
+	}
+	if _, ok := valueTypeEncodings[b]; ok {
+		r.pos++
+		return 0, 1, nil
+	}
+	at := r.offset()
+	idx, n, err := DecodeSLEB128(r.data[r.pos:], 33)
+	if err != nil {
+		return 0, 0, NewModuleError(ModuleMalformed, at, err, err.Error())
+	}
+	r.pos += n
+	if idx < 0 || idx >= int64(len(m.Types)) {
+		return 0, 0, NewModuleError(ModuleInvalidIndex, at, nil, "type", idx)
+	}
+	return len(m.Types[idx].Params), len(m.Types[idx].Results), nil
+}
+
+// The value stack can't hold a reference, so the instructions that put
+// one there or take one off are refused when a body is scanned
+var refInstructionNames = map[byte]string{
+	0x25: "table.get",
+	0x26: "table.set",
+	0xD0: "ref.null",
+	0xD1: "ref.is_null",
+	0xD2: "ref.func",
+}
+
+var refMiscInstructionNames = map[uint32]string{
+	15: "table.grow",
+	17: "table.fill",
+}
+
+type refInstructionError struct {
+	name string
+}
+
+func (e *refInstructionError) Error() string {
+	return e.name + " is not supported"
+}
+
+// Name of the reference instruction at the reader, empty if op isn't one
+func (r *moduleReader) refInstruction(op byte) string {
+	if op == OP_PREFIX_MISC {
+		peek := *r
+		sub, err := peek.readU32()
+		if err != nil {
+			return ""
+		}
+		return refMiscInstructionNames[sub]
+	}
+	return refInstructionNames[op]
+}
+
+// Where a block starts and ends in the code memory
+type blockInfo struct {
+	Body    uint64 // First instruction inside the block
+	Else    uint64 // The else of an if, zero when there is none
+	End     uint64
+	Params  int
+	Results int
+}
+
+// Scans a body that is placed at base in the code memory, recording its
+// blocks. Returns the address of the final end, or a refInstructionError
+// for an instruction that works on references.
+func scanFuncBody(m *Module, body FuncBody, base uint64, blocks map[uint64]blockInfo) (uint64, error) {
+	r := &moduleReader{data: body.Code, base: body.Offset}
+	var open []uint64
+	for !r.done() {
+		pc := base + uint64(r.pos)
+		op, _ := r.readByte()
+		switch op {
+		case OP_BLOCK, OP_LOOP, OP_IF:
+			params, results, err := r.readBlockType(m)
+			if err != nil {
+				return 0, err
+			}
+			blocks[pc] = blockInfo{Body: base + uint64(r.pos), Params: params, Results: results}
+			open = append(open, pc)
+		case OP_ELSE:
+			if len(open) == 0 {
+				return 0, r.malformed("else outside of if")
+			}
+			top := open[len(open)-1]
+			info := blocks[top]
+			if body.Code[top-base] != OP_IF || info.Else != 0 {
+				return 0, r.malformed("else outside of if")
+			}
+			info.Else = pc
+			blocks[top] = info
+		case OP_END:
+			if len(open) == 0 {
+				if !r.done() {
+					return 0, r.malformed("instructions after the end of the function")
+				}
+				return pc, nil
+			}
+			top := open[len(open)-1]
+			open = open[:len(open)-1]
+			info := blocks[top]
+			info.End = pc
+			blocks[top] = info
+		default:
+			if name := r.refInstruction(op); name != "" {
+				return 0, &refInstructionError{name: name}
+			}
+			if err := r.skipImmediates(op); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return 0, NewModuleError(ModuleMalformed, r.offset(), nil, fmt.Sprintf("%d blocks not closed", len(open)))
+}
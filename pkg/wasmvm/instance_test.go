@@ -0,0 +1,692 @@
+package wasmvm_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Function body declaring count locals of type vt
+func wasmBodyLocals(count byte, vt byte, code ...byte) []byte {
+	body := append([]byte{0x01, count, vt}, code...)
+	return append(wasmvm.AppendULEB128(nil, uint64(len(body))), body...)
+}
+
+const (
+	opI32Sub  = wasmvm.OP_SUB_I32
+	blockVoid = 0x40
+)
+
+var instanceTestExports = []string{"add", "double", "sum", "callback", "indirect", "counter", "pick", "trap", "spin", "classify", "recurse"}
+
+// Imports env.callback (i32) -> (i32) as function 0, followed by the
+// functions in instanceTestExports
+var instanceTestModule = func() []byte {
+	exports := make([][]byte, len(instanceTestExports))
+	for i, name := range instanceTestExports {
+		exports[i] = wasmCat(wasmName(name), []byte{0x00, byte(i + 1)})
+	}
+	return wasmBinary(
+		wasmSection(wasmvm.SectionType, wasmVec(
+			wasmFuncType([]byte{wasmI32, wasmI32}, []byte{wasmI32}),
+			wasmFuncType([]byte{wasmI32}, []byte{wasmI32}),
+			wasmFuncType(nil, []byte{wasmI64}),
+			wasmFuncType(nil, nil),
+		)...),
+		wasmSection(wasmvm.SectionImport, wasmVec(
+			wasmCat(wasmName("env"), wasmName("callback"), []byte{0x00, 0x01}),
+		)...),
+		wasmSection(wasmvm.SectionFunction, wasmVec(
+			[]byte{0x00}, []byte{0x01}, []byte{0x01}, []byte{0x01}, []byte{0x00}, []byte{0x02},
+			[]byte{0x01}, []byte{0x03}, []byte{0x03}, []byte{0x01}, []byte{0x01},
+		)...),
+		wasmSection(wasmvm.SectionTable, wasmVec([]byte{0x70, 0x00, 0x02})...),
+		wasmSection(wasmvm.SectionMemory, wasmVec([]byte{0x00, 0x01})...),
+		wasmSection(wasmvm.SectionGlobal, wasmVec([]byte{wasmI64, 0x01, wasmvm.OP_CONST_I64, 0x00, wasmvm.OP_END})...),
+		wasmSection(wasmvm.SectionExport, wasmVec(append(exports, wasmCat(wasmName("mem"), []byte{0x02, 0x00}))...)...),
+		wasmSection(wasmvm.SectionElement, wasmVec(
+			[]byte{0x00, wasmvm.OP_CONST_I32, 0x00, wasmvm.OP_END, 0x02, 0x02, 0x01},
+		)...),
+		wasmSection(wasmvm.SectionCode, wasmVec(
+			// add
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_ADD_I32, wasmvm.OP_END),
+			// double
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_ADD_I32, wasmvm.OP_END),
+			// sum: n + ... + 1, counting n down to zero
+			wasmBodyLocals(1, wasmI32,
+				wasmvm.OP_LOOP, blockVoid,
+				wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_ADD_I32, wasmvm.OP_LOCAL_SET, 1,
+				wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_CONST_I32, 1, opI32Sub, wasmvm.OP_LOCAL_TEE, 0,
+				wasmvm.OP_BR_IF, 0,
+				wasmvm.OP_END,
+				wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_END),
+			// callback
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_CALL, 0, wasmvm.OP_END),
+			// indirect: calls table element $1 with $0
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_CALL_INDIRECT, 0x01, 0x00, wasmvm.OP_END),
+			// counter
+			wasmBody(wasmvm.OP_GLOBAL_GET, 0, wasmvm.OP_CONST_I64, 1, wasmvm.OP_ADD_I64, wasmvm.OP_GLOBAL_SET, 0,
+				wasmvm.OP_GLOBAL_GET, 0, wasmvm.OP_END),
+			// pick
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_IF, wasmI32, wasmvm.OP_CONST_I32, 10,
+				wasmvm.OP_ELSE, wasmvm.OP_CONST_I32, 20, wasmvm.OP_END, wasmvm.OP_END),
+			// trap
+			wasmBody(wasmvm.OP_UNREACHABLE, wasmvm.OP_END),
+			// spin
+			wasmBody(wasmvm.OP_LOOP, blockVoid, wasmvm.OP_BR, 0, wasmvm.OP_END, wasmvm.OP_END),
+			// classify: 100 for zero, 200 otherwise
+			wasmBody(wasmvm.OP_BLOCK, blockVoid, wasmvm.OP_BLOCK, blockVoid,
+				wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_BR_TABLE, 1, 0, 1, wasmvm.OP_END,
+				wasmvm.OP_CONST_I32, 0xE4, 0x00, wasmvm.OP_RETURN, wasmvm.OP_END,
+				wasmvm.OP_CONST_I32, 0xC8, 0x01, wasmvm.OP_END),
+			// recurse
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_CALL, 11, wasmvm.OP_END),
+		)...),
+		wasmSection(wasmvm.SectionData, wasmVec(
+			[]byte{0x00, wasmvm.OP_CONST_I32, 0x08, wasmvm.OP_END, 0x02, 'h', 'i'},
+		)...),
+	)
+}()
+
+// env.callback calls double on the instance and adds one
+func newTestInstance(t testing.TB) *wasmvm.Instance {
+	m, err := wasmvm.DecodeModule(instanceTestModule)
+	require.NoError(t, err)
+	var inst *wasmvm.Instance
+	l := wasmvm.NewLinker()
+	_, err = l.DefineFunc("env", "callback", wasmvm.HostFunc1_1(func(ctx context.Context, _ *wasmvm.VMState, x int32) (int32, error) {
+		r, err := wasmvm.Call1[int32](ctx, inst.ExportedFunction("double"), wasmvm.EncodeValue(x))
+		return r + 1, err
+	}))
+	require.NoError(t, err)
+	inst, err = wasmvm.Instantiate(m, l, nil)
+	require.NoError(t, err)
+	return inst
+}
+
+func TestInstance_Call(t *testing.T) {
+	inst := newTestInstance(t)
+	tests := []struct {
+		name       string
+		fn         string
+		args       []uint64
+		expect     []uint64
+		expectTrap wasmvm.TrapType
+	}{
+		{name: "add", fn: "add", args: []uint64{2, 3}, expect: []uint64{5}},
+		{name: "add wraps", fn: "add", args: []uint64{math.MaxUint32, 2}, expect: []uint64{1}},
+		{name: "loop", fn: "sum", args: []uint64{100}, expect: []uint64{5050}},
+		{name: "re-entrant host call", fn: "callback", args: []uint64{20}, expect: []uint64{41}},
+		{name: "call_indirect", fn: "indirect", args: []uint64{7, 0}, expect: []uint64{14}},
+		{name: "call_indirect type mismatch", fn: "indirect", args: []uint64{7, 1}, expectTrap: wasmvm.TrapIndirectCallTypeMismatch},
+		{name: "call_indirect out of range", fn: "indirect", args: []uint64{7, 2}, expectTrap: wasmvm.TrapUndefinedElement},
+		{name: "if", fn: "pick", args: []uint64{1}, expect: []uint64{10}},
+		{name: "else", fn: "pick", args: []uint64{0}, expect: []uint64{20}},
+		{name: "br_table", fn: "classify", args: []uint64{0}, expect: []uint64{100}},
+		{name: "br_table default", fn: "classify", args: []uint64{9}, expect: []uint64{200}},
+		{name: "unreachable", fn: "trap", expectTrap: wasmvm.TrapUnreachable},
+		{name: "recursion", fn: "recurse", args: []uint64{1}, expectTrap: wasmvm.TrapCallStackExhausted},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := inst.ExportedFunction(tc.fn)
+			require.NotNil(t, f)
+			got, err := f.Call(context.Background(), tc.args...)
+			if tc.expectTrap != wasmvm.UndefinedTrap {
+				var te *wasmvm.TrapError
+				require.ErrorAs(t, err, &te)
+				assert.Equal(t, tc.expectTrap, te.Type, err.Error())
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expect, got)
+			}
+			// Nothing is left behind, even after a trap
+			assert.False(t, inst.VM.Trap)
+			assert.Empty(t, inst.VM.CallStack)
+			assert.Equal(t, 0, inst.VM.ValueStack.Size())
+		})
+	}
+}
+
+func TestInstance_TypedCalls(t *testing.T) {
+	inst := newTestInstance(t)
+	assert.Nil(t, inst.ExportedFunction("missing"))
+	assert.Nil(t, inst.ExportedFunction("mem"))
+
+	add := inst.ExportedFunction("add")
+	assert.Equal(t, "(i32, i32) -> (i32)", add.Type.String())
+	sum, err := wasmvm.Call1[int32](context.Background(), add, wasmvm.EncodeValue(int32(-5)), wasmvm.EncodeValue(int32(3)))
+	require.NoError(t, err)
+	assert.Equal(t, int32(-2), sum)
+
+	_, err = wasmvm.Call1[int64](context.Background(), add, 1, 2)
+	var ie *wasmvm.InstanceError
+	require.ErrorAs(t, err, &ie)
+	assert.Equal(t, wasmvm.InstanceSignatureMismatch, ie.Type)
+	_, _, err = wasmvm.Call2[int32, int32](context.Background(), add, 1, 2)
+	assert.ErrorAs(t, err, &ie)
+	_, err = add.Call(context.Background(), 1)
+	assert.EqualError(t, err, "[InstanceSignatureMismatch] add expects (i32, i32) -> (i32), called with 1 arguments")
+	_, err = add.CallValues(context.Background(), *wasmvm.NewValueStackEntryI32(1), *wasmvm.NewValueStackEntryI64(2))
+	assert.EqualError(t, err, "[InstanceSignatureMismatch] add expects (i32, i32) -> (i32), called with (i32, i64) -> ()")
+
+	assert.Equal(t, float32(1.5), wasmvm.DecodeValue[float32](wasmvm.EncodeValue(float32(1.5))))
+	assert.Equal(t, uint64(math.Float64bits(-2.25)), wasmvm.EncodeValue(-2.25))
+	assert.Equal(t, uint64(0xFFFFFFFF), wasmvm.EncodeValue(int32(-1)))
+	assert.Equal(t, int64(-1), wasmvm.DecodeValue[int64](math.MaxUint64))
+}
+
+func TestInstance_GlobalsAndMemory(t *testing.T) {
+	inst := newTestInstance(t)
+	counter := inst.ExportedFunction("counter")
+	for i := int64(1); i <= 3; i++ {
+		got, err := wasmvm.Call1[int64](context.Background(), counter)
+		require.NoError(t, err)
+		assert.Equal(t, i, got)
+	}
+
+	ext, ok := inst.Export("mem")
+	require.True(t, ok)
+	buf := make([]byte, 2)
+	ext.Memory.Memory.Read(wasmvm.MemoryContext{}, 8, buf)
+	assert.Equal(t, []byte("hi"), buf)
+	assert.Equal(t, uint64(wasmvm.WasmPageSize), ext.Memory.Memory.Size())
+
+	// Reset brings the globals back to the snapshot along with memory
+	_, err := inst.VM.Snapshot()
+	require.NoError(t, err)
+	_, err = counter.Call(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, inst.VM.Reset())
+	got, err := wasmvm.Call1[int64](context.Background(), counter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), got)
+
+	// So does a checkpoint
+	var cp bytes.Buffer
+	require.NoError(t, inst.VM.Save(&cp))
+	_, err = counter.Call(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, inst.VM.Restore(&cp))
+	assert.Equal(t, uint64(4), inst.Globals[0].Value.Value_I64)
+}
+
+// Table 0 starts out as $one $two, with $two also in a passive segment
+const checkpointTablesWAT = `(module
+  (type $r (func (result i32)))
+  (table 2 funcref)
+  (elem (i32.const 0) $one $two)
+  (elem $p func $two)
+  (func $one (result i32) (i32.const 1))
+  (func $two (result i32) (i32.const 2))
+  (func (export "copy") (table.copy (i32.const 0) (i32.const 1) (i32.const 1)))
+  (func (export "drop") (elem.drop $p))
+  (func (export "init") (table.init $p (i32.const 1) (i32.const 0) (i32.const 1)))
+  (func (export "call") (param i32) (result i32) (call_indirect (type $r) (local.get 0))))`
+
+func TestInstance_CheckpointTables(t *testing.T) {
+	m, err := wasmvm.ParseWAT(checkpointTablesWAT)
+	require.NoError(t, err)
+	ctx := context.Background()
+	inst, err := wasmvm.Instantiate(m, wasmvm.NewLinker(), nil)
+	require.NoError(t, err)
+	for _, name := range []string{"copy", "drop"} {
+		_, err = inst.ExportedFunction(name).Call(ctx)
+		require.NoError(t, err)
+	}
+	var cp bytes.Buffer
+	require.NoError(t, inst.VM.Save(&cp))
+
+	// As if restoring in a new process
+	fresh, err := wasmvm.Instantiate(m, wasmvm.NewLinker(), nil)
+	require.NoError(t, err)
+	got, err := wasmvm.Call1[int32](ctx, fresh.ExportedFunction("call"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), got)
+	require.NoError(t, fresh.VM.Restore(&cp))
+	got, err = wasmvm.Call1[int32](ctx, fresh.ExportedFunction("call"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), got)
+	// The segment stays dropped
+	_, err = fresh.ExportedFunction("init").Call(ctx)
+	var te *wasmvm.TrapError
+	require.ErrorAs(t, err, &te)
+
+	// A host function the module doesn't import can't be found again
+	fresh.Tables[0].Elements[1] = wasmvm.NewExposedFunc(wasmvm.FuncType{Results: []wasmvm.ValueStackEntryType{wasmvm.TYPE_I32}},
+		func(context.Context, *wasmvm.VMState, []wasmvm.ValueStackEntry) ([]wasmvm.ValueStackEntry, error) {
+			return nil, nil
+		})
+	err = fresh.VM.Save(&bytes.Buffer{})
+	var ce *wasmvm.CheckpointError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, wasmvm.CheckpointForeignReference, ce.Type)
+	assert.EqualError(t, err, "[CheckpointForeignReference] table 0 element 1 is a function of another instance")
+}
+
+// use copies the passive segment into memory once, then drops it
+const resetWAT = `(module
+  (type $r (func (result i32)))
+  (memory 1)
+  (data $d "x")
+  (table 2 funcref)
+  (elem (i32.const 0) $one $two)
+  (func $one (result i32) (i32.const 1))
+  (func $two (result i32) (i32.const 2))
+  (func (export "copy") (table.copy (i32.const 0) (i32.const 1) (i32.const 1)))
+  (func (export "use") (memory.init $d (i32.const 0) (i32.const 0) (i32.const 1)) (data.drop $d))
+  (func (export "call") (param i32) (result i32) (call_indirect (type $r) (local.get 0))))`
+
+func TestInstance_Reset(t *testing.T) {
+	m, err := wasmvm.ParseWAT(resetWAT)
+	require.NoError(t, err)
+	ctx := context.Background()
+	inst, err := wasmvm.Instantiate(m, nil, new(wasmvm.VMConfig).SetFuel(1000))
+	require.NoError(t, err)
+	_, err = inst.VM.Snapshot()
+	require.NoError(t, err)
+
+	// As a pooled instance would be between uses
+	for range 2 {
+		for _, name := range []string{"copy", "use"} {
+			_, err = inst.ExportedFunction(name).Call(ctx)
+			require.NoError(t, err, name)
+		}
+		got, err := wasmvm.Call1[int32](ctx, inst.ExportedFunction("call"), 0)
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), got)
+		fuel, _ := inst.Fuel()
+		assert.Less(t, fuel, uint64(1000))
+
+		require.NoError(t, inst.VM.Reset())
+		got, err = wasmvm.Call1[int32](ctx, inst.ExportedFunction("call"), 0)
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), got)
+		require.NoError(t, inst.VM.Reset())
+		fuel, _ = inst.Fuel()
+		assert.Equal(t, uint64(1000), fuel)
+	}
+}
+
+const growWAT = `(module
+  (memory 1 3)
+  (func (export "grow") (drop (memory.grow (i32.const 1))))
+  (func (export "store") (i32.store (i32.const 65536) (i32.const 7)))
+  (func (export "load") (result i32) (i32.load (i32.const 65536)))
+  (func (export "size") (result i32) memory.size))`
+
+func TestInstance_GrownMemory(t *testing.T) {
+	m, err := wasmvm.ParseWAT(growWAT)
+	require.NoError(t, err)
+	ctx := context.Background()
+	for _, model := range []wasmvm.MemoryModel{wasmvm.FlatMemoryModel, wasmvm.ShardedMemoryModel} {
+		t.Run(model.String(), func(t *testing.T) {
+			call := func(inst *wasmvm.Instance, name string) int32 {
+				t.Helper()
+				r, err := inst.ExportedFunction(name).Call(ctx)
+				require.NoError(t, err)
+				if len(r) == 0 {
+					return 0
+				}
+				return int32(r[0])
+			}
+			config := func() *wasmvm.VMConfig { return new(wasmvm.VMConfig).SetMemoryModel(model) }
+			inst, err := wasmvm.Instantiate(m, nil, config())
+			require.NoError(t, err)
+			_, err = inst.VM.Snapshot()
+			require.NoError(t, err)
+			call(inst, "grow")
+			call(inst, "store")
+			var cp bytes.Buffer
+			require.NoError(t, inst.VM.Save(&cp))
+
+			// Reset cuts the memory back, growing again gives zeros
+			require.NoError(t, inst.VM.Reset())
+			assert.Equal(t, int32(1), call(inst, "size"))
+			call(inst, "grow")
+			assert.Equal(t, int32(0), call(inst, "load"))
+
+			// A fresh instance grows to the saved size
+			fresh, err := wasmvm.Instantiate(m, nil, config())
+			require.NoError(t, err)
+			require.NoError(t, fresh.VM.Restore(bytes.NewReader(cp.Bytes())))
+			assert.Equal(t, int32(2), call(fresh, "size"))
+			assert.Equal(t, int32(7), call(fresh, "load"))
+
+			// But not past its limits
+			limited, err := wasmvm.Instantiate(m, nil, config().SetMaxMemory(wasmvm.WasmPageSize))
+			require.NoError(t, err)
+			assert.Equal(t, wasmvm.CheckpointMemoryMismatch, checkpointErrorType(t, limited.VM.Restore(bytes.NewReader(cp.Bytes()))))
+			assert.Equal(t, int32(1), call(limited, "size"))
+		})
+	}
+}
+
+// Bodies aren't type checked, so an i32 will do for a reference operand
+func TestInstance_RefInstructionsUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "ref.func", body: `(table.set (i32.const 1) (ref.func $a))`},
+		{name: "ref.null", body: `(drop (ref.null func))`},
+		{name: "ref.is_null", body: `i32.const 0 ref.is_null drop`},
+		{name: "table.get", body: `(drop (table.get (i32.const 0)))`},
+		{name: "table.grow", body: `i32.const 0 i32.const 1 table.grow drop`},
+		{name: "table.fill", body: `i32.const 0 i32.const 0 i32.const 1 table.fill`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := wasmvm.ParseWAT(`(table 2 funcref) (func $a) (func ` + tc.body + `)`)
+			require.NoError(t, err)
+			_, err = wasmvm.Instantiate(m, nil, nil)
+			var ie *wasmvm.InstanceError
+			require.ErrorAs(t, err, &ie)
+			assert.Equal(t, wasmvm.InstanceUnsupported, ie.Type)
+			assert.EqualError(t, err, "[InstanceUnsupported] unsupported: "+tc.name+" in function 1")
+		})
+	}
+}
+
+func TestInstance_CrossInstanceCall(t *testing.T) {
+	first := newTestInstance(t)
+	double, ok := first.Export("double")
+	require.True(t, ok)
+
+	// A second instance imports double from the first in place of the
+	// host callback
+	m, err := wasmvm.DecodeModule(instanceTestModule)
+	require.NoError(t, err)
+	l := wasmvm.NewLinker()
+	_, err = l.Define("env", "callback", double)
+	require.NoError(t, err)
+	second, err := wasmvm.Instantiate(m, l, nil)
+	require.NoError(t, err)
+
+	got, err := wasmvm.Call1[int32](context.Background(), second.ExportedFunction("callback"), 21)
+	require.NoError(t, err)
+	assert.Equal(t, int32(42), got)
+}
+
+func TestInstance_Interrupted(t *testing.T) {
+	inst := newTestInstance(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := inst.ExportedFunction("spin").Call(ctx)
+	var te *wasmvm.TrapError
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, wasmvm.TrapInterrupted, te.Type)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	got, err := inst.ExportedFunction("add").Call(context.Background(), 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2}, got)
+}
+
+func TestInstance_InterruptedWait(t *testing.T) {
+	// Waits forever on a value nothing changes
+	m, err := wasmvm.ParseWAT(`(module
+	  (memory 1 1 shared)
+	  (func (export "wait") (result i32)
+	    (memory.atomic.wait32 (i32.const 0) (i32.const 0) (i64.const -1))))`)
+	require.NoError(t, err)
+	inst, err := wasmvm.Instantiate(m, wasmvm.NewLinker(), nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = inst.ExportedFunction("wait").Call(ctx)
+	var te *wasmvm.TrapError
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, wasmvm.TrapInterrupted, te.Type)
+	assert.Equal(t, "ATOMIC_WAIT32", te.Op)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestInstantiate_Errors(t *testing.T) {
+	m, err := wasmvm.DecodeModule(linkTestModule)
+	require.NoError(t, err)
+	_, err = wasmvm.Instantiate(m, nil, nil)
+	var ie *wasmvm.InstanceError
+	require.ErrorAs(t, err, &ie)
+	assert.Equal(t, wasmvm.InstanceLinkFailed, ie.Type)
+	var le *wasmvm.LinkError
+	assert.ErrorAs(t, err, &le)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		expectErr wasmvm.InstanceErrorType
+	}{
+		{
+			name: "data out of bounds",
+			data: wasmBinary(
+				wasmSection(wasmvm.SectionMemory, wasmVec([]byte{0x00, 0x00})...),
+				wasmSection(wasmvm.SectionData, wasmVec([]byte{0x00, wasmvm.OP_CONST_I32, 0x00, wasmvm.OP_END, 0x01, 'x'})...),
+			),
+			expectErr: wasmvm.InstanceSegmentOutOfBounds,
+		},
+		{
+			name: "element out of bounds",
+			data: wasmBinary(
+				wasmSection(wasmvm.SectionType, wasmVec(wasmFuncType(nil, nil))...),
+				wasmSection(wasmvm.SectionFunction, wasmVec([]byte{0x00})...),
+				wasmSection(wasmvm.SectionTable, wasmVec([]byte{0x70, 0x00, 0x01})...),
+				wasmSection(wasmvm.SectionElement, wasmVec([]byte{0x00, wasmvm.OP_CONST_I32, 0x01, wasmvm.OP_END, 0x01, 0x00})...),
+				wasmSection(wasmvm.SectionCode, wasmVec(wasmBody(wasmvm.OP_END))...),
+			),
+			expectErr: wasmvm.InstanceSegmentOutOfBounds,
+		},
+		{
+			name: "global type",
+			data: wasmBinary(
+				wasmSection(wasmvm.SectionGlobal, wasmVec([]byte{wasmI64, 0x00, wasmvm.OP_CONST_I32, 0x00, wasmvm.OP_END})...),
+			),
+			expectErr: wasmvm.InstanceConstExpr,
+		},
+		{
+			name: "unknown instruction",
+			data: wasmBinary(
+				wasmSection(wasmvm.SectionType, wasmVec(wasmFuncType(nil, nil))...),
+				wasmSection(wasmvm.SectionFunction, wasmVec([]byte{0x00})...),
+				wasmSection(wasmvm.SectionCode, wasmVec(wasmBody(0xFF, wasmvm.OP_END))...),
+			),
+			expectErr: wasmvm.InstanceMalformedCode,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := wasmvm.DecodeModule(tc.data)
+			require.NoError(t, err)
+			_, err = wasmvm.Instantiate(m, nil, nil)
+			var ie *wasmvm.InstanceError
+			require.ErrorAs(t, err, &ie)
+			assert.Equal(t, tc.expectErr, ie.Type, err.Error())
+		})
+	}
+}
+
+func BenchmarkInstance_Call(b *testing.B) {
+	inst := newTestInstance(b)
+	add := inst.ExportedFunction("add")
+	ctx := context.Background()
+	for b.Loop() {
+		if _, err := add.Call(ctx, 1, 2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A module with a start function and entry exports that each add to
+// the global. The start function traps instead when trapStart is set.
+func entryTestModule(exports []string, trapStart bool) []byte {
+	startBody := wasmBody(wasmvm.OP_CONST_I32, 1, wasmvm.OP_GLOBAL_SET, 0, wasmvm.OP_END)
+	if trapStart {
+		startBody = wasmBody(wasmvm.OP_UNREACHABLE, wasmvm.OP_END)
+	}
+	add := func(n byte) []byte {
+		return wasmBody(wasmvm.OP_GLOBAL_GET, 0, wasmvm.OP_CONST_I32, n, wasmvm.OP_ADD_I32, wasmvm.OP_GLOBAL_SET, 0, wasmvm.OP_END)
+	}
+	entries := make([][]byte, len(exports))
+	for i, name := range exports {
+		entries[i] = wasmCat(wasmName(name), []byte{0x00, byte(i + 1)})
+	}
+	return wasmBinary(
+		wasmSection(wasmvm.SectionType, wasmVec(wasmFuncType(nil, nil), wasmFuncType([]byte{wasmI32}, nil))...),
+		wasmSection(wasmvm.SectionFunction, wasmVec([]byte{0x00}, []byte{0x00}, []byte{0x00}, []byte{0x01})...),
+		wasmSection(wasmvm.SectionGlobal, wasmVec([]byte{wasmI32, 0x01, wasmvm.OP_CONST_I32, 0x00, wasmvm.OP_END})...),
+		wasmSection(wasmvm.SectionExport, wasmVec(entries...)...),
+		wasmSection(wasmvm.SectionStart, 0x00),
+		wasmSection(wasmvm.SectionCode, wasmVec(startBody, add(10), add(20), wasmBody(wasmvm.OP_END))...),
+	)
+}
+
+func TestInstance_StartAndEntryPoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		exports     []string
+		entry       string
+		expectEntry string
+		expectValue uint32
+		expectErr   wasmvm.InstanceErrorType
+	}{
+		{name: "command", exports: []string{"_start"}, expectEntry: "_start", expectValue: 11},
+		{name: "reactor", exports: []string{"x", "_initialize"}, expectEntry: "_initialize", expectValue: 21},
+		{name: "command wins", exports: []string{"_initialize", "_start"}, expectEntry: "_start", expectValue: 21},
+		{name: "library", exports: []string{"x"}, expectValue: 1},
+		{name: "configured", exports: []string{"_start", "main"}, entry: "main", expectEntry: "main", expectValue: 21},
+		{name: "configured missing", exports: []string{"_start"}, entry: "main", expectEntry: "main", expectValue: 1, expectErr: wasmvm.InstanceMissingEntryPoint},
+		{name: "bad signature", exports: []string{"a", "b", "_start"}, expectEntry: "_start", expectValue: 1, expectErr: wasmvm.InstanceSignatureMismatch},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := wasmvm.DecodeModule(entryTestModule(tc.exports, false))
+			require.NoError(t, err)
+			inst, err := wasmvm.Instantiate(m, nil, new(wasmvm.VMConfig).SetEntryPoint(tc.entry))
+			require.NoError(t, err)
+			// The start function has already run
+			assert.Equal(t, uint32(1), inst.Globals[0].Value.Value_I32)
+			assert.Equal(t, tc.expectEntry, inst.EntryPoint())
+
+			err = inst.Run(context.Background())
+			if tc.expectErr != wasmvm.UndefinedInstanceError {
+				var ie *wasmvm.InstanceError
+				require.ErrorAs(t, err, &ie)
+				assert.Equal(t, tc.expectErr, ie.Type, err.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectValue, inst.Globals[0].Value.Value_I32)
+		})
+	}
+
+	m, err := wasmvm.DecodeModule(entryTestModule(nil, true))
+	require.NoError(t, err)
+	_, err = wasmvm.Instantiate(m, nil, nil)
+	var ie *wasmvm.InstanceError
+	require.ErrorAs(t, err, &ie)
+	assert.Equal(t, wasmvm.InstanceStartFailed, ie.Type)
+	var te *wasmvm.TrapError
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, wasmvm.TrapUnreachable, te.Type)
+
+	m, err = wasmvm.ParseWAT(`(func $spin loop br 0 end) (start $spin)`)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = wasmvm.InstantiateContext(ctx, m, nil, nil)
+	require.ErrorAs(t, err, &ie)
+	assert.Equal(t, wasmvm.InstanceStartFailed, ie.Type)
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, wasmvm.TrapInterrupted, te.Type)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestInstance_Fuel(t *testing.T) {
+	m, err := wasmvm.ParseWAT(`
+		(func (export "sum") (param $n i32) (result i32) (local $acc i32)
+		  (loop $again
+		    (local.set $acc (i32.add (local.get $acc) (local.get $n)))
+		    (br_if $again (local.tee $n (i32.sub (local.get $n) (i32.const 1)))))
+		  (local.get $acc))
+		(func (export "spin") (loop (br 0)))`)
+	require.NoError(t, err)
+	inst, err := wasmvm.Instantiate(m, nil, new(wasmvm.VMConfig).SetFuel(100))
+	require.NoError(t, err)
+
+	// loop, 9 per round, then end, local.get and the final end
+	got, err := inst.ExportedFunction("sum").Call(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{6}, got)
+	left, metered := inst.Fuel()
+	assert.True(t, metered)
+	assert.Equal(t, uint64(100-31), left)
+
+	_, err = inst.ExportedFunction("spin").Call(context.Background())
+	var te *wasmvm.TrapError
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, wasmvm.TrapOutOfFuel, te.Type)
+	left, _ = inst.Fuel()
+	assert.Zero(t, left)
+
+	inst.AddFuel(31)
+	got, err = inst.ExportedFunction("sum").Call(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{6}, got)
+
+	_, metered = newTestInstance(t).Fuel()
+	assert.False(t, metered)
+}
+
+func TestInstance_MaxMemory(t *testing.T) {
+	m, err := wasmvm.ParseWAT(`(memory 2) (func (export "grow") (param i32) (result i32) (memory.grow (local.get 0)))`)
+	require.NoError(t, err)
+	_, err = wasmvm.Instantiate(m, nil, new(wasmvm.VMConfig).SetMaxMemory(wasmvm.WasmPageSize))
+	var ie *wasmvm.InstanceError
+	require.ErrorAs(t, err, &ie)
+	assert.Equal(t, wasmvm.InstanceMemoryLimit, ie.Type)
+
+	// Refused before the 4GiB is allocated
+	huge, err := wasmvm.ParseWAT(`(memory 65536)`)
+	require.NoError(t, err)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = wasmvm.Instantiate(huge, nil, new(wasmvm.VMConfig).SetMaxMemory(wasmvm.WasmPageSize))
+	runtime.ReadMemStats(&after)
+	assert.EqualError(t, err, "[InstanceMemoryLimit] memory of 4294967296 bytes exceeds the limit of 65536")
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	inst, err := wasmvm.Instantiate(m, nil, new(wasmvm.VMConfig).SetMaxMemory(3*wasmvm.WasmPageSize+100))
+	require.NoError(t, err)
+	grow := inst.ExportedFunction("grow")
+	got, err := grow.Call(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{0xFFFFFFFF}, got)
+	got, err = grow.Call(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2}, got)
+}
+
+func TestInstance_Locate(t *testing.T) {
+	inst := newTestInstance(t)
+	_, err := inst.ExportedFunction("trap").Call(context.Background())
+	var te *wasmvm.TrapError
+	require.ErrorAs(t, err, &te)
+
+	idx, offset, ok := inst.Locate(te.PC)
+	require.True(t, ok)
+	assert.Equal(t, uint32(8), idx)
+	code, err := inst.Module.Disassemble(idx)
+	require.NoError(t, err)
+	assert.Equal(t, wasmvm.DecodedInstruction{Offset: offset, Text: "unreachable"}, code[0])
+
+	_, _, ok = inst.Locate(1 << 40)
+	assert.False(t, ok)
+}
@@ -0,0 +1,342 @@
+package wasmvm
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+// Handler for an instruction behind a prefix opcode. immAddr is the
+// address just past the sub-opcode.
+type prefixedInstruction func(vm *VMState, immAddr uint64) error
+
+var atomicInstructionMap = buildAtomicInstructionMap()
+
+func buildAtomicInstructionMap() map[uint32]prefixedInstruction {
+	m := map[uint32]prefixedInstruction{
+		OP_ATOMIC_NOTIFY: ATOMIC_NOTIFY,
+		OP_ATOMIC_WAIT32: atomicWait("ATOMIC_WAIT32", TYPE_I32, WidthI32),
+		OP_ATOMIC_WAIT64: atomicWait("ATOMIC_WAIT64", TYPE_I64, WidthI64),
+		OP_ATOMIC_FENCE:  ATOMIC_FENCE,
+
+		OP_ATOMIC_LOAD_I32:    atomicLoad("ATOMIC_LOAD_I32", TYPE_I32, 4),
+		OP_ATOMIC_LOAD_I64:    atomicLoad("ATOMIC_LOAD_I64", TYPE_I64, 8),
+		OP_ATOMIC_LOAD8U_I32:  atomicLoad("ATOMIC_LOAD8U_I32", TYPE_I32, 1),
+		OP_ATOMIC_LOAD16U_I32: atomicLoad("ATOMIC_LOAD16U_I32", TYPE_I32, 2),
+		OP_ATOMIC_LOAD8U_I64:  atomicLoad("ATOMIC_LOAD8U_I64", TYPE_I64, 1),
+		OP_ATOMIC_LOAD16U_I64: atomicLoad("ATOMIC_LOAD16U_I64", TYPE_I64, 2),
+		OP_ATOMIC_LOAD32U_I64: atomicLoad("ATOMIC_LOAD32U_I64", TYPE_I64, 4),
+
+		OP_ATOMIC_STORE_I32:   atomicStore("ATOMIC_STORE_I32", TYPE_I32, 4),
+		OP_ATOMIC_STORE_I64:   atomicStore("ATOMIC_STORE_I64", TYPE_I64, 8),
+		OP_ATOMIC_STORE8_I32:  atomicStore("ATOMIC_STORE8_I32", TYPE_I32, 1),
+		OP_ATOMIC_STORE16_I32: atomicStore("ATOMIC_STORE16_I32", TYPE_I32, 2),
+		OP_ATOMIC_STORE8_I64:  atomicStore("ATOMIC_STORE8_I64", TYPE_I64, 1),
+		OP_ATOMIC_STORE16_I64: atomicStore("ATOMIC_STORE16_I64", TYPE_I64, 2),
+		OP_ATOMIC_STORE32_I64: atomicStore("ATOMIC_STORE32_I64", TYPE_I64, 4),
+	}
+	// Every read-modify-write group has the same seven shapes in the same
+	// order, starting at add and ending with cmpxchg
+	shapes := []struct {
+		suffix    string
+		valueType ValueStackEntryType
+		width     int
+	}{
+		{"_I32", TYPE_I32, 4},
+		{"_I64", TYPE_I64, 8},
+		{"8U_I32", TYPE_I32, 1},
+		{"16U_I32", TYPE_I32, 2},
+		{"8U_I64", TYPE_I64, 1},
+		{"16U_I64", TYPE_I64, 2},
+		{"32U_I64", TYPE_I64, 4},
+	}
+	groups := []struct {
+		name string
+		op   AtomicOp
+	}{
+		{"ADD", AtomicAdd},
+		{"SUB", AtomicSub},
+		{"AND", AtomicAnd},
+		{"OR", AtomicOr},
+		{"XOR", AtomicXor},
+		{"XCHG", AtomicXchg},
+	}
+	for g, group := range groups {
+		for s, shape := range shapes {
+			opcode := uint32(OP_ATOMIC_RMW_ADD_I32 + g*len(shapes) + s)
+			m[opcode] = atomicRMW(atomicOpName("RMW", shape.width, shape.valueType, group.name), shape.valueType, shape.width, group.op)
+		}
+	}
+	for s, shape := range shapes {
+		m[uint32(OP_ATOMIC_RMW_CMPXCHG_I32+s)] = atomicCompareExchange(atomicOpName("RMW", shape.width, shape.valueType, "CMPXCHG"), shape.valueType, shape.width)
+	}
+	return m
+}
+
+// Builds names such as ATOMIC_RMW_ADD_I32 and ATOMIC_RMW8_ADDU_I64 to
+// match the opcode constants
+func atomicOpName(kind string, width int, valueType ValueStackEntryType, op string) string {
+	full := 4
+	suffix := "_I32"
+	if valueType == TYPE_I64 {
+		full = 8
+		suffix = "_I64"
+	}
+	if width == full {
+		return fmt.Sprintf("ATOMIC_%s_%s%s", kind, op, suffix)
+	}
+	return fmt.Sprintf("ATOMIC_%s%d_%sU%s", kind, width*8, op, suffix)
+}
+
+// 0xFE: Reads the sub-opcode and dispatches to the atomic instruction
+func ATOMIC_PREFIX(vm *VMState) error {
+	sub, next, err := vm.fetchULEB128("ATOMIC_PREFIX", vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	handler, ok := atomicInstructionMap[uint32(sub)]
+	if !ok {
+		opcode := uint8(OP_PREFIX_ATOMIC)
+		return vm.SetTrapError(&TrapError{
+			Type:        TrapUnknownInstruction,
+			Op:          "ATOMIC_PREFIX",
+			PC:          vm.PC,
+			Message:     fmt.Sprintf("Unknown instruction: 0x%02X 0x%02X", opcode, sub),
+			Instruction: &opcode,
+			Meta: map[string]uint64{
+				"sub_opcode": sub,
+			},
+		})
+	}
+	return handler(vm, next)
+}
+
+// Reads the align and offset immediates. Atomics require the alignment
+// hint to be exactly the natural alignment.
+func (vm *VMState) fetchAtomicMemArg(op string, addr uint64, width int) (uint64, uint64, error) {
+	align, next, err := vm.fetchULEB128(op, addr, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	if align != uint64(bits.TrailingZeros(uint(width))) {
+		return 0, 0, vm.SetTrapError(&TrapError{
+			Type:    TrapMalformedImmediate,
+			Op:      op,
+			PC:      vm.PC,
+			Message: fmt.Sprintf("%s: alignment must be %d, got %d", op, bits.TrailingZeros(uint(width)), align),
+		})
+	}
+	return vm.fetchULEB128(op, next, 32)
+}
+
+// Computes the effective address and traps if it isn't naturally aligned
+func (vm *VMState) atomicEffectiveAddress(op string, access TrapAccessType, base uint32, offset uint64, width int) (uint64, error) {
+	ea := uint64(base) + offset
+	if ea%uint64(width) != 0 {
+		return 0, vm.SetTrapError(&TrapError{
+			Type:       TrapUnalignedAtomic,
+			Op:         op,
+			PC:         vm.PC,
+			Message:    fmt.Sprintf("%s: Unaligned atomic access", op),
+			AccessType: access,
+			Address:    &ea,
+			Meta: map[string]uint64{
+				"width": uint64(width),
+			},
+		})
+	}
+	return ea, nil
+}
+
+func entryValue(entry ValueStackEntry) uint64 {
+	if entry.EntryType == TYPE_I64 {
+		return entry.Value_I64
+	}
+	return uint64(entry.Value_I32)
+}
+
+func (vs *ValueStack) pushValue(valueType ValueStackEntryType, val uint64) {
+	if valueType == TYPE_I64 {
+		vs.PushInt64(val)
+		return
+	}
+	vs.PushInt32(uint32(val))
+}
+
+// Shared prologue: immediates, operand types, and the effective address.
+// access is what an unaligned address is reported as. On success the
+// operands have been dropped and returned.
+func (vm *VMState) atomicOperands(op string, access TrapAccessType, immAddr uint64, width int, operandTypes ...ValueStackEntryType) (uint64, uint64, []ValueStackEntry, error) {
+	offset, next, err := vm.fetchAtomicMemArg(op, immAddr, width)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	enough, collect := vm.ValueStack.HasTypes(append([]ValueStackEntryType{TYPE_I32}, operandTypes...)...)
+	if !enough {
+		return 0, 0, nil, NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	operands := make([]ValueStackEntry, len(collect))
+	copy(operands, collect)
+	ea, err := vm.atomicEffectiveAddress(op, access, operands[0].Value_I32, offset, width)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if !vm.ValueStack.Drop(len(operands), true) {
+		return 0, 0, nil, NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+	return ea, next, operands[1:], nil
+}
+
+// i32.atomic.load, i64.atomic.load32_u, etc
+func atomicLoad(op string, valueType ValueStackEntryType, width int) prefixedInstruction {
+	return func(vm *VMState, immAddr uint64) error {
+		ea, next, _, err := vm.atomicOperands(op, TrapAccessRead, immAddr, width)
+		if err != nil {
+			return err
+		}
+		val, res := vm.atomicMemory().AtomicLoad(vm.MemoryContext(), ea, width)
+		if res != MemoryAccessOK {
+			return vm.memoryAccessTrap(op, TrapAccessRead, ea, width, res)
+		}
+		vm.ValueStack.pushValue(valueType, val)
+		vm.PC = next
+		return nil
+	}
+}
+
+// i32.atomic.store, i64.atomic.store8, etc
+func atomicStore(op string, valueType ValueStackEntryType, width int) prefixedInstruction {
+	return func(vm *VMState, immAddr uint64) error {
+		ea, next, operands, err := vm.atomicOperands(op, TrapAccessWrite, immAddr, width, valueType)
+		if err != nil {
+			return err
+		}
+		res := vm.atomicMemory().AtomicStore(vm.MemoryContext(), ea, width, entryValue(operands[0]))
+		if res != MemoryAccessOK {
+			return vm.memoryAccessTrap(op, TrapAccessWrite, ea, width, res)
+		}
+		vm.PC = next
+		return nil
+	}
+}
+
+// i32.atomic.rmw.add, i64.atomic.rmw8.xchg_u, etc; pushes the old value
+func atomicRMW(op string, valueType ValueStackEntryType, width int, rmw AtomicOp) prefixedInstruction {
+	return func(vm *VMState, immAddr uint64) error {
+		ea, next, operands, err := vm.atomicOperands(op, TrapAccessWrite, immAddr, width, valueType)
+		if err != nil {
+			return err
+		}
+		old, res := vm.atomicMemory().AtomicRMW(vm.MemoryContext(), ea, width, rmw, entryValue(operands[0]))
+		if res != MemoryAccessOK {
+			return vm.memoryAccessTrap(op, TrapAccessWrite, ea, width, res)
+		}
+		vm.ValueStack.pushValue(valueType, old)
+		vm.PC = next
+		return nil
+	}
+}
+
+// i32.atomic.rmw.cmpxchg, etc; pushes the old value
+func atomicCompareExchange(op string, valueType ValueStackEntryType, width int) prefixedInstruction {
+	return func(vm *VMState, immAddr uint64) error {
+		ea, next, operands, err := vm.atomicOperands(op, TrapAccessWrite, immAddr, width, valueType, valueType)
+		if err != nil {
+			return err
+		}
+		old, res := vm.atomicMemory().AtomicCompareExchange(vm.MemoryContext(), ea, width, entryValue(operands[0]), entryValue(operands[1]))
+		if res != MemoryAccessOK {
+			return vm.memoryAccessTrap(op, TrapAccessWrite, ea, width, res)
+		}
+		vm.ValueStack.pushValue(valueType, old)
+		vm.PC = next
+		return nil
+	}
+}
+
+// memory.atomic.wait32/64: blocks this thread until notified, the value
+// differs, or the timeout (nanoseconds, negative for forever) expires
+func atomicWait(op string, valueType ValueStackEntryType, width int) prefixedInstruction {
+	return func(vm *VMState, immAddr uint64) error {
+		ea, next, operands, err := vm.atomicOperands(op, TrapAccessRead, immAddr, width, valueType, TYPE_I64)
+		if err != nil {
+			return err
+		}
+		mem := vm.atomicMemory()
+		if !mem.Shared() {
+			return vm.SetTrapError(&TrapError{
+				Type:       TrapMemoryAccess,
+				Op:         op,
+				PC:         vm.PC,
+				Message:    fmt.Sprintf("%s: Wait on unshared memory", op),
+				AccessType: TrapAccessRead,
+				Address:    &ea,
+			})
+		}
+		timeout := time.Duration(int64(operands[1].Value_I64))
+		ctx := vm.MemoryContext()
+		cancel, stop := vm.waitCancel()
+		ctx.Cancel = cancel
+		result, res := mem.Wait(ctx, ea, width, entryValue(operands[0]), timeout)
+		stop()
+		if res != MemoryAccessOK {
+			return vm.memoryAccessTrap(op, TrapAccessRead, ea, width, res)
+		}
+		if result == WaitCancelled {
+			if vm.aborted.Load() {
+				return vm.SetTrapError(&TrapError{
+					Type:    TrapThreadAborted,
+					Op:      op,
+					PC:      vm.PC,
+					Message: fmt.Sprintf("Thread %d aborted", vm.ID),
+				})
+			}
+			return vm.SetTrapError(&TrapError{
+				Type:    TrapInterrupted,
+				Op:      op,
+				PC:      vm.PC,
+				Message: fmt.Sprintf("%s: interrupted: %v", op, context.Cause(vm.ctx)),
+				Cause:   context.Cause(vm.ctx),
+			})
+		}
+		vm.ValueStack.PushInt32(uint32(result))
+		vm.PC = next
+		return nil
+	}
+}
+
+// memory.atomic.notify: wakes up to count waiters, pushes how many woke
+func ATOMIC_NOTIFY(vm *VMState, immAddr uint64) error {
+	const op = "ATOMIC_NOTIFY"
+	ea, next, operands, err := vm.atomicOperands(op, TrapAccessRead, immAddr, WidthI32, TYPE_I32)
+	if err != nil {
+		return err
+	}
+	woken, res := vm.atomicMemory().Notify(vm.MemoryContext(), ea, operands[0].Value_I32)
+	if res != MemoryAccessOK {
+		return vm.memoryAccessTrap(op, TrapAccessRead, ea, WidthI32, res)
+	}
+	vm.ValueStack.PushInt32(woken)
+	vm.PC = next
+	return nil
+}
+
+// atomic.fence: Go atomics are sequentially consistent already, so only
+// the reserved immediate needs to be consumed
+func ATOMIC_FENCE(vm *VMState, immAddr uint64) error {
+	flags, res := vm.fetch(immAddr, 1)
+	if res != MemoryAccessOK {
+		return vm.memoryAccessTrap("ATOMIC_FENCE", TrapAccessExecute, immAddr, 1, res)
+	}
+	if flags[0] != 0x00 {
+		return vm.SetTrapError(&TrapError{
+			Type:    TrapMalformedImmediate,
+			Op:      "ATOMIC_FENCE",
+			PC:      vm.PC,
+			Message: "ATOMIC_FENCE: reserved immediate must be zero",
+		})
+	}
+	vm.PC = immAddr + 1
+	return nil
+}
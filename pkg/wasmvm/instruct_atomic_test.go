@@ -0,0 +1,586 @@
+package wasmvm_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Data lives in the shard after the code so that the default W^X
+// policy leaves it writable
+const atomicDataAddr = wasmvm.MemoryShardSize
+
+func i32(v uint32) wasmvm.ValueStackEntry {
+	return *wasmvm.NewValueStackEntryI32(v)
+}
+
+func i64(v uint64) wasmvm.ValueStackEntry {
+	return *wasmvm.NewValueStackEntryI64(v)
+}
+
+// 0xFE sub align offset, with single octet immediates
+func atomicInstr(sub byte, align byte, offset byte) []byte {
+	return []byte{wasmvm.OP_PREFIX_ATOMIC, sub, align, offset}
+}
+
+type atomicTestCase struct {
+	name         string
+	program      []byte
+	shared       bool
+	initial      []byte // At atomicDataAddr
+	stack        []wasmvm.ValueStackEntry
+	expectTrap   bool
+	trapType     wasmvm.TrapType
+	trapOp       string
+	trapAccess   wasmvm.TrapAccessType    // Checked unless unknown
+	expectStack  []wasmvm.ValueStackEntry // Bottom to top
+	expectMemory []byte                   // At atomicDataAddr
+	expectPC     uint64
+}
+
+func newAtomicTestVM(t testing.TB, program []byte, shared bool) *wasmvm.VMState {
+	vm, err := (&wasmvm.VMConfig{
+		Image: (&wasmvm.ImageConfig{}).SetArray(program).SetSize(uint64(len(program))),
+	}).SetSize(wasmvm.MemoryShardSize * 2).SetShared(shared).BuildVMState()
+	require.NoError(t, err)
+	return vm
+}
+
+func runTestBatchAtomic(t *testing.T, tests []atomicTestCase) {
+	for _, tc := range tests {
+		for _, shared := range []bool{true, false} {
+			name := tc.name + " (unshared)"
+			if shared {
+				name = tc.name + " (shared)"
+			}
+			if tc.shared && !shared {
+				continue
+			}
+			t.Run(name, func(t *testing.T) {
+				vm := newAtomicTestVM(t, tc.program, shared)
+				if tc.initial != nil {
+					require.NoError(t, vm.WriteMemory("TEST", atomicDataAddr, tc.initial))
+				}
+				for i := range tc.stack {
+					vm.ValueStack.Push(&tc.stack[i])
+				}
+				err := vm.Step()
+				if tc.expectTrap {
+					assert.Error(t, err)
+					require.NotNil(t, vm.TrapErr)
+					assert.Equal(t, tc.trapType, vm.TrapErr.Type)
+					assert.Equal(t, tc.trapOp, vm.TrapErr.Op)
+					if tc.trapAccess != wasmvm.TrapAccessUnknown {
+						assert.Equal(t, tc.trapAccess, vm.TrapErr.AccessType)
+					}
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tc.expectPC, vm.PC)
+				assert.Equal(t, len(tc.expectStack), vm.ValueStack.Size())
+				for i := len(tc.expectStack) - 1; i >= 0; i-- {
+					val, ok := vm.ValueStack.Pop()
+					require.True(t, ok)
+					assert.Equal(t, tc.expectStack[i], *val)
+				}
+				if tc.expectMemory != nil {
+					buf := make([]byte, len(tc.expectMemory))
+					require.NoError(t, vm.ReadMemory("TEST", atomicDataAddr, buf))
+					assert.Equal(t, tc.expectMemory, buf)
+				}
+			})
+		}
+	}
+}
+
+func TestAtomic_LoadStore(t *testing.T) {
+	initial := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	tests := []atomicTestCase{
+		{
+			name:        "i32.atomic.load",
+			program:     atomicInstr(wasmvm.OP_ATOMIC_LOAD_I32, 2, 0),
+			initial:     initial,
+			stack:       []wasmvm.ValueStackEntry{i32(atomicDataAddr)},
+			expectStack: []wasmvm.ValueStackEntry{i32(0x04030201)},
+			expectPC:    4,
+		},
+		{
+			name:        "i64.atomic.load",
+			program:     atomicInstr(wasmvm.OP_ATOMIC_LOAD_I64, 3, 0),
+			initial:     initial,
+			stack:       []wasmvm.ValueStackEntry{i32(atomicDataAddr)},
+			expectStack: []wasmvm.ValueStackEntry{i64(0x0807060504030201)},
+			expectPC:    4,
+		},
+		{
+			name:        "i32.atomic.load8_u with offset",
+			program:     atomicInstr(wasmvm.OP_ATOMIC_LOAD8U_I32, 0, 3),
+			initial:     initial,
+			stack:       []wasmvm.ValueStackEntry{i32(atomicDataAddr)},
+			expectStack: []wasmvm.ValueStackEntry{i32(0x04)},
+			expectPC:    4,
+		},
+		{
+			name:        "i32.atomic.load16_u",
+			program:     atomicInstr(wasmvm.OP_ATOMIC_LOAD16U_I32, 1, 2),
+			initial:     initial,
+			stack:       []wasmvm.ValueStackEntry{i32(atomicDataAddr)},
+			expectStack: []wasmvm.ValueStackEntry{i32(0x0403)},
+			expectPC:    4,
+		},
+		{
+			name:        "i64.atomic.load32_u",
+			program:     atomicInstr(wasmvm.OP_ATOMIC_LOAD32U_I64, 2, 4),
+			initial:     initial,
+			stack:       []wasmvm.ValueStackEntry{i32(atomicDataAddr)},
+			expectStack: []wasmvm.ValueStackEntry{i64(0x08070605)},
+			expectPC:    4,
+		},
+		{
+			name:         "i32.atomic.store",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_STORE_I32, 2, 4),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(0xAABBCCDD)},
+			expectMemory: []byte{0x01, 0x02, 0x03, 0x04, 0xDD, 0xCC, 0xBB, 0xAA},
+			expectPC:     4,
+		},
+		{
+			name:         "i64.atomic.store",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_STORE_I64, 3, 0),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(0x1122334455667788)},
+			expectMemory: []byte{0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11},
+			expectPC:     4,
+		},
+		{
+			name:         "i32.atomic.store8 truncates",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_STORE8_I32, 0, 1),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(0xFFFFFF99)},
+			expectMemory: []byte{0x01, 0x99, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			expectPC:     4,
+		},
+		{
+			name:         "i64.atomic.store16",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_STORE16_I64, 1, 6),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(0xBEEF)},
+			expectMemory: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0xEF, 0xBE},
+			expectPC:     4,
+		},
+		{
+			name:       "failure - unaligned",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_LOAD_I32, 2, 2),
+			stack:      []wasmvm.ValueStackEntry{i32(atomicDataAddr)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapUnalignedAtomic,
+			trapOp:     "ATOMIC_LOAD_I32",
+			trapAccess: wasmvm.TrapAccessRead,
+		},
+		{
+			name:       "failure - store unaligned",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_STORE16_I64, 1, 1),
+			stack:      []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(0)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapUnalignedAtomic,
+			trapOp:     "ATOMIC_STORE16_I64",
+			trapAccess: wasmvm.TrapAccessWrite,
+		},
+		{
+			name:       "failure - wrong alignment immediate",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_LOAD_I64, 2, 0),
+			stack:      []wasmvm.ValueStackEntry{i32(atomicDataAddr)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapMalformedImmediate,
+			trapOp:     "ATOMIC_LOAD_I64",
+		},
+		{
+			name:       "failure - out of bounds",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_LOAD_I32, 2, 0),
+			stack:      []wasmvm.ValueStackEntry{i32(atomicDataAddr * 2)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapMemoryAccess,
+			trapOp:     "ATOMIC_LOAD_I32",
+		},
+		{
+			name:       "failure - store into code",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_STORE_I32, 2, 0),
+			stack:      []wasmvm.ValueStackEntry{i32(0), i32(0)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapMemoryAccess,
+			trapOp:     "ATOMIC_STORE_I32",
+		},
+		{
+			name:       "failure - missing operand",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_STORE_I32, 2, 0),
+			stack:      []wasmvm.ValueStackEntry{i32(atomicDataAddr)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapStackUnderflow,
+			trapOp:     "ATOMIC_STORE_I32",
+		},
+		{
+			name:       "failure - wrong operand type",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_STORE_I64, 3, 0),
+			stack:      []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(1)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapStackUnderflow,
+			trapOp:     "ATOMIC_STORE_I64",
+		},
+	}
+	runTestBatchAtomic(t, tests)
+}
+
+func TestAtomic_RMW(t *testing.T) {
+	initial := []byte{0xF0, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF}
+	tests := []atomicTestCase{
+		{
+			name:         "i32.atomic.rmw.add",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW_ADD_I32, 2, 0),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(0x20)},
+			expectStack:  []wasmvm.ValueStackEntry{i32(0xF0)},
+			expectMemory: []byte{0x10, 0x01, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF},
+			expectPC:     4,
+		},
+		{
+			name:         "i32.atomic.rmw8.add_u wraps within the octet",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW8_ADDU_I32, 0, 0),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(0x20)},
+			expectStack:  []wasmvm.ValueStackEntry{i32(0xF0)},
+			expectMemory: []byte{0x10, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF},
+			expectPC:     4,
+		},
+		{
+			name:         "i64.atomic.rmw.sub",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW_SUB_I64, 3, 0),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(0xF1)},
+			expectStack:  []wasmvm.ValueStackEntry{i64(0xFFFFFFFF000000F0)},
+			expectMemory: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFE, 0xFF, 0xFF, 0xFF},
+			expectPC:     4,
+		},
+		{
+			name:         "i64.atomic.rmw16.and_u",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW16_ANDU_I64, 1, 4),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(0x0F0F)},
+			expectStack:  []wasmvm.ValueStackEntry{i64(0xFFFF)},
+			expectMemory: []byte{0xF0, 0x00, 0x00, 0x00, 0x0F, 0x0F, 0xFF, 0xFF},
+			expectPC:     4,
+		},
+		{
+			name:         "i32.atomic.rmw16.or_u",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW16_ORU_I32, 1, 2),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(0x1234)},
+			expectStack:  []wasmvm.ValueStackEntry{i32(0)},
+			expectMemory: []byte{0xF0, 0x00, 0x34, 0x12, 0xFF, 0xFF, 0xFF, 0xFF},
+			expectPC:     4,
+		},
+		{
+			name:         "i64.atomic.rmw8.xor_u",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW8_XORU_I64, 0, 5),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(0x0F)},
+			expectStack:  []wasmvm.ValueStackEntry{i64(0xFF)},
+			expectMemory: []byte{0xF0, 0x00, 0x00, 0x00, 0xFF, 0xF0, 0xFF, 0xFF},
+			expectPC:     4,
+		},
+		{
+			name:         "i64.atomic.rmw32.xchg_u",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW32_XCHGU_I64, 2, 4),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(0xAABBCCDD)},
+			expectStack:  []wasmvm.ValueStackEntry{i64(0xFFFFFFFF)},
+			expectMemory: []byte{0xF0, 0x00, 0x00, 0x00, 0xDD, 0xCC, 0xBB, 0xAA},
+			expectPC:     4,
+		},
+		{
+			name:         "i32.atomic.rmw.cmpxchg match",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW_CMPXCHG_I32, 2, 0),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(0xF0), i32(0x42)},
+			expectStack:  []wasmvm.ValueStackEntry{i32(0xF0)},
+			expectMemory: []byte{0x42, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF},
+			expectPC:     4,
+		},
+		{
+			name:         "i32.atomic.rmw.cmpxchg mismatch",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW_CMPXCHG_I32, 2, 0),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(0xF1), i32(0x42)},
+			expectStack:  []wasmvm.ValueStackEntry{i32(0xF0)},
+			expectMemory: initial,
+			expectPC:     4,
+		},
+		{
+			name:         "i64.atomic.rmw.cmpxchg",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW_CMPXCHG_I64, 3, 0),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(0xFFFFFFFF000000F0), i64(7)},
+			expectStack:  []wasmvm.ValueStackEntry{i64(0xFFFFFFFF000000F0)},
+			expectMemory: []byte{0x07, 0, 0, 0, 0, 0, 0, 0},
+			expectPC:     4,
+		},
+		{
+			name:         "i64.atomic.rmw8.cmpxchg_u compares the truncated expected",
+			program:      atomicInstr(wasmvm.OP_ATOMIC_RMW8_CMPXCHGU_I64, 0, 0),
+			initial:      initial,
+			stack:        []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(0x1F0), i64(0x1)},
+			expectStack:  []wasmvm.ValueStackEntry{i64(0xF0)},
+			expectMemory: []byte{0x01, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF},
+			expectPC:     4,
+		},
+		{
+			name:       "failure - rmw into code",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_RMW_ADD_I32, 2, 0),
+			stack:      []wasmvm.ValueStackEntry{i32(0), i32(1)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapMemoryAccess,
+			trapOp:     "ATOMIC_RMW_ADD_I32",
+		},
+		{
+			name:       "failure - cmpxchg unaligned",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_RMW16_CMPXCHGU_I32, 1, 1),
+			stack:      []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(0), i32(1)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapUnalignedAtomic,
+			trapOp:     "ATOMIC_RMW16_CMPXCHGU_I32",
+			trapAccess: wasmvm.TrapAccessWrite,
+		},
+	}
+	runTestBatchAtomic(t, tests)
+}
+
+func TestAtomic_WaitNotifyFence(t *testing.T) {
+	initial := []byte{0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	tests := []atomicTestCase{
+		{
+			name:        "wait32 not equal",
+			program:     atomicInstr(wasmvm.OP_ATOMIC_WAIT32, 2, 0),
+			shared:      true,
+			initial:     initial,
+			stack:       []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(4), i64(0)},
+			expectStack: []wasmvm.ValueStackEntry{i32(uint32(wasmvm.WaitNotEqual))},
+			expectPC:    4,
+		},
+		{
+			name:        "wait32 timed out",
+			program:     atomicInstr(wasmvm.OP_ATOMIC_WAIT32, 2, 0),
+			shared:      true,
+			initial:     initial,
+			stack:       []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(5), i64(uint64(time.Millisecond))},
+			expectStack: []wasmvm.ValueStackEntry{i32(uint32(wasmvm.WaitTimedOut))},
+			expectPC:    4,
+		},
+		{
+			name:        "wait64 timed out",
+			program:     atomicInstr(wasmvm.OP_ATOMIC_WAIT64, 3, 0),
+			shared:      true,
+			initial:     initial,
+			stack:       []wasmvm.ValueStackEntry{i32(atomicDataAddr), i64(5), i64(0)},
+			expectStack: []wasmvm.ValueStackEntry{i32(uint32(wasmvm.WaitTimedOut))},
+			expectPC:    4,
+		},
+		{
+			name:       "failure - wait32 out of bounds",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_WAIT32, 2, 0),
+			shared:     true,
+			stack:      []wasmvm.ValueStackEntry{i32(atomicDataAddr * 2), i32(0), i64(0)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapMemoryAccess,
+			trapOp:     "ATOMIC_WAIT32",
+		},
+		{
+			name:        "notify with no waiters",
+			program:     atomicInstr(wasmvm.OP_ATOMIC_NOTIFY, 2, 0),
+			stack:       []wasmvm.ValueStackEntry{i32(atomicDataAddr), i32(10)},
+			expectStack: []wasmvm.ValueStackEntry{i32(0)},
+			expectPC:    4,
+		},
+		{
+			name:       "failure - notify out of bounds",
+			program:    atomicInstr(wasmvm.OP_ATOMIC_NOTIFY, 2, 0),
+			stack:      []wasmvm.ValueStackEntry{i32(atomicDataAddr * 2), i32(10)},
+			expectTrap: true,
+			trapType:   wasmvm.TrapMemoryAccess,
+			trapOp:     "ATOMIC_NOTIFY",
+		},
+		{
+			name:     "fence",
+			program:  []byte{wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_FENCE, 0x00},
+			expectPC: 3,
+		},
+		{
+			name:       "failure - fence reserved immediate",
+			program:    []byte{wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_FENCE, 0x01},
+			expectTrap: true,
+			trapType:   wasmvm.TrapMalformedImmediate,
+			trapOp:     "ATOMIC_FENCE",
+		},
+		{
+			name:       "failure - unknown sub-opcode",
+			program:    []byte{wasmvm.OP_PREFIX_ATOMIC, 0x7F},
+			expectTrap: true,
+			trapType:   wasmvm.TrapUnknownInstruction,
+			trapOp:     "ATOMIC_PREFIX",
+		},
+		{
+			name:       "failure - malformed sub-opcode",
+			program:    []byte{wasmvm.OP_PREFIX_ATOMIC, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F},
+			expectTrap: true,
+			trapType:   wasmvm.TrapMalformedImmediate,
+			trapOp:     "ATOMIC_PREFIX",
+		},
+	}
+	runTestBatchAtomic(t, tests)
+}
+
+func TestAtomic_WaitUnshared(t *testing.T) {
+	vm := newAtomicTestVM(t, atomicInstr(wasmvm.OP_ATOMIC_WAIT32, 2, 0), false)
+	vm.ValueStack.Push(wasmvm.NewValueStackEntryI32(atomicDataAddr))
+	vm.ValueStack.PushInt32(0)
+	vm.ValueStack.PushInt64(0)
+	assert.Error(t, vm.Step())
+	require.NotNil(t, vm.TrapErr)
+	assert.Equal(t, wasmvm.TrapMemoryAccess, vm.TrapErr.Type)
+	assert.Contains(t, vm.TrapErr.Message, "unshared")
+}
+
+// Two VMs share one memory; the first blocks in wait32 until the
+// second one notifies it
+func TestAtomic_WaitNotifyAcrossVMs(t *testing.T) {
+	waiter := []byte{
+		wasmvm.OP_CONST_I32, 0x00, 0x10, 0x00, 0x00, // atomicDataAddr
+		wasmvm.OP_CONST_I32, 0x00, 0x00, 0x00, 0x00, // expected 0
+		wasmvm.OP_CONST_I64, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, // forever
+		wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_WAIT32, 2, 0,
+		wasmvm.OP_END,
+	}
+	notifier := []byte{
+		wasmvm.OP_CONST_I32, 0x00, 0x10, 0x00, 0x00,
+		wasmvm.OP_CONST_I32, 0x01, 0x00, 0x00, 0x00,
+		wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_NOTIFY, 2, 0,
+		wasmvm.OP_END,
+	}
+	first := newAtomicTestVM(t, append(append([]byte{}, waiter...), notifier...), true)
+	second, err := (&wasmvm.VMConfig{}).
+		SetMemory(first.Memory).
+		SetStartOverride(uint64(len(waiter))).
+		BuildVMState()
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		first.MainLoop()
+	}()
+
+	// Keep notifying until the waiter was actually queued and woken
+	var woken uint32
+	deadline := time.Now().Add(5 * time.Second)
+	for woken == 0 && time.Now().Before(deadline) {
+		second.Trap = false
+		second.TrapErr = nil
+		second.PC = uint64(len(waiter))
+		second.MainLoop()
+		require.Equal(t, wasmvm.TrapCallStackEmpty, second.TrapErr.Type)
+		val, ok := second.ValueStack.Pop()
+		require.True(t, ok)
+		woken = val.Value_I32
+		if woken == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	assert.Equal(t, uint32(1), woken)
+	<-done
+	assert.Equal(t, wasmvm.TrapCallStackEmpty, first.TrapErr.Type)
+	val, ok := first.ValueStack.Pop()
+	require.True(t, ok)
+	assert.Equal(t, uint32(wasmvm.WaitOk), val.Value_I32)
+}
+
+func TestFlatSharedMemory_WaitTimeoutRacingNotify(t *testing.T) {
+	mem := wasmvm.NewFlatSharedMemory(8)
+	ctx := wasmvm.MemoryContext{}
+	for i := 0; i < 50; i++ {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		var result wasmvm.WaitResult
+		go func() {
+			defer wg.Done()
+			result, _ = mem.Wait(ctx, 0, 4, 0, time.Microsecond)
+		}()
+		mem.Notify(ctx, 0, 1)
+		wg.Wait()
+		assert.Contains(t, []wasmvm.WaitResult{wasmvm.WaitOk, wasmvm.WaitTimedOut}, result)
+	}
+	// Nobody is left waiting
+	woken, res := mem.Notify(ctx, 0, 100)
+	assert.Equal(t, wasmvm.MemoryAccessOK, res)
+	assert.Equal(t, uint32(0), woken)
+
+	// Closing Cancel gives up the wait and leaves the queue
+	cancel := make(chan struct{})
+	close(cancel)
+	result, res := mem.Wait(wasmvm.MemoryContext{Cancel: cancel}, 0, 4, 0, -1)
+	assert.Equal(t, wasmvm.MemoryAccessOK, res)
+	assert.Equal(t, wasmvm.WaitCancelled, result)
+	woken, _ = mem.Notify(ctx, 0, 100)
+	assert.Equal(t, uint32(0), woken)
+
+	empty := wasmvm.NewFlatSharedMemory(0)
+	assert.Equal(t, uint64(0), empty.Size())
+	assert.True(t, empty.Shared())
+}
+
+// Meant to be run with -race; several VMs hammer the same counter
+func TestAtomic_ConcurrentAdd(t *testing.T) {
+	const threads = 8
+	const adds = 100 // Keeps the code inside the first shard
+	increment := []byte{
+		wasmvm.OP_CONST_I32, 0x00, 0x10, 0x00, 0x00,
+		wasmvm.OP_CONST_I32, 0x01, 0x00, 0x00, 0x00,
+		wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_RMW_ADD_I32, 2, 0,
+		wasmvm.OP_CONST_I32, 0x04, 0x10, 0x00, 0x00,
+		wasmvm.OP_CONST_I32, 0x01, 0x00, 0x00, 0x00,
+		wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_RMW8_ADDU_I32, 0, 0,
+	}
+	program := []byte{}
+	for i := 0; i < adds; i++ {
+		program = append(program, increment...)
+	}
+	program = append(program, wasmvm.OP_END)
+
+	first := newAtomicTestVM(t, program, true)
+	vms := []*wasmvm.VMState{first}
+	for len(vms) < threads {
+		vm, err := (&wasmvm.VMConfig{}).SetMemory(first.Memory).BuildVMState()
+		require.NoError(t, err)
+		vms = append(vms, vm)
+	}
+	var wg sync.WaitGroup
+	for _, vm := range vms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vm.MainLoop()
+		}()
+	}
+	wg.Wait()
+	for _, vm := range vms {
+		assert.Equal(t, wasmvm.TrapCallStackEmpty, vm.TrapErr.Type)
+	}
+	am := first.Memory.(wasmvm.AtomicMemory)
+	val, res := am.AtomicLoad(wasmvm.MemoryContext{}, atomicDataAddr, 4)
+	assert.Equal(t, wasmvm.MemoryAccessOK, res)
+	assert.Equal(t, uint64(threads*adds), val)
+	// The octet counter wraps at 256
+	val, _ = am.AtomicLoad(wasmvm.MemoryContext{}, atomicDataAddr+4, 1)
+	assert.Equal(t, uint64((threads*adds)%256), val)
+}
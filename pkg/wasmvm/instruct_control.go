@@ -1,5 +1,7 @@
 package wasmvm
 
+import "fmt"
+
 // 0x01 NOP: No Operation
 func NOP(vm *VMState) error {
 	vm.PC++
@@ -18,3 +20,318 @@ func END(vm *VMState) error {
 		Message: "END: Call Stack Empty",
 	})
 }
+
+// The structured control instructions below are only available to
+// instances, which know where every block ends ahead of time
+
+// 0x00 unreachable
+func UNREACHABLE(vm *VMState) error {
+	return vm.SetTrapError(&TrapError{
+		Type:    TrapUnreachable,
+		Op:      "UNREACHABLE",
+		PC:      vm.PC,
+		Message: "UNREACHABLE: Unreachable executed",
+	})
+}
+
+// Looks up the block starting at the current instruction
+func (vm *VMState) currentBlock(op string) (blockInfo, error) {
+	info, ok := vm.instance.blocks[vm.PC]
+	if !ok {
+		return info, vm.SetTrapError(&TrapError{
+			Type:    TrapInternalError,
+			Op:      op,
+			PC:      vm.PC,
+			Message: fmt.Sprintf("%s: no block at 0x%X", op, vm.PC),
+		})
+	}
+	return info, nil
+}
+
+func (vm *VMState) pushLabel(op string, info blockInfo, loop bool) error {
+	if !vm.ValueStack.HasAtLeast(info.Params) {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	label := Label{
+		Loop:        loop,
+		Start:       info.Body,
+		End:         info.End,
+		StackHeight: vm.ValueStack.Size() - info.Params,
+		Arity:       info.Results,
+	}
+	// Branching to a loop starts it over, which takes its parameters
+	if loop {
+		label.Arity = info.Params
+	}
+	vm.Labels = append(vm.Labels, label)
+	return nil
+}
+
+// 0x02 block
+func BLOCK(vm *VMState) error {
+	info, err := vm.currentBlock("BLOCK")
+	if err != nil {
+		return err
+	}
+	if err := vm.pushLabel("BLOCK", info, false); err != nil {
+		return err
+	}
+	vm.PC = info.Body
+	return nil
+}
+
+// 0x03 loop
+func LOOP(vm *VMState) error {
+	info, err := vm.currentBlock("LOOP")
+	if err != nil {
+		return err
+	}
+	if err := vm.pushLabel("LOOP", info, true); err != nil {
+		return err
+	}
+	vm.PC = info.Body
+	return nil
+}
+
+// 0x04 if: Pull an I32 condition, run the first branch if it is
+// non-zero and the else branch (if any) otherwise
+func IF(vm *VMState) error {
+	const op = "IF"
+	info, err := vm.currentBlock(op)
+	if err != nil {
+		return err
+	}
+	enough, collect := vm.ValueStack.HasAtLeastOfType(1, TYPE_I32)
+	if !enough {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	cond := collect[0].Value_I32
+	if !vm.ValueStack.Drop(1, true) {
+		return NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+	switch {
+	case cond != 0:
+		vm.PC = info.Body
+	case info.Else != 0:
+		vm.PC = info.Else + 1
+	default:
+		// Without an else there is nothing to run, skip the end as well
+		vm.PC = info.End + 1
+		return nil
+	}
+	return vm.pushLabel(op, info, false)
+}
+
+// 0x05 else: Reached at the end of the first branch, so continue at
+// the end of the if
+func ELSE(vm *VMState) error {
+	if len(vm.Labels) == 0 {
+		return NewStackUnderflowErrorAndSetTrap(vm, "ELSE")
+	}
+	vm.PC = vm.Labels[len(vm.Labels)-1].End
+	return nil
+}
+
+// 0x0B end for instances: Closes the innermost block, or returns when
+// it closes the function body. Without any open block it behaves the
+// same as END.
+func END_STRUCTURED(vm *VMState) error {
+	if len(vm.Labels) == 0 {
+		return END(vm)
+	}
+	label := vm.Labels[len(vm.Labels)-1]
+	vm.Labels = vm.Labels[:len(vm.Labels)-1]
+	if label.Func {
+		return vm.returnFromFrame("END")
+	}
+	vm.PC++
+	return nil
+}
+
+// Moves the top n values down to height, dropping everything between
+func (vm *VMState) keepTop(op string, height int, n int) error {
+	size := vm.ValueStack.Size()
+	if size-n < height {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	copy(vm.ValueStack.elements[height:], vm.ValueStack.elements[size-n:])
+	vm.ValueStack.elements = vm.ValueStack.elements[:height+n]
+	return nil
+}
+
+// Pops the current frame, leaving its results where its parameters were
+func (vm *VMState) returnFromFrame(op string) error {
+	if len(vm.CallStack) == 0 {
+		return END(vm)
+	}
+	frame := vm.CallStack[len(vm.CallStack)-1]
+	if err := vm.keepTop(op, frame.StackHeight, frame.Arity); err != nil {
+		return err
+	}
+	vm.Labels = vm.Labels[:frame.Labels]
+	vm.CallStack = vm.CallStack[:len(vm.CallStack)-1]
+	vm.PC = frame.ReturnPC
+	return nil
+}
+
+// Branches to the label depth levels out
+func (vm *VMState) branch(op string, depth uint64) error {
+	open := len(vm.Labels)
+	if len(vm.CallStack) > 0 {
+		open -= vm.CallStack[len(vm.CallStack)-1].Labels
+	}
+	if depth >= uint64(open) {
+		return badIndexTrap(vm, op, "label", depth)
+	}
+	idx := len(vm.Labels) - 1 - int(depth)
+	label := vm.Labels[idx]
+	if label.Func {
+		return vm.returnFromFrame(op)
+	}
+	if err := vm.keepTop(op, label.StackHeight, label.Arity); err != nil {
+		return err
+	}
+	// The label stays: a loop runs again, and a block is closed by
+	// its own end
+	vm.Labels = vm.Labels[:idx+1]
+	if label.Loop {
+		vm.PC = label.Start
+	} else {
+		vm.PC = label.End
+	}
+	return nil
+}
+
+// 0x0C br
+func BR(vm *VMState) error {
+	depth, _, err := vm.fetchULEB128("BR", vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	return vm.branch("BR", depth)
+}
+
+// 0x0D br_if: Pull an I32 condition and branch if it is non-zero
+func BR_IF(vm *VMState) error {
+	const op = "BR_IF"
+	depth, next, err := vm.fetchULEB128(op, vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	enough, collect := vm.ValueStack.HasAtLeastOfType(1, TYPE_I32)
+	if !enough {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	cond := collect[0].Value_I32
+	if !vm.ValueStack.Drop(1, true) {
+		return NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+	if cond == 0 {
+		vm.PC = next
+		return nil
+	}
+	return vm.branch(op, depth)
+}
+
+// 0x0E br_table: Pull an I32 index into the label list, using the
+// default label when it is out of range
+func BR_TABLE(vm *VMState) error {
+	const op = "BR_TABLE"
+	count, addr, err := vm.fetchULEB128(op, vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	enough, collect := vm.ValueStack.HasAtLeastOfType(1, TYPE_I32)
+	if !enough {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	index := min(uint64(collect[0].Value_I32), count)
+	var depth uint64
+	for i := uint64(0); i <= index; i++ {
+		if depth, addr, err = vm.fetchULEB128(op, addr, 32); err != nil {
+			return err
+		}
+	}
+	if !vm.ValueStack.Drop(1, true) {
+		return NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+	return vm.branch(op, depth)
+}
+
+// 0x0F return
+func RETURN(vm *VMState) error {
+	return vm.returnFromFrame("RETURN")
+}
+
+// 0x10 call
+func CALL(vm *VMState) error {
+	idx, next, err := vm.fetchULEB128("CALL", vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	if idx >= uint64(len(vm.instance.funcs)) {
+		return badIndexTrap(vm, "CALL", "function", idx)
+	}
+	return vm.instance.call(vm, "CALL", uint32(idx), next)
+}
+
+// 0x11 call_indirect: Pull an I32 index into the table and call the
+// function found there, which must have the expected type
+func CALL_INDIRECT(vm *VMState) error {
+	const op = "CALL_INDIRECT"
+	inst := vm.instance
+	typeIdx, addr, err := vm.fetchULEB128(op, vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	tableIdx, next, err := vm.fetchULEB128(op, addr, 32)
+	if err != nil {
+		return err
+	}
+	if typeIdx >= uint64(len(inst.Module.Types)) {
+		return badIndexTrap(vm, op, "type", typeIdx)
+	}
+	if tableIdx >= uint64(len(inst.Tables)) {
+		return badIndexTrap(vm, op, "table", tableIdx)
+	}
+	enough, collect := vm.ValueStack.HasAtLeastOfType(1, TYPE_I32)
+	if !enough {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	elem := collect[0].Value_I32
+	table := inst.Tables[tableIdx]
+	var ef *ExposedFunc
+	if uint64(elem) < uint64(len(table.Elements)) {
+		ef = table.Elements[elem]
+	}
+	if ef == nil {
+		return vm.SetTrapError(&TrapError{
+			Type:    TrapUndefinedElement,
+			Op:      op,
+			PC:      vm.PC,
+			Message: fmt.Sprintf("%s: no function at table %d element %d", op, tableIdx, elem),
+		})
+	}
+	want := inst.Module.Types[typeIdx]
+	if !ef.Type.Equal(want) {
+		return vm.SetTrapError(&TrapError{
+			Type:    TrapIndirectCallTypeMismatch,
+			Op:      op,
+			PC:      vm.PC,
+			Message: fmt.Sprintf("%s: expected %s, found %s", op, want, ef.Type),
+		})
+	}
+	if !vm.ValueStack.Drop(1, true) {
+		return NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+	// Functions of this instance are called directly rather than
+	// through a nested Call
+	if ef.owner == inst {
+		return inst.call(vm, op, ef.index, next)
+	}
+	if err := ef.Call(vm.ctx, vm); err != nil {
+		return err
+	}
+	vm.PC = next
+	return nil
+}
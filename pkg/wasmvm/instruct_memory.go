@@ -0,0 +1,133 @@
+package wasmvm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Loads and stores address the linear memory through vm.Memory. The
+// memarg immediate is the alignment hint followed by the offset; the
+// hint doesn't affect the result, so only the offset is used.
+func (vm *VMState) fetchMemArg(op string, addr uint64) (uint64, uint64, error) {
+	_, next, err := vm.fetchULEB128(op, addr, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return vm.fetchULEB128(op, next, 32)
+}
+
+// i32.load, i64.load8_s, f64.load, etc
+func memoryLoad(op string, valueType ValueStackEntryType, width int, signed bool) Instruction {
+	return func(vm *VMState) error {
+		offset, next, err := vm.fetchMemArg(op, vm.PC+1)
+		if err != nil {
+			return err
+		}
+		enough, collect := vm.ValueStack.HasAtLeastOfType(1, TYPE_I32)
+		if !enough {
+			return NewStackUnderflowErrorAndSetTrap(vm, op)
+		}
+		ea := uint64(collect[0].Value_I32) + offset
+		clear(vm.dataBuf[:])
+		if err := vm.ReadMemory(op, ea, vm.dataBuf[:width]); err != nil {
+			return err
+		}
+		val := binary.LittleEndian.Uint64(vm.dataBuf[:])
+		if shift := 64 - 8*width; signed && shift > 0 {
+			val = uint64(int64(val<<shift) >> shift)
+		}
+		collect[0] = entryFromBits(val, valueType)
+		vm.PC = next
+		return nil
+	}
+}
+
+// i32.store, i64.store32, f32.store, etc. Narrow stores keep the low
+// octets of the value.
+func memoryStore(op string, valueType ValueStackEntryType, width int) Instruction {
+	return func(vm *VMState) error {
+		offset, next, err := vm.fetchMemArg(op, vm.PC+1)
+		if err != nil {
+			return err
+		}
+		enough, collect := vm.ValueStack.HasTypes(TYPE_I32, valueType)
+		if !enough {
+			return NewStackUnderflowErrorAndSetTrap(vm, op)
+		}
+		ea := uint64(collect[0].Value_I32) + offset
+		binary.LittleEndian.PutUint64(vm.dataBuf[:], entryBits(&collect[1]))
+		if err := vm.WriteMemory(op, ea, vm.dataBuf[:width]); err != nil {
+			return err
+		}
+		if !vm.ValueStack.Drop(2, true) {
+			return NewStackCleanupErrorAndSetTrap(vm, op)
+		}
+		vm.PC = next
+		return nil
+	}
+}
+
+// Reads the memory index of memory.size and memory.grow, which has to be
+// 0 until multiple memories are supported
+func (vm *VMState) fetchMemIndex(op string) (uint64, error) {
+	idx, next, err := vm.fetchULEB128(op, vm.PC+1, 32)
+	if err != nil {
+		return 0, err
+	}
+	if idx != 0 {
+		return 0, vm.SetTrapError(&TrapError{
+			Type:    TrapMalformedImmediate,
+			Op:      op,
+			PC:      vm.PC,
+			Message: fmt.Sprintf("%s: memory index %d, only memory 0 exists", op, idx),
+		})
+	}
+	return next, nil
+}
+
+// 0x3F memory.size: pushes the size of the memory in pages
+func MEMORY_SIZE(vm *VMState) error {
+	next, err := vm.fetchMemIndex("MEMORY_SIZE")
+	if err != nil {
+		return err
+	}
+	vm.ValueStack.PushInt32(uint32(vm.Memory.Size() / WasmPageSize))
+	vm.PC = next
+	return nil
+}
+
+// The most octets the memory of vm may grow to, from the maximum of an
+// instance memory and VMConfig.MaxMemory
+func (vm *VMState) memoryLimit() uint64 {
+	limit := uint64(maxMemoryPages)
+	if vm.instance != nil && vm.instance.memory.Max != nil {
+		limit = min(limit, *vm.instance.memory.Max)
+	}
+	if vm.Config != nil && vm.Config.MaxMemory > 0 {
+		limit = min(limit, vm.Config.MaxMemory/WasmPageSize)
+	}
+	return limit * WasmPageSize
+}
+
+// 0x40 memory.grow: grows the memory by the popped number of pages,
+// pushing the old size, or -1 when the memory can't grow that far
+func MEMORY_GROW(vm *VMState) error {
+	next, err := vm.fetchMemIndex("MEMORY_GROW")
+	if err != nil {
+		return err
+	}
+	enough, collect := vm.ValueStack.HasAtLeastOfType(1, TYPE_I32)
+	if !enough {
+		return NewStackUnderflowErrorAndSetTrap(vm, "MEMORY_GROW")
+	}
+	old := vm.Memory.Size() / WasmPageSize
+	delta := uint64(collect[0].Value_I32)
+	limit := vm.memoryLimit() / WasmPageSize
+	collect[0].Value_I32 = uint32(old)
+	gm, ok := vm.Memory.(GrowableMemory)
+	if old+delta > limit || !ok || !gm.Grow(delta*WasmPageSize) {
+		collect[0].Value_I32 = 0xFFFFFFFF
+	}
+	vm.PC = next
+	return nil
+}
@@ -0,0 +1,144 @@
+package wasmvm_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var memoryTestExports = []string{"roundtrip", "grow", "size", "init", "drop", "copy", "fill", "load8u", "sat"}
+
+// One page of memory that may grow to two, a passive "hello" segment and
+// a function per instruction under test
+var memoryTestModule = func() []byte {
+	exports := make([][]byte, len(memoryTestExports))
+	for i, name := range memoryTestExports {
+		exports[i] = wasmCat(wasmName(name), []byte{0x00, byte(i)})
+	}
+	misc := byte(wasmvm.OP_PREFIX_MISC)
+	return wasmBinary(
+		wasmSection(wasmvm.SectionType, wasmVec(
+			wasmFuncType([]byte{wasmI32, wasmI64}, []byte{wasmI64}),
+			wasmFuncType([]byte{wasmI32}, []byte{wasmI32}),
+			wasmFuncType(nil, []byte{wasmI32}),
+			wasmFuncType([]byte{wasmI32, wasmI32, wasmI32}, nil),
+			wasmFuncType(nil, nil),
+			wasmFuncType([]byte{wasmF64}, []byte{wasmI32}),
+		)...),
+		wasmSection(wasmvm.SectionFunction, wasmVec(
+			[]byte{0x00}, []byte{0x01}, []byte{0x02}, []byte{0x03}, []byte{0x04}, []byte{0x03}, []byte{0x03}, []byte{0x01}, []byte{0x05},
+		)...),
+		wasmSection(wasmvm.SectionMemory, wasmVec([]byte{0x01, 0x01, 0x02})...),
+		wasmSection(wasmvm.SectionExport, wasmVec(exports...)...),
+		wasmSection(wasmvm.SectionDataCount, 0x01),
+		wasmSection(wasmvm.SectionCode, wasmVec(
+			// roundtrip: stores all of $1 and loads the low half back sign extended
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_STORE_I64, 3, 0,
+				wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOAD32S_I64, 2, 0, wasmvm.OP_END),
+			// grow
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_MEMORY_GROW, 0, wasmvm.OP_END),
+			// size
+			wasmBody(wasmvm.OP_MEMORY_SIZE, 0, wasmvm.OP_END),
+			// init
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_LOCAL_GET, 2,
+				misc, wasmvm.OP_MEMORY_INIT, 0, 0, wasmvm.OP_END),
+			// drop
+			wasmBody(misc, wasmvm.OP_DATA_DROP, 0, wasmvm.OP_END),
+			// copy
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_LOCAL_GET, 2,
+				misc, wasmvm.OP_MEMORY_COPY, 0, 0, wasmvm.OP_END),
+			// fill
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 1, wasmvm.OP_LOCAL_GET, 2,
+				misc, wasmvm.OP_MEMORY_FILL, 0, wasmvm.OP_END),
+			// load8u
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOAD8U_I32, 0, 0, wasmvm.OP_END),
+			// sat
+			wasmBody(wasmvm.OP_LOCAL_GET, 0, misc, wasmvm.OP_TRUNC_SATS_F64_I32, wasmvm.OP_END),
+		)...),
+		wasmSection(wasmvm.SectionData, wasmVec(wasmCat([]byte{0x01}, wasmName("hello")))...),
+	)
+}()
+
+func TestMemoryInstructions(t *testing.T) {
+	ctx := context.Background()
+	for _, model := range []wasmvm.MemoryModel{wasmvm.FlatMemoryModel, wasmvm.ShardedMemoryModel} {
+		t.Run(model.String(), func(t *testing.T) {
+			m, err := wasmvm.DecodeModule(memoryTestModule)
+			require.NoError(t, err)
+			inst, err := wasmvm.Instantiate(m, nil, new(wasmvm.VMConfig).SetMemoryModel(model))
+			require.NoError(t, err)
+			call := func(name string, args ...uint64) ([]uint64, error) {
+				return inst.ExportedFunction(name).Call(ctx, args...)
+			}
+			load := func(addr uint32) byte {
+				r, err := call("load8u", uint64(addr))
+				require.NoError(t, err)
+				return byte(r[0])
+			}
+			trapType := func(err error) wasmvm.TrapType {
+				var te *wasmvm.TrapError
+				require.ErrorAs(t, err, &te)
+				return te.Type
+			}
+
+			r, err := call("roundtrip", 8, 0x1_8000_0000)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(0xFFFFFFFF80000000), r[0])
+			_, err = call("roundtrip", wasmvm.WasmPageSize-4, 0)
+			assert.Equal(t, wasmvm.TrapMemoryAccess, trapType(err))
+
+			// memory.init copies out of the passive segment
+			_, err = call("init", 100, 1, 3)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("ell"), []byte{load(100), load(101), load(102)})
+			_, err = call("init", 100, 3, 3)
+			assert.Equal(t, wasmvm.TrapMemoryAccess, trapType(err))
+
+			// Overlapping copy, forward
+			_, err = call("init", 10, 0, 5)
+			require.NoError(t, err)
+			_, err = call("copy", 11, 10, 4)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("hhell"), []byte{load(10), load(11), load(12), load(13), load(14)})
+			_, err = call("copy", wasmvm.WasmPageSize-1, 0, 2)
+			assert.Equal(t, wasmvm.TrapMemoryAccess, trapType(err))
+
+			_, err = call("fill", 200, 0x1AB, 3)
+			require.NoError(t, err)
+			assert.Equal(t, []byte{0xAB, 0xAB, 0xAB, 0}, []byte{load(200), load(201), load(202), load(203)})
+
+			// A dropped segment is empty
+			_, err = call("drop")
+			require.NoError(t, err)
+			_, err = call("init", 0, 0, 0)
+			require.NoError(t, err)
+			_, err = call("init", 0, 0, 1)
+			assert.Equal(t, wasmvm.TrapMemoryAccess, trapType(err))
+
+			// Grows up to the maximum of 2 pages
+			r, err = call("grow", 1)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(1), r[0])
+			r, err = call("size")
+			require.NoError(t, err)
+			assert.Equal(t, uint64(2), r[0])
+			assert.Equal(t, byte('h'), load(10))
+			r, err = call("grow", 1)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(0xFFFFFFFF), r[0])
+			_, err = call("roundtrip", wasmvm.WasmPageSize, 7)
+			assert.NoError(t, err)
+
+			r, err = call("sat", wasmvm.EncodeValue(1e10))
+			require.NoError(t, err)
+			assert.Equal(t, uint64(math.MaxInt32), r[0])
+			r, err = call("sat", wasmvm.EncodeValue(math.NaN()))
+			require.NoError(t, err)
+			assert.Equal(t, uint64(0), r[0])
+		})
+	}
+}
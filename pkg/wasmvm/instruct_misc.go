@@ -0,0 +1,327 @@
+package wasmvm
+
+import "fmt"
+
+// The 0xFC prefix holds the saturating truncations and the bulk memory
+// and table instructions. table.grow and table.fill are not here since
+// they take a reference off the stack, which the value stack can't hold;
+// Instantiate refuses bodies that use them.
+
+var miscInstructionMap = buildMiscInstructionMap()
+
+func buildMiscInstructionMap() map[uint32]prefixedInstruction {
+	return map[uint32]prefixedInstruction{
+		OP_TRUNC_SATS_F32_I32: prefixedNumeric(truncI32("TRUNC_SATS_F32_I32", TYPE_F32, true, true)),
+		OP_TRUNC_SATU_F32_I32: prefixedNumeric(truncI32("TRUNC_SATU_F32_I32", TYPE_F32, false, true)),
+		OP_TRUNC_SATS_F64_I32: prefixedNumeric(truncI32("TRUNC_SATS_F64_I32", TYPE_F64, true, true)),
+		OP_TRUNC_SATU_F64_I32: prefixedNumeric(truncI32("TRUNC_SATU_F64_I32", TYPE_F64, false, true)),
+		OP_TRUNC_SATS_F32_I64: prefixedNumeric(truncI64("TRUNC_SATS_F32_I64", TYPE_F32, true, true)),
+		OP_TRUNC_SATU_F32_I64: prefixedNumeric(truncI64("TRUNC_SATU_F32_I64", TYPE_F32, false, true)),
+		OP_TRUNC_SATS_F64_I64: prefixedNumeric(truncI64("TRUNC_SATS_F64_I64", TYPE_F64, true, true)),
+		OP_TRUNC_SATU_F64_I64: prefixedNumeric(truncI64("TRUNC_SATU_F64_I64", TYPE_F64, false, true)),
+
+		OP_MEMORY_INIT: MEMORY_INIT,
+		OP_DATA_DROP:   DATA_DROP,
+		OP_MEMORY_COPY: MEMORY_COPY,
+		OP_MEMORY_FILL: MEMORY_FILL,
+		OP_TABLE_INIT:  TABLE_INIT,
+		OP_ELEM_DROP:   ELEM_DROP,
+		OP_TABLE_COPY:  TABLE_COPY,
+		OP_TABLE_SIZE:  TABLE_SIZE,
+	}
+}
+
+// The numeric factories step over a single opcode, so move on past the
+// sub-opcode once they're done
+func prefixedNumeric(ins Instruction) prefixedInstruction {
+	return func(vm *VMState, immAddr uint64) error {
+		if err := ins(vm); err != nil {
+			return err
+		}
+		vm.PC = immAddr
+		return nil
+	}
+}
+
+// 0xFC: Reads the sub-opcode and dispatches to the misc instruction
+func MISC_PREFIX(vm *VMState) error {
+	sub, next, err := vm.fetchULEB128("MISC_PREFIX", vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	handler, ok := miscInstructionMap[uint32(sub)]
+	if !ok {
+		opcode := uint8(OP_PREFIX_MISC)
+		return vm.SetTrapError(&TrapError{
+			Type:        TrapUnknownInstruction,
+			Op:          "MISC_PREFIX",
+			PC:          vm.PC,
+			Message:     fmt.Sprintf("Unknown instruction: 0x%02X 0x%02X", opcode, sub),
+			Instruction: &opcode,
+			Meta: map[string]uint64{
+				"sub_opcode": sub,
+			},
+		})
+	}
+	return handler(vm, next)
+}
+
+// Reads an index immediate that has to be below count
+func (vm *VMState) fetchIndex(op string, what string, addr uint64, count int) (uint64, uint64, error) {
+	idx, next, err := vm.fetchULEB128(op, addr, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	if idx >= uint64(count) {
+		return 0, 0, badIndexTrap(vm, op, what, idx)
+	}
+	return idx, next, nil
+}
+
+// The three I32 operands of the bulk instructions: destination, source
+// (or fill value) and length. They are dropped before returning.
+func (vm *VMState) bulkOperands(op string) (uint64, uint64, uint64, error) {
+	enough, collect := vm.ValueStack.HasAtLeastOfType(3, TYPE_I32)
+	if !enough {
+		return 0, 0, 0, NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	d, s, n := uint64(collect[0].Value_I32), uint64(collect[1].Value_I32), uint64(collect[2].Value_I32)
+	if !vm.ValueStack.Drop(3, true) {
+		return 0, 0, 0, NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+	return d, s, n, nil
+}
+
+func segmentTrap(vm *VMState, op string, what string, idx uint64) error {
+	return vm.SetTrapError(&TrapError{
+		Type:    TrapMemoryAccess,
+		Op:      op,
+		PC:      vm.PC,
+		Message: fmt.Sprintf("%s: %s segment %d out of bounds", op, what, idx),
+	})
+}
+
+func tableTrap(vm *VMState, op string, idx uint64) error {
+	return vm.SetTrapError(&TrapError{
+		Type:    TrapUndefinedElement,
+		Op:      op,
+		PC:      vm.PC,
+		Message: fmt.Sprintf("%s: table %d access out of bounds", op, idx),
+	})
+}
+
+// 0xFC 8 memory.init: copies part of a passive data segment into memory
+func MEMORY_INIT(vm *VMState, immAddr uint64) error {
+	const op = "MEMORY_INIT"
+	inst := vm.instance
+	seg, addr, err := vm.fetchIndex(op, "data segment", immAddr, len(inst.Module.Data))
+	if err != nil {
+		return err
+	}
+	_, next, err := vm.fetchIndex(op, "memory", addr, 1)
+	if err != nil {
+		return err
+	}
+	d, s, n, err := vm.bulkOperands(op)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if !inst.droppedData[seg] {
+		data = inst.Module.Data[seg].Init
+	}
+	if !inBounds(uint64(len(data)), s, int(n)) {
+		return segmentTrap(vm, op, "data", seg)
+	}
+	if err := vm.WriteMemory(op, d, data[s:s+n]); err != nil {
+		return err
+	}
+	vm.PC = next
+	return nil
+}
+
+// 0xFC 9 data.drop: frees a passive data segment; memory.init sees it as empty afterwards
+func DATA_DROP(vm *VMState, immAddr uint64) error {
+	seg, next, err := vm.fetchIndex("DATA_DROP", "data segment", immAddr, len(vm.instance.Module.Data))
+	if err != nil {
+		return err
+	}
+	vm.instance.droppedData[seg] = true
+	vm.PC = next
+	return nil
+}
+
+// 0xFC 10 memory.copy: copies within the memory, the ranges may overlap
+func MEMORY_COPY(vm *VMState, immAddr uint64) error {
+	const op = "MEMORY_COPY"
+	_, addr, err := vm.fetchIndex(op, "memory", immAddr, 1)
+	if err != nil {
+		return err
+	}
+	_, next, err := vm.fetchIndex(op, "memory", addr, 1)
+	if err != nil {
+		return err
+	}
+	d, s, n, err := vm.bulkOperands(op)
+	if err != nil {
+		return err
+	}
+	size := vm.Memory.Size()
+	if !inBounds(size, s, int(n)) {
+		return vm.memoryAccessTrap(op, TrapAccessRead, s, int(n), MemoryAccessOutOfBounds)
+	}
+	if !inBounds(size, d, int(n)) {
+		return vm.memoryAccessTrap(op, TrapAccessWrite, d, int(n), MemoryAccessOutOfBounds)
+	}
+	if fm, ok := vm.Memory.(*FlatMemory); ok {
+		// Straight copy within the slice, after the permission checks
+		// Read and Write would make
+		if !fm.perms.check(s, int(n), MemoryPermRead) {
+			return vm.memoryAccessTrap(op, TrapAccessRead, s, int(n), MemoryAccessDenied)
+		}
+		if !fm.perms.check(d, int(n), MemoryPermWrite) {
+			return vm.memoryAccessTrap(op, TrapAccessWrite, d, int(n), MemoryAccessDenied)
+		}
+		copy(fm.data[d:d+n], fm.data[s:s+n])
+	} else {
+		buf := make([]byte, n)
+		if err := vm.ReadMemory(op, s, buf); err != nil {
+			return err
+		}
+		if err := vm.WriteMemory(op, d, buf); err != nil {
+			return err
+		}
+	}
+	vm.PC = next
+	return nil
+}
+
+// 0xFC 11 memory.fill: sets a range of the memory to one octet
+func MEMORY_FILL(vm *VMState, immAddr uint64) error {
+	const op = "MEMORY_FILL"
+	_, next, err := vm.fetchIndex(op, "memory", immAddr, 1)
+	if err != nil {
+		return err
+	}
+	d, val, n, err := vm.bulkOperands(op)
+	if err != nil {
+		return err
+	}
+	if !inBounds(vm.Memory.Size(), d, int(n)) {
+		return vm.memoryAccessTrap(op, TrapAccessWrite, d, int(n), MemoryAccessOutOfBounds)
+	}
+	if fm, ok := vm.Memory.(*FlatMemory); ok {
+		if !fm.perms.check(d, int(n), MemoryPermWrite) {
+			return vm.memoryAccessTrap(op, TrapAccessWrite, d, int(n), MemoryAccessDenied)
+		}
+		fill(fm.data[d:d+n], byte(val))
+	} else {
+		buf := make([]byte, n)
+		fill(buf, byte(val))
+		if err := vm.WriteMemory(op, d, buf); err != nil {
+			return err
+		}
+	}
+	vm.PC = next
+	return nil
+}
+
+func fill(buf []byte, b byte) {
+	if len(buf) == 0 {
+		return
+	}
+	buf[0] = b
+	for filled := 1; filled < len(buf); filled *= 2 {
+		copy(buf[filled:], buf[:filled])
+	}
+}
+
+// 0xFC 12 table.init: copies part of a passive element segment into a table
+func TABLE_INIT(vm *VMState, immAddr uint64) error {
+	const op = "TABLE_INIT"
+	inst := vm.instance
+	seg, addr, err := vm.fetchIndex(op, "element segment", immAddr, len(inst.Module.Elements))
+	if err != nil {
+		return err
+	}
+	tableIdx, next, err := vm.fetchIndex(op, "table", addr, len(inst.Tables))
+	if err != nil {
+		return err
+	}
+	d, s, n, err := vm.bulkOperands(op)
+	if err != nil {
+		return err
+	}
+	var refs []*ExposedFunc
+	if !inst.droppedElems[seg] {
+		if refs, err = inst.elementRefs(int(seg)); err != nil {
+			return vm.SetTrapError(&TrapError{
+				Type:    TrapInternalError,
+				Op:      op,
+				PC:      vm.PC,
+				Message: fmt.Sprintf("%s: %v", op, err),
+				Cause:   err,
+			})
+		}
+	}
+	table := inst.Tables[tableIdx]
+	if !inBounds(uint64(len(refs)), s, int(n)) {
+		return segmentTrap(vm, op, "element", seg)
+	}
+	if !inBounds(uint64(len(table.Elements)), d, int(n)) {
+		return tableTrap(vm, op, tableIdx)
+	}
+	copy(table.Elements[d:], refs[s:s+n])
+	vm.PC = next
+	return nil
+}
+
+// 0xFC 13 elem.drop: frees a passive element segment
+func ELEM_DROP(vm *VMState, immAddr uint64) error {
+	seg, next, err := vm.fetchIndex("ELEM_DROP", "element segment", immAddr, len(vm.instance.Module.Elements))
+	if err != nil {
+		return err
+	}
+	vm.instance.droppedElems[seg] = true
+	vm.PC = next
+	return nil
+}
+
+// 0xFC 14 table.copy: copies between two tables, or within one
+func TABLE_COPY(vm *VMState, immAddr uint64) error {
+	const op = "TABLE_COPY"
+	inst := vm.instance
+	dstIdx, addr, err := vm.fetchIndex(op, "table", immAddr, len(inst.Tables))
+	if err != nil {
+		return err
+	}
+	srcIdx, next, err := vm.fetchIndex(op, "table", addr, len(inst.Tables))
+	if err != nil {
+		return err
+	}
+	d, s, n, err := vm.bulkOperands(op)
+	if err != nil {
+		return err
+	}
+	dst, src := inst.Tables[dstIdx], inst.Tables[srcIdx]
+	if !inBounds(uint64(len(src.Elements)), s, int(n)) {
+		return tableTrap(vm, op, srcIdx)
+	}
+	if !inBounds(uint64(len(dst.Elements)), d, int(n)) {
+		return tableTrap(vm, op, dstIdx)
+	}
+	copy(dst.Elements[d:d+n], src.Elements[s:s+n])
+	vm.PC = next
+	return nil
+}
+
+// 0xFC 16 table.size: pushes the number of elements of a table
+func TABLE_SIZE(vm *VMState, immAddr uint64) error {
+	idx, next, err := vm.fetchIndex("TABLE_SIZE", "table", immAddr, len(vm.instance.Tables))
+	if err != nil {
+		return err
+	}
+	vm.ValueStack.PushInt32(uint32(len(vm.instance.Tables[idx].Elements)))
+	vm.PC = next
+	return nil
+}
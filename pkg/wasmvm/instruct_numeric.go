@@ -0,0 +1,529 @@
+package wasmvm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Most of the numeric instructions only differ by the operation they
+// apply, so they are built from the factories below instead of being
+// written out one by one like the original i32/i64 arithmetic. The
+// result replaces the bottom operand in place, so nothing allocates.
+
+// Applies f to the top value, which must be of type from. f returns
+// UndefinedTrap when it succeeds.
+func unaryOp(op string, from ValueStackEntryType, f func(v *ValueStackEntry) (ValueStackEntry, TrapType)) Instruction {
+	return func(vm *VMState) error {
+		enough, collect := vm.ValueStack.HasAtLeastOfType(1, from)
+		if !enough {
+			return NewStackUnderflowErrorAndSetTrap(vm, op)
+		}
+		res, trap := f(&collect[0])
+		if trap != UndefinedTrap {
+			return numericTrap(vm, op, trap)
+		}
+		collect[0] = res
+		vm.PC += 1
+		return nil
+	}
+}
+
+// Applies f to the top two values, both of type vt, a being the deeper one
+func binaryOp(op string, vt ValueStackEntryType, f func(a, b *ValueStackEntry) (ValueStackEntry, TrapType)) Instruction {
+	return func(vm *VMState) error {
+		enough, collect := vm.ValueStack.HasAtLeastOfType(2, vt)
+		if !enough {
+			return NewStackUnderflowErrorAndSetTrap(vm, op)
+		}
+		res, trap := f(&collect[0], &collect[1])
+		if trap != UndefinedTrap {
+			return numericTrap(vm, op, trap)
+		}
+		collect[0] = res
+		if !vm.ValueStack.Drop(1, true) {
+			return NewStackCleanupErrorAndSetTrap(vm, op)
+		}
+		vm.PC += 1
+		return nil
+	}
+}
+
+var numericTrapMessages = map[TrapType]string{
+	TrapDivideByZero:           "Divide by Zero",
+	TrapSignedDivisionOverflow: "Signed Division Overflow",
+	TrapIntegerOverflow:        "Integer Overflow",
+	TrapInvalidConversion:      "Invalid Conversion to Integer",
+}
+
+func numericTrap(vm *VMState, op string, trap TrapType) error {
+	return vm.SetTrapError(&TrapError{
+		Type:    trap,
+		Op:      op,
+		PC:      vm.PC,
+		Message: fmt.Sprintf("%s: %s", op, numericTrapMessages[trap]),
+	})
+}
+
+func i32Entry(v uint32) ValueStackEntry {
+	return ValueStackEntry{EntryType: TYPE_I32, Value_I32: v}
+}
+
+func i64Entry(v uint64) ValueStackEntry {
+	return ValueStackEntry{EntryType: TYPE_I64, Value_I64: v}
+}
+
+func f32Entry(v float32) ValueStackEntry {
+	return ValueStackEntry{EntryType: TYPE_F32, Value_F32: v}
+}
+
+func f64Entry(v float64) ValueStackEntry {
+	return ValueStackEntry{EntryType: TYPE_F64, Value_F64: v}
+}
+
+func boolEntry(b bool) ValueStackEntry {
+	if b {
+		return i32Entry(1)
+	}
+	return i32Entry(0)
+}
+
+func unaryI32(op string, f func(uint32) uint32) Instruction {
+	return unaryOp(op, TYPE_I32, func(v *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return i32Entry(f(v.Value_I32)), UndefinedTrap
+	})
+}
+
+func binaryI32(op string, f func(a, b uint32) uint32) Instruction {
+	return binaryOp(op, TYPE_I32, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return i32Entry(f(a.Value_I32, b.Value_I32)), UndefinedTrap
+	})
+}
+
+func compareI32(op string, f func(a, b uint32) bool) Instruction {
+	return binaryOp(op, TYPE_I32, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return boolEntry(f(a.Value_I32, b.Value_I32)), UndefinedTrap
+	})
+}
+
+func unaryI64(op string, f func(uint64) uint64) Instruction {
+	return unaryOp(op, TYPE_I64, func(v *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return i64Entry(f(v.Value_I64)), UndefinedTrap
+	})
+}
+
+func binaryI64(op string, f func(a, b uint64) uint64) Instruction {
+	return binaryOp(op, TYPE_I64, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return i64Entry(f(a.Value_I64, b.Value_I64)), UndefinedTrap
+	})
+}
+
+func compareI64(op string, f func(a, b uint64) bool) Instruction {
+	return binaryOp(op, TYPE_I64, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return boolEntry(f(a.Value_I64, b.Value_I64)), UndefinedTrap
+	})
+}
+
+func unaryF32(op string, f func(float32) float32) Instruction {
+	return unaryOp(op, TYPE_F32, func(v *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return f32Entry(f(v.Value_F32)), UndefinedTrap
+	})
+}
+
+func binaryF32(op string, f func(a, b float32) float32) Instruction {
+	return binaryOp(op, TYPE_F32, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return f32Entry(f(a.Value_F32, b.Value_F32)), UndefinedTrap
+	})
+}
+
+func compareF32(op string, f func(a, b float32) bool) Instruction {
+	return binaryOp(op, TYPE_F32, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return boolEntry(f(a.Value_F32, b.Value_F32)), UndefinedTrap
+	})
+}
+
+func unaryF64(op string, f func(float64) float64) Instruction {
+	return unaryOp(op, TYPE_F64, func(v *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return f64Entry(f(v.Value_F64)), UndefinedTrap
+	})
+}
+
+func binaryF64(op string, f func(a, b float64) float64) Instruction {
+	return binaryOp(op, TYPE_F64, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return f64Entry(f(a.Value_F64, b.Value_F64)), UndefinedTrap
+	})
+}
+
+func compareF64(op string, f func(a, b float64) bool) Instruction {
+	return binaryOp(op, TYPE_F64, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return boolEntry(f(a.Value_F64, b.Value_F64)), UndefinedTrap
+	})
+}
+
+// Converts the top value from one type to another
+func convertOp(op string, from ValueStackEntryType, f func(v *ValueStackEntry) ValueStackEntry) Instruction {
+	return unaryOp(op, from, func(v *ValueStackEntry) (ValueStackEntry, TrapType) {
+		return f(v), UndefinedTrap
+	})
+}
+
+// Float to integer truncation. The result has to fit strictly between
+// lo and hi, which are exact in a float64; the saturating version clamps
+// instead of trapping.
+func truncOp(op string, from ValueStackEntryType, lo, hi float64, saturate bool, result func(f float64) ValueStackEntry, minimum, maximum ValueStackEntry) Instruction {
+	return unaryOp(op, from, func(v *ValueStackEntry) (ValueStackEntry, TrapType) {
+		f := v.Value_F64
+		if from == TYPE_F32 {
+			f = float64(v.Value_F32)
+		}
+		switch {
+		case math.IsNaN(f) && saturate:
+			return result(0), UndefinedTrap
+		case math.IsNaN(f):
+			return ValueStackEntry{}, TrapInvalidConversion
+		case f <= lo && saturate:
+			return minimum, UndefinedTrap
+		case f >= hi && saturate:
+			return maximum, UndefinedTrap
+		case f <= lo || f >= hi:
+			return ValueStackEntry{}, TrapIntegerOverflow
+		}
+		return result(math.Trunc(f)), UndefinedTrap
+	})
+}
+
+// Bounds of the truncations, exclusive
+const (
+	truncMinS32 = -2147483649.0
+	truncMaxS32 = 2147483648.0
+	truncMaxU32 = 4294967296.0
+	truncMinS64 = -9223372036854777856.0 // Next float64 below -2^63
+	truncMaxS64 = 9223372036854775808.0
+	truncMaxU64 = 18446744073709551616.0
+)
+
+func truncI32(op string, from ValueStackEntryType, signed, saturate bool) Instruction {
+	if signed {
+		return truncOp(op, from, truncMinS32, truncMaxS32, saturate,
+			func(f float64) ValueStackEntry { return i32Entry(uint32(int32(f))) },
+			i32Entry(1<<31), i32Entry(math.MaxInt32))
+	}
+	return truncOp(op, from, -1, truncMaxU32, saturate,
+		func(f float64) ValueStackEntry { return i32Entry(uint32(f)) },
+		i32Entry(0), i32Entry(math.MaxUint32))
+}
+
+func truncI64(op string, from ValueStackEntryType, signed, saturate bool) Instruction {
+	if signed {
+		return truncOp(op, from, truncMinS64, truncMaxS64, saturate,
+			func(f float64) ValueStackEntry { return i64Entry(uint64(int64(f))) },
+			i64Entry(1<<63), i64Entry(math.MaxInt64))
+	}
+	return truncOp(op, from, -1, truncMaxU64, saturate,
+		func(f float64) ValueStackEntry { return i64Entry(uint64(f)) },
+		i64Entry(0), i64Entry(math.MaxUint64))
+}
+
+// Integer division and remainder, trapping on zero. Signed division
+// also traps on MinInt / -1 since the quotient doesn't fit; the
+// remainder of that is just 0.
+func divI32(op string, signed, rem bool) Instruction {
+	return binaryOp(op, TYPE_I32, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		x, y := a.Value_I32, b.Value_I32
+		switch {
+		case y == 0:
+			return ValueStackEntry{}, TrapDivideByZero
+		case !signed && rem:
+			return i32Entry(x % y), UndefinedTrap
+		case !signed:
+			return i32Entry(x / y), UndefinedTrap
+		case int32(y) == -1 && rem:
+			return i32Entry(0), UndefinedTrap
+		case int32(y) == -1 && int32(x) == math.MinInt32:
+			return ValueStackEntry{}, TrapSignedDivisionOverflow
+		case rem:
+			return i32Entry(uint32(int32(x) % int32(y))), UndefinedTrap
+		}
+		return i32Entry(uint32(int32(x) / int32(y))), UndefinedTrap
+	})
+}
+
+func divI64(op string, signed, rem bool) Instruction {
+	return binaryOp(op, TYPE_I64, func(a, b *ValueStackEntry) (ValueStackEntry, TrapType) {
+		x, y := a.Value_I64, b.Value_I64
+		switch {
+		case y == 0:
+			return ValueStackEntry{}, TrapDivideByZero
+		case !signed && rem:
+			return i64Entry(x % y), UndefinedTrap
+		case !signed:
+			return i64Entry(x / y), UndefinedTrap
+		case int64(y) == -1 && rem:
+			return i64Entry(0), UndefinedTrap
+		case int64(y) == -1 && int64(x) == math.MinInt64:
+			return ValueStackEntry{}, TrapSignedDivisionOverflow
+		case rem:
+			return i64Entry(uint64(int64(x) % int64(y))), UndefinedTrap
+		}
+		return i64Entry(uint64(int64(x) / int64(y))), UndefinedTrap
+	})
+}
+
+// abs, neg and copysign only touch the sign bit, so NaN payloads are kept
+const (
+	signBit32 = 1 << 31
+	signBit64 = 1 << 63
+)
+
+func f32Bits(f func(uint32) uint32) func(float32) float32 {
+	return func(v float32) float32 { return math.Float32frombits(f(math.Float32bits(v))) }
+}
+
+func f64Bits(f func(uint64) uint64) func(float64) float64 {
+	return func(v float64) float64 { return math.Float64frombits(f(math.Float64bits(v))) }
+}
+
+// Rounds a float32 through its float64 counterpart, which is exact for
+// these operations
+func viaF64(f func(float64) float64) func(float32) float32 {
+	return func(v float32) float32 { return float32(f(float64(v))) }
+}
+
+// 0x43 const.f32: reads 4 octets little endian and pushes the float
+func CONST_F32(vm *VMState) error {
+	const width = 1 + WidthI32
+	imm, res := vm.fetch(vm.PC+1, WidthI32)
+	if res != MemoryAccessOK {
+		return vm.memoryAccessTrap("CONST_F32", TrapAccessExecute, vm.PC+1, width, res)
+	}
+	vm.ValueStack.pushEntry(f32Entry(math.Float32frombits(binary.LittleEndian.Uint32(imm))))
+	vm.PC += width
+	return nil
+}
+
+// 0x44 const.f64: reads 8 octets little endian and pushes the float
+func CONST_F64(vm *VMState) error {
+	const width = 1 + WidthI64
+	imm, res := vm.fetch(vm.PC+1, WidthI64)
+	if res != MemoryAccessOK {
+		return vm.memoryAccessTrap("CONST_F64", TrapAccessExecute, vm.PC+1, width, res)
+	}
+	vm.ValueStack.pushEntry(f64Entry(math.Float64frombits(binary.LittleEndian.Uint64(imm))))
+	vm.PC += width
+	return nil
+}
+
+var numericInstructionMap = buildNumericInstructionMap()
+
+func buildNumericInstructionMap() map[uint8]Instruction {
+	m := map[uint8]Instruction{
+		OP_CONST_F32: CONST_F32,
+		OP_CONST_F64: CONST_F64,
+
+		OP_EQZ_I32: unaryOp("EQZ_I32", TYPE_I32, func(v *ValueStackEntry) (ValueStackEntry, TrapType) {
+			return boolEntry(v.Value_I32 == 0), UndefinedTrap
+		}),
+		OP_EQ_I32:  compareI32("EQ_I32", func(a, b uint32) bool { return a == b }),
+		OP_NE_I32:  compareI32("NE_I32", func(a, b uint32) bool { return a != b }),
+		OP_LTS_I32: compareI32("LTS_I32", func(a, b uint32) bool { return int32(a) < int32(b) }),
+		OP_LTU_I32: compareI32("LTU_I32", func(a, b uint32) bool { return a < b }),
+		OP_GTS_I32: compareI32("GTS_I32", func(a, b uint32) bool { return int32(a) > int32(b) }),
+		OP_GTU_I32: compareI32("GTU_I32", func(a, b uint32) bool { return a > b }),
+		OP_LES_I32: compareI32("LES_I32", func(a, b uint32) bool { return int32(a) <= int32(b) }),
+		OP_LEU_I32: compareI32("LEU_I32", func(a, b uint32) bool { return a <= b }),
+		OP_GES_I32: compareI32("GES_I32", func(a, b uint32) bool { return int32(a) >= int32(b) }),
+		OP_GEU_I32: compareI32("GEU_I32", func(a, b uint32) bool { return a >= b }),
+
+		OP_EQZ_I64: unaryOp("EQZ_I64", TYPE_I64, func(v *ValueStackEntry) (ValueStackEntry, TrapType) {
+			return boolEntry(v.Value_I64 == 0), UndefinedTrap
+		}),
+		OP_EQ_I64:  compareI64("EQ_I64", func(a, b uint64) bool { return a == b }),
+		OP_NE_I64:  compareI64("NE_I64", func(a, b uint64) bool { return a != b }),
+		OP_LTS_I64: compareI64("LTS_I64", func(a, b uint64) bool { return int64(a) < int64(b) }),
+		OP_LTU_I64: compareI64("LTU_I64", func(a, b uint64) bool { return a < b }),
+		OP_GTS_I64: compareI64("GTS_I64", func(a, b uint64) bool { return int64(a) > int64(b) }),
+		OP_GTU_I64: compareI64("GTU_I64", func(a, b uint64) bool { return a > b }),
+		OP_LES_I64: compareI64("LES_I64", func(a, b uint64) bool { return int64(a) <= int64(b) }),
+		OP_LEU_I64: compareI64("LEU_I64", func(a, b uint64) bool { return a <= b }),
+		OP_GES_I64: compareI64("GES_I64", func(a, b uint64) bool { return int64(a) >= int64(b) }),
+		OP_GEU_I64: compareI64("GEU_I64", func(a, b uint64) bool { return a >= b }),
+
+		OP_EQ_F32: compareF32("EQ_F32", func(a, b float32) bool { return a == b }),
+		OP_NE_F32: compareF32("NE_F32", func(a, b float32) bool { return a != b }),
+		OP_LT_F32: compareF32("LT_F32", func(a, b float32) bool { return a < b }),
+		OP_GT_F32: compareF32("GT_F32", func(a, b float32) bool { return a > b }),
+		OP_LE_F32: compareF32("LE_F32", func(a, b float32) bool { return a <= b }),
+		OP_GE_F32: compareF32("GE_F32", func(a, b float32) bool { return a >= b }),
+		OP_EQ_F64: compareF64("EQ_F64", func(a, b float64) bool { return a == b }),
+		OP_NE_F64: compareF64("NE_F64", func(a, b float64) bool { return a != b }),
+		OP_LT_F64: compareF64("LT_F64", func(a, b float64) bool { return a < b }),
+		OP_GT_F64: compareF64("GT_F64", func(a, b float64) bool { return a > b }),
+		OP_LE_F64: compareF64("LE_F64", func(a, b float64) bool { return a <= b }),
+		OP_GE_F64: compareF64("GE_F64", func(a, b float64) bool { return a >= b }),
+
+		OP_CLZ_I32:    unaryI32("CLZ_I32", func(v uint32) uint32 { return uint32(bits.LeadingZeros32(v)) }),
+		OP_CTZ_I32:    unaryI32("CTZ_I32", func(v uint32) uint32 { return uint32(bits.TrailingZeros32(v)) }),
+		OP_POPCNT_I32: unaryI32("POPCNT_I32", func(v uint32) uint32 { return uint32(bits.OnesCount32(v)) }),
+		OP_REMS_I32:   divI32("REMS_I32", true, true),
+		OP_AND_I32:    binaryI32("AND_I32", func(a, b uint32) uint32 { return a & b }),
+		OP_OR_I32:     binaryI32("OR_I32", func(a, b uint32) uint32 { return a | b }),
+		OP_XOR_I32:    binaryI32("XOR_I32", func(a, b uint32) uint32 { return a ^ b }),
+		OP_SHL_I32:    binaryI32("SHL_I32", func(a, b uint32) uint32 { return a << (b & 31) }),
+		OP_SHRS_I32:   binaryI32("SHRS_I32", func(a, b uint32) uint32 { return uint32(int32(a) >> (b & 31)) }),
+		OP_SHRU_I32:   binaryI32("SHRU_I32", func(a, b uint32) uint32 { return a >> (b & 31) }),
+		OP_ROTL_I32:   binaryI32("ROTL_I32", func(a, b uint32) uint32 { return bits.RotateLeft32(a, int(b&31)) }),
+		OP_ROTR_I32:   binaryI32("ROTR_I32", func(a, b uint32) uint32 { return bits.RotateLeft32(a, -int(b&31)) }),
+
+		OP_CLZ_I64:    unaryI64("CLZ_I64", func(v uint64) uint64 { return uint64(bits.LeadingZeros64(v)) }),
+		OP_CTZ_I64:    unaryI64("CTZ_I64", func(v uint64) uint64 { return uint64(bits.TrailingZeros64(v)) }),
+		OP_POPCNT_I64: unaryI64("POPCNT_I64", func(v uint64) uint64 { return uint64(bits.OnesCount64(v)) }),
+		OP_REMS_I64:   divI64("REMS_I64", true, true),
+		OP_REMU_I64:   divI64("REMU_I64", false, true),
+		OP_AND_I64:    binaryI64("AND_I64", func(a, b uint64) uint64 { return a & b }),
+		OP_OR_I64:     binaryI64("OR_I64", func(a, b uint64) uint64 { return a | b }),
+		OP_XOR_I64:    binaryI64("XOR_I64", func(a, b uint64) uint64 { return a ^ b }),
+		OP_SHL_I64:    binaryI64("SHL_I64", func(a, b uint64) uint64 { return a << (b & 63) }),
+		OP_SHRS_I64:   binaryI64("SHRS_I64", func(a, b uint64) uint64 { return uint64(int64(a) >> (b & 63)) }),
+		OP_SHRU_I64:   binaryI64("SHRU_I64", func(a, b uint64) uint64 { return a >> (b & 63) }),
+		OP_ROTL_I64:   binaryI64("ROTL_I64", func(a, b uint64) uint64 { return bits.RotateLeft64(a, int(b&63)) }),
+		OP_ROTR_I64:   binaryI64("ROTR_I64", func(a, b uint64) uint64 { return bits.RotateLeft64(a, -int(b&63)) }),
+
+		OP_ABS_F32:     unaryF32("ABS_F32", f32Bits(func(v uint32) uint32 { return v &^ signBit32 })),
+		OP_NEG_F32:     unaryF32("NEG_F32", f32Bits(func(v uint32) uint32 { return v ^ signBit32 })),
+		OP_CEIL_F32:    unaryF32("CEIL_F32", viaF64(math.Ceil)),
+		OP_FLOOR_F32:   unaryF32("FLOOR_F32", viaF64(math.Floor)),
+		OP_TRUNC_F32:   unaryF32("TRUNC_F32", viaF64(math.Trunc)),
+		OP_NEAREST_F32: unaryF32("NEAREST_F32", viaF64(math.RoundToEven)),
+		OP_SQRT_F32:    unaryF32("SQRT_F32", viaF64(math.Sqrt)),
+		OP_ADD_F32:     binaryF32("ADD_F32", func(a, b float32) float32 { return a + b }),
+		OP_SUB_F32:     binaryF32("SUB_F32", func(a, b float32) float32 { return a - b }),
+		OP_MUL_F32:     binaryF32("MUL_F32", func(a, b float32) float32 { return a * b }),
+		OP_DIV_F32:     binaryF32("DIV_F32", func(a, b float32) float32 { return a / b }),
+		OP_MIN_F32:     binaryF32("MIN_F32", func(a, b float32) float32 { return float32(math.Min(float64(a), float64(b))) }),
+		OP_MAX_F32:     binaryF32("MAX_F32", func(a, b float32) float32 { return float32(math.Max(float64(a), float64(b))) }),
+		OP_COPYSIGN_F32: binaryF32("COPYSIGN_F32", func(a, b float32) float32 {
+			return math.Float32frombits(math.Float32bits(a)&^signBit32 | math.Float32bits(b)&signBit32)
+		}),
+
+		OP_ABS_F64:      unaryF64("ABS_F64", f64Bits(func(v uint64) uint64 { return v &^ signBit64 })),
+		OP_NEG_F64:      unaryF64("NEG_F64", f64Bits(func(v uint64) uint64 { return v ^ signBit64 })),
+		OP_CEIL_F64:     unaryF64("CEIL_F64", math.Ceil),
+		OP_FLOOR_F64:    unaryF64("FLOOR_F64", math.Floor),
+		OP_TRUNC_F64:    unaryF64("TRUNC_F64", math.Trunc),
+		OP_NEAREST_F64:  unaryF64("NEAREST_F64", math.RoundToEven),
+		OP_SQRT_F64:     unaryF64("SQRT_F64", math.Sqrt),
+		OP_ADD_F64:      binaryF64("ADD_F64", func(a, b float64) float64 { return a + b }),
+		OP_SUB_F64:      binaryF64("SUB_F64", func(a, b float64) float64 { return a - b }),
+		OP_MUL_F64:      binaryF64("MUL_F64", func(a, b float64) float64 { return a * b }),
+		OP_DIV_F64:      binaryF64("DIV_F64", func(a, b float64) float64 { return a / b }),
+		OP_MIN_F64:      binaryF64("MIN_F64", math.Min),
+		OP_MAX_F64:      binaryF64("MAX_F64", math.Max),
+		OP_COPYSIGN_F64: binaryF64("COPYSIGN_F64", math.Copysign),
+
+		OP_WRAP_I64_I32: convertOp("WRAP_I64_I32", TYPE_I64, func(v *ValueStackEntry) ValueStackEntry {
+			return i32Entry(uint32(v.Value_I64))
+		}),
+		OP_TRUNCS_F32_I32: truncI32("TRUNCS_F32_I32", TYPE_F32, true, false),
+		OP_TRUNCU_F32_I32: truncI32("TRUNCU_F32_I32", TYPE_F32, false, false),
+		OP_TRUNCS_F64_I32: truncI32("TRUNCS_F64_I32", TYPE_F64, true, false),
+		OP_TRUNCU_F64_I32: truncI32("TRUNCU_F64_I32", TYPE_F64, false, false),
+		OP_EXTENDS_I32_I64: convertOp("EXTENDS_I32_I64", TYPE_I32, func(v *ValueStackEntry) ValueStackEntry {
+			return i64Entry(uint64(int64(int32(v.Value_I32))))
+		}),
+		OP_EXTENDU_I32_I64: convertOp("EXTENDU_I32_I64", TYPE_I32, func(v *ValueStackEntry) ValueStackEntry {
+			return i64Entry(uint64(v.Value_I32))
+		}),
+		OP_TRUNCS_F32_I64: truncI64("TRUNCS_F32_I64", TYPE_F32, true, false),
+		OP_TRUNCU_F32_I64: truncI64("TRUNCU_F32_I64", TYPE_F32, false, false),
+		OP_TRUNCS_F64_I64: truncI64("TRUNCS_F64_I64", TYPE_F64, true, false),
+		OP_TRUNCU_F64_I64: truncI64("TRUNCU_F64_I64", TYPE_F64, false, false),
+		OP_CONVERTS_I32_F32: convertOp("CONVERTS_I32_F32", TYPE_I32, func(v *ValueStackEntry) ValueStackEntry {
+			return f32Entry(float32(int32(v.Value_I32)))
+		}),
+		OP_CONVERTU_I32_F32: convertOp("CONVERTU_I32_F32", TYPE_I32, func(v *ValueStackEntry) ValueStackEntry {
+			return f32Entry(float32(v.Value_I32))
+		}),
+		OP_CONVERTS_I64_F32: convertOp("CONVERTS_I64_F32", TYPE_I64, func(v *ValueStackEntry) ValueStackEntry {
+			return f32Entry(float32(int64(v.Value_I64)))
+		}),
+		OP_CONVERTU_I64_F32: convertOp("CONVERTU_I64_F32", TYPE_I64, func(v *ValueStackEntry) ValueStackEntry {
+			return f32Entry(float32(v.Value_I64))
+		}),
+		OP_DEMOTE_F64_F32: convertOp("DEMOTE_F64_F32", TYPE_F64, func(v *ValueStackEntry) ValueStackEntry {
+			return f32Entry(float32(v.Value_F64))
+		}),
+		OP_CONVERTS_I32_F64: convertOp("CONVERTS_I32_F64", TYPE_I32, func(v *ValueStackEntry) ValueStackEntry {
+			return f64Entry(float64(int32(v.Value_I32)))
+		}),
+		OP_CONVERTU_I32_F64: convertOp("CONVERTU_I32_F64", TYPE_I32, func(v *ValueStackEntry) ValueStackEntry {
+			return f64Entry(float64(v.Value_I32))
+		}),
+		OP_CONVERTS_I64_F64: convertOp("CONVERTS_I64_F64", TYPE_I64, func(v *ValueStackEntry) ValueStackEntry {
+			return f64Entry(float64(int64(v.Value_I64)))
+		}),
+		OP_CONVERTU_I64_F64: convertOp("CONVERTU_I64_F64", TYPE_I64, func(v *ValueStackEntry) ValueStackEntry {
+			return f64Entry(float64(v.Value_I64))
+		}),
+		OP_PROMOTE_F32_F64: convertOp("PROMOTE_F32_F64", TYPE_F32, func(v *ValueStackEntry) ValueStackEntry {
+			return f64Entry(float64(v.Value_F32))
+		}),
+		OP_REINTERPRET_F32_I32: convertOp("REINTERPRET_F32_I32", TYPE_F32, func(v *ValueStackEntry) ValueStackEntry {
+			return i32Entry(math.Float32bits(v.Value_F32))
+		}),
+		OP_REINTERPRET_F64_I64: convertOp("REINTERPRET_F64_I64", TYPE_F64, func(v *ValueStackEntry) ValueStackEntry {
+			return i64Entry(math.Float64bits(v.Value_F64))
+		}),
+		OP_REINTERPRET_I32_F32: convertOp("REINTERPRET_I32_F32", TYPE_I32, func(v *ValueStackEntry) ValueStackEntry {
+			return f32Entry(math.Float32frombits(v.Value_I32))
+		}),
+		OP_REINTERPRET_I64_F64: convertOp("REINTERPRET_I64_F64", TYPE_I64, func(v *ValueStackEntry) ValueStackEntry {
+			return f64Entry(math.Float64frombits(v.Value_I64))
+		}),
+
+		OP_EXTEND8S_I32:  unaryI32("EXTEND8S_I32", func(v uint32) uint32 { return uint32(int32(int8(v))) }),
+		OP_EXTEND16S_I32: unaryI32("EXTEND16S_I32", func(v uint32) uint32 { return uint32(int32(int16(v))) }),
+		OP_EXTEND8S_I64:  unaryI64("EXTEND8S_I64", func(v uint64) uint64 { return uint64(int64(int8(v))) }),
+		OP_EXTEND16S_I64: unaryI64("EXTEND16S_I64", func(v uint64) uint64 { return uint64(int64(int16(v))) }),
+		OP_EXTEND32S_I64: unaryI64("EXTEND32S_I64", func(v uint64) uint64 { return uint64(int64(int32(v))) }),
+	}
+	for _, op := range nanProducingOps {
+		m[op] = canonicalNaN(m[op])
+	}
+	return m
+}
+
+// The float instructions whose NaN results may differ in sign and
+// payload between machines. abs, neg, copysign and the reinterprets
+// are exact bit operations and aren't listed.
+var nanProducingOps = []uint8{
+	OP_CEIL_F32, OP_FLOOR_F32, OP_TRUNC_F32, OP_NEAREST_F32, OP_SQRT_F32,
+	OP_ADD_F32, OP_SUB_F32, OP_MUL_F32, OP_DIV_F32, OP_MIN_F32, OP_MAX_F32,
+	OP_CEIL_F64, OP_FLOOR_F64, OP_TRUNC_F64, OP_NEAREST_F64, OP_SQRT_F64,
+	OP_ADD_F64, OP_SUB_F64, OP_MUL_F64, OP_DIV_F64, OP_MIN_F64, OP_MAX_F64,
+	OP_DEMOTE_F64_F32, OP_PROMOTE_F32_F64,
+}
+
+// Canonical NaNs, positive with only the top bit of the payload set
+const (
+	canonicalNaN32 uint32 = 0x7FC00000
+	canonicalNaN64 uint64 = 0x7FF8000000000000
+)
+
+// In deterministic mode, replaces a NaN that f leaves on top of the
+// stack with the canonical NaN of its type
+func canonicalNaN(f Instruction) Instruction {
+	return func(vm *VMState) error {
+		if err := f(vm); err != nil || !vm.deterministic {
+			return err
+		}
+		top := &vm.ValueStack.elements[len(vm.ValueStack.elements)-1]
+		switch {
+		case top.EntryType == TYPE_F32 && top.Value_F32 != top.Value_F32:
+			top.Value_F32 = math.Float32frombits(canonicalNaN32)
+		case top.EntryType == TYPE_F64 && top.Value_F64 != top.Value_F64:
+			top.Value_F64 = math.Float64frombits(canonicalNaN64)
+		}
+		return nil
+	}
+}
@@ -9,27 +9,28 @@ import (
 // 0x43 const.i32: reads 4 octets little endian and pushes unit32 to stack
 func CONST_I32(vm *VMState) error {
 	const width = 1 + WidthI32
-	if vm.PC+width > uint64(len(vm.Memory)) {
-		return vm.SetTrapError(&TrapError{
-			Type:    TrapProgramCounterOutOfBounds,
-			Op:      "CONST_I32",
-			PC:      vm.PC,
-			Message: "CONST_I32: Out of bounds",
-			Meta: map[string]uint64{
-				"width":      width,
-				"memory_len": uint64(len(vm.Memory)),
-			},
-		})
+	imm, res := vm.fetch(vm.PC+1, WidthI32)
+	if res != MemoryAccessOK {
+		return vm.memoryAccessTrap("CONST_I32", TrapAccessExecute, vm.PC+1, width, res)
 	}
-	span1 := vm.PC + 1
-	span2 := span1 + WidthI32
 
-	val := binary.LittleEndian.Uint32(vm.Memory[span1:span2])
+	val := binary.LittleEndian.Uint32(imm)
 	vm.ValueStack.PushInt32(val)
 	vm.PC += width
 	return nil
 }
 
+// const.i32 as used by instances: the immediate is a signed LEB128
+func CONST_I32_LEB(vm *VMState) error {
+	val, next, err := vm.fetchSLEB128("CONST_I32", vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	vm.ValueStack.PushInt32(uint32(val))
+	vm.PC = next
+	return nil
+}
+
 // 0x6A add.i32: Pull two I32 words off stack, push I32 sum word on stack
 func ADD_I32(vm *VMState) error {
 	enough, collect := vm.ValueStack.HasAtLeastOfType(2, TYPE_I32)
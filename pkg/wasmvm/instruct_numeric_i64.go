@@ -9,27 +9,28 @@ import (
 // 0x42 const.i64: reads 8 octets little endian and pushes unit64 to stack
 func CONST_I64(vm *VMState) error {
 	const width = 1 + WidthI64
-	if vm.PC+width > uint64(len(vm.Memory)) {
-		return vm.SetTrapError(&TrapError{
-			Type:    TrapProgramCounterOutOfBounds,
-			Op:      "CONST_I64",
-			PC:      vm.PC,
-			Message: "CONST_I64: Out of bounds",
-			Meta: map[string]uint64{
-				"width":      width,
-				"memory_len": uint64(len(vm.Memory)),
-			},
-		})
+	imm, res := vm.fetch(vm.PC+1, WidthI64)
+	if res != MemoryAccessOK {
+		return vm.memoryAccessTrap("CONST_I64", TrapAccessExecute, vm.PC+1, width, res)
 	}
-	span1 := vm.PC + 1
-	span2 := span1 + WidthI64
 
-	val := binary.LittleEndian.Uint64(vm.Memory[span1:span2])
+	val := binary.LittleEndian.Uint64(imm)
 	vm.ValueStack.PushInt64(val)
 	vm.PC += width
 	return nil
 }
 
+// const.i64 as used by instances: the immediate is a signed LEB128
+func CONST_I64_LEB(vm *VMState) error {
+	val, next, err := vm.fetchSLEB128("CONST_I64", vm.PC+1, 64)
+	if err != nil {
+		return err
+	}
+	vm.ValueStack.PushInt64(uint64(val))
+	vm.PC = next
+	return nil
+}
+
 // 0x7C add.i64: Pull two I64 words off stack, push I64 sum word on stack
 func ADD_I64(vm *VMState) error {
 	enough, collect := vm.ValueStack.HasAtLeastOfType(2, TYPE_I64)
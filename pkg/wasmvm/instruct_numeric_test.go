@@ -0,0 +1,126 @@
+package wasmvm_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func f32(v float32) wasmvm.ValueStackEntry {
+	return *wasmvm.NewValueStackEntryF32(v)
+}
+
+func f64(v float64) wasmvm.ValueStackEntry {
+	return *wasmvm.NewValueStackEntryF64(v)
+}
+
+type numericTestCase struct {
+	name     string
+	program  []byte
+	stack    []wasmvm.ValueStackEntry
+	expect   wasmvm.ValueStackEntry
+	trapType wasmvm.TrapType
+	trapMsg  string
+}
+
+// Runs one instruction on a legacy VM and checks the single result
+func runNumericTests(t *testing.T, tests []numericTestCase) {
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			vm, err := wasmvm.NewVM(&wasmvm.VMConfig{
+				Size:  uint64(len(tc.program)),
+				Image: (&wasmvm.ImageConfig{}).SetArray(tc.program).SetSize(uint64(len(tc.program))),
+			})
+			require.NoError(t, err)
+			for i := range tc.stack {
+				vm.ValueStack.Push(&tc.stack[i])
+			}
+			err = vm.Step()
+			if tc.trapType != wasmvm.UndefinedTrap {
+				require.Error(t, err)
+				assert.Equal(t, tc.trapType, vm.TrapErr.Type)
+				assert.Equal(t, tc.trapMsg, vm.TrapErr.Message)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, uint64(len(tc.program)), vm.PC)
+			assert.Equal(t, 1, vm.ValueStack.Size())
+			top, _ := vm.ValueStack.Pop()
+			if tc.expect.EntryType == wasmvm.TYPE_F64 && math.IsNaN(tc.expect.Value_F64) {
+				assert.True(t, math.IsNaN(top.Value_F64))
+				return
+			}
+			assert.Equal(t, tc.expect, *top)
+		})
+	}
+}
+
+func TestNumeric_Integer(t *testing.T) {
+	runNumericTests(t, []numericTestCase{
+		{name: "eqz.i32", program: []byte{wasmvm.OP_EQZ_I32}, stack: []wasmvm.ValueStackEntry{i32(0)}, expect: i32(1)},
+		{name: "lt_s.i32", program: []byte{wasmvm.OP_LTS_I32}, stack: []wasmvm.ValueStackEntry{i32(0xFFFFFFFF), i32(1)}, expect: i32(1)},
+		{name: "lt_u.i32", program: []byte{wasmvm.OP_LTU_I32}, stack: []wasmvm.ValueStackEntry{i32(0xFFFFFFFF), i32(1)}, expect: i32(0)},
+		{name: "ge_s.i64", program: []byte{wasmvm.OP_GES_I64}, stack: []wasmvm.ValueStackEntry{i64(5), i64(5)}, expect: i32(1)},
+		{name: "eqz.i64", program: []byte{wasmvm.OP_EQZ_I64}, stack: []wasmvm.ValueStackEntry{i64(1 << 40)}, expect: i32(0)},
+		{name: "clz.i32", program: []byte{wasmvm.OP_CLZ_I32}, stack: []wasmvm.ValueStackEntry{i32(1)}, expect: i32(31)},
+		{name: "ctz.i64 of 0", program: []byte{wasmvm.OP_CTZ_I64}, stack: []wasmvm.ValueStackEntry{i64(0)}, expect: i64(64)},
+		{name: "popcnt.i32", program: []byte{wasmvm.OP_POPCNT_I32}, stack: []wasmvm.ValueStackEntry{i32(0xF0F0)}, expect: i32(8)},
+		{name: "rem_s.i32 keeps the dividend sign", program: []byte{wasmvm.OP_REMS_I32}, stack: []wasmvm.ValueStackEntry{i32(uint32(0xFFFFFFF9)), i32(2)}, expect: i32(0xFFFFFFFF)},
+		{name: "rem_s.i32 of MinInt by -1", program: []byte{wasmvm.OP_REMS_I32}, stack: []wasmvm.ValueStackEntry{i32(1 << 31), i32(0xFFFFFFFF)}, expect: i32(0)},
+		{name: "rem_u.i64", program: []byte{wasmvm.OP_REMU_I64}, stack: []wasmvm.ValueStackEntry{i64(17), i64(5)}, expect: i64(2)},
+		{name: "rem_s.i64 by zero", program: []byte{wasmvm.OP_REMS_I64}, stack: []wasmvm.ValueStackEntry{i64(17), i64(0)}, trapType: wasmvm.TrapDivideByZero, trapMsg: "REMS_I64: Divide by Zero"},
+		{name: "shl.i32 masks the count", program: []byte{wasmvm.OP_SHL_I32}, stack: []wasmvm.ValueStackEntry{i32(1), i32(33)}, expect: i32(2)},
+		{name: "shr_s.i32", program: []byte{wasmvm.OP_SHRS_I32}, stack: []wasmvm.ValueStackEntry{i32(0x80000000), i32(4)}, expect: i32(0xF8000000)},
+		{name: "shr_u.i64", program: []byte{wasmvm.OP_SHRU_I64}, stack: []wasmvm.ValueStackEntry{i64(1 << 63), i64(63)}, expect: i64(1)},
+		{name: "rotl.i32", program: []byte{wasmvm.OP_ROTL_I32}, stack: []wasmvm.ValueStackEntry{i32(0x80000001), i32(1)}, expect: i32(3)},
+		{name: "rotr.i64", program: []byte{wasmvm.OP_ROTR_I64}, stack: []wasmvm.ValueStackEntry{i64(1), i64(1)}, expect: i64(1 << 63)},
+		{name: "xor.i64", program: []byte{wasmvm.OP_XOR_I64}, stack: []wasmvm.ValueStackEntry{i64(0xFF), i64(0x0F)}, expect: i64(0xF0)},
+		{name: "extend8_s.i32", program: []byte{wasmvm.OP_EXTEND8S_I32}, stack: []wasmvm.ValueStackEntry{i32(0x80)}, expect: i32(0xFFFFFF80)},
+		{name: "extend32_s.i64", program: []byte{wasmvm.OP_EXTEND32S_I64}, stack: []wasmvm.ValueStackEntry{i64(0x80000000)}, expect: i64(0xFFFFFFFF80000000)},
+		{name: "wrong operand type", program: []byte{wasmvm.OP_AND_I32}, stack: []wasmvm.ValueStackEntry{i32(1), i64(1)}, trapType: wasmvm.TrapStackUnderflow, trapMsg: "AND_I32: Stack Underflow"},
+	})
+}
+
+func TestNumeric_Float(t *testing.T) {
+	negZero := math.Copysign(0, -1)
+	runNumericTests(t, []numericTestCase{
+		{name: "const.f32", program: []byte{wasmvm.OP_CONST_F32, 0x00, 0x00, 0xC0, 0x3F}, expect: f32(1.5)},
+		{name: "const.f64", program: []byte{wasmvm.OP_CONST_F64, 0, 0, 0, 0, 0, 0, 0xF0, 0xBF}, expect: f64(-1)},
+		{name: "add.f32", program: []byte{wasmvm.OP_ADD_F32}, stack: []wasmvm.ValueStackEntry{f32(1.25), f32(2)}, expect: f32(3.25)},
+		{name: "div.f64 by zero", program: []byte{wasmvm.OP_DIV_F64}, stack: []wasmvm.ValueStackEntry{f64(1), f64(0)}, expect: f64(math.Inf(1))},
+		{name: "min.f64 of zeros", program: []byte{wasmvm.OP_MIN_F64}, stack: []wasmvm.ValueStackEntry{f64(0), f64(negZero)}, expect: f64(negZero)},
+		{name: "max.f64 with NaN", program: []byte{wasmvm.OP_MAX_F64}, stack: []wasmvm.ValueStackEntry{f64(math.NaN()), f64(1)}, expect: f64(math.NaN())},
+		{name: "nearest.f32 rounds to even", program: []byte{wasmvm.OP_NEAREST_F32}, stack: []wasmvm.ValueStackEntry{f32(2.5)}, expect: f32(2)},
+		{name: "floor.f64", program: []byte{wasmvm.OP_FLOOR_F64}, stack: []wasmvm.ValueStackEntry{f64(-1.5)}, expect: f64(-2)},
+		{name: "sqrt.f32", program: []byte{wasmvm.OP_SQRT_F32}, stack: []wasmvm.ValueStackEntry{f32(16)}, expect: f32(4)},
+		{name: "neg.f64", program: []byte{wasmvm.OP_NEG_F64}, stack: []wasmvm.ValueStackEntry{f64(0)}, expect: f64(negZero)},
+		{name: "abs.f32", program: []byte{wasmvm.OP_ABS_F32}, stack: []wasmvm.ValueStackEntry{f32(-3)}, expect: f32(3)},
+		{name: "copysign.f32", program: []byte{wasmvm.OP_COPYSIGN_F32}, stack: []wasmvm.ValueStackEntry{f32(3), f32(-0.5)}, expect: f32(-3)},
+		{name: "lt.f64", program: []byte{wasmvm.OP_LT_F64}, stack: []wasmvm.ValueStackEntry{f64(1), f64(2)}, expect: i32(1)},
+		{name: "ne.f32 with NaN", program: []byte{wasmvm.OP_NE_F32}, stack: []wasmvm.ValueStackEntry{f32(float32(math.NaN())), f32(float32(math.NaN()))}, expect: i32(1)},
+	})
+}
+
+func TestNumeric_Conversion(t *testing.T) {
+	runNumericTests(t, []numericTestCase{
+		{name: "wrap.i64", program: []byte{wasmvm.OP_WRAP_I64_I32}, stack: []wasmvm.ValueStackEntry{i64(0x1_0000_0005)}, expect: i32(5)},
+		{name: "extend_s.i32", program: []byte{wasmvm.OP_EXTENDS_I32_I64}, stack: []wasmvm.ValueStackEntry{i32(0xFFFFFFFE)}, expect: i64(0xFFFFFFFFFFFFFFFE)},
+		{name: "extend_u.i32", program: []byte{wasmvm.OP_EXTENDU_I32_I64}, stack: []wasmvm.ValueStackEntry{i32(0xFFFFFFFE)}, expect: i64(0xFFFFFFFE)},
+		{name: "trunc_s.f32 to i32", program: []byte{wasmvm.OP_TRUNCS_F32_I32}, stack: []wasmvm.ValueStackEntry{f32(-7.9)}, expect: i32(0xFFFFFFF9)},
+		{name: "trunc_s.f64 to i32 just below the limit", program: []byte{wasmvm.OP_TRUNCS_F64_I32}, stack: []wasmvm.ValueStackEntry{f64(-2147483648.9)}, expect: i32(1 << 31)},
+		{name: "trunc_s.f64 to i32 overflows", program: []byte{wasmvm.OP_TRUNCS_F64_I32}, stack: []wasmvm.ValueStackEntry{f64(2147483648)}, trapType: wasmvm.TrapIntegerOverflow, trapMsg: "TRUNCS_F64_I32: Integer Overflow"},
+		{name: "trunc_u.f64 to i32 of -0.9", program: []byte{wasmvm.OP_TRUNCU_F64_I32}, stack: []wasmvm.ValueStackEntry{f64(-0.9)}, expect: i32(0)},
+		{name: "trunc_u.f32 to i32 of -1", program: []byte{wasmvm.OP_TRUNCU_F32_I32}, stack: []wasmvm.ValueStackEntry{f32(-1)}, trapType: wasmvm.TrapIntegerOverflow, trapMsg: "TRUNCU_F32_I32: Integer Overflow"},
+		{name: "trunc_u.f64 to i64 above 2^63", program: []byte{wasmvm.OP_TRUNCU_F64_I64}, stack: []wasmvm.ValueStackEntry{f64(1 << 63)}, expect: i64(1 << 63)},
+		{name: "trunc_s.f64 to i64 of NaN", program: []byte{wasmvm.OP_TRUNCS_F64_I64}, stack: []wasmvm.ValueStackEntry{f64(math.NaN())}, trapType: wasmvm.TrapInvalidConversion, trapMsg: "TRUNCS_F64_I64: Invalid Conversion to Integer"},
+		{name: "convert_u.i32 to f32", program: []byte{wasmvm.OP_CONVERTU_I32_F32}, stack: []wasmvm.ValueStackEntry{i32(0xFFFFFFFF)}, expect: f32(4294967296)},
+		{name: "convert_s.i64 to f64", program: []byte{wasmvm.OP_CONVERTS_I64_F64}, stack: []wasmvm.ValueStackEntry{i64(0xFFFFFFFFFFFFFFFF)}, expect: f64(-1)},
+		{name: "demote.f64", program: []byte{wasmvm.OP_DEMOTE_F64_F32}, stack: []wasmvm.ValueStackEntry{f64(0.5)}, expect: f32(0.5)},
+		{name: "promote.f32", program: []byte{wasmvm.OP_PROMOTE_F32_F64}, stack: []wasmvm.ValueStackEntry{f32(0.25)}, expect: f64(0.25)},
+		{name: "reinterpret.f32", program: []byte{wasmvm.OP_REINTERPRET_F32_I32}, stack: []wasmvm.ValueStackEntry{f32(1)}, expect: i32(0x3F800000)},
+		{name: "reinterpret.i64", program: []byte{wasmvm.OP_REINTERPRET_I64_F64}, stack: []wasmvm.ValueStackEntry{i64(0x4000000000000000)}, expect: f64(2)},
+	})
+}
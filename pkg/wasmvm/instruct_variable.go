@@ -0,0 +1,120 @@
+package wasmvm
+
+import "fmt"
+
+// The variable instructions are only available to instances. Locals
+// live on the value stack, starting with the parameters at the
+// StackHeight of the current frame.
+
+// Stack position of local idx, or -1 when there is no such local
+func (vm *VMState) localIndex(idx uint64) int {
+	if len(vm.CallStack) == 0 {
+		return -1
+	}
+	frame := vm.CallStack[len(vm.CallStack)-1]
+	// The label of the function body sits right above the locals
+	end := vm.Labels[frame.Labels].StackHeight
+	pos := uint64(frame.StackHeight) + idx
+	if pos >= uint64(end) {
+		return -1
+	}
+	return int(pos)
+}
+
+func badIndexTrap(vm *VMState, op string, what string, idx uint64) error {
+	return vm.SetTrapError(&TrapError{
+		Type:    TrapMalformedImmediate,
+		Op:      op,
+		PC:      vm.PC,
+		Message: fmt.Sprintf("%s: %s %d out of range", op, what, idx),
+	})
+}
+
+// 0x20 local.get: Push a copy of a local
+func LOCAL_GET(vm *VMState) error {
+	const op = "LOCAL_GET"
+	idx, next, err := vm.fetchULEB128(op, vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	pos := vm.localIndex(idx)
+	if pos < 0 {
+		return badIndexTrap(vm, op, "local", idx)
+	}
+	vm.ValueStack.pushEntry(vm.ValueStack.elements[pos])
+	vm.PC = next
+	return nil
+}
+
+// Stores the top of the stack into a local of the same type, popping
+// it unless tee is set
+func (vm *VMState) setLocal(op string, tee bool) error {
+	idx, next, err := vm.fetchULEB128(op, vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	pos := vm.localIndex(idx)
+	if pos < 0 {
+		return badIndexTrap(vm, op, "local", idx)
+	}
+	ok, collect := vm.ValueStack.HasAtLeastOfType(1, vm.ValueStack.elements[pos].EntryType)
+	if !ok {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	vm.ValueStack.elements[pos] = collect[0]
+	if !tee && !vm.ValueStack.Drop(1, true) {
+		return NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+	vm.PC = next
+	return nil
+}
+
+// 0x21 local.set: Pop a value into a local
+func LOCAL_SET(vm *VMState) error {
+	return vm.setLocal("LOCAL_SET", false)
+}
+
+// 0x22 local.tee: Copy the top of the stack into a local
+func LOCAL_TEE(vm *VMState) error {
+	return vm.setLocal("LOCAL_TEE", true)
+}
+
+// 0x23 global.get: Push the value of a global
+func GLOBAL_GET(vm *VMState) error {
+	const op = "GLOBAL_GET"
+	idx, next, err := vm.fetchULEB128(op, vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	globals := vm.instance.Globals
+	if idx >= uint64(len(globals)) {
+		return badIndexTrap(vm, op, "global", idx)
+	}
+	vm.ValueStack.pushEntry(globals[idx].Value)
+	vm.PC = next
+	return nil
+}
+
+// 0x24 global.set: Pop a value into a mutable global
+func GLOBAL_SET(vm *VMState) error {
+	const op = "GLOBAL_SET"
+	idx, next, err := vm.fetchULEB128(op, vm.PC+1, 32)
+	if err != nil {
+		return err
+	}
+	globals := vm.instance.Globals
+	if idx >= uint64(len(globals)) || !globals[idx].Type.Mutable {
+		return badIndexTrap(vm, op, "mutable global", idx)
+	}
+	g := globals[idx]
+	ok, collect := vm.ValueStack.HasAtLeastOfType(1, g.Type.ValType)
+	if !ok {
+		return NewStackUnderflowErrorAndSetTrap(vm, op)
+	}
+	g.Value = collect[0]
+	if !vm.ValueStack.Drop(1, true) {
+		return NewStackCleanupErrorAndSetTrap(vm, op)
+	}
+	vm.PC = next
+	return nil
+}
@@ -4,12 +4,100 @@ type Instruction func(*VMState) error
 
 const (
 	// Control Instructions
-	OP_NOP = 0x01
-	OP_END = 0x0B
+	OP_UNREACHABLE   = 0x00
+	OP_NOP           = 0x01
+	OP_BLOCK         = 0x02
+	OP_LOOP          = 0x03
+	OP_IF            = 0x04
+	OP_ELSE          = 0x05
+	OP_END           = 0x0B
+	OP_BR            = 0x0C
+	OP_BR_IF         = 0x0D
+	OP_BR_TABLE      = 0x0E
+	OP_RETURN        = 0x0F
+	OP_CALL          = 0x10
+	OP_CALL_INDIRECT = 0x11
+
+	// Parametric instructions
+	OP_DROP     = 0x1A
+	OP_SELECT   = 0x1B
+	OP_SELECT_T = 0x1C
+
+	// Variable instructions
+	OP_LOCAL_GET  = 0x20
+	OP_LOCAL_SET  = 0x21
+	OP_LOCAL_TEE  = 0x22
+	OP_GLOBAL_GET = 0x23
+	OP_GLOBAL_SET = 0x24
+
+	// Memory instructions
+	OP_LOAD_I32    = 0x28
+	OP_LOAD_I64    = 0x29
+	OP_LOAD_F32    = 0x2A
+	OP_LOAD_F64    = 0x2B
+	OP_LOAD8S_I32  = 0x2C
+	OP_LOAD8U_I32  = 0x2D
+	OP_LOAD16S_I32 = 0x2E
+	OP_LOAD16U_I32 = 0x2F
+	OP_LOAD8S_I64  = 0x30
+	OP_LOAD8U_I64  = 0x31
+	OP_LOAD16S_I64 = 0x32
+	OP_LOAD16U_I64 = 0x33
+	OP_LOAD32S_I64 = 0x34
+	OP_LOAD32U_I64 = 0x35
+	OP_STORE_I32   = 0x36
+	OP_STORE_I64   = 0x37
+	OP_STORE_F32   = 0x38
+	OP_STORE_F64   = 0x39
+	OP_STORE8_I32  = 0x3A
+	OP_STORE16_I32 = 0x3B
+	OP_STORE8_I64  = 0x3C
+	OP_STORE16_I64 = 0x3D
+	OP_STORE32_I64 = 0x3E
+	OP_MEMORY_SIZE = 0x3F
+	OP_MEMORY_GROW = 0x40
 
 	// Numeric instructions
 	OP_CONST_I32 = 0x41
 	OP_CONST_I64 = 0x42
+	OP_CONST_F32 = 0x43
+	OP_CONST_F64 = 0x44
+
+	// Numeric comparison instructions
+	OP_EQZ_I32 = 0x45
+	OP_EQ_I32  = 0x46
+	OP_NE_I32  = 0x47
+	OP_LTS_I32 = 0x48
+	OP_LTU_I32 = 0x49
+	OP_GTS_I32 = 0x4A
+	OP_GTU_I32 = 0x4B
+	OP_LES_I32 = 0x4C
+	OP_LEU_I32 = 0x4D
+	OP_GES_I32 = 0x4E
+	OP_GEU_I32 = 0x4F
+	OP_EQZ_I64 = 0x50
+	OP_EQ_I64  = 0x51
+	OP_NE_I64  = 0x52
+	OP_LTS_I64 = 0x53
+	OP_LTU_I64 = 0x54
+	OP_GTS_I64 = 0x55
+	OP_GTU_I64 = 0x56
+	OP_LES_I64 = 0x57
+	OP_LEU_I64 = 0x58
+	OP_GES_I64 = 0x59
+	OP_GEU_I64 = 0x5A
+	OP_EQ_F32  = 0x5B
+	OP_NE_F32  = 0x5C
+	OP_LT_F32  = 0x5D
+	OP_GT_F32  = 0x5E
+	OP_LE_F32  = 0x5F
+	OP_GE_F32  = 0x60
+	OP_EQ_F64  = 0x61
+	OP_NE_F64  = 0x62
+	OP_LT_F64  = 0x63
+	OP_GT_F64  = 0x64
+	OP_LE_F64  = 0x65
+	OP_GE_F64  = 0x66
 
 	// Numeric i32 arithmatic instructions
 	OP_ADD_I32  = 0x6A
@@ -17,6 +105,7 @@ const (
 	OP_MUL_I32  = 0x6C
 	OP_DIVS_I32 = 0x6D
 	OP_DIVU_I32 = 0x6E
+	OP_REMS_I32 = 0x6F
 	OP_REMU_I32 = 0x70
 
 	// Numeric I64 arithmatic instructions
@@ -25,10 +114,202 @@ const (
 	OP_MUL_I64  = 0x7E
 	OP_DIVS_I64 = 0x7F
 	OP_DIVU_I64 = 0x80
+	OP_REMS_I64 = 0x81
+	OP_REMU_I64 = 0x82
+
+	// Numeric bitwise instructions
+	OP_CLZ_I32    = 0x67
+	OP_CTZ_I32    = 0x68
+	OP_POPCNT_I32 = 0x69
+	OP_AND_I32    = 0x71
+	OP_OR_I32     = 0x72
+	OP_XOR_I32    = 0x73
+	OP_SHL_I32    = 0x74
+	OP_SHRS_I32   = 0x75
+	OP_SHRU_I32   = 0x76
+	OP_ROTL_I32   = 0x77
+	OP_ROTR_I32   = 0x78
+	OP_CLZ_I64    = 0x79
+	OP_CTZ_I64    = 0x7A
+	OP_POPCNT_I64 = 0x7B
+	OP_AND_I64    = 0x83
+	OP_OR_I64     = 0x84
+	OP_XOR_I64    = 0x85
+	OP_SHL_I64    = 0x86
+	OP_SHRS_I64   = 0x87
+	OP_SHRU_I64   = 0x88
+	OP_ROTL_I64   = 0x89
+	OP_ROTR_I64   = 0x8A
+
+	// Numeric floating point instructions
+	OP_ABS_F32      = 0x8B
+	OP_NEG_F32      = 0x8C
+	OP_CEIL_F32     = 0x8D
+	OP_FLOOR_F32    = 0x8E
+	OP_TRUNC_F32    = 0x8F
+	OP_NEAREST_F32  = 0x90
+	OP_SQRT_F32     = 0x91
+	OP_ADD_F32      = 0x92
+	OP_SUB_F32      = 0x93
+	OP_MUL_F32      = 0x94
+	OP_DIV_F32      = 0x95
+	OP_MIN_F32      = 0x96
+	OP_MAX_F32      = 0x97
+	OP_COPYSIGN_F32 = 0x98
+	OP_ABS_F64      = 0x99
+	OP_NEG_F64      = 0x9A
+	OP_CEIL_F64     = 0x9B
+	OP_FLOOR_F64    = 0x9C
+	OP_TRUNC_F64    = 0x9D
+	OP_NEAREST_F64  = 0x9E
+	OP_SQRT_F64     = 0x9F
+	OP_ADD_F64      = 0xA0
+	OP_SUB_F64      = 0xA1
+	OP_MUL_F64      = 0xA2
+	OP_DIV_F64      = 0xA3
+	OP_MIN_F64      = 0xA4
+	OP_MAX_F64      = 0xA5
+	OP_COPYSIGN_F64 = 0xA6
+
+	// Numeric conversion instructions, named source type first
+	OP_WRAP_I64_I32        = 0xA7
+	OP_TRUNCS_F32_I32      = 0xA8
+	OP_TRUNCU_F32_I32      = 0xA9
+	OP_TRUNCS_F64_I32      = 0xAA
+	OP_TRUNCU_F64_I32      = 0xAB
+	OP_EXTENDS_I32_I64     = 0xAC
+	OP_EXTENDU_I32_I64     = 0xAD
+	OP_TRUNCS_F32_I64      = 0xAE
+	OP_TRUNCU_F32_I64      = 0xAF
+	OP_TRUNCS_F64_I64      = 0xB0
+	OP_TRUNCU_F64_I64      = 0xB1
+	OP_CONVERTS_I32_F32    = 0xB2
+	OP_CONVERTU_I32_F32    = 0xB3
+	OP_CONVERTS_I64_F32    = 0xB4
+	OP_CONVERTU_I64_F32    = 0xB5
+	OP_DEMOTE_F64_F32      = 0xB6
+	OP_CONVERTS_I32_F64    = 0xB7
+	OP_CONVERTU_I32_F64    = 0xB8
+	OP_CONVERTS_I64_F64    = 0xB9
+	OP_CONVERTU_I64_F64    = 0xBA
+	OP_PROMOTE_F32_F64     = 0xBB
+	OP_REINTERPRET_F32_I32 = 0xBC
+	OP_REINTERPRET_F64_I64 = 0xBD
+	OP_REINTERPRET_I32_F32 = 0xBE
+	OP_REINTERPRET_I64_F64 = 0xBF
+	OP_EXTEND8S_I32        = 0xC0
+	OP_EXTEND16S_I32       = 0xC1
+	OP_EXTEND8S_I64        = 0xC2
+	OP_EXTEND16S_I64       = 0xC3
+	OP_EXTEND32S_I64       = 0xC4
+
+	// Saturating truncation and bulk memory prefix; the sub-opcode follows as a u32 LEB128
+	OP_PREFIX_MISC = 0xFC
+
+	// Misc sub-opcodes
+	OP_TRUNC_SATS_F32_I32 = 0x00
+	OP_TRUNC_SATU_F32_I32 = 0x01
+	OP_TRUNC_SATS_F64_I32 = 0x02
+	OP_TRUNC_SATU_F64_I32 = 0x03
+	OP_TRUNC_SATS_F32_I64 = 0x04
+	OP_TRUNC_SATU_F32_I64 = 0x05
+	OP_TRUNC_SATS_F64_I64 = 0x06
+	OP_TRUNC_SATU_F64_I64 = 0x07
+	OP_MEMORY_INIT        = 0x08
+	OP_DATA_DROP          = 0x09
+	OP_MEMORY_COPY        = 0x0A
+	OP_MEMORY_FILL        = 0x0B
+	OP_TABLE_INIT         = 0x0C
+	OP_ELEM_DROP          = 0x0D
+	OP_TABLE_COPY         = 0x0E
+	OP_TABLE_GROW         = 0x0F
+	OP_TABLE_SIZE         = 0x10
+	OP_TABLE_FILL         = 0x11
+
+	// Atomic instruction prefix (threads proposal); the sub-opcode follows as a u32 LEB128
+	OP_PREFIX_ATOMIC = 0xFE
+
+	// Atomic sub-opcodes
+	OP_ATOMIC_NOTIFY = 0x00
+	OP_ATOMIC_WAIT32 = 0x01
+	OP_ATOMIC_WAIT64 = 0x02
+	OP_ATOMIC_FENCE  = 0x03
+
+	OP_ATOMIC_LOAD_I32    = 0x10
+	OP_ATOMIC_LOAD_I64    = 0x11
+	OP_ATOMIC_LOAD8U_I32  = 0x12
+	OP_ATOMIC_LOAD16U_I32 = 0x13
+	OP_ATOMIC_LOAD8U_I64  = 0x14
+	OP_ATOMIC_LOAD16U_I64 = 0x15
+	OP_ATOMIC_LOAD32U_I64 = 0x16
+
+	OP_ATOMIC_STORE_I32   = 0x17
+	OP_ATOMIC_STORE_I64   = 0x18
+	OP_ATOMIC_STORE8_I32  = 0x19
+	OP_ATOMIC_STORE16_I32 = 0x1A
+	OP_ATOMIC_STORE8_I64  = 0x1B
+	OP_ATOMIC_STORE16_I64 = 0x1C
+	OP_ATOMIC_STORE32_I64 = 0x1D
+
+	OP_ATOMIC_RMW_ADD_I32    = 0x1E
+	OP_ATOMIC_RMW_ADD_I64    = 0x1F
+	OP_ATOMIC_RMW8_ADDU_I32  = 0x20
+	OP_ATOMIC_RMW16_ADDU_I32 = 0x21
+	OP_ATOMIC_RMW8_ADDU_I64  = 0x22
+	OP_ATOMIC_RMW16_ADDU_I64 = 0x23
+	OP_ATOMIC_RMW32_ADDU_I64 = 0x24
+
+	OP_ATOMIC_RMW_SUB_I32    = 0x25
+	OP_ATOMIC_RMW_SUB_I64    = 0x26
+	OP_ATOMIC_RMW8_SUBU_I32  = 0x27
+	OP_ATOMIC_RMW16_SUBU_I32 = 0x28
+	OP_ATOMIC_RMW8_SUBU_I64  = 0x29
+	OP_ATOMIC_RMW16_SUBU_I64 = 0x2A
+	OP_ATOMIC_RMW32_SUBU_I64 = 0x2B
+
+	OP_ATOMIC_RMW_AND_I32    = 0x2C
+	OP_ATOMIC_RMW_AND_I64    = 0x2D
+	OP_ATOMIC_RMW8_ANDU_I32  = 0x2E
+	OP_ATOMIC_RMW16_ANDU_I32 = 0x2F
+	OP_ATOMIC_RMW8_ANDU_I64  = 0x30
+	OP_ATOMIC_RMW16_ANDU_I64 = 0x31
+	OP_ATOMIC_RMW32_ANDU_I64 = 0x32
+
+	OP_ATOMIC_RMW_OR_I32    = 0x33
+	OP_ATOMIC_RMW_OR_I64    = 0x34
+	OP_ATOMIC_RMW8_ORU_I32  = 0x35
+	OP_ATOMIC_RMW16_ORU_I32 = 0x36
+	OP_ATOMIC_RMW8_ORU_I64  = 0x37
+	OP_ATOMIC_RMW16_ORU_I64 = 0x38
+	OP_ATOMIC_RMW32_ORU_I64 = 0x39
+
+	OP_ATOMIC_RMW_XOR_I32    = 0x3A
+	OP_ATOMIC_RMW_XOR_I64    = 0x3B
+	OP_ATOMIC_RMW8_XORU_I32  = 0x3C
+	OP_ATOMIC_RMW16_XORU_I32 = 0x3D
+	OP_ATOMIC_RMW8_XORU_I64  = 0x3E
+	OP_ATOMIC_RMW16_XORU_I64 = 0x3F
+	OP_ATOMIC_RMW32_XORU_I64 = 0x40
+
+	OP_ATOMIC_RMW_XCHG_I32    = 0x41
+	OP_ATOMIC_RMW_XCHG_I64    = 0x42
+	OP_ATOMIC_RMW8_XCHGU_I32  = 0x43
+	OP_ATOMIC_RMW16_XCHGU_I32 = 0x44
+	OP_ATOMIC_RMW8_XCHGU_I64  = 0x45
+	OP_ATOMIC_RMW16_XCHGU_I64 = 0x46
+	OP_ATOMIC_RMW32_XCHGU_I64 = 0x47
+
+	OP_ATOMIC_RMW_CMPXCHG_I32    = 0x48
+	OP_ATOMIC_RMW_CMPXCHG_I64    = 0x49
+	OP_ATOMIC_RMW8_CMPXCHGU_I32  = 0x4A
+	OP_ATOMIC_RMW16_CMPXCHGU_I32 = 0x4B
+	OP_ATOMIC_RMW8_CMPXCHGU_I64  = 0x4C
+	OP_ATOMIC_RMW16_CMPXCHGU_I64 = 0x4D
+	OP_ATOMIC_RMW32_CMPXCHGU_I64 = 0x4E
 )
 
 func defaultInstructionMap() map[uint8]Instruction {
-	return map[uint8]Instruction{
+	m := map[uint8]Instruction{
 		OP_NOP:       NOP,
 		OP_END:       END, // End of function
 		OP_CONST_I32: CONST_I32,
@@ -44,5 +325,70 @@ func defaultInstructionMap() map[uint8]Instruction {
 		OP_MUL_I64:   MUL_I64,
 		OP_DIVS_I64:  DIVS_I64,
 		OP_DIVU_I64:  DIVU_I64,
+		OP_DROP:      DROP,
+		OP_SELECT:    SELECT,
+		OP_SELECT_T:  SELECT_T,
+
+		OP_PREFIX_ATOMIC: ATOMIC_PREFIX,
 	}
+	for op, ins := range numericInstructionMap {
+		m[op] = ins
+	}
+	return m
+}
+
+// Instances run code from a module, so the constants take LEB128
+// immediates and the structured control instructions are available
+func instanceInstructionMap() map[uint8]Instruction {
+	im := defaultInstructionMap()
+	im[OP_CONST_I32] = CONST_I32_LEB
+	im[OP_CONST_I64] = CONST_I64_LEB
+	im[OP_END] = END_STRUCTURED
+
+	im[OP_UNREACHABLE] = UNREACHABLE
+	im[OP_BLOCK] = BLOCK
+	im[OP_LOOP] = LOOP
+	im[OP_IF] = IF
+	im[OP_ELSE] = ELSE
+	im[OP_BR] = BR
+	im[OP_BR_IF] = BR_IF
+	im[OP_BR_TABLE] = BR_TABLE
+	im[OP_RETURN] = RETURN
+	im[OP_CALL] = CALL
+	im[OP_CALL_INDIRECT] = CALL_INDIRECT
+
+	im[OP_LOCAL_GET] = LOCAL_GET
+	im[OP_LOCAL_SET] = LOCAL_SET
+	im[OP_LOCAL_TEE] = LOCAL_TEE
+	im[OP_GLOBAL_GET] = GLOBAL_GET
+	im[OP_GLOBAL_SET] = GLOBAL_SET
+
+	im[OP_LOAD_I32] = memoryLoad("LOAD_I32", TYPE_I32, 4, false)
+	im[OP_LOAD_I64] = memoryLoad("LOAD_I64", TYPE_I64, 8, false)
+	im[OP_LOAD_F32] = memoryLoad("LOAD_F32", TYPE_F32, 4, false)
+	im[OP_LOAD_F64] = memoryLoad("LOAD_F64", TYPE_F64, 8, false)
+	im[OP_LOAD8S_I32] = memoryLoad("LOAD8S_I32", TYPE_I32, 1, true)
+	im[OP_LOAD8U_I32] = memoryLoad("LOAD8U_I32", TYPE_I32, 1, false)
+	im[OP_LOAD16S_I32] = memoryLoad("LOAD16S_I32", TYPE_I32, 2, true)
+	im[OP_LOAD16U_I32] = memoryLoad("LOAD16U_I32", TYPE_I32, 2, false)
+	im[OP_LOAD8S_I64] = memoryLoad("LOAD8S_I64", TYPE_I64, 1, true)
+	im[OP_LOAD8U_I64] = memoryLoad("LOAD8U_I64", TYPE_I64, 1, false)
+	im[OP_LOAD16S_I64] = memoryLoad("LOAD16S_I64", TYPE_I64, 2, true)
+	im[OP_LOAD16U_I64] = memoryLoad("LOAD16U_I64", TYPE_I64, 2, false)
+	im[OP_LOAD32S_I64] = memoryLoad("LOAD32S_I64", TYPE_I64, 4, true)
+	im[OP_LOAD32U_I64] = memoryLoad("LOAD32U_I64", TYPE_I64, 4, false)
+	im[OP_STORE_I32] = memoryStore("STORE_I32", TYPE_I32, 4)
+	im[OP_STORE_I64] = memoryStore("STORE_I64", TYPE_I64, 8)
+	im[OP_STORE_F32] = memoryStore("STORE_F32", TYPE_F32, 4)
+	im[OP_STORE_F64] = memoryStore("STORE_F64", TYPE_F64, 8)
+	im[OP_STORE8_I32] = memoryStore("STORE8_I32", TYPE_I32, 1)
+	im[OP_STORE16_I32] = memoryStore("STORE16_I32", TYPE_I32, 2)
+	im[OP_STORE8_I64] = memoryStore("STORE8_I64", TYPE_I64, 1)
+	im[OP_STORE16_I64] = memoryStore("STORE16_I64", TYPE_I64, 2)
+	im[OP_STORE32_I64] = memoryStore("STORE32_I64", TYPE_I64, 4)
+	im[OP_MEMORY_SIZE] = MEMORY_SIZE
+	im[OP_MEMORY_GROW] = MEMORY_GROW
+
+	im[OP_PREFIX_MISC] = MISC_PREFIX
+	return im
 }
@@ -0,0 +1,159 @@
+package wasmvm
+
+import "strings"
+
+// The text format names of the instructions, as used by the WAT parser
+
+// An instruction as it appears in a binary: the opcode and, for the
+// 0xFC and 0xFE prefixes, the sub-opcode
+type opcodeKey struct {
+	op  byte
+	sub uint32
+}
+
+var instructionNames = map[opcodeKey]string{}
+
+var instructionsByName = map[string]opcodeKey{}
+
+func defineInstruction(name string, op byte, sub uint32) {
+	key := opcodeKey{op, sub}
+	instructionNames[key] = name
+	instructionsByName[name] = key
+}
+
+func init() {
+	for op, name := range map[byte]string{
+		OP_UNREACHABLE: "unreachable", OP_NOP: "nop", OP_BLOCK: "block", OP_LOOP: "loop",
+		OP_IF: "if", OP_ELSE: "else", OP_END: "end", OP_BR: "br", OP_BR_IF: "br_if",
+		OP_BR_TABLE: "br_table", OP_RETURN: "return", OP_CALL: "call",
+		OP_CALL_INDIRECT: "call_indirect", OP_DROP: "drop", OP_SELECT: "select",
+		OP_LOCAL_GET: "local.get", OP_LOCAL_SET: "local.set", OP_LOCAL_TEE: "local.tee",
+		OP_GLOBAL_GET: "global.get", OP_GLOBAL_SET: "global.set", 0x25: "table.get", 0x26: "table.set",
+		OP_MEMORY_SIZE: "memory.size", OP_MEMORY_GROW: "memory.grow",
+		0xD0: "ref.null", 0xD1: "ref.is_null", 0xD2: "ref.func",
+	} {
+		defineInstruction(name, op, 0)
+	}
+	// Typed select shares the name, the immediate tells them apart
+	instructionNames[opcodeKey{OP_SELECT_T, 0}] = "select"
+
+	loads := []string{
+		"i32.load", "i64.load", "f32.load", "f64.load",
+		"i32.load8_s", "i32.load8_u", "i32.load16_s", "i32.load16_u",
+		"i64.load8_s", "i64.load8_u", "i64.load16_s", "i64.load16_u", "i64.load32_s", "i64.load32_u",
+		"i32.store", "i64.store", "f32.store", "f64.store",
+		"i32.store8", "i32.store16", "i64.store8", "i64.store16", "i64.store32",
+	}
+	for i, name := range loads {
+		defineInstruction(name, OP_LOAD_I32+byte(i), 0)
+	}
+	for i, name := range []string{"i32.const", "i64.const", "f32.const", "f64.const"} {
+		defineInstruction(name, OP_CONST_I32+byte(i), 0)
+	}
+
+	// The numeric instructions come in runs that only differ by type
+	op := byte(OP_EQZ_I32)
+	run := func(prefix string, names ...string) {
+		for _, name := range names {
+			defineInstruction(prefix+"."+name, op, 0)
+			op++
+		}
+	}
+	icmp := []string{"eqz", "eq", "ne", "lt_s", "lt_u", "gt_s", "gt_u", "le_s", "le_u", "ge_s", "ge_u"}
+	fcmp := []string{"eq", "ne", "lt", "gt", "le", "ge"}
+	iarith := []string{"clz", "ctz", "popcnt", "add", "sub", "mul", "div_s", "div_u", "rem_s", "rem_u",
+		"and", "or", "xor", "shl", "shr_s", "shr_u", "rotl", "rotr"}
+	farith := []string{"abs", "neg", "ceil", "floor", "trunc", "nearest", "sqrt",
+		"add", "sub", "mul", "div", "min", "max", "copysign"}
+	run("i32", icmp...)
+	run("i64", icmp...)
+	run("f32", fcmp...)
+	run("f64", fcmp...)
+	run("i32", iarith...)
+	run("i64", iarith...)
+	run("f32", farith...)
+	run("f64", farith...)
+	run("i32", "wrap_i64", "trunc_f32_s", "trunc_f32_u", "trunc_f64_s", "trunc_f64_u")
+	run("i64", "extend_i32_s", "extend_i32_u", "trunc_f32_s", "trunc_f32_u", "trunc_f64_s", "trunc_f64_u")
+	run("f32", "convert_i32_s", "convert_i32_u", "convert_i64_s", "convert_i64_u", "demote_f64")
+	run("f64", "convert_i32_s", "convert_i32_u", "convert_i64_s", "convert_i64_u", "promote_f32")
+	run("i32", "reinterpret_f32")
+	run("i64", "reinterpret_f64")
+	run("f32", "reinterpret_i32")
+	run("f64", "reinterpret_i64")
+	run("i32", "extend8_s", "extend16_s")
+	run("i64", "extend8_s", "extend16_s", "extend32_s")
+
+	for sub, name := range []string{
+		"i32.trunc_sat_f32_s", "i32.trunc_sat_f32_u", "i32.trunc_sat_f64_s", "i32.trunc_sat_f64_u",
+		"i64.trunc_sat_f32_s", "i64.trunc_sat_f32_u", "i64.trunc_sat_f64_s", "i64.trunc_sat_f64_u",
+		"memory.init", "data.drop", "memory.copy", "memory.fill",
+		"table.init", "elem.drop", "table.copy", "table.grow", "table.size", "table.fill",
+	} {
+		defineInstruction(name, OP_PREFIX_MISC, uint32(sub))
+	}
+
+	for sub, name := range []string{"memory.atomic.notify", "memory.atomic.wait32", "memory.atomic.wait64", "atomic.fence"} {
+		defineInstruction(name, OP_PREFIX_ATOMIC, uint32(sub))
+	}
+	sub := uint32(OP_ATOMIC_LOAD_I32)
+	for _, name := range []string{
+		"i32.atomic.load", "i64.atomic.load", "i32.atomic.load8_u", "i32.atomic.load16_u",
+		"i64.atomic.load8_u", "i64.atomic.load16_u", "i64.atomic.load32_u",
+		"i32.atomic.store", "i64.atomic.store", "i32.atomic.store8", "i32.atomic.store16",
+		"i64.atomic.store8", "i64.atomic.store16", "i64.atomic.store32",
+	} {
+		defineInstruction(name, OP_PREFIX_ATOMIC, sub)
+		sub++
+	}
+	for _, rmw := range []string{"add", "sub", "and", "or", "xor", "xchg", "cmpxchg"} {
+		for _, name := range []string{
+			"i32.atomic.rmw." + rmw, "i64.atomic.rmw." + rmw,
+			"i32.atomic.rmw8." + rmw + "_u", "i32.atomic.rmw16." + rmw + "_u",
+			"i64.atomic.rmw8." + rmw + "_u", "i64.atomic.rmw16." + rmw + "_u", "i64.atomic.rmw32." + rmw + "_u",
+		} {
+			defineInstruction(name, OP_PREFIX_ATOMIC, sub)
+			sub++
+		}
+	}
+}
+
+// Whether the instruction takes a memarg
+func hasMemArg(key opcodeKey) bool {
+	switch key.op {
+	case OP_PREFIX_ATOMIC:
+		return key.sub != OP_ATOMIC_FENCE
+	case OP_PREFIX_MISC:
+		return false
+	}
+	return key.op >= OP_LOAD_I32 && key.op <= OP_STORE32_I64
+}
+
+// Size in octets of what a memory instruction accesses, which is the
+// alignment a memarg defaults to. It's spelled out in the name as in
+// i64.load16_s, or else follows from the type.
+func naturalAlignment(name string) uint32 {
+	if strings.HasPrefix(name, "memory.atomic.") {
+		if name == "memory.atomic.wait64" {
+			return 8
+		}
+		return 4
+	}
+	op := name[strings.LastIndex(name, ".")+1:]
+	if strings.Contains(name, ".rmw") {
+		// The width is on the rmw part, as in i32.atomic.rmw8.add_u
+		parts := strings.Split(name, ".")
+		op = parts[len(parts)-2]
+	}
+	switch {
+	case strings.Contains(op, "8"):
+		return 1
+	case strings.Contains(op, "16"):
+		return 2
+	case strings.Contains(op, "32"):
+		return 4
+	case strings.HasPrefix(name, "i64"), strings.HasPrefix(name, "f64"):
+		return 8
+	}
+	return 4
+}
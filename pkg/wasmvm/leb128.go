@@ -0,0 +1,141 @@
+package wasmvm
+
+import "errors"
+
+// LEB128 as used by the WebAssembly binary format. The decoders take
+// the maximum width in bits so that over-long encodings are rejected
+// the same way the specification does.
+
+var errLEB128Truncated = errors.New("leb128: unexpected end of input")
+var errLEB128Overflow = errors.New("leb128: integer too large")
+
+// Decodes an unsigned LEB128 of at most bits width. Returns the value
+// and the number of octets consumed.
+func DecodeULEB128(data []byte, bits uint) (uint64, int, error) {
+	var result uint64
+	var shift uint
+	for i, b := range data {
+		if shift >= bits || (bits-shift < 7 && uint64(b&0x7F)>>(bits-shift) != 0) {
+			return 0, 0, errLEB128Overflow
+		}
+		result |= uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return result, i + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, errLEB128Truncated
+}
+
+// Decodes a signed LEB128 of at most bits width, sign extended to 64 bits
+func DecodeSLEB128(data []byte, bits uint) (int64, int, error) {
+	var result int64
+	var shift uint
+	for i, b := range data {
+		if shift >= bits {
+			return 0, 0, errLEB128Overflow
+		}
+		if bits-shift < 7 {
+			// The unused bits of the final octet must all match the sign bit
+			rem := bits - shift
+			signAndUnused := int8(b<<1) >> rem
+			if b&0x80 != 0 || (signAndUnused != 0 && signAndUnused != -1) {
+				return 0, 0, errLEB128Overflow
+			}
+		}
+		result |= int64(b&0x7F) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				result |= -1 << shift
+			}
+			return result, i + 1, nil
+		}
+	}
+	return 0, 0, errLEB128Truncated
+}
+
+// Canonical (shortest) unsigned encoding
+func AppendULEB128(dst []byte, v uint64) []byte {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v != 0 {
+			dst = append(dst, b|0x80)
+			continue
+		}
+		return append(dst, b)
+	}
+}
+
+// Canonical (shortest) signed encoding
+func AppendSLEB128(dst []byte, v int64) []byte {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(dst, b)
+		}
+		dst = append(dst, b|0x80)
+	}
+}
+
+// Longest LEB128 for a 64 bit value
+const maxLEB128Width = 10
+
+// Reads an unsigned LEB128 immediate from the instruction stream.
+// Returns the value and the address just past it. Traps on failure.
+func (vm *VMState) fetchULEB128(op string, addr uint64, bits uint) (uint64, uint64, error) {
+	var buf [maxLEB128Width]byte
+	n := 0
+	for n < len(buf) {
+		b, res := vm.fetch(addr+uint64(n), 1)
+		if res != MemoryAccessOK {
+			return 0, 0, vm.memoryAccessTrap(op, TrapAccessExecute, addr+uint64(n), 1, res)
+		}
+		buf[n] = b[0]
+		n++
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+	val, width, err := DecodeULEB128(buf[:n], bits)
+	if err != nil {
+		return 0, 0, vm.SetTrapError(&TrapError{
+			Type:    TrapMalformedImmediate,
+			Op:      op,
+			PC:      vm.PC,
+			Message: op + ": " + err.Error(),
+			Cause:   err,
+		})
+	}
+	return val, addr + uint64(width), nil
+}
+
+// Signed variant of fetchULEB128
+func (vm *VMState) fetchSLEB128(op string, addr uint64, bits uint) (int64, uint64, error) {
+	var buf [maxLEB128Width]byte
+	n := 0
+	for n < len(buf) {
+		b, res := vm.fetch(addr+uint64(n), 1)
+		if res != MemoryAccessOK {
+			return 0, 0, vm.memoryAccessTrap(op, TrapAccessExecute, addr+uint64(n), 1, res)
+		}
+		buf[n] = b[0]
+		n++
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+	val, width, err := DecodeSLEB128(buf[:n], bits)
+	if err != nil {
+		return 0, 0, vm.SetTrapError(&TrapError{
+			Type:    TrapMalformedImmediate,
+			Op:      op,
+			PC:      vm.PC,
+			Message: op + ": " + err.Error(),
+			Cause:   err,
+		})
+	}
+	return val, addr + uint64(width), nil
+}
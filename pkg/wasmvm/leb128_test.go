@@ -0,0 +1,97 @@
+package wasmvm_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestULEB128(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		bits      uint
+		expect    uint64
+		expectLen int
+		expectErr string
+	}{
+		{name: "zero", data: []byte{0x00}, bits: 32, expect: 0, expectLen: 1},
+		{name: "624485", data: []byte{0xE5, 0x8E, 0x26}, bits: 32, expect: 624485, expectLen: 3},
+		{name: "trailing data ignored", data: []byte{0x7F, 0xFF}, bits: 32, expect: 127, expectLen: 1},
+		{name: "non-canonical but in range", data: []byte{0x80, 0x80, 0x00}, bits: 32, expect: 0, expectLen: 3},
+		{name: "max u32", data: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x0F}, bits: 32, expect: math.MaxUint32, expectLen: 5},
+		{name: "max u64", data: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}, bits: 64, expect: math.MaxUint64, expectLen: 10},
+		{name: "u32 unused bits set", data: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x1F}, bits: 32, expectErr: "too large"},
+		{name: "u32 too long", data: []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x00}, bits: 32, expectErr: "too large"},
+		{name: "truncated", data: []byte{0x80}, bits: 32, expectErr: "unexpected end"},
+		{name: "empty", data: []byte{}, bits: 32, expectErr: "unexpected end"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			val, n, err := wasmvm.DecodeULEB128(tc.data, tc.bits)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expect, val)
+			assert.Equal(t, tc.expectLen, n)
+		})
+	}
+}
+
+func TestSLEB128(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		bits      uint
+		expect    int64
+		expectLen int
+		expectErr string
+	}{
+		{name: "zero", data: []byte{0x00}, bits: 32, expect: 0, expectLen: 1},
+		{name: "minus one", data: []byte{0x7F}, bits: 32, expect: -1, expectLen: 1},
+		{name: "-123456", data: []byte{0xC0, 0xBB, 0x78}, bits: 32, expect: -123456, expectLen: 3},
+		{name: "64", data: []byte{0xC0, 0x00}, bits: 32, expect: 64, expectLen: 2},
+		{name: "min i32", data: []byte{0x80, 0x80, 0x80, 0x80, 0x78}, bits: 32, expect: math.MinInt32, expectLen: 5},
+		{name: "max i32", data: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x07}, bits: 32, expect: math.MaxInt32, expectLen: 5},
+		{name: "min i64", data: []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x7F}, bits: 64, expect: math.MinInt64, expectLen: 10},
+		{name: "i32 unused bits mismatch", data: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x17}, bits: 32, expectErr: "too large"},
+		{name: "i32 continuation on last", data: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, bits: 32, expectErr: "too large"},
+		{name: "i32 too long", data: []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x00}, bits: 32, expectErr: "too large"},
+		{name: "truncated", data: []byte{0xFF}, bits: 64, expectErr: "unexpected end"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			val, n, err := wasmvm.DecodeSLEB128(tc.data, tc.bits)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expect, val)
+			assert.Equal(t, tc.expectLen, n)
+		})
+	}
+}
+
+func TestLEB128_RoundTrip(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 624485, math.MaxUint32, math.MaxUint64} {
+		enc := wasmvm.AppendULEB128(nil, v)
+		dec, n, err := wasmvm.DecodeULEB128(enc, 64)
+		assert.NoError(t, err)
+		assert.Equal(t, v, dec)
+		assert.Equal(t, len(enc), n)
+	}
+	for _, v := range []int64{0, 1, -1, 63, 64, -64, -65, -123456, math.MinInt32, math.MaxInt64, math.MinInt64} {
+		enc := wasmvm.AppendSLEB128(nil, v)
+		dec, n, err := wasmvm.DecodeSLEB128(enc, 64)
+		assert.NoError(t, err)
+		assert.Equal(t, v, dec)
+		assert.Equal(t, len(enc), n)
+	}
+	assert.Equal(t, []byte{0xE5, 0x8E, 0x26}, wasmvm.AppendULEB128(nil, 624485))
+	assert.Equal(t, []byte{0xC0, 0xBB, 0x78}, wasmvm.AppendSLEB128(nil, -123456))
+}
@@ -0,0 +1,294 @@
+package wasmvm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A table of references. Elements are nil for null references.
+type Table struct {
+	Type     TableType
+	Elements []*ExposedFunc
+}
+
+func NewTable(tt TableType) *Table {
+	return &Table{
+		Type:     tt,
+		Elements: make([]*ExposedFunc, tt.Limits.Min),
+	}
+}
+
+type Global struct {
+	Type  GlobalType
+	Value ValueStackEntry
+}
+
+// A memory provided by the host. Its current size in pages is taken
+// from the Memory; Max is the most it may grow to, nil for no limit.
+type HostMemory struct {
+	Memory Memory
+	Max    *uint64
+}
+
+func (hm *HostMemory) Type() MemoryType {
+	mt := MemoryType{Limits: Limits{Min: hm.Memory.Size() / WasmPageSize, Max: hm.Max}}
+	if am, ok := hm.Memory.(AtomicMemory); ok {
+		mt.Shared = am.Shared()
+	}
+	return mt
+}
+
+// Something that can satisfy an import. Only the field for Kind is set.
+type Extern struct {
+	Kind   ExternType
+	Func   *ExposedFunc
+	Table  *Table
+	Memory *HostMemory
+	Global *Global
+}
+
+func (e Extern) valid() bool {
+	switch e.Kind {
+	case ExternFunc:
+		return e.Func != nil && e.Func.Function != nil
+	case ExternTable:
+		return e.Table != nil
+	case ExternMemory:
+		return e.Memory != nil && e.Memory.Memory != nil
+	case ExternGlobal:
+		return e.Global != nil && e.Global.Value.EntryType == e.Global.Type.ValType
+	}
+	return false
+}
+
+// The imports of a module in index space order, ready to instantiate
+// against
+type ResolvedImports struct {
+	Funcs    []*ExposedFunc
+	Tables   []*Table
+	Memories []*HostMemory
+	Globals  []*Global
+}
+
+type LinkErrorType byte
+
+const (
+	UndefinedLinkError LinkErrorType = iota
+	LinkUnresolved
+	LinkKindMismatch
+	LinkTypeMismatch
+	LinkDuplicate
+	LinkInvalidExtern
+)
+
+var linkErrorTypeNames = map[LinkErrorType]string{
+	UndefinedLinkError: "UndefinedLinkError",
+	LinkUnresolved:     "LinkUnresolved",
+	LinkKindMismatch:   "LinkKindMismatch",
+	LinkTypeMismatch:   "LinkTypeMismatch",
+	LinkDuplicate:      "LinkDuplicate",
+	LinkInvalidExtern:  "LinkInvalidExtern",
+}
+
+var linkErrorMessageTemplates = map[LinkErrorType]string{
+	UndefinedLinkError: "unknown link error",
+	LinkUnresolved:     "not defined",
+	LinkKindMismatch:   "defined as a %s",
+	LinkTypeMismatch:   "expected %s, defined as %s",
+	LinkDuplicate:      "already defined",
+	LinkInvalidExtern:  "incomplete %s definition",
+}
+
+func (t LinkErrorType) String() string {
+	if name, ok := linkErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("LinkErrorType(%d)", t)
+}
+
+// A single import (or definition) the linker couldn't handle
+type LinkProblem struct {
+	Type   LinkErrorType
+	Module string
+	Name   string
+	Kind   ExternType
+	Msg    string
+}
+
+func newLinkProblem(eType LinkErrorType, module, name string, kind ExternType, paras ...any) LinkProblem {
+	msg, ok := linkErrorMessageTemplates[eType]
+	if !ok {
+		msg = linkErrorMessageTemplates[UndefinedLinkError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	return LinkProblem{Type: eType, Module: module, Name: name, Kind: kind, Msg: msg}
+}
+
+func (p LinkProblem) String() string {
+	return fmt.Sprintf("[%s] %s.%s (%s): %s", p.Type.String(), p.Module, p.Name, p.Kind, p.Msg)
+}
+
+// Lists every problem found, not just the first
+type LinkError struct {
+	Problems []LinkProblem
+}
+
+func (e *LinkError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = p.String()
+	}
+	return fmt.Sprintf("link failed with %d problem(s): %s", len(e.Problems), strings.Join(lines, "; "))
+}
+
+type linkKey struct {
+	module string
+	name   string
+}
+
+// Holds the host definitions that imports are resolved against, keyed
+// by module and name
+type Linker struct {
+	defs map[linkKey]Extern
+}
+
+func NewLinker() *Linker {
+	return &Linker{defs: map[linkKey]Extern{}}
+}
+
+func (l *Linker) Define(module, name string, ext Extern) (*Linker, error) {
+	if !ext.valid() {
+		return l, &LinkError{Problems: []LinkProblem{newLinkProblem(LinkInvalidExtern, module, name, ext.Kind, ext.Kind)}}
+	}
+	key := linkKey{module, name}
+	if _, ok := l.defs[key]; ok {
+		return l, &LinkError{Problems: []LinkProblem{newLinkProblem(LinkDuplicate, module, name, ext.Kind)}}
+	}
+	l.defs[key] = ext
+	return l, nil
+}
+
+func (l *Linker) DefineFunc(module, name string, ef *ExposedFunc) (*Linker, error) {
+	return l.Define(module, name, Extern{Kind: ExternFunc, Func: ef})
+}
+
+// Binds fn through NewHostFunc and defines it
+func (l *Linker) DefineHostFunc(module, name string, fn any) (*Linker, error) {
+	ef, err := NewHostFunc(fn)
+	if err != nil {
+		return l, err
+	}
+	return l.DefineFunc(module, name, ef)
+}
+
+// Defines every function of a VMConfig.ExposedFuncs style map under module
+func (l *Linker) DefineExposedFuncs(module string, funcs map[string]*ExposedFunc) (*Linker, error) {
+	for name, ef := range funcs {
+		if _, err := l.DefineFunc(module, name, ef); err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+// Defines every export of inst under module. Nothing is defined if any
+// of the names is already taken.
+func (l *Linker) DefineInstance(module string, inst *Instance) (*Linker, error) {
+	var problems []LinkProblem
+	for _, exp := range inst.Module.Exports {
+		if _, ok := l.defs[linkKey{module, exp.Name}]; ok {
+			problems = append(problems, newLinkProblem(LinkDuplicate, module, exp.Name, exp.Kind))
+		}
+	}
+	if len(problems) > 0 {
+		return l, &LinkError{Problems: problems}
+	}
+	for _, exp := range inst.Module.Exports {
+		ext, _ := inst.Export(exp.Name)
+		l.defs[linkKey{module, exp.Name}] = ext
+	}
+	return l, nil
+}
+
+func (l *Linker) DefineTable(module, name string, t *Table) (*Linker, error) {
+	return l.Define(module, name, Extern{Kind: ExternTable, Table: t})
+}
+
+func (l *Linker) DefineMemory(module, name string, mem *HostMemory) (*Linker, error) {
+	return l.Define(module, name, Extern{Kind: ExternMemory, Memory: mem})
+}
+
+func (l *Linker) DefineGlobal(module, name string, g *Global) (*Linker, error) {
+	return l.Define(module, name, Extern{Kind: ExternGlobal, Global: g})
+}
+
+func (l *Linker) Lookup(module, name string) (Extern, bool) {
+	ext, ok := l.defs[linkKey{module, name}]
+	return ext, ok
+}
+
+// Resolves every import of m, checking that each definition has the
+// kind and type the module expects. A LinkError lists all the imports
+// that couldn't be resolved.
+func (l *Linker) Resolve(m *Module) (*ResolvedImports, error) {
+	res := &ResolvedImports{}
+	var problems []LinkProblem
+	for _, imp := range m.Imports {
+		ext, ok := l.defs[linkKey{imp.Module, imp.Name}]
+		if !ok {
+			problems = append(problems, newLinkProblem(LinkUnresolved, imp.Module, imp.Name, imp.Kind))
+			continue
+		}
+		if ext.Kind != imp.Kind {
+			problems = append(problems, newLinkProblem(LinkKindMismatch, imp.Module, imp.Name, imp.Kind, ext.Kind))
+			continue
+		}
+		if want, got, ok := importTypeMatches(m, imp, ext); !ok {
+			problems = append(problems, newLinkProblem(LinkTypeMismatch, imp.Module, imp.Name, imp.Kind, want, got))
+			continue
+		}
+		switch imp.Kind {
+		case ExternFunc:
+			res.Funcs = append(res.Funcs, ext.Func)
+		case ExternTable:
+			res.Tables = append(res.Tables, ext.Table)
+		case ExternMemory:
+			res.Memories = append(res.Memories, ext.Memory)
+		case ExternGlobal:
+			res.Globals = append(res.Globals, ext.Global)
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &LinkError{Problems: problems}
+	}
+	return res, nil
+}
+
+// Returns the expected and actual types as text for the error message
+func importTypeMatches(m *Module, imp Import, ext Extern) (string, string, bool) {
+	switch imp.Kind {
+	case ExternFunc:
+		want := m.Types[imp.Func]
+		return want.String(), ext.Func.Type.String(), want.Equal(ext.Func.Type)
+	case ExternTable:
+		want, got := imp.Table, ext.Table.Type
+		got.Limits.Min = uint64(len(ext.Table.Elements))
+		return fmt.Sprintf("%s %s", want.ElemType, want.Limits), fmt.Sprintf("%s %s", got.ElemType, got.Limits),
+			want.ElemType == got.ElemType && got.Limits.Matches(want.Limits)
+	case ExternMemory:
+		want, got := imp.Memory, ext.Memory.Type()
+		return memoryTypeString(want), memoryTypeString(got), want.Shared == got.Shared && got.Limits.Matches(want.Limits)
+	default:
+		want, got := imp.Global, ext.Global.Type
+		return want.String(), got.String(), want == got
+	}
+}
+
+func memoryTypeString(mt MemoryType) string {
+	if mt.Shared {
+		return mt.Limits.String() + " shared"
+	}
+	return mt.Limits.String()
+}
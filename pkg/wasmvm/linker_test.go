@@ -0,0 +1,171 @@
+package wasmvm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pages(n uint64) *uint64 {
+	return &n
+}
+
+// Satisfies every import of linkTestModule
+func newTestLinker(t *testing.T) *wasmvm.Linker {
+	l := wasmvm.NewLinker()
+	_, err := l.DefineHostFunc("env", "add", func(a, b int32) int32 { return a + b })
+	require.NoError(t, err)
+	_, err = l.DefineMemory("env", "mem", &wasmvm.HostMemory{Memory: wasmvm.NewFlatMemory(make([]byte, wasmvm.WasmPageSize)), Max: pages(2)})
+	require.NoError(t, err)
+	_, err = l.DefineGlobal("env", "counter", &wasmvm.Global{
+		Type:  wasmvm.GlobalType{ValType: wasmvm.TYPE_I64, Mutable: true},
+		Value: i64(5),
+	})
+	require.NoError(t, err)
+	_, err = l.DefineTable("env", "table", wasmvm.NewTable(wasmvm.TableType{ElemType: wasmvm.RefFunc, Limits: wasmvm.Limits{Min: 4}}))
+	require.NoError(t, err)
+	return l
+}
+
+func TestLinker_Resolve(t *testing.T) {
+	m, err := wasmvm.DecodeModule(linkTestModule)
+	require.NoError(t, err)
+	l := newTestLinker(t)
+
+	res, err := l.Resolve(m)
+	require.NoError(t, err)
+	require.Len(t, res.Funcs, 1)
+	require.Len(t, res.Memories, 1)
+	require.Len(t, res.Globals, 1)
+	require.Len(t, res.Tables, 1)
+	assert.Equal(t, uint64(5), res.Globals[0].Value.Value_I64)
+	assert.Len(t, res.Tables[0].Elements, 4)
+
+	vm := newHostTestVM(t)
+	vm.ValueStack.PushInt32(2)
+	vm.ValueStack.PushInt32(3)
+	require.NoError(t, res.Funcs[0].Call(context.Background(), vm))
+	top, _ := vm.ValueStack.Pop()
+	assert.Equal(t, uint32(5), top.Value_I32)
+
+	ext, ok := l.Lookup("env", "mem")
+	assert.True(t, ok)
+	assert.Equal(t, wasmvm.ExternMemory, ext.Kind)
+}
+
+func TestLinker_ResolveErrors(t *testing.T) {
+	m, err := wasmvm.DecodeModule(linkTestModule)
+	require.NoError(t, err)
+
+	l := wasmvm.NewLinker()
+	// Wrong signature
+	_, err = l.DefineHostFunc("env", "add", func(a, b int64) int64 { return a + b })
+	require.NoError(t, err)
+	// Unbounded, but the import wants at most 2 pages
+	_, err = l.DefineMemory("env", "mem", &wasmvm.HostMemory{Memory: wasmvm.NewFlatMemory(make([]byte, wasmvm.WasmPageSize))})
+	require.NoError(t, err)
+	// A function where a global is expected
+	_, err = l.DefineHostFunc("env", "counter", func() {})
+	require.NoError(t, err)
+	// env.table is missing
+
+	_, err = l.Resolve(m)
+	var le *wasmvm.LinkError
+	require.ErrorAs(t, err, &le)
+	require.Len(t, le.Problems, 4)
+	assert.Equal(t, []wasmvm.LinkProblem{
+		{Type: wasmvm.LinkTypeMismatch, Module: "env", Name: "add", Kind: wasmvm.ExternFunc, Msg: "expected (i32, i32) -> (i32), defined as (i64, i64) -> (i64)"},
+		{Type: wasmvm.LinkTypeMismatch, Module: "env", Name: "mem", Kind: wasmvm.ExternMemory, Msg: "expected {min 1, max 2}, defined as {min 1}"},
+		{Type: wasmvm.LinkKindMismatch, Module: "env", Name: "counter", Kind: wasmvm.ExternGlobal, Msg: "defined as a func"},
+		{Type: wasmvm.LinkUnresolved, Module: "env", Name: "table", Kind: wasmvm.ExternTable, Msg: "not defined"},
+	}, le.Problems)
+	assert.Contains(t, err.Error(), "link failed with 4 problem(s): [LinkTypeMismatch] env.add (func)")
+
+	tests := []struct {
+		name   string
+		define func(l *wasmvm.Linker) (*wasmvm.Linker, error)
+		expect string
+	}{
+		{
+			name: "immutable global",
+			define: func(l *wasmvm.Linker) (*wasmvm.Linker, error) {
+				return l.DefineGlobal("env", "counter", &wasmvm.Global{Type: wasmvm.GlobalType{ValType: wasmvm.TYPE_I64}, Value: i64(0)})
+			},
+			expect: "expected mut i64, defined as i64",
+		},
+		{
+			name: "small memory",
+			define: func(l *wasmvm.Linker) (*wasmvm.Linker, error) {
+				return l.DefineMemory("env", "mem", &wasmvm.HostMemory{Memory: wasmvm.NewFlatMemory(make([]byte, 100)), Max: pages(2)})
+			},
+			expect: "expected {min 1, max 2}, defined as {min 0, max 2}",
+		},
+		{
+			name: "shared memory",
+			define: func(l *wasmvm.Linker) (*wasmvm.Linker, error) {
+				return l.DefineMemory("env", "mem", &wasmvm.HostMemory{Memory: wasmvm.NewFlatSharedMemory(wasmvm.WasmPageSize), Max: pages(1)})
+			},
+			expect: "expected {min 1, max 2}, defined as {min 1, max 1} shared",
+		},
+		{
+			name: "externref table",
+			define: func(l *wasmvm.Linker) (*wasmvm.Linker, error) {
+				return l.DefineTable("env", "table", wasmvm.NewTable(wasmvm.TableType{ElemType: wasmvm.RefExtern, Limits: wasmvm.Limits{Min: 2}}))
+			},
+			expect: "expected funcref {min 2}, defined as externref {min 2}",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			full := newTestLinker(t)
+			replaced, err := tc.define(wasmvm.NewLinker())
+			require.NoError(t, err)
+			// Everything else comes from the working linker
+			for _, imp := range m.Imports {
+				if _, ok := replaced.Lookup(imp.Module, imp.Name); !ok {
+					ext, _ := full.Lookup(imp.Module, imp.Name)
+					_, err := replaced.Define(imp.Module, imp.Name, ext)
+					require.NoError(t, err)
+				}
+			}
+			_, err = replaced.Resolve(m)
+			var le *wasmvm.LinkError
+			require.ErrorAs(t, err, &le)
+			require.Len(t, le.Problems, 1)
+			assert.Equal(t, wasmvm.LinkTypeMismatch, le.Problems[0].Type)
+			assert.Equal(t, tc.expect, le.Problems[0].Msg)
+		})
+	}
+}
+
+func TestLinker_Define(t *testing.T) {
+	l := wasmvm.NewLinker()
+	_, err := l.DefineExposedFuncs("env", map[string]*wasmvm.ExposedFunc{
+		"a": wasmvm.HostFunc0_0(func(context.Context, *wasmvm.VMState) error { return nil }),
+	})
+	require.NoError(t, err)
+
+	_, err = l.DefineHostFunc("env", "a", func() {})
+	assert.EqualError(t, err, "link failed with 1 problem(s): [LinkDuplicate] env.a (func): already defined")
+	// Same name in another module is fine
+	_, err = l.DefineHostFunc("wasi", "a", func() {})
+	assert.NoError(t, err)
+
+	_, err = l.DefineHostFunc("env", "b", func(string) {})
+	var he *wasmvm.HostFuncError
+	assert.ErrorAs(t, err, &he)
+
+	_, err = l.DefineGlobal("env", "g", &wasmvm.Global{Type: wasmvm.GlobalType{ValType: wasmvm.TYPE_F32}, Value: i32(1)})
+	var le *wasmvm.LinkError
+	require.ErrorAs(t, err, &le)
+	assert.Equal(t, wasmvm.LinkInvalidExtern, le.Problems[0].Type)
+	_, err = l.DefineMemory("env", "m", nil)
+	assert.ErrorAs(t, err, &le)
+	_, err = l.DefineFunc("env", "f", &wasmvm.ExposedFunc{})
+	assert.ErrorAs(t, err, &le)
+	_, ok := l.Lookup("env", "g")
+	assert.False(t, ok)
+}
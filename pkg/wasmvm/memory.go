@@ -0,0 +1,318 @@
+package wasmvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Size of a single shard for the sharded memory compositor. Later
+// features (permissions, snapshots, shared ownership) operate on
+// this granularity as well.
+const MemoryShardSize = 4096
+
+// The result of a memory access. This is intentionally not an error
+// so that the hot path doesn't allocate; the VM converts non-OK
+// results into the appropriate TrapError.
+type MemoryAccessResult byte
+
+const (
+	MemoryAccessOK MemoryAccessResult = iota
+	MemoryAccessOutOfBounds
+	MemoryAccessDenied
+)
+
+var memoryAccessResultNames = map[MemoryAccessResult]string{
+	MemoryAccessOK:          "MemoryAccessOK",
+	MemoryAccessOutOfBounds: "MemoryAccessOutOfBounds",
+	MemoryAccessDenied:      "MemoryAccessDenied",
+}
+
+func (r MemoryAccessResult) String() string {
+	if name, ok := memoryAccessResultNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("MemoryAccessResult(%d)", r)
+}
+
+// The execution context an access is performed under. For now, this
+// is only the ring; the compositors only use the logical address, but
+// ring-aware mapping will need it later.
+type MemoryContext struct {
+	Ring uint8
+	// Closed when an access that blocks, an atomic wait, should give
+	// up. Nil for accesses that can't be interrupted.
+	Cancel <-chan struct{}
+}
+
+// Memory is the compositor that sits between the VM and the backing
+// storage. Each access takes the execution context, a logical address
+// and a buffer; the purpose of the access is given by the method used.
+// Implementations must not partially apply an access that does not
+// return MemoryAccessOK.
+type Memory interface {
+	// Size in octets of the logical address space
+	Size() uint64
+	// Copies len(buf) octets starting at addr into buf
+	Read(ctx MemoryContext, addr uint64, buf []byte) MemoryAccessResult
+	// Copies data into memory starting at addr
+	Write(ctx MemoryContext, addr uint64, data []byte) MemoryAccessResult
+	// Same as Read, but for instruction fetch
+	Execute(ctx MemoryContext, addr uint64, buf []byte) MemoryAccessResult
+}
+
+// Memories that memory.grow can extend. Restoring a snapshot taken
+// before cuts a grown memory back to the size it had then.
+type GrowableMemory interface {
+	Memory
+	// Adds delta zeroed octets to the end, returning false if it can't
+	Grow(delta uint64) bool
+}
+
+// Which compositor NewVM constructs when the host doesn't supply one
+type MemoryModel byte
+
+const (
+	FlatMemoryModel MemoryModel = iota
+	ShardedMemoryModel
+)
+
+var memoryModelNames = map[MemoryModel]string{
+	FlatMemoryModel:    "flat",
+	ShardedMemoryModel: "sharded",
+}
+
+func (m MemoryModel) String() string {
+	if name, ok := memoryModelNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("MemoryModel(%d)", m)
+}
+
+func ParseMemoryModel(s string) (MemoryModel, error) {
+	key := strings.ToLower(strings.TrimSpace(s))
+	for k, v := range memoryModelNames {
+		if v == key {
+			return k, nil
+		}
+	}
+	return FlatMemoryModel, fmt.Errorf("unknown memory model: %q", s)
+}
+
+func (m *MemoryModel) UnmarshalText(text []byte) error {
+	val, err := ParseMemoryModel(string(text))
+	if err != nil {
+		return err
+	}
+	*m = val
+	return nil
+}
+
+// Written by name, or as a number when it has none
+func (m MemoryModel) MarshalJSON() ([]byte, error) {
+	if name, ok := memoryModelNames[m]; ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(int(m))
+}
+
+func (m *MemoryModel) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return m.UnmarshalText([]byte(s))
+	}
+	var i int
+	if err := json.Unmarshal(data, &i); err == nil {
+		*m = MemoryModel(i)
+		return nil
+	}
+	return fmt.Errorf("MemoryModel: cannot unmarshal %s", string(data))
+}
+
+// Bounds check that also guards against addr+length overflowing
+func inBounds(size, addr uint64, length int) bool {
+	end := addr + uint64(length)
+	return end >= addr && end <= size
+}
+
+// FlatMemory preserves the original behavior of a single contiguous
+// byte slice. It does not copy the slice it is given.
+type FlatMemory struct {
+	data  []byte
+	perms shardPermissions
+}
+
+func NewFlatMemory(data []byte) *FlatMemory {
+	return &FlatMemory{data: data}
+}
+
+// Direct access to the backing slice. This bypasses any checks, so
+// should be limited to host code and tests.
+func (m *FlatMemory) Bytes() []byte {
+	return m.data
+}
+
+func (m *FlatMemory) Size() uint64 {
+	return uint64(len(m.data))
+}
+
+func (m *FlatMemory) Read(ctx MemoryContext, addr uint64, buf []byte) MemoryAccessResult {
+	if !inBounds(uint64(len(m.data)), addr, len(buf)) {
+		return MemoryAccessOutOfBounds
+	}
+	if !m.perms.check(addr, len(buf), MemoryPermRead) {
+		return MemoryAccessDenied
+	}
+	return m.read(addr, buf)
+}
+
+// Copy out without any checks
+func (m *FlatMemory) read(addr uint64, buf []byte) MemoryAccessResult {
+	copy(buf, m.data[addr:])
+	return MemoryAccessOK
+}
+
+func (m *FlatMemory) Write(ctx MemoryContext, addr uint64, data []byte) MemoryAccessResult {
+	if !inBounds(uint64(len(m.data)), addr, len(data)) {
+		return MemoryAccessOutOfBounds
+	}
+	if !m.perms.check(addr, len(data), MemoryPermWrite) {
+		return MemoryAccessDenied
+	}
+	copy(m.data[addr:], data)
+	return MemoryAccessOK
+}
+
+func (m *FlatMemory) Execute(ctx MemoryContext, addr uint64, buf []byte) MemoryAccessResult {
+	if !inBounds(uint64(len(m.data)), addr, len(buf)) {
+		return MemoryAccessOutOfBounds
+	}
+	if !m.perms.check(addr, len(buf), MemoryPermExecute) {
+		return MemoryAccessDenied
+	}
+	return m.read(addr, buf)
+}
+
+// Grows the memory by delta octets
+func (m *FlatMemory) Grow(delta uint64) bool {
+	m.data = append(m.data, make([]byte, delta)...)
+	m.perms.grow(m.Size())
+	return true
+}
+
+// ShardedMemory splits the address space into MemoryShardSize shards.
+// Shards are only allocated once written; reading an unallocated
+// shard yields zeros.
+type ShardedMemory struct {
+	size   uint64
+	shards [][]byte
+	perms  shardPermissions
+
+	// Set when created from a snapshot. Borrowed shards still belong to
+	// the snapshot and are copied on the first write; dirty lists the
+	// shards that no longer match it.
+	snapshot *MemorySnapshot
+	borrowed []bool
+	dirty    []uint64
+}
+
+func NewShardedMemory(size uint64) *ShardedMemory {
+	count := (size + MemoryShardSize - 1) / MemoryShardSize
+	return &ShardedMemory{
+		size:   size,
+		shards: make([][]byte, count),
+	}
+}
+
+func (m *ShardedMemory) Size() uint64 {
+	return m.size
+}
+
+// Grows the memory by delta octets. The new shards are unallocated like
+// the rest of the untouched memory.
+func (m *ShardedMemory) Grow(delta uint64) bool {
+	m.size += delta
+	count := (m.size + MemoryShardSize - 1) / MemoryShardSize
+	m.shards = append(m.shards, make([][]byte, count-uint64(len(m.shards)))...)
+	if m.borrowed != nil {
+		m.borrowed = append(m.borrowed, make([]bool, count-uint64(len(m.borrowed)))...)
+	}
+	m.perms.grow(m.size)
+	return true
+}
+
+// Number of shards, including the trailing partial one
+func (m *ShardedMemory) ShardCount() int {
+	return len(m.shards)
+}
+
+func (m *ShardedMemory) Read(ctx MemoryContext, addr uint64, buf []byte) MemoryAccessResult {
+	if !inBounds(m.size, addr, len(buf)) {
+		return MemoryAccessOutOfBounds
+	}
+	if !m.perms.check(addr, len(buf), MemoryPermRead) {
+		return MemoryAccessDenied
+	}
+	return m.read(addr, buf)
+}
+
+// Copy out without any checks
+func (m *ShardedMemory) read(addr uint64, buf []byte) MemoryAccessResult {
+	for len(buf) > 0 {
+		idx, off := addr/MemoryShardSize, addr%MemoryShardSize
+		n := min(uint64(len(buf)), MemoryShardSize-off)
+		if shard := m.shards[idx]; shard != nil {
+			copy(buf[:n], shard[off:])
+		} else {
+			clear(buf[:n])
+		}
+		buf = buf[n:]
+		addr += n
+	}
+	return MemoryAccessOK
+}
+
+func (m *ShardedMemory) Write(ctx MemoryContext, addr uint64, data []byte) MemoryAccessResult {
+	if !inBounds(m.size, addr, len(data)) {
+		return MemoryAccessOutOfBounds
+	}
+	if !m.perms.check(addr, len(data), MemoryPermWrite) {
+		return MemoryAccessDenied
+	}
+	for len(data) > 0 {
+		idx, off := addr/MemoryShardSize, addr%MemoryShardSize
+		n := min(uint64(len(data)), MemoryShardSize-off)
+		shard := m.shards[idx]
+		if shard == nil || (m.borrowed != nil && m.borrowed[idx]) {
+			shard = m.ownShard(idx)
+		}
+		copy(shard[off:], data[:n])
+		data = data[n:]
+		addr += n
+	}
+	return MemoryAccessOK
+}
+
+// Allocates a private copy of shard idx
+func (m *ShardedMemory) ownShard(idx uint64) []byte {
+	shard := make([]byte, MemoryShardSize)
+	if m.shards[idx] != nil {
+		copy(shard, m.shards[idx])
+	}
+	m.shards[idx] = shard
+	if m.snapshot != nil {
+		m.borrowed[idx] = false
+		m.dirty = append(m.dirty, idx)
+	}
+	return shard
+}
+
+func (m *ShardedMemory) Execute(ctx MemoryContext, addr uint64, buf []byte) MemoryAccessResult {
+	if !inBounds(m.size, addr, len(buf)) {
+		return MemoryAccessOutOfBounds
+	}
+	if !m.perms.check(addr, len(buf), MemoryPermExecute) {
+		return MemoryAccessDenied
+	}
+	return m.read(addr, buf)
+}
@@ -0,0 +1,284 @@
+package wasmvm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Permission bits, tracked per MemoryShardSize shard
+type MemoryPermission byte
+
+const (
+	MemoryPermRead MemoryPermission = 1 << iota
+	MemoryPermWrite
+	MemoryPermExecute
+
+	MemoryPermNone MemoryPermission = 0
+	MemoryPermRW                    = MemoryPermRead | MemoryPermWrite
+	MemoryPermRX                    = MemoryPermRead | MemoryPermExecute
+	MemoryPermRWX                   = MemoryPermRead | MemoryPermWrite | MemoryPermExecute
+)
+
+// Renders in the familiar "r-x" form
+func (p MemoryPermission) String() string {
+	if p&^MemoryPermRWX != 0 {
+		return fmt.Sprintf("MemoryPermission(%d)", p)
+	}
+	out := []byte("---")
+	if p&MemoryPermRead != 0 {
+		out[0] = 'r'
+	}
+	if p&MemoryPermWrite != 0 {
+		out[1] = 'w'
+	}
+	if p&MemoryPermExecute != 0 {
+		out[2] = 'x'
+	}
+	return string(out)
+}
+
+// Accepts the "r-x" form as well as a bare "rx"
+func ParseMemoryPermission(s string) (MemoryPermission, error) {
+	perm := MemoryPermNone
+	for _, c := range strings.ToLower(strings.TrimSpace(s)) {
+		switch c {
+		case 'r':
+			perm |= MemoryPermRead
+		case 'w':
+			perm |= MemoryPermWrite
+		case 'x':
+			perm |= MemoryPermExecute
+		case '-':
+		default:
+			return MemoryPermNone, fmt.Errorf("unknown memory permission: %q", s)
+		}
+	}
+	return perm, nil
+}
+
+func (p *MemoryPermission) UnmarshalText(text []byte) error {
+	val, err := ParseMemoryPermission(string(text))
+	if err != nil {
+		return err
+	}
+	*p = val
+	return nil
+}
+
+// Reported when a permission change is rejected
+type MemoryPermissionError struct {
+	Addr   uint64
+	Length uint64
+	Perm   MemoryPermission
+	Msg    string
+}
+
+func (e *MemoryPermissionError) Error() string {
+	return fmt.Sprintf("[MemoryPermissionError] %s (addr=%d length=%d perm=%s)", e.Msg, e.Addr, e.Length, e.Perm)
+}
+
+const errmsg_PermissionWX = "write and execute on the same shard violates the W^X policy"
+const errmsg_PermissionOOB = "permission range out of bounds"
+const errmsg_PermissionUnsupported = "memory does not support permissions"
+
+// Memory compositors that track per-shard permissions. Both of the
+// built-in compositors implement this.
+type PermissionedMemory interface {
+	Memory
+	// Applies perm to every shard overlapping [addr, addr+length)
+	SetPermissions(addr uint64, length uint64, perm MemoryPermission) error
+	// Permission of the shard containing addr
+	Permissions(addr uint64) MemoryPermission
+	// Host override for the W^X policy. Clearing it takes write away
+	// from the shards that are write and execute.
+	SetAllowWriteExecute(allow bool)
+}
+
+// Per-shard permission table shared by the compositors. A nil table
+// means that permissions were never applied and everything is allowed,
+// which is how a freshly constructed memory behaves until NewVM
+// applies the default policy.
+type shardPermissions struct {
+	perms   []MemoryPermission
+	allowWX bool
+}
+
+func (sp *shardPermissions) check(addr uint64, length int, need MemoryPermission) bool {
+	if sp.perms == nil || length == 0 {
+		return true
+	}
+	first := addr / MemoryShardSize
+	last := (addr + uint64(length) - 1) / MemoryShardSize
+	for i := first; i <= last; i++ {
+		if sp.perms[i]&need != need {
+			return false
+		}
+	}
+	return true
+}
+
+func (sp *shardPermissions) set(size uint64, addr uint64, length uint64, perm MemoryPermission) error {
+	if !sp.allowWX && perm&MemoryPermWrite != 0 && perm&MemoryPermExecute != 0 {
+		return &MemoryPermissionError{Addr: addr, Length: length, Perm: perm, Msg: errmsg_PermissionWX}
+	}
+	end := addr + length
+	if end < addr || end > size {
+		return &MemoryPermissionError{Addr: addr, Length: length, Perm: perm, Msg: errmsg_PermissionOOB}
+	}
+	if length == 0 {
+		return nil
+	}
+	if sp.perms == nil {
+		sp.perms = make([]MemoryPermission, (size+MemoryShardSize-1)/MemoryShardSize)
+		for i := range sp.perms {
+			sp.perms[i] = MemoryPermRWX
+		}
+	}
+	for i := addr / MemoryShardSize; i <= (end-1)/MemoryShardSize; i++ {
+		sp.perms[i] = perm
+	}
+	return nil
+}
+
+// Extends the table to a memory that grew to size. The new shards get
+// the same permissions as a memory that never had any set, less execute
+// while W^X is enforced.
+func (sp *shardPermissions) grow(size uint64) {
+	if sp.perms == nil {
+		return
+	}
+	perm := MemoryPermRWX
+	if !sp.allowWX {
+		perm = MemoryPermRW
+	}
+	for n := (size + MemoryShardSize - 1) / MemoryShardSize; uint64(len(sp.perms)) < n; {
+		sp.perms = append(sp.perms, perm)
+	}
+}
+
+// Shards that are write and execute when the override is cleared keep
+// execute, so code already there still runs, and become read only
+func (sp *shardPermissions) setAllowWX(allow bool) {
+	sp.allowWX = allow
+	if allow {
+		return
+	}
+	for i, perm := range sp.perms {
+		if perm&MemoryPermWrite != 0 && perm&MemoryPermExecute != 0 {
+			sp.perms[i] = perm &^ MemoryPermWrite
+		}
+	}
+}
+
+func (sp *shardPermissions) get(addr uint64) MemoryPermission {
+	if sp.perms == nil {
+		return MemoryPermRWX
+	}
+	idx := addr / MemoryShardSize
+	if idx >= uint64(len(sp.perms)) {
+		return MemoryPermNone
+	}
+	return sp.perms[idx]
+}
+
+func (m *FlatMemory) SetPermissions(addr uint64, length uint64, perm MemoryPermission) error {
+	return m.perms.set(m.Size(), addr, length, perm)
+}
+
+func (m *FlatMemory) Permissions(addr uint64) MemoryPermission {
+	return m.perms.get(addr)
+}
+
+func (m *FlatMemory) SetAllowWriteExecute(allow bool) {
+	m.perms.setAllowWX(allow)
+}
+
+func (m *ShardedMemory) SetPermissions(addr uint64, length uint64, perm MemoryPermission) error {
+	return m.perms.set(m.Size(), addr, length, perm)
+}
+
+func (m *ShardedMemory) Permissions(addr uint64) MemoryPermission {
+	return m.perms.get(addr)
+}
+
+func (m *ShardedMemory) SetAllowWriteExecute(allow bool) {
+	m.perms.setAllowWX(allow)
+}
+
+// Wraps a memory while the image is loaded so the default policy
+// knows which shards hold the image
+type shardTracker struct {
+	Memory
+	touched []bool
+}
+
+func newShardTracker(mem Memory) *shardTracker {
+	return &shardTracker{
+		Memory:  mem,
+		touched: make([]bool, (mem.Size()+MemoryShardSize-1)/MemoryShardSize),
+	}
+}
+
+func (t *shardTracker) Write(ctx MemoryContext, addr uint64, data []byte) MemoryAccessResult {
+	res := t.Memory.Write(ctx, addr, data)
+	if res == MemoryAccessOK {
+		t.mark(addr, uint64(len(data)))
+	}
+	return res
+}
+
+func (t *shardTracker) mark(addr uint64, length uint64) {
+	if length == 0 {
+		return
+	}
+	for i := addr / MemoryShardSize; i <= (addr+length-1)/MemoryShardSize; i++ {
+		t.touched[i] = true
+	}
+}
+
+// The default W^X policy: shards holding the image are read/execute,
+// everything else is read/write. With AllowWriteExecute the host opts
+// back into everything being read/write/execute.
+func applyDefaultMemoryPolicy(mem PermissionedMemory, tracker *shardTracker, allowWX bool) {
+	mem.SetAllowWriteExecute(allowWX)
+	if allowWX {
+		mem.SetPermissions(0, mem.Size(), MemoryPermRWX)
+		return
+	}
+	for i, touched := range tracker.touched {
+		addr := uint64(i) * MemoryShardSize
+		length := min(MemoryShardSize, mem.Size()-addr)
+		if touched {
+			mem.SetPermissions(addr, length, MemoryPermRX)
+		} else {
+			mem.SetPermissions(addr, length, MemoryPermRW)
+		}
+	}
+}
+
+// Host API for changing permissions while the VM is running
+func (vm *VMState) SetMemoryPermissions(addr uint64, length uint64, perm MemoryPermission) error {
+	pm, ok := vm.Memory.(PermissionedMemory)
+	if !ok {
+		return &MemoryPermissionError{Addr: addr, Length: length, Perm: perm, Msg: errmsg_PermissionUnsupported}
+	}
+	return pm.SetPermissions(addr, length, perm)
+}
+
+// Reads guest memory on behalf of the running code, trapping on failure
+func (vm *VMState) ReadMemory(op string, addr uint64, buf []byte) error {
+	res := vm.Memory.Read(vm.MemoryContext(), addr, buf)
+	if res != MemoryAccessOK {
+		return vm.memoryAccessTrap(op, TrapAccessRead, addr, len(buf), res)
+	}
+	return nil
+}
+
+// Writes guest memory on behalf of the running code, trapping on failure
+func (vm *VMState) WriteMemory(op string, addr uint64, data []byte) error {
+	res := vm.Memory.Write(vm.MemoryContext(), addr, data)
+	if res != MemoryAccessOK {
+		return vm.memoryAccessTrap(op, TrapAccessWrite, addr, len(data), res)
+	}
+	return nil
+}
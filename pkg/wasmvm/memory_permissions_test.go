@@ -0,0 +1,243 @@
+package wasmvm_test
+
+import (
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Minimal compositor without permission support
+type plainMemory struct {
+	wasmvm.Memory
+}
+
+func TestMemoryPermissionString(t *testing.T) {
+	assert.Equal(t, "r-x", wasmvm.MemoryPermRX.String())
+	assert.Equal(t, "rw-", wasmvm.MemoryPermRW.String())
+	assert.Equal(t, "---", wasmvm.MemoryPermNone.String())
+	assert.Equal(t, "MemoryPermission(8)", wasmvm.MemoryPermission(8).String())
+}
+
+func TestParseMemoryPermission(t *testing.T) {
+	perm, err := wasmvm.ParseMemoryPermission("r-x")
+	assert.NoError(t, err)
+	assert.Equal(t, wasmvm.MemoryPermRX, perm)
+	perm, err = wasmvm.ParseMemoryPermission(" RW ")
+	assert.NoError(t, err)
+	assert.Equal(t, wasmvm.MemoryPermRW, perm)
+	_, err = wasmvm.ParseMemoryPermission("rwq")
+	assert.Error(t, err)
+
+	var p wasmvm.MemoryPermission
+	assert.NoError(t, p.UnmarshalText([]byte("x")))
+	assert.Equal(t, wasmvm.MemoryPermExecute, p)
+	assert.Error(t, p.UnmarshalText([]byte("z")))
+}
+
+func TestSetPermissions(t *testing.T) {
+	for kind, m := range newTestMemories(wasmvm.MemoryShardSize * 2) {
+		t.Run(kind, func(t *testing.T) {
+			mem := m.(wasmvm.PermissionedMemory)
+			// Unrestricted until something is applied
+			assert.Equal(t, wasmvm.MemoryPermRWX, mem.Permissions(0))
+
+			err := mem.SetPermissions(0, 1, wasmvm.MemoryPermRWX)
+			var permErr *wasmvm.MemoryPermissionError
+			require.ErrorAs(t, err, &permErr)
+			assert.Contains(t, err.Error(), "W^X")
+
+			err = mem.SetPermissions(wasmvm.MemoryShardSize, wasmvm.MemoryShardSize+1, wasmvm.MemoryPermRW)
+			require.ErrorAs(t, err, &permErr)
+			assert.Contains(t, err.Error(), "out of bounds")
+
+			// Touching one octet of a shard applies to the whole shard
+			require.NoError(t, mem.SetPermissions(wasmvm.MemoryShardSize-1, 1, wasmvm.MemoryPermRX))
+			require.NoError(t, mem.SetPermissions(0, 0, wasmvm.MemoryPermNone))
+			assert.Equal(t, wasmvm.MemoryPermRX, mem.Permissions(0))
+			assert.Equal(t, wasmvm.MemoryPermRWX, mem.Permissions(wasmvm.MemoryShardSize))
+			assert.Equal(t, wasmvm.MemoryPermNone, mem.Permissions(wasmvm.MemoryShardSize*5))
+
+			ctx := wasmvm.MemoryContext{}
+			buf := make([]byte, 2)
+			assert.Equal(t, wasmvm.MemoryAccessDenied, mem.Write(ctx, 0, buf))
+			assert.Equal(t, wasmvm.MemoryAccessOK, mem.Read(ctx, 0, buf))
+			assert.Equal(t, wasmvm.MemoryAccessOK, mem.Execute(ctx, 0, buf))
+			// Spans into an unrestricted shard, but the first one is still read only
+			assert.Equal(t, wasmvm.MemoryAccessDenied, mem.Write(ctx, wasmvm.MemoryShardSize-1, buf))
+
+			require.NoError(t, mem.SetPermissions(0, 1, wasmvm.MemoryPermNone))
+			assert.Equal(t, wasmvm.MemoryAccessDenied, mem.Read(ctx, 0, buf))
+			assert.Equal(t, wasmvm.MemoryAccessDenied, mem.Execute(ctx, 0, buf))
+
+			mem.SetAllowWriteExecute(true)
+			require.NoError(t, mem.SetPermissions(0, 1, wasmvm.MemoryPermRWX))
+			assert.Equal(t, wasmvm.MemoryAccessOK, mem.Write(ctx, 0, buf))
+		})
+	}
+}
+
+func newWXTestVM(t *testing.T, model wasmvm.MemoryModel, allowWX bool) *wasmvm.VMState {
+	program := []byte{
+		wasmvm.OP_CONST_I32, 2, 0, 0, 0,
+		wasmvm.OP_END,
+	}
+	vm, err := (&wasmvm.VMConfig{
+		Image: (&wasmvm.ImageConfig{}).SetArray(program).SetSize(uint64(len(program))),
+	}).
+		SetSize(wasmvm.MemoryShardSize * 3).
+		SetMemoryModel(model).
+		SetAllowWriteExecute(allowWX).
+		BuildVMState()
+	require.NoError(t, err)
+	return vm
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	for _, model := range []wasmvm.MemoryModel{wasmvm.FlatMemoryModel, wasmvm.ShardedMemoryModel} {
+		t.Run(model.String(), func(t *testing.T) {
+			vm := newWXTestVM(t, model, false)
+			mem := vm.Memory.(wasmvm.PermissionedMemory)
+			assert.Equal(t, wasmvm.MemoryPermRX, mem.Permissions(0))
+			assert.Equal(t, wasmvm.MemoryPermRW, mem.Permissions(wasmvm.MemoryShardSize))
+			assert.Equal(t, wasmvm.MemoryPermRW, mem.Permissions(wasmvm.MemoryShardSize*2))
+		})
+	}
+}
+
+func TestWXViolation_WriteToCode(t *testing.T) {
+	for _, model := range []wasmvm.MemoryModel{wasmvm.FlatMemoryModel, wasmvm.ShardedMemoryModel} {
+		t.Run(model.String(), func(t *testing.T) {
+			vm := newWXTestVM(t, model, false)
+			err := vm.WriteMemory("TEST", 1, []byte{9})
+			assert.Error(t, err)
+			require.NotNil(t, vm.TrapErr)
+			assert.Equal(t, wasmvm.TrapMemoryAccess, vm.TrapErr.Type)
+			assert.Equal(t, wasmvm.TrapAccessWrite, vm.TrapErr.AccessType)
+			require.NotNil(t, vm.TrapErr.Address)
+			assert.Equal(t, uint64(1), *vm.TrapErr.Address)
+			assert.Equal(t, "TEST: Access denied", vm.TrapErr.Message)
+		})
+	}
+}
+
+func TestWXViolation_ExecuteWrittenData(t *testing.T) {
+	for _, model := range []wasmvm.MemoryModel{wasmvm.FlatMemoryModel, wasmvm.ShardedMemoryModel} {
+		t.Run(model.String(), func(t *testing.T) {
+			vm := newWXTestVM(t, model, false)
+			addr := uint64(wasmvm.MemoryShardSize)
+			require.NoError(t, vm.WriteMemory("TEST", addr, []byte{wasmvm.OP_NOP}))
+			vm.PC = addr
+			err := vm.Step()
+			assert.Error(t, err)
+			require.NotNil(t, vm.TrapErr)
+			assert.Equal(t, wasmvm.TrapMemoryAccess, vm.TrapErr.Type)
+			assert.Equal(t, wasmvm.TrapAccessExecute, vm.TrapErr.AccessType)
+			assert.Equal(t, "STEP", vm.TrapErr.Op)
+
+			// The host flips the shard to executable and then it runs
+			vm = newWXTestVM(t, model, false)
+			require.NoError(t, vm.WriteMemory("TEST", addr, []byte{wasmvm.OP_NOP}))
+			require.NoError(t, vm.SetMemoryPermissions(addr, 1, wasmvm.MemoryPermRX))
+			vm.PC = addr
+			assert.NoError(t, vm.Step())
+			assert.Equal(t, addr+1, vm.PC)
+			// and is no longer writable
+			assert.Error(t, vm.WriteMemory("TEST", addr, []byte{wasmvm.OP_NOP}))
+		})
+	}
+}
+
+func TestWXViolation_ImmediateFetch(t *testing.T) {
+	// The opcode is in the code shard, but the immediate crosses
+	// into a data shard
+	vm, err := (&wasmvm.VMConfig{
+		Image: (&wasmvm.ImageConfig{}).SetSparseArray([]wasmvm.SparseArrayEntry{
+			{Offset: wasmvm.MemoryShardSize - 1, Array: []byte{wasmvm.OP_CONST_I32}},
+		}),
+	}).SetSize(wasmvm.MemoryShardSize * 2).BuildVMState()
+	require.NoError(t, err)
+	vm.PC = wasmvm.MemoryShardSize - 1
+	err = vm.Step()
+	assert.Error(t, err)
+	require.NotNil(t, vm.TrapErr)
+	assert.Equal(t, wasmvm.TrapMemoryAccess, vm.TrapErr.Type)
+	assert.Equal(t, wasmvm.TrapAccessExecute, vm.TrapErr.AccessType)
+	assert.Equal(t, "CONST_I32", vm.TrapErr.Op)
+}
+
+func TestAllowWriteExecute(t *testing.T) {
+	vm := newWXTestVM(t, wasmvm.FlatMemoryModel, true)
+	mem := vm.Memory.(wasmvm.PermissionedMemory)
+	assert.Equal(t, wasmvm.MemoryPermRWX, mem.Permissions(0))
+	assert.Equal(t, wasmvm.MemoryPermRWX, mem.Permissions(wasmvm.MemoryShardSize))
+
+	// Self modifying code is permitted with the override
+	require.NoError(t, vm.WriteMemory("TEST", 0, []byte{wasmvm.OP_NOP}))
+	assert.NoError(t, vm.Step())
+	assert.NoError(t, vm.SetMemoryPermissions(0, 1, wasmvm.MemoryPermRWX))
+}
+
+func TestAllowWriteExecute_Cleared(t *testing.T) {
+	for _, model := range []wasmvm.MemoryModel{wasmvm.FlatMemoryModel, wasmvm.ShardedMemoryModel} {
+		t.Run(model.String(), func(t *testing.T) {
+			vm := newWXTestVM(t, model, true)
+			mem := vm.Memory.(wasmvm.PermissionedMemory)
+			require.NoError(t, mem.SetPermissions(wasmvm.MemoryShardSize, 1, wasmvm.MemoryPermRW))
+
+			// The write and execute shards lose write, the others are left alone
+			mem.SetAllowWriteExecute(false)
+			assert.Equal(t, wasmvm.MemoryPermRX, mem.Permissions(0))
+			assert.Equal(t, wasmvm.MemoryPermRW, mem.Permissions(wasmvm.MemoryShardSize))
+			assert.Equal(t, wasmvm.MemoryPermRX, mem.Permissions(wasmvm.MemoryShardSize*2))
+			assert.NoError(t, vm.Step())
+			assert.Error(t, vm.WriteMemory("TEST", 0, []byte{wasmvm.OP_NOP}))
+			assert.Error(t, vm.SetMemoryPermissions(0, 1, wasmvm.MemoryPermRWX))
+
+			// Nor does growing bring them back
+			require.True(t, vm.Memory.(wasmvm.GrowableMemory).Grow(wasmvm.MemoryShardSize))
+			assert.Equal(t, wasmvm.MemoryPermRW, mem.Permissions(wasmvm.MemoryShardSize*3))
+		})
+	}
+}
+
+func TestDefaultPolicy_FlatMemorySeed(t *testing.T) {
+	vm, err := (&wasmvm.VMConfig{}).SetFlatMemory([]byte{wasmvm.OP_NOP, wasmvm.OP_END}).BuildVMState()
+	require.NoError(t, err)
+	assert.Equal(t, wasmvm.MemoryPermRX, vm.Memory.(wasmvm.PermissionedMemory).Permissions(0))
+	assert.NoError(t, vm.Step())
+}
+
+func TestDefaultPolicy_HostMemoryUntouched(t *testing.T) {
+	hostMem := wasmvm.NewFlatMemory(make([]byte, 8))
+	require.NoError(t, hostMem.SetPermissions(0, 8, wasmvm.MemoryPermRead))
+	vm, err := (&wasmvm.VMConfig{}).SetMemory(hostMem).BuildVMState()
+	require.NoError(t, err)
+	assert.Equal(t, wasmvm.MemoryPermRead, hostMem.Permissions(0))
+	assert.Error(t, vm.Step())
+	assert.Equal(t, wasmvm.TrapAccessExecute, vm.TrapErr.AccessType)
+}
+
+func TestSetMemoryPermissions_Unsupported(t *testing.T) {
+	vm, err := (&wasmvm.VMConfig{}).SetMemory(plainMemory{wasmvm.NewFlatMemory(make([]byte, 8))}).BuildVMState()
+	require.NoError(t, err)
+	err = vm.SetMemoryPermissions(0, 1, wasmvm.MemoryPermRX)
+	var permErr *wasmvm.MemoryPermissionError
+	require.ErrorAs(t, err, &permErr)
+	assert.Contains(t, err.Error(), "does not support")
+}
+
+func TestReadMemory(t *testing.T) {
+	vm := newWXTestVM(t, wasmvm.FlatMemoryModel, false)
+	buf := make([]byte, 1)
+	require.NoError(t, vm.ReadMemory("TEST", 0, buf))
+	assert.Equal(t, []byte{wasmvm.OP_CONST_I32}, buf)
+
+	err := vm.ReadMemory("TEST", wasmvm.MemoryShardSize*3, buf)
+	assert.Error(t, err)
+	require.NotNil(t, vm.TrapErr)
+	assert.Equal(t, wasmvm.TrapMemoryAccess, vm.TrapErr.Type)
+	assert.Equal(t, wasmvm.TrapAccessRead, vm.TrapErr.AccessType)
+	assert.Equal(t, "TEST: Out of bounds", vm.TrapErr.Message)
+}
@@ -0,0 +1,373 @@
+package wasmvm
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Read-modify-write operations for the atomic instructions
+type AtomicOp byte
+
+const (
+	AtomicAdd AtomicOp = iota
+	AtomicSub
+	AtomicAnd
+	AtomicOr
+	AtomicXor
+	AtomicXchg
+)
+
+func (op AtomicOp) apply(old uint64, val uint64) uint64 {
+	switch op {
+	case AtomicAdd:
+		return old + val
+	case AtomicSub:
+		return old - val
+	case AtomicAnd:
+		return old & val
+	case AtomicOr:
+		return old | val
+	case AtomicXor:
+		return old ^ val
+	default:
+		return val
+	}
+}
+
+// Result of memory.atomic.wait32/64 as defined by the threads proposal
+type WaitResult uint32
+
+const (
+	WaitOk WaitResult = iota
+	WaitNotEqual
+	WaitTimedOut
+	// Not a result the guest sees: MemoryContext.Cancel was closed, so
+	// the thread is being aborted or interrupted
+	WaitCancelled
+)
+
+// Memory compositors supporting the threads proposal. Widths are 1,
+// 2, 4 or 8 octets and addr must already be aligned to the width;
+// alignment is checked by the instruction since it traps differently.
+// Narrow values are zero extended into the uint64.
+type AtomicMemory interface {
+	Memory
+	// Whether the memory was declared with the shared limits flag
+	Shared() bool
+	AtomicLoad(ctx MemoryContext, addr uint64, width int) (uint64, MemoryAccessResult)
+	AtomicStore(ctx MemoryContext, addr uint64, width int, val uint64) MemoryAccessResult
+	// Returns the previous value
+	AtomicRMW(ctx MemoryContext, addr uint64, width int, op AtomicOp, val uint64) (uint64, MemoryAccessResult)
+	// Returns the previous value, the swap only happened if it equals expected
+	AtomicCompareExchange(ctx MemoryContext, addr uint64, width int, expected uint64, replacement uint64) (uint64, MemoryAccessResult)
+	// Blocks while the value at addr equals expected, up until the timeout.
+	// A negative timeout waits forever. width is 4 or 8.
+	Wait(ctx MemoryContext, addr uint64, width int, expected uint64, timeout time.Duration) (WaitResult, MemoryAccessResult)
+	// Wakes up to count waiters on addr, returning the number woken
+	Notify(ctx MemoryContext, addr uint64, count uint32) (uint32, MemoryAccessResult)
+}
+
+// FlatSharedMemory is a FlatMemory that may be used from several threads
+// at once. The backing array is 8 octet aligned so that naturally aligned
+// atomics map directly onto sync/atomic. This assumes a little endian
+// host, which covers every platform Go supports for WebAssembly hosts
+// in practice (amd64, arm64, riscv64, wasm).
+//
+// Non-atomic accesses are not synchronized, the same as the specification
+// allows them to race. Permission changes are also not synchronized, so the
+// host should only make them while the threads are quiescent.
+type FlatSharedMemory struct {
+	FlatMemory
+	mu      sync.Mutex
+	waiters map[uint64][]*memoryWaiter
+}
+
+type memoryWaiter struct {
+	ch       chan struct{}
+	notified bool
+}
+
+func NewFlatSharedMemory(size uint64) *FlatSharedMemory {
+	words := make([]uint64, (size+7)/8)
+	var data []byte
+	if size > 0 {
+		data = unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), size)
+	} else {
+		data = []byte{}
+	}
+	return &FlatSharedMemory{
+		FlatMemory: FlatMemory{data: data},
+		waiters:    make(map[uint64][]*memoryWaiter),
+	}
+}
+
+func (m *FlatSharedMemory) Shared() bool {
+	return true
+}
+
+// Other threads may be accessing the backing array, which can't be
+// replaced under them, so shared memories don't grow
+func (m *FlatSharedMemory) Grow(delta uint64) bool {
+	return delta == 0
+}
+
+func (m *FlatSharedMemory) checkAtomic(addr uint64, width int, need MemoryPermission) MemoryAccessResult {
+	if !inBounds(uint64(len(m.data)), addr, width) {
+		return MemoryAccessOutOfBounds
+	}
+	if !m.perms.check(addr, width, need) {
+		return MemoryAccessDenied
+	}
+	return MemoryAccessOK
+}
+
+// The aligned 32 bit word holding addr, and the bit offset of addr in it
+func (m *FlatSharedMemory) word32(addr uint64) (*uint32, uint) {
+	base := addr &^ 3
+	return (*uint32)(unsafe.Pointer(&m.data[base])), uint(addr-base) * 8
+}
+
+func (m *FlatSharedMemory) word64(addr uint64) *uint64 {
+	return (*uint64)(unsafe.Pointer(&m.data[addr]))
+}
+
+func widthMask(width int) uint64 {
+	if width == 8 {
+		return ^uint64(0)
+	}
+	return (uint64(1) << (uint(width) * 8)) - 1
+}
+
+func (m *FlatSharedMemory) load(addr uint64, width int) uint64 {
+	if width == 8 {
+		return atomic.LoadUint64(m.word64(addr))
+	}
+	word, shift := m.word32(addr)
+	return (uint64(atomic.LoadUint32(word)) >> shift) & widthMask(width)
+}
+
+func (m *FlatSharedMemory) AtomicLoad(ctx MemoryContext, addr uint64, width int) (uint64, MemoryAccessResult) {
+	if res := m.checkAtomic(addr, width, MemoryPermRead); res != MemoryAccessOK {
+		return 0, res
+	}
+	return m.load(addr, width), MemoryAccessOK
+}
+
+func (m *FlatSharedMemory) AtomicStore(ctx MemoryContext, addr uint64, width int, val uint64) MemoryAccessResult {
+	if res := m.checkAtomic(addr, width, MemoryPermWrite); res != MemoryAccessOK {
+		return res
+	}
+	switch width {
+	case 8:
+		atomic.StoreUint64(m.word64(addr), val)
+	case 4:
+		word, _ := m.word32(addr)
+		atomic.StoreUint32(word, uint32(val))
+	default:
+		m.rmwNarrow(addr, width, AtomicXchg, val)
+	}
+	return MemoryAccessOK
+}
+
+// sync/atomic has no 8 or 16 bit operations, so those are done as a
+// compare-and-swap loop on the containing 32 bit word
+func (m *FlatSharedMemory) rmwNarrow(addr uint64, width int, op AtomicOp, val uint64) uint64 {
+	word, shift := m.word32(addr)
+	mask := uint32(widthMask(width)) << shift
+	for {
+		oldWord := atomic.LoadUint32(word)
+		old := uint64((oldWord & mask) >> shift)
+		updated := (uint32(op.apply(old, val)) << shift) & mask
+		if atomic.CompareAndSwapUint32(word, oldWord, (oldWord&^mask)|updated) {
+			return old
+		}
+	}
+}
+
+func (m *FlatSharedMemory) AtomicRMW(ctx MemoryContext, addr uint64, width int, op AtomicOp, val uint64) (uint64, MemoryAccessResult) {
+	if res := m.checkAtomic(addr, width, MemoryPermRW); res != MemoryAccessOK {
+		return 0, res
+	}
+	switch width {
+	case 8:
+		ptr := m.word64(addr)
+		for {
+			old := atomic.LoadUint64(ptr)
+			if atomic.CompareAndSwapUint64(ptr, old, op.apply(old, val)) {
+				return old, MemoryAccessOK
+			}
+		}
+	case 4:
+		word, _ := m.word32(addr)
+		for {
+			old := atomic.LoadUint32(word)
+			if atomic.CompareAndSwapUint32(word, old, uint32(op.apply(uint64(old), val))) {
+				return uint64(old), MemoryAccessOK
+			}
+		}
+	default:
+		return m.rmwNarrow(addr, width, op, val), MemoryAccessOK
+	}
+}
+
+func (m *FlatSharedMemory) AtomicCompareExchange(ctx MemoryContext, addr uint64, width int, expected uint64, replacement uint64) (uint64, MemoryAccessResult) {
+	if res := m.checkAtomic(addr, width, MemoryPermRW); res != MemoryAccessOK {
+		return 0, res
+	}
+	mask := widthMask(width)
+	expected &= mask
+	replacement &= mask
+	switch width {
+	case 8:
+		ptr := m.word64(addr)
+		for {
+			old := atomic.LoadUint64(ptr)
+			if old != expected || atomic.CompareAndSwapUint64(ptr, old, replacement) {
+				return old, MemoryAccessOK
+			}
+		}
+	default:
+		word, shift := m.word32(addr)
+		wmask := uint32(mask) << shift
+		for {
+			oldWord := atomic.LoadUint32(word)
+			old := uint64((oldWord & wmask) >> shift)
+			if old != expected {
+				return old, MemoryAccessOK
+			}
+			if atomic.CompareAndSwapUint32(word, oldWord, (oldWord&^wmask)|(uint32(replacement)<<shift)) {
+				return old, MemoryAccessOK
+			}
+		}
+	}
+}
+
+func (m *FlatSharedMemory) Wait(ctx MemoryContext, addr uint64, width int, expected uint64, timeout time.Duration) (WaitResult, MemoryAccessResult) {
+	if res := m.checkAtomic(addr, width, MemoryPermRead); res != MemoryAccessOK {
+		return 0, res
+	}
+	// Holding the lock while comparing means a notify can't slip in
+	// between the comparison and the waiter being queued
+	m.mu.Lock()
+	if m.load(addr, width) != expected&widthMask(width) {
+		m.mu.Unlock()
+		return WaitNotEqual, MemoryAccessOK
+	}
+	w := &memoryWaiter{ch: make(chan struct{})}
+	m.waiters[addr] = append(m.waiters[addr], w)
+	m.mu.Unlock()
+
+	// A nil channel never fires, so no timeout waits forever
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	result := WaitTimedOut
+	select {
+	case <-w.ch:
+		return WaitOk, MemoryAccessOK
+	case <-expired:
+	case <-ctx.Cancel:
+		result = WaitCancelled
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// A notify may have raced the timer or the cancel
+	if w.notified {
+		return WaitOk, MemoryAccessOK
+	}
+	queue := m.waiters[addr]
+	for i, other := range queue {
+		if other == w {
+			m.waiters[addr] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(m.waiters[addr]) == 0 {
+		delete(m.waiters, addr)
+	}
+	return result, MemoryAccessOK
+}
+
+func (m *FlatSharedMemory) Notify(ctx MemoryContext, addr uint64, count uint32) (uint32, MemoryAccessResult) {
+	if res := m.checkAtomic(addr, 4, MemoryPermRead); res != MemoryAccessOK {
+		return 0, res
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	queue := m.waiters[addr]
+	woken := uint32(0)
+	for woken < count && len(queue) > 0 {
+		queue[0].notified = true
+		close(queue[0].ch)
+		queue = queue[1:]
+		woken++
+	}
+	if len(queue) == 0 {
+		delete(m.waiters, addr)
+	} else {
+		m.waiters[addr] = queue
+	}
+	return woken, MemoryAccessOK
+}
+
+// Atomics are still valid on memories that aren't shared. Those are
+// only used from a single thread, so plain reads and writes suffice.
+// Waiting traps and notify wakes nobody, as the specification requires.
+type unsharedAtomics struct {
+	Memory
+}
+
+func (m unsharedAtomics) Shared() bool {
+	return false
+}
+
+func (m unsharedAtomics) AtomicLoad(ctx MemoryContext, addr uint64, width int) (uint64, MemoryAccessResult) {
+	var buf [8]byte
+	res := m.Read(ctx, addr, buf[:width])
+	return binary.LittleEndian.Uint64(buf[:]), res
+}
+
+func (m unsharedAtomics) AtomicStore(ctx MemoryContext, addr uint64, width int, val uint64) MemoryAccessResult {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], val)
+	return m.Write(ctx, addr, buf[:width])
+}
+
+func (m unsharedAtomics) AtomicRMW(ctx MemoryContext, addr uint64, width int, op AtomicOp, val uint64) (uint64, MemoryAccessResult) {
+	old, res := m.AtomicLoad(ctx, addr, width)
+	if res != MemoryAccessOK {
+		return 0, res
+	}
+	return old, m.AtomicStore(ctx, addr, width, op.apply(old, val))
+}
+
+func (m unsharedAtomics) AtomicCompareExchange(ctx MemoryContext, addr uint64, width int, expected uint64, replacement uint64) (uint64, MemoryAccessResult) {
+	old, res := m.AtomicLoad(ctx, addr, width)
+	if res != MemoryAccessOK || old != expected&widthMask(width) {
+		return old, res
+	}
+	return old, m.AtomicStore(ctx, addr, width, replacement)
+}
+
+func (m unsharedAtomics) Wait(ctx MemoryContext, addr uint64, width int, expected uint64, timeout time.Duration) (WaitResult, MemoryAccessResult) {
+	return 0, MemoryAccessDenied
+}
+
+func (m unsharedAtomics) Notify(ctx MemoryContext, addr uint64, count uint32) (uint32, MemoryAccessResult) {
+	var buf [4]byte
+	return 0, m.Read(ctx, addr, buf[:])
+}
+
+// The atomic view of the VM memory
+func (vm *VMState) atomicMemory() AtomicMemory {
+	if am, ok := vm.Memory.(AtomicMemory); ok {
+		return am
+	}
+	return unsharedAtomics{vm.Memory}
+}
@@ -0,0 +1,208 @@
+package wasmvm
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+// An immutable copy of an initialized memory, including its shard
+// permissions. Memories created from it share the shards until they
+// write to them, so the same image doesn't need to be populated again
+// for every VM.
+type MemorySnapshot struct {
+	size    uint64
+	shards  [][]byte // nil for shards that are all zeros
+	perms   []MemoryPermission
+	allowWX bool
+}
+
+// Reported when a memory can't be captured or restored
+type MemorySnapshotError struct {
+	Msg string
+}
+
+func (e *MemorySnapshotError) Error() string {
+	return fmt.Sprintf("[MemorySnapshotError] %s", e.Msg)
+}
+
+const errmsg_SnapshotUnsupported = "memory does not support snapshots"
+const errmsg_SnapshotSizeMismatch = "snapshot size %d does not match memory size %d"
+const errmsg_SnapshotTooLarge = "snapshot size %d is over the memory limit of %d"
+const errmsg_SnapshotMissing = "no snapshot to reset to"
+const errmsg_SnapshotThreadsRunning = "threads other than thread 0 have not been joined"
+
+// The built-in compositors implement this
+type snapshotMemory interface {
+	Memory
+	read(addr uint64, buf []byte) MemoryAccessResult
+	permissionTable() *shardPermissions
+	restoreSnapshot(s *MemorySnapshot)
+	truncate(size uint64)
+}
+
+// Captures mem as it is right now. Any later changes to mem don't
+// affect the snapshot.
+func NewMemorySnapshot(mem Memory) (*MemorySnapshot, error) {
+	sm, ok := mem.(snapshotMemory)
+	if !ok {
+		return nil, &MemorySnapshotError{Msg: errmsg_SnapshotUnsupported}
+	}
+	size := sm.Size()
+	s := &MemorySnapshot{
+		size:   size,
+		shards: make([][]byte, (size+MemoryShardSize-1)/MemoryShardSize),
+	}
+	zero := make([]byte, MemoryShardSize)
+	for i := range s.shards {
+		addr := uint64(i) * MemoryShardSize
+		shard := make([]byte, MemoryShardSize)
+		sm.read(addr, shard[:min(MemoryShardSize, size-addr)])
+		if !bytes.Equal(shard, zero) {
+			s.shards[i] = shard
+		}
+	}
+	table := sm.permissionTable()
+	s.perms = slices.Clone(table.perms)
+	s.allowWX = table.allowWX
+	return s, nil
+}
+
+func (s *MemorySnapshot) Size() uint64 {
+	return s.size
+}
+
+// A fresh copy-on-write memory backed by the snapshot
+func (s *MemorySnapshot) NewMemory() *ShardedMemory {
+	mem := NewShardedMemory(s.size)
+	mem.restoreSnapshot(s)
+	return mem
+}
+
+func (s *MemorySnapshot) permissions() shardPermissions {
+	return shardPermissions{perms: slices.Clone(s.perms), allowWX: s.allowWX}
+}
+
+func (m *FlatMemory) permissionTable() *shardPermissions {
+	return &m.perms
+}
+
+// Flat memory has nothing to share, so this is a full copy
+func (m *FlatMemory) restoreSnapshot(s *MemorySnapshot) {
+	for i, shard := range s.shards {
+		dst := m.data[uint64(i)*MemoryShardSize:]
+		dst = dst[:min(MemoryShardSize, uint64(len(dst)))]
+		if shard == nil {
+			clear(dst)
+		} else {
+			copy(dst, shard)
+		}
+	}
+	m.perms = s.permissions()
+}
+
+// The octets past size stay in the backing array, Grow zeroes them again
+func (m *FlatMemory) truncate(size uint64) {
+	m.data = m.data[:size]
+}
+
+func (m *ShardedMemory) permissionTable() *shardPermissions {
+	return &m.perms
+}
+
+// Only the shards written since the last restore need to go back when
+// the memory already came from s
+func (m *ShardedMemory) restoreSnapshot(s *MemorySnapshot) {
+	if m.snapshot == s {
+		for _, idx := range m.dirty {
+			m.shards[idx] = s.shards[idx]
+			m.borrowed[idx] = s.shards[idx] != nil
+		}
+	} else {
+		copy(m.shards, s.shards)
+		m.borrowed = make([]bool, len(s.shards))
+		for i, shard := range s.shards {
+			m.borrowed[i] = shard != nil
+		}
+		m.snapshot = s
+	}
+	m.dirty = m.dirty[:0]
+	m.perms = s.permissions()
+}
+
+// Shards past the new size are dropped. A trailing partial shard written
+// past the size is dirty, so the restore that follows replaces it.
+func (m *ShardedMemory) truncate(size uint64) {
+	count := (size + MemoryShardSize - 1) / MemoryShardSize
+	m.size = size
+	m.shards = m.shards[:count]
+	if m.borrowed != nil {
+		m.borrowed = m.borrowed[:count]
+	}
+	m.dirty = slices.DeleteFunc(m.dirty, func(idx uint64) bool { return idx >= count })
+}
+
+// Puts mem back to the contents and permissions of s. A memory that has
+// grown since is cut back to the size of s, a smaller one is grown to it
+// if it can be.
+func RestoreMemorySnapshot(mem Memory, s *MemorySnapshot) error {
+	sm, ok := mem.(snapshotMemory)
+	if !ok {
+		return &MemorySnapshotError{Msg: errmsg_SnapshotUnsupported}
+	}
+	if size := sm.Size(); size > s.size {
+		sm.truncate(s.size)
+	} else if gm, ok := mem.(GrowableMemory); size < s.size && (!ok || !gm.Grow(s.size-size)) {
+		return &MemorySnapshotError{Msg: fmt.Sprintf(errmsg_SnapshotSizeMismatch, s.size, size)}
+	}
+	sm.restoreSnapshot(s)
+	return nil
+}
+
+// Captures the memory of the VM and makes it the point Reset returns
+// to. The snapshot can also seed other VMs through VMConfig.SetSnapshot.
+func (vm *VMState) Snapshot() (*MemorySnapshot, error) {
+	s, err := NewMemorySnapshot(vm.Memory)
+	if err != nil {
+		return nil, err
+	}
+	vm.snapshot = s
+	if vm.instance != nil {
+		vm.instance.saveState()
+	}
+	return s, nil
+}
+
+// Returns the VM to its snapshot, either the one it was built from or
+// the one taken by the last call to Snapshot. Memory is restored, cut
+// back to its old size if it has grown since, and the stacks and any
+// trap of thread 0 are cleared, keeping their allocations. In protected
+// mode every other thread must have been joined first. An instance also
+// gets back its globals, tables, dropped segments and fuel.
+func (vm *VMState) Reset() error {
+	if vm.snapshot == nil {
+		return &MemorySnapshotError{Msg: errmsg_SnapshotMissing}
+	}
+	if tg := vm.threads; tg != nil {
+		tg.mu.Lock()
+		defer tg.mu.Unlock()
+		if len(tg.threads) > 1 {
+			return &MemorySnapshotError{Msg: errmsg_SnapshotThreadsRunning}
+		}
+		tg.aborted = false
+	}
+	if err := RestoreMemorySnapshot(vm.Memory, vm.snapshot); err != nil {
+		return err
+	}
+	vm.PC = vm.Config.StartOverride
+	vm.Trap = false
+	vm.TrapErr = nil
+	vm.ValueStack.elements = vm.ValueStack.elements[:0]
+	vm.CallStack = vm.CallStack[:0]
+	vm.Labels = vm.Labels[:0]
+	if vm.instance != nil {
+		vm.instance.restoreState()
+	}
+	vm.aborted.Store(false)
+	return nil
+}
@@ -0,0 +1,186 @@
+package wasmvm_test
+
+import (
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Stores 0xAABBCCDD into the data shard and ends
+var snapshotProgram = []byte{
+	wasmvm.OP_CONST_I32, 0x00, 0x10, 0x00, 0x00,
+	wasmvm.OP_CONST_I32, 0xDD, 0xCC, 0xBB, 0xAA,
+	wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_STORE_I32, 2, 0,
+	wasmvm.OP_CONST_I32, 0x07, 0x00, 0x00, 0x00,
+	wasmvm.OP_END,
+}
+
+func newSnapshotSourceVM(t testing.TB, model wasmvm.MemoryModel) *wasmvm.VMState {
+	vm, err := (&wasmvm.VMConfig{
+		Image: (&wasmvm.ImageConfig{}).SetArray(snapshotProgram).SetSize(uint64(len(snapshotProgram))),
+	}).SetSize(wasmvm.MemoryShardSize * 3).SetMemoryModel(model).BuildVMState()
+	require.NoError(t, err)
+	return vm
+}
+
+func readData(t *testing.T, vm *wasmvm.VMState) []byte {
+	buf := make([]byte, 4)
+	require.NoError(t, vm.ReadMemory("TEST", atomicDataAddr, buf))
+	return buf
+}
+
+func TestMemorySnapshot_NewVM(t *testing.T) {
+	source := newSnapshotSourceVM(t, wasmvm.FlatMemoryModel)
+	snap, err := wasmvm.NewMemorySnapshot(source.Memory)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(wasmvm.MemoryShardSize*3), snap.Size())
+
+	// Changing the source afterwards doesn't reach the snapshot
+	require.NoError(t, source.WriteMemory("TEST", atomicDataAddr, []byte{1, 2, 3, 4}))
+
+	first, err := (&wasmvm.VMConfig{}).SetSnapshot(snap).BuildVMState()
+	require.NoError(t, err)
+	second, err := (&wasmvm.VMConfig{}).SetSnapshot(snap).SetMode(wasmvm.ProtectedMode).SetShared(true).BuildVMState()
+	require.NoError(t, err)
+	assert.IsType(t, &wasmvm.ShardedMemory{}, first.Memory)
+	assert.Equal(t, map[uint8]wasmvm.RingConfig{0: {Enabled: true}}, first.Config.Rings)
+
+	first.MainLoop()
+	assert.Equal(t, wasmvm.TrapCallStackEmpty, first.TrapErr.Type)
+	assert.Equal(t, []byte{0xDD, 0xCC, 0xBB, 0xAA}, readData(t, first))
+	assert.Equal(t, []byte{0, 0, 0, 0}, readData(t, second))
+
+	// Permissions come along with the contents
+	pm := second.Memory.(wasmvm.PermissionedMemory)
+	assert.Equal(t, wasmvm.MemoryPermRX, pm.Permissions(0))
+	assert.Equal(t, wasmvm.MemoryPermRW, pm.Permissions(atomicDataAddr))
+	assert.Equal(t, wasmvm.MemoryAccessDenied, second.Memory.Write(wasmvm.MemoryContext{}, 0, []byte{0}))
+
+	second.MainLoop()
+	assert.Equal(t, wasmvm.TrapCallStackEmpty, second.TrapErr.Type)
+	assert.Equal(t, []byte{0xDD, 0xCC, 0xBB, 0xAA}, readData(t, second))
+
+	// Shared memories get their own copy
+	shared, err := (&wasmvm.VMConfig{}).SetSnapshot(snap).SetShared(true).BuildVMState()
+	require.NoError(t, err)
+	assert.IsType(t, &wasmvm.FlatSharedMemory{}, shared.Memory)
+	buf := make([]byte, len(snapshotProgram))
+	require.NoError(t, shared.ReadMemory("TEST", 0, buf))
+	assert.Equal(t, snapshotProgram, buf)
+}
+
+func TestVMState_Reset(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(t *testing.T) *wasmvm.VMState
+	}{
+		{
+			name: "from snapshot",
+			build: func(t *testing.T) *wasmvm.VMState {
+				snap, err := wasmvm.NewMemorySnapshot(newSnapshotSourceVM(t, wasmvm.FlatMemoryModel).Memory)
+				require.NoError(t, err)
+				vm, err := (&wasmvm.VMConfig{}).SetSnapshot(snap).BuildVMState()
+				require.NoError(t, err)
+				return vm
+			},
+		},
+		{
+			name: "flat memory after Snapshot",
+			build: func(t *testing.T) *wasmvm.VMState {
+				vm := newSnapshotSourceVM(t, wasmvm.FlatMemoryModel)
+				_, err := vm.Snapshot()
+				require.NoError(t, err)
+				return vm
+			},
+		},
+		{
+			name: "sharded memory after Snapshot",
+			build: func(t *testing.T) *wasmvm.VMState {
+				vm := newSnapshotSourceVM(t, wasmvm.ShardedMemoryModel)
+				_, err := vm.Snapshot()
+				require.NoError(t, err)
+				return vm
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := tc.build(t)
+			for range 3 {
+				vm.MainLoop()
+				assert.Equal(t, wasmvm.TrapCallStackEmpty, vm.TrapErr.Type)
+				assert.Equal(t, 1, vm.ValueStack.Size())
+				assert.Equal(t, []byte{0xDD, 0xCC, 0xBB, 0xAA}, readData(t, vm))
+
+				// Code shards are RX again after the reset
+				require.NoError(t, vm.SetMemoryPermissions(0, 1, wasmvm.MemoryPermRW))
+				require.NoError(t, vm.Reset())
+				assert.False(t, vm.Trap)
+				assert.Nil(t, vm.TrapErr)
+				assert.Equal(t, uint64(0), vm.PC)
+				assert.True(t, vm.ValueStack.IsEmpty())
+				assert.Equal(t, []byte{0, 0, 0, 0}, readData(t, vm))
+				assert.Equal(t, wasmvm.MemoryPermRX, vm.Memory.(wasmvm.PermissionedMemory).Permissions(0))
+			}
+		})
+	}
+}
+
+func TestVMState_ResetErrors(t *testing.T) {
+	vm := newSnapshotSourceVM(t, wasmvm.FlatMemoryModel)
+	assert.EqualError(t, vm.Reset(), "[MemorySnapshotError] no snapshot to reset to")
+
+	_, err := wasmvm.NewMemorySnapshot(plainMemory{wasmvm.NewFlatMemory(make([]byte, 8))})
+	assert.EqualError(t, err, "[MemorySnapshotError] memory does not support snapshots")
+
+	snap, err := vm.Snapshot()
+	require.NoError(t, err)
+	// Shared memories can't grow to fit
+	err = wasmvm.RestoreMemorySnapshot(wasmvm.NewFlatSharedMemory(8), snap)
+	assert.EqualError(t, err, "[MemorySnapshotError] snapshot size 12288 does not match memory size 8")
+	err = wasmvm.RestoreMemorySnapshot(plainMemory{wasmvm.NewFlatMemory(make([]byte, 8))}, snap)
+	assert.Error(t, err)
+
+	threaded, err := (&wasmvm.VMConfig{}).SetSnapshot(snap).SetMode(wasmvm.ProtectedMode).SetShared(true).BuildVMState()
+	require.NoError(t, err)
+	id, err := threaded.SpawnThread(0, 0)
+	require.NoError(t, err)
+	var se *wasmvm.MemorySnapshotError
+	assert.ErrorAs(t, threaded.Reset(), &se)
+	_, err = threaded.JoinThread(id)
+	require.NoError(t, err)
+	assert.NoError(t, threaded.Reset())
+}
+
+func BenchmarkNewVM_Image(b *testing.B) {
+	for b.Loop() {
+		newSnapshotSourceVM(b, wasmvm.FlatMemoryModel)
+	}
+}
+
+func BenchmarkNewVM_Snapshot(b *testing.B) {
+	snap, err := wasmvm.NewMemorySnapshot(newSnapshotSourceVM(b, wasmvm.FlatMemoryModel).Memory)
+	require.NoError(b, err)
+	config := (&wasmvm.VMConfig{}).SetSnapshot(snap)
+	for b.Loop() {
+		_, err := config.BuildVMState()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVMState_Reset(b *testing.B) {
+	snap, err := wasmvm.NewMemorySnapshot(newSnapshotSourceVM(b, wasmvm.FlatMemoryModel).Memory)
+	require.NoError(b, err)
+	vm, err := (&wasmvm.VMConfig{}).SetSnapshot(snap).BuildVMState()
+	require.NoError(b, err)
+	for b.Loop() {
+		vm.MainLoop()
+		if err := vm.Reset(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package wasmvm_test
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryTestCase struct {
+	name       string
+	size       uint64
+	addr       uint64
+	data       []byte
+	expectRes  wasmvm.MemoryAccessResult
+	expectRead []byte
+}
+
+// Both compositors should behave identically through the interface
+func newTestMemories(size uint64) map[string]wasmvm.Memory {
+	return map[string]wasmvm.Memory{
+		"flat":    wasmvm.NewFlatMemory(make([]byte, size)),
+		"sharded": wasmvm.NewShardedMemory(size),
+	}
+}
+
+func TestMemory_ReadWrite(t *testing.T) {
+	tests := []memoryTestCase{
+		{
+			name:       "success - start",
+			size:       16,
+			addr:       0,
+			data:       []byte{1, 2, 3},
+			expectRes:  wasmvm.MemoryAccessOK,
+			expectRead: []byte{1, 2, 3},
+		},
+		{
+			name:       "success - exactly at end",
+			size:       16,
+			addr:       14,
+			data:       []byte{1, 2},
+			expectRes:  wasmvm.MemoryAccessOK,
+			expectRead: []byte{1, 2},
+		},
+		{
+			name:       "success - across shard boundary",
+			size:       wasmvm.MemoryShardSize * 3,
+			addr:       wasmvm.MemoryShardSize - 2,
+			data:       []byte{1, 2, 3, 4},
+			expectRes:  wasmvm.MemoryAccessOK,
+			expectRead: []byte{1, 2, 3, 4},
+		},
+		{
+			name:       "success - spanning several shards",
+			size:       wasmvm.MemoryShardSize * 3,
+			addr:       1,
+			data:       make([]byte, wasmvm.MemoryShardSize*2+2),
+			expectRes:  wasmvm.MemoryAccessOK,
+			expectRead: make([]byte, wasmvm.MemoryShardSize*2+2),
+		},
+		{
+			name:      "failure - past end",
+			size:      16,
+			addr:      15,
+			data:      []byte{1, 2},
+			expectRes: wasmvm.MemoryAccessOutOfBounds,
+		},
+		{
+			name:      "failure - address overflow",
+			size:      16,
+			addr:      math.MaxUint64,
+			data:      []byte{1, 2},
+			expectRes: wasmvm.MemoryAccessOutOfBounds,
+		},
+	}
+	for _, tc := range tests {
+		for kind, mem := range newTestMemories(tc.size) {
+			t.Run(kind+": "+tc.name, func(t *testing.T) {
+				ctx := wasmvm.MemoryContext{}
+				assert.Equal(t, tc.size, mem.Size())
+				assert.Equal(t, tc.expectRes, mem.Write(ctx, tc.addr, tc.data))
+				buf := make([]byte, len(tc.data))
+				assert.Equal(t, tc.expectRes, mem.Read(ctx, tc.addr, buf))
+				assert.Equal(t, tc.expectRes, mem.Execute(ctx, tc.addr, buf))
+				if tc.expectRes == wasmvm.MemoryAccessOK {
+					assert.Equal(t, tc.expectRead, buf)
+				}
+			})
+		}
+	}
+}
+
+func TestShardedMemory_Lazy(t *testing.T) {
+	mem := wasmvm.NewShardedMemory(wasmvm.MemoryShardSize*2 + 1)
+	assert.Equal(t, 3, mem.ShardCount())
+
+	// Unwritten shards read as zero
+	buf := []byte{0xFF, 0xFF}
+	assert.Equal(t, wasmvm.MemoryAccessOK, mem.Read(wasmvm.MemoryContext{}, wasmvm.MemoryShardSize*2-1, buf))
+	assert.Equal(t, []byte{0, 0}, buf)
+}
+
+func TestFlatMemory_Bytes(t *testing.T) {
+	backing := []byte{1, 2, 3}
+	mem := wasmvm.NewFlatMemory(backing)
+	mem.Write(wasmvm.MemoryContext{}, 1, []byte{9})
+	assert.Equal(t, []byte{1, 9, 3}, backing)
+	assert.Equal(t, backing, mem.Bytes())
+}
+
+func TestMemoryAccessResultString(t *testing.T) {
+	assert.Equal(t, "MemoryAccessDenied", wasmvm.MemoryAccessDenied.String())
+	assert.Equal(t, "MemoryAccessResult(99)", wasmvm.MemoryAccessResult(99).String())
+}
+
+func TestParseMemoryModel(t *testing.T) {
+	mm, err := wasmvm.ParseMemoryModel(" Sharded ")
+	assert.NoError(t, err)
+	assert.Equal(t, wasmvm.ShardedMemoryModel, mm)
+	assert.Equal(t, "sharded", mm.String())
+	assert.Equal(t, "MemoryModel(99)", wasmvm.MemoryModel(99).String())
+
+	_, err = wasmvm.ParseMemoryModel("paged")
+	assert.Error(t, err)
+
+	var cfg wasmvm.VMConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"MemoryModel":"sharded"}`), &cfg))
+	assert.Equal(t, wasmvm.ShardedMemoryModel, cfg.MemoryModel)
+	require.NoError(t, json.Unmarshal([]byte(`{"MemoryModel":0}`), &cfg))
+	assert.Equal(t, wasmvm.FlatMemoryModel, cfg.MemoryModel)
+	assert.Error(t, json.Unmarshal([]byte(`{"MemoryModel":"paged"}`), &cfg))
+	assert.Error(t, json.Unmarshal([]byte(`{"MemoryModel":true}`), &cfg))
+}
+
+func TestNewVM_MemoryModels(t *testing.T) {
+	program := []byte{
+		wasmvm.OP_CONST_I32, 2, 0, 0, 0,
+		wasmvm.OP_CONST_I32, 3, 0, 0, 0,
+		wasmvm.OP_ADD_I32,
+		wasmvm.OP_END,
+	}
+	hostMem := wasmvm.NewShardedMemory(64)
+	tests := []struct {
+		name   string
+		config *wasmvm.VMConfig
+		expect any
+	}{
+		{
+			name:   "flat from size",
+			config: (&wasmvm.VMConfig{}).SetSize(64),
+			expect: &wasmvm.FlatMemory{},
+		},
+		{
+			name:   "sharded from size",
+			config: (&wasmvm.VMConfig{}).SetSize(64).SetMemoryModel(wasmvm.ShardedMemoryModel),
+			expect: &wasmvm.ShardedMemory{},
+		},
+		{
+			name:   "sharded from flat memory",
+			config: (&wasmvm.VMConfig{}).SetFlatMemory(make([]byte, 64)).SetMemoryModel(wasmvm.ShardedMemoryModel),
+			expect: &wasmvm.ShardedMemory{},
+		},
+		{
+			name:   "host supplied",
+			config: (&wasmvm.VMConfig{}).SetMemory(hostMem),
+			expect: &wasmvm.ShardedMemory{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Image = (&wasmvm.ImageConfig{}).SetArray(program).SetSize(uint64(len(program)))
+			vm, err := wasmvm.NewVM(tc.config)
+			require.NoError(t, err)
+			assert.IsType(t, tc.expect, vm.Memory)
+			assert.Equal(t, uint64(64), vm.Memory.Size())
+
+			vm.MainLoop()
+			require.NotNil(t, vm.TrapErr)
+			assert.Equal(t, wasmvm.TrapCallStackEmpty, vm.TrapErr.Type)
+			val, ok := vm.ValueStack.Pop()
+			require.True(t, ok)
+			assert.Equal(t, uint32(5), val.Value_I32)
+		})
+	}
+	// The host memory is shared rather than copied
+	buf := make([]byte, 1)
+	hostMem.Read(wasmvm.MemoryContext{}, 0, buf)
+	assert.Equal(t, []byte{wasmvm.OP_CONST_I32}, buf)
+}
+
+func TestConstOperandOutOfBounds_Sharded(t *testing.T) {
+	vm, err := (&wasmvm.VMConfig{
+		Image: (&wasmvm.ImageConfig{}).SetArray([]byte{wasmvm.OP_CONST_I32}).SetSize(1),
+	}).SetSize(3).SetMemoryModel(wasmvm.ShardedMemoryModel).BuildVMState()
+	require.NoError(t, err)
+	err = vm.Step()
+	assert.Error(t, err)
+	require.NotNil(t, vm.TrapErr)
+	assert.Equal(t, wasmvm.TrapProgramCounterOutOfBounds, vm.TrapErr.Type)
+	assert.Equal(t, "CONST_I32: Out of bounds", vm.TrapErr.Message)
+	assert.Equal(t, wasmvm.TrapAccessExecute, vm.TrapErr.AccessType)
+	require.NotNil(t, vm.TrapErr.Address)
+	assert.Equal(t, uint64(1), *vm.TrapErr.Address)
+}
+
+func benchmarkStep(b *testing.B, model wasmvm.MemoryModel) {
+	program := []byte{
+		wasmvm.OP_CONST_I32, 2, 0, 0, 0,
+		wasmvm.OP_CONST_I32, 3, 0, 0, 0,
+		wasmvm.OP_ADD_I32,
+	}
+	vm, err := (&wasmvm.VMConfig{
+		Image: (&wasmvm.ImageConfig{}).SetArray(program).SetSize(uint64(len(program))),
+	}).SetSize(uint64(len(program))).SetMemoryModel(model).BuildVMState()
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm.PC = 0
+		for vm.PC < uint64(len(program)) {
+			if err := vm.Step(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		vm.ValueStack.Drop(1, true)
+	}
+}
+
+func BenchmarkStep_FlatMemory(b *testing.B) {
+	benchmarkStep(b, wasmvm.FlatMemoryModel)
+}
+
+func BenchmarkStep_ShardedMemory(b *testing.B) {
+	benchmarkStep(b, wasmvm.ShardedMemoryModel)
+}
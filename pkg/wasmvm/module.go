@@ -0,0 +1,984 @@
+package wasmvm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// A decoded WebAssembly binary module. Function bodies, constant
+// expressions and data are kept as the raw bytes from the binary; they
+// only get interpreted when the module is instantiated.
+
+var ModuleMagic = []byte{0x00, 'a', 's', 'm'}
+
+const ModuleVersion uint32 = 1
+
+// Size of a WebAssembly page, which memory limits are given in
+const WasmPageSize = 65536
+
+// The most pages a 32 bit memory can address
+const maxMemoryPages = 65536
+
+type SectionID byte
+
+const (
+	SectionCustom SectionID = iota
+	SectionType
+	SectionImport
+	SectionFunction
+	SectionTable
+	SectionMemory
+	SectionGlobal
+	SectionExport
+	SectionStart
+	SectionElement
+	SectionCode
+	SectionData
+	SectionDataCount
+)
+
+var sectionIDNames = map[SectionID]string{
+	SectionCustom:    "custom",
+	SectionType:      "type",
+	SectionImport:    "import",
+	SectionFunction:  "function",
+	SectionTable:     "table",
+	SectionMemory:    "memory",
+	SectionGlobal:    "global",
+	SectionExport:    "export",
+	SectionStart:     "start",
+	SectionElement:   "element",
+	SectionCode:      "code",
+	SectionData:      "data",
+	SectionDataCount: "datacount",
+}
+
+func (id SectionID) String() string {
+	if name, ok := sectionIDNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("SectionID(%d)", id)
+}
+
+// Where a section may appear; datacount sits between element and code
+var sectionOrder = map[SectionID]int{
+	SectionType:      1,
+	SectionImport:    2,
+	SectionFunction:  3,
+	SectionTable:     4,
+	SectionMemory:    5,
+	SectionGlobal:    6,
+	SectionExport:    7,
+	SectionStart:     8,
+	SectionElement:   9,
+	SectionDataCount: 10,
+	SectionCode:      11,
+	SectionData:      12,
+}
+
+// What an import or export refers to
+type ExternType byte
+
+const (
+	ExternFunc ExternType = iota
+	ExternTable
+	ExternMemory
+	ExternGlobal
+)
+
+var externTypeNames = map[ExternType]string{
+	ExternFunc:   "func",
+	ExternTable:  "table",
+	ExternMemory: "memory",
+	ExternGlobal: "global",
+}
+
+func (t ExternType) String() string {
+	if name, ok := externTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ExternType(%d)", t)
+}
+
+// Binary encoding of the value types
+var valueTypeEncodings = map[byte]ValueStackEntryType{
+	0x7F: TYPE_I32,
+	0x7E: TYPE_I64,
+	0x7D: TYPE_F32,
+	0x7C: TYPE_F64,
+}
+
+type RefType byte
+
+const (
+	RefFunc   RefType = 0x70
+	RefExtern RefType = 0x6F
+)
+
+var refTypeNames = map[RefType]string{
+	RefFunc:   "funcref",
+	RefExtern: "externref",
+}
+
+func (t RefType) String() string {
+	if name, ok := refTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("RefType(0x%02X)", byte(t))
+}
+
+// Min and Max are in pages for memories and elements for tables. Max
+// is nil when there is no upper bound.
+type Limits struct {
+	Min uint64
+	Max *uint64
+}
+
+func (l Limits) String() string {
+	if l.Max == nil {
+		return fmt.Sprintf("{min %d}", l.Min)
+	}
+	return fmt.Sprintf("{min %d, max %d}", l.Min, *l.Max)
+}
+
+// Whether something with limits l can be used where want is expected
+func (l Limits) Matches(want Limits) bool {
+	if l.Min < want.Min {
+		return false
+	}
+	if want.Max == nil {
+		return true
+	}
+	return l.Max != nil && *l.Max <= *want.Max
+}
+
+type TableType struct {
+	ElemType RefType
+	Limits   Limits
+}
+
+type MemoryType struct {
+	Limits Limits
+	Shared bool
+}
+
+type GlobalType struct {
+	ValType ValueStackEntryType
+	Mutable bool
+}
+
+func (gt GlobalType) String() string {
+	if gt.Mutable {
+		return "mut " + valueTypeNames[gt.ValType]
+	}
+	return valueTypeNames[gt.ValType]
+}
+
+// Only the field for Kind is used
+type Import struct {
+	Module string
+	Name   string
+	Kind   ExternType
+	Func   uint32 // Type index
+	Table  TableType
+	Memory MemoryType
+	Global GlobalType
+}
+
+type Export struct {
+	Name  string
+	Kind  ExternType
+	Index uint32
+}
+
+type ModuleGlobal struct {
+	Type GlobalType
+	Init []byte // Constant expression, including the final end
+}
+
+type LocalEntry struct {
+	Count uint32
+	Type  ValueStackEntryType
+}
+
+type FuncBody struct {
+	Locals []LocalEntry
+	Code   []byte // Expression, including the final end
+	Offset uint64 // Of Code within the binary
+}
+
+type SegmentMode byte
+
+const (
+	SegmentActive SegmentMode = iota
+	SegmentPassive
+	SegmentDeclarative
+)
+
+type ElementSegment struct {
+	Mode   SegmentMode
+	Table  uint32
+	Offset []byte // Constant expression for active segments
+	Type   RefType
+	// Either function indices or constant expressions, depending on
+	// which encoding the segment used
+	Funcs []uint32
+	Exprs [][]byte
+}
+
+type DataSegment struct {
+	Mode   SegmentMode
+	Memory uint32
+	Offset []byte // Constant expression for active segments
+	Init   []byte
+}
+
+type CustomSection struct {
+	Name string
+	Data []byte
+	// The last non-custom section before this one, SectionCustom when
+	// it came first, so an encoder can put it back in the same place
+	After SectionID
+}
+
+type Module struct {
+	Types     []FuncType
+	Imports   []Import
+	Funcs     []uint32 // Type index of each function defined by the module
+	Tables    []TableType
+	Memories  []MemoryType
+	Globals   []ModuleGlobal
+	Exports   []Export
+	Start     *uint32
+	Elements  []ElementSegment
+	DataCount *uint32
+	Code      []FuncBody
+	Data      []DataSegment
+	Customs   []CustomSection
+}
+
+// Number of imports of the given kind; these come first in the index
+// space of that kind
+func (m *Module) ImportCount(kind ExternType) int {
+	n := 0
+	for _, imp := range m.Imports {
+		if imp.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// Signature of a function in the function index space, imports included
+func (m *Module) FuncType(idx uint32) (FuncType, bool) {
+	imported := 0
+	for _, imp := range m.Imports {
+		if imp.Kind != ExternFunc {
+			continue
+		}
+		if uint32(imported) == idx {
+			return m.Types[imp.Func], true
+		}
+		imported++
+	}
+	local := uint64(idx) - uint64(imported)
+	if local >= uint64(len(m.Funcs)) {
+		return FuncType{}, false
+	}
+	return m.Types[m.Funcs[local]], true
+}
+
+// Looks up an export by name
+func (m *Module) Export(name string) (Export, bool) {
+	for _, exp := range m.Exports {
+		if exp.Name == name {
+			return exp, true
+		}
+	}
+	return Export{}, false
+}
+
+type ModuleErrorType byte
+
+const (
+	UndefinedModuleError ModuleErrorType = iota
+	ModuleBadMagic
+	ModuleUnsupportedVersion
+	ModuleTruncated
+	ModuleMalformed
+	ModuleSectionOrder
+	ModuleUnknownSection
+	ModuleUnsupportedType
+	ModuleFunctionCountMismatch
+	ModuleInvalidIndex
+)
+
+var moduleErrorTypeNames = map[ModuleErrorType]string{
+	UndefinedModuleError:        "UndefinedModuleError",
+	ModuleBadMagic:              "ModuleBadMagic",
+	ModuleUnsupportedVersion:    "ModuleUnsupportedVersion",
+	ModuleTruncated:             "ModuleTruncated",
+	ModuleMalformed:             "ModuleMalformed",
+	ModuleSectionOrder:          "ModuleSectionOrder",
+	ModuleUnknownSection:        "ModuleUnknownSection",
+	ModuleUnsupportedType:       "ModuleUnsupportedType",
+	ModuleFunctionCountMismatch: "ModuleFunctionCountMismatch",
+	ModuleInvalidIndex:          "ModuleInvalidIndex",
+}
+
+var moduleErrorMessageTemplates = map[ModuleErrorType]string{
+	UndefinedModuleError:        "unknown module error",
+	ModuleBadMagic:              "not a WebAssembly binary",
+	ModuleUnsupportedVersion:    "unsupported binary version %d",
+	ModuleTruncated:             "unexpected end of module",
+	ModuleMalformed:             "malformed module: %s",
+	ModuleSectionOrder:          "%s section out of order",
+	ModuleUnknownSection:        "unknown section id %d",
+	ModuleUnsupportedType:       "unsupported %s 0x%02X",
+	ModuleFunctionCountMismatch: "%d functions declared but %d bodies given",
+	ModuleInvalidIndex:          "%s index %d out of range",
+}
+
+func (t ModuleErrorType) String() string {
+	if name, ok := moduleErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ModuleErrorType(%d)", t)
+}
+
+type ModuleError struct {
+	Type   ModuleErrorType
+	Msg    string
+	Offset uint64 // Into the binary
+	Cause  error
+}
+
+func NewModuleError(eType ModuleErrorType, offset uint64, cause error, paras ...any) error {
+	msg, ok := moduleErrorMessageTemplates[eType]
+	if !ok {
+		msg = moduleErrorMessageTemplates[UndefinedModuleError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	return &ModuleError{
+		Type:   eType,
+		Msg:    msg,
+		Offset: offset,
+		Cause:  cause,
+	}
+}
+
+func (e *ModuleError) Error() string {
+	return fmt.Sprintf("[%s] at 0x%X: %s", e.Type.String(), e.Offset, e.Msg)
+}
+
+func (e *ModuleError) Unwrap() error {
+	return e.Cause
+}
+
+// Sequential reader over a section (or the whole binary). Offsets in
+// errors are relative to the start of the binary.
+type moduleReader struct {
+	data []byte
+	pos  int
+	base uint64
+}
+
+func (r *moduleReader) offset() uint64 {
+	return r.base + uint64(r.pos)
+}
+
+func (r *moduleReader) done() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *moduleReader) malformed(format string, paras ...any) error {
+	return NewModuleError(ModuleMalformed, r.offset(), nil, fmt.Sprintf(format, paras...))
+}
+
+func (r *moduleReader) readByte() (byte, error) {
+	if r.done() {
+		return 0, NewModuleError(ModuleTruncated, r.offset(), nil)
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *moduleReader) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.pos) {
+		return nil, NewModuleError(ModuleTruncated, r.offset(), nil)
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *moduleReader) readU32() (uint32, error) {
+	val, n, err := DecodeULEB128(r.data[r.pos:], 32)
+	if errors.Is(err, errLEB128Truncated) {
+		return 0, NewModuleError(ModuleTruncated, r.offset(), err)
+	}
+	if err != nil {
+		return 0, NewModuleError(ModuleMalformed, r.offset(), err, err.Error())
+	}
+	r.pos += n
+	return uint32(val), nil
+}
+
+func (r *moduleReader) readU64() (uint64, error) {
+	val, n, err := DecodeULEB128(r.data[r.pos:], 64)
+	if errors.Is(err, errLEB128Truncated) {
+		return 0, NewModuleError(ModuleTruncated, r.offset(), err)
+	}
+	if err != nil {
+		return 0, NewModuleError(ModuleMalformed, r.offset(), err, err.Error())
+	}
+	r.pos += n
+	return val, nil
+}
+
+func (r *moduleReader) readSigned(bits uint) (int64, error) {
+	val, n, err := DecodeSLEB128(r.data[r.pos:], bits)
+	if errors.Is(err, errLEB128Truncated) {
+		return 0, NewModuleError(ModuleTruncated, r.offset(), err)
+	}
+	if err != nil {
+		return 0, NewModuleError(ModuleMalformed, r.offset(), err, err.Error())
+	}
+	r.pos += n
+	return val, nil
+}
+
+func (r *moduleReader) readName() (string, error) {
+	n, err := r.readU32()
+	if err != nil {
+		return "", err
+	}
+	start := r.offset()
+	b, err := r.readBytes(uint64(n))
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(b) {
+		return "", NewModuleError(ModuleMalformed, start, nil, "name is not valid UTF-8")
+	}
+	return string(b), nil
+}
+
+// Reads a vector length, rejecting counts that can't possibly fit in
+// what is left, so a corrupt count doesn't cause a huge allocation
+func (r *moduleReader) readCount() (int, error) {
+	n, err := r.readU32()
+	if err != nil {
+		return 0, err
+	}
+	if uint64(n) > uint64(len(r.data)-r.pos) {
+		return 0, NewModuleError(ModuleTruncated, r.offset(), nil)
+	}
+	return int(n), nil
+}
+
+func (r *moduleReader) readValType() (ValueStackEntryType, error) {
+	at := r.offset()
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	vt, ok := valueTypeEncodings[b]
+	if !ok {
+		return 0, NewModuleError(ModuleUnsupportedType, at, nil, "value type", b)
+	}
+	return vt, nil
+}
+
+func (r *moduleReader) readRefType() (RefType, error) {
+	at := r.offset()
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := refTypeNames[RefType(b)]; !ok {
+		return 0, NewModuleError(ModuleUnsupportedType, at, nil, "reference type", b)
+	}
+	return RefType(b), nil
+}
+
+func (r *moduleReader) readLimits(allowShared bool) (Limits, bool, error) {
+	at := r.offset()
+	flags, err := r.readByte()
+	if err != nil {
+		return Limits{}, false, err
+	}
+	if flags > 3 || (flags&2 != 0 && !allowShared) {
+		return Limits{}, false, NewModuleError(ModuleMalformed, at, nil, fmt.Sprintf("limits flags 0x%02X", flags))
+	}
+	min, err := r.readU32()
+	if err != nil {
+		return Limits{}, false, err
+	}
+	limits := Limits{Min: uint64(min)}
+	if flags&1 != 0 {
+		max, err := r.readU32()
+		if err != nil {
+			return Limits{}, false, err
+		}
+		if max < min {
+			return Limits{}, false, NewModuleError(ModuleMalformed, at, nil, "limits maximum below minimum")
+		}
+		limits.Max = new(uint64)
+		*limits.Max = uint64(max)
+	} else if flags&2 != 0 {
+		return Limits{}, false, NewModuleError(ModuleMalformed, at, nil, "shared memory needs a maximum")
+	}
+	return limits, flags&2 != 0, nil
+}
+
+func (r *moduleReader) readTableType() (TableType, error) {
+	rt, err := r.readRefType()
+	if err != nil {
+		return TableType{}, err
+	}
+	limits, _, err := r.readLimits(false)
+	return TableType{ElemType: rt, Limits: limits}, err
+}
+
+func (r *moduleReader) readMemoryType() (MemoryType, error) {
+	limits, shared, err := r.readLimits(true)
+	if err == nil && limits.Min > math.MaxUint32/WasmPageSize+1 {
+		err = r.malformed("memory larger than 4GiB")
+	}
+	return MemoryType{Limits: limits, Shared: shared}, err
+}
+
+func (r *moduleReader) readGlobalType() (GlobalType, error) {
+	vt, err := r.readValType()
+	if err != nil {
+		return GlobalType{}, err
+	}
+	at := r.offset()
+	mut, err := r.readByte()
+	if err != nil {
+		return GlobalType{}, err
+	}
+	if mut > 1 {
+		return GlobalType{}, NewModuleError(ModuleMalformed, at, nil, "global mutability flag")
+	}
+	return GlobalType{ValType: vt, Mutable: mut == 1}, nil
+}
+
+// Constant expressions are limited to a handful of instructions, so
+// they are only scanned for their end here
+func (r *moduleReader) readConstExpr() ([]byte, error) {
+	start := r.pos
+	for {
+		at := r.offset()
+		op, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case OP_END:
+			return r.data[start:r.pos], nil
+		case OP_CONST_I32:
+			_, err = r.readSigned(32)
+		case OP_CONST_I64:
+			_, err = r.readSigned(64)
+		case 0x43: // f32.const
+			_, err = r.readBytes(4)
+		case 0x44: // f64.const
+			_, err = r.readBytes(8)
+		case 0x23, 0xD2: // global.get, ref.func
+			_, err = r.readU32()
+		case 0xD0: // ref.null
+			_, err = r.readRefType()
+		default:
+			return nil, NewModuleError(ModuleMalformed, at, nil, fmt.Sprintf("opcode 0x%02X in constant expression", op))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Decodes a WebAssembly binary module. Sections are checked for order
+// and indices for range, but function bodies are not validated.
+func DecodeModule(data []byte) (*Module, error) {
+	r := &moduleReader{data: data}
+	magic, err := r.readBytes(4)
+	if err != nil || !bytes.Equal(magic, ModuleMagic) {
+		return nil, NewModuleError(ModuleBadMagic, 0, nil)
+	}
+	ver, err := r.readBytes(4)
+	if err != nil {
+		return nil, err
+	}
+	version := uint32(ver[0]) | uint32(ver[1])<<8 | uint32(ver[2])<<16 | uint32(ver[3])<<24
+	if version != ModuleVersion {
+		return nil, NewModuleError(ModuleUnsupportedVersion, 4, nil, version)
+	}
+
+	m := &Module{}
+	last := SectionCustom
+	for !r.done() {
+		at := r.offset()
+		idByte, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		id := SectionID(idByte)
+		size, err := r.readU32()
+		if err != nil {
+			return nil, err
+		}
+		payloadAt := r.offset()
+		payload, err := r.readBytes(uint64(size))
+		if err != nil {
+			return nil, err
+		}
+		sr := &moduleReader{data: payload, base: payloadAt}
+
+		if id != SectionCustom {
+			order, ok := sectionOrder[id]
+			if !ok {
+				return nil, NewModuleError(ModuleUnknownSection, at, nil, idByte)
+			}
+			if order <= sectionOrder[last] {
+				return nil, NewModuleError(ModuleSectionOrder, at, nil, id)
+			}
+			last = id
+		}
+		if err := m.decodeSection(id, sr, last); err != nil {
+			return nil, err
+		}
+		if !sr.done() {
+			return nil, NewModuleError(ModuleMalformed, sr.offset(), nil, fmt.Sprintf("%s section size mismatch", id))
+		}
+	}
+	if err := m.check(r.offset()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Module) decodeSection(id SectionID, r *moduleReader, last SectionID) error {
+	switch id {
+	case SectionCustom:
+		name, err := r.readName()
+		if err != nil {
+			return err
+		}
+		rest, _ := r.readBytes(uint64(len(r.data) - r.pos))
+		m.Customs = append(m.Customs, CustomSection{Name: name, Data: rest, After: last})
+		return nil
+	case SectionStart:
+		idx, err := r.readU32()
+		m.Start = &idx
+		return err
+	case SectionDataCount:
+		n, err := r.readU32()
+		m.DataCount = &n
+		return err
+	}
+
+	count, err := r.readCount()
+	if err != nil {
+		return err
+	}
+	for range count {
+		switch id {
+		case SectionType:
+			err = m.decodeFuncType(r)
+		case SectionImport:
+			err = m.decodeImport(r)
+		case SectionFunction:
+			var idx uint32
+			idx, err = r.readU32()
+			m.Funcs = append(m.Funcs, idx)
+		case SectionTable:
+			var tt TableType
+			tt, err = r.readTableType()
+			m.Tables = append(m.Tables, tt)
+		case SectionMemory:
+			var mt MemoryType
+			mt, err = r.readMemoryType()
+			m.Memories = append(m.Memories, mt)
+		case SectionGlobal:
+			var g ModuleGlobal
+			if g.Type, err = r.readGlobalType(); err == nil {
+				g.Init, err = r.readConstExpr()
+			}
+			m.Globals = append(m.Globals, g)
+		case SectionExport:
+			var exp Export
+			if exp.Name, err = r.readName(); err == nil {
+				exp.Kind, exp.Index, err = r.readExternIndex()
+			}
+			m.Exports = append(m.Exports, exp)
+		case SectionElement:
+			err = m.decodeElement(r)
+		case SectionCode:
+			err = m.decodeCode(r)
+		case SectionData:
+			err = m.decodeData(r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Module) decodeFuncType(r *moduleReader) error {
+	at := r.offset()
+	form, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	if form != 0x60 {
+		return NewModuleError(ModuleMalformed, at, nil, fmt.Sprintf("function type form 0x%02X", form))
+	}
+	var ft FuncType
+	for _, list := range []*[]ValueStackEntryType{&ft.Params, &ft.Results} {
+		n, err := r.readCount()
+		if err != nil {
+			return err
+		}
+		for range n {
+			vt, err := r.readValType()
+			if err != nil {
+				return err
+			}
+			*list = append(*list, vt)
+		}
+	}
+	m.Types = append(m.Types, ft)
+	return nil
+}
+
+func (r *moduleReader) readExternIndex() (ExternType, uint32, error) {
+	at := r.offset()
+	kind, err := r.readByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	if kind > byte(ExternGlobal) {
+		return 0, 0, NewModuleError(ModuleMalformed, at, nil, fmt.Sprintf("extern kind 0x%02X", kind))
+	}
+	idx, err := r.readU32()
+	return ExternType(kind), idx, err
+}
+
+func (m *Module) decodeImport(r *moduleReader) error {
+	var imp Import
+	var err error
+	if imp.Module, err = r.readName(); err != nil {
+		return err
+	}
+	if imp.Name, err = r.readName(); err != nil {
+		return err
+	}
+	at := r.offset()
+	kind, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	imp.Kind = ExternType(kind)
+	switch imp.Kind {
+	case ExternFunc:
+		imp.Func, err = r.readU32()
+	case ExternTable:
+		imp.Table, err = r.readTableType()
+	case ExternMemory:
+		imp.Memory, err = r.readMemoryType()
+	case ExternGlobal:
+		imp.Global, err = r.readGlobalType()
+	default:
+		return NewModuleError(ModuleMalformed, at, nil, fmt.Sprintf("import kind 0x%02X", kind))
+	}
+	m.Imports = append(m.Imports, imp)
+	return err
+}
+
+func (m *Module) decodeElement(r *moduleReader) error {
+	at := r.offset()
+	flags, err := r.readU32()
+	if err != nil {
+		return err
+	}
+	if flags > 7 {
+		return NewModuleError(ModuleMalformed, at, nil, fmt.Sprintf("element segment flags %d", flags))
+	}
+	seg := ElementSegment{Type: RefFunc}
+	switch {
+	case flags&1 == 0:
+		seg.Mode = SegmentActive
+		if flags&2 != 0 {
+			if seg.Table, err = r.readU32(); err != nil {
+				return err
+			}
+		}
+		if seg.Offset, err = r.readConstExpr(); err != nil {
+			return err
+		}
+	case flags&2 == 0:
+		seg.Mode = SegmentPassive
+	default:
+		seg.Mode = SegmentDeclarative
+	}
+	// Flags 0 and 4 have an implicit funcref type, the others spell
+	// out an element kind (for indices) or a reference type (for
+	// expressions)
+	if flags != 0 && flags != 4 {
+		if flags&4 != 0 {
+			seg.Type, err = r.readRefType()
+		} else {
+			kindAt := r.offset()
+			var kind byte
+			if kind, err = r.readByte(); err == nil && kind != 0 {
+				err = NewModuleError(ModuleMalformed, kindAt, nil, fmt.Sprintf("element kind 0x%02X", kind))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	n, err := r.readCount()
+	if err != nil {
+		return err
+	}
+	for range n {
+		if flags&4 != 0 {
+			var expr []byte
+			if expr, err = r.readConstExpr(); err != nil {
+				return err
+			}
+			seg.Exprs = append(seg.Exprs, expr)
+			continue
+		}
+		var idx uint32
+		if idx, err = r.readU32(); err != nil {
+			return err
+		}
+		seg.Funcs = append(seg.Funcs, idx)
+	}
+	m.Elements = append(m.Elements, seg)
+	return nil
+}
+
+func (m *Module) decodeCode(r *moduleReader) error {
+	size, err := r.readU32()
+	if err != nil {
+		return err
+	}
+	bodyAt := r.offset()
+	data, err := r.readBytes(uint64(size))
+	if err != nil {
+		return err
+	}
+	br := &moduleReader{data: data, base: bodyAt}
+	groups, err := br.readCount()
+	if err != nil {
+		return err
+	}
+	body := FuncBody{}
+	var total uint64
+	for range groups {
+		var entry LocalEntry
+		if entry.Count, err = br.readU32(); err != nil {
+			return err
+		}
+		if entry.Type, err = br.readValType(); err != nil {
+			return err
+		}
+		total += uint64(entry.Count)
+		if total > math.MaxUint32 {
+			return br.malformed("too many locals")
+		}
+		body.Locals = append(body.Locals, entry)
+	}
+	body.Code = br.data[br.pos:]
+	body.Offset = br.offset()
+	if len(body.Code) == 0 || body.Code[len(body.Code)-1] != OP_END {
+		return NewModuleError(ModuleMalformed, bodyAt, nil, "function body does not end with end")
+	}
+	m.Code = append(m.Code, body)
+	return nil
+}
+
+func (m *Module) decodeData(r *moduleReader) error {
+	at := r.offset()
+	flags, err := r.readU32()
+	if err != nil {
+		return err
+	}
+	seg := DataSegment{}
+	switch flags {
+	case 0, 2:
+		if flags == 2 {
+			if seg.Memory, err = r.readU32(); err != nil {
+				return err
+			}
+		}
+		if seg.Offset, err = r.readConstExpr(); err != nil {
+			return err
+		}
+	case 1:
+		seg.Mode = SegmentPassive
+	default:
+		return NewModuleError(ModuleMalformed, at, nil, fmt.Sprintf("data segment flags %d", flags))
+	}
+	n, err := r.readU32()
+	if err != nil {
+		return err
+	}
+	if seg.Init, err = r.readBytes(uint64(n)); err != nil {
+		return err
+	}
+	m.Data = append(m.Data, seg)
+	return nil
+}
+
+// Cross section checks once everything has been read
+func (m *Module) check(end uint64) error {
+	if len(m.Funcs) != len(m.Code) {
+		return NewModuleError(ModuleFunctionCountMismatch, end, nil, len(m.Funcs), len(m.Code))
+	}
+	if m.DataCount != nil && int(*m.DataCount) != len(m.Data) {
+		return NewModuleError(ModuleMalformed, end, nil, "data count does not match the data section")
+	}
+	for _, imp := range m.Imports {
+		if imp.Kind == ExternFunc && int(imp.Func) >= len(m.Types) {
+			return NewModuleError(ModuleInvalidIndex, end, nil, "type", imp.Func)
+		}
+	}
+	for _, idx := range m.Funcs {
+		if int(idx) >= len(m.Types) {
+			return NewModuleError(ModuleInvalidIndex, end, nil, "type", idx)
+		}
+	}
+	spaces := map[ExternType]int{
+		ExternFunc:   m.ImportCount(ExternFunc) + len(m.Funcs),
+		ExternTable:  m.ImportCount(ExternTable) + len(m.Tables),
+		ExternMemory: m.ImportCount(ExternMemory) + len(m.Memories),
+		ExternGlobal: m.ImportCount(ExternGlobal) + len(m.Globals),
+	}
+	seen := map[string]bool{}
+	for _, exp := range m.Exports {
+		if seen[exp.Name] {
+			return NewModuleError(ModuleMalformed, end, nil, fmt.Sprintf("duplicate export %q", exp.Name))
+		}
+		seen[exp.Name] = true
+		if int(exp.Index) >= spaces[exp.Kind] {
+			return NewModuleError(ModuleInvalidIndex, end, nil, exp.Kind, exp.Index)
+		}
+	}
+	if m.Start != nil && int(*m.Start) >= spaces[ExternFunc] {
+		return NewModuleError(ModuleInvalidIndex, end, nil, ExternFunc, *m.Start)
+	}
+	return nil
+}
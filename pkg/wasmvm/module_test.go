@@ -0,0 +1,234 @@
+package wasmvm_test
+
+import (
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helpers to hand assemble binary modules
+
+func wasmBinary(sections ...[]byte) []byte {
+	out := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	for _, s := range sections {
+		out = append(out, s...)
+	}
+	return out
+}
+
+func wasmSection(id wasmvm.SectionID, payload ...byte) []byte {
+	out := wasmvm.AppendULEB128([]byte{byte(id)}, uint64(len(payload)))
+	return append(out, payload...)
+}
+
+// Vector of already encoded entries
+func wasmVec(entries ...[]byte) []byte {
+	out := wasmvm.AppendULEB128(nil, uint64(len(entries)))
+	for _, e := range entries {
+		out = append(out, e...)
+	}
+	return out
+}
+
+func wasmName(s string) []byte {
+	return append(wasmvm.AppendULEB128(nil, uint64(len(s))), s...)
+}
+
+func wasmCat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+const (
+	wasmI32 = 0x7F
+	wasmI64 = 0x7E
+	wasmF32 = 0x7D
+	wasmF64 = 0x7C
+)
+
+func wasmFuncType(params []byte, results []byte) []byte {
+	return wasmCat([]byte{0x60}, wasmvm.AppendULEB128(nil, uint64(len(params))), params,
+		wasmvm.AppendULEB128(nil, uint64(len(results))), results)
+}
+
+// Function body without locals
+func wasmBody(code ...byte) []byte {
+	body := append([]byte{0x00}, code...)
+	return append(wasmvm.AppendULEB128(nil, uint64(len(body))), body...)
+}
+
+// Imports env.add (i32, i32) -> (i32), env.mem, env.counter and
+// env.table, defines one function, memory, global and table, and
+// exports the function
+var linkTestModule = wasmBinary(
+	wasmSection(wasmvm.SectionType, wasmVec(
+		wasmFuncType([]byte{wasmI32, wasmI32}, []byte{wasmI32}),
+		wasmFuncType(nil, nil),
+	)...),
+	wasmSection(wasmvm.SectionImport, wasmVec(
+		wasmCat(wasmName("env"), wasmName("add"), []byte{0x00, 0x00}),
+		wasmCat(wasmName("env"), wasmName("mem"), []byte{0x02, 0x01, 0x01, 0x02}),
+		wasmCat(wasmName("env"), wasmName("counter"), []byte{0x03, wasmI64, 0x01}),
+		wasmCat(wasmName("env"), wasmName("table"), []byte{0x01, 0x70, 0x00, 0x02}),
+	)...),
+	wasmSection(wasmvm.SectionFunction, wasmVec([]byte{0x01})...),
+	wasmSection(wasmvm.SectionTable, wasmVec([]byte{0x70, 0x00, 0x01})...),
+	wasmSection(wasmvm.SectionGlobal, wasmVec([]byte{wasmF64, 0x00, 0x44, 0, 0, 0, 0, 0, 0, 0xF0, 0x3F, wasmvm.OP_END})...),
+	wasmSection(wasmvm.SectionExport, wasmVec(
+		wasmCat(wasmName("run"), []byte{0x00, 0x01}),
+		wasmCat(wasmName("counter"), []byte{0x03, 0x00}),
+	)...),
+	wasmSection(wasmvm.SectionStart, 0x01),
+	wasmSection(wasmvm.SectionElement, wasmVec(
+		[]byte{0x00, wasmvm.OP_CONST_I32, 0x00, wasmvm.OP_END, 0x02, 0x00, 0x01},
+		[]byte{0x05, 0x70, 0x01, 0xD2, 0x01, wasmvm.OP_END},
+	)...),
+	wasmSection(wasmvm.SectionDataCount, 0x02),
+	wasmSection(wasmvm.SectionCode, wasmVec(wasmBody(wasmvm.OP_NOP, wasmvm.OP_END))...),
+	wasmSection(wasmvm.SectionData, wasmVec(
+		[]byte{0x00, wasmvm.OP_CONST_I32, 0x10, wasmvm.OP_END, 0x02, 'h', 'i'},
+		[]byte{0x01, 0x01, '!'},
+	)...),
+	wasmSection(wasmvm.SectionCustom, wasmCat(wasmName("name"), []byte{1, 2, 3})...),
+)
+
+func TestDecodeModule(t *testing.T) {
+	m, err := wasmvm.DecodeModule(linkTestModule)
+	require.NoError(t, err)
+
+	assert.Equal(t, "(i32, i32) -> (i32)", m.Types[0].String())
+	require.Len(t, m.Imports, 4)
+	assert.Equal(t, wasmvm.Import{Module: "env", Name: "add", Kind: wasmvm.ExternFunc, Func: 0}, m.Imports[0])
+	two := uint64(2)
+	assert.Equal(t, wasmvm.MemoryType{Limits: wasmvm.Limits{Min: 1, Max: &two}}, m.Imports[1].Memory)
+	assert.Equal(t, wasmvm.GlobalType{ValType: wasmvm.TYPE_I64, Mutable: true}, m.Imports[2].Global)
+	assert.Equal(t, wasmvm.TableType{ElemType: wasmvm.RefFunc, Limits: wasmvm.Limits{Min: 2}}, m.Imports[3].Table)
+	assert.Equal(t, 1, m.ImportCount(wasmvm.ExternFunc))
+
+	assert.Equal(t, []uint32{1}, m.Funcs)
+	ft, ok := m.FuncType(1)
+	assert.True(t, ok)
+	assert.Equal(t, "() -> ()", ft.String())
+	_, ok = m.FuncType(2)
+	assert.False(t, ok)
+
+	assert.Equal(t, []byte{0x44, 0, 0, 0, 0, 0, 0, 0xF0, 0x3F, wasmvm.OP_END}, m.Globals[0].Init)
+	exp, ok := m.Export("run")
+	assert.True(t, ok)
+	assert.Equal(t, wasmvm.Export{Name: "run", Kind: wasmvm.ExternFunc, Index: 1}, exp)
+	assert.Equal(t, uint32(1), *m.Start)
+
+	require.Len(t, m.Elements, 2)
+	assert.Equal(t, []uint32{0, 1}, m.Elements[0].Funcs)
+	assert.Equal(t, wasmvm.SegmentPassive, m.Elements[1].Mode)
+	assert.Equal(t, [][]byte{{0xD2, 0x01, wasmvm.OP_END}}, m.Elements[1].Exprs)
+
+	require.Len(t, m.Code, 1)
+	assert.Equal(t, []byte{wasmvm.OP_NOP, wasmvm.OP_END}, m.Code[0].Code)
+	assert.Equal(t, []byte{wasmvm.OP_NOP}, linkTestModule[m.Code[0].Offset:m.Code[0].Offset+1])
+
+	assert.Equal(t, []byte("hi"), m.Data[0].Init)
+	assert.Equal(t, wasmvm.SegmentPassive, m.Data[1].Mode)
+	assert.Equal(t, []wasmvm.CustomSection{{Name: "name", Data: []byte{1, 2, 3}, After: wasmvm.SectionData}}, m.Customs)
+}
+
+func TestDecodeModule_Errors(t *testing.T) {
+	typeSection := wasmSection(wasmvm.SectionType, wasmVec(wasmFuncType(nil, nil))...)
+	tests := []struct {
+		name      string
+		data      []byte
+		expectErr wasmvm.ModuleErrorType
+	}{
+		{name: "empty module", data: wasmBinary()},
+		{name: "bad magic", data: []byte("\x00asn\x01\x00\x00\x00"), expectErr: wasmvm.ModuleBadMagic},
+		{name: "short", data: []byte{0x00, 'a'}, expectErr: wasmvm.ModuleBadMagic},
+		{name: "version", data: []byte{0x00, 'a', 's', 'm', 0x02, 0x00, 0x00, 0x00}, expectErr: wasmvm.ModuleUnsupportedVersion},
+		{name: "truncated section", data: wasmBinary(typeSection[:len(typeSection)-1]), expectErr: wasmvm.ModuleTruncated},
+		{name: "unknown section", data: wasmBinary(wasmSection(0x20)), expectErr: wasmvm.ModuleUnknownSection},
+		{name: "out of order", data: wasmBinary(wasmSection(wasmvm.SectionFunction, 0x00), typeSection), expectErr: wasmvm.ModuleSectionOrder},
+		{name: "repeated", data: wasmBinary(typeSection, typeSection), expectErr: wasmvm.ModuleSectionOrder},
+		{
+			name:      "v128",
+			data:      wasmBinary(wasmSection(wasmvm.SectionType, wasmVec(wasmFuncType([]byte{0x7B}, nil))...)),
+			expectErr: wasmvm.ModuleUnsupportedType,
+		},
+		{
+			name:      "section size mismatch",
+			data:      wasmBinary(wasmSection(wasmvm.SectionStart, 0x00, 0x00)),
+			expectErr: wasmvm.ModuleMalformed,
+		},
+		{
+			name:      "function without body",
+			data:      wasmBinary(typeSection, wasmSection(wasmvm.SectionFunction, 0x01, 0x00)),
+			expectErr: wasmvm.ModuleFunctionCountMismatch,
+		},
+		{
+			name:      "bad type index",
+			data:      wasmBinary(typeSection, wasmSection(wasmvm.SectionFunction, 0x01, 0x01), wasmSection(wasmvm.SectionCode, wasmVec(wasmBody(wasmvm.OP_END))...)),
+			expectErr: wasmvm.ModuleInvalidIndex,
+		},
+		{
+			name:      "bad export index",
+			data:      wasmBinary(wasmSection(wasmvm.SectionExport, wasmVec(wasmCat(wasmName("x"), []byte{0x02, 0x00}))...)),
+			expectErr: wasmvm.ModuleInvalidIndex,
+		},
+		{
+			name:      "bad start index",
+			data:      wasmBinary(wasmSection(wasmvm.SectionStart, 0x00)),
+			expectErr: wasmvm.ModuleInvalidIndex,
+		},
+		{
+			name: "duplicate export",
+			data: wasmBinary(
+				wasmSection(wasmvm.SectionMemory, wasmVec([]byte{0x00, 0x01})...),
+				wasmSection(wasmvm.SectionExport, wasmVec(wasmCat(wasmName("m"), []byte{0x02, 0x00}), wasmCat(wasmName("m"), []byte{0x02, 0x00}))...),
+			),
+			expectErr: wasmvm.ModuleMalformed,
+		},
+		{
+			name:      "shared memory without maximum",
+			data:      wasmBinary(wasmSection(wasmvm.SectionMemory, wasmVec([]byte{0x02, 0x01})...)),
+			expectErr: wasmvm.ModuleMalformed,
+		},
+		{
+			name:      "non constant global",
+			data:      wasmBinary(wasmSection(wasmvm.SectionGlobal, wasmVec([]byte{wasmI32, 0x00, wasmvm.OP_ADD_I32, wasmvm.OP_END})...)),
+			expectErr: wasmvm.ModuleMalformed,
+		},
+		{
+			name:      "body without end",
+			data:      wasmBinary(typeSection, wasmSection(wasmvm.SectionFunction, 0x01, 0x00), wasmSection(wasmvm.SectionCode, wasmVec(wasmBody(wasmvm.OP_NOP))...)),
+			expectErr: wasmvm.ModuleMalformed,
+		},
+		{
+			name:      "overlong count",
+			data:      wasmBinary(wasmSection(wasmvm.SectionType, 0x80, 0x80, 0x80, 0x80, 0x10)),
+			expectErr: wasmvm.ModuleMalformed,
+		},
+		{
+			name:      "bad name",
+			data:      wasmBinary(wasmSection(wasmvm.SectionCustom, 0x01, 0xFF)),
+			expectErr: wasmvm.ModuleMalformed,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := wasmvm.DecodeModule(tc.data)
+			if tc.expectErr == wasmvm.UndefinedModuleError {
+				assert.NoError(t, err)
+				return
+			}
+			var me *wasmvm.ModuleError
+			require.ErrorAs(t, err, &me)
+			assert.Equal(t, tc.expectErr, me.Type, err.Error())
+		})
+	}
+
+	_, err := wasmvm.DecodeModule(wasmBinary(wasmSection(0x20)))
+	assert.EqualError(t, err, "[ModuleUnknownSection] at 0x8: unknown section id 32")
+}
@@ -0,0 +1,497 @@
+package wasmvm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sync"
+)
+
+// Record and replay of host calls. A Recorder sits between the guest and
+// the host functions of a Linker, logging what goes in and comes out of
+// every call, including what the function wrote to memory. A Replayer
+// stands in for the same functions later on and serves the log back
+// without calling the host, so a run that depended on the clock, files
+// or the network can be repeated exactly. Any call that doesn't match
+// the log traps with a ReplayError.
+//
+// Calls from several threads are logged in whatever order they happen
+// to run, which a replay can't reproduce. Host functions calling back
+// into the guest aren't supported either.
+
+// Starts every log, followed by the format version
+var recordMagic = []byte("\x00wvr")
+
+const recordVersion = 1
+
+// How a logged call ended
+const (
+	recordReturned byte = iota
+	recordExited
+	recordFailed
+)
+
+// Octets a host function wrote to memory
+type MemoryWrite struct {
+	Addr uint64
+	Data []byte
+}
+
+// One logged host call
+type HostCall struct {
+	Module  string
+	Name    string
+	Params  []ValueStackEntry
+	Results []ValueStackEntry
+	// In the order they happened
+	Writes []MemoryWrite
+	// Set when the call ended through proc_exit
+	Exited   bool
+	ExitCode uint32
+	// Message of any other error the call returned
+	Failure string
+}
+
+// Stands in for the memory during a recorded call, keeping a copy of
+// every successful write
+type recordingMemory struct {
+	Memory
+	writes []MemoryWrite
+}
+
+func (m *recordingMemory) Write(ctx MemoryContext, addr uint64, data []byte) MemoryAccessResult {
+	res := m.Memory.Write(ctx, addr, data)
+	if res == MemoryAccessOK {
+		m.writes = append(m.writes, MemoryWrite{Addr: addr, Data: slices.Clone(data)})
+	}
+	return res
+}
+
+// Logs host calls to a writer, one call at a time as they complete
+type Recorder struct {
+	mu     sync.Mutex
+	w      io.Writer
+	header bool
+	buf    []byte
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Wraps ef so that its calls get logged under module and name. Failing
+// to write the log traps the call.
+func (r *Recorder) Wrap(module, name string, ef *ExposedFunc) *ExposedFunc {
+	inner := *ef.Function
+	wrapped := NewExposedFunc(ef.Type, func(ctx context.Context, vm *VMState, params []ValueStackEntry) (results []ValueStackEntry, err error) {
+		call := HostCall{Module: module, Name: name, Params: slices.Clone(params)}
+		mem := &recordingMemory{Memory: vm.Memory}
+		vm.Memory = mem
+		defer func() { vm.Memory = mem.Memory }()
+		results, err = inner(ctx, vm, params)
+		call.Writes = mem.writes
+		switch code, exited := ExitCode(err); {
+		case exited:
+			call.Exited, call.ExitCode = true, code
+		case err != nil:
+			call.Failure = err.Error()
+		default:
+			call.Results = results
+		}
+		if werr := r.write(&call); werr != nil {
+			return nil, werr
+		}
+		return results, err
+	})
+	wrapped.Deterministic = ef.Deterministic
+	return wrapped
+}
+
+// A copy of l with every host function wrapped. Tables and the exports
+// of instances are left alone.
+func (r *Recorder) Linker(l *Linker) *Linker {
+	out := NewLinker()
+	for key, ext := range l.defs {
+		if ext.Kind == ExternFunc && ext.Func.owner == nil {
+			ext.Func = r.Wrap(key.module, key.name, ext.Func)
+		}
+		out.defs[key] = ext
+	}
+	return out
+}
+
+func (r *Recorder) write(call *HostCall) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = r.buf[:0]
+	if !r.header {
+		r.buf = append(append(r.buf, recordMagic...), recordVersion)
+	}
+	r.buf = appendHostCall(r.buf, call)
+	if _, err := r.w.Write(r.buf); err != nil {
+		return fmt.Errorf("recording %s.%s: %w", call.Module, call.Name, err)
+	}
+	r.header = true
+	return nil
+}
+
+func appendRecordString(dst []byte, s []byte) []byte {
+	return append(AppendULEB128(dst, uint64(len(s))), s...)
+}
+
+// The type followed by the bits of the value
+func appendRecordValue(dst []byte, v ValueStackEntry) []byte {
+	dst = append(dst, byte(v.EntryType))
+	switch v.EntryType {
+	case TYPE_I32:
+		return AppendULEB128(dst, uint64(v.Value_I32))
+	case TYPE_F32:
+		return AppendULEB128(dst, uint64(math.Float32bits(v.Value_F32)))
+	case TYPE_I64:
+		return AppendULEB128(dst, v.Value_I64)
+	default:
+		return AppendULEB128(dst, math.Float64bits(v.Value_F64))
+	}
+}
+
+func appendHostCall(dst []byte, call *HostCall) []byte {
+	dst = appendRecordString(dst, []byte(call.Module))
+	dst = appendRecordString(dst, []byte(call.Name))
+	dst = AppendULEB128(dst, uint64(len(call.Params)))
+	for _, v := range call.Params {
+		dst = appendRecordValue(dst, v)
+	}
+	dst = AppendULEB128(dst, uint64(len(call.Writes)))
+	for _, w := range call.Writes {
+		dst = appendRecordString(AppendULEB128(dst, w.Addr), w.Data)
+	}
+	switch {
+	case call.Exited:
+		return AppendULEB128(append(dst, recordExited), uint64(call.ExitCode))
+	case call.Failure != "":
+		return appendRecordString(append(dst, recordFailed), []byte(call.Failure))
+	}
+	dst = AppendULEB128(append(dst, recordReturned), uint64(len(call.Results)))
+	for _, v := range call.Results {
+		dst = appendRecordValue(dst, v)
+	}
+	return dst
+}
+
+type ReplayErrorType byte
+
+const (
+	UndefinedReplayError ReplayErrorType = iota
+	ReplayCorrupt
+	ReplayExhausted
+	ReplayDiverged
+	ReplayWriteFailed
+	ReplayUnfinished
+)
+
+var replayErrorTypeNames = map[ReplayErrorType]string{
+	UndefinedReplayError: "UndefinedReplayError",
+	ReplayCorrupt:        "ReplayCorrupt",
+	ReplayExhausted:      "ReplayExhausted",
+	ReplayDiverged:       "ReplayDiverged",
+	ReplayWriteFailed:    "ReplayWriteFailed",
+	ReplayUnfinished:     "ReplayUnfinished",
+}
+
+var replayErrorMessageTemplates = map[ReplayErrorType]string{
+	UndefinedReplayError: "unknown replay error",
+	ReplayCorrupt:        "log is corrupt: %v",
+	ReplayExhausted:      "call %d to %s.%s is past the end of the log",
+	ReplayDiverged:       "call %d: the log has %s, the guest made %s",
+	ReplayWriteFailed:    "call %d to %s.%s: writing %d octets at %d: %s",
+	ReplayUnfinished:     "%d of %d calls were replayed",
+}
+
+func (t ReplayErrorType) String() string {
+	if name, ok := replayErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ReplayErrorType(%d)", t)
+}
+
+// Reported when a log can't be read or the guest strays from it.
+// Index is the number of the call in the log, from 0.
+type ReplayError struct {
+	Type  ReplayErrorType
+	Msg   string
+	Index int
+	Cause error
+}
+
+func NewReplayError(eType ReplayErrorType, index int, cause error, paras ...any) error {
+	msg, ok := replayErrorMessageTemplates[eType]
+	if !ok {
+		msg = replayErrorMessageTemplates[UndefinedReplayError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	return &ReplayError{
+		Type:  eType,
+		Msg:   msg,
+		Index: index,
+		Cause: cause,
+	}
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("[%s] %s", e.Type.String(), e.Msg)
+}
+
+func (e *ReplayError) Unwrap() error {
+	return e.Cause
+}
+
+// Reads a whole log written by a Recorder
+func ReadHostCalls(r io.Reader) ([]HostCall, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, NewReplayError(ReplayCorrupt, 0, err, err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if !bytes.HasPrefix(data, recordMagic) || len(data) == len(recordMagic) {
+		return nil, NewReplayError(ReplayCorrupt, 0, nil, "not a host call log")
+	}
+	if v := data[len(recordMagic)]; v != recordVersion {
+		return nil, NewReplayError(ReplayCorrupt, 0, nil, fmt.Sprintf("unsupported version %d", v))
+	}
+	rd := &moduleReader{data: data[len(recordMagic)+1:], base: uint64(len(recordMagic) + 1)}
+	var calls []HostCall
+	for !rd.done() {
+		call, err := readHostCall(rd)
+		if err != nil {
+			return nil, NewReplayError(ReplayCorrupt, len(calls), err, err)
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+func readRecordString(r *moduleReader) ([]byte, error) {
+	n, err := r.readU64()
+	if err != nil {
+		return nil, err
+	}
+	return r.readBytes(n)
+}
+
+func readRecordValues(r *moduleReader) ([]ValueStackEntry, error) {
+	n, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]ValueStackEntry, n)
+	for i := range values {
+		at := r.offset()
+		t, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		bits, err := r.readU64()
+		if err != nil {
+			return nil, err
+		}
+		v := ValueStackEntry{EntryType: ValueStackEntryType(t)}
+		switch v.EntryType {
+		case TYPE_I32:
+			v.Value_I32 = uint32(bits)
+		case TYPE_F32:
+			v.Value_F32 = math.Float32frombits(uint32(bits))
+		case TYPE_I64:
+			v.Value_I64 = bits
+		case TYPE_F64:
+			v.Value_F64 = math.Float64frombits(bits)
+		default:
+			return nil, NewModuleError(ModuleMalformed, at, nil, fmt.Sprintf("unknown value type 0x%02x", t))
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func readHostCall(r *moduleReader) (call HostCall, err error) {
+	module, err := readRecordString(r)
+	if err != nil {
+		return call, err
+	}
+	name, err := readRecordString(r)
+	if err != nil {
+		return call, err
+	}
+	call.Module, call.Name = string(module), string(name)
+	if call.Params, err = readRecordValues(r); err != nil {
+		return call, err
+	}
+	n, err := r.readCount()
+	if err != nil {
+		return call, err
+	}
+	for range n {
+		addr, err := r.readU64()
+		if err != nil {
+			return call, err
+		}
+		data, err := readRecordString(r)
+		if err != nil {
+			return call, err
+		}
+		call.Writes = append(call.Writes, MemoryWrite{Addr: addr, Data: data})
+	}
+	at := r.offset()
+	outcome, err := r.readByte()
+	if err != nil {
+		return call, err
+	}
+	switch outcome {
+	case recordReturned:
+		call.Results, err = readRecordValues(r)
+	case recordExited:
+		var code uint32
+		code, err = r.readU32()
+		call.Exited, call.ExitCode = true, code
+	case recordFailed:
+		var msg []byte
+		msg, err = readRecordString(r)
+		call.Failure = string(msg)
+	default:
+		err = NewModuleError(ModuleMalformed, at, nil, fmt.Sprintf("unknown outcome %d", outcome))
+	}
+	return call, err
+}
+
+// Serves the calls of a log back in order
+type Replayer struct {
+	mu    sync.Mutex
+	calls []HostCall
+	next  int
+}
+
+// Reads the whole log up front, so a corrupt one is reported here
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	calls, err := ReadHostCalls(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Replayer{calls: calls}, nil
+}
+
+// A function of type ft that replays the calls logged under module and
+// name instead of doing anything itself
+func (p *Replayer) Func(module, name string, ft FuncType) *ExposedFunc {
+	ef := NewExposedFunc(ft, func(ctx context.Context, vm *VMState, params []ValueStackEntry) ([]ValueStackEntry, error) {
+		call, index, err := p.take(module, name, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range call.Writes {
+			if res := vm.Memory.Write(vm.MemoryContext(), w.Addr, w.Data); res != MemoryAccessOK {
+				return nil, NewReplayError(ReplayWriteFailed, index, nil, index, module, name, len(w.Data), w.Addr, res)
+			}
+		}
+		switch {
+		case call.Exited:
+			return nil, &ExitError{Code: call.ExitCode}
+		case call.Failure != "":
+			return nil, replayedFailure(call.Failure)
+		}
+		// A log recorded against another signature is caught by the
+		// result check of ExposedFunc.Call
+		return slices.Clone(call.Results), nil
+	})
+	// Whatever the original did, the replay only depends on the log
+	ef.Deterministic = true
+	return ef
+}
+
+// A copy of l with every host function replaced by its replay. Tables
+// and the exports of instances are left alone.
+func (p *Replayer) Linker(l *Linker) *Linker {
+	out := NewLinker()
+	for key, ext := range l.defs {
+		if ext.Kind == ExternFunc && ext.Func.owner == nil {
+			ext.Func = p.Func(key.module, key.name, ext.Func.Type)
+		}
+		out.defs[key] = ext
+	}
+	return out
+}
+
+// The next logged call, which has to be to module.name with params
+func (p *Replayer) take(module, name string, params []ValueStackEntry) (*HostCall, int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	index := p.next
+	if index >= len(p.calls) {
+		return nil, index, NewReplayError(ReplayExhausted, index, nil, index, module, name)
+	}
+	call := &p.calls[index]
+	if call.Module != module || call.Name != name || !sameValues(call.Params, params) {
+		return nil, index, NewReplayError(ReplayDiverged, index, nil, index,
+			describeCall(call.Module, call.Name, call.Params), describeCall(module, name, params))
+	}
+	p.next++
+	return call, index, nil
+}
+
+// Reports a ReplayUnfinished error if the guest stopped before the end
+// of the log
+func (p *Replayer) Done() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next < len(p.calls) {
+		return NewReplayError(ReplayUnfinished, p.next, nil, p.next, len(p.calls))
+	}
+	return nil
+}
+
+// Compares bits, so that NaNs match themselves
+func sameValues(a, b []ValueStackEntry) bool {
+	return slices.EqualFunc(a, b, func(x, y ValueStackEntry) bool {
+		return bytes.Equal(appendRecordValue(nil, x), appendRecordValue(nil, y))
+	})
+}
+
+// Formatted like "env.f(i32 1, f64 0.5)"
+func describeCall(module, name string, params []ValueStackEntry) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s.%s(", module, name)
+	for i, v := range params {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		switch v.EntryType {
+		case TYPE_I32:
+			fmt.Fprintf(&b, "i32 %d", v.Value_I32)
+		case TYPE_F32:
+			fmt.Fprintf(&b, "f32 %v", v.Value_F32)
+		case TYPE_I64:
+			fmt.Fprintf(&b, "i64 %d", v.Value_I64)
+		default:
+			fmt.Fprintf(&b, "f64 %v", v.Value_F64)
+		}
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// The context errors come back as themselves so that errors.Is still
+// works on a replayed cancellation
+func replayedFailure(msg string) error {
+	for _, err := range []error{context.Canceled, context.DeadlineExceeded} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,142 @@
+package wasmvm_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecord_ReplayWASI(t *testing.T) {
+	var log bytes.Buffer
+	l, err := wasmvm.NewLinker().DefineWASI(nil)
+	require.NoError(t, err)
+
+	run := func(l *wasmvm.Linker) []byte {
+		vm, err := new(wasmvm.VMConfig).SetSize(64).BuildVMState()
+		require.NoError(t, err)
+		require.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "random_get", i32(0), i32(16)))
+		require.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "clock_time_get", i32(0), i64(1), i32(16)))
+		require.Equal(t, wasmvm.ErrnoFault, wasiCall(t, l, vm, "random_get", i32(60), i32(16)))
+		return vm.Memory.(*wasmvm.FlatMemory).Bytes()
+	}
+	recorded := run(wasmvm.NewRecorder(&log).Linker(l))
+
+	calls, err := wasmvm.ReadHostCalls(bytes.NewReader(log.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, calls, 3)
+	assert.Equal(t, "random_get", calls[0].Name)
+	assert.Equal(t, []wasmvm.MemoryWrite{{Addr: 0, Data: recorded[:16]}}, calls[0].Writes)
+	assert.Empty(t, calls[2].Writes)
+
+	p, err := wasmvm.NewReplayer(bytes.NewReader(log.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, recorded, run(p.Linker(l)))
+	assert.NoError(t, p.Done())
+}
+
+func TestRecord_Divergence(t *testing.T) {
+	var log bytes.Buffer
+	l, err := wasmvm.NewLinker().DefineWASI(nil)
+	require.NoError(t, err)
+	rl := wasmvm.NewRecorder(&log).Linker(l)
+	vm, err := new(wasmvm.VMConfig).SetSize(64).BuildVMState()
+	require.NoError(t, err)
+	require.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, rl, vm, "random_get", i32(0), i32(8)))
+	require.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, rl, vm, "random_get", i32(8), i32(8)))
+
+	call := func(p *wasmvm.Replayer, args ...wasmvm.ValueStackEntry) *wasmvm.ReplayError {
+		vm, err := new(wasmvm.VMConfig).SetSize(64).BuildVMState()
+		require.NoError(t, err)
+		ext, ok := p.Linker(l).Lookup(wasmvm.WASIModuleName, "random_get")
+		require.True(t, ok)
+		for i := range args {
+			vm.ValueStack.Push(&args[i])
+		}
+		err = ext.Func.Call(context.Background(), vm)
+		if err == nil {
+			return nil
+		}
+		var trap *wasmvm.TrapError
+		require.ErrorAs(t, err, &trap)
+		assert.Equal(t, wasmvm.TrapHostFunction, trap.Type)
+		var re *wasmvm.ReplayError
+		require.ErrorAs(t, err, &re)
+		return re
+	}
+
+	p, err := wasmvm.NewReplayer(bytes.NewReader(log.Bytes()))
+	require.NoError(t, err)
+	assert.Nil(t, call(p, i32(0), i32(8)))
+	re := call(p, i32(8), i32(4))
+	require.NotNil(t, re)
+	assert.Equal(t, wasmvm.ReplayDiverged, re.Type)
+	assert.Equal(t, 1, re.Index)
+	assert.Contains(t, re.Msg, "wasi_snapshot_preview1.random_get(i32 8, i32 4)")
+
+	var unfinished *wasmvm.ReplayError
+	require.ErrorAs(t, p.Done(), &unfinished)
+	assert.Equal(t, wasmvm.ReplayUnfinished, unfinished.Type)
+	assert.Nil(t, call(p, i32(8), i32(8)))
+	assert.NoError(t, p.Done())
+	assert.Equal(t, wasmvm.ReplayExhausted, call(p, i32(0), i32(8)).Type)
+}
+
+func TestRecord_Outcomes(t *testing.T) {
+	var log bytes.Buffer
+	l, err := wasmvm.NewLinker().DefineWASI(nil)
+	require.NoError(t, err)
+	l, err = l.DefineHostFunc("env", "fail", func(x int32) error { return context.Canceled })
+	require.NoError(t, err)
+	rl := wasmvm.NewRecorder(&log).Linker(l)
+
+	run := func(l *wasmvm.Linker) (error, error) {
+		vm, err := new(wasmvm.VMConfig).SetSize(64).BuildVMState()
+		require.NoError(t, err)
+		fail, _ := l.Lookup("env", "fail")
+		exit, _ := l.Lookup(wasmvm.WASIModuleName, "proc_exit")
+		vm.ValueStack.Push(&wasmvm.ValueStackEntry{EntryType: wasmvm.TYPE_I32, Value_I32: 1})
+		failErr := fail.Func.Call(context.Background(), vm)
+		vm.ValueStack.Push(&wasmvm.ValueStackEntry{EntryType: wasmvm.TYPE_I32, Value_I32: 3})
+		return failErr, exit.Func.Call(context.Background(), vm)
+	}
+	run(rl)
+
+	p, err := wasmvm.NewReplayer(bytes.NewReader(log.Bytes()))
+	require.NoError(t, err)
+	failErr, exitErr := run(p.Linker(l))
+	assert.ErrorIs(t, failErr, context.Canceled)
+	code, ok := wasmvm.ExitCode(exitErr)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(3), code)
+
+	// Replays only depend on the log
+	ext, _ := p.Linker(l).Lookup("env", "fail")
+	assert.True(t, ext.Func.Deterministic)
+}
+
+func TestRecord_Corrupt(t *testing.T) {
+	var log bytes.Buffer
+	l, err := wasmvm.NewLinker().DefineWASI(nil)
+	require.NoError(t, err)
+	vm, err := new(wasmvm.VMConfig).SetSize(64).BuildVMState()
+	require.NoError(t, err)
+	wasiCall(t, wasmvm.NewRecorder(&log).Linker(l), vm, "random_get", i32(0), i32(8))
+
+	for _, data := range [][]byte{
+		[]byte("not a log"),
+		log.Bytes()[:4],
+		log.Bytes()[:log.Len()-1],
+	} {
+		_, err := wasmvm.NewReplayer(bytes.NewReader(data))
+		var re *wasmvm.ReplayError
+		require.ErrorAs(t, err, &re)
+		assert.Equal(t, wasmvm.ReplayCorrupt, re.Type)
+	}
+	calls, err := wasmvm.ReadHostCalls(bytes.NewReader(nil))
+	assert.NoError(t, err)
+	assert.Empty(t, calls)
+}
@@ -0,0 +1,125 @@
+package wasmvm
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Holds instances that can import each other's exports. Every instance
+// is registered under a name, and its exports become importable as
+// name.export by anything instantiated afterwards, next to whatever the
+// host defines in Linker.
+type Store struct {
+	config    *VMConfig
+	linker    *Linker
+	instances map[string]*Instance
+	names     []string // In instantiation order
+}
+
+type StoreErrorType byte
+
+const (
+	UndefinedStoreError StoreErrorType = iota
+	StoreDuplicateInstance
+)
+
+var storeErrorTypeNames = map[StoreErrorType]string{
+	UndefinedStoreError:    "UndefinedStoreError",
+	StoreDuplicateInstance: "StoreDuplicateInstance",
+}
+
+var storeErrorMessageTemplates = map[StoreErrorType]string{
+	UndefinedStoreError:    "unknown store error",
+	StoreDuplicateInstance: "instance %q already exists",
+}
+
+func (t StoreErrorType) String() string {
+	if name, ok := storeErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("StoreErrorType(%d)", t)
+}
+
+type StoreError struct {
+	Type StoreErrorType
+	Msg  string
+}
+
+func NewStoreError(eType StoreErrorType, paras ...any) error {
+	msg, ok := storeErrorMessageTemplates[eType]
+	if !ok {
+		msg = storeErrorMessageTemplates[UndefinedStoreError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	return &StoreError{
+		Type: eType,
+		Msg:  msg,
+	}
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("[%s] %s", e.Type.String(), e.Msg)
+}
+
+// config is passed on to every Instantiate and may be nil
+func NewStore(config *VMConfig) *Store {
+	return &Store{
+		config:    config,
+		linker:    NewLinker(),
+		instances: map[string]*Instance{},
+	}
+}
+
+// The linker imports are resolved against. Host definitions go here;
+// instance exports are added by Instantiate.
+func (s *Store) Linker() *Linker {
+	return s.linker
+}
+
+// Instantiates m against the host definitions and the instances already
+// in the store, then registers its exports under name
+func (s *Store) Instantiate(name string, m *Module) (*Instance, error) {
+	if _, ok := s.instances[name]; ok {
+		return nil, NewStoreError(StoreDuplicateInstance, name)
+	}
+	inst, err := Instantiate(m, s.linker, s.config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.linker.DefineInstance(name, inst); err != nil {
+		return nil, err
+	}
+	s.instances[name] = inst
+	s.names = append(s.names, name)
+	return inst, nil
+}
+
+// Decodes and instantiates a binary module
+func (s *Store) InstantiateBinary(name string, data []byte) (*Instance, error) {
+	m, err := DecodeModule(data)
+	if err != nil {
+		return nil, err
+	}
+	return s.Instantiate(name, m)
+}
+
+func (s *Store) Instance(name string) (*Instance, bool) {
+	inst, ok := s.instances[name]
+	return inst, ok
+}
+
+// Names of the instances, in the order they were instantiated
+func (s *Store) Instances() []string {
+	return slices.Clone(s.names)
+}
+
+// Looks up an export of a named instance
+func (s *Store) Export(instance, name string) (Extern, bool) {
+	inst, ok := s.instances[instance]
+	if !ok {
+		return Extern{}, false
+	}
+	return inst.Export(name)
+}
@@ -0,0 +1,134 @@
+package wasmvm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A library exporting a memory, a mutable global, a table and a
+// function that logs through the host
+var storeLibModule = wasmBinary(
+	wasmSection(wasmvm.SectionType, wasmVec(
+		wasmFuncType([]byte{wasmI32}, []byte{wasmI32}),
+		wasmFuncType([]byte{wasmI32}, nil),
+	)...),
+	wasmSection(wasmvm.SectionImport, wasmVec(
+		wasmCat(wasmName("host"), wasmName("log"), []byte{0x00, 0x01}),
+	)...),
+	wasmSection(wasmvm.SectionFunction, wasmVec([]byte{0x00})...),
+	wasmSection(wasmvm.SectionTable, wasmVec([]byte{0x70, 0x00, 0x01})...),
+	wasmSection(wasmvm.SectionMemory, wasmVec([]byte{0x00, 0x01})...),
+	wasmSection(wasmvm.SectionGlobal, wasmVec([]byte{wasmI32, 0x01, wasmvm.OP_CONST_I32, 0x00, wasmvm.OP_END})...),
+	wasmSection(wasmvm.SectionExport, wasmVec(
+		wasmCat(wasmName("twice"), []byte{0x00, 0x01}),
+		wasmCat(wasmName("table"), []byte{0x01, 0x00}),
+		wasmCat(wasmName("memory"), []byte{0x02, 0x00}),
+		wasmCat(wasmName("calls"), []byte{0x03, 0x00}),
+	)...),
+	wasmSection(wasmvm.SectionElement, wasmVec([]byte{0x00, wasmvm.OP_CONST_I32, 0x00, wasmvm.OP_END, 0x01, 0x01})...),
+	wasmSection(wasmvm.SectionCode, wasmVec(
+		// twice: logs its argument, counts the call and doubles it
+		wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_CALL, 0,
+			wasmvm.OP_GLOBAL_GET, 0, wasmvm.OP_CONST_I32, 1, wasmvm.OP_ADD_I32, wasmvm.OP_GLOBAL_SET, 0,
+			wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_ADD_I32, wasmvm.OP_END),
+	)...),
+)
+
+// An application linked against the library: run calls twice directly
+// and through the library's table, then bumps the shared global
+var storeAppModule = wasmBinary(
+	wasmSection(wasmvm.SectionType, wasmVec(
+		wasmFuncType([]byte{wasmI32}, []byte{wasmI32}),
+	)...),
+	wasmSection(wasmvm.SectionImport, wasmVec(
+		wasmCat(wasmName("lib"), wasmName("twice"), []byte{0x00, 0x00}),
+		wasmCat(wasmName("lib"), wasmName("table"), []byte{0x01, 0x70, 0x00, 0x01}),
+		wasmCat(wasmName("lib"), wasmName("memory"), []byte{0x02, 0x00, 0x01}),
+		wasmCat(wasmName("lib"), wasmName("calls"), []byte{0x03, wasmI32, 0x01}),
+	)...),
+	wasmSection(wasmvm.SectionFunction, wasmVec([]byte{0x00})...),
+	wasmSection(wasmvm.SectionExport, wasmVec(wasmCat(wasmName("run"), []byte{0x00, 0x01}))...),
+	wasmSection(wasmvm.SectionCode, wasmVec(
+		wasmBody(wasmvm.OP_LOCAL_GET, 0, wasmvm.OP_CALL, 0,
+			wasmvm.OP_CONST_I32, 0, wasmvm.OP_CALL_INDIRECT, 0x00, 0x00,
+			wasmvm.OP_GLOBAL_GET, 0, wasmvm.OP_CONST_I32, 10, wasmvm.OP_ADD_I32, wasmvm.OP_GLOBAL_SET, 0,
+			wasmvm.OP_END),
+	)...),
+	wasmSection(wasmvm.SectionData, wasmVec([]byte{0x00, wasmvm.OP_CONST_I32, 0x00, wasmvm.OP_END, 0x03, 'a', 'p', 'p'})...),
+)
+
+func TestStore_LinkInstances(t *testing.T) {
+	s := wasmvm.NewStore(nil)
+	var logged []int32
+	_, err := s.Linker().DefineFunc("host", "log", wasmvm.HostFunc1_0(func(_ context.Context, _ *wasmvm.VMState, v int32) error {
+		logged = append(logged, v)
+		return nil
+	}))
+	require.NoError(t, err)
+
+	lib, err := s.InstantiateBinary("lib", storeLibModule)
+	require.NoError(t, err)
+	app, err := s.InstantiateBinary("app", storeAppModule)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lib", "app"}, s.Instances())
+
+	got, err := wasmvm.Call1[int32](context.Background(), app.ExportedFunction("run"), 3)
+	require.NoError(t, err)
+	assert.Equal(t, int32(12), got)
+	assert.Equal(t, []int32{3, 6}, logged)
+
+	// Both instances see the same global and memory
+	assert.Same(t, lib.Globals[0], app.Globals[0])
+	assert.Equal(t, uint32(12), lib.Globals[0].Value.Value_I32)
+	assert.Same(t, lib.VM.Memory, app.VM.Memory)
+	buf := make([]byte, 3)
+	lib.VM.Memory.Read(wasmvm.MemoryContext{}, 0, buf)
+	assert.Equal(t, []byte("app"), buf)
+
+	ext, ok := s.Export("app", "run")
+	require.True(t, ok)
+	assert.Equal(t, wasmvm.ExternFunc, ext.Kind)
+	_, ok = s.Export("libc", "twice")
+	assert.False(t, ok)
+	inst, ok := s.Instance("lib")
+	assert.True(t, ok)
+	assert.Same(t, lib, inst)
+}
+
+func TestStore_Errors(t *testing.T) {
+	s := wasmvm.NewStore(nil)
+	// Nothing provides lib yet
+	_, err := s.InstantiateBinary("app", storeAppModule)
+	var ie *wasmvm.InstanceError
+	require.ErrorAs(t, err, &ie)
+	assert.Equal(t, wasmvm.InstanceLinkFailed, ie.Type)
+	assert.Empty(t, s.Instances())
+
+	_, err = s.Linker().DefineHostFunc("host", "log", func(int32) {})
+	require.NoError(t, err)
+	_, err = s.InstantiateBinary("lib", storeLibModule)
+	require.NoError(t, err)
+	_, err = s.InstantiateBinary("lib", storeLibModule)
+	assert.EqualError(t, err, "[StoreDuplicateInstance] instance \"lib\" already exists")
+
+	// Exports only clash by name, so a module can be shared with the host
+	_, err = s.InstantiateBinary("host", storeLibModule)
+	assert.NoError(t, err)
+	_, err = s.Linker().DefineHostFunc("other", "twice", func() {})
+	require.NoError(t, err)
+	_, err = s.InstantiateBinary("other", storeLibModule)
+	var le *wasmvm.LinkError
+	require.ErrorAs(t, err, &le)
+	assert.Equal(t, wasmvm.LinkDuplicate, le.Problems[0].Type)
+	assert.Equal(t, []string{"lib", "host"}, s.Instances())
+}
+
+func TestStore_BadBinary(t *testing.T) {
+	_, err := wasmvm.NewStore(nil).InstantiateBinary("x", []byte("nope"))
+	var me *wasmvm.ModuleError
+	assert.ErrorAs(t, err, &me)
+}
@@ -0,0 +1,425 @@
+package wasmvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Legacy mode is the original behavior, a single thread running in
+// ring 0. Protected mode enables rings and allows the host to spawn
+// additional threads that share the memory of the VM.
+type ExecutionMode byte
+
+const (
+	LegacyMode ExecutionMode = iota
+	ProtectedMode
+)
+
+var executionModeNames = map[ExecutionMode]string{
+	LegacyMode:    "legacy",
+	ProtectedMode: "protected",
+}
+
+func (m ExecutionMode) String() string {
+	if name, ok := executionModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("ExecutionMode(%d)", m)
+}
+
+func ParseExecutionMode(s string) (ExecutionMode, error) {
+	key := strings.ToLower(strings.TrimSpace(s))
+	for k, v := range executionModeNames {
+		if v == key {
+			return k, nil
+		}
+	}
+	return LegacyMode, fmt.Errorf("unknown execution mode: %q", s)
+}
+
+func (m *ExecutionMode) UnmarshalText(text []byte) error {
+	val, err := ParseExecutionMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = val
+	return nil
+}
+
+// Written by name, or as a number when it has none
+func (m ExecutionMode) MarshalJSON() ([]byte, error) {
+	if name, ok := executionModeNames[m]; ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(int(m))
+}
+
+func (m *ExecutionMode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return m.UnmarshalText([]byte(s))
+	}
+	var i int
+	if err := json.Unmarshal(data, &i); err == nil {
+		*m = ExecutionMode(i)
+		return nil
+	}
+	return fmt.Errorf("ExecutionMode: cannot unmarshal %s", string(data))
+}
+
+// Thread 0 is always the VMState returned by NewVM
+type ThreadID uint32
+
+// Pushed for each function call. The legacy VM only uses the first two
+// fields; instances also track which function is running and where its
+// labels and results start.
+type CallFrame struct {
+	ReturnPC    uint64
+	StackHeight int    // ValueStack size when the frame was entered, below the parameters
+	Func        uint32 // Function index
+	Labels      int    // Label stack size when the frame was entered
+	Arity       int    // Number of results
+}
+
+// A structured control instruction (block, loop, if or the function
+// body itself) that is currently open
+type Label struct {
+	Loop bool
+	Func bool
+	// Where a branch to a loop continues
+	Start uint64
+	// The matching end instruction
+	End uint64
+	// ValueStack size below the values the label takes
+	StackHeight int
+	// How many values a branch to the label carries
+	Arity int
+}
+
+// The execution context of a single thread. VMState embeds it, so
+// instructions keep using vm.PC, vm.ValueStack, etc.
+type Thread struct {
+	ID         ThreadID
+	PC         uint64 // Program Counter
+	Ring       uint8
+	Trap       bool
+	TrapErr    *TrapError
+	ValueStack ValueStack
+	CallStack  []CallFrame
+	Labels     []Label
+
+	// Set from other goroutines, checked before every step
+	aborted abortFlag
+}
+
+// Whether a thread has been aborted, along with a channel that is
+// closed once it is, for waits that would otherwise never see the flag
+type abortFlag struct {
+	flag atomic.Bool
+	mu   sync.Mutex
+	ch   chan struct{}
+}
+
+func (a *abortFlag) Load() bool {
+	return a.flag.Load()
+}
+
+// Clearing the flag starts a fresh channel for the next abort
+func (a *abortFlag) Store(aborted bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.flag.Swap(aborted) == aborted {
+		return
+	}
+	if aborted && a.ch != nil {
+		close(a.ch)
+	} else if !aborted {
+		a.ch = nil
+	}
+}
+
+func (a *abortFlag) Done() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ch == nil {
+		a.ch = make(chan struct{})
+		if a.flag.Load() {
+			close(a.ch)
+		}
+	}
+	return a.ch
+}
+
+// The channel that interrupts a blocking wait of this thread, closed
+// when it is aborted or the context of the call it runs for is done.
+// stop releases it once the wait is over.
+func (vm *VMState) waitCancel() (cancel <-chan struct{}, stop func()) {
+	abort := vm.aborted.Done()
+	if vm.ctx == nil || vm.ctx.Done() == nil {
+		return abort, func() {}
+	}
+	ctxDone := vm.ctx.Done()
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		select {
+		case <-abort:
+		case <-ctxDone:
+		case <-stopped:
+			return
+		}
+		close(done)
+	}()
+	return done, func() { close(stopped) }
+}
+
+type ThreadErrorType byte
+
+const (
+	UndefinedThreadError ThreadErrorType = iota
+	ThreadLegacyMode
+	ThreadLimitReached
+	ThreadRingDisabled
+	ThreadUnknown
+	ThreadNotJoinable
+	ThreadGroupAborted
+	ThreadDeterministic
+	ThreadMemoryNotShared
+)
+
+var threadErrorTypeNames = map[ThreadErrorType]string{
+	UndefinedThreadError:  "UndefinedThreadError",
+	ThreadLegacyMode:      "ThreadLegacyMode",
+	ThreadLimitReached:    "ThreadLimitReached",
+	ThreadRingDisabled:    "ThreadRingDisabled",
+	ThreadUnknown:         "ThreadUnknown",
+	ThreadNotJoinable:     "ThreadNotJoinable",
+	ThreadGroupAborted:    "ThreadGroupAborted",
+	ThreadDeterministic:   "ThreadDeterministic",
+	ThreadMemoryNotShared: "ThreadMemoryNotShared",
+}
+
+var threadErrorMessageTemplates = map[ThreadErrorType]string{
+	UndefinedThreadError:  "unknown thread error",
+	ThreadLegacyMode:      "threads require protected mode",
+	ThreadLimitReached:    "thread limit of %d reached",
+	ThreadRingDisabled:    "ring %d is not enabled",
+	ThreadUnknown:         "unknown thread %d",
+	ThreadNotJoinable:     "thread %d cannot be joined",
+	ThreadGroupAborted:    "thread 0 has been aborted",
+	ThreadDeterministic:   "threads are not allowed in deterministic mode",
+	ThreadMemoryNotShared: "threads require a shared memory",
+}
+
+func (t ThreadErrorType) String() string {
+	if name, ok := threadErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ThreadErrorType(%d)", t)
+}
+
+type ThreadError struct {
+	Type   ThreadErrorType
+	Msg    string
+	Thread ThreadID
+}
+
+func NewThreadError(eType ThreadErrorType, id ThreadID, paras ...any) error {
+	msg, ok := threadErrorMessageTemplates[eType]
+	if !ok {
+		msg = threadErrorMessageTemplates[UndefinedThreadError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	return &ThreadError{
+		Type:   eType,
+		Msg:    msg,
+		Thread: id,
+	}
+}
+
+func (e *ThreadError) Error() string {
+	return fmt.Sprintf("[%s] %s", e.Type.String(), e.Msg)
+}
+
+type threadHandle struct {
+	vm   *VMState
+	done chan struct{} // nil for thread 0, which the host runs itself
+}
+
+// Shared by every thread of a protected mode VM
+type threadGroup struct {
+	mu      sync.Mutex
+	next    ThreadID
+	max     uint32
+	aborted bool
+	threads map[ThreadID]*threadHandle
+}
+
+func newThreadGroup(primary *VMState, max uint32) *threadGroup {
+	return &threadGroup{
+		next: 1,
+		max:  max,
+		threads: map[ThreadID]*threadHandle{
+			0: {vm: primary},
+		},
+	}
+}
+
+// Starts a new thread at start in the given ring, running on its own
+// goroutine until it traps. args are pushed onto its value stack, bottom
+// first. Only available in protected mode, with a shared memory since
+// the other memories aren't safe to use from more than one goroutine.
+// The thread runs under the context of the call vm is running for, if
+// any, so cancelling it interrupts the thread too.
+func (vm *VMState) SpawnThread(start uint64, ring uint8, args ...ValueStackEntry) (ThreadID, error) {
+	tg := vm.threads
+	if tg == nil {
+		return 0, NewThreadError(ThreadLegacyMode, 0)
+	}
+	if vm.deterministic {
+		return 0, NewThreadError(ThreadDeterministic, 0)
+	}
+	if am, ok := vm.Memory.(AtomicMemory); !ok || !am.Shared() {
+		return 0, NewThreadError(ThreadMemoryNotShared, 0)
+	}
+	if rc, ok := vm.Config.Rings[ring]; !ok || !rc.Enabled {
+		return 0, NewThreadError(ThreadRingDisabled, 0, ring)
+	}
+
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	if tg.aborted {
+		return 0, NewThreadError(ThreadGroupAborted, 0)
+	}
+	if tg.max > 0 && uint32(len(tg.threads)) >= tg.max {
+		return 0, NewThreadError(ThreadLimitReached, 0, tg.max)
+	}
+	id := tg.next
+	tg.next++
+	view := &VMState{
+		Thread: Thread{
+			ID:   id,
+			PC:   start,
+			Ring: ring,
+		},
+		Memory:         vm.Memory,
+		Config:         vm.Config,
+		InstructionMap: vm.InstructionMap,
+		threads:        tg,
+		instance:       vm.instance,
+		code:           vm.code,
+		ctx:            vm.ctx,
+	}
+	for i := range args {
+		view.ValueStack.Push(&args[i])
+	}
+	handle := &threadHandle{vm: view, done: make(chan struct{})}
+	tg.threads[id] = handle
+	go func() {
+		defer close(handle.done)
+		view.runThread()
+	}()
+	return id, nil
+}
+
+// MainLoop for a spawned thread, which also stops once the context it
+// runs under is done
+func (vm *VMState) runThread() {
+	if vm.ctx == nil || vm.ctx.Done() == nil {
+		vm.MainLoop()
+		return
+	}
+	done := vm.ctx.Done()
+	for steps := 0; !vm.Trap; steps++ {
+		if steps&1023 == 0 {
+			select {
+			case <-done:
+				vm.SetTrapError(&TrapError{
+					Type:    TrapInterrupted,
+					Op:      "THREAD",
+					PC:      vm.PC,
+					Message: fmt.Sprintf("Thread %d interrupted: %v", vm.ID, context.Cause(vm.ctx)),
+					Cause:   context.Cause(vm.ctx),
+				})
+				return
+			default:
+			}
+		}
+		vm.stepAndReport()
+	}
+}
+
+// Waits for a spawned thread to trap and returns its state, the reason
+// being in TrapErr. A thread can only be joined once.
+func (vm *VMState) JoinThread(id ThreadID) (*VMState, error) {
+	tg := vm.threads
+	if tg == nil {
+		return nil, NewThreadError(ThreadLegacyMode, id)
+	}
+	if id == 0 || id == vm.ID {
+		return nil, NewThreadError(ThreadNotJoinable, id, id)
+	}
+	tg.mu.Lock()
+	handle, ok := tg.threads[id]
+	if ok {
+		delete(tg.threads, id)
+	}
+	tg.mu.Unlock()
+	if !ok {
+		return nil, NewThreadError(ThreadUnknown, id, id)
+	}
+	<-handle.done
+	return handle.vm, nil
+}
+
+// Requests that a thread stop; it traps with TrapThreadAborted before
+// its next instruction. Aborting thread 0 aborts every thread and
+// prevents new ones from being spawned. A thread blocked in an atomic
+// wait is woken to trap.
+func (vm *VMState) AbortThread(id ThreadID) error {
+	tg := vm.threads
+	if tg == nil {
+		if id != 0 {
+			return NewThreadError(ThreadLegacyMode, id)
+		}
+		vm.aborted.Store(true)
+		return nil
+	}
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	if id == 0 {
+		tg.aborted = true
+		for _, handle := range tg.threads {
+			handle.vm.aborted.Store(true)
+		}
+		return nil
+	}
+	handle, ok := tg.threads[id]
+	if !ok {
+		return NewThreadError(ThreadUnknown, id, id)
+	}
+	handle.vm.aborted.Store(true)
+	return nil
+}
+
+// IDs of the threads that have not been joined yet, including thread 0
+func (vm *VMState) Threads() []ThreadID {
+	tg := vm.threads
+	if tg == nil {
+		return []ThreadID{0}
+	}
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	ids := make([]ThreadID, 0, len(tg.threads))
+	for id := ThreadID(0); id < tg.next; id++ {
+		if _, ok := tg.threads[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
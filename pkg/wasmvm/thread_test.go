@@ -0,0 +1,271 @@
+package wasmvm_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Adds 1 to the i32 at the address passed as the thread argument,
+// leaving the previous value on the stack
+var threadIncrement = []byte{
+	wasmvm.OP_CONST_I32, 0x01, 0x00, 0x00, 0x00,
+	wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_RMW_ADD_I32, 2, 0,
+	wasmvm.OP_END,
+}
+
+// Repeatedly sleeps for a millisecond through wait32, long enough
+// for an abort to land while it is still running
+func threadSleeper() []byte {
+	program := []byte{}
+	for range 100 {
+		program = append(program,
+			wasmvm.OP_CONST_I32, 0x00, 0x10, 0x00, 0x00,
+			wasmvm.OP_CONST_I32, 0x00, 0x00, 0x00, 0x00,
+			wasmvm.OP_CONST_I64, 0x40, 0x42, 0x0F, 0x00, 0x00, 0x00, 0x00, 0x00,
+			wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_WAIT32, 2, 0,
+		)
+	}
+	return append(program, wasmvm.OP_END)
+}
+
+// Thread 0 ends straight away, the increment program follows it and the
+// sleeper comes after that
+func newThreadTestVM(t *testing.T, config *wasmvm.VMConfig) (*wasmvm.VMState, uint64, uint64) {
+	program := append([]byte{wasmvm.OP_END}, threadIncrement...)
+	sleeper := uint64(len(program))
+	program = append(program, threadSleeper()...)
+	config.Image = (&wasmvm.ImageConfig{}).SetArray(program).SetSize(uint64(len(program)))
+	vm, err := config.
+		SetSize(wasmvm.MemoryShardSize * 2).
+		SetShared(true).
+		BuildVMState()
+	require.NoError(t, err)
+	return vm, 1, sleeper
+}
+
+func requireThreadError(t *testing.T, err error, eType wasmvm.ThreadErrorType) {
+	t.Helper()
+	var te *wasmvm.ThreadError
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, eType, te.Type)
+}
+
+func TestThread_LegacyMode(t *testing.T) {
+	vm, increment, _ := newThreadTestVM(t, &wasmvm.VMConfig{})
+	_, err := vm.SpawnThread(increment, 0)
+	requireThreadError(t, err, wasmvm.ThreadLegacyMode)
+	_, err = vm.JoinThread(1)
+	requireThreadError(t, err, wasmvm.ThreadLegacyMode)
+	requireThreadError(t, vm.AbortThread(1), wasmvm.ThreadLegacyMode)
+	assert.Equal(t, []wasmvm.ThreadID{0}, vm.Threads())
+
+	// The single thread can still be aborted by the host
+	require.NoError(t, vm.AbortThread(0))
+	assert.Error(t, vm.Step())
+	assert.Equal(t, wasmvm.TrapThreadAborted, vm.TrapErr.Type)
+	assert.Equal(t, uint64(0), vm.PC)
+}
+
+func TestThread_SpawnJoin(t *testing.T) {
+	vm, increment, _ := newThreadTestVM(t, (&wasmvm.VMConfig{}).
+		SetMode(wasmvm.ProtectedMode).
+		SetRingConfig(map[uint8]wasmvm.RingConfig{1: {Enabled: true}}))
+
+	ids := []wasmvm.ThreadID{}
+	for i := range 4 {
+		id, err := vm.SpawnThread(increment, uint8(i%2), i32(atomicDataAddr))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []wasmvm.ThreadID{1, 2, 3, 4}, ids)
+	assert.Equal(t, []wasmvm.ThreadID{0, 1, 2, 3, 4}, vm.Threads())
+
+	vm.MainLoop()
+	assert.Equal(t, wasmvm.TrapCallStackEmpty, vm.TrapErr.Type)
+
+	for i, id := range ids {
+		thread, err := vm.JoinThread(id)
+		require.NoError(t, err)
+		assert.Equal(t, id, thread.ID)
+		assert.Equal(t, uint8(i%2), thread.Ring)
+		assert.Equal(t, wasmvm.TrapCallStackEmpty, thread.TrapErr.Type)
+		assert.Equal(t, 1, thread.ValueStack.Size())
+	}
+	assert.Equal(t, []wasmvm.ThreadID{0}, vm.Threads())
+
+	buf := make([]byte, 4)
+	require.NoError(t, vm.ReadMemory("TEST", atomicDataAddr, buf))
+	assert.Equal(t, []byte{0x04, 0x00, 0x00, 0x00}, buf)
+
+	// Each thread keeps its own trap and stack
+	assert.True(t, vm.ValueStack.IsEmpty())
+}
+
+func TestThread_SpawnErrors(t *testing.T) {
+	vm, increment, _ := newThreadTestVM(t, (&wasmvm.VMConfig{}).
+		SetMode(wasmvm.ProtectedMode).
+		SetMaxThreads(2).
+		SetRingConfig(map[uint8]wasmvm.RingConfig{2: {Enabled: false}}))
+
+	_, err := vm.SpawnThread(increment, 2)
+	requireThreadError(t, err, wasmvm.ThreadRingDisabled)
+	_, err = vm.SpawnThread(increment, 3)
+	requireThreadError(t, err, wasmvm.ThreadRingDisabled)
+
+	id, err := vm.SpawnThread(increment, 0, i32(atomicDataAddr))
+	require.NoError(t, err)
+	_, err = vm.SpawnThread(increment, 0, i32(atomicDataAddr))
+	requireThreadError(t, err, wasmvm.ThreadLimitReached)
+	assert.EqualError(t, err, "[ThreadLimitReached] thread limit of 2 reached")
+
+	_, err = vm.JoinThread(0)
+	requireThreadError(t, err, wasmvm.ThreadNotJoinable)
+	_, err = vm.JoinThread(42)
+	requireThreadError(t, err, wasmvm.ThreadUnknown)
+	requireThreadError(t, vm.AbortThread(42), wasmvm.ThreadUnknown)
+
+	_, err = vm.JoinThread(id)
+	require.NoError(t, err)
+	_, err = vm.JoinThread(id)
+	requireThreadError(t, err, wasmvm.ThreadUnknown)
+
+	// Joining frees up the slot
+	_, err = vm.SpawnThread(increment, 0, i32(atomicDataAddr))
+	assert.NoError(t, err)
+}
+
+func TestThread_MemoryNotShared(t *testing.T) {
+	vm, err := (&wasmvm.VMConfig{}).SetSize(64).SetMode(wasmvm.ProtectedMode).BuildVMState()
+	require.NoError(t, err)
+	_, err = vm.SpawnThread(0, 0)
+	requireThreadError(t, err, wasmvm.ThreadMemoryNotShared)
+}
+
+func TestThread_Context(t *testing.T) {
+	// spawn starts the spinning function, which comes first in the code
+	var id wasmvm.ThreadID
+	spawn := wasmvm.HostFunc0_0(func(_ context.Context, vm *wasmvm.VMState) error {
+		var err error
+		id, err = vm.SpawnThread(0, 0)
+		return err
+	})
+	l, err := wasmvm.NewLinker().DefineFunc("env", "spawn", spawn)
+	require.NoError(t, err)
+	m, err := wasmvm.ParseWAT(`(import "env" "spawn" (func $spawn)) (memory 1 1 shared)
+		(func $spin loop br 0 end) (func (export "spawn") call $spawn)`)
+	require.NoError(t, err)
+	inst, err := wasmvm.Instantiate(m, l, (&wasmvm.VMConfig{}).SetMode(wasmvm.ProtectedMode))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = inst.ExportedFunction("spawn").Call(ctx)
+	require.NoError(t, err)
+	cancel()
+	thread, err := inst.VM.JoinThread(id)
+	require.NoError(t, err)
+	assert.Equal(t, wasmvm.TrapInterrupted, thread.TrapErr.Type)
+	assert.ErrorIs(t, thread.TrapErr, context.Canceled)
+}
+
+func TestThread_Abort(t *testing.T) {
+	vm, _, sleeper := newThreadTestVM(t, (&wasmvm.VMConfig{}).SetMode(wasmvm.ProtectedMode))
+
+	id, err := vm.SpawnThread(sleeper, 0)
+	require.NoError(t, err)
+	require.NoError(t, vm.AbortThread(id))
+	thread, err := vm.JoinThread(id)
+	require.NoError(t, err)
+	assert.Equal(t, wasmvm.TrapThreadAborted, thread.TrapErr.Type)
+	assert.Equal(t, "Thread 1 aborted", thread.TrapErr.Message)
+
+	// Thread 0 is unaffected
+	assert.False(t, vm.Trap)
+}
+
+func TestThread_AbortWaiting(t *testing.T) {
+	// Waits on a value nothing changes, with no timeout
+	program := []byte{
+		wasmvm.OP_CONST_I32, 0x00, 0x10, 0x00, 0x00,
+		wasmvm.OP_CONST_I32, 0x00, 0x00, 0x00, 0x00,
+		wasmvm.OP_CONST_I64, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		wasmvm.OP_PREFIX_ATOMIC, wasmvm.OP_ATOMIC_WAIT32, 2, 0,
+		wasmvm.OP_END,
+	}
+	config := (&wasmvm.VMConfig{}).SetMode(wasmvm.ProtectedMode)
+	config.Image = (&wasmvm.ImageConfig{}).SetArray(program).SetSize(uint64(len(program)))
+	vm, err := config.
+		SetSize(wasmvm.MemoryShardSize * 2).
+		SetShared(true).
+		BuildVMState()
+	require.NoError(t, err)
+
+	id, err := vm.SpawnThread(0, 0)
+	require.NoError(t, err)
+	// Give it time to block
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, vm.AbortThread(id))
+
+	joined := make(chan *wasmvm.VMState)
+	go func() {
+		thread, _ := vm.JoinThread(id)
+		joined <- thread
+	}()
+	select {
+	case thread := <-joined:
+		assert.Equal(t, wasmvm.TrapThreadAborted, thread.TrapErr.Type)
+		assert.Equal(t, "ATOMIC_WAIT32", thread.TrapErr.Op, thread.TrapErr.Error())
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting thread was not aborted")
+	}
+}
+
+func TestThread_AbortThreadZero(t *testing.T) {
+	vm, _, sleeper := newThreadTestVM(t, (&wasmvm.VMConfig{}).SetMode(wasmvm.ProtectedMode))
+
+	first, err := vm.SpawnThread(sleeper, 0)
+	require.NoError(t, err)
+	child, err := vm.JoinThread(0)
+	requireThreadError(t, err, wasmvm.ThreadNotJoinable)
+	assert.Nil(t, child)
+	second, err := vm.SpawnThread(sleeper, 0)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, vm.AbortThread(0))
+	for _, id := range []wasmvm.ThreadID{first, second} {
+		thread, err := vm.JoinThread(id)
+		require.NoError(t, err)
+		assert.Equal(t, wasmvm.TrapThreadAborted, thread.TrapErr.Type)
+	}
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	vm.MainLoop()
+	assert.Equal(t, wasmvm.TrapThreadAborted, vm.TrapErr.Type)
+
+	_, err = vm.SpawnThread(sleeper, 0)
+	requireThreadError(t, err, wasmvm.ThreadGroupAborted)
+}
+
+func TestExecutionMode_Parse(t *testing.T) {
+	mode, err := wasmvm.ParseExecutionMode(" Protected ")
+	require.NoError(t, err)
+	assert.Equal(t, wasmvm.ProtectedMode, mode)
+	_, err = wasmvm.ParseExecutionMode("real")
+	assert.Error(t, err)
+	assert.Equal(t, "legacy", wasmvm.LegacyMode.String())
+	assert.Equal(t, "ExecutionMode(9)", wasmvm.ExecutionMode(9).String())
+
+	var cfg wasmvm.VMConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"Mode":"protected","MaxThreads":3}`), &cfg))
+	assert.Equal(t, wasmvm.ProtectedMode, cfg.Mode)
+	assert.Equal(t, uint32(3), cfg.MaxThreads)
+	require.NoError(t, json.Unmarshal([]byte(`{"Mode":0}`), &cfg))
+	assert.Equal(t, wasmvm.LegacyMode, cfg.Mode)
+	assert.Error(t, json.Unmarshal([]byte(`{"Mode":true}`), &cfg))
+}
@@ -1,6 +1,9 @@
 package wasmvm
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 type TrapType byte
 
@@ -16,20 +19,44 @@ const (
 	TrapMemoryAccess
 	TrapHostFunction
 	TrapInternalError
+	TrapMalformedImmediate
+	TrapUnalignedAtomic
+	TrapThreadAborted
+	TrapUnreachable
+	TrapCallStackExhausted
+	TrapUndefinedElement
+	TrapIndirectCallTypeMismatch
+	TrapInterrupted
+	TrapIntegerOverflow
+	TrapInvalidConversion
+	TrapExit
+	TrapOutOfFuel
 )
 
 var trapTypeNames = map[TrapType]string{
-	UndefinedTrap:              "UndefinedTrap",
-	TrapUnknownInstruction:     "TrapUnknownInstruction",
+	UndefinedTrap:                 "UndefinedTrap",
+	TrapUnknownInstruction:        "TrapUnknownInstruction",
 	TrapProgramCounterOutOfBounds: "TrapProgramCounterOutOfBounds",
-	TrapCallStackEmpty:         "TrapCallStackEmpty",
-	TrapStackUnderflow:         "TrapStackUnderflow",
-	TrapStackCleanup:           "TrapStackCleanup",
-	TrapDivideByZero:           "TrapDivideByZero",
-	TrapSignedDivisionOverflow: "TrapSignedDivisionOverflow",
-	TrapMemoryAccess:           "TrapMemoryAccess",
-	TrapHostFunction:           "TrapHostFunction",
-	TrapInternalError:          "TrapInternalError",
+	TrapCallStackEmpty:            "TrapCallStackEmpty",
+	TrapStackUnderflow:            "TrapStackUnderflow",
+	TrapStackCleanup:              "TrapStackCleanup",
+	TrapDivideByZero:              "TrapDivideByZero",
+	TrapSignedDivisionOverflow:    "TrapSignedDivisionOverflow",
+	TrapMemoryAccess:              "TrapMemoryAccess",
+	TrapHostFunction:              "TrapHostFunction",
+	TrapInternalError:             "TrapInternalError",
+	TrapMalformedImmediate:        "TrapMalformedImmediate",
+	TrapUnalignedAtomic:           "TrapUnalignedAtomic",
+	TrapThreadAborted:             "TrapThreadAborted",
+	TrapUnreachable:               "TrapUnreachable",
+	TrapCallStackExhausted:        "TrapCallStackExhausted",
+	TrapUndefinedElement:          "TrapUndefinedElement",
+	TrapIndirectCallTypeMismatch:  "TrapIndirectCallTypeMismatch",
+	TrapInterrupted:               "TrapInterrupted",
+	TrapIntegerOverflow:           "TrapIntegerOverflow",
+	TrapInvalidConversion:         "TrapInvalidConversion",
+	TrapExit:                      "TrapExit",
+	TrapOutOfFuel:                 "TrapOutOfFuel",
 }
 
 func (t TrapType) String() string {
@@ -39,6 +66,14 @@ func (t TrapType) String() string {
 	return fmt.Sprintf("TrapType(%d)", t)
 }
 
+func (t TrapType) MarshalJSON() ([]byte, error) {
+	return marshalEnumName(t)
+}
+
+func (t *TrapType) UnmarshalJSON(data []byte) error {
+	return unmarshalEnumName(data, t, "TrapType")
+}
+
 type TrapAccessType byte
 
 const (
@@ -62,6 +97,14 @@ func (t TrapAccessType) String() string {
 	return fmt.Sprintf("TrapAccessType(%d)", t)
 }
 
+func (t TrapAccessType) MarshalJSON() ([]byte, error) {
+	return marshalEnumName(t)
+}
+
+func (t *TrapAccessType) UnmarshalJSON(data []byte) error {
+	return unmarshalEnumName(data, t, "TrapAccessType")
+}
+
 type TrapError struct {
 	Type        TrapType
 	Op          string
@@ -76,17 +119,29 @@ type TrapError struct {
 }
 
 var trapDefaultMessageTemplates = map[TrapType]string{
-	UndefinedTrap:              "undefined trap",
-	TrapUnknownInstruction:     "unknown instruction trap",
+	UndefinedTrap:                 "undefined trap",
+	TrapUnknownInstruction:        "unknown instruction trap",
 	TrapProgramCounterOutOfBounds: "program counter out of bounds",
-	TrapCallStackEmpty:         "call stack empty",
-	TrapStackUnderflow:         "stack underflow",
-	TrapStackCleanup:           "stack cleanup error",
-	TrapDivideByZero:           "divide by zero",
-	TrapSignedDivisionOverflow: "signed division overflow",
-	TrapMemoryAccess:           "memory access trap",
-	TrapHostFunction:           "host function trap",
-	TrapInternalError:          "internal trap error",
+	TrapCallStackEmpty:            "call stack empty",
+	TrapStackUnderflow:            "stack underflow",
+	TrapStackCleanup:              "stack cleanup error",
+	TrapDivideByZero:              "divide by zero",
+	TrapSignedDivisionOverflow:    "signed division overflow",
+	TrapMemoryAccess:              "memory access trap",
+	TrapHostFunction:              "host function trap",
+	TrapInternalError:             "internal trap error",
+	TrapMalformedImmediate:        "malformed immediate",
+	TrapUnalignedAtomic:           "unaligned atomic",
+	TrapThreadAborted:             "thread aborted",
+	TrapUnreachable:               "unreachable",
+	TrapCallStackExhausted:        "call stack exhausted",
+	TrapUndefinedElement:          "undefined element",
+	TrapIndirectCallTypeMismatch:  "indirect call type mismatch",
+	TrapInterrupted:               "interrupted",
+	TrapIntegerOverflow:           "integer overflow",
+	TrapInvalidConversion:         "invalid conversion to integer",
+	TrapExit:                      "exit status %d",
+	TrapOutOfFuel:                 "out of fuel",
 }
 
 func TrapErrStr(t TrapType, paras ...any) string {
@@ -132,3 +187,72 @@ func (e *TrapError) Unwrap() error {
 	}
 	return e.Cause
 }
+
+// The JSON form of a TrapError, for logging and replaying failures
+type trapErrorJSON struct {
+	Type        TrapType        `json:"type"`
+	Op          string          `json:"op,omitempty"`
+	PC          uint64          `json:"pc"`
+	Message     string          `json:"message"`
+	Cause       json.RawMessage `json:"cause,omitempty"`
+	AccessType  TrapAccessType  `json:"accessType"`
+	Address     *uint64         `json:"address,omitempty"`
+	Ring        *uint8          `json:"ring,omitempty"`
+	Instruction *uint8          `json:"instruction,omitempty"`
+	Meta        json.RawMessage `json:"metadata,omitempty"`
+}
+
+func (e *TrapError) MarshalJSON() ([]byte, error) {
+	cause, err := marshalCause(e.Cause)
+	if err != nil {
+		return nil, err
+	}
+	var meta json.RawMessage
+	if e.Meta != nil {
+		if meta, err = json.Marshal(e.Meta); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(trapErrorJSON{
+		Type:        e.Type,
+		Op:          e.Op,
+		PC:          e.PC,
+		Message:     e.Message,
+		Cause:       cause,
+		AccessType:  e.AccessType,
+		Address:     e.Address,
+		Ring:        e.Ring,
+		Instruction: e.Instruction,
+		Meta:        meta,
+	})
+}
+
+// Metadata comes back as maps and json.Numbers rather than the types
+// it was written from
+func (e *TrapError) UnmarshalJSON(data []byte) error {
+	var v trapErrorJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	cause, err := unmarshalCause(v.Cause)
+	if err != nil {
+		return err
+	}
+	meta, err := unmarshalMeta(v.Meta)
+	if err != nil {
+		return err
+	}
+	*e = TrapError{
+		Type:        v.Type,
+		Op:          v.Op,
+		PC:          v.PC,
+		Message:     v.Message,
+		Cause:       cause,
+		AccessType:  v.AccessType,
+		Address:     v.Address,
+		Ring:        v.Ring,
+		Instruction: v.Instruction,
+		Meta:        meta,
+	}
+	return nil
+}
@@ -1,11 +1,13 @@
 package wasmvm_test
 
 import (
+	"encoding/json"
 	"errors"
 	"testing"
 
 	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTrapTypeString(t *testing.T) {
@@ -68,3 +70,58 @@ func TestTrapError_Unwrap(t *testing.T) {
 
 	assert.Equal(t, cause, err.Unwrap())
 }
+
+func TestTrapError_JSON(t *testing.T) {
+	addr, ring, instr := uint64(0x10), uint8(3), uint8(wasmvm.OP_LOAD_I32)
+	trap := &wasmvm.TrapError{
+		Type:        wasmvm.TrapMemoryAccess,
+		Op:          "LOAD_I32",
+		PC:          42,
+		Message:     "out of bounds",
+		AccessType:  wasmvm.TrapAccessRead,
+		Address:     &addr,
+		Ring:        &ring,
+		Instruction: &instr,
+		Cause: &wasmvm.TrapError{
+			Type:    wasmvm.TrapHostFunction,
+			Message: "host",
+			Cause:   errors.New("root cause"),
+		},
+		Meta: map[string]uint64{"size": 1 << 63},
+	}
+	data, err := json.Marshal(trap)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "TrapMemoryAccess", "op": "LOAD_I32", "pc": 42, "message": "out of bounds",
+		"accessType": "TrapAccessRead", "address": 16, "ring": 3, "instruction": 40,
+		"cause": {"kind": "TrapError", "error": {
+			"type": "TrapHostFunction", "pc": 0, "message": "host", "accessType": "TrapAccessUnknown",
+			"cause": {"kind": "error", "error": "root cause"}}},
+		"metadata": {"size": 9223372036854775808}}`, string(data))
+
+	var back wasmvm.TrapError
+	require.NoError(t, json.Unmarshal(data, &back))
+	assert.Equal(t, trap.Error(), back.Error())
+	assert.Equal(t, trap.Address, back.Address)
+	assert.Equal(t, "root cause", errors.Unwrap(back.Cause).Error())
+	again, err := json.Marshal(&back)
+	require.NoError(t, err)
+	assert.Equal(t, string(data), string(again))
+
+	// Unnamed values and exits come back as themselves
+	exit := &wasmvm.TrapError{Type: wasmvm.TrapType(99), Cause: &wasmvm.ExitError{Code: 3}}
+	data, err = json.Marshal(exit)
+	require.NoError(t, err)
+	back = wasmvm.TrapError{}
+	require.NoError(t, json.Unmarshal(data, &back))
+	assert.Equal(t, exit, &back)
+	code, ok := wasmvm.ExitCode(&back)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(3), code)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"type": "TrapNope"}`), &back))
+	assert.Error(t, json.Unmarshal([]byte(`{"accessType": true}`), &back))
+	assert.Error(t, json.Unmarshal([]byte(`{"cause": {"kind": "nope"}}`), &back))
+	require.NoError(t, json.Unmarshal([]byte(`{"type": 6}`), &back))
+	assert.Equal(t, wasmvm.TrapDivideByZero, back.Type)
+}
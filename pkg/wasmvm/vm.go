@@ -1,25 +1,45 @@
 package wasmvm
 
-import "fmt"
-
-// The actual VM state itself. Right now, we are only assuming a
-// single execution context. I'll need to refactor this when
-// rings get added, which is the prereq to my threading model
-// since I'm ignoring the "mark memory as shared" proposed
-// standard for which I stumbled upon for something I think
-// will allow for easier porting
+import (
+	"context"
+	"fmt"
+)
+
+// The actual VM state itself. Each thread gets its own VMState,
+// with the execution context in the embedded Thread and everything
+// else shared with thread 0, the one returned by NewVM.
 type VMState struct {
-	Memory         []byte
-	PC             uint64 // Program Counter
-	Trap           bool
-	TrapErr        *TrapError
-	ImageInitWarn  []string
+	Thread
+	Memory         Memory
+	ImageInitWarn  []ImageWarning
 	Config         *VMConfig
 	InstructionMap map[uint8]Instruction
 	StateStack     []VMState
-	ValueStack     ValueStack
 
 	// Add more state as needed
+
+	// Only set in protected mode
+	threads *threadGroup
+	// What Reset returns the memory to
+	snapshot *MemorySnapshot
+
+	// Only set for the VM of an Instance, which fetches instructions
+	// from code instead of Memory
+	instance *Instance
+	code     Memory
+	// Passed on to host functions called by the running code
+	ctx context.Context
+
+	// Scratch space for instruction fetches so that reading
+	// immediates through the Memory interface doesn't allocate
+	fetchBuf [16]byte
+	// Same for loads and stores
+	dataBuf [8]byte
+
+	// From VMConfig.Deterministic, along with the sources that replace
+	// the real clock and randomness
+	deterministic bool
+	virtual       *virtualSources
 }
 
 func NewVMInitializationError(eType VMInitializationErrorType, msg string) error {
@@ -65,7 +85,7 @@ func NewVM(config *VMConfig) (*VMState, error) {
 		return nil, NewVMInitializationErrorWithCauseOrMeta(VMConfigInternalError, VmInitErrStr(VMConfigInternalError, err.Error()), err, nil)
 	}
 
-	if vc.Size == 0 && vc.FlatMemory == nil {
+	if vc.Size == 0 && vc.FlatMemory == nil && config.Memory == nil && config.Snapshot == nil {
 		return nil, NewVMInitializationError(MissingSizeOrFlatMemory, VmInitErrStr(MissingSizeOrFlatMemory))
 	}
 
@@ -73,21 +93,31 @@ func NewVM(config *VMConfig) (*VMState, error) {
 	vc.Stdout = config.Stdout
 	vc.Stderr = config.Stderr
 	vc.ExposedFuncs = config.ExposedFuncs
+	vc.SnapshotHooks = config.SnapshotHooks
+	vc.Snapshot = config.Snapshot
+	if vc.Image != nil {
+		vc.Image.Reader = config.Image.Reader
+		vc.Image.FS = config.Image.FS
+	}
 
-	mem := vc.FlatMemory
-	if mem == nil {
-		mem = make([]byte, config.Size)
+	if vc.Snapshot != nil && config.Memory == nil {
+		return newVMFromSnapshot(vc)
+	}
+
+	mem := newConfiguredMemory(vc, config)
+	tracker := newShardTracker(mem)
+	if config.Memory == nil && len(vc.FlatMemory) > 0 {
+		// Existing memory is treated the same as an image
+		tracker.mark(0, uint64(len(vc.FlatMemory)))
 	}
 	state := &VMState{
 		Memory:         mem,
-		PC:             0,
-		Trap:           false,
 		Config:         vc,
 		InstructionMap: defaultInstructionMap(),
 	}
 	// Populate memory/image via config.Image (see image.go)
 	if vc.Image != nil {
-		warns, err := PopulateImage(mem, vc.Image, vc.Strict)
+		warns, err := PopulateImage(tracker, vc.Image, vc.Strict)
 		state.ImageInitWarn = warns
 		if err != nil {
 			if vc.Strict {
@@ -97,9 +127,45 @@ func NewVM(config *VMConfig) (*VMState, error) {
 			// but it doesn't show under coverage in VS Code
 			// And stranger yet, warn - NewVM Type SparseArray Lenient
 			// tests for the result
-			state.ImageInitWarn = append(state.ImageInitWarn, err.Error())
+			state.ImageInitWarn = append(state.ImageInitWarn, imageWarningFromError(err))
 		}
 	}
+	// Host supplied memory keeps whatever permissions the host gave it
+	if pm, ok := mem.(PermissionedMemory); ok && config.Memory == nil {
+		applyDefaultMemoryPolicy(pm, tracker, vc.AllowWriteExecute)
+	}
+	if err := initVMState(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// The memory of a snapshot already has its image and permissions, so
+// only the rest of the state needs setting up
+func newVMFromSnapshot(vc *VMConfig) (*VMState, error) {
+	var mem Memory
+	if vc.Shared {
+		shared := NewFlatSharedMemory(vc.Snapshot.Size())
+		shared.restoreSnapshot(vc.Snapshot)
+		mem = shared
+	} else {
+		mem = vc.Snapshot.NewMemory()
+	}
+	state := &VMState{
+		Memory:         mem,
+		Config:         vc,
+		InstructionMap: defaultInstructionMap(),
+		snapshot:       vc.Snapshot,
+	}
+	if err := initVMState(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Everything in NewVM that comes after setting up the memory
+func initVMState(state *VMState) error {
+	vc := state.Config
 	// Initialize rings
 	if vc.Rings == nil {
 		vc.Rings = make(map[uint8]RingConfig)
@@ -109,18 +175,121 @@ func NewVM(config *VMConfig) (*VMState, error) {
 	// Ring 0 is always full access; ignore/override if defined
 	if ok && (rc.Enabled || vc.Strict) {
 		if vc.Strict {
-			return nil, NewVMInitializationError(StrictModeAttemptRing0Reconfigure, VmInitErrStr(StrictModeAttemptRing0Reconfigure))
+			return NewVMInitializationError(StrictModeAttemptRing0Reconfigure, VmInitErrStr(StrictModeAttemptRing0Reconfigure))
 		}
-		state.ImageInitWarn = append(state.ImageInitWarn, "Ring 0 redefinition ignored")
+		state.ImageInitWarn = append(state.ImageInitWarn, ImageWarning{Msg: "Ring 0 redefinition ignored", Entry: -1})
 	}
 	vc.Rings[0] = RingConfig{Enabled: true}
 
+	if vc.Mode == ProtectedMode {
+		state.threads = newThreadGroup(state, vc.MaxThreads)
+	}
+	if vc.Deterministic {
+		state.deterministic = true
+		state.virtual = newVirtualSources(vc.Seed)
+	}
+
 	// Set start point
 	if vc.StartOverride != 0 {
 		state.PC = vc.StartOverride
 	}
 
-	return state, nil
+	return nil
+}
+
+// Picks the Memory for a new VM. A host supplied Memory wins,
+// otherwise the configured model is constructed and seeded from
+// FlatMemory if present.
+func newConfiguredMemory(vc *VMConfig, config *VMConfig) Memory {
+	if config.Memory != nil {
+		vc.Memory = config.Memory
+		return config.Memory
+	}
+	if vc.Shared {
+		size := vc.Size
+		if vc.FlatMemory != nil {
+			size = uint64(len(vc.FlatMemory))
+		}
+		mem := NewFlatSharedMemory(size)
+		copy(mem.data, vc.FlatMemory)
+		return mem
+	}
+	switch vc.MemoryModel {
+	case ShardedMemoryModel:
+		size := vc.Size
+		if vc.FlatMemory != nil {
+			size = uint64(len(vc.FlatMemory))
+		}
+		mem := NewShardedMemory(size)
+		if len(vc.FlatMemory) > 0 {
+			mem.Write(MemoryContext{}, 0, vc.FlatMemory)
+		}
+		return mem
+	default:
+		if vc.FlatMemory != nil {
+			return NewFlatMemory(vc.FlatMemory)
+		}
+		return NewFlatMemory(make([]byte, vc.Size))
+	}
+}
+
+// The context used for accesses made on behalf of the running code.
+// Legacy mode threads are always in ring 0.
+func (vm *VMState) MemoryContext() MemoryContext {
+	return MemoryContext{Ring: vm.Ring}
+}
+
+// Fetches width octets of the instruction stream at addr. The returned
+// slice is only valid until the next fetch.
+func (vm *VMState) fetch(addr uint64, width int) ([]byte, MemoryAccessResult) {
+	mem := vm.Memory
+	if vm.code != nil {
+		mem = vm.code
+	}
+	// Flat memory is the common case, so skip the interface dispatch
+	if fm, ok := mem.(*FlatMemory); ok {
+		if !inBounds(uint64(len(fm.data)), addr, width) {
+			return nil, MemoryAccessOutOfBounds
+		}
+		if !fm.perms.check(addr, width, MemoryPermExecute) {
+			return nil, MemoryAccessDenied
+		}
+		return fm.data[addr : addr+uint64(width)], MemoryAccessOK
+	}
+	buf := vm.fetchBuf[:width]
+	res := mem.Execute(vm.MemoryContext(), addr, buf)
+	return buf, res
+}
+
+// Converts a non-OK memory access result into a trap. Out of bounds
+// fetches keep reporting as program counter traps.
+func (vm *VMState) memoryAccessTrap(op string, access TrapAccessType, addr uint64, width int, res MemoryAccessResult) error {
+	trapType := TrapMemoryAccess
+	if res == MemoryAccessOutOfBounds && access == TrapAccessExecute {
+		trapType = TrapProgramCounterOutOfBounds
+	}
+	message := fmt.Sprintf("%s: Out of bounds", op)
+	if res == MemoryAccessDenied {
+		message = fmt.Sprintf("%s: Access denied", op)
+	}
+	ring := vm.MemoryContext().Ring
+	size := vm.Memory.Size()
+	if access == TrapAccessExecute && vm.code != nil {
+		size = vm.code.Size()
+	}
+	return vm.SetTrapError(&TrapError{
+		Type:       trapType,
+		Op:         op,
+		PC:         vm.PC,
+		Message:    message,
+		AccessType: access,
+		Address:    &addr,
+		Ring:       &ring,
+		Meta: map[string]uint64{
+			"width":      uint64(width),
+			"memory_len": size,
+		},
+	})
 }
 
 // Operates on a VMState - This fetches the next instruction and acts upon
@@ -137,15 +306,26 @@ func (vm *VMState) Step() error {
 			Message: "execution trapped with no TrapErr",
 		}
 	}
-	if vm.PC >= uint64(len(vm.Memory)) {
+	if vm.aborted.Load() {
+		return vm.SetTrapError(&TrapError{
+			Type:    TrapThreadAborted,
+			Op:      "STEP",
+			PC:      vm.PC,
+			Message: fmt.Sprintf("Thread %d aborted", vm.ID),
+		})
+	}
+	op, res := vm.fetch(vm.PC, 1)
+	if res == MemoryAccessOutOfBounds {
 		return vm.SetTrapError(&TrapError{
 			Type:    TrapProgramCounterOutOfBounds,
 			Op:      "STEP",
 			PC:      vm.PC,
 			Message: "Program counter out of bounds",
 		})
+	} else if res != MemoryAccessOK {
+		return vm.memoryAccessTrap("STEP", TrapAccessExecute, vm.PC, 1, res)
 	}
-	opcode := vm.Memory[vm.PC]
+	opcode := op[0]
 	handler, ok := vm.InstructionMap[opcode]
 	if !ok {
 		return vm.SetTrapError(&TrapError{
@@ -162,11 +342,15 @@ func (vm *VMState) Step() error {
 // Operates on VMState - Calls vm.Step() until trap is reached
 func (vm *VMState) MainLoop() {
 	for !vm.Trap {
-		err := vm.Step()
-		if err != nil && vm.Config != nil && vm.Config.Stderr != nil {
-			if vm.TrapErr == nil || vm.TrapErr.Type != TrapCallStackEmpty {
-				fmt.Fprintf(vm.Config.Stderr, "Execution error: %v\n", err)
-			}
+		vm.stepAndReport()
+	}
+}
+
+func (vm *VMState) stepAndReport() {
+	err := vm.Step()
+	if err != nil && vm.Config != nil && vm.Config.Stderr != nil {
+		if vm.TrapErr == nil || vm.TrapErr.Type != TrapCallStackEmpty {
+			fmt.Fprintf(vm.Config.Stderr, "Execution error: %v\n", err)
 		}
 	}
 }
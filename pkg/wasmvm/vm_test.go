@@ -25,6 +25,14 @@ type vmTestCase struct {
 	clearInstructionMapOnActual bool
 }
 
+// The memory NewVM produces once the default W^X policy has been applied
+// to a memory that fits in a single shard
+func newPolicyFlatMemory(data []byte, perm wasmvm.MemoryPermission) *wasmvm.FlatMemory {
+	mem := wasmvm.NewFlatMemory(data)
+	mem.SetPermissions(0, mem.Size(), perm)
+	return mem
+}
+
 func executeVMTests(t *testing.T, tests []vmTestCase) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -49,7 +57,7 @@ func executeVMTests(t *testing.T, tests []vmTestCase) {
 					vm.InstructionMap = nil
 				}
 				if test.checkMemorySize {
-					assert.Equal(t, test.expectSize, uint64(len(vm.Memory)))
+					assert.Equal(t, test.expectSize, vm.Memory.Size())
 				}
 				if test.checkExpect {
 					assert.Equal(t, test.expect, vm)
@@ -122,7 +130,7 @@ func TestNewVM(t *testing.T) {
 				},
 			},
 			expect: &wasmvm.VMState{
-				Memory: []byte{0x00},
+				Memory: newPolicyFlatMemory([]byte{0x00}, wasmvm.MemoryPermRW),
 				Config: &wasmvm.VMConfig{
 					Size:   1,
 					Strict: true,
@@ -145,7 +153,7 @@ func TestNewVM(t *testing.T) {
 			checkExpect:                 true,
 			clearInstructionMapOnActual: true,
 			expect: &wasmvm.VMState{
-				Memory: make([]byte, 42),
+				Memory: newPolicyFlatMemory(make([]byte, 42), wasmvm.MemoryPermRW),
 				Config: &wasmvm.VMConfig{
 					Size:   42,
 					Strict: false,
@@ -153,8 +161,8 @@ func TestNewVM(t *testing.T) {
 						0: {Enabled: true},
 					},
 				},
-				ImageInitWarn: []string{
-					"Ring 0 redefinition ignored",
+				ImageInitWarn: []wasmvm.ImageWarning{
+					{Msg: "Ring 0 redefinition ignored", Entry: -1},
 				},
 			},
 		},
@@ -182,7 +190,7 @@ func TestNewVM(t *testing.T) {
 			checkExpect:                 true,
 			clearInstructionMapOnActual: true,
 			expect: &wasmvm.VMState{
-				Memory: make([]byte, 10),
+				Memory: newPolicyFlatMemory(make([]byte, 10), wasmvm.MemoryPermRX),
 				Config: &wasmvm.VMConfig{
 					FlatMemory: make([]byte, 10),
 					Rings: map[uint8]wasmvm.RingConfig{
@@ -190,7 +198,7 @@ func TestNewVM(t *testing.T) {
 					},
 					StartOverride: uint64(5),
 				},
-				PC: uint64(5),
+				Thread: wasmvm.Thread{PC: uint64(5)},
 			},
 		},
 		{
@@ -254,7 +262,7 @@ func TestNewVM(t *testing.T) {
 			checkExpect:                 true,
 			clearInstructionMapOnActual: true,
 			expect: &wasmvm.VMState{
-				Memory: []byte{0x01, 0x02, 0x00},
+				Memory: newPolicyFlatMemory([]byte{0x01, 0x02, 0x00}, wasmvm.MemoryPermRX),
 				Config: &wasmvm.VMConfig{
 					Size:   3,
 					Strict: false,
@@ -268,9 +276,16 @@ func TestNewVM(t *testing.T) {
 						0: {Enabled: true},
 					},
 				},
-				ImageInitWarn: []string{
-					"sparsearray entry out of bounds at offset 3",
-					"sparsearray entry out of bounds at offset 4",
+				ImageInitWarn: []wasmvm.ImageWarning{
+					{
+						Type:     wasmvm.SparseEntryOutOfBounds,
+						Msg:      "sparsearray entry out of bounds at offset 3 (entry 1, 2 bytes)",
+						Entry:    1,
+						Offset:   3,
+						Count:    2,
+						DataSize: 2,
+						MemSize:  3,
+					},
 				},
 			},
 		},
@@ -319,11 +334,11 @@ func TestVMState_ExecuteNext_Trap(t *testing.T) {
 
 func TestVMState_ExecuteNext_UnknownOpcode(t *testing.T) {
 	cfg := &wasmvm.VMConfig{
-		Size: 2,
+		Size:  2,
+		Image: (&wasmvm.ImageConfig{}).SetArray([]byte{0xFF}).SetSize(1), // No handler for 0xFF in default map
 	}
 	vm, err := wasmvm.NewVM(cfg)
 	require.NoError(t, err)
-	vm.Memory[0] = 0xFF // No handler for 0xFF in default map
 	vm.PC = 0
 	err = vm.Step()
 	assert.Error(t, err)
@@ -356,12 +371,12 @@ func TestVMState_MainLoop_ErrorOutput(t *testing.T) {
 	var buf bytes.Buffer
 	cfg := &wasmvm.VMConfig{
 		Size:   2,
+		Image:  (&wasmvm.ImageConfig{}).SetArray([]byte{0xFF}).SetSize(1), // Will cause unknown instruction
 		Stdout: &buf,
 		Stderr: &buf,
 	}
 	vm, err := cfg.BuildVMState()
 	require.NoError(t, err)
-	vm.Memory[0] = 0xFF // Will cause unknown instruction
 	vm.MainLoop()
 	assert.Contains(t, buf.String(), "Execution error:")
 }
@@ -44,10 +44,29 @@ func NewValueStackEntryI64(value uint64) *ValueStackEntry {
 	}
 }
 
+func NewValueStackEntryF32(value float32) *ValueStackEntry {
+	return &ValueStackEntry{
+		EntryType: TYPE_F32,
+		Value_F32: value,
+	}
+}
+
+func NewValueStackEntryF64(value float64) *ValueStackEntry {
+	return &ValueStackEntry{
+		EntryType: TYPE_F64,
+		Value_F64: value,
+	}
+}
+
 func (vs *ValueStack) Push(item *ValueStackEntry) {
 	vs.elements = append(vs.elements, *item)
 }
 
+// Push without going through a pointer
+func (vs *ValueStack) pushEntry(item ValueStackEntry) {
+	vs.elements = append(vs.elements, item)
+}
+
 func (vs *ValueStack) PushInt32(item uint32) {
 	stackEntry := NewValueStackEntryI32(item)
 	vs.Push(stackEntry)
@@ -88,6 +107,21 @@ func (vs *ValueStack) HasAtLeastOfType(cnt int, entryType ValueStackEntryType) (
 	return true, items
 }
 
+// Same as HasAtLeastOfType, but each entry may have its own type. The
+// types are given bottom to top, the same order as the returned slice
+func (vs *ValueStack) HasTypes(entryTypes ...ValueStackEntryType) (bool, []ValueStackEntry) {
+	if !vs.HasAtLeast(len(entryTypes)) {
+		return false, nil
+	}
+	items := vs.elements[len(vs.elements)-len(entryTypes):]
+	for i, val := range items {
+		if val.EntryType != entryTypes[i] {
+			return false, nil
+		}
+	}
+	return true, items
+}
+
 func (vs *ValueStack) Drop(cnt int, allOrNothing bool) bool {
 	if (allOrNothing && !vs.HasAtLeast(cnt)) || vs.IsEmpty() {
 		return false
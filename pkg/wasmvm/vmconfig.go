@@ -64,6 +64,54 @@ func (e *VMInitializationError) Unwrap() error {
 	return e.Cause
 }
 
+func (t VMInitializationErrorType) MarshalJSON() ([]byte, error) {
+	return marshalEnumName(t)
+}
+
+func (t *VMInitializationErrorType) UnmarshalJSON(data []byte) error {
+	return unmarshalEnumName(data, t, "VMInitializationErrorType")
+}
+
+type vmInitializationErrorJSON struct {
+	Type  VMInitializationErrorType `json:"type"`
+	Msg   string                    `json:"message"`
+	Cause json.RawMessage           `json:"cause,omitempty"`
+	Meta  json.RawMessage           `json:"metadata,omitempty"`
+}
+
+func (e *VMInitializationError) MarshalJSON() ([]byte, error) {
+	cause, err := marshalCause(e.Cause)
+	if err != nil {
+		return nil, err
+	}
+	var meta json.RawMessage
+	if e.Meta != nil {
+		if meta, err = json.Marshal(e.Meta); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(vmInitializationErrorJSON{Type: e.Type, Msg: e.Msg, Cause: cause, Meta: meta})
+}
+
+// Metadata, such as the VMErrorMeta of a ring clash, comes back as maps
+// and json.Numbers
+func (e *VMInitializationError) UnmarshalJSON(data []byte) error {
+	var v vmInitializationErrorJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	cause, err := unmarshalCause(v.Cause)
+	if err != nil {
+		return err
+	}
+	meta, err := unmarshalMeta(v.Meta)
+	if err != nil {
+		return err
+	}
+	*e = VMInitializationError{Type: v.Type, Msg: v.Msg, Cause: cause, Meta: meta}
+	return nil
+}
+
 // This won't include the stdin, etc or the exposed functions
 func (vmc *VMConfig) QuickClone() (*VMConfig, error) {
 	if vmc == nil {
@@ -100,21 +148,50 @@ type RingConfig struct {
 // thus we have a different struct
 type VMConfig struct {
 	Size uint64 // Memory size in bytes
-	// TODO [RWV-18]: Replace this with a FlatMemory compositor that accepts
-	// logical address, access purpose, and ring execution context, while
-	// preserving the current direct flat-memory behavior for now. The first
-	// implementation should operate on 4 KiB shards and only use the logical
-	// address; ring-aware mapping, shared-memory semantics, and RWX policy
-	// enforcement are deferred to later backlog items.
-	FlatMemory    []byte // Optional: existing memory
-	Strict        bool
-	Image         *ImageConfig
-	Rings         map[uint8]RingConfig    // 0-255
-	Stdin         io.Reader               `json:"-"`
-	Stdout        io.Writer               `json:"-"`
-	Stderr        io.Writer               `json:"-"`
-	ExposedFuncs  map[string]*ExposedFunc `json:"-"`
-	StartOverride uint64                  // Optional entry point override
+	// Initial contents for the memory; also sets the size. The VM works
+	// on a copy, so set Memory to share the contents with the host
+	FlatMemory  []byte // Optional: existing memory
+	MemoryModel MemoryModel
+	// Optional: host supplied compositor, takes precedence over the
+	// fields above and is shared rather than cloned
+	Memory Memory `json:"-"`
+	// Optional: initialized memory to start from instead of FlatMemory
+	// and Image, which are then ignored. Unless Shared is set, the
+	// memory shares the snapshot copy-on-write. Memory still wins
+	Snapshot *MemorySnapshot `json:"-"`
+	// Equivalent of the shared limits flag. The memory is constructed
+	// as a FlatSharedMemory regardless of MemoryModel so that it can be
+	// handed to other VMs through SetMemory
+	Shared bool
+	// Protected mode enables rings and additional threads
+	Mode ExecutionMode
+	// Protected mode only, includes thread 0. Zero means no limit
+	MaxThreads uint32
+	// Host override of the default W^X policy, allowing shards to be
+	// writable and executable at the same time
+	AllowWriteExecute bool
+	Strict            bool
+	Image             *ImageConfig
+	Rings             map[uint8]RingConfig    // 0-255
+	Stdin             io.Reader               `json:"-"`
+	Stdout            io.Writer               `json:"-"`
+	Stderr            io.Writer               `json:"-"`
+	ExposedFuncs      map[string]*ExposedFunc `json:"-"`
+	SnapshotHooks     map[string]SnapshotHook `json:"-"`
+	StartOverride     uint64                  // Optional entry point override, a raw offset for byte images
+	// Export that Instance.Run calls. Empty picks _start for commands
+	// and _initialize for reactors
+	EntryPoint string
+	// Bit-identical results across runs and machines, see determinism.go
+	Deterministic bool
+	// Seeds the virtual randomness of deterministic mode
+	Seed uint64
+	// Bytes the memory of an instance may grow to, below the maximum of
+	// the module itself. Zero means no limit
+	MaxMemory uint64
+	// Instructions an instance may execute over all of its calls before
+	// trapping with TrapOutOfFuel. Zero means no limit
+	Fuel uint64
 }
 
 // Helper function since AppendRings and AppendExposedFuncs do almost the same thing
@@ -158,6 +235,41 @@ func (vmc *VMConfig) AppendFlatMemory(fm []byte) *VMConfig {
 	return vmc
 }
 
+func (vmc *VMConfig) SetMemoryModel(mm MemoryModel) *VMConfig {
+	vmc.MemoryModel = mm
+	return vmc
+}
+
+func (vmc *VMConfig) SetMemory(mem Memory) *VMConfig {
+	vmc.Memory = mem
+	return vmc
+}
+
+func (vmc *VMConfig) SetSnapshot(s *MemorySnapshot) *VMConfig {
+	vmc.Snapshot = s
+	return vmc
+}
+
+func (vmc *VMConfig) SetShared(shared bool) *VMConfig {
+	vmc.Shared = shared
+	return vmc
+}
+
+func (vmc *VMConfig) SetAllowWriteExecute(allow bool) *VMConfig {
+	vmc.AllowWriteExecute = allow
+	return vmc
+}
+
+func (vmc *VMConfig) SetMode(mode ExecutionMode) *VMConfig {
+	vmc.Mode = mode
+	return vmc
+}
+
+func (vmc *VMConfig) SetMaxThreads(max uint32) *VMConfig {
+	vmc.MaxThreads = max
+	return vmc
+}
+
 func (vmc *VMConfig) SetRingConfig(rc map[uint8]RingConfig) *VMConfig {
 	vmc.Rings = rc
 	return vmc
@@ -216,33 +328,69 @@ func (vmc *VMConfig) AppendExposedFunc(ef map[string]*ExposedFunc) (*VMConfig, e
 	return vmc, nil
 }
 
+// Binds fn through NewHostFunc and adds it under name
+func (vmc *VMConfig) AppendHostFunc(name string, fn any) (*VMConfig, error) {
+	ef, err := NewHostFunc(fn)
+	if err != nil {
+		return vmc, err
+	}
+	return vmc.AppendExposedFunc(map[string]*ExposedFunc{name: ef})
+}
+
+func (vmc *VMConfig) SetSnapshotHooks(hooks map[string]SnapshotHook) *VMConfig {
+	vmc.SnapshotHooks = hooks
+	return vmc
+}
+
+func (vmc *VMConfig) AppendSnapshotHooks(hooks map[string]SnapshotHook) (*VMConfig, error) {
+	if vmc.SnapshotHooks == nil {
+		vmc.SnapshotHooks = hooks
+		return vmc, nil
+	}
+	merged, mergeErr := mergeMaps(vmc.SnapshotHooks, hooks, vmc)
+	if mergeErr != nil {
+		return vmc, mergeErr
+	}
+	vmc.SnapshotHooks = merged
+	return vmc, nil
+}
+
 func (vmc *VMConfig) SetStartOverride(start uint64) *VMConfig {
 	vmc.StartOverride = start
 	return vmc
 }
 
+func (vmc *VMConfig) SetEntryPoint(name string) *VMConfig {
+	vmc.EntryPoint = name
+	return vmc
+}
+
+func (vmc *VMConfig) SetMaxMemory(max uint64) *VMConfig {
+	vmc.MaxMemory = max
+	return vmc
+}
+
+func (vmc *VMConfig) SetFuel(fuel uint64) *VMConfig {
+	vmc.Fuel = fuel
+	return vmc
+}
+
+func (vmc *VMConfig) SetDeterministic(deterministic bool) *VMConfig {
+	vmc.Deterministic = deterministic
+	return vmc
+}
+
+func (vmc *VMConfig) SetSeed(seed uint64) *VMConfig {
+	vmc.Seed = seed
+	return vmc
+}
+
 // BuildVMState constructs a new VMState from this config.
 // Returns (*VMState, error). The config is cloned during build.
 func (vmc *VMConfig) BuildVMState() (*VMState, error) {
 	return NewVM(vmc)
 }
 
-// This will eventually provide a function pointer for
-// functions exposed to anything running in the VM
-type ExposedFunc struct {
-
-	// TODO: Consider making this something like map[string]reflect.Type
-	// Or some []struct{} that contains the name and exposed arguments
-	// Also, as far as I know, wasm doesn't support generic or variadic
-	// functions. I suspect the latter can be handled via an array; however,
-	// I might try to look into "supporting" it via type erasure or something.
-	// For this, I might just forbid generics as part of signatures, and require
-	// that they be "wrapped" for this
-	// I'll cross that bridge when I get to it.
-	Parameters map[string]interface{} // Metadata for the function
-	Function   *func(*VMState, ...interface{}) error
-}
-
 func NewVMFluentError[K comparable, O any](meta VMErrorMeta[K, O]) error {
 	return &VMInitializationError{
 		Type:  VMRingAlreadyExists,
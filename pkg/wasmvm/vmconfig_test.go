@@ -1,12 +1,15 @@
 package wasmvm_test
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"testing"
 
 	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type fluentTestCase struct {
@@ -21,12 +24,13 @@ type fluentTestCase struct {
 	expectStdout          io.Writer
 	expectStderr          io.Writer
 	expectStartupOverride uint64
+	expectEntryPoint      string
 }
 
 func TestVMConfig_FluentAPI(t *testing.T) {
-	dummyExposedFunc := func(*wasmvm.VMState, ...interface{}) error {
-		return nil
-	}
+	dummyExposedFunc := wasmvm.HostFunction(func(context.Context, *wasmvm.VMState, []wasmvm.ValueStackEntry) ([]wasmvm.ValueStackEntry, error) {
+		return nil, nil
+	})
 	in := new(io.Reader)
 	out := new(io.Writer)
 
@@ -93,14 +97,14 @@ func TestVMConfig_FluentAPI(t *testing.T) {
 			testCase: func() (*wasmvm.VMConfig, error) {
 				conf := new(wasmvm.VMConfig).SetExposedFunc(map[string]*wasmvm.ExposedFunc{
 					"temp": {
-						Parameters: nil,
-						Function:   &dummyExposedFunc,
+						Type:     wasmvm.FuncType{},
+						Function: &dummyExposedFunc,
 					},
 				})
 				conf, err := conf.AppendExposedFunc(map[string]*wasmvm.ExposedFunc{
 					"temp2": {
-						Parameters: nil,
-						Function:   &dummyExposedFunc,
+						Type:     wasmvm.FuncType{},
+						Function: &dummyExposedFunc,
 					},
 				})
 
@@ -108,12 +112,12 @@ func TestVMConfig_FluentAPI(t *testing.T) {
 			},
 			expectEFunc: map[string]*wasmvm.ExposedFunc{
 				"temp": {
-					Parameters: nil,
-					Function:   &dummyExposedFunc,
+					Type:     wasmvm.FuncType{},
+					Function: &dummyExposedFunc,
 				},
 				"temp2": {
-					Parameters: nil,
-					Function:   &dummyExposedFunc,
+					Type:     wasmvm.FuncType{},
+					Function: &dummyExposedFunc,
 				},
 			},
 		},
@@ -123,8 +127,8 @@ func TestVMConfig_FluentAPI(t *testing.T) {
 				conf := new(wasmvm.VMConfig)
 				conf, err := conf.AppendExposedFunc(map[string]*wasmvm.ExposedFunc{
 					"temp2": {
-						Parameters: nil,
-						Function:   &dummyExposedFunc,
+						Type:     wasmvm.FuncType{},
+						Function: &dummyExposedFunc,
 					},
 				})
 
@@ -132,8 +136,8 @@ func TestVMConfig_FluentAPI(t *testing.T) {
 			},
 			expectEFunc: map[string]*wasmvm.ExposedFunc{
 				"temp2": {
-					Parameters: nil,
-					Function:   &dummyExposedFunc,
+					Type:     wasmvm.FuncType{},
+					Function: &dummyExposedFunc,
 				},
 			},
 		},
@@ -142,14 +146,14 @@ func TestVMConfig_FluentAPI(t *testing.T) {
 			testCase: func() (*wasmvm.VMConfig, error) {
 				conf := new(wasmvm.VMConfig).SetExposedFunc(map[string]*wasmvm.ExposedFunc{
 					"temp": {
-						Parameters: nil,
-						Function:   &dummyExposedFunc,
+						Type:     wasmvm.FuncType{},
+						Function: &dummyExposedFunc,
 					},
 				})
 				conf, err := conf.AppendExposedFunc(map[string]*wasmvm.ExposedFunc{
 					"temp": {
-						Parameters: nil,
-						Function:   &dummyExposedFunc,
+						Type:     wasmvm.FuncType{},
+						Function: &dummyExposedFunc,
 					},
 				})
 
@@ -157,8 +161,8 @@ func TestVMConfig_FluentAPI(t *testing.T) {
 			},
 			expectEFunc: map[string]*wasmvm.ExposedFunc{
 				"temp": {
-					Parameters: nil,
-					Function:   &dummyExposedFunc,
+					Type:     wasmvm.FuncType{},
+					Function: &dummyExposedFunc,
 				},
 			},
 			expectError: true,
@@ -191,6 +195,13 @@ func TestVMConfig_FluentAPI(t *testing.T) {
 			},
 			expectStartupOverride: 137,
 		},
+		{
+			name: "success - SetEntryPoint Only",
+			testCase: func() (*wasmvm.VMConfig, error) {
+				return new(wasmvm.VMConfig).SetEntryPoint("main"), nil
+			},
+			expectEntryPoint: "main",
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -228,6 +239,9 @@ func TestVMConfig_FluentAPI(t *testing.T) {
 			if test.expectStartupOverride > 0 {
 				assert.Equal(t, test.expectStartupOverride, conf.StartOverride)
 			}
+			if test.expectEntryPoint != "" {
+				assert.Equal(t, test.expectEntryPoint, conf.EntryPoint)
+			}
 		})
 	}
 }
@@ -251,3 +265,63 @@ func TestErrStr(t *testing.T) {
 	assert.Contains(t, err.Error(), "unknown vm initialization error")
 	assert.Contains(t, err.Unwrap().Error(), "Test Error")
 }
+
+func TestVMConfig_JSON(t *testing.T) {
+	vmc := (&wasmvm.VMConfig{}).
+		SetSize(16).
+		SetMemoryModel(wasmvm.ShardedMemoryModel).
+		SetMode(wasmvm.ProtectedMode).
+		SetRingConfig(map[uint8]wasmvm.RingConfig{3: {Enabled: true}, 0: {Enabled: true}}).
+		SetEntryPoint("main").
+		SetFuel(100)
+	vmc.Image = (&wasmvm.ImageConfig{}).SetArray([]byte{1}).SetSize(1)
+	data, err := json.Marshal(vmc)
+	require.NoError(t, err)
+	assert.Equal(t, `{"Size":16,"FlatMemory":null,"MemoryModel":"sharded","Shared":false,"Mode":"protected",`+
+		`"MaxThreads":0,"AllowWriteExecute":false,"Strict":false,"Image":{"type":"array","array":"AQ==","size":1},`+
+		`"Rings":{"0":{"Enabled":true},"3":{"Enabled":true}},"StartOverride":0,"EntryPoint":"main",`+
+		`"Deterministic":false,"Seed":0,"MaxMemory":0,"Fuel":100}`, string(data))
+
+	back := &wasmvm.VMConfig{}
+	require.NoError(t, json.Unmarshal(data, back))
+	assert.Equal(t, vmc, back)
+	lc, err := wasmvm.LoadConfig(data, wasmvm.ConfigJSON, nil)
+	require.NoError(t, err)
+	assert.Equal(t, vmc, lc.VM)
+
+	// Values without a name still come back
+	odd := &wasmvm.VMConfig{MemoryModel: wasmvm.MemoryModel(7), Mode: wasmvm.ExecutionMode(9)}
+	clone, err := odd.QuickClone()
+	require.NoError(t, err)
+	assert.Equal(t, odd, clone)
+}
+
+func TestVMInitializationError_JSON(t *testing.T) {
+	vmc := (&wasmvm.VMConfig{}).SetRingConfig(map[uint8]wasmvm.RingConfig{1: {}})
+	_, err := vmc.AppendRingConfig(map[uint8]wasmvm.RingConfig{1: {Enabled: true}})
+	var vie *wasmvm.VMInitializationError
+	require.ErrorAs(t, err, &vie)
+
+	data, err := json.Marshal(vie)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `{"type":"VMRingAlreadyExists","message":"the ring 1 is already present","metadata":{"num":1,"config":{"Size":0,`)
+	back := &wasmvm.VMInitializationError{}
+	require.NoError(t, json.Unmarshal(data, back))
+	assert.Equal(t, vie.Error(), back.Error())
+	again, err := json.Marshal(back)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(data), string(again)) // The metadata keys come back sorted
+
+	// Causes of this package come back as themselves
+	wrapped := &wasmvm.VMInitializationError{
+		Type:  wasmvm.VMImageError,
+		Msg:   "image",
+		Cause: &wasmvm.ImageInitializationError{Type: wasmvm.ImageSizeRequired, Msg: "array type requires size"},
+	}
+	data, err = json.Marshal(wrapped)
+	require.NoError(t, err)
+	back = &wasmvm.VMInitializationError{}
+	require.NoError(t, json.Unmarshal(data, back))
+	assert.Equal(t, wrapped, back)
+	assert.Error(t, json.Unmarshal([]byte(`{"type":"VMNope"}`), back))
+}
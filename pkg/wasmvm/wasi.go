@@ -0,0 +1,525 @@
+package wasmvm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The WASI preview1 host module, so that programs built for
+// wasm32-wasi/wasip1 by the standard toolchains run without changes.
+// Everything not implemented is still defined, returning ENOSYS, so such
+// programs always link.
+
+const WASIModuleName = "wasi_snapshot_preview1"
+
+// What the guest sees of the outside world. The zero value has no
+// arguments or environment, uses the stdio of the VMConfig and the real
+// clocks and randomness.
+type WASIConfig struct {
+	Args []string
+	Env  []string // KEY=value, like os.Environ
+	// When nil the streams of the VMConfig of the calling VM are used,
+	// and when those are nil too stdin is empty and output is discarded
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Wall clock, defaults to time.Now
+	Clock func() time.Time
+	// Monotonic clock, defaults to the time since DefineWASI
+	Monotonic func() time.Duration
+	// Source for random_get, defaults to crypto/rand
+	Rand io.Reader
+	// In a deterministic VM the defaults of the three above are replaced
+	// by the virtual sources of the VM, sources set here are still used
+
+	// Directories the guest may use, as descriptors 3 and up in order
+	Preopens []WASIPreopen
+	// Listeners the guest may accept connections on, as the descriptors
+	// after the preopens
+	Listeners []net.Listener
+}
+
+// A filesystem mounted at GuestPath, such as "/" or "/data"
+type WASIPreopen struct {
+	GuestPath string
+	FS        WASIFS
+}
+
+func (wc *WASIConfig) SetArgs(args ...string) *WASIConfig {
+	wc.Args = args
+	return wc
+}
+
+func (wc *WASIConfig) SetEnv(env ...string) *WASIConfig {
+	wc.Env = env
+	return wc
+}
+
+func (wc *WASIConfig) SetStdin(si io.Reader) *WASIConfig {
+	wc.Stdin = si
+	return wc
+}
+
+func (wc *WASIConfig) SetStdout(so io.Writer) *WASIConfig {
+	wc.Stdout = so
+	return wc
+}
+
+func (wc *WASIConfig) SetStderr(se io.Writer) *WASIConfig {
+	wc.Stderr = se
+	return wc
+}
+
+func (wc *WASIConfig) SetClock(clock func() time.Time) *WASIConfig {
+	wc.Clock = clock
+	return wc
+}
+
+func (wc *WASIConfig) SetMonotonic(monotonic func() time.Duration) *WASIConfig {
+	wc.Monotonic = monotonic
+	return wc
+}
+
+func (wc *WASIConfig) SetRand(r io.Reader) *WASIConfig {
+	wc.Rand = r
+	return wc
+}
+
+func (wc *WASIConfig) AddPreopen(guestPath string, fsys WASIFS) *WASIConfig {
+	wc.Preopens = append(wc.Preopens, WASIPreopen{GuestPath: guestPath, FS: fsys})
+	return wc
+}
+
+func (wc *WASIConfig) AddListener(ln net.Listener) *WASIConfig {
+	wc.Listeners = append(wc.Listeners, ln)
+	return wc
+}
+
+// Error numbers returned to the guest
+type WASIErrno uint32
+
+const (
+	ErrnoSuccess     WASIErrno = 0
+	ErrnoAcces       WASIErrno = 2
+	ErrnoAgain       WASIErrno = 6
+	ErrnoBadf        WASIErrno = 8
+	ErrnoBusy        WASIErrno = 10
+	ErrnoConnreset   WASIErrno = 15
+	ErrnoExist       WASIErrno = 20
+	ErrnoFault       WASIErrno = 21
+	ErrnoInval       WASIErrno = 28
+	ErrnoIO          WASIErrno = 29
+	ErrnoIsdir       WASIErrno = 31
+	ErrnoLoop        WASIErrno = 32
+	ErrnoNametoolong WASIErrno = 37
+	ErrnoNoent       WASIErrno = 44
+	ErrnoNosys       WASIErrno = 52
+	ErrnoNotconn     WASIErrno = 53
+	ErrnoNotdir      WASIErrno = 54
+	ErrnoNotempty    WASIErrno = 55
+	ErrnoNotsock     WASIErrno = 57
+	ErrnoNotsup      WASIErrno = 58
+	ErrnoPipe        WASIErrno = 64
+	ErrnoRofs        WASIErrno = 69
+	ErrnoSpipe       WASIErrno = 70
+	ErrnoXdev        WASIErrno = 75
+	ErrnoNotcapable  WASIErrno = 76
+)
+
+var wasiErrnoNames = map[WASIErrno]string{
+	ErrnoSuccess:     "ESUCCESS",
+	ErrnoAcces:       "EACCES",
+	ErrnoAgain:       "EAGAIN",
+	ErrnoBadf:        "EBADF",
+	ErrnoBusy:        "EBUSY",
+	ErrnoConnreset:   "ECONNRESET",
+	ErrnoExist:       "EEXIST",
+	ErrnoFault:       "EFAULT",
+	ErrnoInval:       "EINVAL",
+	ErrnoIO:          "EIO",
+	ErrnoIsdir:       "EISDIR",
+	ErrnoLoop:        "ELOOP",
+	ErrnoNametoolong: "ENAMETOOLONG",
+	ErrnoNoent:       "ENOENT",
+	ErrnoNosys:       "ENOSYS",
+	ErrnoNotconn:     "ENOTCONN",
+	ErrnoNotdir:      "ENOTDIR",
+	ErrnoNotempty:    "ENOTEMPTY",
+	ErrnoNotsock:     "ENOTSOCK",
+	ErrnoNotsup:      "ENOTSUP",
+	ErrnoPipe:        "EPIPE",
+	ErrnoRofs:        "EROFS",
+	ErrnoSpipe:       "ESPIPE",
+	ErrnoXdev:        "EXDEV",
+	ErrnoNotcapable:  "ENOTCAPABLE",
+}
+
+func (e WASIErrno) String() string {
+	if name, ok := wasiErrnoNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("errno %d", uint32(e))
+}
+
+// Returned by proc_exit. The call traps with TrapExit and this as the
+// cause, so it comes back out of ExportedFunction.Call and Instance.Run.
+type ExitError struct {
+	Code uint32
+}
+
+func (e *ExitError) Error() string {
+	return TrapErrStr(TrapExit, e.Code)
+}
+
+// The status err carries if the guest exited through proc_exit
+func ExitCode(err error) (uint32, bool) {
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		return ee.Code, true
+	}
+	return 0, false
+}
+
+// The state behind one DefineWASI
+type wasi struct {
+	config WASIConfig
+	start  time.Time
+
+	mu  sync.Mutex
+	fds map[uint32]*wasiFD
+}
+
+// Defines the wasi_snapshot_preview1 functions. config may be nil.
+// Every instance linked against them shares one set of descriptors.
+// Only the functions whose input is virtualized are marked
+// deterministic, see wasiDeterministic.
+func (l *Linker) DefineWASI(config *WASIConfig) (*Linker, error) {
+	w := &wasi{start: time.Now()}
+	if config != nil {
+		w.config = *config
+	}
+	w.fds = map[uint32]*wasiFD{
+		0: {kind: wasiFDStdin},
+		1: {kind: wasiFDStdout},
+		2: {kind: wasiFDStderr},
+	}
+	for _, p := range w.config.Preopens {
+		w.add(&wasiFD{kind: wasiFDDir, fs: p.FS, path: ".", preopen: p.GuestPath})
+	}
+	for _, ln := range w.config.Listeners {
+		w.add(&wasiFD{kind: wasiFDListener, listener: ln})
+	}
+	funcs := w.funcs()
+	for name, params := range wasiSignatures {
+		ef, ok := funcs[name]
+		if !ok {
+			ef = wasiNosys(params)
+		}
+		ef.Deterministic = !ok || w.deterministic(name)
+		if _, err := l.DefineFunc(WASIModuleName, name, ef); err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+// Functions that only see the config and the descriptors that come
+// from it. Output is taken to be deterministic; input from stdin, files
+// and connections is not, and without path_open or sock_accept the
+// descriptors written to and closed can only be the standard streams.
+var wasiDeterministic = map[string]bool{
+	"args_get":            true,
+	"args_sizes_get":      true,
+	"environ_get":         true,
+	"environ_sizes_get":   true,
+	"clock_res_get":       true,
+	"proc_exit":           true,
+	"sched_yield":         true,
+	"fd_close":            true,
+	"fd_fdstat_get":       true,
+	"fd_prestat_get":      true,
+	"fd_prestat_dir_name": true,
+	"fd_write":            true,
+}
+
+// The clocks and randomness are deterministic when they are left to the
+// virtual sources of the VM
+func (w *wasi) deterministic(name string) bool {
+	switch name {
+	case "clock_time_get":
+		return w.config.Clock == nil && w.config.Monotonic == nil
+	case "random_get":
+		return w.config.Rand == nil
+	}
+	return wasiDeterministic[name]
+}
+
+// Parameters of every preview1 function, i for i32 and I for i64. All
+// of them return an errno except proc_exit.
+var wasiSignatures = map[string]string{
+	"args_get":                "ii",
+	"args_sizes_get":          "ii",
+	"environ_get":             "ii",
+	"environ_sizes_get":       "ii",
+	"clock_res_get":           "ii",
+	"clock_time_get":          "iIi",
+	"fd_advise":               "iIIi",
+	"fd_allocate":             "iII",
+	"fd_close":                "i",
+	"fd_datasync":             "i",
+	"fd_fdstat_get":           "ii",
+	"fd_fdstat_set_flags":     "ii",
+	"fd_fdstat_set_rights":    "iII",
+	"fd_filestat_get":         "ii",
+	"fd_filestat_set_size":    "iI",
+	"fd_filestat_set_times":   "iIIi",
+	"fd_pread":                "iiiIi",
+	"fd_prestat_get":          "ii",
+	"fd_prestat_dir_name":     "iii",
+	"fd_pwrite":               "iiiIi",
+	"fd_read":                 "iiii",
+	"fd_readdir":              "iiiIi",
+	"fd_renumber":             "ii",
+	"fd_seek":                 "iIii",
+	"fd_sync":                 "i",
+	"fd_tell":                 "ii",
+	"fd_write":                "iiii",
+	"path_create_directory":   "iii",
+	"path_filestat_get":       "iiiii",
+	"path_filestat_set_times": "iiiiIIi",
+	"path_link":               "iiiiiii",
+	"path_open":               "iiiiiIIii",
+	"path_readlink":           "iiiiii",
+	"path_remove_directory":   "iii",
+	"path_rename":             "iiiiii",
+	"path_symlink":            "iiiii",
+	"path_unlink_file":        "iii",
+	"poll_oneoff":             "iiii",
+	"proc_exit":               "i",
+	"proc_raise":              "i",
+	"sched_yield":             "",
+	"random_get":              "ii",
+	"sock_accept":             "iii",
+	"sock_recv":               "iiiiii",
+	"sock_send":               "iiiii",
+	"sock_shutdown":           "ii",
+}
+
+// A function that only returns ENOSYS
+func wasiNosys(params string) *ExposedFunc {
+	ft := FuncType{Results: []ValueStackEntryType{TYPE_I32}}
+	for _, p := range params {
+		if p == 'I' {
+			ft.Params = append(ft.Params, TYPE_I64)
+		} else {
+			ft.Params = append(ft.Params, TYPE_I32)
+		}
+	}
+	return NewExposedFunc(ft, func(context.Context, *VMState, []ValueStackEntry) ([]ValueStackEntry, error) {
+		return []ValueStackEntry{i32Entry(uint32(ErrnoNosys))}, nil
+	})
+}
+
+func (w *wasi) funcs() map[string]*ExposedFunc {
+	return map[string]*ExposedFunc{
+		"args_get":          HostFunc2_1(w.argsGet),
+		"args_sizes_get":    HostFunc2_1(w.argsSizesGet),
+		"environ_get":       HostFunc2_1(w.environGet),
+		"environ_sizes_get": HostFunc2_1(w.environSizesGet),
+		"clock_res_get":     HostFunc2_1(w.clockResGet),
+		"clock_time_get":    HostFunc3_1(w.clockTimeGet),
+		"random_get":        HostFunc2_1(w.randomGet),
+		"proc_exit":         HostFunc1_0(w.procExit),
+		"sched_yield":       HostFunc0_1(w.schedYield),
+
+		"fd_close":             HostFunc1_1(w.fdClose),
+		"fd_datasync":          HostFunc1_1(w.fdSync),
+		"fd_fdstat_get":        HostFunc2_1(w.fdFdstatGet),
+		"fd_fdstat_set_flags":  HostFunc2_1(w.fdFdstatSetFlags),
+		"fd_filestat_get":      HostFunc2_1(w.fdFilestatGet),
+		"fd_filestat_set_size": HostFunc2_1(w.fdFilestatSetSize),
+		"fd_pread":             HostFunc5_1(w.fdPread),
+		"fd_prestat_get":       HostFunc2_1(w.fdPrestatGet),
+		"fd_prestat_dir_name":  HostFunc3_1(w.fdPrestatDirName),
+		"fd_pwrite":            HostFunc5_1(w.fdPwrite),
+		"fd_read":              HostFunc4_1(w.fdRead),
+		"fd_readdir":           HostFunc5_1(w.fdReaddir),
+		"fd_seek":              HostFunc4_1(w.fdSeek),
+		"fd_sync":              HostFunc1_1(w.fdSync),
+		"fd_tell":              HostFunc2_1(w.fdTell),
+		"fd_write":             HostFunc4_1(w.fdWrite),
+
+		"path_create_directory": HostFunc3_1(w.pathCreateDirectory),
+		"path_filestat_get":     HostFunc5_1(w.pathFilestatGet),
+		"path_open":             w.pathOpenFunc(),
+		"path_remove_directory": HostFunc3_1(w.pathRemoveDirectory),
+		"path_rename":           HostFunc6_1(w.pathRename),
+		"path_unlink_file":      HostFunc3_1(w.pathUnlinkFile),
+
+		"sock_accept":   HostFunc3_1(w.sockAccept),
+		"sock_recv":     HostFunc6_1(w.sockRecv),
+		"sock_send":     HostFunc5_1(w.sockSend),
+		"sock_shutdown": HostFunc2_1(w.sockShutdown),
+	}
+}
+
+// Guest memory access. Failures become EFAULT instead of trapping, the
+// way a kernel reports a bad pointer.
+
+// Whether [addr, addr+n) lies in the memory. Checked before a buffer of
+// a guest chosen length is allocated, or input is consumed for it.
+func wasiInBounds(vm *VMState, addr uint32, n uint32) bool {
+	return inBounds(vm.Memory.Size(), uint64(addr), int(n))
+}
+
+func wasiRead(vm *VMState, addr uint32, n uint32) ([]byte, bool) {
+	if !wasiInBounds(vm, addr, n) {
+		return nil, false
+	}
+	buf := make([]byte, n)
+	return buf, vm.Memory.Read(vm.MemoryContext(), uint64(addr), buf) == MemoryAccessOK
+}
+
+func wasiWrite(vm *VMState, addr uint32, data []byte) bool {
+	return vm.Memory.Write(vm.MemoryContext(), uint64(addr), data) == MemoryAccessOK
+}
+
+func wasiWriteU32(vm *VMState, addr uint32, v uint32) bool {
+	return wasiWrite(vm, addr, binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func wasiWriteU64(vm *VMState, addr uint32, v uint64) bool {
+	return wasiWrite(vm, addr, binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func errnoIf(ok bool, errno WASIErrno) WASIErrno {
+	if ok {
+		return ErrnoSuccess
+	}
+	return errno
+}
+
+// args_get and environ_get: an array of pointers to NUL terminated
+// strings, which are packed into buf
+func wasiStringsGet(vm *VMState, strs []string, ptrs, buf uint32) WASIErrno {
+	for _, s := range strs {
+		if !wasiWriteU32(vm, ptrs, buf) || !wasiWrite(vm, buf, append([]byte(s), 0)) {
+			return ErrnoFault
+		}
+		ptrs += 4
+		buf += uint32(len(s)) + 1
+	}
+	return ErrnoSuccess
+}
+
+func wasiStringsSizesGet(vm *VMState, strs []string, countPtr, sizePtr uint32) WASIErrno {
+	size := 0
+	for _, s := range strs {
+		size += len(s) + 1
+	}
+	return errnoIf(wasiWriteU32(vm, countPtr, uint32(len(strs))) && wasiWriteU32(vm, sizePtr, uint32(size)), ErrnoFault)
+}
+
+func (w *wasi) argsGet(_ context.Context, vm *VMState, argv, buf uint32) (WASIErrno, error) {
+	return wasiStringsGet(vm, w.config.Args, argv, buf), nil
+}
+
+func (w *wasi) argsSizesGet(_ context.Context, vm *VMState, countPtr, sizePtr uint32) (WASIErrno, error) {
+	return wasiStringsSizesGet(vm, w.config.Args, countPtr, sizePtr), nil
+}
+
+func (w *wasi) environGet(_ context.Context, vm *VMState, environ, buf uint32) (WASIErrno, error) {
+	return wasiStringsGet(vm, w.config.Env, environ, buf), nil
+}
+
+func (w *wasi) environSizesGet(_ context.Context, vm *VMState, countPtr, sizePtr uint32) (WASIErrno, error) {
+	return wasiStringsSizesGet(vm, w.config.Env, countPtr, sizePtr), nil
+}
+
+// Clock ids
+const (
+	wasiClockRealtime uint32 = iota
+	wasiClockMonotonic
+	wasiClockProcessCPUTime
+	wasiClockThreadCPUTime
+)
+
+// Nanoseconds on the given clock. The CPU time clocks are approximated
+// by the monotonic clock.
+func (w *wasi) now(vm *VMState, id uint32) (uint64, bool) {
+	switch id {
+	case wasiClockRealtime:
+		switch {
+		case w.config.Clock != nil:
+			return uint64(w.config.Clock().UnixNano()), true
+		case vm.virtual != nil:
+			return virtualEpoch + vm.virtual.now(), true
+		}
+		return uint64(time.Now().UnixNano()), true
+	case wasiClockMonotonic, wasiClockProcessCPUTime, wasiClockThreadCPUTime:
+		switch {
+		case w.config.Monotonic != nil:
+			return uint64(w.config.Monotonic()), true
+		case vm.virtual != nil:
+			return vm.virtual.now(), true
+		}
+		return uint64(time.Since(w.start)), true
+	}
+	return 0, false
+}
+
+func wasiClockValid(id uint32) bool {
+	return id <= wasiClockThreadCPUTime
+}
+
+func (w *wasi) clockResGet(_ context.Context, vm *VMState, id, resPtr uint32) (WASIErrno, error) {
+	if !wasiClockValid(id) {
+		return ErrnoInval, nil
+	}
+	return errnoIf(wasiWriteU64(vm, resPtr, 1), ErrnoFault), nil
+}
+
+func (w *wasi) clockTimeGet(_ context.Context, vm *VMState, id uint32, _ uint64, timePtr uint32) (WASIErrno, error) {
+	t, ok := w.now(vm, id)
+	if !ok {
+		return ErrnoInval, nil
+	}
+	return errnoIf(wasiWriteU64(vm, timePtr, t), ErrnoFault), nil
+}
+
+func (w *wasi) randomGet(_ context.Context, vm *VMState, buf, n uint32) (WASIErrno, error) {
+	var src io.Reader
+	switch {
+	case w.config.Rand != nil:
+		src = w.config.Rand
+	case vm.virtual != nil:
+		src = vm.virtual
+	default:
+		src = rand.Reader
+	}
+	if !wasiInBounds(vm, buf, n) {
+		return ErrnoFault, nil
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(src, data); err != nil {
+		return ErrnoIO, nil
+	}
+	return errnoIf(wasiWrite(vm, buf, data), ErrnoFault), nil
+}
+
+func (w *wasi) procExit(_ context.Context, _ *VMState, code uint32) error {
+	return &ExitError{Code: code}
+}
+
+func (w *wasi) schedYield(context.Context, *VMState) (WASIErrno, error) {
+	runtime.Gosched()
+	return ErrnoSuccess, nil
+}
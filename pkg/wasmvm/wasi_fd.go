@@ -0,0 +1,477 @@
+package wasmvm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+)
+
+// File descriptors of the WASI module: the three stdio streams, the
+// preopened directories, the listeners and then whatever the guest opens
+// or accepts.
+
+type wasiFDKind byte
+
+const (
+	wasiFDStdin wasiFDKind = iota
+	wasiFDStdout
+	wasiFDStderr
+	wasiFDDir
+	wasiFDFile
+	wasiFDListener
+	wasiFDSocket
+)
+
+type wasiFD struct {
+	kind    wasiFDKind
+	fs      WASIFS
+	path    string   // Name within fs, for directories and files
+	file    WASIFile // For files
+	preopen string   // Guest path of a preopened directory
+	append  bool
+
+	listener net.Listener
+	conn     net.Conn // Accepted connections
+}
+
+func (f *wasiFD) close() error {
+	switch {
+	case f.file != nil:
+		return f.file.Close()
+	case f.listener != nil:
+		return f.listener.Close()
+	case f.conn != nil:
+		return f.conn.Close()
+	}
+	return nil
+}
+
+// File types, as in fdstat and filestat
+const (
+	wasiFiletypeUnknown         byte = 0
+	wasiFiletypeCharacterDevice byte = 2
+	wasiFiletypeDirectory       byte = 3
+	wasiFiletypeRegularFile     byte = 4
+	wasiFiletypeSocketStream    byte = 6
+	wasiFiletypeSymbolicLink    byte = 7
+)
+
+func wasiFiletype(mode fs.FileMode) byte {
+	switch {
+	case mode.IsDir():
+		return wasiFiletypeDirectory
+	case mode.IsRegular():
+		return wasiFiletypeRegularFile
+	case mode&fs.ModeSymlink != 0:
+		return wasiFiletypeSymbolicLink
+	case mode&fs.ModeCharDevice != 0:
+		return wasiFiletypeCharacterDevice
+	}
+	return wasiFiletypeUnknown
+}
+
+// fdflags
+const (
+	wasiFdflagAppend   uint16 = 1
+	wasiFdflagNonblock uint16 = 4
+)
+
+func (w *wasi) fd(fd uint32) (*wasiFD, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f, ok := w.fds[fd]
+	return f, ok
+}
+
+// Adds f under the lowest free descriptor
+func (w *wasi) add(f *wasiFD) uint32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fd := uint32(0)
+	for w.fds[fd] != nil {
+		fd++
+	}
+	w.fds[fd] = f
+	return fd
+}
+
+// The stream behind a stdio descriptor, falling back to the VMConfig
+func (w *wasi) reader(vm *VMState, f *wasiFD) io.Reader {
+	switch f.kind {
+	case wasiFDFile:
+		return f.file
+	case wasiFDSocket:
+		return f.conn
+	case wasiFDStdin:
+	default:
+		return nil
+	}
+	if w.config.Stdin != nil {
+		return w.config.Stdin
+	}
+	if vm.Config != nil && vm.Config.Stdin != nil {
+		return vm.Config.Stdin
+	}
+	return eofReader{}
+}
+
+func (w *wasi) writer(vm *VMState, f *wasiFD) io.Writer {
+	var own, fallback io.Writer
+	switch f.kind {
+	case wasiFDFile:
+		return f.file
+	case wasiFDSocket:
+		return f.conn
+	case wasiFDStdout:
+		own = w.config.Stdout
+		if vm.Config != nil {
+			fallback = vm.Config.Stdout
+		}
+	case wasiFDStderr:
+		own = w.config.Stderr
+		if vm.Config != nil {
+			fallback = vm.Config.Stderr
+		}
+	default:
+		return nil
+	}
+	switch {
+	case own != nil:
+		return own
+	case fallback != nil:
+		return fallback
+	}
+	return io.Discard
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Reads an array of n iovecs, each a pointer and a length
+func wasiIovecs(vm *VMState, iovs, n uint32) ([][2]uint32, bool) {
+	if n > 1<<28 {
+		return nil, false
+	}
+	raw, ok := wasiRead(vm, iovs, n*8)
+	if !ok {
+		return nil, false
+	}
+	vecs := make([][2]uint32, n)
+	for i := range vecs {
+		vecs[i] = [2]uint32{binary.LittleEndian.Uint32(raw[i*8:]), binary.LittleEndian.Uint32(raw[i*8+4:])}
+	}
+	return vecs, true
+}
+
+func (w *wasi) fdWrite(ctx context.Context, vm *VMState, fd, iovs, iovsLen, nwrittenPtr uint32) (WASIErrno, error) {
+	f, ok := w.fd(fd)
+	if !ok {
+		return ErrnoBadf, nil
+	}
+	out := w.writer(vm, f)
+	if out == nil {
+		return ErrnoBadf, nil
+	}
+	done := wasiInterruptible(ctx, f.conn)
+	errno := wasiWriteIovecs(vm, out, iovs, iovsLen, nwrittenPtr)
+	if err := done(); err != nil {
+		return 0, err
+	}
+	return errno, nil
+}
+
+func (w *wasi) fdPwrite(_ context.Context, vm *VMState, fd, iovs, iovsLen uint32, offset uint64, nwrittenPtr uint32) (WASIErrno, error) {
+	f, errno := w.file(fd)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	return wasiWriteIovecs(vm, io.NewOffsetWriter(f.file, int64(offset)), iovs, iovsLen, nwrittenPtr), nil
+}
+
+func wasiWriteIovecs(vm *VMState, out io.Writer, iovs, iovsLen, nwrittenPtr uint32) WASIErrno {
+	vecs, ok := wasiIovecs(vm, iovs, iovsLen)
+	if !ok {
+		return ErrnoFault
+	}
+	var written uint32
+	for _, vec := range vecs {
+		data, ok := wasiRead(vm, vec[0], vec[1])
+		if !ok {
+			return ErrnoFault
+		}
+		n, err := out.Write(data)
+		written += uint32(n)
+		if err != nil {
+			return wasiErrno(err)
+		}
+	}
+	return errnoIf(wasiWriteU32(vm, nwrittenPtr, written), ErrnoFault)
+}
+
+func (w *wasi) fdRead(ctx context.Context, vm *VMState, fd, iovs, iovsLen, nreadPtr uint32) (WASIErrno, error) {
+	f, ok := w.fd(fd)
+	if !ok {
+		return ErrnoBadf, nil
+	}
+	in := w.reader(vm, f)
+	if in == nil {
+		return ErrnoBadf, nil
+	}
+	done := wasiInterruptible(ctx, f.conn)
+	errno := wasiReadIovecs(vm, in, iovs, iovsLen, nreadPtr)
+	if err := done(); err != nil {
+		return 0, err
+	}
+	return errno, nil
+}
+
+func (w *wasi) fdPread(_ context.Context, vm *VMState, fd, iovs, iovsLen uint32, offset uint64, nreadPtr uint32) (WASIErrno, error) {
+	f, errno := w.file(fd)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	if offset > math.MaxInt64 {
+		return ErrnoInval, nil
+	}
+	return wasiReadIovecs(vm, io.NewSectionReader(f.file, int64(offset), math.MaxInt64-int64(offset)), iovs, iovsLen, nreadPtr), nil
+}
+
+// Fills the iovecs in order, stopping at the first short read
+func wasiReadIovecs(vm *VMState, in io.Reader, iovs, iovsLen, nreadPtr uint32) WASIErrno {
+	vecs, ok := wasiIovecs(vm, iovs, iovsLen)
+	if !ok || !wasiInBounds(vm, nreadPtr, 4) {
+		return ErrnoFault
+	}
+	// Nothing is read unless all of it has somewhere to go
+	for _, vec := range vecs {
+		if !wasiInBounds(vm, vec[0], vec[1]) {
+			return ErrnoFault
+		}
+	}
+	var read uint32
+	for _, vec := range vecs {
+		buf := make([]byte, vec[1])
+		n, err := in.Read(buf)
+		if !wasiWrite(vm, vec[0], buf[:n]) {
+			return ErrnoFault
+		}
+		read += uint32(n)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return wasiErrno(err)
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return errnoIf(wasiWriteU32(vm, nreadPtr, read), ErrnoFault)
+}
+
+// The open file behind fd
+func (w *wasi) file(fd uint32) (*wasiFD, WASIErrno) {
+	f, ok := w.fd(fd)
+	switch {
+	case !ok:
+		return nil, ErrnoBadf
+	case f.kind == wasiFDDir:
+		return nil, ErrnoIsdir
+	case f.kind != wasiFDFile:
+		return nil, ErrnoSpipe
+	}
+	return f, ErrnoSuccess
+}
+
+// Only files seek, the whence values match io.Seek*
+func (w *wasi) fdSeek(_ context.Context, vm *VMState, fd uint32, offset int64, whence uint32, newOffsetPtr uint32) (WASIErrno, error) {
+	f, errno := w.file(fd)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	if whence > io.SeekEnd {
+		return ErrnoInval, nil
+	}
+	pos, err := f.file.Seek(offset, int(whence))
+	if err != nil {
+		return wasiErrno(err), nil
+	}
+	return errnoIf(wasiWriteU64(vm, newOffsetPtr, uint64(pos)), ErrnoFault), nil
+}
+
+func (w *wasi) fdTell(ctx context.Context, vm *VMState, fd, offsetPtr uint32) (WASIErrno, error) {
+	return w.fdSeek(ctx, vm, fd, 0, io.SeekCurrent, offsetPtr)
+}
+
+func (w *wasi) fdClose(_ context.Context, _ *VMState, fd uint32) (WASIErrno, error) {
+	w.mu.Lock()
+	f, ok := w.fds[fd]
+	delete(w.fds, fd)
+	w.mu.Unlock()
+	if !ok {
+		return ErrnoBadf, nil
+	}
+	return wasiErrno(f.close()), nil
+}
+
+// Writes the 24 octet fdstat: filetype, flags and the rights, which
+// are all granted
+func (w *wasi) fdFdstatGet(_ context.Context, vm *VMState, fd, statPtr uint32) (WASIErrno, error) {
+	f, ok := w.fd(fd)
+	if !ok {
+		return ErrnoBadf, nil
+	}
+	stat := make([]byte, 24)
+	switch f.kind {
+	case wasiFDDir:
+		stat[0] = wasiFiletypeDirectory
+	case wasiFDFile:
+		stat[0] = wasiFiletypeRegularFile
+	case wasiFDListener, wasiFDSocket:
+		stat[0] = wasiFiletypeSocketStream
+	default:
+		stat[0] = wasiFiletypeCharacterDevice
+	}
+	if f.append {
+		binary.LittleEndian.PutUint16(stat[2:], wasiFdflagAppend)
+	}
+	binary.LittleEndian.PutUint64(stat[8:], ^uint64(0))
+	binary.LittleEndian.PutUint64(stat[16:], ^uint64(0))
+	return errnoIf(wasiWrite(vm, statPtr, stat), ErrnoFault), nil
+}
+
+// Flags are fixed at path_open, so only setting them to what they
+// already are succeeds. Non-blocking is ignored, nothing here blocks
+// for long.
+func (w *wasi) fdFdstatSetFlags(_ context.Context, _ *VMState, fd, flags uint32) (WASIErrno, error) {
+	f, ok := w.fd(fd)
+	if !ok {
+		return ErrnoBadf, nil
+	}
+	flags &^= uint32(wasiFdflagNonblock)
+	if f.append {
+		flags &^= uint32(wasiFdflagAppend)
+	}
+	return errnoIf(flags == 0, ErrnoNotsup), nil
+}
+
+// Writes the 64 octet filestat: device, inode, filetype, links, size
+// and the access, modification and change times, all three being the
+// modification time. Deterministic VMs see zero times.
+func wasiFilestat(vm *VMState, ptr uint32, fi fs.FileInfo) WASIErrno {
+	stat := make([]byte, 64)
+	stat[16] = wasiFiletype(fi.Mode())
+	binary.LittleEndian.PutUint64(stat[24:], 1)
+	binary.LittleEndian.PutUint64(stat[32:], uint64(fi.Size()))
+	mtime := uint64(fi.ModTime().UnixNano())
+	if vm.deterministic {
+		mtime = 0
+	}
+	for off := 40; off < 64; off += 8 {
+		binary.LittleEndian.PutUint64(stat[off:], mtime)
+	}
+	return errnoIf(wasiWrite(vm, ptr, stat), ErrnoFault)
+}
+
+func (w *wasi) fdFilestatGet(_ context.Context, vm *VMState, fd, statPtr uint32) (WASIErrno, error) {
+	f, ok := w.fd(fd)
+	if !ok {
+		return ErrnoBadf, nil
+	}
+	var fi fs.FileInfo
+	var err error
+	switch f.kind {
+	case wasiFDFile:
+		fi, err = f.file.Stat()
+	case wasiFDDir:
+		fi, err = f.fs.Stat(f.path)
+	case wasiFDListener, wasiFDSocket:
+		stat := make([]byte, 64)
+		stat[16] = wasiFiletypeSocketStream
+		return errnoIf(wasiWrite(vm, statPtr, stat), ErrnoFault), nil
+	default:
+		stat := make([]byte, 64)
+		stat[16] = wasiFiletypeCharacterDevice
+		return errnoIf(wasiWrite(vm, statPtr, stat), ErrnoFault), nil
+	}
+	if err != nil {
+		return wasiErrno(err), nil
+	}
+	return wasiFilestat(vm, statPtr, fi), nil
+}
+
+func (w *wasi) fdFilestatSetSize(_ context.Context, _ *VMState, fd uint32, size uint64) (WASIErrno, error) {
+	f, errno := w.file(fd)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	if size > math.MaxInt64 {
+		return ErrnoInval, nil
+	}
+	return wasiErrno(f.file.Truncate(int64(size))), nil
+}
+
+// fd_sync and fd_datasync
+func (w *wasi) fdSync(_ context.Context, _ *VMState, fd uint32) (WASIErrno, error) {
+	f, errno := w.file(fd)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	return wasiErrno(f.file.Sync()), nil
+}
+
+// Writes the directory entries from cookie on, each a 24 octet dirent
+// followed by the name: the cookie of the next entry, the inode, the
+// length of the name and the filetype. The last entry is cut off when
+// buf runs out, which the guest takes as the sign to call again. There
+// are no "." and ".." entries.
+func (w *wasi) fdReaddir(_ context.Context, vm *VMState, fd, buf, bufLen uint32, cookie uint64, bufusedPtr uint32) (WASIErrno, error) {
+	f, ok := w.fd(fd)
+	if !ok {
+		return ErrnoBadf, nil
+	}
+	if f.kind != wasiFDDir {
+		return ErrnoNotdir, nil
+	}
+	entries, err := f.fs.ReadDir(f.path)
+	if err != nil {
+		return wasiErrno(err), nil
+	}
+	var out []byte
+	for i := cookie; i < uint64(len(entries)) && len(out) < int(bufLen); i++ {
+		dirent := make([]byte, 24)
+		binary.LittleEndian.PutUint64(dirent, i+1)
+		binary.LittleEndian.PutUint32(dirent[16:], uint32(len(entries[i].Name())))
+		dirent[20] = wasiFiletype(entries[i].Type())
+		out = append(append(out, dirent...), entries[i].Name()...)
+	}
+	out = out[:min(len(out), int(bufLen))]
+	return errnoIf(wasiWrite(vm, buf, out) && wasiWriteU32(vm, bufusedPtr, uint32(len(out))), ErrnoFault), nil
+}
+
+// The prestat of a preopened directory: a tag of 0 for a directory and
+// the length of its guest path
+func (w *wasi) fdPrestatGet(_ context.Context, vm *VMState, fd, prestatPtr uint32) (WASIErrno, error) {
+	f, ok := w.fd(fd)
+	if !ok || f.preopen == "" {
+		return ErrnoBadf, nil
+	}
+	prestat := make([]byte, 8)
+	binary.LittleEndian.PutUint32(prestat[4:], uint32(len(f.preopen)))
+	return errnoIf(wasiWrite(vm, prestatPtr, prestat), ErrnoFault), nil
+}
+
+func (w *wasi) fdPrestatDirName(_ context.Context, vm *VMState, fd, pathPtr, pathLen uint32) (WASIErrno, error) {
+	f, ok := w.fd(fd)
+	if !ok || f.preopen == "" {
+		return ErrnoBadf, nil
+	}
+	if pathLen < uint32(len(f.preopen)) {
+		return ErrnoNametoolong, nil
+	}
+	return errnoIf(wasiWrite(vm, pathPtr, []byte(f.preopen)), ErrnoFault), nil
+}
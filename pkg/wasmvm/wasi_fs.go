@@ -0,0 +1,262 @@
+package wasmvm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Filesystems behind the preopened directories of the WASI module.
+// Names are slash separated and relative to the root of the filesystem,
+// as for fs.FS, with "." for the root itself. Errors follow the os
+// package, *fs.PathError wrapping fs.ErrNotExist, syscall.ENOTDIR and
+// the like, so they map onto the errno the guest gets. A name that
+// would lead out of the filesystem fails with ErrPathEscapes.
+type WASIFS interface {
+	// flag is a combination of the os.O_* flags
+	OpenFile(name string, flag int, perm fs.FileMode) (WASIFile, error)
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	Mkdir(name string, perm fs.FileMode) error
+	// Removes a file or an empty directory
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	// Sorted by name
+	ReadDir(name string) ([]fs.DirEntry, error)
+}
+
+// An open file of a WASIFS. *os.File is one.
+type WASIFile interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// The guest sees it as ENOTCAPABLE
+var ErrPathEscapes = errors.New("path escapes from the filesystem")
+
+// A WASIFS over a host directory. Access is confined to the tree below
+// it through os.Root, so neither ".." nor symlinks lead out of it.
+type DirFS struct {
+	root *os.Root
+	// What os.Root fails with for a name leading out of it, which os
+	// doesn't export
+	escape error
+}
+
+func NewDirFS(dir string) (*DirFS, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(abs)
+	if err != nil {
+		return nil, err
+	}
+	// Refused before anything is looked up
+	_, err = root.Lstat("..")
+	var pe *fs.PathError
+	if !errors.As(err, &pe) {
+		root.Close()
+		return nil, fmt.Errorf("dirfs: os.Root let %q out", "..")
+	}
+	return &DirFS{root: root, escape: pe.Err}, nil
+}
+
+// Swaps the escape error of os.Root for ErrPathEscapes
+func (d *DirFS) wrap(err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) && pe.Err == d.escape {
+		return &fs.PathError{Op: pe.Op, Path: pe.Path, Err: ErrPathEscapes}
+	}
+	return err
+}
+
+// Releases the handle on the directory
+func (d *DirFS) Close() error {
+	return d.root.Close()
+}
+
+func (d *DirFS) OpenFile(name string, flag int, perm fs.FileMode) (WASIFile, error) {
+	f, err := d.root.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, d.wrap(err)
+	}
+	return f, nil
+}
+
+func (d *DirFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := d.root.Stat(name)
+	return fi, d.wrap(err)
+}
+
+func (d *DirFS) Lstat(name string) (fs.FileInfo, error) {
+	fi, err := d.root.Lstat(name)
+	return fi, d.wrap(err)
+}
+
+func (d *DirFS) Mkdir(name string, perm fs.FileMode) error {
+	return d.wrap(d.root.Mkdir(name, perm))
+}
+
+func (d *DirFS) Remove(name string) error {
+	return d.wrap(d.root.Remove(name))
+}
+
+func (d *DirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := d.root.Open(name)
+	if err != nil {
+		return nil, d.wrap(err)
+	}
+	defer f.Close()
+	entries, err := f.ReadDir(-1)
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, err
+}
+
+// A read-only WASIFS over any fs.FS, such as an embed.FS. Anything that
+// would change it fails with EROFS.
+type ReadOnlyFS struct {
+	fsys fs.FS
+}
+
+func NewReadOnlyFS(fsys fs.FS) *ReadOnlyFS {
+	return &ReadOnlyFS{fsys: fsys}
+}
+
+func readOnlyErr(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+func (r *ReadOnlyFS) OpenFile(name string, flag int, _ fs.FileMode) (WASIFile, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, readOnlyErr("open", name)
+	}
+	f, err := r.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{File: f, name: name}, nil
+}
+
+func (r *ReadOnlyFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, name)
+}
+
+// An fs.FS has no notion of links
+func (r *ReadOnlyFS) Lstat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, name)
+}
+
+func (r *ReadOnlyFS) Mkdir(name string, _ fs.FileMode) error {
+	return readOnlyErr("mkdir", name)
+}
+
+func (r *ReadOnlyFS) Remove(name string) error {
+	return readOnlyErr("remove", name)
+}
+
+func (r *ReadOnlyFS) Rename(oldname, _ string) error {
+	return readOnlyErr("rename", oldname)
+}
+
+func (r *ReadOnlyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(r.fsys, name)
+}
+
+// Seeking and positioned reads work when the underlying file supports
+// them, as the files of embed.FS and os.DirFS do
+type readOnlyFile struct {
+	fs.File
+	name string
+}
+
+func (f *readOnlyFile) err(op string, errno error) error {
+	return &fs.PathError{Op: op, Path: f.name, Err: errno}
+}
+
+func (f *readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, f.err("seek", syscall.ESPIPE)
+}
+
+func (f *readOnlyFile) ReadAt(p []byte, off int64) (int, error) {
+	if r, ok := f.File.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+	return 0, f.err("read", syscall.ESPIPE)
+}
+
+func (f *readOnlyFile) Write([]byte) (int, error) {
+	return 0, f.err("write", syscall.EBADF)
+}
+
+func (f *readOnlyFile) WriteAt([]byte, int64) (int, error) {
+	return 0, f.err("write", syscall.EBADF)
+}
+
+func (f *readOnlyFile) Truncate(int64) error {
+	return f.err("truncate", syscall.EBADF)
+}
+
+func (f *readOnlyFile) Sync() error {
+	return nil
+}
+
+// The errno for an error out of a WASIFS or a connection. The syscall
+// errors go before the fs ones,
+// ENOTEMPTY would pass for fs.ErrExist otherwise.
+func wasiErrno(err error) WASIErrno {
+	if e, ok := wasiNetErrno(err); ok {
+		return e
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if e, ok := wasiSyscallErrnos[errno]; ok {
+			return e
+		}
+	}
+	switch {
+	case err == nil:
+		return ErrnoSuccess
+	case errors.Is(err, ErrPathEscapes):
+		return ErrnoNotcapable
+	case errors.Is(err, errors.ErrUnsupported):
+		return ErrnoNotsup
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrnoNoent
+	case errors.Is(err, fs.ErrExist):
+		return ErrnoExist
+	case errors.Is(err, fs.ErrPermission):
+		return ErrnoAcces
+	case errors.Is(err, fs.ErrInvalid):
+		return ErrnoInval
+	}
+	return ErrnoIO
+}
+
+var wasiSyscallErrnos = map[syscall.Errno]WASIErrno{
+	syscall.EBADF:     ErrnoBadf,
+	syscall.EINVAL:    ErrnoInval,
+	syscall.EISDIR:    ErrnoIsdir,
+	syscall.ENOTDIR:   ErrnoNotdir,
+	syscall.ENOTEMPTY: ErrnoNotempty,
+	syscall.EROFS:     ErrnoRofs,
+	syscall.ESPIPE:    ErrnoSpipe,
+	syscall.EXDEV:     ErrnoXdev,
+	syscall.ELOOP:     ErrnoLoop,
+}
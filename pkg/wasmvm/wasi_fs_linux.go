@@ -0,0 +1,36 @@
+package wasmvm
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Renames between the parent directories opened through the root, so
+// a symlink swapped in while it happens can't redirect it
+func (d *DirFS) Rename(oldname, newname string) error {
+	oldDir, err := d.openParent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	defer oldDir.Close()
+	newDir, err := d.openParent("rename", newname)
+	if err != nil {
+		return err
+	}
+	defer newDir.Close()
+	err = syscall.Renameat(int(oldDir.Fd()), path.Base(oldname), int(newDir.Fd()), path.Base(newname))
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (d *DirFS) openParent(op, name string) (*os.File, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := d.root.Open(path.Dir(name))
+	return f, d.wrap(err)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package wasmvm
+
+import (
+	"errors"
+	"os"
+)
+
+// os.Root can't rename before Go 1.25 and there's no renameat to do it
+// safely through here, so the guest gets ENOTSUP
+func (d *DirFS) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+}
@@ -0,0 +1,274 @@
+package wasmvm_test
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"testing/fstest"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	rightRead  = 1 << 1
+	rightWrite = 1 << 6
+)
+
+// A VM with 512 octets of memory and the WASI functions over preopens
+type wasiFSTest struct {
+	t   *testing.T
+	l   *wasmvm.Linker
+	vm  *wasmvm.VMState
+	mem []byte
+}
+
+func newWASIFSTest(t *testing.T, config *wasmvm.WASIConfig) *wasiFSTest {
+	l, err := wasmvm.NewLinker().DefineWASI(config)
+	require.NoError(t, err)
+	vm, err := new(wasmvm.VMConfig).SetSize(512).BuildVMState()
+	require.NoError(t, err)
+	return &wasiFSTest{t: t, l: l, vm: vm, mem: vm.Memory.(*wasmvm.FlatMemory).Bytes()}
+}
+
+func (w *wasiFSTest) call(name string, args ...wasmvm.ValueStackEntry) wasmvm.WASIErrno {
+	return wasiCall(w.t, w.l, w.vm, name, args...)
+}
+
+// Calls name with a path at 0 as the pointer and length right after the
+// descriptor
+func (w *wasiFSTest) path(name string, fd uint32, path string, rest ...wasmvm.ValueStackEntry) wasmvm.WASIErrno {
+	copy(w.mem, path)
+	return w.call(name, append([]wasmvm.ValueStackEntry{i32(fd), i32(0), i32(uint32(len(path)))}, rest...)...)
+}
+
+// path_open, returning the new descriptor
+func (w *wasiFSTest) open(path string, oflags uint32, rights uint64) (uint32, wasmvm.WASIErrno) {
+	copy(w.mem, path)
+	errno := w.call("path_open", i32(3), i32(1), i32(0), i32(uint32(len(path))), i32(oflags),
+		i64(rights), i64(rights), i32(0), i32(256))
+	return w.u32(256), errno
+}
+
+func (w *wasiFSTest) u32(addr int) uint32 {
+	return binary.LittleEndian.Uint32(w.mem[addr:])
+}
+
+// Reads up to 64 octets from fd through one iovec
+func (w *wasiFSTest) read(fd uint32) string {
+	binary.LittleEndian.PutUint32(w.mem[260:], 300)
+	binary.LittleEndian.PutUint32(w.mem[264:], 64)
+	require.Equal(w.t, wasmvm.ErrnoSuccess, w.call("fd_read", i32(fd), i32(260), i32(1), i32(268)))
+	return string(w.mem[300 : 300+w.u32(268)])
+}
+
+func (w *wasiFSTest) write(fd uint32, data string) wasmvm.WASIErrno {
+	copy(w.mem[300:], data)
+	binary.LittleEndian.PutUint32(w.mem[260:], 300)
+	binary.LittleEndian.PutUint32(w.mem[264:], uint32(len(data)))
+	return w.call("fd_write", i32(fd), i32(260), i32(1), i32(268))
+}
+
+func TestWASI_Filesystem(t *testing.T) {
+	mfs := wasmvm.NewMemFS()
+	require.NoError(t, mfs.Mkdir("dir", 0o755))
+	require.NoError(t, mfs.WriteFile("dir/a.txt", []byte("hello"), 0o644))
+	w := newWASIFSTest(t, new(wasmvm.WASIConfig).AddPreopen("/sandbox", mfs))
+
+	// The preopen is the first descriptor after stdio
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_prestat_get", i32(3), i32(256)))
+	assert.Equal(t, []uint32{0, 8}, []uint32{w.u32(256), w.u32(260)})
+	assert.Equal(t, wasmvm.ErrnoNametoolong, w.call("fd_prestat_dir_name", i32(3), i32(256), i32(4)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_prestat_dir_name", i32(3), i32(256), i32(8)))
+	assert.Equal(t, "/sandbox", string(w.mem[256:264]))
+	assert.Equal(t, wasmvm.ErrnoBadf, w.call("fd_prestat_get", i32(4), i32(256)))
+
+	fd, errno := w.open("dir/a.txt", 0, rightRead)
+	require.Equal(t, wasmvm.ErrnoSuccess, errno)
+	assert.Equal(t, uint32(4), fd)
+	assert.Equal(t, "hello", w.read(fd))
+	assert.Equal(t, wasmvm.ErrnoBadf, w.write(fd, "x"))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_seek", i32(fd), i64(1), i32(0), i32(256)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_tell", i32(fd), i32(256)))
+	assert.Equal(t, uint32(1), w.u32(256))
+	assert.Equal(t, "ello", w.read(fd))
+	binary.LittleEndian.PutUint32(w.mem[260:], 300)
+	binary.LittleEndian.PutUint32(w.mem[264:], 64)
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_pread", i32(fd), i32(260), i32(1), i64(3), i32(268)))
+	assert.Equal(t, "lo", string(w.mem[300:302]))
+	assert.Equal(t, uint32(2), w.u32(268))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_filestat_get", i32(fd), i32(256)))
+	assert.Equal(t, byte(4), w.mem[256+16])
+	assert.Equal(t, uint32(5), w.u32(256+32))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_close", i32(fd)))
+
+	// Nothing outside the preopen is reachable
+	for _, path := range []string{"../x", "dir/../../x", "/etc/passwd"} {
+		_, errno = w.open(path, 0, rightRead)
+		assert.Equal(t, wasmvm.ErrnoNotcapable, errno, path)
+	}
+	_, errno = w.open("missing", 0, rightRead)
+	assert.Equal(t, wasmvm.ErrnoNoent, errno)
+	_, errno = w.open("dir/a.txt", 2, rightRead)
+	assert.Equal(t, wasmvm.ErrnoNotdir, errno)
+
+	// Created files land in the MemFS
+	fd, errno = w.open("new.txt", 1|4, rightRead|rightWrite)
+	require.Equal(t, wasmvm.ErrnoSuccess, errno)
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.write(fd, "abcdef"))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_filestat_set_size", i32(fd), i64(3)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_sync", i32(fd)))
+	data, err := fs.ReadFile(mfs, "new.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(data))
+	_, errno = w.open("new.txt", 1|4, rightWrite)
+	assert.Equal(t, wasmvm.ErrnoExist, errno)
+
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.path("path_create_directory", 3, "sub"))
+	assert.Equal(t, wasmvm.ErrnoExist, w.path("path_create_directory", 3, "sub"))
+	copy(w.mem, "sub")
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("path_filestat_get", i32(3), i32(1), i32(0), i32(3), i32(256)))
+	assert.Equal(t, byte(3), w.mem[256+16])
+	copy(w.mem, "nop")
+	assert.Equal(t, wasmvm.ErrnoNoent, w.call("path_filestat_get", i32(3), i32(1), i32(0), i32(3), i32(256)))
+
+	// Directories open as descriptors that list their entries
+	dirfd, errno := w.open("dir", 0, rightRead)
+	require.Equal(t, wasmvm.ErrnoSuccess, errno)
+	assert.Equal(t, wasmvm.ErrnoIsdir, w.call("fd_seek", i32(dirfd), i64(0), i32(0), i32(256)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_readdir", i32(dirfd), i32(300), i32(128), i64(0), i32(256)))
+	assert.Equal(t, uint32(29), w.u32(256))
+	assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(w.mem[300:]))
+	assert.Equal(t, uint32(5), w.u32(300+16))
+	assert.Equal(t, byte(4), w.mem[300+20])
+	assert.Equal(t, "a.txt", string(w.mem[324:329]))
+	_, errno = w.open("dir", 0, rightWrite)
+	assert.Equal(t, wasmvm.ErrnoIsdir, errno)
+
+	// A full buffer means there is more, the cookie picks up after it
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_readdir", i32(3), i32(300), i32(30), i64(0), i32(256)))
+	assert.Equal(t, uint32(30), w.u32(256))
+	assert.Equal(t, "dir", string(w.mem[324:327]))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_readdir", i32(3), i32(300), i32(128), i64(2), i32(256)))
+	assert.Equal(t, uint32(24+3), w.u32(256))
+	assert.Equal(t, "sub", string(w.mem[324:327]))
+
+	copy(w.mem[32:], "sub/moved.txt")
+	copy(w.mem, "new.txt")
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("path_rename", i32(3), i32(0), i32(7), i32(3), i32(32), i32(13)))
+	data, err = fs.ReadFile(mfs, "sub/moved.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(data))
+
+	assert.Equal(t, wasmvm.ErrnoIsdir, w.path("path_unlink_file", 3, "sub"))
+	assert.Equal(t, wasmvm.ErrnoNotempty, w.path("path_remove_directory", 3, "sub"))
+	assert.Equal(t, wasmvm.ErrnoNotdir, w.path("path_remove_directory", 3, "sub/moved.txt"))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.path("path_unlink_file", 3, "sub/moved.txt"))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.path("path_remove_directory", 3, "sub"))
+	_, err = mfs.Stat("sub")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestWASI_ReadOnlyFS(t *testing.T) {
+	ro := wasmvm.NewReadOnlyFS(fstest.MapFS{"etc/motd": {Data: []byte("welcome")}})
+	w := newWASIFSTest(t, new(wasmvm.WASIConfig).AddPreopen("/", ro))
+
+	fd, errno := w.open("etc/motd", 0, rightRead)
+	require.Equal(t, wasmvm.ErrnoSuccess, errno)
+	assert.Equal(t, "welcome", w.read(fd))
+	_, errno = w.open("etc/motd", 0, rightWrite)
+	assert.Equal(t, wasmvm.ErrnoRofs, errno)
+	_, errno = w.open("etc/new", 1, rightRead)
+	assert.Equal(t, wasmvm.ErrnoRofs, errno)
+	assert.Equal(t, wasmvm.ErrnoRofs, w.path("path_create_directory", 3, "tmp"))
+	assert.Equal(t, wasmvm.ErrnoRofs, w.path("path_unlink_file", 3, "etc/motd"))
+}
+
+func TestWASI_DirFS(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	require.NoError(t, os.Mkdir(root, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "in.txt"), []byte("inside"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "secret"), []byte("outside"), 0o644))
+	symlinks := os.Symlink(filepath.Join(base, "secret"), filepath.Join(root, "escape")) == nil &&
+		os.Symlink(base, filepath.Join(root, "up")) == nil
+
+	dfs, err := wasmvm.NewDirFS(root)
+	require.NoError(t, err)
+	defer dfs.Close()
+	w := newWASIFSTest(t, new(wasmvm.WASIConfig).AddPreopen("/", dfs))
+
+	fd, errno := w.open("in.txt", 0, rightRead)
+	require.Equal(t, wasmvm.ErrnoSuccess, errno)
+	assert.Equal(t, "inside", w.read(fd))
+	if symlinks {
+		_, errno = w.open("escape", 0, rightRead)
+		assert.Equal(t, wasmvm.ErrnoNotcapable, errno)
+		_, errno = w.open("up/secret", 0, rightRead)
+		assert.Equal(t, wasmvm.ErrnoNotcapable, errno)
+		assert.Equal(t, wasmvm.ErrnoNotcapable, w.path("path_create_directory", 3, "up/made"))
+		assert.NoDirExists(t, filepath.Join(base, "made"))
+	}
+	_, err = dfs.OpenFile("../secret", os.O_RDONLY, 0)
+	assert.ErrorIs(t, err, wasmvm.ErrPathEscapes)
+
+	fd, errno = w.open("out.txt", 1, rightWrite)
+	require.Equal(t, wasmvm.ErrnoSuccess, errno)
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.write(fd, "written"))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_close", i32(fd)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.path("path_create_directory", 3, "d"))
+	copy(w.mem[32:], "d/out.txt")
+	copy(w.mem, "out.txt")
+	errno = w.call("path_rename", i32(3), i32(0), i32(7), i32(3), i32(32), i32(9))
+	if runtime.GOOS != "linux" {
+		// Only renamed where it can be done relative to the root
+		assert.Equal(t, wasmvm.ErrnoNotsup, errno)
+		return
+	}
+	assert.Equal(t, wasmvm.ErrnoSuccess, errno)
+	data, err := os.ReadFile(filepath.Join(root, "d", "out.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "written", string(data))
+	if symlinks {
+		assert.Error(t, dfs.Rename("in.txt", "escape/x"))
+		assert.ErrorIs(t, dfs.Rename("in.txt", "up/moved"), wasmvm.ErrPathEscapes)
+		assert.ErrorIs(t, dfs.Rename("up/secret", "moved"), wasmvm.ErrPathEscapes)
+		assert.FileExists(t, filepath.Join(root, "in.txt"))
+		assert.FileExists(t, filepath.Join(base, "secret"))
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	mfs := wasmvm.NewMemFS()
+	require.NoError(t, mfs.Mkdir("a", 0o755))
+	require.NoError(t, mfs.Mkdir("a/b", 0o755))
+	require.NoError(t, mfs.WriteFile("a/b/c.txt", []byte("c"), 0o644))
+	require.NoError(t, mfs.WriteFile("top.txt", []byte("top"), 0o644))
+	require.NoError(t, fstest.TestFS(mfs, "a/b/c.txt", "top.txt"))
+
+	assert.ErrorIs(t, mfs.Mkdir("x/y", 0o755), fs.ErrNotExist)
+	assert.Error(t, mfs.Rename("a", "a/b/a"))
+	assert.Error(t, mfs.Rename("top.txt", "a"))
+	require.NoError(t, mfs.Rename("a/b/c.txt", "top.txt"))
+	data, err := fs.ReadFile(mfs, "top.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "c", string(data))
+
+	f, err := mfs.OpenFile("top.txt", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("++"))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("C"), 0)
+	require.NoError(t, err)
+	_, err = f.Read(make([]byte, 1))
+	assert.Error(t, err)
+	require.NoError(t, f.Close())
+	assert.ErrorIs(t, f.Close(), fs.ErrClosed)
+	data, err = fs.ReadFile(mfs, "top.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "C++", string(data))
+}
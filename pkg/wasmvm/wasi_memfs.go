@@ -0,0 +1,433 @@
+package wasmvm
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A writable WASIFS held in memory, for tests and throwaway sandboxes.
+// It is also an fs.FS, so the host can read back what the guest wrote
+// with fs.ReadFile and friends. Safe for concurrent use.
+type MemFS struct {
+	mu   sync.Mutex
+	root *memNode
+}
+
+type memNode struct {
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte
+	children map[string]*memNode // Directories only
+}
+
+func newMemDir(name string, perm fs.FileMode) *memNode {
+	return &memNode{name: name, mode: fs.ModeDir | perm.Perm(), modTime: time.Now(), children: map[string]*memNode{}}
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{root: newMemDir(".", 0o755)}
+}
+
+func memErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// The node at name. Callers hold mu.
+func (m *MemFS) lookup(op, name string) (*memNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, memErr(op, name, fs.ErrInvalid)
+	}
+	node := m.root
+	if name == "." {
+		return node, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !node.mode.IsDir() {
+			return nil, memErr(op, name, syscall.ENOTDIR)
+		}
+		child, ok := node.children[elem]
+		if !ok {
+			return nil, memErr(op, name, fs.ErrNotExist)
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// The directory holding name and the last element of name. Callers
+// hold mu.
+func (m *MemFS) parent(op, name string) (*memNode, string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, "", memErr(op, name, fs.ErrInvalid)
+	}
+	dir, err := m.lookup(op, path.Dir(name))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.mode.IsDir() {
+		return nil, "", memErr(op, name, syscall.ENOTDIR)
+	}
+	return dir, path.Base(name), nil
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (WASIFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	node, err := m.lookup("open", name)
+	switch {
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memErr("open", name, fs.ErrExist)
+	case err == nil:
+	case flag&os.O_CREATE != 0:
+		dir, base, err := m.parent("open", name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := dir.children[base]; ok {
+			return nil, memErr("open", name, fs.ErrExist)
+		}
+		node = &memNode{name: base, mode: perm.Perm(), modTime: time.Now()}
+		dir.children[base] = node
+		dir.modTime = node.modTime
+	default:
+		return nil, err
+	}
+	if node.mode.IsDir() && (writable || flag&os.O_TRUNC != 0) {
+		return nil, memErr("open", name, syscall.EISDIR)
+	}
+	if flag&os.O_TRUNC != 0 && writable {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{fs: m, node: node, name: name, flag: flag}, nil
+}
+
+// Opens name read-only, for fs.FS
+func (m *MemFS) Open(name string) (fs.File, error) {
+	f, err := m.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Creates or replaces the file at name, to seed the filesystem
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+// There are no links, so this is Stat
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	return m.Stat(name)
+}
+
+func (m *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, base, err := m.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.children[base]; ok {
+		return memErr("mkdir", name, fs.ErrExist)
+	}
+	dir.children[base] = newMemDir(base, perm)
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, base, err := m.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	node, ok := dir.children[base]
+	switch {
+	case !ok:
+		return memErr("remove", name, fs.ErrNotExist)
+	case len(node.children) > 0:
+		return memErr("remove", name, syscall.ENOTEMPTY)
+	}
+	delete(dir.children, base)
+	dir.modTime = time.Now()
+	return nil
+}
+
+// Replaces newname if it exists, as long as both are files or newname
+// is an empty directory
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, oldBase, err := m.parent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	node, ok := from.children[oldBase]
+	if !ok {
+		return memErr("rename", oldname, fs.ErrNotExist)
+	}
+	to, newBase, err := m.parent("rename", newname)
+	if err != nil {
+		return err
+	}
+	if node.mode.IsDir() && (newname == oldname || strings.HasPrefix(newname, oldname+"/")) {
+		if newname == oldname {
+			return nil
+		}
+		return memErr("rename", newname, fs.ErrInvalid)
+	}
+	if old, ok := to.children[newBase]; ok && old != node {
+		switch {
+		case old.mode.IsDir() && !node.mode.IsDir():
+			return memErr("rename", newname, syscall.EISDIR)
+		case !old.mode.IsDir() && node.mode.IsDir():
+			return memErr("rename", newname, syscall.ENOTDIR)
+		case len(old.children) > 0:
+			return memErr("rename", newname, syscall.ENOTEMPTY)
+		}
+	}
+	delete(from.children, oldBase)
+	node.name = newBase
+	to.children[newBase] = node
+	from.modTime = time.Now()
+	to.modTime = from.modTime
+	return nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, memErr("readdir", name, syscall.ENOTDIR)
+	}
+	return node.entries(), nil
+}
+
+// Callers hold mu
+func (n *memNode) info() fs.FileInfo {
+	return memInfo{name: n.name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+func (n *memNode) entries() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for _, child := range n.children {
+		entries = append(entries, fs.FileInfoToDirEntry(child.info()))
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+// An open file of a MemFS. Writes show through every other open file
+// of the same node.
+type memFile struct {
+	fs     *MemFS
+	node   *memNode
+	name   string
+	flag   int
+	pos    int64
+	closed bool
+	dirPos int // For ReadDir
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return memErr(op, f.name, fs.ErrClosed)
+	case f.node.mode.IsDir():
+		return memErr(op, f.name, syscall.EISDIR)
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0, !write && f.flag&os.O_WRONLY != 0:
+		return memErr(op, f.name, syscall.EBADF)
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, err := f.readAt("read", p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.readAt("read", p, off)
+}
+
+func (f *memFile) readAt(op string, p []byte, off int64) (int, error) {
+	if err := f.check(op, false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, memErr(op, f.name, fs.ErrInvalid)
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.node.data))
+	}
+	n, err := f.writeAt("write", p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.writeAt("write", p, off)
+}
+
+func (f *memFile) writeAt(op string, p []byte, off int64) (int, error) {
+	if err := f.check(op, true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, memErr(op, f.name, fs.ErrInvalid)
+	}
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, memErr("seek", f.name, fs.ErrClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	case io.SeekStart:
+	default:
+		return 0, memErr("seek", f.name, fs.ErrInvalid)
+	}
+	if offset < 0 {
+		return 0, memErr("seek", f.name, fs.ErrInvalid)
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return memErr("truncate", f.name, fs.ErrInvalid)
+	}
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return nil, memErr("stat", f.name, fs.ErrClosed)
+	}
+	return f.node.info(), nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return memErr("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+// For fs.ReadDirFile
+func (f *memFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return nil, memErr("readdir", f.name, fs.ErrClosed)
+	}
+	if !f.node.mode.IsDir() {
+		return nil, memErr("readdir", f.name, syscall.ENOTDIR)
+	}
+	entries := f.node.entries()[min(f.dirPos, len(f.node.children)):]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		entries = entries[:min(n, len(entries))]
+	}
+	f.dirPos += len(entries)
+	return entries, nil
+}
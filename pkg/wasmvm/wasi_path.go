@@ -0,0 +1,208 @@
+package wasmvm
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// The path_* functions. Guest paths are relative to a directory
+// descriptor and are resolved lexically against it, so ".." can't climb
+// above the preopen it came from. Following symlinks is up to the
+// WASIFS, which for DirFS stays inside the directory too.
+
+// oflags of path_open
+const (
+	wasiOflagCreat     uint32 = 1
+	wasiOflagDirectory uint32 = 2
+	wasiOflagExcl      uint32 = 4
+	wasiOflagTrunc     uint32 = 8
+)
+
+// Rights that decide how path_open opens a file
+const (
+	wasiRightFdRead  uint64 = 1 << 1
+	wasiRightFdWrite uint64 = 1 << 6
+)
+
+// lookupflags
+const wasiLookupSymlinkFollow uint32 = 1
+
+// The directory descriptor dirfd and the name the guest path resolves
+// to within its filesystem
+func (w *wasi) resolve(vm *VMState, dirfd, pathPtr, pathLen uint32) (*wasiFD, string, WASIErrno) {
+	dir, ok := w.fd(dirfd)
+	if !ok {
+		return nil, "", ErrnoBadf
+	}
+	if dir.kind != wasiFDDir {
+		return nil, "", ErrnoNotdir
+	}
+	raw, ok := wasiRead(vm, pathPtr, pathLen)
+	if !ok {
+		return nil, "", ErrnoFault
+	}
+	p := string(raw)
+	switch {
+	case p == "":
+		return nil, "", ErrnoNoent
+	case strings.ContainsRune(p, 0):
+		return nil, "", ErrnoInval
+	case strings.HasPrefix(p, "/"):
+		return nil, "", ErrnoNotcapable
+	}
+	name := path.Join(dir.path, p)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return nil, "", ErrnoNotcapable
+	}
+	return dir, name, ErrnoSuccess
+}
+
+// path_open has more parameters than the HostFunc adapters take
+func (w *wasi) pathOpenFunc() *ExposedFunc {
+	ft := FuncType{
+		Params:  []ValueStackEntryType{TYPE_I32, TYPE_I32, TYPE_I32, TYPE_I32, TYPE_I32, TYPE_I64, TYPE_I64, TYPE_I32, TYPE_I32},
+		Results: []ValueStackEntryType{TYPE_I32},
+	}
+	return NewExposedFunc(ft, func(_ context.Context, vm *VMState, args []ValueStackEntry) ([]ValueStackEntry, error) {
+		errno := w.pathOpen(vm, args[0].Value_I32, args[2].Value_I32, args[3].Value_I32, args[4].Value_I32,
+			args[5].Value_I64, uint16(args[7].Value_I32), args[8].Value_I32)
+		return []ValueStackEntry{i32Entry(uint32(errno))}, nil
+	})
+}
+
+// Opens a file or directory below dirfd. Files are opened for reading
+// and/or writing according to the fd_read and fd_write rights asked for.
+// Symlinks are always followed.
+func (w *wasi) pathOpen(vm *VMState, dirfd, pathPtr, pathLen, oflags uint32, rights uint64, fdflags uint16, fdPtr uint32) WASIErrno {
+	dir, name, errno := w.resolve(vm, dirfd, pathPtr, pathLen)
+	if errno != ErrnoSuccess {
+		return errno
+	}
+	write := rights&wasiRightFdWrite != 0
+	fi, err := dir.fs.Stat(name)
+	switch {
+	case err == nil && oflags&wasiOflagCreat != 0 && oflags&wasiOflagExcl != 0:
+		return ErrnoExist
+	case err == nil && fi.IsDir():
+		if write || oflags&wasiOflagTrunc != 0 {
+			return ErrnoIsdir
+		}
+		return w.opened(vm, fdPtr, &wasiFD{kind: wasiFDDir, fs: dir.fs, path: name})
+	case err == nil && oflags&wasiOflagDirectory != 0:
+		return ErrnoNotdir
+	case err != nil && (oflags&wasiOflagCreat == 0 || !errors.Is(err, fs.ErrNotExist)):
+		return wasiErrno(err)
+	}
+
+	flag := os.O_RDONLY
+	switch {
+	case write && rights&wasiRightFdRead != 0:
+		flag = os.O_RDWR
+	case write:
+		flag = os.O_WRONLY
+	}
+	if oflags&wasiOflagCreat != 0 {
+		flag |= os.O_CREATE
+	}
+	if oflags&wasiOflagExcl != 0 {
+		flag |= os.O_EXCL
+	}
+	if oflags&wasiOflagTrunc != 0 {
+		flag |= os.O_TRUNC
+	}
+	appending := fdflags&wasiFdflagAppend != 0
+	if appending {
+		flag |= os.O_APPEND
+	}
+	file, err := dir.fs.OpenFile(name, flag, 0o644)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	return w.opened(vm, fdPtr, &wasiFD{kind: wasiFDFile, fs: dir.fs, path: name, file: file, append: appending})
+}
+
+// Hands f to the guest, or closes it again when fdPtr is bad
+func (w *wasi) opened(vm *VMState, fdPtr uint32, f *wasiFD) WASIErrno {
+	fd := w.add(f)
+	if !wasiWriteU32(vm, fdPtr, fd) {
+		w.fdClose(context.Background(), vm, fd)
+		return ErrnoFault
+	}
+	return ErrnoSuccess
+}
+
+func (w *wasi) pathFilestatGet(_ context.Context, vm *VMState, dirfd, flags, pathPtr, pathLen, statPtr uint32) (WASIErrno, error) {
+	dir, name, errno := w.resolve(vm, dirfd, pathPtr, pathLen)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	stat := dir.fs.Lstat
+	if flags&wasiLookupSymlinkFollow != 0 {
+		stat = dir.fs.Stat
+	}
+	fi, err := stat(name)
+	if err != nil {
+		return wasiErrno(err), nil
+	}
+	return wasiFilestat(vm, statPtr, fi), nil
+}
+
+func (w *wasi) pathCreateDirectory(_ context.Context, vm *VMState, dirfd, pathPtr, pathLen uint32) (WASIErrno, error) {
+	dir, name, errno := w.resolve(vm, dirfd, pathPtr, pathLen)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	return wasiErrno(dir.fs.Mkdir(name, 0o755)), nil
+}
+
+// Removes name if it is a directory exactly when dir says so
+func (w *wasi) remove(vm *VMState, dirfd, pathPtr, pathLen uint32, dir bool) WASIErrno {
+	d, name, errno := w.resolve(vm, dirfd, pathPtr, pathLen)
+	if errno != ErrnoSuccess {
+		return errno
+	}
+	if name == d.path {
+		return ErrnoBusy
+	}
+	fi, err := d.fs.Lstat(name)
+	switch {
+	case err != nil:
+		return wasiErrno(err)
+	case fi.IsDir() && !dir:
+		return ErrnoIsdir
+	case !fi.IsDir() && dir:
+		return ErrnoNotdir
+	}
+	return wasiErrno(d.fs.Remove(name))
+}
+
+func (w *wasi) pathUnlinkFile(_ context.Context, vm *VMState, dirfd, pathPtr, pathLen uint32) (WASIErrno, error) {
+	return w.remove(vm, dirfd, pathPtr, pathLen, false), nil
+}
+
+func (w *wasi) pathRemoveDirectory(_ context.Context, vm *VMState, dirfd, pathPtr, pathLen uint32) (WASIErrno, error) {
+	return w.remove(vm, dirfd, pathPtr, pathLen, true), nil
+}
+
+// Both paths have to be on the same filesystem
+func (w *wasi) pathRename(_ context.Context, vm *VMState, oldfd, oldPtr, oldLen, newfd, newPtr, newLen uint32) (WASIErrno, error) {
+	from, oldname, errno := w.resolve(vm, oldfd, oldPtr, oldLen)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	to, newname, errno := w.resolve(vm, newfd, newPtr, newLen)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	if from.fs != to.fs {
+		return ErrnoXdev, nil
+	}
+	if oldname == "." || newname == "." {
+		return ErrnoBusy, nil
+	}
+	return wasiErrno(from.fs.Rename(oldname, newname)), nil
+}
@@ -0,0 +1,182 @@
+package wasmvm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Sockets of the WASI module. The guest can't open any, it accepts
+// connections on the listeners the host put in the WASIConfig. The
+// calls block, until the context of the call is done where the listener
+// or connection supports deadlines.
+
+// siflags and riflags
+const (
+	wasiRecvPeek    uint32 = 1
+	wasiRecvWaitall uint32 = 2
+)
+
+// sdflags of sock_shutdown
+const (
+	wasiShutRd uint32 = 1
+	wasiShutWr uint32 = 2
+)
+
+// The socket behind fd, which has to be a connection unless listener
+func (w *wasi) socket(fd uint32, listener bool) (*wasiFD, WASIErrno) {
+	f, ok := w.fd(fd)
+	switch {
+	case !ok:
+		return nil, ErrnoBadf
+	case f.kind == wasiFDListener && listener, f.kind == wasiFDSocket && !listener:
+		return f, ErrnoSuccess
+	case f.kind == wasiFDListener:
+		return nil, ErrnoNotconn
+	}
+	return nil, ErrnoNotsock
+}
+
+type deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+// Wakes whatever blocks on d once ctx is done. The returned func undoes
+// that and reports the context error if it got there first.
+func wasiInterruptible(ctx context.Context, d any) func() error {
+	dl, ok := d.(deadliner)
+	if !ok {
+		return func() error { return nil }
+	}
+	stop := context.AfterFunc(ctx, func() { dl.SetDeadline(time.Now()) })
+	return func() error {
+		if !stop() {
+			dl.SetDeadline(time.Time{})
+			return ctx.Err()
+		}
+		return nil
+	}
+}
+
+// fdflags are ignored, the connection blocks like the rest
+func (w *wasi) sockAccept(ctx context.Context, vm *VMState, fd, _, fdPtr uint32) (WASIErrno, error) {
+	f, errno := w.socket(fd, true)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	done := wasiInterruptible(ctx, f.listener)
+	conn, err := f.listener.Accept()
+	if cerr := done(); cerr != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return 0, cerr
+	}
+	if err != nil {
+		return wasiErrno(err), nil
+	}
+	return w.opened(vm, fdPtr, &wasiFD{kind: wasiFDSocket, conn: conn}), nil
+}
+
+// No flags come back, a stream never truncates
+func (w *wasi) sockRecv(ctx context.Context, vm *VMState, fd, iovs, iovsLen, flags, nreadPtr, roflagsPtr uint32) (WASIErrno, error) {
+	f, errno := w.socket(fd, false)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	if flags&wasiRecvPeek != 0 {
+		return ErrnoNotsup, nil
+	}
+	var in io.Reader = f.conn
+	if flags&wasiRecvWaitall != 0 {
+		in = waitallReader{f.conn}
+	}
+	done := wasiInterruptible(ctx, f.conn)
+	errno = wasiReadIovecs(vm, in, iovs, iovsLen, nreadPtr)
+	if err := done(); err != nil {
+		return 0, err
+	}
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	return errnoIf(wasiWrite(vm, roflagsPtr, []byte{0, 0}), ErrnoFault), nil
+}
+
+// Fills every buffer unless the stream ends
+type waitallReader struct {
+	r io.Reader
+}
+
+func (w waitallReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(w.r, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (w *wasi) sockSend(ctx context.Context, vm *VMState, fd, iovs, iovsLen, _, nwrittenPtr uint32) (WASIErrno, error) {
+	f, errno := w.socket(fd, false)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	done := wasiInterruptible(ctx, f.conn)
+	errno = wasiWriteIovecs(vm, f.conn, iovs, iovsLen, nwrittenPtr)
+	if err := done(); err != nil {
+		return 0, err
+	}
+	return errno, nil
+}
+
+// Half closes need a connection that has CloseRead and CloseWrite, as
+// TCP and Unix connections do. Shutting both down works on any.
+func (w *wasi) sockShutdown(_ context.Context, _ *VMState, fd, how uint32) (WASIErrno, error) {
+	f, errno := w.socket(fd, false)
+	if errno != ErrnoSuccess {
+		return errno, nil
+	}
+	type halfCloser interface {
+		CloseRead() error
+		CloseWrite() error
+	}
+	hc, half := f.conn.(halfCloser)
+	switch {
+	case how == 0 || how&^(wasiShutRd|wasiShutWr) != 0:
+		return ErrnoInval, nil
+	case how == wasiShutRd|wasiShutWr && !half:
+		return wasiErrno(f.conn.Close()), nil
+	case !half:
+		return ErrnoNotsup, nil
+	}
+	if how&wasiShutRd != 0 {
+		if err := hc.CloseRead(); err != nil {
+			return wasiErrno(err), nil
+		}
+	}
+	if how&wasiShutWr != 0 {
+		return wasiErrno(hc.CloseWrite()), nil
+	}
+	return ErrnoSuccess, nil
+}
+
+// Errors of connections, which are reported as the syscall errors when
+// they come from the host network stack
+func wasiNetErrno(err error) (WASIErrno, bool) {
+	switch {
+	case errors.Is(err, net.ErrClosed):
+		return ErrnoBadf, true
+	case errors.Is(err, io.ErrClosedPipe), errors.Is(err, syscall.EPIPE):
+		return ErrnoPipe, true
+	case errors.Is(err, syscall.ECONNRESET):
+		return ErrnoConnreset, true
+	case errors.Is(err, syscall.ENOTCONN):
+		return ErrnoNotconn, true
+	case errors.Is(err, syscall.EAGAIN), errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrnoAgain, true
+	}
+	return 0, false
+}
@@ -0,0 +1,160 @@
+package wasmvm_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Hands out the server ends of net.Pipe connections
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (p *pipeListener) Accept() (net.Conn, error) {
+	conn, ok := <-p.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (p *pipeListener) Close() error {
+	close(p.conns)
+	return nil
+}
+
+func (p *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "unix"}
+}
+
+// The client end of a new connection
+func (p *pipeListener) dial() net.Conn {
+	server, client := net.Pipe()
+	p.conns <- server
+	return client
+}
+
+// sock_recv into one iovec of n octets at 300
+func (w *wasiFSTest) recv(fd, n, flags uint32) (string, wasmvm.WASIErrno) {
+	binary.LittleEndian.PutUint32(w.mem[260:], 300)
+	binary.LittleEndian.PutUint32(w.mem[264:], n)
+	binary.LittleEndian.PutUint32(w.mem[268:], 0)
+	errno := w.call("sock_recv", i32(fd), i32(260), i32(1), i32(flags), i32(268), i32(272))
+	return string(w.mem[300 : 300+w.u32(268)]), errno
+}
+
+func (w *wasiFSTest) send(fd uint32, data string) wasmvm.WASIErrno {
+	copy(w.mem[300:], data)
+	binary.LittleEndian.PutUint32(w.mem[260:], 300)
+	binary.LittleEndian.PutUint32(w.mem[264:], uint32(len(data)))
+	return w.call("sock_send", i32(fd), i32(260), i32(1), i32(0), i32(268))
+}
+
+func TestWASI_SocketsPipe(t *testing.T) {
+	ln := &pipeListener{conns: make(chan net.Conn, 1)}
+	w := newWASIFSTest(t, new(wasmvm.WASIConfig).AddListener(ln))
+
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_fdstat_get", i32(3), i32(256)))
+	assert.Equal(t, byte(6), w.mem[256])
+	_, errno := w.recv(3, 4, 0)
+	assert.Equal(t, wasmvm.ErrnoNotconn, errno)
+	_, errno = w.recv(0, 4, 0)
+	assert.Equal(t, wasmvm.ErrnoNotsock, errno)
+
+	client := ln.dial()
+	defer client.Close()
+	require.Equal(t, wasmvm.ErrnoSuccess, w.call("sock_accept", i32(3), i32(0), i32(256)))
+	fd := w.u32(256)
+	assert.Equal(t, uint32(4), fd)
+
+	// Pipes hand writes over in pieces, waitall gathers them
+	go func() {
+		client.Write([]byte("pi"))
+		client.Write([]byte("ng"))
+	}()
+	data, errno := w.recv(fd, 4, 2)
+	assert.Equal(t, wasmvm.ErrnoSuccess, errno)
+	assert.Equal(t, "ping", data)
+	_, errno = w.recv(fd, 4, 1)
+	assert.Equal(t, wasmvm.ErrnoNotsup, errno)
+
+	reply := make(chan string)
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(client, buf)
+		reply <- string(buf)
+	}()
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.send(fd, "pong"))
+	assert.Equal(t, "pong", <-reply)
+
+	// fd_read and fd_write work on sockets too, as Go uses them
+	go client.Write([]byte("abc"))
+	assert.Equal(t, "abc", w.read(fd))
+
+	assert.Equal(t, wasmvm.ErrnoNotsup, w.call("sock_shutdown", i32(fd), i32(2)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("sock_shutdown", i32(fd), i32(3)))
+	assert.Equal(t, wasmvm.ErrnoPipe, w.send(fd, "late"))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_close", i32(fd)))
+
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("fd_close", i32(3)))
+	assert.Equal(t, wasmvm.ErrnoBadf, w.call("sock_accept", i32(3), i32(0), i32(256)))
+}
+
+func TestWASI_SocketsTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	w := newWASIFSTest(t, new(wasmvm.WASIConfig).AddListener(ln))
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	require.Equal(t, wasmvm.ErrnoSuccess, w.call("sock_accept", i32(3), i32(0), i32(256)))
+	fd := w.u32(256)
+
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, client.(*net.TCPConn).CloseWrite())
+	data, errno := w.recv(fd, 16, 2)
+	assert.Equal(t, wasmvm.ErrnoSuccess, errno)
+	assert.Equal(t, "hello", data)
+
+	// Half closing the write side ends the stream for the client
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.send(fd, "bye"))
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("sock_shutdown", i32(fd), i32(2)))
+	rest, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(rest))
+	assert.Equal(t, wasmvm.ErrnoInval, w.call("sock_shutdown", i32(fd), i32(4)))
+}
+
+func TestWASI_SocketsCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	w := newWASIFSTest(t, new(wasmvm.WASIConfig).AddListener(ln))
+
+	// Nobody connects, the accept gives up with the context
+	ext, ok := w.l.Lookup(wasmvm.WASIModuleName, "sock_accept")
+	require.True(t, ok)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for _, v := range []wasmvm.ValueStackEntry{i32(3), i32(0), i32(256)} {
+		w.vm.ValueStack.Push(&v)
+	}
+	assert.ErrorIs(t, ext.Func.Call(ctx, w.vm), context.DeadlineExceeded)
+
+	// The listener still works afterwards
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, wasmvm.ErrnoSuccess, w.call("sock_accept", i32(3), i32(0), i32(256)))
+}
@@ -0,0 +1,165 @@
+package wasmvm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// _start writes "hi\n" to stdout and exits with 7
+var wasiTestModule = wasmBinary(
+	wasmSection(wasmvm.SectionType, wasmVec(
+		wasmFuncType([]byte{wasmI32, wasmI32, wasmI32, wasmI32}, []byte{wasmI32}),
+		wasmFuncType([]byte{wasmI32}, nil),
+		wasmFuncType(nil, nil),
+	)...),
+	wasmSection(wasmvm.SectionImport, wasmVec(
+		wasmCat(wasmName(wasmvm.WASIModuleName), wasmName("fd_write"), []byte{0x00, 0x00}),
+		wasmCat(wasmName(wasmvm.WASIModuleName), wasmName("proc_exit"), []byte{0x00, 0x01}),
+	)...),
+	wasmSection(wasmvm.SectionFunction, wasmVec([]byte{0x02})...),
+	wasmSection(wasmvm.SectionMemory, wasmVec([]byte{0x00, 0x01})...),
+	wasmSection(wasmvm.SectionExport, wasmVec(
+		wasmCat(wasmName("_start"), []byte{0x00, 0x02}),
+		wasmCat(wasmName("memory"), []byte{0x02, 0x00}),
+	)...),
+	wasmSection(wasmvm.SectionCode, wasmVec(
+		wasmBody(
+			wasmvm.OP_CONST_I32, 1, wasmvm.OP_CONST_I32, 16, wasmvm.OP_CONST_I32, 1, wasmvm.OP_CONST_I32, 24,
+			wasmvm.OP_CALL, 0, wasmvm.OP_DROP,
+			wasmvm.OP_CONST_I32, 7, wasmvm.OP_CALL, 1,
+			wasmvm.OP_END),
+	)...),
+	wasmSection(wasmvm.SectionData, wasmVec(
+		wasmCat([]byte{0x00, wasmvm.OP_CONST_I32, 0, wasmvm.OP_END}, wasmName("hi\n")),
+		wasmCat([]byte{0x00, wasmvm.OP_CONST_I32, 16, wasmvm.OP_END, 8}, []byte{0, 0, 0, 0, 3, 0, 0, 0}),
+	)...),
+)
+
+func TestWASI_Run(t *testing.T) {
+	m, err := wasmvm.DecodeModule(wasiTestModule)
+	require.NoError(t, err)
+
+	// Output falls back to the VMConfig
+	var out bytes.Buffer
+	l, err := wasmvm.NewLinker().DefineWASI(nil)
+	require.NoError(t, err)
+	inst, err := wasmvm.Instantiate(m, l, new(wasmvm.VMConfig).SetStdout(&out))
+	require.NoError(t, err)
+
+	err = inst.Run(context.Background())
+	var te *wasmvm.TrapError
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, wasmvm.TrapExit, te.Type)
+	code, ok := wasmvm.ExitCode(err)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(7), code)
+	assert.Equal(t, "hi\n", out.String())
+
+	// The WASIConfig wins over the VMConfig
+	var own bytes.Buffer
+	l, err = wasmvm.NewLinker().DefineWASI(new(wasmvm.WASIConfig).SetStdout(&own))
+	require.NoError(t, err)
+	inst, err = wasmvm.Instantiate(m, l, new(wasmvm.VMConfig).SetStdout(&out))
+	require.NoError(t, err)
+	assert.Error(t, inst.Run(context.Background()))
+	assert.Equal(t, "hi\n", own.String())
+
+	_, ok = wasmvm.ExitCode(assert.AnError)
+	assert.False(t, ok)
+}
+
+// Calls a WASI function directly on vm, returning the errno
+func wasiCall(t *testing.T, l *wasmvm.Linker, vm *wasmvm.VMState, name string, args ...wasmvm.ValueStackEntry) wasmvm.WASIErrno {
+	t.Helper()
+	ext, ok := l.Lookup(wasmvm.WASIModuleName, name)
+	require.True(t, ok, name)
+	for i := range args {
+		vm.ValueStack.Push(&args[i])
+	}
+	require.NoError(t, ext.Func.Call(context.Background(), vm))
+	res, ok := vm.ValueStack.Pop()
+	require.True(t, ok)
+	return wasmvm.WASIErrno(res.Value_I32)
+}
+
+func TestWASI_Functions(t *testing.T) {
+	epoch := time.Unix(1700000000, 5)
+	config := new(wasmvm.WASIConfig).
+		SetArgs("prog", "-v").
+		SetEnv("A=1").
+		SetStdin(strings.NewReader("input")).
+		SetClock(func() time.Time { return epoch }).
+		SetMonotonic(func() time.Duration { return 42 }).
+		SetRand(bytes.NewReader([]byte{9, 8, 7, 6}))
+	l, err := wasmvm.NewLinker().DefineWASI(config)
+	require.NoError(t, err)
+	vm, err := new(wasmvm.VMConfig).SetSize(256).BuildVMState()
+	require.NoError(t, err)
+	mem := vm.Memory.(*wasmvm.FlatMemory).Bytes()
+	u32 := func(addr int) uint32 { return binary.LittleEndian.Uint32(mem[addr:]) }
+
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "args_sizes_get", i32(0), i32(4)))
+	assert.Equal(t, []uint32{2, 8}, []uint32{u32(0), u32(4)})
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "args_get", i32(16), i32(32)))
+	assert.Equal(t, []uint32{32, 37}, []uint32{u32(16), u32(20)})
+	assert.Equal(t, "prog\x00-v\x00", string(mem[32:40]))
+
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "environ_sizes_get", i32(0), i32(4)))
+	assert.Equal(t, []uint32{1, 4}, []uint32{u32(0), u32(4)})
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "environ_get", i32(16), i32(48)))
+	assert.Equal(t, "A=1\x00", string(mem[48:52]))
+
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "clock_time_get", i32(0), i64(1), i32(64)))
+	assert.Equal(t, uint64(epoch.UnixNano()), binary.LittleEndian.Uint64(mem[64:]))
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "clock_time_get", i32(1), i64(1), i32(64)))
+	assert.Equal(t, uint64(42), binary.LittleEndian.Uint64(mem[64:]))
+	assert.Equal(t, wasmvm.ErrnoInval, wasiCall(t, l, vm, "clock_time_get", i32(9), i64(1), i32(64)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "clock_res_get", i32(1), i32(64)))
+	assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(mem[64:]))
+
+	// A bad buffer fails before anything is allocated or drawn
+	assert.Equal(t, wasmvm.ErrnoFault, wasiCall(t, l, vm, "random_get", i32(80), i32(0xFFFFFFFF)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "random_get", i32(80), i32(4)))
+	assert.Equal(t, []byte{9, 8, 7, 6}, mem[80:84])
+	assert.Equal(t, wasmvm.ErrnoIO, wasiCall(t, l, vm, "random_get", i32(80), i32(4)))
+
+	// Two iovecs of 3 octets at 100 and 110; the second read comes up short.
+	// With the second out of bounds nothing is read at all.
+	binary.LittleEndian.PutUint32(mem[90:], 100)
+	binary.LittleEndian.PutUint32(mem[94:], 3)
+	binary.LittleEndian.PutUint32(mem[98:], 110)
+	binary.LittleEndian.PutUint32(mem[102:], 0xFFFFFFFF)
+	assert.Equal(t, wasmvm.ErrnoFault, wasiCall(t, l, vm, "fd_read", i32(0), i32(90), i32(2), i32(120)))
+	assert.Equal(t, wasmvm.ErrnoFault, wasiCall(t, l, vm, "fd_read", i32(0), i32(90), i32(1), i32(0xFFFFFFFF)))
+	binary.LittleEndian.PutUint32(mem[102:], 3)
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "fd_read", i32(0), i32(90), i32(2), i32(120)))
+	assert.Equal(t, uint32(5), u32(120))
+	assert.Equal(t, "inp", string(mem[100:103]))
+	assert.Equal(t, "ut", string(mem[110:112]))
+
+	assert.Equal(t, wasmvm.ErrnoSpipe, wasiCall(t, l, vm, "fd_seek", i32(1), i64(0), i32(0), i32(120)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "fd_fdstat_get", i32(2), i32(128)))
+	assert.Equal(t, byte(2), mem[128])
+	assert.Equal(t, wasmvm.ErrnoBadf, wasiCall(t, l, vm, "fd_prestat_get", i32(3), i32(128)))
+	assert.Equal(t, wasmvm.ErrnoFault, wasiCall(t, l, vm, "fd_write", i32(1), i32(250), i32(2), i32(120)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "fd_close", i32(1)))
+	assert.Equal(t, wasmvm.ErrnoBadf, wasiCall(t, l, vm, "fd_write", i32(1), i32(90), i32(1), i32(120)))
+	assert.Equal(t, wasmvm.ErrnoBadf, wasiCall(t, l, vm, "fd_close", i32(1)))
+	assert.Equal(t, wasmvm.ErrnoSuccess, wasiCall(t, l, vm, "sched_yield"))
+
+	// Unimplemented functions are defined, they just fail
+	assert.Equal(t, wasmvm.ErrnoNosys, wasiCall(t, l, vm, "path_symlink", i32(0), i32(0), i32(3), i32(0), i32(0)))
+	assert.Equal(t, "ENOSYS", wasmvm.ErrnoNosys.String())
+
+	_, err = l.DefineWASI(nil)
+	var le *wasmvm.LinkError
+	assert.ErrorAs(t, err, &le)
+}
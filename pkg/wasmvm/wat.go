@@ -0,0 +1,1758 @@
+package wasmvm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parser for the WebAssembly text format. The text is assembled into a
+// binary and decoded, so ParseWAT gives exactly the Module that
+// DecodeModule would for the equivalent binary. Both the flat and the
+// folded instruction forms are accepted, as are the usual abbreviations
+// such as inline imports, exports, type uses and data.
+
+type WATErrorType byte
+
+const (
+	UndefinedWATError WATErrorType = iota
+	WATSyntax
+	WATUnknownInstruction
+	WATUndefinedName
+	WATDuplicateName
+	WATBadNumber
+	WATTypeMismatch
+)
+
+var watErrorTypeNames = map[WATErrorType]string{
+	UndefinedWATError:     "UndefinedWATError",
+	WATSyntax:             "WATSyntax",
+	WATUnknownInstruction: "WATUnknownInstruction",
+	WATUndefinedName:      "WATUndefinedName",
+	WATDuplicateName:      "WATDuplicateName",
+	WATBadNumber:          "WATBadNumber",
+	WATTypeMismatch:       "WATTypeMismatch",
+}
+
+var watErrorMessageTemplates = map[WATErrorType]string{
+	UndefinedWATError:     "unknown text format error",
+	WATSyntax:             "%s",
+	WATUnknownInstruction: "unknown instruction %s",
+	WATUndefinedName:      "undefined %s %s",
+	WATDuplicateName:      "duplicate %s %s",
+	WATBadNumber:          "bad %s %s",
+	WATTypeMismatch:       "signature %s does not match type %d %s",
+}
+
+func (t WATErrorType) String() string {
+	if name, ok := watErrorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("WATErrorType(%d)", t)
+}
+
+// Reported for text that can't be assembled. Line and Column are where
+// the offending token starts, both counting from 1.
+type WATError struct {
+	Type   WATErrorType
+	Msg    string
+	Line   int
+	Column int
+}
+
+func NewWATError(eType WATErrorType, line, column int, paras ...any) error {
+	msg, ok := watErrorMessageTemplates[eType]
+	if !ok {
+		msg = watErrorMessageTemplates[UndefinedWATError]
+	}
+	if len(paras) > 0 {
+		msg = fmt.Sprintf(msg, paras...)
+	}
+	return &WATError{
+		Type:   eType,
+		Msg:    msg,
+		Line:   line,
+		Column: column,
+	}
+}
+
+func (e *WATError) Error() string {
+	return fmt.Sprintf("[%s] %d:%d: %s", e.Type.String(), e.Line, e.Column, e.Msg)
+}
+
+// Parses a module in the text format
+func ParseWAT(src string) (*Module, error) {
+	bin, err := AssembleWAT(src)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeModule(bin)
+}
+
+// Assembles a module in the text format into a binary. The source may
+// be a (module ...) or just the fields that would go inside one.
+func AssembleWAT(src string) ([]byte, error) {
+	nodes, err := parseWATNodes(src)
+	if err != nil {
+		return nil, err
+	}
+	fields := nodes
+	if len(nodes) == 1 && nodes[0].head() == "module" {
+		c := newWATCursor(nodes[0])
+		c.id()
+		fields = c.rest()
+	}
+	b := newWATBuilder()
+	for _, f := range fields {
+		if err := b.declare(f); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range fields {
+		if err := b.define(f); err != nil {
+			return nil, err
+		}
+	}
+	if b.dataCount {
+		n := uint32(len(b.m.Data))
+		b.m.DataCount = &n
+	}
+	return EncodeModule(b.m)
+}
+
+// An S-expression: either a list or an atom. String atoms hold the
+// decoded octets.
+type watNode struct {
+	list   []*watNode
+	isList bool
+	str    bool
+	text   string
+	line   int
+	col    int
+}
+
+// The keyword a list starts with, if any
+func (n *watNode) head() string {
+	if n == nil || !n.isList || len(n.list) == 0 || n.list[0].isList || n.list[0].str {
+		return ""
+	}
+	return n.list[0].text
+}
+
+func (n *watNode) keyword() bool {
+	return n != nil && !n.isList && !n.str && !strings.HasPrefix(n.text, "$")
+}
+
+func (n *watNode) errorf(eType WATErrorType, paras ...any) error {
+	return NewWATError(eType, n.line, n.col, paras...)
+}
+
+func (n *watNode) describe() string {
+	switch {
+	case n.isList && n.head() != "":
+		return "(" + n.head() + " ...)"
+	case n.isList:
+		return "list"
+	case n.str:
+		return strconv.Quote(n.text)
+	}
+	return n.text
+}
+
+type watScanner struct {
+	src  string
+	pos  int
+	line int
+	col  int
+}
+
+func (s *watScanner) advance(n int) {
+	for _, c := range s.src[s.pos : s.pos+n] {
+		if c == '\n' {
+			s.line++
+			s.col = 1
+		} else {
+			s.col++
+		}
+	}
+	s.pos += n
+}
+
+func (s *watScanner) errorf(format string, paras ...any) error {
+	return NewWATError(WATSyntax, s.line, s.col, fmt.Sprintf(format, paras...))
+}
+
+// Skips whitespace and both kinds of comments, block comments nesting
+func (s *watScanner) skipSpace() error {
+	for s.pos < len(s.src) {
+		rest := s.src[s.pos:]
+		switch {
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n' || rest[0] == '\r':
+			s.advance(1)
+		case strings.HasPrefix(rest, ";;"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			s.advance(end)
+		case strings.HasPrefix(rest, "(;"):
+			line, col := s.line, s.col
+			depth := 0
+			for {
+				rest = s.src[s.pos:]
+				switch {
+				case rest == "":
+					return NewWATError(WATSyntax, line, col, "unterminated block comment")
+				case strings.HasPrefix(rest, "(;"):
+					depth++
+					s.advance(2)
+				case strings.HasPrefix(rest, ";)"):
+					depth--
+					s.advance(2)
+				default:
+					s.advance(1)
+				}
+				if depth == 0 {
+					break
+				}
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isWATIDChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		strings.IndexByte("!#$%&'*+-./:<=>?@\\^_`|~", c) >= 0
+}
+
+func (s *watScanner) readString() (string, error) {
+	var b strings.Builder
+	s.advance(1)
+	for {
+		if s.pos >= len(s.src) {
+			return "", s.errorf("unterminated string")
+		}
+		c := s.src[s.pos]
+		switch {
+		case c == '"':
+			s.advance(1)
+			return b.String(), nil
+		case c < 0x20 || c == 0x7F:
+			return "", s.errorf("control character in string")
+		case c != '\\':
+			b.WriteByte(c)
+			s.advance(1)
+			continue
+		}
+		if s.pos+1 >= len(s.src) {
+			return "", s.errorf("unterminated string")
+		}
+		esc := s.src[s.pos+1]
+		switch esc {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case '"', '\'', '\\':
+			b.WriteByte(esc)
+		case 'u':
+			end := strings.IndexByte(s.src[s.pos:], '}')
+			if !strings.HasPrefix(s.src[s.pos+2:], "{") || end < 0 {
+				return "", s.errorf("bad unicode escape")
+			}
+			r, err := strconv.ParseUint(strings.ReplaceAll(s.src[s.pos+3:s.pos+end], "_", ""), 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", s.errorf("bad unicode escape")
+			}
+			b.WriteRune(rune(r))
+			s.advance(end + 1)
+			continue
+		default:
+			v, err := strconv.ParseUint(s.src[s.pos+1:min(s.pos+3, len(s.src))], 16, 8)
+			if err != nil || s.pos+3 > len(s.src) {
+				return "", s.errorf("bad escape \\%c", esc)
+			}
+			b.WriteByte(byte(v))
+			s.advance(3)
+			continue
+		}
+		s.advance(2)
+	}
+}
+
+// Splits the source into S-expressions, dropping annotations
+func parseWATNodes(src string) ([]*watNode, error) {
+	s := &watScanner{src: src, line: 1, col: 1}
+	root := &watNode{isList: true}
+	stack := []*watNode{root}
+	for {
+		if err := s.skipSpace(); err != nil {
+			return nil, err
+		}
+		if s.pos >= len(s.src) {
+			break
+		}
+		top := stack[len(stack)-1]
+		n := &watNode{line: s.line, col: s.col}
+		switch c := s.src[s.pos]; {
+		case c == '(':
+			s.advance(1)
+			n.isList = true
+			top.list = append(top.list, n)
+			stack = append(stack, n)
+			continue
+		case c == ')':
+			if len(stack) == 1 {
+				return nil, s.errorf("unexpected )")
+			}
+			if len(top.list) == 0 {
+				return nil, NewWATError(WATSyntax, top.line, top.col, "empty list")
+			}
+			s.advance(1)
+			stack = stack[:len(stack)-1]
+			if strings.HasPrefix(top.head(), "@") {
+				parent := stack[len(stack)-1]
+				parent.list = parent.list[:len(parent.list)-1]
+			}
+			continue
+		case c == '"':
+			text, err := s.readString()
+			if err != nil {
+				return nil, err
+			}
+			n.str, n.text = true, text
+		default:
+			end := s.pos
+			for end < len(s.src) && isWATIDChar(s.src[end]) {
+				end++
+			}
+			if end == s.pos {
+				return nil, s.errorf("unexpected character %q", c)
+			}
+			n.text = s.src[s.pos:end]
+			s.advance(end - s.pos)
+		}
+		top.list = append(top.list, n)
+	}
+	if len(stack) > 1 {
+		open := stack[len(stack)-1]
+		return nil, NewWATError(WATSyntax, open.line, open.col, "unclosed (")
+	}
+	return root.list, nil
+}
+
+// Walks the children of a list
+type watCursor struct {
+	parent *watNode
+	nodes  []*watNode
+	pos    int
+}
+
+// Starts after the keyword of the list
+func newWATCursor(n *watNode) *watCursor {
+	if n == nil || len(n.list) == 0 {
+		return &watCursor{parent: n}
+	}
+	return &watCursor{parent: n, nodes: n.list[1:]}
+}
+
+func (c *watCursor) done() bool {
+	return c.pos >= len(c.nodes)
+}
+
+func (c *watCursor) peek() *watNode {
+	if c.done() {
+		return nil
+	}
+	return c.nodes[c.pos]
+}
+
+func (c *watCursor) next() *watNode {
+	n := c.peek()
+	if n != nil {
+		c.pos++
+	}
+	return n
+}
+
+func (c *watCursor) rest() []*watNode {
+	r := c.nodes[c.pos:]
+	c.pos = len(c.nodes)
+	return r
+}
+
+// The node errors are reported at, the end of the list once there's
+// nothing left
+func (c *watCursor) at() *watNode {
+	if n := c.peek(); n != nil {
+		return n
+	}
+	return c.parent
+}
+
+// Consumes an optional identifier
+func (c *watCursor) id() string {
+	if n := c.peek(); n != nil && !n.isList && !n.str && strings.HasPrefix(n.text, "$") {
+		c.pos++
+		return n.text
+	}
+	return ""
+}
+
+// Consumes the next node if it's a list starting with head
+func (c *watCursor) list(head string) *watNode {
+	if n := c.peek(); n.head() == head {
+		c.pos++
+		return n
+	}
+	return nil
+}
+
+// Consumes the next node if it's the keyword word
+func (c *watCursor) keyword(word string) bool {
+	if n := c.peek(); n.keyword() && n.text == word {
+		c.pos++
+		return true
+	}
+	return false
+}
+
+// Consumes the next node, which has to be there
+func (c *watCursor) need(what string) (*watNode, error) {
+	if n := c.next(); n != nil {
+		return n, nil
+	}
+	return nil, c.expected(what, nil)
+}
+
+func (c *watCursor) str() (string, error) {
+	n := c.next()
+	if n == nil || !n.str {
+		return "", c.expected("a string", n)
+	}
+	return n.text, nil
+}
+
+func (c *watCursor) expected(what string, got *watNode) error {
+	if got == nil && c.parent == nil {
+		return NewWATError(WATSyntax, 0, 0, "expected "+what)
+	}
+	if got == nil {
+		return c.parent.errorf(WATSyntax, fmt.Sprintf("expected %s before the end of (%s ...)", what, c.parent.head()))
+	}
+	return got.errorf(WATSyntax, fmt.Sprintf("expected %s, got %s", what, got.describe()))
+}
+
+// Whether the next node could be an index, a number or an identifier
+func (c *watCursor) atIndex() bool {
+	n := c.peek()
+	return n != nil && !n.isList && !n.str && n.text != "" &&
+		(n.text[0] == '$' || n.text[0] >= '0' && n.text[0] <= '9')
+}
+
+func (c *watCursor) end() error {
+	if n := c.peek(); n != nil {
+		return n.errorf(WATSyntax, "unexpected "+n.describe())
+	}
+	return nil
+}
+
+// The index spaces identifiers are bound in
+type watSpace byte
+
+const (
+	watFuncs watSpace = iota
+	watTables
+	watMemories
+	watGlobals
+	watTypes
+	watElems
+	watDatas
+	watSpaces
+)
+
+var watSpaceNames = [watSpaces]string{"function", "table", "memory", "global", "type", "elem segment", "data segment"}
+
+var watFieldSpaces = map[string]watSpace{
+	"func":   watFuncs,
+	"table":  watTables,
+	"memory": watMemories,
+	"global": watGlobals,
+	"elem":   watElems,
+	"data":   watDatas,
+}
+
+var watValueTypes = map[string]ValueStackEntryType{
+	"i32": TYPE_I32,
+	"i64": TYPE_I64,
+	"f32": TYPE_F32,
+	"f64": TYPE_F64,
+}
+
+var watRefTypes = map[string]RefType{
+	"funcref":   RefFunc,
+	"externref": RefExtern,
+}
+
+// Assembles the module in two passes: the first binds every identifier
+// so that fields can refer to ones further down, the second builds the
+// module in field order
+type watBuilder struct {
+	m      *Module
+	names  [watSpaces]map[string]uint32
+	counts [watSpaces]uint32
+	// Indices handed out so far by the second pass
+	next [watSpaces]uint32
+	// Whether something other than an import took an index, after
+	// which imports of that kind aren't allowed
+	defined   [watSpaces]bool
+	dataCount bool
+}
+
+func newWATBuilder() *watBuilder {
+	b := &watBuilder{m: &Module{}}
+	for i := range b.names {
+		b.names[i] = map[string]uint32{}
+	}
+	return b
+}
+
+func (b *watBuilder) bind(space watSpace, id string, at *watNode) error {
+	if id != "" {
+		if _, ok := b.names[space][id]; ok {
+			return at.errorf(WATDuplicateName, watSpaceNames[space], id)
+		}
+		b.names[space][id] = b.counts[space]
+	}
+	b.counts[space]++
+	return nil
+}
+
+// Resolves an identifier or number to an index in space
+func (b *watBuilder) index(space watSpace, n *watNode) (uint32, error) {
+	if n == nil || n.isList || n.str {
+		return 0, (&watCursor{parent: n}).expected("a "+watSpaceNames[space]+" index", n)
+	}
+	if strings.HasPrefix(n.text, "$") {
+		idx, ok := b.names[space][n.text]
+		if !ok {
+			return 0, n.errorf(WATUndefinedName, watSpaceNames[space], n.text)
+		}
+		return idx, nil
+	}
+	idx, err := watU32(n)
+	if err != nil {
+		return 0, err
+	}
+	if idx >= b.counts[space] {
+		return 0, n.errorf(WATUndefinedName, watSpaceNames[space], n.text)
+	}
+	return idx, nil
+}
+
+// An index in space, or 0 when none is given
+func (b *watBuilder) optionalIndex(space watSpace, c *watCursor) (uint32, error) {
+	if !c.atIndex() {
+		return 0, nil
+	}
+	return b.index(space, c.next())
+}
+
+// First pass, binding the identifier of the field and those of its
+// inline imports and segments
+func (b *watBuilder) declare(field *watNode) error {
+	head := field.head()
+	c := &watCursor{parent: field}
+	if field.isList {
+		c = newWATCursor(field)
+	}
+	switch head {
+	case "type":
+		id := c.id()
+		fn := c.list("func")
+		if fn == nil {
+			return c.expected("(func ...)", c.peek())
+		}
+		fc := newWATCursor(fn)
+		sig, err := b.signature(fc, false)
+		if err != nil {
+			return err
+		}
+		if err := fc.end(); err != nil {
+			return err
+		}
+		if err := c.end(); err != nil {
+			return err
+		}
+		b.m.Types = append(b.m.Types, sig.ft)
+		return b.bind(watTypes, id, field)
+	case "import":
+		c.next()
+		c.next()
+		desc := c.next()
+		space, ok := watFieldSpaces[desc.head()]
+		if !ok || space > watGlobals {
+			return c.expected("an import description", desc)
+		}
+		if b.defined[space] {
+			return desc.errorf(WATSyntax, "imports must come before other "+desc.head()+" definitions")
+		}
+		return b.bind(space, newWATCursor(desc).id(), desc)
+	case "func", "table", "memory", "global":
+		space := watFieldSpaces[head]
+		id := c.id()
+		imported := false
+		for _, n := range c.rest() {
+			switch n.head() {
+			case "import":
+				imported = true
+			case "elem":
+				// Inline segments of a table or memory
+				b.counts[watElems]++
+			case "data":
+				b.counts[watDatas]++
+			}
+		}
+		if imported && b.defined[space] {
+			return field.errorf(WATSyntax, "imports must come before other "+head+" definitions")
+		}
+		b.defined[space] = b.defined[space] || !imported
+		return b.bind(space, id, field)
+	case "elem", "data":
+		return b.bind(watFieldSpaces[head], c.id(), field)
+	case "export", "start":
+		return nil
+	}
+	return c.expected("a module field", field)
+}
+
+// A type use, possibly abbreviated to inline params and results
+type watSig struct {
+	ref   *watNode // The (type x), if given
+	ft    FuncType
+	names []string // Of the params, empty for unnamed ones
+	// Whether there were any param or result lists
+	inline bool
+}
+
+// Reads (type x)? (param ...)* (result ...)*, the type use only where
+// allowed
+func (b *watBuilder) signature(c *watCursor, typeUse bool) (watSig, error) {
+	var sig watSig
+	if typeUse {
+		if sig.ref = c.list("type"); sig.ref != nil && len(sig.ref.list) != 2 {
+			return sig, sig.ref.errorf(WATSyntax, "expected a single type index")
+		}
+	}
+	for _, kind := range []string{"param", "result"} {
+		for n := c.list(kind); n != nil; n = c.list(kind) {
+			sig.inline = true
+			lc := newWATCursor(n)
+			id := ""
+			if kind == "param" {
+				id = lc.id()
+			}
+			for !lc.done() {
+				t := lc.next()
+				vt, ok := watValueTypes[t.text]
+				if !ok || !t.keyword() {
+					return sig, lc.expected("a value type", t)
+				}
+				if kind == "result" {
+					sig.ft.Results = append(sig.ft.Results, vt)
+					continue
+				}
+				sig.ft.Params = append(sig.ft.Params, vt)
+				sig.names = append(sig.names, id)
+				if id != "" && !lc.done() {
+					return sig, lc.peek().errorf(WATSyntax, "a named param has a single type")
+				}
+			}
+			if id != "" && len(n.list) == 2 {
+				return sig, n.errorf(WATSyntax, "param "+id+" has no type")
+			}
+		}
+	}
+	return sig, nil
+}
+
+// The type index for sig, adding a type if there's no match. Types
+// added this way go after the explicitly defined ones.
+func (b *watBuilder) sigType(sig watSig) (uint32, error) {
+	if sig.ref != nil {
+		idx, err := b.index(watTypes, sig.ref.list[1])
+		if err != nil {
+			return 0, err
+		}
+		if want := b.m.Types[idx]; sig.inline && !want.Equal(sig.ft) {
+			return 0, sig.ref.errorf(WATTypeMismatch, sig.ft, idx, want)
+		}
+		return idx, nil
+	}
+	for i, ft := range b.m.Types {
+		if ft.Equal(sig.ft) {
+			return uint32(i), nil
+		}
+	}
+	b.m.Types = append(b.m.Types, sig.ft)
+	b.counts[watTypes]++
+	return uint32(len(b.m.Types) - 1), nil
+}
+
+// The params of a function, named where the text gave them names
+func (b *watBuilder) funcSig(c *watCursor) (uint32, []string, error) {
+	sig, err := b.signature(c, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	idx, err := b.sigType(sig)
+	if err != nil {
+		return 0, nil, err
+	}
+	names := sig.names
+	if !sig.inline {
+		names = make([]string, len(b.m.Types[idx].Params))
+	}
+	return idx, names, nil
+}
+
+// Reads the inline (export "name") lists of a field
+func (b *watBuilder) inlineExports(c *watCursor, kind ExternType, idx uint32) error {
+	for n := c.list("export"); n != nil; n = c.list("export") {
+		ec := newWATCursor(n)
+		name, err := ec.str()
+		if err != nil {
+			return err
+		}
+		if err := ec.end(); err != nil {
+			return err
+		}
+		b.m.Exports = append(b.m.Exports, Export{Name: name, Kind: kind, Index: idx})
+	}
+	return nil
+}
+
+// Reads an inline (import "module" "name"), returning nil if there
+// isn't one
+func (b *watBuilder) inlineImport(c *watCursor) (*Import, error) {
+	n := c.list("import")
+	if n == nil {
+		return nil, nil
+	}
+	ic := newWATCursor(n)
+	module, err := ic.str()
+	if err != nil {
+		return nil, err
+	}
+	name, err := ic.str()
+	if err != nil {
+		return nil, err
+	}
+	return &Import{Module: module, Name: name}, ic.end()
+}
+
+func (b *watBuilder) limits(c *watCursor) (Limits, error) {
+	n, err := c.need("a number")
+	if err != nil {
+		return Limits{}, err
+	}
+	min, err := watU32(n)
+	if err != nil {
+		return Limits{}, err
+	}
+	l := Limits{Min: uint64(min)}
+	if c.atIndex() {
+		max, err := watU32(c.next())
+		if err != nil {
+			return Limits{}, err
+		}
+		l.Max = new(uint64)
+		*l.Max = uint64(max)
+	}
+	return l, nil
+}
+
+func (b *watBuilder) tableType(c *watCursor) (TableType, error) {
+	l, err := b.limits(c)
+	if err != nil {
+		return TableType{}, err
+	}
+	n := c.next()
+	rt, ok := watRefTypes[n.describeKeyword()]
+	if !ok {
+		return TableType{}, c.expected("a reference type", n)
+	}
+	return TableType{ElemType: rt, Limits: l}, nil
+}
+
+func (b *watBuilder) memoryType(c *watCursor) (MemoryType, error) {
+	l, err := b.limits(c)
+	if err != nil {
+		return MemoryType{}, err
+	}
+	return MemoryType{Limits: l, Shared: c.keyword("shared")}, nil
+}
+
+func (b *watBuilder) globalType(c *watCursor) (GlobalType, error) {
+	n := c.next()
+	gt := GlobalType{}
+	if mut := n; mut.head() == "mut" && len(mut.list) == 2 {
+		gt.Mutable = true
+		n = mut.list[1]
+	}
+	vt, ok := watValueTypes[n.describeKeyword()]
+	if !ok {
+		return gt, c.expected("a global type", n)
+	}
+	gt.ValType = vt
+	return gt, nil
+}
+
+// The text of a keyword atom, empty for anything else
+func (n *watNode) describeKeyword() string {
+	if n.keyword() {
+		return n.text
+	}
+	return ""
+}
+
+// Second pass, adding the field to the module
+func (b *watBuilder) define(field *watNode) error {
+	head := field.head()
+	c := newWATCursor(field)
+	switch head {
+	case "type":
+		return nil
+	case "import":
+		module, _ := c.str()
+		name, _ := c.str()
+		desc := c.next()
+		dc := newWATCursor(desc)
+		dc.id()
+		if err := b.importDesc(&Import{Module: module, Name: name}, desc.head(), dc); err != nil {
+			return err
+		}
+		if err := dc.end(); err != nil {
+			return err
+		}
+		return c.end()
+	case "func":
+		return b.defineFunc(c)
+	case "table":
+		return b.defineTable(c)
+	case "memory":
+		return b.defineMemory(c)
+	case "global":
+		return b.defineGlobal(c)
+	case "export":
+		return b.defineExport(c)
+	case "start":
+		n, err := c.need("a func index")
+		if err != nil {
+			return err
+		}
+		idx, err := b.index(watFuncs, n)
+		if err != nil {
+			return err
+		}
+		b.m.Start = &idx
+		return c.end()
+	case "elem":
+		return b.defineElem(c)
+	case "data":
+		return b.defineData(c)
+	}
+	return nil
+}
+
+// The kind specific part of an import
+func (b *watBuilder) importDesc(imp *Import, kind string, c *watCursor) error {
+	var err error
+	space := watFieldSpaces[kind]
+	switch kind {
+	case "func":
+		imp.Kind = ExternFunc
+		imp.Func, _, err = b.funcSig(c)
+	case "table":
+		imp.Kind = ExternTable
+		imp.Table, err = b.tableType(c)
+	case "memory":
+		imp.Kind = ExternMemory
+		imp.Memory, err = b.memoryType(c)
+	default:
+		imp.Kind = ExternGlobal
+		imp.Global, err = b.globalType(c)
+	}
+	b.m.Imports = append(b.m.Imports, *imp)
+	b.next[space]++
+	return err
+}
+
+// The index the field being defined gets, and any inline exports and
+// import. An imported field is done once it returns.
+func (b *watBuilder) fieldHeader(c *watCursor, space watSpace, kind ExternType) (uint32, bool, error) {
+	c.id()
+	idx := b.next[space]
+	if err := b.inlineExports(c, kind, idx); err != nil {
+		return 0, false, err
+	}
+	imp, err := b.inlineImport(c)
+	if err != nil || imp == nil {
+		return idx, false, err
+	}
+	if err := b.importDesc(imp, externTypeNames[kind], c); err != nil {
+		return 0, false, err
+	}
+	return idx, true, c.end()
+}
+
+func (b *watBuilder) defineFunc(c *watCursor) error {
+	_, imported, err := b.fieldHeader(c, watFuncs, ExternFunc)
+	if err != nil || imported {
+		return err
+	}
+	b.next[watFuncs]++
+	typeIdx, params, err := b.funcSig(c)
+	if err != nil {
+		return err
+	}
+	f := newWATFunc(b)
+	for _, name := range params {
+		if err := f.local(name, c.parent); err != nil {
+			return err
+		}
+	}
+	body := FuncBody{}
+	for n := c.list("local"); n != nil; n = c.list("local") {
+		lc := newWATCursor(n)
+		id := lc.id()
+		for !lc.done() {
+			t := lc.next()
+			vt, ok := watValueTypes[t.describeKeyword()]
+			if !ok {
+				return lc.expected("a value type", t)
+			}
+			if err := f.local(id, t); err != nil {
+				return err
+			}
+			if l := len(body.Locals); l > 0 && body.Locals[l-1].Type == vt {
+				body.Locals[l-1].Count++
+			} else {
+				body.Locals = append(body.Locals, LocalEntry{Count: 1, Type: vt})
+			}
+			if id != "" && !lc.done() {
+				return lc.peek().errorf(WATSyntax, "a named local has a single type")
+			}
+		}
+	}
+	if err := f.instrs(c); err != nil {
+		return err
+	}
+	if len(f.labels) > 0 {
+		return c.parent.errorf(WATSyntax, fmt.Sprintf("%d blocks not closed", len(f.labels)))
+	}
+	body.Code = append(f.code, OP_END)
+	b.m.Funcs = append(b.m.Funcs, typeIdx)
+	b.m.Code = append(b.m.Code, body)
+	return nil
+}
+
+func (b *watBuilder) defineTable(c *watCursor) error {
+	idx, imported, err := b.fieldHeader(c, watTables, ExternTable)
+	if err != nil || imported {
+		return err
+	}
+	b.next[watTables]++
+	// The abbreviation with the elements inline gives the table
+	// exactly as many as there are
+	if rt, ok := watRefTypes[c.peek().describeKeyword()]; ok {
+		c.next()
+		n := c.list("elem")
+		if n == nil {
+			return c.expected("(elem ...)", c.peek())
+		}
+		seg := ElementSegment{Mode: SegmentActive, Table: idx, Type: rt, Offset: watConstI32Zero}
+		if err := b.elemList(newWATCursor(n), &seg, rt); err != nil {
+			return err
+		}
+		size := uint64(max(len(seg.Funcs), len(seg.Exprs)))
+		b.m.Tables = append(b.m.Tables, TableType{ElemType: rt, Limits: Limits{Min: size, Max: &size}})
+		b.m.Elements = append(b.m.Elements, seg)
+		b.next[watElems]++
+		return c.end()
+	}
+	tt, err := b.tableType(c)
+	if err != nil {
+		return err
+	}
+	b.m.Tables = append(b.m.Tables, tt)
+	return c.end()
+}
+
+// i32.const 0, end
+var watConstI32Zero = []byte{OP_CONST_I32, 0x00, OP_END}
+
+func (b *watBuilder) defineMemory(c *watCursor) error {
+	idx, imported, err := b.fieldHeader(c, watMemories, ExternMemory)
+	if err != nil || imported {
+		return err
+	}
+	b.next[watMemories]++
+	if n := c.list("data"); n != nil {
+		init, err := watStrings(newWATCursor(n))
+		if err != nil {
+			return err
+		}
+		pages := (uint64(len(init)) + WasmPageSize - 1) / WasmPageSize
+		b.m.Memories = append(b.m.Memories, MemoryType{Limits: Limits{Min: pages, Max: &pages}})
+		b.m.Data = append(b.m.Data, DataSegment{Memory: idx, Offset: watConstI32Zero, Init: init})
+		b.next[watDatas]++
+		return c.end()
+	}
+	mt, err := b.memoryType(c)
+	if err != nil {
+		return err
+	}
+	b.m.Memories = append(b.m.Memories, mt)
+	return c.end()
+}
+
+func (b *watBuilder) defineGlobal(c *watCursor) error {
+	_, imported, err := b.fieldHeader(c, watGlobals, ExternGlobal)
+	if err != nil || imported {
+		return err
+	}
+	b.next[watGlobals]++
+	gt, err := b.globalType(c)
+	if err != nil {
+		return err
+	}
+	init, err := b.constExpr(c)
+	if err != nil {
+		return err
+	}
+	b.m.Globals = append(b.m.Globals, ModuleGlobal{Type: gt, Init: init})
+	return nil
+}
+
+func (b *watBuilder) defineExport(c *watCursor) error {
+	name, err := c.str()
+	if err != nil {
+		return err
+	}
+	desc := c.next()
+	space, ok := watFieldSpaces[desc.head()]
+	if !ok || space > watGlobals || len(desc.list) != 2 {
+		return c.expected("an export description", desc)
+	}
+	idx, err := b.index(space, desc.list[1])
+	if err != nil {
+		return err
+	}
+	b.m.Exports = append(b.m.Exports, Export{Name: name, Kind: ExternType(space), Index: idx})
+	return c.end()
+}
+
+// The offset of an active segment, either (offset instr*) or a single
+// folded instruction
+func (b *watBuilder) offset(c *watCursor) ([]byte, error) {
+	if n := c.list("offset"); n != nil {
+		return b.constExpr(newWATCursor(n))
+	}
+	n := c.next()
+	if n == nil || !n.isList {
+		return nil, c.expected("an offset", n)
+	}
+	return b.constExpr(&watCursor{parent: c.parent, nodes: []*watNode{n}})
+}
+
+func (b *watBuilder) defineElem(c *watCursor) error {
+	c.id()
+	b.next[watElems]++
+	seg := ElementSegment{Mode: SegmentPassive, Type: RefFunc}
+	switch {
+	case c.keyword("declare"):
+		seg.Mode = SegmentDeclarative
+	case c.peek() != nil && c.peek().isList && c.peek().head() != "item":
+		seg.Mode = SegmentActive
+		if n := c.list("table"); n != nil {
+			idx, err := b.index(watTables, n.list[len(n.list)-1])
+			if err != nil {
+				return err
+			}
+			seg.Table = idx
+		}
+		offset, err := b.offset(c)
+		if err != nil {
+			return err
+		}
+		seg.Offset = offset
+	}
+	rt := RefFunc
+	switch n := c.peek(); {
+	case c.keyword("func"):
+	case n != nil && watRefTypes[n.describeKeyword()] != 0:
+		c.next()
+		rt = watRefTypes[n.text]
+		seg.Exprs = [][]byte{}
+	case seg.Mode != SegmentActive:
+		return c.expected("func or a reference type", n)
+	}
+	seg.Type = rt
+	if err := b.elemList(c, &seg, rt); err != nil {
+		return err
+	}
+	b.m.Elements = append(b.m.Elements, seg)
+	return nil
+}
+
+// The elements of a segment, either all function indices or all
+// expressions. Expressions are (item instr*) or a folded instruction.
+func (b *watBuilder) elemList(c *watCursor, seg *ElementSegment, rt RefType) error {
+	if !c.done() && c.peek().isList {
+		seg.Exprs = [][]byte{}
+	}
+	for !c.done() {
+		n := c.next()
+		if seg.Exprs == nil {
+			idx, err := b.index(watFuncs, n)
+			if err != nil {
+				return err
+			}
+			seg.Funcs = append(seg.Funcs, idx)
+			continue
+		}
+		if !n.isList {
+			return c.expected("an element expression", n)
+		}
+		ic := &watCursor{parent: n, nodes: []*watNode{n}}
+		if n.head() == "item" {
+			ic = newWATCursor(n)
+		}
+		expr, err := b.constExpr(ic)
+		if err != nil {
+			return err
+		}
+		seg.Exprs = append(seg.Exprs, expr)
+	}
+	if seg.Funcs == nil && seg.Exprs == nil && rt == RefFunc {
+		seg.Funcs = []uint32{}
+	}
+	return nil
+}
+
+func (b *watBuilder) defineData(c *watCursor) error {
+	c.id()
+	b.next[watDatas]++
+	seg := DataSegment{Mode: SegmentPassive}
+	if c.peek() != nil && c.peek().isList {
+		seg.Mode = SegmentActive
+		if n := c.list("memory"); n != nil {
+			idx, err := b.index(watMemories, n.list[len(n.list)-1])
+			if err != nil {
+				return err
+			}
+			seg.Memory = idx
+		}
+		offset, err := b.offset(c)
+		if err != nil {
+			return err
+		}
+		seg.Offset = offset
+	}
+	init, err := watStrings(c)
+	if err != nil {
+		return err
+	}
+	seg.Init = init
+	b.m.Data = append(b.m.Data, seg)
+	return nil
+}
+
+// Concatenates the strings that make up data
+func watStrings(c *watCursor) ([]byte, error) {
+	var data []byte
+	for !c.done() {
+		s, err := c.str()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, s...)
+	}
+	return data, nil
+}
+
+// The instructions left in c, followed by end
+func (b *watBuilder) constExpr(c *watCursor) ([]byte, error) {
+	f := newWATFunc(b)
+	if err := f.instrs(c); err != nil {
+		return nil, err
+	}
+	return append(f.code, OP_END), nil
+}
+
+// A block that's still open while assembling a function
+type watLabel struct {
+	name string
+	op   byte
+	// Whether the if has had its else
+	sawElse bool
+}
+
+// Assembles the instructions of a function body or constant expression
+type watFunc struct {
+	b       *watBuilder
+	locals  map[string]uint32
+	nlocals uint32
+	labels  []watLabel
+	code    []byte
+}
+
+func newWATFunc(b *watBuilder) *watFunc {
+	return &watFunc{b: b, locals: map[string]uint32{}}
+}
+
+func (f *watFunc) local(id string, at *watNode) error {
+	if id != "" {
+		if _, ok := f.locals[id]; ok {
+			return at.errorf(WATDuplicateName, "local", id)
+		}
+		f.locals[id] = f.nlocals
+	}
+	f.nlocals++
+	return nil
+}
+
+func (f *watFunc) instrs(c *watCursor) error {
+	for !c.done() {
+		n := c.next()
+		var err error
+		switch {
+		case n.isList:
+			err = f.folded(n)
+		case !n.keyword():
+			err = c.expected("an instruction", n)
+		default:
+			err = f.flat(n, c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *watFunc) flat(n *watNode, c *watCursor) error {
+	switch n.text {
+	case "block", "loop", "if":
+		return f.open(n.text, c)
+	case "else":
+		if len(f.labels) == 0 {
+			return n.errorf(WATSyntax, "else outside of if")
+		}
+		top := &f.labels[len(f.labels)-1]
+		if top.op != OP_IF || top.sawElse {
+			return n.errorf(WATSyntax, "else outside of if")
+		}
+		if err := f.closingLabel(c, top.name); err != nil {
+			return err
+		}
+		top.sawElse = true
+		f.code = append(f.code, OP_ELSE)
+		return nil
+	case "end":
+		if len(f.labels) == 0 {
+			return n.errorf(WATSyntax, "end outside of a block")
+		}
+		if err := f.closingLabel(c, f.labels[len(f.labels)-1].name); err != nil {
+			return err
+		}
+		f.labels = f.labels[:len(f.labels)-1]
+		f.code = append(f.code, OP_END)
+		return nil
+	}
+	code, err := f.plain(n, c)
+	f.code = append(f.code, code...)
+	return err
+}
+
+// The label repeated after else or end has to match the block
+func (f *watFunc) closingLabel(c *watCursor, name string) error {
+	at := c.peek()
+	if id := c.id(); id != "" && id != name {
+		return at.errorf(WATSyntax, fmt.Sprintf("label %s does not match %s", id, name))
+	}
+	return nil
+}
+
+// Starts a block, loop or if: its label, block type and opcode
+func (f *watFunc) open(kind string, c *watCursor) error {
+	label, bt, err := f.blockHeader(kind, c)
+	if err != nil {
+		return err
+	}
+	f.push(label, bt)
+	return nil
+}
+
+func (f *watFunc) blockHeader(kind string, c *watCursor) (watLabel, []byte, error) {
+	label := watLabel{name: c.id(), op: instructionsByName[kind].op}
+	bt, err := f.blockType(c)
+	return label, bt, err
+}
+
+func (f *watFunc) push(label watLabel, bt []byte) {
+	f.code = append(append(f.code, label.op), bt...)
+	f.labels = append(f.labels, label)
+}
+
+func (f *watFunc) blockType(c *watCursor) ([]byte, error) {
+	sig, err := f.b.signature(c, true)
+	if err != nil {
+		return nil, err
+	}
+	if sig.ref == nil && len(sig.ft.Params) == 0 && len(sig.ft.Results) <= 1 {
+		if len(sig.ft.Results) == 0 {
+			return []byte{0x40}, nil
+		}
+		return []byte{valueTypeBytes[sig.ft.Results[0]]}, nil
+	}
+	idx, err := f.b.sigType(sig)
+	return AppendSLEB128(nil, int64(idx)), err
+}
+
+func (f *watFunc) folded(n *watNode) error {
+	if !n.isList {
+		return n.errorf(WATSyntax, "expected a folded instruction, got "+n.describe())
+	}
+	if !n.list[0].keyword() {
+		return n.errorf(WATSyntax, "expected an instruction, got "+n.list[0].describe())
+	}
+	c := newWATCursor(n)
+	switch kind := n.head(); kind {
+	case "block", "loop":
+		if err := f.open(kind, c); err != nil {
+			return err
+		}
+		if err := f.instrs(c); err != nil {
+			return err
+		}
+	case "if":
+		// The condition is folded inside but goes before the if,
+		// outside of its block
+		label, bt, err := f.blockHeader(kind, c)
+		if err != nil {
+			return err
+		}
+		for c.peek() != nil && c.peek().head() != "then" {
+			if err := f.folded(c.next()); err != nil {
+				return err
+			}
+		}
+		f.push(label, bt)
+		then := c.list("then")
+		if then == nil {
+			return c.expected("(then ...)", c.peek())
+		}
+		if err := f.instrs(newWATCursor(then)); err != nil {
+			return err
+		}
+		if els := c.list("else"); els != nil {
+			f.code = append(f.code, OP_ELSE)
+			if err := f.instrs(newWATCursor(els)); err != nil {
+				return err
+			}
+		}
+		if err := c.end(); err != nil {
+			return err
+		}
+	default:
+		code, err := f.plain(n.list[0], c)
+		if err != nil {
+			return err
+		}
+		for !c.done() {
+			operand := c.next()
+			if !operand.isList {
+				return operand.errorf(WATSyntax, "unexpected "+operand.describe())
+			}
+			if err := f.folded(operand); err != nil {
+				return err
+			}
+		}
+		f.code = append(f.code, code...)
+		return nil
+	}
+	f.labels = f.labels[:len(f.labels)-1]
+	f.code = append(f.code, OP_END)
+	return nil
+}
+
+// An instruction other than the structured ones, with its immediates
+func (f *watFunc) plain(n *watNode, c *watCursor) ([]byte, error) {
+	key, ok := instructionsByName[n.text]
+	if !ok || key.op == OP_BLOCK || key.op == OP_LOOP || key.op == OP_IF || key.op == OP_ELSE || key.op == OP_END {
+		return nil, n.errorf(WATUnknownInstruction, n.text)
+	}
+	b := f.b
+	out := []byte{key.op}
+	if key.op == OP_PREFIX_MISC || key.op == OP_PREFIX_ATOMIC {
+		out = AppendULEB128(out, uint64(key.sub))
+	}
+	// Appends the index of the next node in space, or 0 when optional
+	// and missing
+	idx := func(space watSpace, optional bool) error {
+		var i uint32
+		var err error
+		if optional {
+			i, err = b.optionalIndex(space, c)
+		} else if operand, nerr := c.need("a " + watSpaceNames[space] + " index"); nerr != nil {
+			err = nerr
+		} else {
+			i, err = b.index(space, operand)
+		}
+		out = AppendULEB128(out, uint64(i))
+		return err
+	}
+
+	switch {
+	case hasMemArg(key):
+		return f.memArg(out, n.text, c)
+	case key.op == OP_PREFIX_ATOMIC: // atomic.fence
+		return append(out, 0x00), nil
+	case key.op == OP_PREFIX_MISC:
+		switch key.sub {
+		case OP_MEMORY_INIT, OP_TABLE_INIT:
+			// The segment comes last in the text but first in the binary
+			space, target := watDatas, watMemories
+			if key.sub == OP_TABLE_INIT {
+				space, target = watElems, watTables
+			}
+			b.dataCount = b.dataCount || key.sub == OP_MEMORY_INIT
+			first, err := c.need("a " + watSpaceNames[space] + " index")
+			if err != nil {
+				return nil, err
+			}
+			var ti uint32
+			seg := first
+			if c.atIndex() {
+				var err error
+				if ti, err = b.index(target, first); err != nil {
+					return nil, err
+				}
+				seg = c.next()
+			}
+			si, err := b.index(space, seg)
+			return AppendULEB128(AppendULEB128(out, uint64(si)), uint64(ti)), err
+		case OP_DATA_DROP:
+			b.dataCount = true
+			return out, idx(watDatas, false)
+		case OP_ELEM_DROP:
+			return out, idx(watElems, false)
+		case OP_MEMORY_COPY:
+			if err := idx(watMemories, true); err != nil {
+				return nil, err
+			}
+			return out, idx(watMemories, true)
+		case OP_TABLE_COPY:
+			if err := idx(watTables, true); err != nil {
+				return nil, err
+			}
+			return out, idx(watTables, true)
+		case OP_MEMORY_FILL:
+			return out, idx(watMemories, true)
+		case OP_TABLE_GROW, OP_TABLE_SIZE, OP_TABLE_FILL:
+			return out, idx(watTables, true)
+		}
+		return out, nil
+	}
+
+	switch key.op {
+	case OP_BR, OP_BR_IF:
+		n, err := c.need("a label")
+		if err != nil {
+			return nil, err
+		}
+		depth, err := f.label(n)
+		return AppendULEB128(out, uint64(depth)), err
+	case OP_BR_TABLE:
+		var depths []uint32
+		for c.atIndex() {
+			depth, err := f.label(c.next())
+			if err != nil {
+				return nil, err
+			}
+			depths = append(depths, depth)
+		}
+		if len(depths) == 0 {
+			return nil, c.expected("a label", c.peek())
+		}
+		out = AppendULEB128(out, uint64(len(depths)-1))
+		for _, d := range depths {
+			out = AppendULEB128(out, uint64(d))
+		}
+		return out, nil
+	case OP_CALL, 0xD2: // ref.func
+		return out, idx(watFuncs, false)
+	case OP_CALL_INDIRECT:
+		table, err := b.optionalIndex(watTables, c)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := b.signature(c, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(sig.names) > 0 && sig.names[0] != "" {
+			return nil, n.errorf(WATSyntax, "call_indirect params can't be named")
+		}
+		typeIdx, err := b.sigType(sig)
+		return AppendULEB128(AppendULEB128(out, uint64(typeIdx)), uint64(table)), err
+	case OP_LOCAL_GET, OP_LOCAL_SET, OP_LOCAL_TEE:
+		n, err := c.need("a local index")
+		if err != nil {
+			return nil, err
+		}
+		local, err := f.localIndex(n)
+		return AppendULEB128(out, uint64(local)), err
+	case OP_GLOBAL_GET, OP_GLOBAL_SET:
+		return out, idx(watGlobals, false)
+	case 0x25, 0x26: // table.get, table.set
+		return out, idx(watTables, true)
+	case OP_MEMORY_SIZE, OP_MEMORY_GROW:
+		return out, idx(watMemories, true)
+	case OP_SELECT:
+		sig, err := b.signature(c, false)
+		if err != nil || !sig.inline {
+			return out, err
+		}
+		if len(sig.ft.Params) > 0 {
+			return nil, n.errorf(WATSyntax, "select only takes results")
+		}
+		out = AppendULEB128([]byte{OP_SELECT_T}, uint64(len(sig.ft.Results)))
+		for _, vt := range sig.ft.Results {
+			out = append(out, valueTypeBytes[vt])
+		}
+		return out, nil
+	case OP_CONST_I32, OP_CONST_I64:
+		size := 32
+		if key.op == OP_CONST_I64 {
+			size = 64
+		}
+		lit, err := c.need("an integer")
+		if err != nil {
+			return nil, err
+		}
+		v, err := watInt(lit, size)
+		if size == 32 {
+			return AppendSLEB128(out, int64(int32(v))), err
+		}
+		return AppendSLEB128(out, int64(v)), err
+	case OP_CONST_F32, OP_CONST_F64:
+		lit, err := c.need("a float")
+		if err != nil {
+			return nil, err
+		}
+		if key.op == OP_CONST_F32 {
+			v, err := watFloat(lit, 32)
+			return binary.LittleEndian.AppendUint32(out, uint32(v)), err
+		}
+		v, err := watFloat(lit, 64)
+		return binary.LittleEndian.AppendUint64(out, v), err
+	case 0xD0: // ref.null
+		heap := c.next()
+		switch heap.describeKeyword() {
+		case "func":
+			return append(out, byte(RefFunc)), nil
+		case "extern":
+			return append(out, byte(RefExtern)), nil
+		}
+		return nil, c.expected("func or extern", heap)
+	}
+	return out, nil
+}
+
+// offset=N and align=N, both optional and in that order
+func (f *watFunc) memArg(out []byte, name string, c *watCursor) ([]byte, error) {
+	var offset uint64
+	align := uint64(naturalAlignment(name))
+	for _, field := range []string{"offset=", "align="} {
+		n := c.peek()
+		if !n.keyword() || !strings.HasPrefix(n.text, field) {
+			continue
+		}
+		c.next()
+		v, err := watUnsigned(n.text[len(field):], 32)
+		if err != nil {
+			return nil, n.errorf(WATBadNumber, field[:len(field)-1], n.text)
+		}
+		if field == "align=" {
+			if v == 0 || v&(v-1) != 0 {
+				return nil, n.errorf(WATSyntax, "alignment must be a power of two")
+			}
+			align = v
+		} else {
+			offset = v
+		}
+	}
+	out = AppendULEB128(out, uint64(bits.TrailingZeros64(align)))
+	return AppendULEB128(out, offset), nil
+}
+
+// The depth of a label, given by name or directly
+func (f *watFunc) label(n *watNode) (uint32, error) {
+	if n != nil && !n.isList && strings.HasPrefix(n.text, "$") {
+		for i := len(f.labels) - 1; i >= 0; i-- {
+			if f.labels[i].name == n.text {
+				return uint32(len(f.labels) - 1 - i), nil
+			}
+		}
+		return 0, n.errorf(WATUndefinedName, "label", n.text)
+	}
+	return watU32(n)
+}
+
+func (f *watFunc) localIndex(n *watNode) (uint32, error) {
+	if n != nil && !n.isList && strings.HasPrefix(n.text, "$") {
+		idx, ok := f.locals[n.text]
+		if !ok {
+			return 0, n.errorf(WATUndefinedName, "local", n.text)
+		}
+		return idx, nil
+	}
+	idx, err := watU32(n)
+	if err == nil && idx >= f.nlocals {
+		return 0, n.errorf(WATUndefinedName, "local", n.text)
+	}
+	return idx, err
+}
+
+// Drops the underscores that may separate digits
+func watDigits(s string, hex bool) (string, bool) {
+	if !strings.Contains(s, "_") {
+		return s, true
+	}
+	isDigit := func(c byte) bool {
+		return c >= '0' && c <= '9' || hex && (c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F')
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '_' && (i == 0 || i == len(s)-1 || !isDigit(s[i-1]) || !isDigit(s[i+1])) {
+			return "", false
+		}
+	}
+	return strings.ReplaceAll(s, "_", ""), true
+}
+
+// An unsigned decimal or hexadecimal number of at most size bits
+func watUnsigned(s string, size int) (uint64, error) {
+	base := 10
+	if strings.HasPrefix(s, "0x") {
+		base, s = 16, s[2:]
+	}
+	digits, ok := watDigits(s, base == 16)
+	if !ok || digits == "" || digits[0] == '+' || digits[0] == '-' {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseUint(digits, base, size)
+}
+
+func watU32(n *watNode) (uint32, error) {
+	if n == nil || !n.keyword() {
+		return 0, (&watCursor{parent: n}).expected("a number", n)
+	}
+	v, err := watUnsigned(n.text, 32)
+	if err != nil {
+		return 0, n.errorf(WATBadNumber, "index", n.text)
+	}
+	return uint32(v), nil
+}
+
+// An integer literal for a size bit value, which may be written signed
+// or unsigned. Returns the bits of the value.
+func watInt(n *watNode, size int) (uint64, error) {
+	if n == nil || !n.keyword() {
+		return 0, (&watCursor{parent: n}).expected("an integer", n)
+	}
+	s, neg := n.text, false
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		s, neg = s[1:], s[0] == '-'
+	}
+	v, err := watUnsigned(s, size)
+	if err == nil && neg && v > 1<<(size-1) {
+		err = strconv.ErrRange
+	}
+	if err != nil {
+		return 0, n.errorf(WATBadNumber, fmt.Sprintf("i%d", size), n.text)
+	}
+	if neg {
+		v = -v
+	}
+	if size == 32 {
+		v &= math.MaxUint32
+	}
+	return v, nil
+}
+
+// A float literal for a size bit value: decimal, hexadecimal, inf, nan
+// or nan:0x followed by the payload. Returns the bits of the value.
+func watFloat(n *watNode, size int) (uint64, error) {
+	if n == nil || !n.keyword() {
+		return 0, (&watCursor{parent: n}).expected("a float", n)
+	}
+	bad := n.errorf(WATBadNumber, fmt.Sprintf("f%d", size), n.text)
+	s, neg := n.text, false
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		s, neg = s[1:], s[0] == '-'
+	}
+	fraction := uint(52)
+	if size == 32 {
+		fraction = 23
+	}
+	var sign uint64
+	if neg {
+		sign = 1 << (size - 1)
+	}
+	inf := (uint64(1)<<(size-1-int(fraction)) - 1) << fraction
+	switch {
+	case s == "inf":
+		return sign | inf, nil
+	case s == "nan":
+		return sign | inf | 1<<(fraction-1), nil
+	case strings.HasPrefix(s, "nan:0x"):
+		payload, err := watUnsigned(s[4:], int(fraction))
+		if err != nil || payload == 0 {
+			return 0, bad
+		}
+		return sign | inf | payload, nil
+	case s == "" || s[0] < '0' || s[0] > '9':
+		return 0, bad
+	}
+	hex := strings.HasPrefix(s, "0x")
+	digits, ok := watDigits(s, hex)
+	if !ok {
+		return 0, bad
+	}
+	if hex && !strings.ContainsAny(digits, "pP") {
+		digits += "p0"
+	}
+	f, err := strconv.ParseFloat(digits, size)
+	if err != nil {
+		return 0, bad
+	}
+	if neg {
+		f = math.Copysign(f, -1)
+	}
+	if size == 32 {
+		return uint64(math.Float32bits(float32(f))), nil
+	}
+	return math.Float64bits(f), nil
+}
@@ -0,0 +1,276 @@
+package wasmvm_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/redmasq/rmq-wasm-vm/pkg/wasmvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// instanceTestModule, written out as text
+const instanceTestWAT = `
+(module
+  (type $binop (func (param i32 i32) (result i32)))
+  (type $unop (func (param i32) (result i32)))
+  (type (func (result i64)))
+  (type $void (func))
+  (import "env" "callback" (func $host (type $unop)))
+  (table 2 funcref)
+  (memory 1)
+  (global $counter (mut i64) (i64.const 0))
+  (elem (i32.const 0) $double $add)
+
+  (func $add (export "add") (type $binop)
+    local.get 0
+    local.get 1
+    i32.add)
+  (func $double (export "double") (param $x i32) (result i32)
+    (i32.add (local.get $x) (local.get $x)))
+  ;; n + ... + 1, counting n down to zero
+  (func $sum (export "sum") (param $n i32) (result i32) (local $acc i32)
+    (loop $again
+      (local.set $acc (i32.add (local.get $acc) (local.get $n)))
+      (br_if $again (local.tee $n (i32.sub (local.get $n) (i32.const 1)))))
+    (local.get $acc))
+  (func (export "callback") (param i32) (result i32)
+    local.get 0 call $host)
+  (func (export "indirect") (type $binop)
+    (call_indirect (type $unop) (local.get 0) (local.get 1)))
+  (func (export "counter") (result i64)
+    (global.set $counter (i64.add (global.get $counter) (i64.const 1)))
+    (global.get $counter))
+  (func (export "pick") (param i32) (result i32)
+    (if (result i32) (local.get 0)
+      (then (i32.const 10))
+      (else (i32.const 20))))
+  (func (export "trap") unreachable)
+  (func (export "spin") loop br 0 end)
+  (; 100 for zero, 200 otherwise ;)
+  (func (export "classify") (param i32) (result i32)
+    block block local.get 0 br_table 0 1 end
+      i32.const 100 return
+    end
+    i32.const 200)
+  (func $recurse (export "recurse") (param i32) (result i32)
+    local.get 0 call $recurse)
+  (export "mem" (memory 0))
+  (data (i32.const 8) "hi"))
+`
+
+func TestParseWAT_SameAsBinary(t *testing.T) {
+	want, err := wasmvm.DecodeModule(instanceTestModule)
+	require.NoError(t, err)
+	got, err := wasmvm.ParseWAT(instanceTestWAT)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	bin, err := wasmvm.AssembleWAT(instanceTestWAT)
+	require.NoError(t, err)
+	assert.Equal(t, instanceTestModule, bin)
+}
+
+// Code of the only function in src, without the final end
+func watCode(t *testing.T, src string) []byte {
+	t.Helper()
+	m, err := wasmvm.ParseWAT(src)
+	require.NoError(t, err)
+	require.Len(t, m.Code, 1)
+	code := m.Code[0].Code
+	return code[:len(code)-1]
+}
+
+func TestParseWAT_Literals(t *testing.T) {
+	tests := []struct {
+		name   string
+		instr  string
+		expect []byte
+	}{
+		{name: "i32 negative", instr: "i32.const -1", expect: []byte{0x41, 0x7F}},
+		{name: "i32 unsigned", instr: "i32.const 0xFFFF_FFFF", expect: []byte{0x41, 0x7F}},
+		{name: "i32 minimum", instr: "i32.const -2147483648", expect: []byte{0x41, 0x80, 0x80, 0x80, 0x80, 0x78}},
+		{name: "i32 underscores", instr: "i32.const 1_000", expect: []byte{0x41, 0xE8, 0x07}},
+		{name: "i64 unsigned", instr: "i64.const 0x8000000000000000", expect: []byte{0x42, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x7F}},
+		{name: "f32 decimal", instr: "f32.const 1.5", expect: []byte{0x43, 0x00, 0x00, 0xC0, 0x3F}},
+		{name: "f32 hex", instr: "f32.const 0x1.8p1", expect: []byte{0x43, 0x00, 0x00, 0x40, 0x40}},
+		{name: "f32 hex integer", instr: "f32.const 0x10", expect: []byte{0x43, 0x00, 0x00, 0x80, 0x41}},
+		{name: "f32 negative zero", instr: "f32.const -0", expect: []byte{0x43, 0x00, 0x00, 0x00, 0x80}},
+		{name: "f32 inf", instr: "f32.const -inf", expect: []byte{0x43, 0x00, 0x00, 0x80, 0xFF}},
+		{name: "f32 nan", instr: "f32.const nan", expect: []byte{0x43, 0x00, 0x00, 0xC0, 0x7F}},
+		{name: "f32 nan payload", instr: "f32.const -nan:0x200001", expect: []byte{0x43, 0x01, 0x00, 0xA0, 0xFF}},
+		{name: "f64 exponent", instr: "f64.const 1e3", expect: []byte{0x44, 0, 0, 0, 0, 0, 0x40, 0x8F, 0x40}},
+		{name: "f64 nan payload", instr: "f64.const nan:0x1", expect: []byte{0x44, 1, 0, 0, 0, 0, 0, 0xF0, 0x7F}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, watCode(t, "(func "+tc.instr+" drop)")[:len(tc.expect)])
+		})
+	}
+}
+
+func TestParseWAT_Instructions(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		expect []byte
+	}{
+		{
+			name:   "memarg defaults to natural alignment",
+			src:    `(memory 1) (func (i64.load16_s offset=8 (i32.const 0)) drop)`,
+			expect: []byte{0x41, 0x00, 0x32, 0x01, 0x08, 0x1A},
+		},
+		{
+			name:   "memarg alignment",
+			src:    `(memory 1) (func (i64.store align=2 (i32.const 0) (i64.const 1)))`,
+			expect: []byte{0x41, 0x00, 0x42, 0x01, 0x37, 0x01, 0x00},
+		},
+		{
+			name:   "atomic memarg",
+			src:    `(memory 1 1 shared) (func i32.const 0 i64.const 1 i64.atomic.rmw32.add_u drop atomic.fence)`,
+			expect: []byte{0x41, 0x00, 0x42, 0x01, 0xFE, 0x24, 0x02, 0x00, 0x1A, 0xFE, 0x03, 0x00},
+		},
+		{
+			name:   "typed select",
+			src:    `(func (select (result i64) (i64.const 1) (i64.const 2) (i32.const 0)) drop)`,
+			expect: []byte{0x42, 0x01, 0x42, 0x02, 0x41, 0x00, 0x1C, 0x01, 0x7E, 0x1A},
+		},
+		{
+			name:   "labels by name",
+			src:    `(func block $out loop $in br $out br $in end $in end $out)`,
+			expect: []byte{0x02, 0x40, 0x03, 0x40, 0x0C, 0x01, 0x0C, 0x00, 0x0B, 0x0B},
+		},
+		{
+			name:   "multi-value block gets a type",
+			src:    `(func i32.const 1 (block (param i32) (result i32 i32) (i32.const 2)) drop drop)`,
+			expect: []byte{0x41, 0x01, 0x02, 0x01, 0x41, 0x02, 0x0B, 0x1A, 0x1A},
+		},
+		{
+			name:   "bulk memory",
+			src:    `(memory 1) (data $d "abc") (func (memory.init $d (i32.const 0) (i32.const 0) (i32.const 3)) data.drop 0 (memory.copy (i32.const 0) (i32.const 1) (i32.const 2)))`,
+			expect: []byte{0x41, 0x00, 0x41, 0x00, 0x41, 0x03, 0xFC, 0x08, 0x00, 0x00, 0xFC, 0x09, 0x00, 0x41, 0x00, 0x41, 0x01, 0x41, 0x02, 0xFC, 0x0A, 0x00, 0x00},
+		},
+		{
+			name:   "tables",
+			src:    `(table $t 1 externref) (elem $e func $f) (func $f (table.init $t $e (i32.const 0) (i32.const 0) (i32.const 1)) elem.drop $e (drop (ref.is_null (ref.null extern))) (drop (ref.func $f)))`,
+			expect: []byte{0x41, 0x00, 0x41, 0x00, 0x41, 0x01, 0xFC, 0x0C, 0x00, 0x00, 0xFC, 0x0D, 0x00, 0xD0, 0x6F, 0xD1, 0x1A, 0xD2, 0x00, 0x1A},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, watCode(t, tc.src))
+		})
+	}
+}
+
+func TestParseWAT_Fields(t *testing.T) {
+	m, err := wasmvm.ParseWAT(`
+		(module $fields
+		  (import "env" "f" (func $f (param i32)))
+		  (func $g (import "env" "g") (result i32))
+		  (global $gi (import "env" "g") (mut f64))
+		  (memory (export "mem") (data "hello" "\n\u{263A}\00"))
+		  (table (export "tab") funcref (elem $f $h))
+		  (global $x (export "x") f32 (f32.const 0.5))
+		  (func $h (call $f (call $g)))
+		  (elem declare func $h)
+		  (elem (table 0) (offset (i32.const 1)) funcref (item ref.func $h) (ref.null func))
+		  (data (memory 0) (offset (i32.const 64)) "!")
+		  (start $h))`)
+	require.NoError(t, err)
+
+	require.Len(t, m.Imports, 3)
+	assert.Equal(t, wasmvm.Import{Module: "env", Name: "g", Kind: wasmvm.ExternGlobal, Global: wasmvm.GlobalType{ValType: wasmvm.TYPE_F64, Mutable: true}}, m.Imports[2])
+	assert.Equal(t, []wasmvm.FuncType{
+		{Params: []wasmvm.ValueStackEntryType{wasmvm.TYPE_I32}},
+		{Results: []wasmvm.ValueStackEntryType{wasmvm.TYPE_I32}},
+		{},
+	}, m.Types)
+	assert.Equal(t, []wasmvm.Export{
+		{Name: "mem", Kind: wasmvm.ExternMemory, Index: 0},
+		{Name: "tab", Kind: wasmvm.ExternTable, Index: 0},
+		{Name: "x", Kind: wasmvm.ExternGlobal, Index: 1},
+	}, m.Exports)
+	assert.Equal(t, uint64(1), *m.Memories[0].Limits.Max)
+	assert.Equal(t, []byte("hello\n\xE2\x98\xBA\x00"), m.Data[0].Init)
+	assert.Equal(t, []byte{wasmvm.OP_CONST_I32, 0xC0, 0x00, wasmvm.OP_END}, m.Data[1].Offset)
+	assert.Equal(t, uint64(2), m.Tables[0].Limits.Min)
+	require.Len(t, m.Elements, 3)
+	assert.Equal(t, []uint32{0, 2}, m.Elements[0].Funcs)
+	assert.Equal(t, wasmvm.SegmentDeclarative, m.Elements[1].Mode)
+	assert.Equal(t, [][]byte{{0xD2, 0x02, wasmvm.OP_END}, {0xD0, 0x70, wasmvm.OP_END}}, m.Elements[2].Exprs)
+	assert.Equal(t, uint32(2), *m.Start)
+	assert.Equal(t, []byte{0x10, 0x01, 0x10, 0x00, wasmvm.OP_END}, m.Code[0].Code)
+}
+
+func TestParseWAT_Run(t *testing.T) {
+	m, err := wasmvm.ParseWAT(`
+		(module
+		  (memory 1)
+		  (data (i32.const 16) "\01\02\03\04")
+		  (func $fac (export "fac") (param $n i64) (result i64)
+		    (if (result i64) (i64.eqz (local.get $n))
+		      (then (i64.const 1))
+		      (else (i64.mul (local.get $n) (call $fac (i64.sub (local.get $n) (i64.const 1)))))))
+		  (func (export "peek") (result i32)
+		    (i32.load offset=12 align=1 (i32.const 4)))
+		  (func (export "half") (param f64) (result f64)
+		    (f64.mul (local.get 0) (f64.const 0x1p-1))))`)
+	require.NoError(t, err)
+	inst, err := wasmvm.Instantiate(m, wasmvm.NewLinker(), nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	r, err := inst.ExportedFunction("fac").Call(ctx, 20)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2432902008176640000), r[0])
+	r, err = inst.ExportedFunction("peek").Call(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x04030201), r[0])
+	r, err = inst.ExportedFunction("half").Call(ctx, math.Float64bits(5))
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, math.Float64frombits(r[0]))
+}
+
+func TestParseWAT_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		expect wasmvm.WATErrorType
+		line   int
+		col    int
+	}{
+		{name: "unknown instruction", src: "(func\n  i32.frob)", expect: wasmvm.WATUnknownInstruction, line: 2, col: 3},
+		{name: "undefined function", src: "(func call $nope)", expect: wasmvm.WATUndefinedName, line: 1, col: 12},
+		{name: "undefined label", src: "(func block br $l end)", expect: wasmvm.WATUndefinedName, line: 1, col: 16},
+		{name: "undefined local", src: "(func (param i32) local.get 1 drop)", expect: wasmvm.WATUndefinedName, line: 1, col: 29},
+		{name: "duplicate", src: "(func $a) (func $a)", expect: wasmvm.WATDuplicateName, line: 1, col: 11},
+		{name: "unclosed", src: "(module\n (func)", expect: wasmvm.WATSyntax, line: 1, col: 1},
+		{name: "stray paren", src: "(func))", expect: wasmvm.WATSyntax, line: 1, col: 7},
+		{name: "i32 out of range", src: "(func i32.const 4294967296 drop)", expect: wasmvm.WATBadNumber, line: 1, col: 17},
+		{name: "nan without payload", src: "(func f32.const nan:0x0 drop)", expect: wasmvm.WATBadNumber, line: 1, col: 17},
+		{name: "float overflow", src: "(func f32.const 0x1p128 drop)", expect: wasmvm.WATBadNumber, line: 1, col: 17},
+		{name: "type mismatch", src: "(type $t (func)) (func (type $t) (param i32))", expect: wasmvm.WATTypeMismatch, line: 1, col: 24},
+		{name: "import after definition", src: "(func) (import \"a\" \"b\" (func))", expect: wasmvm.WATSyntax, line: 1, col: 24},
+		{name: "mismatched end label", src: "(func block $a end $b)", expect: wasmvm.WATSyntax, line: 1, col: 20},
+		{name: "unterminated comment", src: "(; (; ;)", expect: wasmvm.WATSyntax, line: 1, col: 1},
+		{name: "unterminated string", src: "(data \"abc", expect: wasmvm.WATSyntax, line: 1, col: 11},
+		// Inputs that used to panic
+		{name: "empty list", src: "()", expect: wasmvm.WATSyntax, line: 1, col: 1},
+		{name: "memory without limits", src: "(module (memory))", expect: wasmvm.WATSyntax, line: 1, col: 9},
+		{name: "const without operand", src: "(module (func (i32.const)))", expect: wasmvm.WATSyntax, line: 1, col: 15},
+		{name: "if condition not folded", src: "(func (if \"\"))", expect: wasmvm.WATSyntax, line: 1, col: 11},
+		{name: "short hex escape", src: "(data \"\\0", expect: wasmvm.WATSyntax, line: 1, col: 8},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := wasmvm.ParseWAT(tc.src)
+			var we *wasmvm.WATError
+			require.ErrorAs(t, err, &we)
+			assert.Equal(t, tc.expect, we.Type, we.Error())
+			assert.Equal(t, tc.line, we.Line, we.Error())
+			assert.Equal(t, tc.col, we.Column, we.Error())
+		})
+	}
+}